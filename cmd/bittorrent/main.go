@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/rpc"
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+	"github.com/mt/bittorrent-impl/internal/tracker"
+	"github.com/mt/bittorrent-impl/internal/webui"
+)
+
+var version = "dev"
+
+// ProgressInterval is how often download progress is printed
+const ProgressInterval = 1 * time.Second
+
+// peerList collects repeated --peer flags
+type peerList []string
+
+func (p *peerList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *peerList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+type options struct {
+	torrentPath  string
+	outputDir    string
+	verbose      bool
+	info         bool
+	announceOnly bool
+	strategy     string
+	port         uint
+	peers        peerList
+	rpcAddr      string
+	rpcToken     string
+	webAddr      string
+}
+
+func parseFlags() options {
+	var opts options
+
+	flag.StringVar(&opts.torrentPath, "t", "", "path or URL of the .torrent file (required)")
+	flag.StringVar(&opts.torrentPath, "torrent", "", "path or URL of the .torrent file (required)")
+	flag.StringVar(&opts.outputDir, "o", ".", "output directory")
+	flag.StringVar(&opts.outputDir, "output", ".", "output directory")
+	flag.BoolVar(&opts.verbose, "v", false, "enable verbose logging")
+	flag.BoolVar(&opts.verbose, "verbose", false, "enable verbose logging")
+	flag.BoolVar(&opts.info, "info", false, "display torrent information and exit")
+	flag.BoolVar(&opts.announceOnly, "announce-only", false, "test tracker connectivity only")
+	flag.StringVar(&opts.strategy, "strategy", "smart", "piece selection strategy ("+strings.Join(piece.StrategyNames(), ", ")+")")
+	flag.UintVar(&opts.port, "port", session.DefaultListenPort, "port to listen on for incoming peers (0 picks one)")
+	flag.Var(&opts.peers, "peer", "connect to this peer (host:port); may be repeated")
+	flag.StringVar(&opts.rpcAddr, "rpc", "", "serve the JSON-RPC control API on this address (host:port)")
+	flag.StringVar(&opts.rpcToken, "rpc-token", "", "bearer token required by the control API")
+	flag.StringVar(&opts.webAddr, "web", "", "serve the web UI on this address (host:port)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "bittorrent %s\n\nUsage: bittorrent -t <torrent> [options]\n\n", version)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if opts.torrentPath == "" && flag.NArg() > 0 {
+		opts.torrentPath = flag.Arg(0)
+	}
+	return opts
+}
+
+func main() {
+	opts := parseFlags()
+	if opts.torrentPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if opts.port > 65535 {
+		log.Fatalf("Invalid port %d", opts.port)
+	}
+	if !opts.verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	config := session.DefaultConfig()
+	config.DownloadDir = opts.outputDir
+	config.ListenPort = uint16(opts.port)
+	config.Strategy = opts.strategy
+
+	s, err := session.New(config)
+	if err != nil {
+		fatalf("Failed to create session: %v", err)
+	}
+	defer s.Close()
+
+	h, err := addTorrent(ctx, s, opts.torrentPath)
+	if err != nil {
+		fatalf("Failed to load torrent: %v", err)
+	}
+
+	if opts.info {
+		fmt.Print(h.Torrent().String())
+		return
+	}
+	if opts.announceOnly {
+		announceOnly(ctx, s, h.Torrent())
+		return
+	}
+
+	for _, addr := range opts.peers {
+		if err := h.AddPeer(addr); err != nil {
+			fatalf("Failed to add peer: %v", err)
+		}
+	}
+
+	if err := s.Listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not accepting incoming peers: %v\n", err)
+	}
+	if opts.rpcAddr != "" {
+		serve("Control API", opts.rpcAddr, rpc.NewServer(s, opts.rpcToken))
+	}
+	if opts.webAddr != "" {
+		serve("Web UI", opts.webAddr, webui.NewServer(s))
+	}
+	if err := h.Start(); err != nil {
+		fatalf("Failed to start download: %v", err)
+	}
+
+	fmt.Printf("Downloading %s to %s\n", h.Name(), opts.outputDir)
+	if waitForDownload(ctx, s, h) {
+		fmt.Println("\nDownload complete")
+	} else {
+		fmt.Println("\nInterrupted, stopping")
+	}
+}
+
+// serve runs an HTTP handler in the background
+func serve(name, addr string, handler http.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf("Failed to start %s: %v", name, err)
+	}
+	fmt.Printf("%s listening on %s\n", name, listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			fmt.Fprintf(os.Stderr, "%s stopped: %v\n", name, err)
+		}
+	}()
+}
+
+// addTorrent adds a torrent from a file path or an http(s) URL
+func addTorrent(ctx context.Context, s *session.Session, path string) (*session.Handle, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return s.AddTorrentURL(ctx, path)
+	}
+	return s.AddTorrentFile(path)
+}
+
+// waitForDownload prints progress until the torrent completes or ctx is
+// cancelled, and reports whether it completed
+func waitForDownload(ctx context.Context, s *session.Session, h *session.Handle) bool {
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		progress := h.Progress()
+		stats := s.Stats()
+		fmt.Printf("\r%6.2f%%  peers: %d", progress, stats.ActivePeers)
+		if progress >= 100 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// announceOnly sends a single announce to every tracker and prints the
+// result
+func announceOnly(ctx context.Context, s *session.Session, t *torrent.Torrent) {
+	urls := t.GetAnnounceURLs()
+	if len(urls) == 0 {
+		fmt.Println("Torrent has no trackers")
+		return
+	}
+
+	client := tracker.NewClient()
+	params := tracker.AnnounceParams{
+		InfoHash: t.InfoHash,
+		PeerID:   s.PeerID(),
+		Port:     s.Config().ListenPort,
+		Left:     t.TotalLength(),
+		Event:    "started",
+		Compact:  true,
+		NumWant:  s.Config().NumWant,
+	}
+
+	for _, url := range urls {
+		resp, err := client.AnnounceContext(ctx, url, params)
+		if err != nil {
+			fmt.Printf("%s: %v\n", url, err)
+			continue
+		}
+		fmt.Printf("%s: %d peers, %d seeders, %d leechers, interval %ds\n",
+			url, len(resp.Peers), resp.Complete, resp.Incomplete, resp.Interval)
+
+		// Take ourselves back out of the swarm
+		stopped := params
+		stopped.Event = "stopped"
+		stopped.NumWant = 0
+		client.AnnounceContext(ctx, url, stopped)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
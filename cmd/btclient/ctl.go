@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mt/bittorrent-impl/internal/rpc"
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+// ctlCommand is a subcommand of ctl
+type ctlCommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, c *rpc.Client, args []string) error
+}
+
+var ctlCommands = []ctlCommand{
+	{"add", "[-paused] [-label l] [-save-dir d] [-seed-only] <torrent file or URL>...", "add torrents to the daemon", ctlAdd},
+	{"list", "", "list torrents", ctlList},
+	{"start", "<torrent>...", "start torrents", ctlAction("torrent.start")},
+	{"pause", "<torrent>...", "pause torrents", ctlAction("torrent.pause")},
+	{"resume", "<torrent>...", "resume paused torrents", ctlAction("torrent.resume")},
+	{"stop", "<torrent>...", "stop torrents and close their files", ctlAction("torrent.stop")},
+	{"rm", "<torrent>...", "remove torrents, keeping their data", ctlRemove},
+	{"stats", "", "show session totals", ctlStats},
+	{"altspeed", "on|off", "switch to the alternate rate limits or back", ctlAltSpeed},
+	{"label", "<label> <torrent>...", `label torrents ("" takes their label away)`, ctlLabel},
+	{"labels", "", "list labels", ctlLabels},
+	{"mklabel", "[options] <label>", "create or change a label", ctlSetLabel},
+	{"rmlabel", "<label>...", "remove labels from the daemon and its torrents", ctlRemoveLabel},
+}
+
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	addr := fs.String("rpc", rpc.DefaultAddr, "address of the daemon's control API")
+	socket := fs.String("socket", "", "unix socket of the daemon's control API, used instead of -rpc")
+	token := fs.String("token", "", "bearer token for the control API")
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: btclient ctl [options] <command> [args]\n\nCommands:\n")
+		for _, cmd := range ctlCommands {
+			fmt.Fprintf(out, "  %-7s %-46s %s\n", cmd.name, cmd.args, cmd.summary)
+		}
+		fmt.Fprintf(out, "\nA torrent is named by its info hash, a unique prefix of it, or its name.\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var client *rpc.Client
+	if *socket != "" {
+		client = rpc.NewUnixClient(*socket, *token)
+	} else {
+		client = rpc.NewClient("http://"+*addr+"/", *token)
+	}
+
+	name := fs.Arg(0)
+	for _, cmd := range ctlCommands {
+		if cmd.name != name {
+			continue
+		}
+		if err := cmd.run(context.Background(), client, fs.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "btclient ctl %s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "btclient ctl: unknown command %q\n\n", name)
+	fs.Usage()
+	return 2
+}
+
+func ctlAdd(ctx context.Context, c *rpc.Client, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	paused := fs.Bool("paused", false, "add without starting")
+	label := fs.String("label", "", "label to give the torrents, which may choose where they are saved")
+	saveDir := fs.String("save-dir", "", "directory on the daemon's host to save the torrents in")
+	seedOnly := fs.Bool("seed-only", false, "seed data already in the save directory without writing to it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no torrents given")
+	}
+
+	for _, path := range fs.Args() {
+		params := map[string]interface{}{"start": !*paused, "label": *label, "saveDir": *saveDir, "seedOnly": *seedOnly}
+		if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+			params["url"] = path
+		} else {
+			// Send the file itself, as the daemon may run elsewhere
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			params["metainfo"] = data
+		}
+
+		var status session.Status
+		if err := c.Call(ctx, "torrent.add", params, &status); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("Added %s (%s)\n", status.Name, status.InfoHash)
+	}
+	return nil
+}
+
+func ctlList(ctx context.Context, c *rpc.Client, args []string) error {
+	var torrents []session.Status
+	if err := c.Call(ctx, "torrent.list", nil, &torrents); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tNAME\tLABEL\tSTATE\tDONE\tSIZE\tDOWN\tUP\tPEERS\tETA")
+	for _, t := range torrents {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f%%\t%s\t%s\t%s\t%d\t%s\n",
+			t.InfoHash[:8], t.Name, t.Label, t.State, t.Progress, formatBytes(float64(t.Size)),
+			formatRate(t.DownloadRate), formatRate(t.UploadRate), t.Peers, formatETA(t.ETA))
+	}
+	return w.Flush()
+}
+
+// ctlAction returns a command calling method on each torrent named
+func ctlAction(method string) func(ctx context.Context, c *rpc.Client, args []string) error {
+	return func(ctx context.Context, c *rpc.Client, args []string) error {
+		return forEachTorrent(ctx, c, args, func(infoHash string) error {
+			var status session.Status
+			if err := c.Call(ctx, method, map[string]string{"infoHash": infoHash}, &status); err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s\n", status.Name, status.State)
+			return nil
+		})
+	}
+}
+
+func ctlRemove(ctx context.Context, c *rpc.Client, args []string) error {
+	return forEachTorrent(ctx, c, args, func(infoHash string) error {
+		if err := c.Call(ctx, "torrent.remove", map[string]string{"infoHash": infoHash}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", infoHash)
+		return nil
+	})
+}
+
+func ctlStats(ctx context.Context, c *rpc.Client, args []string) error {
+	var stats rpc.SessionStats
+	if err := c.Call(ctx, "session.stats", nil, &stats); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Torrents:\t%d (%d running)\n", stats.Torrents, stats.RunningTorrents)
+	fmt.Fprintf(w, "Peers:\t%d\n", stats.ActivePeers)
+	fmt.Fprintf(w, "Download:\t%s (%s total)\n", formatRate(stats.DownloadRate), formatBytes(float64(stats.Downloaded)))
+	fmt.Fprintf(w, "Upload:\t%s (%s total)\n", formatRate(stats.UploadRate), formatBytes(float64(stats.Uploaded)))
+	if stats.AltSpeed {
+		fmt.Fprintf(w, "Limits:\talternate\n")
+	}
+	if stats.ListenPort != 0 {
+		fmt.Fprintf(w, "Listening:\tport %d\n", stats.ListenPort)
+	}
+	return w.Flush()
+}
+
+func ctlAltSpeed(ctx context.Context, c *rpc.Client, args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return errors.New("expected on or off")
+	}
+	params := map[string]bool{"enabled": args[0] == "on"}
+	if err := c.Call(ctx, "session.setAltSpeed", params, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Alternate speed %s\n", args[0])
+	return nil
+}
+
+func ctlLabel(ctx context.Context, c *rpc.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no label given")
+	}
+	label := args[0]
+	return forEachTorrent(ctx, c, args[1:], func(infoHash string) error {
+		var status session.Status
+		params := map[string]string{"infoHash": infoHash, "label": label}
+		if err := c.Call(ctx, "torrent.setLabel", params, &status); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %q\n", status.Name, status.Label)
+		return nil
+	})
+}
+
+func ctlLabels(ctx context.Context, c *rpc.Client, args []string) error {
+	var labels []session.Label
+	if err := c.Call(ctx, "label.list", nil, &labels); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSAVE DIR\tDOWN LIMIT\tUP LIMIT\tSEED RATIO\tSEED TIME")
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%g\t%s\n", l.Name, l.SaveDir,
+			formatLimit(l.DownloadRateLimit), formatLimit(l.UploadRateLimit), l.SeedRatio, l.SeedTime)
+	}
+	return w.Flush()
+}
+
+func ctlSetLabel(ctx context.Context, c *rpc.Client, args []string) error {
+	fs := flag.NewFlagSet("mklabel", flag.ContinueOnError)
+	saveDir := fs.String("save-dir", "", "directory to save torrents added with the label in")
+	downLimit := fs.Int64("down-limit", 0, "download limit in KiB/s shared by the label's torrents (0 for none)")
+	upLimit := fs.Int64("up-limit", 0, "upload limit in KiB/s shared by the label's torrents (0 for none)")
+	seedRatio := fs.Float64("seed-ratio", 0, "stop seeding at this upload ratio (0 for the daemon's)")
+	seedTime := fs.Duration("seed-time", 0, "stop seeding after this long (0 for the daemon's)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected one label name")
+	}
+
+	label := session.Label{
+		Name:              fs.Arg(0),
+		SaveDir:           *saveDir,
+		DownloadRateLimit: *downLimit * 1024,
+		UploadRateLimit:   *upLimit * 1024,
+		SeedRatio:         *seedRatio,
+		SeedTime:          *seedTime,
+	}
+	if err := c.Call(ctx, "label.set", label, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Set label %s\n", label.Name)
+	return nil
+}
+
+func ctlRemoveLabel(ctx context.Context, c *rpc.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no labels given")
+	}
+	for _, name := range args {
+		if err := c.Call(ctx, "label.remove", map[string]string{"name": name}, nil); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Printf("Removed label %s\n", name)
+	}
+	return nil
+}
+
+// formatLimit formats a rate limit in bytes per second, 0 meaning none
+func formatLimit(bytesPerSecond int64) string {
+	if bytesPerSecond == 0 {
+		return "none"
+	}
+	return formatRate(float64(bytesPerSecond))
+}
+
+// forEachTorrent resolves each name in args to an info hash and calls fn
+// with it
+func forEachTorrent(ctx context.Context, c *rpc.Client, args []string, fn func(infoHash string) error) error {
+	if len(args) == 0 {
+		return errors.New("no torrents given")
+	}
+
+	var torrents []session.Status
+	for _, arg := range args {
+		if _, err := hex.DecodeString(arg); err != nil || len(arg) != 40 {
+			// Only list the torrents when a name or prefix needs resolving
+			if torrents == nil {
+				if err := c.Call(ctx, "torrent.list", nil, &torrents); err != nil {
+					return err
+				}
+			}
+			infoHash, err := resolveTorrent(torrents, arg)
+			if err != nil {
+				return err
+			}
+			arg = infoHash
+		}
+		if err := fn(strings.ToLower(arg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTorrent finds the info hash of the torrent with the given name or
+// info hash prefix
+func resolveTorrent(torrents []session.Status, name string) (string, error) {
+	var matches []string
+	for _, t := range torrents {
+		if t.Name == name || strings.HasPrefix(t.InfoHash, strings.ToLower(name)) {
+			matches = append(matches, t.InfoHash)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no torrent matches %q", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %d torrents", name, len(matches))
+	}
+}
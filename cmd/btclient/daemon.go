@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/rpc"
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/stream"
+	"github.com/mt/bittorrent-impl/internal/webui"
+)
+
+// ShutdownTimeout bounds how long the daemon waits for API calls in
+// flight when it stops
+const ShutdownTimeout = 5 * time.Second
+
+// daemonOptions are the flags of the daemon command
+type daemonOptions struct {
+	sessionOptions
+	rpcAddr    string
+	socket     string
+	token      string
+	webAddr    string
+	streamAddr string
+}
+
+func parseDaemonFlags(args []string) (daemonOptions, []string, error) {
+	var opts daemonOptions
+
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	opts.register(fs)
+	fs.StringVar(&opts.rpcAddr, "rpc", rpc.DefaultAddr, "serve the control API on this address (empty to disable)")
+	fs.StringVar(&opts.socket, "socket", "", "also serve the control API on this unix socket")
+	fs.StringVar(&opts.token, "token", "", "bearer token required by the control API")
+	fs.StringVar(&opts.webAddr, "web", "", "serve the web UI on this address")
+	fs.StringVar(&opts.streamAddr, "stream", "", "stream torrent files over HTTP on this address")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: btclient daemon [options] [torrent file or URL...]\n\n"+
+			"Torrents the daemon had when it last stopped are restored from -state-dir.\n\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return opts, nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return opts, nil, err
+	}
+	if opts.rpcAddr == "" && opts.socket == "" {
+		return opts, nil, errors.New("one of -rpc and -socket is required")
+	}
+	return opts, fs.Args(), nil
+}
+
+func runDaemon(args []string) int {
+	opts, torrents, err := parseDaemonFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "btclient daemon: %v\n", err)
+		return 2
+	}
+	if !opts.verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	config := opts.config()
+	config.PersistTorrents = true
+	s, err := session.New(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create session: %v\n", err)
+		return 1
+	}
+	defer s.Close()
+	defer opts.startHooks(s).Close()
+
+	if err := s.Listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not accepting incoming peers: %v\n", err)
+	}
+
+	restored, err := s.Restore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to restore torrents: %v\n", err)
+	} else if len(restored) > 0 {
+		fmt.Printf("Restored %d torrent(s)\n", len(restored))
+	}
+
+	for _, path := range torrents {
+		h, err := addTorrent(ctx, s, path, session.AddOptions{})
+		if errors.Is(err, session.ErrDuplicateTorrent) {
+			continue
+		}
+		if err == nil {
+			err = h.Start()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add %s: %v\n", path, err)
+		}
+	}
+
+	api := rpc.NewServer(s, opts.token)
+	var servers []*http.Server
+	start := func(name, network, addr string, handler http.Handler) error {
+		listener, err := listen(network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to start %s: %w", name, err)
+		}
+		server := &http.Server{Handler: handler}
+		servers = append(servers, server)
+		fmt.Printf("%s listening on %s\n", name, listener.Addr())
+
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "%s stopped: %v\n", name, err)
+			}
+		}()
+		return nil
+	}
+
+	if opts.rpcAddr != "" {
+		err = start("Control API", "tcp", opts.rpcAddr, api)
+	}
+	if err == nil && opts.socket != "" {
+		err = start("Control API", "unix", opts.socket, api)
+	}
+	if err == nil && opts.webAddr != "" {
+		err = start("Web UI", "tcp", opts.webAddr, webui.NewServer(s))
+	}
+	if err == nil && opts.streamAddr != "" {
+		err = start("Streaming server", "tcp", opts.streamAddr, stream.NewServer(s))
+	}
+
+	if err == nil {
+		<-ctx.Done()
+		// A second signal exits without waiting for the shutdown
+		stop()
+		fmt.Println("Shutting down")
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(shutdownCtx)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// listen opens a listener. A stale unix socket left by a daemon that did
+// not exit cleanly is replaced, but a socket still in use is not. Unix
+// sockets are only accessible to the daemon's user.
+func listen(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", addr); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another daemon", addr)
+		}
+		os.Remove(addr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
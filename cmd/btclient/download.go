@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// peerList collects repeated -peer flags
+type peerList []string
+
+func (p *peerList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *peerList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// downloadOptions are the flags of the download command
+type downloadOptions struct {
+	sessionOptions
+	seed     bool
+	seedOnly bool
+	peers    peerList
+}
+
+func parseDownloadFlags(args []string) (downloadOptions, string, error) {
+	var opts downloadOptions
+
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	opts.register(fs)
+	fs.BoolVar(&opts.seed, "seed", false, "keep seeding after the download completes (implied by -seed-ratio and -seed-time)")
+	fs.BoolVar(&opts.seedOnly, "seed-only", false, "seed data already in -o without writing to it; fails unless it is complete")
+	fs.Var(&opts.peers, "peer", "connect to this peer (host:port); may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: btclient download [options] <torrent file or URL>\n\n")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return opts, "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return opts, "", errors.New("expected one torrent file or URL")
+	}
+	if err := opts.validate(); err != nil {
+		return opts, "", err
+	}
+	if opts.seedRatio > 0 || opts.seedTime > 0 || opts.seedOnly {
+		opts.seed = true
+	}
+	return opts, fs.Arg(0), nil
+}
+
+func runDownload(args []string) int {
+	opts, path, err := parseDownloadFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "btclient download: %v\n", err)
+		return 2
+	}
+	if !opts.verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := session.New(opts.config())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create session: %v\n", err)
+		return 1
+	}
+	defer s.Close()
+	defer opts.startHooks(s).Close()
+
+	h, err := addTorrent(ctx, s, path, session.AddOptions{SeedOnly: opts.seedOnly})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load torrent: %v\n", err)
+		return 1
+	}
+	for _, addr := range opts.peers {
+		if err := h.AddPeer(addr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add peer: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := s.Listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Not accepting incoming peers: %v\n", err)
+	}
+	if err := h.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start download: %v\n", err)
+		return 1
+	}
+
+	if opts.seedOnly {
+		fmt.Printf("Seeding %s from %s\n", h.Name(), opts.outputDir)
+	} else {
+		fmt.Printf("Downloading %s to %s\n", h.Name(), opts.outputDir)
+	}
+	display := newProgressDisplay(os.Stdout)
+	switch watch(ctx, h, display, opts.seed) {
+	case watchComplete:
+		display.finish("Download complete")
+	case watchSeeded:
+		display.finish("Seeding goal reached")
+	case watchFailed:
+		display.finish(fmt.Sprintf("Failed: %v", h.Err()))
+		return 1
+	case watchInterrupted:
+		// A second signal exits without waiting for the shutdown
+		stop()
+		display.finish("Interrupted, stopping")
+		return 130
+	}
+	return 0
+}
+
+// addTorrent adds a torrent from a file path or an http(s) URL
+func addTorrent(ctx context.Context, s *session.Session, path string, opts session.AddOptions) (*session.Handle, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return s.AddTorrentURLWithOptions(ctx, path, opts)
+	}
+	t, err := torrent.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddWithOptions(t, opts)
+}
+
+// watchResult is why watch returned
+type watchResult int
+
+const (
+	watchComplete watchResult = iota
+	watchSeeded
+	watchFailed
+	watchInterrupted
+)
+
+// watch shows progress until the download completes, or with seed until
+// the session stops seeding the torrent, or until ctx is cancelled
+func watch(ctx context.Context, h *session.Handle, display *progressDisplay, seed bool) watchResult {
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		status := h.Status()
+		display.update(status)
+
+		switch state := h.State(); {
+		case state == session.StateError:
+			return watchFailed
+		case state == session.StateSeeding && !seed:
+			return watchComplete
+		case state == session.StateStopped:
+			return watchSeeded
+		}
+
+		select {
+		case <-ctx.Done():
+			return watchInterrupted
+		case <-ticker.C:
+		}
+	}
+}
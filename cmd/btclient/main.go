@@ -0,0 +1,57 @@
+// Command btclient is a BitTorrent client. Each subcommand has its own
+// flags; run "btclient <command> -h" for details.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var version = "dev"
+
+// command is a btclient subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"download", "download a torrent, optionally seeding it afterwards", runDownload},
+	{"daemon", "run a session in the background, controlled over the API", runDaemon},
+	{"ctl", "control a running daemon", runCtl},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "btclient %s\n\nUsage: btclient <command> [options]\n\nCommands:\n", version)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	switch name {
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	case "version", "-version", "--version":
+		fmt.Println(version)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "btclient: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
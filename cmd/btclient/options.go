@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/hooks"
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+// sessionOptions are the flags of commands that run a session
+type sessionOptions struct {
+	outputDir string
+	port      string
+	reusePort bool
+	strategy  string
+	downLimit int64 // KiB/s
+	upLimit   int64 // KiB/s
+	altDown   int64 // KiB/s
+	altUp     int64 // KiB/s
+	altWhen   string
+	seedRatio float64
+	seedTime  time.Duration
+	peerIdle  time.Duration
+	stateDir  string
+	verbose   bool
+
+	bootstrap  string
+	bootPieces int
+	endGame    int
+	endGameAny int
+
+	suppressHave bool
+	bitfield     string
+	uploadSlots  int
+	announceJobs int
+
+	bind           string
+	bindKillSwitch bool
+
+	onComplete string
+	onError    string
+	webhook    string
+}
+
+// register adds the session flags to fs
+func (o *sessionOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.outputDir, "o", ".", "directory to save downloads in")
+	fs.StringVar(&o.port, "port", strconv.Itoa(session.DefaultListenPort), "port to listen on for incoming peers, or a range such as 6881-6999 to pick one from at random (0 picks any)")
+	fs.BoolVar(&o.reusePort, "reuse-port", false, "let other sockets share the listen port (SO_REUSEPORT)")
+	fs.StringVar(&o.strategy, "strategy", "smart", "piece selection strategy ("+strings.Join(piece.StrategyNames(), ", ")+")")
+	fs.StringVar(&o.bootstrap, "bootstrap", "sequential", "how the smart strategy picks the first pieces (sequential, random)")
+	fs.IntVar(&o.bootPieces, "bootstrap-pieces", piece.DefaultBootstrapPieces, "pieces the smart strategy picks that way before going rarest-first")
+	fs.IntVar(&o.endGame, "endgame-pieces", piece.DefaultEndGamePieces, "pieces left when the smart strategy enters end game")
+	fs.IntVar(&o.endGameAny, "endgame-any-pieces", piece.DefaultEndGameAnyPieces, "pieces left when end game takes any piece a peer has rather than the rarest")
+	fs.Int64Var(&o.downLimit, "down-limit", 0, "download limit in KiB/s (0 for none)")
+	fs.Int64Var(&o.upLimit, "up-limit", 0, "upload limit in KiB/s (0 for none)")
+	fs.Int64Var(&o.altDown, "alt-down-limit", 0, "download limit in KiB/s while alternate speed is on (0 for none)")
+	fs.Int64Var(&o.altUp, "alt-up-limit", 0, "upload limit in KiB/s while alternate speed is on (0 for none)")
+	fs.StringVar(&o.altWhen, "alt-schedule", "", `when to turn alternate speed on, e.g. "mon-fri 09:00-17:00"`)
+	fs.Float64Var(&o.seedRatio, "seed-ratio", 0, "stop seeding at this upload ratio (0 for none)")
+	fs.DurationVar(&o.seedTime, "seed-time", 0, "stop seeding after this long (0 for none)")
+	fs.DurationVar(&o.peerIdle, "peer-timeout", peer.IdleTimeout, "disconnect peers that send nothing, not even a keep-alive, for this long")
+	fs.StringVar(&o.stateDir, "state-dir", defaultStateDir(), "directory to keep resume data in (empty for none)")
+	fs.BoolVar(&o.suppressHave, "suppress-have", false, "skip HAVE messages to peers that already have the piece")
+	fs.StringVar(&o.bitfield, "bitfield", "full", "how to announce our pieces to new peers (full, partial, empty)")
+	fs.IntVar(&o.uploadSlots, "upload-slots", peer.AutoUploadSlots, "peers each torrent uploads to at once (0 tunes it to the upload limit)")
+	fs.StringVar(&o.bind, "bind", "", "local IP or interface to listen on and make every connection from")
+	fs.BoolVar(&o.bindKillSwitch, "bind-kill-switch", false, "pause all torrents while the -bind address is gone")
+	fs.IntVar(&o.announceJobs, "announce-concurrency", session.DefaultAnnounceConcurrency, "tracker tiers to announce to at once (1 announces to the first tracker that answers)")
+	fs.BoolVar(&o.verbose, "v", false, "log to stderr")
+	fs.StringVar(&o.onComplete, "on-complete", "", "run this program when a torrent finishes, with BT_* variables describing it")
+	fs.StringVar(&o.onError, "on-error", "", "run this program when a torrent fails")
+	fs.StringVar(&o.webhook, "webhook", "", "POST a JSON event to this URL when a torrent finishes or fails")
+}
+
+// validate checks the flag values
+func (o sessionOptions) validate() error {
+	if _, _, err := parsePortRange(o.port); err != nil {
+		return err
+	}
+	if o.downLimit < 0 || o.upLimit < 0 || o.altDown < 0 || o.altUp < 0 || o.seedRatio < 0 || o.seedTime < 0 || o.peerIdle < 0 || o.uploadSlots < 0 || o.announceJobs < 0 || o.bootPieces < 0 || o.endGame < 0 || o.endGameAny < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if o.altWhen != "" {
+		if _, err := session.ParseSchedule(o.altWhen); err != nil {
+			return err
+		}
+	}
+	if _, err := piece.NewStrategy(o.strategy); err != nil {
+		return err
+	}
+	if _, err := piece.ParseBootstrapMode(o.bootstrap); err != nil {
+		return err
+	}
+	if _, err := peer.ParseBitfieldMode(o.bitfield); err != nil {
+		return err
+	}
+	if o.bindKillSwitch && o.bind == "" {
+		return fmt.Errorf("-bind-kill-switch needs -bind")
+	}
+	return nil
+}
+
+// config builds the session configuration for the options
+func (o sessionOptions) config() session.Config {
+	config := session.DefaultConfig()
+	config.DownloadDir = o.outputDir
+	// validate has checked it parses
+	config.ListenPort, config.ListenPortMax, _ = parsePortRange(o.port)
+	config.ReusePort = o.reusePort
+	config.Strategy = o.strategy
+	config.Bootstrap, _ = piece.ParseBootstrapMode(o.bootstrap)
+	config.BootstrapPieces = o.bootPieces
+	config.EndGamePieces = o.endGame
+	config.EndGameAnyPieces = o.endGameAny
+	config.DownloadRateLimit = o.downLimit * 1024
+	config.UploadRateLimit = o.upLimit * 1024
+	config.AltDownloadRateLimit = o.altDown * 1024
+	config.AltUploadRateLimit = o.altUp * 1024
+	if o.altWhen != "" {
+		// validate has checked it parses
+		config.AltSchedule, _ = session.ParseSchedule(o.altWhen)
+	}
+	config.SeedRatio = o.seedRatio
+	config.SeedTime = o.seedTime
+	config.PeerIdleTimeout = o.peerIdle
+	config.StateDir = o.stateDir
+	config.SuppressHave = o.suppressHave
+	config.BitfieldMode, _ = peer.ParseBitfieldMode(o.bitfield)
+	config.UploadSlots = o.uploadSlots
+	config.AnnounceConcurrency = o.announceJobs
+	config.BindAddress = o.bind
+	config.BindKillSwitch = o.bindKillSwitch
+
+	level := slog.LevelError
+	if o.verbose {
+		level = slog.LevelDebug
+	}
+	config.Logger = logging.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	config.Logger.SetDefaultLevel(level)
+	return config
+}
+
+// parsePortRange parses a port, or a range of ports written first-last
+func parsePortRange(s string) (first, last uint16, err error) {
+	firstStr, lastStr, isRange := strings.Cut(s, "-")
+	first64, err := strconv.ParseUint(firstStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return uint16(first64), 0, nil
+	}
+	last64, err := strconv.ParseUint(lastStr, 10, 16)
+	if err != nil || last64 < first64 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(first64), uint16(last64), nil
+}
+
+// startHooks fires the hooks given by the flags for the session's
+// torrents. The caller closes the runner before the session.
+func (o sessionOptions) startHooks(s *session.Session) *hooks.Runner {
+	return hooks.New(s, hooks.Config{
+		OnComplete: o.onComplete,
+		OnError:    o.onError,
+		Webhook:    o.webhook,
+	})
+}
+
+// defaultStateDir returns btclient's directory under the user's
+// configuration directory, or "" if there is none
+func defaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "btclient")
+}
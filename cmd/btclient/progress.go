@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+const (
+	// ProgressInterval is how often the progress line is redrawn
+	ProgressInterval = 1 * time.Second
+
+	// LogInterval is how often progress is printed when the output is not
+	// a terminal
+	LogInterval = 10 * time.Second
+
+	// barWidth is the number of cells in the progress bar
+	barWidth = 30
+)
+
+// progressDisplay draws a torrent's progress on one line of a terminal, or
+// prints it periodically to any other output
+type progressDisplay struct {
+	w        io.Writer
+	terminal bool
+	drawn    bool
+	last     time.Time
+}
+
+func newProgressDisplay(f *os.File) *progressDisplay {
+	info, err := f.Stat()
+	terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &progressDisplay{w: f, terminal: terminal}
+}
+
+// update shows the latest status
+func (d *progressDisplay) update(status session.Status) {
+	line := formatStatus(status)
+	if d.terminal {
+		// Redraw in place and clear what is left of a longer line
+		fmt.Fprintf(d.w, "\r%s\x1b[K", line)
+		d.drawn = true
+		return
+	}
+
+	if now := time.Now(); now.Sub(d.last) >= LogInterval {
+		fmt.Fprintln(d.w, line)
+		d.last = now
+	}
+}
+
+// finish ends the progress line with a message
+func (d *progressDisplay) finish(message string) {
+	if d.drawn {
+		fmt.Fprintln(d.w)
+	}
+	fmt.Fprintln(d.w, message)
+}
+
+// formatStatus renders a status as a single line
+func formatStatus(status session.Status) string {
+	filled := int(status.Progress / 100 * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled)
+
+	return fmt.Sprintf("%-11s [%s] %6.2f%%  down %s  up %s  peers %d  eta %s",
+		status.State, bar, status.Progress,
+		formatRate(status.DownloadRate), formatRate(status.UploadRate),
+		status.Peers, formatETA(status.ETA))
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// formatRate renders a transfer rate
+func formatRate(bytesPerSecond float64) string {
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+// formatETA renders an ETA in seconds, which is 0 once done or -1 if
+// unknown
+func formatETA(seconds int64) string {
+	switch {
+	case seconds < 0:
+		return "--"
+	case seconds == 0:
+		return "done"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
@@ -1,165 +0,0 @@
-package main
-
-import (
-	"crypto/sha1"
-	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-
-	"github.com/mt/bittorrent-impl/internal/disk"
-	"github.com/mt/bittorrent-impl/internal/piece"
-	"github.com/mt/bittorrent-impl/internal/torrent"
-)
-
-func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <torrent-file>")
-	}
-
-	torrentFile := os.Args[1]
-	
-	fmt.Printf("=== BITTORRENT DOWNLOAD SIMULATION ===\n")
-	fmt.Printf("Torrent file: %s\n\n", torrentFile)
-	
-	// 1. Parse the torrent file
-	fmt.Println("1. Parsing torrent file...")
-	t, err := torrent.ParseFile(torrentFile)
-	if err != nil {
-		log.Fatalf("Failed to parse torrent: %v", err)
-	}
-	
-	fmt.Printf("   ✓ Loaded: %s\n", t.Info.Name)
-	
-	// 2. Set up disk manager
-	fmt.Println("\n2. Setting up download environment...")
-	downloadDir := filepath.Join("downloads", "simulation")
-	diskManager := disk.NewManager(t, downloadDir)
-	
-	err = diskManager.Initialize()
-	if err != nil {
-		log.Fatalf("Failed to initialize disk manager: %v", err)
-	}
-	defer diskManager.Close()
-	
-	// 3. Set up piece manager
-	lastPieceSize := int(t.PieceSize(t.NumPieces() - 1))
-	pieceHashes := make([][20]byte, t.NumPieces())
-	for i := 0; i < t.NumPieces(); i++ {
-		hash, _ := t.PieceHash(i)
-		pieceHashes[i] = hash
-	}
-	
-	pieceManager := piece.NewManager(
-		t.NumPieces(),
-		int(t.Info.PieceLength),
-		lastPieceSize,
-		pieceHashes,
-	)
-	pieceManager.SetDiskManager(diskManager)
-	
-	fmt.Printf("   ✓ Ready to download %d pieces\n", t.NumPieces())
-	
-	// 4. Simulate downloading first piece
-	fmt.Println("\n3. Simulating piece download...")
-	
-	pieceIndex := 0
-	piece := pieceManager.GetPiece(pieceIndex)
-	if piece == nil {
-		log.Fatalf("Could not get piece %d", pieceIndex)
-	}
-	
-	fmt.Printf("   Downloading piece %d (%d bytes)...\n", pieceIndex, piece.Length)
-	
-	// Get blocks for this piece
-	blocks := pieceManager.GetNextBlocks(pieceIndex, 100) // Get all blocks
-	fmt.Printf("   ✓ Piece divided into %d blocks\n", len(blocks))
-	
-	// Simulate downloading each block
-	for i, block := range blocks {
-		fmt.Printf("   Block %d/%d: offset=%d, length=%d\n", 
-			i+1, len(blocks), block.Begin, block.Length)
-		
-		// Create fake block data (normally this would come from a peer)
-		blockData := make([]byte, block.Length)
-		for j := range blockData {
-			blockData[j] = byte((block.Begin + j) % 256)
-		}
-		
-		// Add block to piece manager
-		err = pieceManager.AddBlockData(pieceIndex, block.Begin, blockData)
-		if err != nil {
-			fmt.Printf("   ✗ Failed to add block: %v\n", err)
-			continue
-		}
-		
-		fmt.Printf("   ✓ Block added successfully\n")
-	}
-	
-	// Check if piece is complete
-	if piece.IsComplete() {
-		fmt.Printf("   ✓ Piece %d is complete!\n", pieceIndex)
-		
-		// Get the complete piece data
-		pieceData, err := piece.GetData()
-		if err != nil {
-			fmt.Printf("   ✗ Failed to get piece data: %v\n", err)
-		} else {
-			fmt.Printf("   ✓ Got complete piece data (%d bytes)\n", len(pieceData))
-			
-			// Test manual verification
-			expectedHash, _ := t.PieceHash(pieceIndex)
-			actualHash := sha1.Sum(pieceData)
-			
-			fmt.Printf("   Expected hash: %x\n", expectedHash)
-			fmt.Printf("   Actual hash:   %x\n", actualHash)
-			fmt.Printf("   Hash match: %t\n", expectedHash == actualHash)
-			
-			// The piece manager will automatically verify and store this piece
-			// Let's wait a moment and check the statistics
-			fmt.Println("\n4. Checking download progress...")
-			
-			stats := pieceManager.GetStatistics()
-			fmt.Printf("   Total pieces: %d\n", stats.TotalPieces)
-			fmt.Printf("   Verified pieces: %d\n", stats.VerifiedPieces)
-			fmt.Printf("   Progress: %.2f%%\n", pieceManager.GetProgress())
-			fmt.Printf("   Bytes downloaded: %d\n", stats.BytesDownloaded)
-			
-			if stats.VerifiedPieces > 0 {
-				fmt.Println("   ✓ Piece was successfully verified and stored!")
-				
-				// Test reading the piece back from disk
-				fmt.Println("\n5. Testing disk read...")
-				readData, err := diskManager.ReadPiece(pieceIndex)
-				if err != nil {
-					fmt.Printf("   ✗ Failed to read piece from disk: %v\n", err)
-				} else {
-					fmt.Printf("   ✓ Read %d bytes from disk\n", len(readData))
-					
-					// Test block reading
-					blockData, err := pieceManager.ReadBlockFromDisk(pieceIndex, 0, 1024)
-					if err != nil {
-						fmt.Printf("   ✗ Failed to read block from disk: %v\n", err)
-					} else {
-						fmt.Printf("   ✓ Read 1024-byte block from disk\n")
-						fmt.Printf("   First few bytes: %v\n", blockData[:min(16, len(blockData))])
-					}
-				}
-			} else {
-				fmt.Println("   ⚠ Piece verification failed (expected with fake data)")
-			}
-		}
-	} else {
-		fmt.Printf("   ⚠ Piece %d is not complete\n", pieceIndex)
-	}
-	
-	fmt.Println("\n=== DOWNLOAD SIMULATION COMPLETE ===")
-	fmt.Println("The BitTorrent client successfully demonstrated:")
-	fmt.Println("✓ Torrent parsing")
-	fmt.Println("✓ Disk management and file allocation")
-	fmt.Println("✓ Piece and block management")  
-	fmt.Println("✓ Block data assembly")
-	fmt.Println("✓ SHA-1 hash verification")
-	fmt.Println("✓ Disk I/O operations")
-	fmt.Println("\nReady for real peer connections and data transfer!")
-}
\ No newline at end of file
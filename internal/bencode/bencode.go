@@ -15,9 +15,45 @@ var (
 	ErrUnexpectedEnd  = errors.New("unexpected end of bencode data")
 )
 
+// Marshaler is implemented by types that can encode themselves into a
+// single valid bencode value
+type Marshaler interface {
+	BencodeMarshal() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that can decode a bencode
+// representation of themselves. The input is the complete encoded value.
+type Unmarshaler interface {
+	BencodeUnmarshal([]byte) error
+}
+
+// RawMessage is a raw encoded bencode value. It can be used to delay
+// decoding or to keep the exact original bytes of a value.
+type RawMessage []byte
+
+// BencodeMarshal returns m as the encoding of m
+func (m RawMessage) BencodeMarshal() ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("cannot encode nil RawMessage")
+	}
+	return m, nil
+}
+
+// BencodeUnmarshal sets *m to a copy of data
+func (m *RawMessage) BencodeUnmarshal(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
 type Decoder struct {
 	r   io.Reader
 	buf *bytes.Buffer
+	raw []byte // consumed bytes, recorded while non-nil
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -36,6 +72,14 @@ func (d *Decoder) decode(v reflect.Value) error {
 		v = v.Elem()
 	}
 
+	if u, ok := unmarshalerFor(v); ok {
+		raw, err := d.readRaw()
+		if err != nil {
+			return err
+		}
+		return u.BencodeUnmarshal(raw)
+	}
+
 	b, err := d.readByte()
 	if err != nil {
 		return err
@@ -70,6 +114,8 @@ func (d *Decoder) decodeInt(v reflect.Value) error {
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		v.SetInt(n)
+	case reflect.Bool:
+		v.SetBool(n != 0)
 	case reflect.Interface:
 		v.Set(reflect.ValueOf(n))
 	default:
@@ -95,6 +141,9 @@ func (d *Decoder) decodeString(v reflect.Value) error {
 	if err != nil {
 		return err
 	}
+	if d.raw != nil {
+		d.raw = append(d.raw, data...)
+	}
 
 	switch v.Kind() {
 	case reflect.String:
@@ -199,6 +248,15 @@ func (d *Decoder) decodeDict(v reflect.Value) error {
 			}
 			v.SetMapIndex(reflect.ValueOf(key), elem)
 		} else if v.Kind() == reflect.Struct {
+			// Fields that decode themselves need the raw value, not the
+			// generic form mapToStruct works from
+			if field, ok := structField(v, key); ok && containsUnmarshaler(field.Type(), nil) {
+				if err := d.decode(field); err != nil {
+					return err
+				}
+				continue
+			}
+
 			var val interface{}
 			if err := d.decode(reflect.ValueOf(&val).Elem()); err != nil {
 				return err
@@ -245,6 +303,63 @@ func mapToStruct(m map[string]interface{}, v reflect.Value) error {
 	return nil
 }
 
+// structField returns the settable field of v whose bencode key is key
+func structField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("bencode")
+		if tag == "" {
+			tag = t.Field(i).Name
+		}
+		if tag == key && v.Field(i).CanSet() {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// implementsUnmarshaler reports whether values of t (or pointers to them)
+// implement Unmarshaler
+func implementsUnmarshaler(t reflect.Type) bool {
+	return t.Implements(unmarshalerType) || reflect.PointerTo(t).Implements(unmarshalerType)
+}
+
+// containsUnmarshaler reports whether t implements Unmarshaler or is a
+// container whose elements do
+func containsUnmarshaler(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if implementsUnmarshaler(t) {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	if seen == nil {
+		seen = make(map[reflect.Type]bool)
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		return containsUnmarshaler(t.Elem(), seen)
+	}
+	return false
+}
+
+// unmarshalerFor returns the Unmarshaler for an addressable value, if any
+func unmarshalerFor(v reflect.Value) (Unmarshaler, bool) {
+	if v.Kind() != reflect.Ptr {
+		if !v.CanAddr() {
+			return nil, false
+		}
+		v = v.Addr()
+	}
+	if v.IsNil() || !v.CanInterface() {
+		return nil, false
+	}
+	u, ok := v.Interface().(Unmarshaler)
+	return u, ok
+}
+
 func setFieldValue(field reflect.Value, val interface{}) error {
 	valReflect := reflect.ValueOf(val)
 	
@@ -265,6 +380,11 @@ func setFieldValue(field reflect.Value, val interface{}) error {
 			field.SetInt(i)
 			return nil
 		}
+	case reflect.Bool:
+		if i, ok := val.(int64); ok {
+			field.SetBool(i != 0)
+			return nil
+		}
 	case reflect.Slice:
 		if field.Type().Elem().Kind() == reflect.Uint8 {
 			if s, ok := val.(string); ok {
@@ -286,14 +406,45 @@ func setFieldValue(field reflect.Value, val interface{}) error {
 func (d *Decoder) readByte() (byte, error) {
 	// Check buffer first
 	if d.buf != nil && d.buf.Len() > 0 {
-		return d.buf.ReadByte()
+		c, err := d.buf.ReadByte()
+		d.record(c)
+		return c, err
 	}
 	
 	b := make([]byte, 1)
 	_, err := io.ReadFull(d.r, b)
+	if err == nil {
+		d.record(b[0])
+	}
 	return b[0], err
 }
 
+// record appends a consumed byte to the raw capture, if one is active
+func (d *Decoder) record(b byte) {
+	if d.raw != nil {
+		d.raw = append(d.raw, b)
+	}
+}
+
+// readRaw consumes the next complete value and returns its encoded bytes
+func (d *Decoder) readRaw() ([]byte, error) {
+	outer := d.raw != nil
+	if !outer {
+		d.raw = []byte{}
+	}
+	start := len(d.raw)
+
+	var discard interface{}
+	err := d.decode(reflect.ValueOf(&discard).Elem())
+
+	raw := make([]byte, len(d.raw)-start)
+	copy(raw, d.raw[start:])
+	if !outer {
+		d.raw = nil
+	}
+	return raw, err
+}
+
 func (d *Decoder) peekByte() (byte, error) {
 	b, err := d.readByte()
 	if err != nil {
@@ -309,6 +460,11 @@ func (d *Decoder) unreadByte(b byte) {
 		d.buf = &bytes.Buffer{}
 	}
 	d.buf.WriteByte(b)
+
+	// The byte is no longer consumed
+	if len(d.raw) > 0 {
+		d.raw = d.raw[:len(d.raw)-1]
+	}
 }
 
 func (d *Decoder) readUntil(delim byte) ([]byte, error) {
@@ -340,8 +496,14 @@ func (e *Encoder) Encode(v interface{}) error {
 }
 
 func (e *Encoder) encode(v reflect.Value) error {
-	// Handle pointers and interfaces
-	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+	// Handle marshalers, pointers and interfaces
+	for {
+		if m, ok := marshalerFor(v); ok {
+			return e.encodeMarshaler(m)
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
 		if v.IsNil() {
 			return errors.New("cannot encode nil")
 		}
@@ -351,6 +513,12 @@ func (e *Encoder) encode(v reflect.Value) error {
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return e.encodeInt(v.Int())
+	case reflect.Bool:
+		// Bencode has no booleans; flags such as "private" use 0 and 1
+		if v.Bool() {
+			return e.encodeInt(1)
+		}
+		return e.encodeInt(0)
 	case reflect.String:
 		return e.encodeString(v.String())
 	case reflect.Slice:
@@ -372,6 +540,44 @@ func (e *Encoder) encode(v reflect.Value) error {
 	}
 }
 
+// marshalerFor returns the Marshaler implemented by v or, when v is
+// addressable, by a pointer to it
+func marshalerFor(v reflect.Value) (Marshaler, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(marshalerType) && v.CanInterface() {
+		return v.Interface().(Marshaler), true
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(marshalerType) && v.Addr().CanInterface() {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+func (e *Encoder) encodeMarshaler(m Marshaler) error {
+	data, err := m.BencodeMarshal()
+	if err != nil {
+		return err
+	}
+
+	// Reject output that would corrupt the surrounding document
+	d := NewDecoder(bytes.NewReader(data))
+	var discard interface{}
+	if err := d.Decode(&discard); err != nil {
+		return fmt.Errorf("%w: marshaler returned invalid bencode: %v", ErrInvalidBencode, err)
+	}
+	if _, err := d.readByte(); err != io.EOF {
+		return fmt.Errorf("%w: marshaler returned trailing data", ErrInvalidBencode)
+	}
+
+	_, err = e.w.Write(data)
+	return err
+}
+
 func (e *Encoder) encodeInt(n int64) error {
 	_, err := fmt.Fprintf(e.w, "i%de", n)
 	return err
@@ -2,8 +2,12 @@ package bencode
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDecodeInt(t *testing.T) {
@@ -307,4 +311,216 @@ func TestComplexNesting(t *testing.T) {
 	if !reflect.DeepEqual(input, decoded) {
 		t.Errorf("Roundtrip failed: got %+v, want %+v", decoded, input)
 	}
-}
\ No newline at end of file
+}
+
+// testHash encodes a fixed-size hash as a bencode string
+type testHash [20]byte
+
+func (h testHash) BencodeMarshal() ([]byte, error) {
+	return Encode(h[:])
+}
+
+func (h *testHash) BencodeUnmarshal(data []byte) error {
+	var b []byte
+	if err := Decode(data, &b); err != nil {
+		return err
+	}
+	if len(b) != len(h) {
+		return fmt.Errorf("hash length %d, want %d", len(b), len(h))
+	}
+	copy(h[:], b)
+	return nil
+}
+
+// testTime encodes a timestamp as unix seconds
+type testTime struct {
+	time.Time
+}
+
+func (t testTime) BencodeMarshal() ([]byte, error) {
+	return Encode(t.Unix())
+}
+
+func (t *testTime) BencodeUnmarshal(data []byte) error {
+	var sec int64
+	if err := Decode(data, &sec); err != nil {
+		return err
+	}
+	t.Time = time.Unix(sec, 0).UTC()
+	return nil
+}
+
+// testIP encodes an address in its textual form
+type testIP struct {
+	net.IP
+}
+
+func (ip testIP) BencodeMarshal() ([]byte, error) {
+	return Encode(ip.String())
+}
+
+func (ip *testIP) BencodeUnmarshal(data []byte) error {
+	var s string
+	if err := Decode(data, &s); err != nil {
+		return err
+	}
+	ip.IP = net.ParseIP(s)
+	if ip.IP == nil {
+		return fmt.Errorf("invalid IP %q", s)
+	}
+	return nil
+}
+
+func TestMarshalerRoundTrip(t *testing.T) {
+	type record struct {
+		Hash    testHash `bencode:"hash"`
+		Created testTime `bencode:"created"`
+		Addr    *testIP  `bencode:"addr"`
+		Name    string   `bencode:"name"`
+		Peers   []testIP `bencode:"peers"`
+	}
+
+	input := record{
+		Hash:    testHash{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		Created: testTime{time.Unix(1234567890, 0).UTC()},
+		Addr:    &testIP{net.ParseIP("10.0.0.1")},
+		Name:    "test",
+	}
+
+	encoded, err := Encode(input)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	expected := "d4:addr8:10.0.0.17:createdi1234567890e4:hash20:" + string(input.Hash[:]) + "4:name4:test5:peerslee"
+	if string(encoded) != expected {
+		t.Errorf("Encode() = %q, want %q", encoded, expected)
+	}
+
+	var decoded record
+	if err := Decode(encoded, &decoded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if decoded.Hash != input.Hash {
+		t.Errorf("Hash = %x, want %x", decoded.Hash, input.Hash)
+	}
+	if !decoded.Created.Equal(input.Created.Time) {
+		t.Errorf("Created = %v, want %v", decoded.Created, input.Created)
+	}
+	if decoded.Addr == nil || !decoded.Addr.Equal(input.Addr.IP) {
+		t.Errorf("Addr = %v, want %v", decoded.Addr, input.Addr)
+	}
+	if decoded.Name != input.Name {
+		t.Errorf("Name = %v, want %v", decoded.Name, input.Name)
+	}
+}
+
+func TestUnmarshalerInContainers(t *testing.T) {
+	data := []byte("d5:peersl7:1.2.3.43:badee")
+
+	var decoded struct {
+		Peers []testIP `bencode:"peers"`
+	}
+	if err := Decode(data, &decoded); err == nil {
+		t.Fatal("Decode() should fail on an invalid IP")
+	}
+
+	var byKey map[string]testTime
+	if err := Decode([]byte("d1:ai1e1:bi2ee"), &byKey); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if byKey["b"].Unix() != 2 {
+		t.Errorf("byKey[b] = %v, want unix 2", byKey["b"])
+	}
+
+	var list []testIP
+	if err := Decode([]byte("l7:1.2.3.43:::1e"), &list); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(list) != 2 || !list[1].Equal(net.IPv6loopback) {
+		t.Errorf("Decode() = %v, want [1.2.3.4 ::1]", list)
+	}
+}
+
+// brokenMarshaler returns data that is not a single bencode value
+type brokenMarshaler string
+
+func (b brokenMarshaler) BencodeMarshal() ([]byte, error) {
+	return []byte(b), nil
+}
+
+func TestMarshalerInvalidOutput(t *testing.T) {
+	for _, output := range []string{"i42", "4:spamextra", "x"} {
+		_, err := Encode(brokenMarshaler(output))
+		if !errors.Is(err, ErrInvalidBencode) {
+			t.Errorf("Encode(%q) error = %v, want ErrInvalidBencode", output, err)
+		}
+	}
+
+	encoded, err := Encode([]interface{}{brokenMarshaler("i7e")})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if string(encoded) != "li7ee" {
+		t.Errorf("Encode() = %s, want li7ee", encoded)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	data := []byte("d4:infod6:lengthi3e4:name1:ae4:spaml1:a1:bee")
+
+	var envelope struct {
+		Info RawMessage    `bencode:"info"`
+		Spam []interface{} `bencode:"spam"`
+	}
+	if err := Decode(data, &envelope); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if string(envelope.Info) != "d6:lengthi3e4:name1:ae" {
+		t.Errorf("Info = %s, want d6:lengthi3e4:name1:ae", envelope.Info)
+	}
+	if len(envelope.Spam) != 2 {
+		t.Errorf("Spam = %v, want 2 elements", envelope.Spam)
+	}
+
+	var byKey map[string]RawMessage
+	if err := Decode(data, &byKey); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if string(byKey["spam"]) != "l1:a1:be" {
+		t.Errorf("byKey[spam] = %s, want l1:a1:be", byKey["spam"])
+	}
+
+	encoded, err := Encode(map[string]interface{}{"info": envelope.Info})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if string(encoded) != "d4:infod6:lengthi3e4:name1:aee" {
+		t.Errorf("Encode() = %s, want d4:infod6:lengthi3e4:name1:aee", encoded)
+	}
+}
+
+func TestBoolEncoding(t *testing.T) {
+	type flags struct {
+		Private bool `bencode:"private"`
+		Seed    bool `bencode:"seed"`
+	}
+
+	encoded, err := Encode(flags{Private: true})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if string(encoded) != "d7:privatei1e4:seedi0ee" {
+		t.Errorf("Encode() = %s, want d7:privatei1e4:seedi0ee", encoded)
+	}
+
+	var decoded flags
+	if err := Decode(encoded, &decoded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !decoded.Private || decoded.Seed {
+		t.Errorf("Decode() = %+v, want {Private:true Seed:false}", decoded)
+	}
+}
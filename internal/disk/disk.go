@@ -1,22 +1,32 @@
 package disk
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/mt/bittorrent-impl/internal/torrent"
 )
 
+// ErrReadOnly is returned when writing to files opened read-only
+var ErrReadOnly = errors.New("storage is read-only")
+
 // Manager handles file I/O operations for torrent downloads
 type Manager struct {
 	mu          sync.RWMutex
 	torrent     *torrent.Torrent
 	downloadDir string
-	files       map[string]*os.File // filepath -> file handle
+	files       []*os.File // open files, in torrent order
+	paths       []string   // paths of the open files
+	layout      *Layout    // where each piece is stored, once files are open
+	generation  int        // counts replacements of the open files
+	readOnly    bool       // files opened by OpenReadOnly
 	totalSize   int64
 	pieceHashes [][20]byte
 }
@@ -33,7 +43,6 @@ func NewManager(torrent *torrent.Torrent, downloadDir string) *Manager {
 	return &Manager{
 		torrent:     torrent,
 		downloadDir: downloadDir,
-		files:       make(map[string]*os.File),
 		totalSize:   torrent.TotalLength(),
 		pieceHashes: pieceHashes,
 	}
@@ -41,6 +50,12 @@ func NewManager(torrent *torrent.Torrent, downloadDir string) *Manager {
 
 // Initialize creates the directory structure and opens files
 func (d *Manager) Initialize() error {
+	return d.InitializeContext(context.Background())
+}
+
+// InitializeContext is Initialize, giving up before the next file once
+// ctx is done. The files opened so far are closed again.
+func (d *Manager) InitializeContext(ctx context.Context) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -49,239 +64,321 @@ func (d *Manager) Initialize() error {
 		return fmt.Errorf("failed to create download directory: %w", err)
 	}
 
-	// Handle single file torrents
-	if d.torrent.IsSingleFile() {
-		filePath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		file, err := d.createFile(filePath, d.torrent.Info.Length)
-		if err != nil {
-			return err
-		}
-		d.files[filePath] = file
-		return nil
+	files, err := d.fileLayouts()
+	if err != nil {
+		return err
 	}
-
-	// Handle multi-file torrents
-	for _, fileInfo := range d.torrent.Info.Files {
-		// Build file path
-		fullPath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		for _, pathComponent := range fileInfo.Path {
-			fullPath = filepath.Join(fullPath, pathComponent)
+	opened := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			closeFiles(opened)
+			return err
 		}
 
 		// Create directory structure
-		dir := filepath.Dir(fullPath)
+		dir := filepath.Dir(f.path)
 		if err := os.MkdirAll(dir, 0755); err != nil {
+			closeFiles(opened)
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 
 		// Create/open file
-		file, err := d.createFile(fullPath, fileInfo.Length)
+		file, err := d.createFile(f.path, f.length)
 		if err != nil {
+			closeFiles(opened)
 			return err
 		}
-		d.files[fullPath] = file
+		opened = append(opened, file)
 	}
+	d.setFiles(files, opened, false)
 
 	return nil
 }
 
-// createFile creates or opens a file with the specified size
-func (d *Manager) createFile(path string, size int64) (*os.File, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file %s: %w", path, err)
-	}
+// OpenReadOnly opens the torrent's existing files for reading only, to
+// seed data downloaded elsewhere. Nothing is created, allocated or
+// truncated; a file that is missing or not the size the torrent gives is
+// an error.
+func (d *Manager) OpenReadOnly() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	// Allocate space for the file
-	if err := file.Truncate(size); err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to allocate space for file %s: %w", path, err)
+	files, opened, err := d.openReadOnly()
+	if err != nil {
+		return err
 	}
-
-	return file, nil
+	d.setFiles(files, opened, true)
+	return nil
 }
 
-// WritePiece writes piece data to the appropriate file(s)
-func (d *Manager) WritePiece(pieceIndex int, data []byte) error {
+// ReopenReadOnly swaps the open files for read-only handles once the
+// torrent is complete, so seeding cannot change the data and the files may
+// sit on a read-only mount. Each file is synced a last time before its
+// writable handle is closed; after that no more writes or syncs are made.
+// If the files cannot be reopened the writable handles are kept.
+func (d *Manager) ReopenReadOnly() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	pieceLength := d.torrent.Info.PieceLength
-	pieceOffset := int64(pieceIndex) * int64(pieceLength)
+	if d.readOnly {
+		return nil
+	}
+	files, opened, err := d.openReadOnly()
+	if err != nil {
+		return err
+	}
 
-	// Handle single file torrents
-	if d.torrent.IsSingleFile() {
-		filePath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		file, exists := d.files[filePath]
-		if !exists {
-			return fmt.Errorf("file not open: %s", filePath)
+	var errs []error
+	for i, file := range d.files {
+		if err := file.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to sync file %s: %w", d.paths[i], err))
 		}
-
-		_, err := file.WriteAt(data, pieceOffset)
-		if err != nil {
-			return fmt.Errorf("failed to write to file %s at offset %d: %w", filePath, pieceOffset, err)
+		if err := file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close file %s: %w", d.paths[i], err))
 		}
-
-		return file.Sync()
 	}
-
-	// Handle multi-file torrents
-	return d.writeMultiFile(pieceOffset, data)
+	d.setFiles(files, opened, true)
+	return errors.Join(errs...)
 }
 
-// writeMultiFile writes data across multiple files for multi-file torrents
-func (d *Manager) writeMultiFile(offset int64, data []byte) error {
-	currentOffset := int64(0)
-	dataOffset := 0
-
-	for _, fileInfo := range d.torrent.Info.Files {
-		fileEnd := currentOffset + fileInfo.Length
-
-		// Skip files that are before our offset
-		if offset >= fileEnd {
-			currentOffset = fileEnd
-			continue
-		}
+// openReadOnly opens every file of the torrent read-only, closing them
+// all if any fails (must hold d.mu)
+func (d *Manager) openReadOnly() ([]fileLayout, []*os.File, error) {
+	files, err := d.fileLayouts()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Calculate how much to write to this file
-		fileWriteStart := int64(0)
-		if offset > currentOffset {
-			fileWriteStart = offset - currentOffset
+	opened := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		file, err := openExisting(f.path, f.length)
+		if err != nil {
+			closeFiles(opened)
+			return nil, nil, err
 		}
+		opened = append(opened, file)
+	}
+	return files, opened, nil
+}
 
-		bytesToWrite := int64(len(data)) - int64(dataOffset)
-		if fileWriteStart+bytesToWrite > fileInfo.Length {
-			bytesToWrite = fileInfo.Length - fileWriteStart
-		}
+// setFiles makes opened, laid out as files, the open files (must hold
+// d.mu)
+func (d *Manager) setFiles(files []fileLayout, opened []*os.File, readOnly bool) {
+	d.paths = make([]string, len(files))
+	for i, f := range files {
+		d.paths[i] = f.path
+	}
+	d.files = opened
+	if d.layout == nil {
+		d.layout = NewLayout(d.torrent)
+	}
+	d.readOnly = readOnly
+	d.generation++
+}
 
-		if bytesToWrite <= 0 {
-			break
-		}
+// closeFiles closes files opened before a later one failed
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
 
-		// Get file path
-		fullPath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		for _, pathComponent := range fileInfo.Path {
-			fullPath = filepath.Join(fullPath, pathComponent)
-		}
+// ReadOnly returns true if the files were opened read-only
+func (d *Manager) ReadOnly() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.readOnly
+}
 
-		file, exists := d.files[fullPath]
-		if !exists {
-			return fmt.Errorf("file not open: %s", fullPath)
-		}
+// fileLayout is where one of the torrent's files is stored
+type fileLayout struct {
+	path   string
+	length int64
+}
 
-		// Write data
-		writeData := data[dataOffset : dataOffset+int(bytesToWrite)]
-		_, err := file.WriteAt(writeData, fileWriteStart)
+// fileLayouts returns the paths and sizes of the torrent's files
+func (d *Manager) fileLayouts() ([]fileLayout, error) {
+	if d.torrent.IsSingleFile() {
+		path, err := d.safeJoin(d.torrent.Info.Name)
 		if err != nil {
-			return fmt.Errorf("failed to write to file %s: %w", fullPath, err)
-		}
-
-		if err := file.Sync(); err != nil {
-			return fmt.Errorf("failed to sync file %s: %w", fullPath, err)
+			return nil, err
 		}
+		return []fileLayout{{path, d.torrent.Info.Length}}, nil
+	}
 
-		dataOffset += int(bytesToWrite)
-		currentOffset = fileEnd
-
-		// If we've written all data, we're done
-		if dataOffset >= len(data) {
-			break
+	files := make([]fileLayout, 0, len(d.torrent.Info.Files))
+	for _, fileInfo := range d.torrent.Info.Files {
+		path, err := d.safeJoin(append([]string{d.torrent.Info.Name}, fileInfo.Path...)...)
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, fileLayout{path, fileInfo.Length})
 	}
-
-	return nil
+	return files, nil
 }
 
-// ReadPiece reads piece data from the appropriate file(s)
-func (d *Manager) ReadPiece(pieceIndex int) ([]byte, error) {
+// Layout returns where each piece is stored, or nil until the files are
+// opened
+func (d *Manager) Layout() *Layout {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
+	return d.layout
+}
 
-	actualLength := int(d.torrent.PieceSize(pieceIndex))
-	pieceOffset := int64(pieceIndex) * int64(d.torrent.Info.PieceLength)
-	data := make([]byte, actualLength)
+// SetLayout gives the manager a layout already worked out for its
+// torrent, so opening the files need not map the pieces again
+func (d *Manager) SetLayout(layout *Layout) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.layout = layout
+}
 
-	// Handle single file torrents
-	if d.torrent.IsSingleFile() {
-		filePath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		file, exists := d.files[filePath]
-		if !exists {
-			return nil, fmt.Errorf("file not open: %s", filePath)
-		}
+// openExisting opens a file for reading, checking it has the expected
+// size
+func openExisting(path string, size int64) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	if fi.Size() != size {
+		file.Close()
+		return nil, fmt.Errorf("file %s is %d bytes, want %d", path, fi.Size(), size)
+	}
+	return file, nil
+}
 
-		_, err := file.ReadAt(data, pieceOffset)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read from file %s at offset %d: %w", filePath, pieceOffset, err)
+// safeJoin joins torrent path components below the download directory,
+// refusing any that would place the file outside of it
+func (d *Manager) safeJoin(components ...string) (string, error) {
+	for _, component := range components {
+		if err := torrent.ValidatePathComponent(component); err != nil {
+			return "", err
 		}
+	}
+
+	base := filepath.Clean(d.downloadDir)
+	fullPath := filepath.Join(append([]string{base}, components...)...)
 
-		return data, nil
+	rel, err := filepath.Rel(base, fullPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside %s", torrent.ErrUnsafePath, fullPath, base)
 	}
 
-	// Handle multi-file torrents
-	err := d.readMultiFile(pieceOffset, data)
+	return fullPath, nil
+}
+
+// createFile creates or opens a file with the specified size
+func (d *Manager) createFile(path string, size int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create file %s: %w", path, err)
 	}
 
-	return data, nil
+	// Allocate space for the file
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to allocate space for file %s: %w", path, err)
+	}
+
+	return file, nil
 }
 
-// readMultiFile reads data from multiple files for multi-file torrents
-func (d *Manager) readMultiFile(offset int64, data []byte) error {
-	currentOffset := int64(0)
-	dataOffset := 0
+// WritePiece writes piece data to the appropriate file(s)
+func (d *Manager) WritePiece(pieceIndex int, data []byte) error {
+	if size := d.torrent.PieceSize(pieceIndex); int64(len(data)) != size {
+		return fmt.Errorf("piece %d is %d bytes, want %d", pieceIndex, len(data), size)
+	}
+	return d.transfer(pieceIndex, 0, data, true, true)
+}
 
-	for _, fileInfo := range d.torrent.Info.Files {
-		fileEnd := currentOffset + fileInfo.Length
+// WriteBlock writes a block of a piece that has not been verified, so the
+// block is kept while the rest of the piece arrives. It is synced, as a
+// piece is, so resume data recording it can be trusted after a crash.
+func (d *Manager) WriteBlock(pieceIndex, begin int, data []byte) error {
+	if pieceIndex < 0 || pieceIndex >= d.torrent.NumPieces() {
+		return fmt.Errorf("piece %d out of range", pieceIndex)
+	}
+	if pieceSize := d.torrent.PieceSize(pieceIndex); begin < 0 || int64(begin)+int64(len(data)) > pieceSize {
+		return fmt.Errorf("block %d+%d out of range for piece %d", begin, len(data), pieceIndex)
+	}
+	return d.transfer(pieceIndex, int64(begin), data, true, true)
+}
 
-		// Skip files that are before our offset
-		if offset >= fileEnd {
-			currentOffset = fileEnd
-			continue
-		}
+// ReadPiece reads piece data from the appropriate file(s)
+func (d *Manager) ReadPiece(pieceIndex int) ([]byte, error) {
+	if pieceIndex < 0 || pieceIndex >= d.torrent.NumPieces() {
+		return nil, fmt.Errorf("piece %d out of range", pieceIndex)
+	}
+	data := make([]byte, d.torrent.PieceSize(pieceIndex))
+	if err := d.transfer(pieceIndex, 0, data, false, false); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
 
-		// Calculate how much to read from this file
-		fileReadStart := int64(0)
-		if offset > currentOffset {
-			fileReadStart = offset - currentOffset
+// transfer reads or writes data at begin in a piece, syncing the files
+// written to if sync is set. Each file the range covers takes a single
+// positioned read or write, and d.mu is only held to look the files up, so
+// pieces are read and written in parallel. If the files are replaced
+// meanwhile, as ReopenReadOnly does, it starts again with the new ones.
+func (d *Manager) transfer(pieceIndex int, begin int64, data []byte, write, sync bool) error {
+	for {
+		d.mu.RLock()
+		files, paths, generation, readOnly := d.files, d.paths, d.generation, d.readOnly
+		var extents []Extent
+		if d.layout != nil {
+			extents = within(d.layout.PieceExtents(pieceIndex), begin, int64(len(data)))
 		}
+		d.mu.RUnlock()
 
-		bytesToRead := int64(len(data)) - int64(dataOffset)
-		if fileReadStart+bytesToRead > fileInfo.Length {
-			bytesToRead = fileInfo.Length - fileReadStart
+		switch {
+		case files == nil:
+			return errors.New("files not open")
+		case write && readOnly:
+			return ErrReadOnly
 		}
 
-		if bytesToRead <= 0 {
-			break
+		err := transferExtents(files, paths, extents, data, write, sync)
+		if errors.Is(err, os.ErrClosed) {
+			d.mu.RLock()
+			replaced := d.generation != generation
+			d.mu.RUnlock()
+			if replaced {
+				continue
+			}
 		}
+		return err
+	}
+}
 
-		// Get file path
-		fullPath := filepath.Join(d.downloadDir, d.torrent.Info.Name)
-		for _, pathComponent := range fileInfo.Path {
-			fullPath = filepath.Join(fullPath, pathComponent)
+// transferExtents reads or writes data over extents of files, syncing
+// each file written to if sync is set
+func transferExtents(files []*os.File, paths []string, extents []Extent, data []byte, write, sync bool) error {
+	for _, e := range extents {
+		file, buf := files[e.File], data[:e.Length]
+		data = data[e.Length:]
+
+		if !write {
+			if _, err := file.ReadAt(buf, e.Offset); err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read from file %s at offset %d: %w", paths[e.File], e.Offset, err)
+			}
+			continue
 		}
-
-		file, exists := d.files[fullPath]
-		if !exists {
-			return fmt.Errorf("file not open: %s", fullPath)
+		if _, err := file.WriteAt(buf, e.Offset); err != nil {
+			return fmt.Errorf("failed to write to file %s at offset %d: %w", paths[e.File], e.Offset, err)
 		}
-
-		// Read data
-		readData := data[dataOffset : dataOffset+int(bytesToRead)]
-		_, err := file.ReadAt(readData, fileReadStart)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read from file %s: %w", fullPath, err)
+		if !sync {
+			continue
 		}
-
-		dataOffset += int(bytesToRead)
-		currentOffset = fileEnd
-
-		// If we've read all data, we're done
-		if dataOffset >= len(data) {
-			break
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file %s: %w", paths[e.File], err)
 		}
 	}
-
 	return nil
 }
 
@@ -299,21 +396,40 @@ func (d *Manager) VerifyPiece(pieceIndex int, data []byte) bool {
 
 // ReadBlock reads a specific block from a piece
 func (d *Manager) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
-	pieceData, err := d.ReadPiece(pieceIndex)
-	if err != nil {
-		return nil, err
+	if pieceIndex < 0 || pieceIndex >= d.torrent.NumPieces() {
+		return nil, fmt.Errorf("piece %d out of range", pieceIndex)
 	}
+	pieceSize := int(d.torrent.PieceSize(pieceIndex))
 
-	if begin < 0 || begin >= len(pieceData) {
+	if begin < 0 || begin >= pieceSize {
 		return nil, fmt.Errorf("block begin offset %d out of range for piece %d", begin, pieceIndex)
 	}
+	if length < 0 {
+		return nil, fmt.Errorf("invalid block length %d", length)
+	}
 
 	end := begin + length
-	if end > len(pieceData) {
-		end = len(pieceData)
+	if end > pieceSize {
+		end = pieceSize
 	}
 
-	return pieceData[begin:end], nil
+	data := make([]byte, end-begin)
+	if err := d.transfer(pieceIndex, int64(begin), data, false, false); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadBlockInto reads the block at begin in a piece into buf, which must
+// lie within the piece
+func (d *Manager) ReadBlockInto(pieceIndex, begin int, buf []byte) error {
+	if pieceIndex < 0 || pieceIndex >= d.torrent.NumPieces() {
+		return fmt.Errorf("piece %d out of range", pieceIndex)
+	}
+	if pieceSize := d.torrent.PieceSize(pieceIndex); begin < 0 || int64(begin)+int64(len(buf)) > pieceSize {
+		return fmt.Errorf("block %d+%d out of range for piece %d", begin, len(buf), pieceIndex)
+	}
+	return d.transfer(pieceIndex, int64(begin), buf, false, false)
 }
 
 // Close closes all open files
@@ -322,13 +438,14 @@ func (d *Manager) Close() error {
 	defer d.mu.Unlock()
 
 	var errs []error
-	for path, file := range d.files {
+	for i, file := range d.files {
 		if err := file.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("failed to close file %s: %w", path, err))
+			errs = append(errs, fmt.Errorf("failed to close file %s: %w", d.paths[i], err))
 		}
 	}
 
-	d.files = make(map[string]*os.File)
+	d.files = nil
+	d.generation++
 
 	if len(errs) > 0 {
 		return fmt.Errorf("errors closing files: %v", errs)
@@ -1,9 +1,13 @@
 package disk
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/mt/bittorrent-impl/internal/torrent"
@@ -330,6 +334,27 @@ func TestReadBlock(t *testing.T) {
 			break
 		}
 	}
+
+	// Reading into a buffer takes blocks of any length within the piece
+	buf := make([]byte, 5000)
+	if err := manager.ReadBlockInto(0, 1000, buf); err != nil || !bytes.Equal(buf, testData[1000:6000]) {
+		t.Errorf("ReadBlockInto = %v, want bytes 1000 to 6000", err)
+	}
+	if err := manager.ReadBlockInto(0, 16000, buf); err == nil {
+		t.Error("ReadBlockInto past the end of the piece succeeded")
+	}
+
+	// A block written on its own is read back without the rest of the piece
+	block := bytes.Repeat([]byte{9}, 1000)
+	if err := manager.WriteBlock(0, 2000, block); err != nil {
+		t.Fatalf("WriteBlock failed: %v", err)
+	}
+	if got, err := manager.ReadBlock(0, 2000, 1000); err != nil || !bytes.Equal(got, block) {
+		t.Errorf("ReadBlock after WriteBlock = %v, want the block written", err)
+	}
+	if err := manager.WriteBlock(0, 16000, block); err == nil {
+		t.Error("WriteBlock past the end of the piece succeeded")
+	}
 }
 
 func TestGetProgress(t *testing.T) {
@@ -402,4 +427,208 @@ func TestClose(t *testing.T) {
 	if len(manager.files) != 0 {
 		t.Error("Files were not cleared after close")
 	}
-}
\ No newline at end of file
+}
+func TestInitializeRejectsTraversal(t *testing.T) {
+	tempDir := t.TempDir()
+	downloadDir := filepath.Join(tempDir, "downloads")
+
+	files := []torrent.File{
+		{Length: 1024, Path: []string{"..", "..", "escaped.txt"}},
+	}
+	torrentData := createTestTorrent(16384, files, 0)
+	manager := NewManager(torrentData, downloadDir)
+
+	err := manager.Initialize()
+	if !errors.Is(err, torrent.ErrUnsafePath) {
+		t.Fatalf("Initialize() error = %v, want ErrUnsafePath", err)
+	}
+	defer manager.Close()
+
+	if _, err := os.Stat(filepath.Join(tempDir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("File outside the download directory should not be created")
+	}
+
+	// Absolute names are rejected as well
+	torrentData = createTestTorrent(16384, nil, 1024)
+	torrentData.Info.Name = filepath.Join(tempDir, "absolute.txt")
+	manager = NewManager(torrentData, downloadDir)
+	if err := manager.Initialize(); !errors.Is(err, torrent.ErrUnsafePath) {
+		t.Errorf("Initialize() error = %v, want ErrUnsafePath", err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := []torrent.File{
+		{Length: 10000, Path: []string{"file1.txt"}},
+		{Length: 6384, Path: []string{"sub", "file2.txt"}},
+	}
+	tor := createTestTorrent(16384, files, 0)
+
+	// Nothing is created for missing files
+	if err := NewManager(tor, tmpDir).OpenReadOnly(); err == nil {
+		t.Fatal("OpenReadOnly succeeded without the files")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "test-torrent")); !os.IsNotExist(err) {
+		t.Errorf("OpenReadOnly created the torrent directory: %v", err)
+	}
+
+	data := make([]byte, 16384)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	root := filepath.Join(tmpDir, "test-torrent")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "file1.txt"), data[:10000], 0444)
+	os.WriteFile(filepath.Join(root, "sub", "file2.txt"), data[10000:16000], 0444)
+
+	// A file of the wrong size is refused rather than truncated
+	if err := NewManager(tor, tmpDir).OpenReadOnly(); err == nil {
+		t.Fatal("OpenReadOnly accepted a short file")
+	}
+	if fi, _ := os.Stat(filepath.Join(root, "sub", "file2.txt")); fi.Size() != 6000 {
+		t.Errorf("short file resized to %d bytes", fi.Size())
+	}
+
+	os.WriteFile(filepath.Join(root, "sub", "file2.txt"), data[10000:], 0444)
+	manager := NewManager(tor, tmpDir)
+	if err := manager.OpenReadOnly(); err != nil {
+		t.Fatalf("OpenReadOnly failed: %v", err)
+	}
+	defer manager.Close()
+
+	if !manager.ReadOnly() {
+		t.Error("ReadOnly() = false")
+	}
+	got, err := manager.ReadPiece(0)
+	if err != nil {
+		t.Fatalf("ReadPiece failed: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Error("ReadPiece returned different data")
+	}
+	if err := manager.WritePiece(0, data); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WritePiece = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestReopenReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := []torrent.File{
+		{Length: 10000, Path: []string{"file1.txt"}},
+		{Length: 6384, Path: []string{"sub", "file2.txt"}},
+	}
+	tor := createTestTorrent(16384, files, 0)
+
+	manager := NewManager(tor, tmpDir)
+	if err := manager.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer manager.Close()
+
+	data := make([]byte, 16384)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := manager.WritePiece(0, data); err != nil {
+		t.Fatalf("WritePiece failed: %v", err)
+	}
+
+	if err := manager.ReopenReadOnly(); err != nil {
+		t.Fatalf("ReopenReadOnly failed: %v", err)
+	}
+	if !manager.ReadOnly() {
+		t.Error("ReadOnly() = false")
+	}
+	got, err := manager.ReadPiece(0)
+	if err != nil {
+		t.Fatalf("ReadPiece failed: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Error("ReadPiece returned different data")
+	}
+	if err := manager.WritePiece(0, data); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WritePiece = %v, want ErrReadOnly", err)
+	}
+	if err := manager.ReopenReadOnly(); err != nil {
+		t.Errorf("second ReopenReadOnly failed: %v", err)
+	}
+}
+
+func TestParallelPieceIO(t *testing.T) {
+	files := []torrent.File{
+		{Length: 5000, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 20000, Path: []string{"b"}},
+		{Length: 3000, Path: []string{"c"}},
+		{Length: 12000, Path: []string{"d"}},
+	}
+	tor := createTestTorrent(4096, files, 0)
+
+	manager := NewManager(tor, t.TempDir())
+	if err := manager.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer manager.Close()
+
+	content := make([]byte, tor.TotalLength())
+	for i := range content {
+		content[i] = byte(i * 31 % 253)
+	}
+	piece := func(index int) []byte {
+		begin := int64(index) * tor.Info.PieceLength
+		return content[begin : begin+tor.PieceSize(index)]
+	}
+
+	var wg sync.WaitGroup
+	for index := 0; index < tor.NumPieces(); index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := manager.WritePiece(index, piece(index)); err != nil {
+				t.Errorf("WritePiece(%d) failed: %v", index, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for index := 0; index < tor.NumPieces(); index++ {
+		got, err := manager.ReadPiece(index)
+		if err != nil {
+			t.Fatalf("ReadPiece(%d) failed: %v", index, err)
+		}
+		if !bytes.Equal(got, piece(index)) {
+			t.Errorf("ReadPiece(%d) returned different data", index)
+		}
+	}
+
+	// A block crossing three files, cut short at the end of the piece
+	block, err := manager.ReadBlock(6, 200, 5000)
+	if err != nil {
+		t.Fatalf("ReadBlock failed: %v", err)
+	}
+	if want := piece(6)[200:]; !bytes.Equal(block, want) {
+		t.Errorf("ReadBlock returned %d bytes, want %d matching the piece", len(block), len(want))
+	}
+
+	if err := manager.WritePiece(0, content[:100]); err == nil {
+		t.Error("WritePiece accepted a short piece")
+	}
+	if _, err := manager.ReadPiece(tor.NumPieces()); err == nil {
+		t.Error("ReadPiece accepted a piece out of range")
+	}
+}
+
+func TestInitializeContext(t *testing.T) {
+	dir := t.TempDir()
+	manager := NewManager(createTestTorrent(16384, nil, 32768), dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := manager.InitializeContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("InitializeContext error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test-torrent")); !os.IsNotExist(err) {
+		t.Errorf("file created after the context was cancelled: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package disk
+
+import "github.com/mt/bittorrent-impl/internal/torrent"
+
+// Extent is the part of one file that a piece, or part of one, covers
+type Extent struct {
+	File   int   // index of the file in torrent order
+	Offset int64 // within the file
+	Length int64
+}
+
+// Layout maps each piece of a torrent to the file ranges it covers, and
+// each file to the pieces holding its data
+type Layout struct {
+	pieces [][]Extent
+	files  [][2]int // first and last piece of each file
+}
+
+// NewLayout works out where each piece of a torrent is stored
+func NewLayout(t *torrent.Torrent) *Layout {
+	return newLayout(t.GetFiles(), t.NumPieces(), t.Info.PieceLength)
+}
+
+func newLayout(files []torrent.FileInfo, numPieces int, pieceLength int64) *Layout {
+	l := &Layout{
+		pieces: make([][]Extent, numPieces),
+		files:  make([][2]int, len(files)),
+	}
+	for i := range l.files {
+		// Empty files stay out of every piece
+		l.files[i] = [2]int{1, 0}
+	}
+
+	file := 0
+	for index := range l.pieces {
+		pos := int64(index) * pieceLength
+		end := pos + pieceLength
+		for pos < end && file < len(files) {
+			f := files[file]
+			fileEnd := f.Offset + f.Length
+			if pos >= fileEnd {
+				file++
+				continue
+			}
+			if pos == f.Offset {
+				l.files[file][0] = index
+			}
+			l.files[file][1] = index
+
+			n := min(end, fileEnd) - pos
+			l.pieces[index] = append(l.pieces[index], Extent{file, pos - f.Offset, n})
+			pos += n
+		}
+	}
+	return l
+}
+
+// NumPieces returns the number of pieces mapped
+func (l *Layout) NumPieces() int {
+	return len(l.pieces)
+}
+
+// PieceExtents returns the file ranges a piece covers, in order, or nil if
+// the index is out of range. The slice must not be modified.
+func (l *Layout) PieceExtents(index int) []Extent {
+	if index < 0 || index >= len(l.pieces) {
+		return nil
+	}
+	return l.pieces[index]
+}
+
+// FilePieces returns the first and last piece holding a file's data; first
+// is past last for an empty file or an index out of range
+func (l *Layout) FilePieces(file int) (first, last int) {
+	if file < 0 || file >= len(l.files) {
+		return 1, 0
+	}
+	return l.files[file][0], l.files[file][1]
+}
+
+// within returns the extents of length bytes from begin into the range
+// that extents cover
+func within(extents []Extent, begin, length int64) []Extent {
+	var part []Extent
+	for _, e := range extents {
+		if length <= 0 {
+			break
+		}
+		if begin >= e.Length {
+			begin -= e.Length
+			continue
+		}
+		n := min(e.Length-begin, length)
+		part = append(part, Extent{e.File, e.Offset + begin, n})
+		begin = 0
+		length -= n
+	}
+	return part
+}
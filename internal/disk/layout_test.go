@@ -0,0 +1,61 @@
+package disk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+func TestLayout(t *testing.T) {
+	files := []torrent.FileInfo{
+		{Path: "a", Offset: 0, Length: 10},
+		{Path: "empty", Offset: 10, Length: 0},
+		{Path: "b", Offset: 10, Length: 4},
+		{Path: "c", Offset: 14, Length: 20},
+	}
+	l := newLayout(files, 5, 8)
+
+	pieces := [][]Extent{
+		{{0, 0, 8}},
+		{{0, 8, 2}, {2, 0, 4}, {3, 0, 2}},
+		{{3, 2, 8}},
+		{{3, 10, 8}},
+		{{3, 18, 2}},
+	}
+	for index, want := range pieces {
+		if got := l.PieceExtents(index); !reflect.DeepEqual(got, want) {
+			t.Errorf("PieceExtents(%d) = %v, want %v", index, got, want)
+		}
+	}
+	if got := l.PieceExtents(5); got != nil {
+		t.Errorf("PieceExtents(5) = %v, want nil", got)
+	}
+
+	ranges := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, 4}, {1, 0}}
+	for file, want := range ranges {
+		if first, last := l.FilePieces(file); first != want[0] || last != want[1] {
+			t.Errorf("FilePieces(%d) = %d, %d, want %d, %d", file, first, last, want[0], want[1])
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	extents := []Extent{{0, 8, 2}, {2, 0, 4}, {3, 0, 2}}
+
+	tests := []struct {
+		begin, length int64
+		want          []Extent
+	}{
+		{0, 8, extents},
+		{1, 6, []Extent{{0, 9, 1}, {2, 0, 4}, {3, 0, 1}}},
+		{2, 4, []Extent{{2, 0, 4}}},
+		{7, 10, []Extent{{3, 1, 1}}},
+		{8, 1, nil},
+	}
+	for _, tt := range tests {
+		if got := within(extents, tt.begin, tt.length); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("within(%d, %d) = %v, want %v", tt.begin, tt.length, got, tt.want)
+		}
+	}
+}
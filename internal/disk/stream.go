@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// VerifyPieceFrom verifies the SHA-1 hash of the piece src writes,
+// without holding the whole piece in one buffer
+func (d *Manager) VerifyPieceFrom(pieceIndex int, src io.WriterTo) bool {
+	if pieceIndex < 0 || pieceIndex >= len(d.pieceHashes) {
+		return false
+	}
+
+	h := sha1.New()
+	if _, err := src.WriteTo(h); err != nil {
+		return false
+	}
+	var hash [20]byte
+	h.Sum(hash[:0])
+	return hash == d.pieceHashes[pieceIndex]
+}
+
+// WritePieceFrom writes the piece src writes to the appropriate file(s)
+// as it arrives, syncing each file once the whole piece is written
+func (d *Manager) WritePieceFrom(pieceIndex int, src io.WriterTo) error {
+	if pieceIndex < 0 || pieceIndex >= d.torrent.NumPieces() {
+		return fmt.Errorf("piece %d out of range", pieceIndex)
+	}
+
+	w := &pieceWriter{d: d, index: pieceIndex, size: d.torrent.PieceSize(pieceIndex)}
+	if _, err := src.WriteTo(w); err != nil {
+		return err
+	}
+	if w.offset != w.size {
+		return fmt.Errorf("piece %d is %d bytes, want %d", pieceIndex, w.offset, w.size)
+	}
+	return d.syncPiece(pieceIndex)
+}
+
+// pieceWriter writes consecutive parts of a piece without syncing
+type pieceWriter struct {
+	d      *Manager
+	index  int
+	offset int64
+	size   int64
+}
+
+func (w *pieceWriter) Write(p []byte) (int, error) {
+	if w.offset+int64(len(p)) > w.size {
+		return 0, fmt.Errorf("piece %d is %d bytes, got more", w.index, w.size)
+	}
+	if err := w.d.transfer(w.index, w.offset, p, true, false); err != nil {
+		return 0, err
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// syncPiece syncs the files a piece is stored in. Files replaced by
+// ReopenReadOnly meanwhile were synced before they were closed.
+func (d *Manager) syncPiece(pieceIndex int) error {
+	d.mu.RLock()
+	files, paths, generation := d.files, d.paths, d.generation
+	var extents []Extent
+	if d.layout != nil {
+		extents = d.layout.PieceExtents(pieceIndex)
+	}
+	d.mu.RUnlock()
+
+	if files == nil {
+		return errors.New("files not open")
+	}
+	for _, e := range extents {
+		err := files[e.File].Sync()
+		if errors.Is(err, os.ErrClosed) {
+			d.mu.RLock()
+			replaced := d.generation != generation
+			d.mu.RUnlock()
+			if replaced {
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync file %s: %w", paths[e.File], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// chunks writes its parts in turn, as a piece writes its blocks
+type chunks [][]byte
+
+func (c chunks) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, part := range c {
+		n, err := w.Write(part)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func TestWritePieceFrom(t *testing.T) {
+	files := []torrent.File{
+		{Length: 10000, Path: []string{"file1.txt"}},
+		{Length: 10000, Path: []string{"file2.txt"}},
+		{Length: 8384, Path: []string{"file3.txt"}},
+	}
+	tor := createTestTorrent(16384, files, 0)
+	data := make([]byte, 16384)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	hash := sha1.Sum(data)
+	copy(tor.Info.Pieces, hash[:])
+
+	manager := NewManager(tor, t.TempDir())
+	if err := manager.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer manager.Close()
+
+	// Parts that do not line up with the files
+	src := chunks{data[:4096], data[4096:12288], data[12288:]}
+	if !manager.VerifyPieceFrom(0, src) {
+		t.Error("VerifyPieceFrom failed for the right data")
+	}
+	if manager.VerifyPieceFrom(0, src[:2]) {
+		t.Error("VerifyPieceFrom passed part of the piece")
+	}
+
+	if err := manager.WritePieceFrom(0, src); err != nil {
+		t.Fatalf("WritePieceFrom failed: %v", err)
+	}
+	got, err := manager.ReadPiece(0)
+	if err != nil {
+		t.Fatalf("ReadPiece failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("piece read back differs from what was written")
+	}
+
+	if err := manager.WritePieceFrom(0, src[:2]); err == nil {
+		t.Error("WritePieceFrom accepted a short piece")
+	}
+	if err := manager.WritePieceFrom(0, append(src, []byte{1})); err == nil {
+		t.Error("WritePieceFrom accepted a long piece")
+	}
+	if err := manager.WritePieceFrom(2, src); err == nil {
+		t.Error("WritePieceFrom accepted a piece out of range")
+	}
+}
@@ -2,15 +2,50 @@ package download
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mt/bittorrent-impl/internal/peer"
 	"github.com/mt/bittorrent-impl/internal/piece"
 )
 
+const (
+	// FallbackInterval is how often every peer is checked regardless of
+	// events, in case one was missed
+	FallbackInterval = 5 * time.Second
+	
+	// MaxPendingEvents bounds the events waiting to be handled. Events
+	// beyond it are dropped and made up for by a pass over every peer once
+	// the queue drains.
+	MaxPendingEvents = 256
+	
+	// TimeoutCheckInterval is how often outstanding requests are checked
+	// against their peer's request timeout
+	TimeoutCheckInterval = time.Second
+	
+	// maxNeededPieces bounds the pieces considered in one pass
+	maxNeededPieces = 500
+)
+
+// eventKind identifies what woke the coordinator
+type eventKind int
+
+const (
+	eventPeerReady     eventKind = iota // peer unchoked us or delivered a block
+	eventPeerHas                        // peer announced new pieces
+	eventPieceVerified                  // we finished a piece
+	eventBlocksReleased                 // requests were freed for other peers
+)
+
+// event is a change that may let the coordinator request more blocks
+type event struct {
+	kind eventKind
+	peer *peer.Peer
+}
+
 // PeerManager interface for interacting with peers  
 type PeerManager interface {
 	GetConnectedPeers() []*peer.Peer
@@ -19,40 +54,52 @@ type PeerManager interface {
 // PieceManager interface for piece management
 type PieceManager interface {
 	GetNeededPieces() []int
-	SelectPieceForPeer(peerBitfield []byte) (int, error)
+	HasUnrequestedBlocks() bool
+	AssignPiece(peerID string, peerBitfield []byte, endgame bool) (int, error)
+	UnassignPeer(peerID string)
+	UpdatePeerBitfield(peerID string, bitfield []byte)
+	PeerHave(peerID string, index int)
+	PeerHaveAll(peerID string)
+	PeerInteresting(peerID string) bool
+	RemovePeer(peerID string)
 	GetBlockRequests(pieceIndex int) []piece.BlockRequest
-	RequestBlock(pieceIndex, begin, length int) error
-	GetActiveRequests() map[string]time.Time
+	Requests() *piece.Requests
 	GetProgressCounts() (downloaded, total int)
 }
 
-// RequestInfo tracks active requests to peers
-type RequestInfo struct {
-	PieceIndex int
-	Begin      int
-	Length     int
-	RequestedAt time.Time
-	Peer       *peer.Peer
-}
-
 // Coordinator manages the download process by coordinating between peers and pieces
 type Coordinator struct {
 	mu           sync.RWMutex
 	peerManager  PeerManager
 	pieceManager PieceManager
 	
-	// Request tracking
-	activeRequests map[string]*RequestInfo // key: "pieceIndex:begin"
+	// Outstanding requests, tracked by the piece manager so that it knows
+	// which blocks are taken
+	requests           *piece.Requests
 	maxRequestsPerPeer int
-	requestTimeout time.Duration
 	
 	// Statistics
 	downloadedPieces int
 	totalPieces     int
 	
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	// Events that wake the coordination loop, and whether any were
+	// dropped since the last catch-up pass
+	events  chan event
+	dropped atomic.Bool
+	
+	// Pieces still needed, owned by the coordination loop. The endgame
+	// starts once every remaining block has been requested: snubbed peers
+	// are asked again, pieces may be shared and blocks in flight asked of
+	// a second peer, since any source may finish the download.
+	needed  []int
+	endgame bool
+	
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	
+	logger *slog.Logger
 }
 
 // NewCoordinator creates a new download coordinator
@@ -62,198 +109,352 @@ func NewCoordinator(peerManager PeerManager, pieceManager PieceManager) *Coordin
 	return &Coordinator{
 		peerManager:        peerManager,
 		pieceManager:       pieceManager,
-		activeRequests:     make(map[string]*RequestInfo),
+		requests:           pieceManager.Requests(),
 		maxRequestsPerPeer: 10, // Maximum concurrent requests per peer (increased for speed)
-		requestTimeout:     15 * time.Second, // Faster timeout for unresponsive peers
+		events:             make(chan event, MaxPendingEvents),
 		ctx:                ctx,
 		cancel:             cancel,
+		logger:             slog.Default(),
 	}
 }
 
+// SetLogger sets the coordinator's logger. It must be called before Start.
+func (c *Coordinator) SetLogger(logger *slog.Logger) {
+	c.logger = logger
+}
+
 // Start begins the download coordination process
 func (c *Coordinator) Start() {
+	c.StartContext(context.Background())
+}
+
+// StartContext begins the download coordination process, which is stopped
+// as by Stop once ctx is done
+func (c *Coordinator) StartContext(ctx context.Context) {
 	c.wg.Add(2)
 	go c.coordinationLoop()
 	go c.timeoutLoop()
+	
+	context.AfterFunc(ctx, c.Stop)
 }
 
-// Stop stops the download coordinator
+// Stop stops the download coordinator and gives back its outstanding
+// requests and pieces, so another coordinator can pick them up. Later calls
+// do nothing.
 func (c *Coordinator) Stop() {
+	c.stopOnce.Do(c.stop)
+}
+
+func (c *Coordinator) stop() {
 	c.cancel()
 	c.wg.Wait()
+	
+	peers := make(map[string]bool)
+	for _, p := range c.peerManager.GetConnectedPeers() {
+		peers[p.Address().String()] = true
+	}
+	for _, peerID := range c.requests.Peers() {
+		peers[peerID] = true
+	}
+	
+	for peerID := range peers {
+		c.releasePeer(peerID)
+	}
 }
 
-// coordinationLoop is the main coordination loop
+// coordinationLoop requests blocks as events arrive, with a periodic
+// pass over every peer as a fallback
 func (c *Coordinator) coordinationLoop() {
 	defer c.wg.Done()
 	
-	log.Printf("Download coordinator started")
-	ticker := time.NewTicker(500 * time.Millisecond) // Ultra-responsive coordination for max speed
+	ticker := time.NewTicker(FallbackInterval)
 	defer ticker.Stop()
 	
+	c.processDownloadCycle()
+	
 	for {
 		select {
 		case <-c.ctx.Done():
-			log.Printf("Download coordinator stopped")
 			return
+		case ev := <-c.events:
+			c.handleEvent(ev)
+			c.catchUp()
 		case <-ticker.C:
 			c.processDownloadCycle()
 		}
 	}
 }
 
-// processDownloadCycle performs one cycle of download coordination
-func (c *Coordinator) processDownloadCycle() {
-	// Get connected peers
-	peers := c.peerManager.GetConnectedPeers()
-	if len(peers) == 0 {
-		log.Printf("No connected peers")
-		return
+// post queues an event for the coordination loop without blocking
+func (c *Coordinator) post(ev event) {
+	select {
+	case c.events <- ev:
+	default:
+		// Queue full; catchUp makes up for it
+		c.dropped.Store(true)
 	}
-	
-	// Get needed pieces
-	neededPieces := c.pieceManager.GetNeededPieces()
-	if len(neededPieces) == 0 {
-		log.Printf("Download complete - no needed pieces")
-		return // Download complete
+}
+
+// catchUp runs a pass over every peer once the queue is drained if events
+// were dropped, so an unchoke lost in a burst is acted on right away
+// rather than at the next fallback tick
+func (c *Coordinator) catchUp() {
+	if len(c.events) == 0 && c.dropped.Swap(false) {
+		c.processDownloadCycle()
 	}
-	
-	// Reduced logging for performance - only log every 10th cycle
-	c.mu.Lock()
-	cycleCount := c.downloadedPieces // Use as cycle counter
-	c.mu.Unlock()
-	
-	if cycleCount%10 == 0 {
-		log.Printf("Coordination cycle: %d peers, %d needed pieces", len(peers), len(neededPieces))
+}
+
+// handleEvent reacts to a single event
+func (c *Coordinator) handleEvent(ev event) {
+	switch ev.kind {
+	case eventPieceVerified, eventBlocksReleased:
+		c.processDownloadCycle()
+		
+	case eventPeerHas:
+		c.updateInterest(ev.peer)
+		c.servePeer(ev.peer)
+		
+	case eventPeerReady:
+		c.servePeer(ev.peer)
 	}
-	
-	// Process more pieces for higher throughput
-	if len(neededPieces) > 500 {
-		neededPieces = neededPieces[:500] // Process first 500 pieces at a time for max speed
+}
+
+// HandlePeerEvent wakes the coordinator when a peer unchokes us or
+// announces pieces, and moves requests away from peers that choke us,
+// reject them or disconnect. Piece announcements also feed the selection
+// strategy.
+func (c *Coordinator) HandlePeerEvent(ev peer.PeerEvent) {
+	switch ev.Type {
+	case peer.PeerUnchoked:
+		c.post(event{kind: eventPeerReady, peer: ev.Peer})
+	case peer.PeerHave:
+		c.pieceManager.PeerHave(ev.Peer.Address().String(), ev.Piece)
+		c.post(event{kind: eventPeerHas, peer: ev.Peer})
+	case peer.PeerBitfield:
+		c.pieceManager.UpdatePeerBitfield(ev.Peer.Address().String(), ev.Peer.GetBitfield())
+		c.post(event{kind: eventPeerHas, peer: ev.Peer})
+	case peer.PeerHaveAll:
+		c.pieceManager.PeerHaveAll(ev.Peer.Address().String())
+		c.post(event{kind: eventPeerHas, peer: ev.Peer})
+	case peer.PeerChoked:
+		// The peer drops requests it has not served, unless it will
+		// reject them explicitly under the Fast extension
+		if ev.Peer.FastExtension() {
+			return
+		}
+		if c.releasePeer(ev.Peer.Address().String()) > 0 {
+			c.post(event{kind: eventBlocksReleased})
+		}
+	case peer.PeerRejected:
+		if _, ok := c.requests.ReleaseAt(ev.Piece, ev.Begin, ev.Peer.Address().String()); ok {
+			c.post(event{kind: eventBlocksReleased})
+		}
+	case peer.PeerDisconnected:
+		c.pieceManager.RemovePeer(ev.Peer.Address().String())
+		if c.releasePeer(ev.Peer.Address().String()) > 0 {
+			c.post(event{kind: eventBlocksReleased})
+		}
 	}
+}
+
+// releasePeer drops every request outstanding at a peer, along with the
+// pieces it was working on, and returns how many requests there were
+func (c *Coordinator) releasePeer(peerID string) int {
+	released := c.requests.ReleasePeer(peerID)
+	c.pieceManager.UnassignPeer(peerID)
+	return len(released)
+}
+
+// HandlePieceVerified wakes the coordinator when a piece is stored
+func (c *Coordinator) HandlePieceVerified(index int) {
+	c.post(event{kind: eventPieceVerified})
+}
+
+// HandlePieceFailed wakes the coordinator to request a failed piece again
+func (c *Coordinator) HandlePieceFailed(index int, err error) {
+	c.post(event{kind: eventBlocksReleased})
+}
+
+// HandleTorrentComplete is called once every piece is verified
+func (c *Coordinator) HandleTorrentComplete() {
+	c.logger.Info("Download complete")
+}
+
+// processDownloadCycle refreshes the needed pieces and requests blocks
+// from every peer that can take more
+func (c *Coordinator) processDownloadCycle() {
+	c.refreshNeeded()
+	defer c.updateProgress()
 	
-	// Update interest states for all peers
+	peers := c.peerManager.GetConnectedPeers()
+	
+	// Update interest states for all peers, dropping interest in those
+	// left with nothing we need by a verified piece
 	for _, p := range peers {
-		if err := p.EnsureInterested(neededPieces); err != nil {
-			log.Printf("Failed to update interest for peer %s: %v", p.Address(), err)
-		}
+		c.updateInterest(p)
+	}
+	
+	if len(c.needed) == 0 {
+		return // Download complete
 	}
 	
 	// Request pieces from ALL peers that can provide them (parallel downloads)
-	downloadablePeers := 0
 	for _, p := range peers {
-		if p.CanDownload() {
-			downloadablePeers++
-			c.requestPiecesFromPeer(p, neededPieces)
-		}
+		c.servePeer(p)
+	}
+}
+
+// updateInterest tells a peer whether we are interested in it, going by
+// every piece we still need rather than the truncated needed list
+func (c *Coordinator) updateInterest(p *peer.Peer) {
+	interested := c.pieceManager.PeerInteresting(p.Address().String())
+	if err := p.SetInterested(interested); err != nil {
+		c.logger.Debug("Failed to update interest", "peer", p.Address(), "err", err)
+	}
+}
+
+// refreshNeeded reloads the pieces still to download
+func (c *Coordinator) refreshNeeded() {
+	needed := c.pieceManager.GetNeededPieces()
+	if len(needed) > maxNeededPieces {
+		needed = needed[:maxNeededPieces]
+	}
+	c.needed = needed
+	c.setEndgame(len(needed) > 0 && !c.pieceManager.HasUnrequestedBlocks())
+}
+
+// setEndgame records whether the download is in its endgame
+func (c *Coordinator) setEndgame(endgame bool) {
+	if endgame && !c.endgame {
+		c.logger.Debug("Entering endgame", "pieces", len(c.needed))
+	}
+	c.endgame = endgame
+}
+
+// servePeer requests blocks from a peer that is unchoking us
+func (c *Coordinator) servePeer(p *peer.Peer) {
+	if len(c.needed) == 0 || !p.CanDownload() {
+		return
 	}
 	
-	if downloadablePeers > 0 {
-		log.Printf("Requesting from %d downloadable peers", downloadablePeers)
+	// Snubbed peers get no new pieces until the endgame
+	if p.IsSnubbed() && !c.endgame {
+		return
 	}
 	
-	// Update progress
-	c.updateProgress()
+	c.requestPiecesFromPeer(p, c.needed)
 }
 
 // requestPiecesFromPeer requests pieces from a specific peer
 func (c *Coordinator) requestPiecesFromPeer(p *peer.Peer, neededPieces []int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	peerID := p.Address().String()
+	
+	// Never queue more than the peer advertised it will hold
+	maxRequests := c.maxRequestsPerPeer
+	if reqq := p.MaxOutstandingRequests(); reqq < maxRequests {
+		maxRequests = reqq
+	}
 	
 	// Count active requests for this peer
-	activeCount := c.countActiveRequestsForPeer(p)
-	if activeCount >= c.maxRequestsPerPeer {
+	activeCount := c.requests.PeerCount(peerID)
+	if activeCount >= maxRequests {
 		return // Already at request limit for this peer
 	}
 	
 	// Check if peer has a bitfield
 	bitfield := p.GetBitfield()
 	if bitfield == nil {
-		log.Printf("Peer %s has no bitfield yet", p.Address())
 		return
 	}
 	
-	// Find pieces this peer has that we need
-	availablePieces := make([]int, 0)
+	// Skip peers that have nothing we need
+	hasNeeded := false
 	for _, pieceIndex := range neededPieces {
 		if p.HasPiece(pieceIndex) {
-			availablePieces = append(availablePieces, pieceIndex)
+			hasNeeded = true
+			break
 		}
 	}
-	
-	if len(availablePieces) == 0 {
-		log.Printf("Peer %s has bitfield but no pieces we need (checked %d pieces)", p.Address(), len(neededPieces))
-		return // Peer has no pieces we need
+	if !hasNeeded {
+		return
 	}
 	
-	log.Printf("Peer %s has %d pieces we need", p.Address(), len(availablePieces))
-	
-	// Select a piece using the piece manager's strategy
-	pieceIndex, err := c.pieceManager.SelectPieceForPeer(bitfield)
-	if err != nil {
-		return // No piece selected
+	// Fill the peer's request slots, taking on more pieces as the ones it
+	// owns run out of unrequested blocks
+	requestsToMake := maxRequests - activeCount
+	for requestsToMake > 0 {
+		pieceIndex, err := c.pieceManager.AssignPiece(peerID, bitfield, c.endgame)
+		if errors.Is(err, piece.ErrPartialLimit) {
+			return // Started pieces are to be finished first
+		}
+		if err != nil && !c.endgame && !c.pieceManager.HasUnrequestedBlocks() {
+			// The last blocks were just requested; share the pieces
+			c.setEndgame(true)
+			pieceIndex, err = c.pieceManager.AssignPiece(peerID, bitfield, true)
+		}
+		if err != nil {
+			return // No piece selected
+		}
+		
+		made := c.requestBlocks(p, pieceIndex, requestsToMake)
+		if made == 0 {
+			return
+		}
+		requestsToMake -= made
 	}
-	
+}
+
+// requestBlocks requests up to limit unrequested blocks of a piece from a
+// peer, or in the endgame blocks requested from one other peer, and
+// returns how many were requested. Each request times out after the
+// peer's request timeout, which follows its latency.
+func (c *Coordinator) requestBlocks(p *peer.Peer, pieceIndex, limit int) int {
 	// Get block requests for this piece
 	blockRequests := c.pieceManager.GetBlockRequests(pieceIndex)
 	
-	// Request blocks aggressively until we hit the limit
-	requestsToMake := c.maxRequestsPerPeer - activeCount
+	peerID := p.Address().String()
 	requestsMade := 0
 	for _, blockReq := range blockRequests {
-		if requestsMade >= requestsToMake {
+		if requestsMade >= limit {
 			break
 		}
 		
-		// Check if this block is already requested
-		requestKey := fmt.Sprintf("%d:%d", pieceIndex, blockReq.Begin)
-		if _, exists := c.activeRequests[requestKey]; exists {
+		// Take the block unless it is already requested, from this peer
+		// or outside the endgame, or timed out at this peer and is to be
+		// retried elsewhere
+		now := time.Now()
+		req := piece.Request{
+			Piece:    pieceIndex,
+			Begin:    blockReq.Begin,
+			Length:   blockReq.Length,
+			Peer:     peerID,
+			At:       now,
+			Deadline: now.Add(p.RequestTimeout()),
+		}
+		cancel := func() {
+			p.Cancel(uint32(req.Piece), uint32(req.Begin), uint32(req.Length))
+		}
+		if !c.requests.Add(req, cancel, c.endgame) {
 			continue
 		}
 		
 		// Send the request
 		if err := p.RequestPiece(uint32(pieceIndex), uint32(blockReq.Begin), uint32(blockReq.Length)); err != nil {
-			log.Printf("Failed to request piece %d block %d from peer %s: %v", pieceIndex, blockReq.Begin, p.Address(), err)
+			c.logger.Debug("Failed to request block", "piece", pieceIndex, "begin", blockReq.Begin, "peer", p.Address(), "err", err)
+			c.requests.ReleaseAt(pieceIndex, blockReq.Begin, peerID)
 			continue
 		}
 		
-		// Track the request
-		c.activeRequests[requestKey] = &RequestInfo{
-			PieceIndex:  pieceIndex,
-			Begin:       blockReq.Begin,
-			Length:      blockReq.Length,
-			RequestedAt: time.Now(),
-			Peer:        p,
-		}
-		
-		// Also track in piece manager
-		if err := c.pieceManager.RequestBlock(pieceIndex, blockReq.Begin, blockReq.Length); err != nil {
-			log.Printf("Failed to mark block as requested in piece manager: %v", err)
-		}
-		
-		log.Printf("Requested block %d:%d (length %d) from peer %s", 
-			pieceIndex, blockReq.Begin, blockReq.Length, p.Address())
 		requestsMade++
 	}
-}
-
-// countActiveRequestsForPeer counts active requests for a specific peer
-func (c *Coordinator) countActiveRequestsForPeer(targetPeer *peer.Peer) int {
-	count := 0
-	for _, req := range c.activeRequests {
-		if req.Peer == targetPeer {
-			count++
-		}
-	}
-	return count
+	return requestsMade
 }
 
 // timeoutLoop handles request timeouts
 func (c *Coordinator) timeoutLoop() {
 	defer c.wg.Done()
 	
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(TimeoutCheckInterval)
 	defer ticker.Stop()
 	
 	for {
@@ -266,37 +467,49 @@ func (c *Coordinator) timeoutLoop() {
 	}
 }
 
-// cleanupTimedOutRequests removes timed out requests
+// cleanupTimedOutRequests cancels requests that are past their deadline
+// and frees the blocks for another peer. The slow peer gives up its pieces
+// so that, outside the endgame, someone else may take them on.
 func (c *Coordinator) cleanupTimedOutRequests() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	expired := c.requests.Expire(time.Now())
+	if len(expired) == 0 {
+		return
+	}
 	
-	now := time.Now()
-	for key, req := range c.activeRequests {
-		if now.Sub(req.RequestedAt) > c.requestTimeout {
-			log.Printf("Request timeout for block %d:%d from peer %s", 
-				req.PieceIndex, req.Begin, req.Peer.Address())
-			delete(c.activeRequests, key)
-		}
+	slow := make(map[string]bool)
+	for _, req := range expired {
+		c.logger.Debug("Request timed out", "piece", req.Piece, "begin", req.Begin, "peer", req.Peer, "timeout", req.Deadline.Sub(req.At))
+		req.Cancel()
+		slow[req.Peer] = true
 	}
+	for peerID := range slow {
+		c.pieceManager.UnassignPeer(peerID)
+	}
+	c.post(event{kind: eventBlocksReleased})
 }
 
-// HandlePieceReceived should be called when a piece block is received
+// HandlePieceReceived should be called when a piece block is received. The
+// peer that sent it has a free request slot, so it is asked for more.
 func (c *Coordinator) HandlePieceReceived(pieceIndex, begin int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	
-	requestKey := fmt.Sprintf("%d:%d", pieceIndex, begin)
-	if req, exists := c.activeRequests[requestKey]; exists {
-		duration := time.Since(req.RequestedAt)
-		log.Printf("Received block %d:%d (length %d) from peer %s in %v", 
-			pieceIndex, begin, req.Length, req.Peer.Address(), duration.Round(time.Millisecond))
-		delete(c.activeRequests, requestKey)
-	} else {
-		log.Printf("Warning: Received unrequested block %d:%d", pieceIndex, begin)
+	req, exists := c.requests.Complete(pieceIndex, begin)
+	if !exists {
+		return
+	}
+	if p := c.connectedPeer(req.Peer); p != nil {
+		c.post(event{kind: eventPeerReady, peer: p})
 	}
 }
 
+// connectedPeer returns the connected peer with an ID, or nil
+func (c *Coordinator) connectedPeer(peerID string) *peer.Peer {
+	for _, p := range c.peerManager.GetConnectedPeers() {
+		if p.Address().String() == peerID {
+			return p
+		}
+	}
+	return nil
+}
+
 // updateProgress updates download statistics
 func (c *Coordinator) updateProgress() {
 	downloaded, total := c.pieceManager.GetProgressCounts()
@@ -315,9 +528,7 @@ func (c *Coordinator) GetProgress() (downloaded, total int) {
 
 // GetActiveRequestCount returns the number of active requests
 func (c *Coordinator) GetActiveRequestCount() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return len(c.activeRequests)
+	return c.requests.Count()
 }
 
 // IsDownloadComplete returns true if all pieces are downloaded
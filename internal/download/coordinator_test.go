@@ -0,0 +1,421 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// noPeers is a peer manager with nobody connected
+type noPeers struct{}
+
+func (noPeers) GetConnectedPeers() []*peer.Peer { return nil }
+
+// connectedPeers is a peer manager with the given peers connected
+type connectedPeers []*peer.Peer
+
+func (c connectedPeers) GetConnectedPeers() []*peer.Peer { return c }
+
+// fakePieces records the peers unassigned from their pieces
+type fakePieces struct {
+	requests   *piece.Requests
+	unassigned []string
+	tracked    map[string][]int // pieces announced by each peer
+
+	allRequested bool // every remaining block is requested
+
+	blocks []piece.BlockRequest // missing blocks of every piece
+}
+
+func (f *fakePieces) GetNeededPieces() []int { return []int{0, 1} }
+func (f *fakePieces) HasUnrequestedBlocks() bool {
+	return !f.allRequested
+}
+func (f *fakePieces) AssignPiece(peerID string, peerBitfield []byte, endgame bool) (int, error) {
+	return 0, nil
+}
+func (f *fakePieces) UnassignPeer(peerID string) {
+	f.unassigned = append(f.unassigned, peerID)
+}
+func (f *fakePieces) GetBlockRequests(pieceIndex int) []piece.BlockRequest {
+	return f.blocks
+}
+func (f *fakePieces) Requests() *piece.Requests {
+	if f.requests == nil {
+		f.requests = piece.NewRequests()
+	}
+	return f.requests
+}
+func (f *fakePieces) UpdatePeerBitfield(peerID string, bitfield []byte) {
+	f.track()[peerID] = nil
+	for i := 0; i < len(bitfield)*8; i++ {
+		if bitfield[i/8]&(1<<(7-i%8)) != 0 {
+			f.tracked[peerID] = append(f.tracked[peerID], i)
+		}
+	}
+}
+func (f *fakePieces) PeerHave(peerID string, index int) {
+	f.track()[peerID] = append(f.tracked[peerID], index)
+}
+func (f *fakePieces) PeerHaveAll(peerID string) {
+	f.track()[peerID] = []int{0, 1}
+}
+func (f *fakePieces) PeerInteresting(peerID string) bool {
+	return len(f.tracked[peerID]) > 0
+}
+func (f *fakePieces) RemovePeer(peerID string) { delete(f.track(), peerID) }
+func (f *fakePieces) track() map[string][]int {
+	if f.tracked == nil {
+		f.tracked = make(map[string][]int)
+	}
+	return f.tracked
+}
+func (f *fakePieces) GetProgressCounts() (downloaded, total int) {
+	return 0, 2
+}
+
+// testConn is a pipe with the remote address of a TCP connection, so
+// test peers have IDs of their own
+type testConn struct {
+	net.Conn
+	addr *net.TCPAddr
+}
+
+func (c testConn) RemoteAddr() net.Addr { return c.addr }
+
+// testPeers counts the peers made by newTestPeer
+var testPeers int
+
+// newTestPeer returns an unstarted peer over a pipe
+func newTestPeer(t *testing.T) *peer.Peer {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	testPeers++
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, byte(testPeers>>8), byte(testPeers)), Port: 6881}
+	return peer.NewPeer(testConn{client, addr}, [20]byte{}, [20]byte{})
+}
+
+// newUnchokedPeer returns a started peer over a pipe that has unchoked us
+func newUnchokedPeer(t *testing.T) *peer.Peer {
+	t.Helper()
+
+	server, client := net.Pipe()
+	testPeers++
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, byte(testPeers>>8), byte(testPeers)), Port: 6881}
+	p := peer.NewPeer(testConn{client, addr}, [20]byte{}, [20]byte{})
+	t.Cleanup(func() {
+		p.Stop()
+		server.Close()
+		client.Close()
+	})
+
+	go func() {
+		if _, err := peer.Read(server); err != nil {
+			return
+		}
+		peer.NewHandshake([20]byte{}, [20]byte{1}).Write(server)
+		server.Write(peer.NewUnchokeMessage().Serialize())
+		io.Copy(io.Discard, server)
+	}()
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); p.GetState().PeerChoking; {
+		if time.Now().After(deadline) {
+			t.Fatal("peer never unchoked us")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return p
+}
+
+// track records an outstanding request as requestBlocks would
+func track(c *Coordinator, p *peer.Peer, pieceIndex, begin int, at time.Time) {
+	c.requests.Add(piece.Request{
+		Piece:    pieceIndex,
+		Begin:    begin,
+		Length:   piece.BlockSize,
+		Peer:     p.Address().String(),
+		At:       at,
+		Deadline: at.Add(p.RequestTimeout()),
+	}, nil, false)
+}
+
+func TestDisconnectReleasesRequests(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	gone, staying := newTestPeer(t), newTestPeer(t)
+
+	now := time.Now()
+	track(c, gone, 0, 0, now)
+	track(c, gone, 0, piece.BlockSize, now)
+	track(c, staying, 1, 0, now)
+
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerDisconnected, Peer: gone})
+
+	if got := c.GetActiveRequestCount(); got != 1 {
+		t.Errorf("active requests = %d, want 1", got)
+	}
+	if c.requests.Requested(0, 0) || c.requests.Requested(0, piece.BlockSize) {
+		t.Error("blocks requested from the disconnected peer still requested")
+	}
+	if len(pieces.unassigned) != 1 || pieces.unassigned[0] != gone.Address().String() {
+		t.Errorf("unassigned = %v, want the disconnected peer", pieces.unassigned)
+	}
+
+	select {
+	case ev := <-c.events:
+		if ev.kind != eventBlocksReleased {
+			t.Errorf("event = %v, want blocks released", ev.kind)
+		}
+	default:
+		t.Error("no event posted for the released blocks")
+	}
+
+	// A peer with nothing outstanding wakes nobody
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerDisconnected, Peer: newTestPeer(t)})
+	select {
+	case ev := <-c.events:
+		t.Errorf("unexpected event %v", ev.kind)
+	default:
+	}
+}
+
+func TestTimedOutRequestsReleased(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	p := newTestPeer(t)
+
+	track(c, p, 0, 0, time.Now().Add(-time.Hour))
+	track(c, p, 0, piece.BlockSize, time.Now())
+
+	c.cleanupTimedOutRequests()
+
+	if got := c.GetActiveRequestCount(); got != 1 {
+		t.Errorf("active requests = %d, want 1", got)
+	}
+	if c.requests.Requested(0, 0) {
+		t.Error("timed out block still requested")
+	}
+	if len(pieces.unassigned) != 1 {
+		t.Errorf("unassigned = %v, want the slow peer", pieces.unassigned)
+	}
+
+	// The block is retried at another peer, not the one it timed out at
+	if peerID, _ := c.requests.TimedOutAt(0, 0); peerID != p.Address().String() {
+		t.Error("timed out block not remembered")
+	}
+	track(c, p, 0, 0, time.Now())
+	if c.requests.Requested(0, 0) {
+		t.Error("timed out block requested again from the same peer")
+	}
+	c.HandlePieceReceived(0, 0)
+	if _, ok := c.requests.TimedOutAt(0, 0); ok {
+		t.Error("received block still remembered as timed out")
+	}
+}
+
+func TestChokeReleasesRequests(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	choking, other := newTestPeer(t), newTestPeer(t)
+
+	now := time.Now()
+	track(c, choking, 0, 0, now)
+	track(c, other, 0, piece.BlockSize, now)
+
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerChoked, Peer: choking})
+
+	if got := c.GetActiveRequestCount(); got != 1 {
+		t.Errorf("active requests = %d, want 1", got)
+	}
+	if c.requests.Requested(0, 0) {
+		t.Error("block requested from the choking peer still requested")
+	}
+	if len(c.events) != 1 {
+		t.Errorf("%d events posted, want 1", len(c.events))
+	}
+}
+
+func TestRejectReleasesRequest(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	rejecting := newTestPeer(t)
+
+	now := time.Now()
+	track(c, rejecting, 0, 0, now)
+	track(c, rejecting, 0, piece.BlockSize, now)
+
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerRejected, Peer: rejecting, Piece: 0, Begin: piece.BlockSize})
+
+	if c.requests.Requested(0, piece.BlockSize) {
+		t.Error("rejected block still requested")
+	}
+	if !c.requests.Requested(0, 0) {
+		t.Error("block the peer did not reject was released")
+	}
+	if len(c.events) != 1 {
+		t.Errorf("%d events posted, want 1", len(c.events))
+	}
+
+	// A reject for a block not requested from the peer changes nothing
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerRejected, Peer: rejecting, Piece: 1, Begin: 0})
+	if len(c.events) != 1 {
+		t.Errorf("%d events posted after a stray reject, want 1", len(c.events))
+	}
+}
+
+func TestPeerAnnouncementsReachStrategy(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	p := newTestPeer(t)
+	id := p.Address().String()
+
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerBitfield, Peer: p})
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerHave, Peer: p, Piece: 4})
+
+	if got, ok := pieces.tracked[id]; !ok || len(got) != 1 || got[0] != 4 {
+		t.Errorf("tracked pieces = %v, %v, want [4]", got, ok)
+	}
+	if len(c.events) != 2 {
+		t.Errorf("%d events posted, want 2", len(c.events))
+	}
+
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerDisconnected, Peer: p})
+	if _, ok := pieces.tracked[id]; ok {
+		t.Error("disconnected peer still tracked")
+	}
+}
+
+func TestInterestFollowsAnnouncements(t *testing.T) {
+	pieces := &fakePieces{}
+	p := newTestPeer(t)
+	c := NewCoordinator(connectedPeers{p}, pieces)
+
+	// The piece is beyond anything in the needed list
+	c.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerHave, Peer: p, Piece: 1000})
+	c.handleEvent(<-c.events)
+	if !p.GetState().AmInterested {
+		t.Error("not interested in a peer that announced a needed piece")
+	}
+
+	delete(pieces.tracked, p.Address().String())
+	c.processDownloadCycle()
+	if p.GetState().AmInterested {
+		t.Error("still interested in a peer with nothing we need")
+	}
+}
+
+func TestDroppedEventsCaughtUp(t *testing.T) {
+	pieces := &fakePieces{}
+	p := newTestPeer(t)
+	c := NewCoordinator(connectedPeers{p}, pieces)
+	pieces.PeerHave(p.Address().String(), 0)
+
+	other := newTestPeer(t)
+	for i := 0; i <= MaxPendingEvents; i++ {
+		c.post(event{kind: eventPeerReady, peer: other})
+	}
+	if !c.dropped.Load() {
+		t.Fatal("event beyond the queue not recorded as dropped")
+	}
+
+	// Events about another peer leave p alone until the queue drains
+	for len(c.events) > 1 {
+		c.handleEvent(<-c.events)
+		c.catchUp()
+	}
+	if p.GetState().AmInterested {
+		t.Fatal("catch-up pass ran before the queue drained")
+	}
+	c.handleEvent(<-c.events)
+	c.catchUp()
+	if !p.GetState().AmInterested || c.dropped.Load() {
+		t.Error("no catch-up pass once the queue drained")
+	}
+}
+
+func TestStopReleasesRequests(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	p := newTestPeer(t)
+
+	track(c, p, 0, 0, time.Now())
+	track(c, p, 0, piece.BlockSize, time.Now())
+
+	c.Start()
+	c.Stop()
+
+	if got := c.GetActiveRequestCount(); got != 0 {
+		t.Errorf("active requests = %d after Stop, want 0", got)
+	}
+	if len(pieces.unassigned) != 1 {
+		t.Errorf("unassigned = %v, want the peer", pieces.unassigned)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+	p := newTestPeer(t)
+	track(c, p, 0, 0, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.StartContext(ctx)
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for c.GetActiveRequestCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests not released after the context was cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Stop()
+}
+
+func TestEndgameWhenAllBlocksRequested(t *testing.T) {
+	pieces := &fakePieces{}
+	c := NewCoordinator(noPeers{}, pieces)
+
+	c.refreshNeeded()
+	if c.endgame {
+		t.Error("endgame with unrequested blocks left")
+	}
+
+	pieces.allRequested = true
+	c.refreshNeeded()
+	if !c.endgame {
+		t.Error("no endgame once every block is requested")
+	}
+}
+
+func TestEndgameRequestsBlocksInFlight(t *testing.T) {
+	pieces := &fakePieces{blocks: []piece.BlockRequest{{Begin: 0, Length: piece.BlockSize}}}
+	c := NewCoordinator(noPeers{}, pieces)
+	slow, fast := newTestPeer(t), newUnchokedPeer(t)
+	track(c, slow, 0, 0, time.Now())
+
+	if made := c.requestBlocks(fast, 0, 1); made != 0 {
+		t.Errorf("requested %d blocks in flight outside the endgame, want 0", made)
+	}
+
+	// In the endgame a second peer is asked for the block too
+	c.endgame = true
+	if made := c.requestBlocks(fast, 0, 1); made != 1 {
+		t.Fatalf("requested %d blocks in flight in the endgame, want 1", made)
+	}
+	if c.requests.PeerCount(slow.Address().String()) != 1 || c.requests.PeerCount(fast.Address().String()) != 1 {
+		t.Error("block not requested from both peers")
+	}
+}
@@ -0,0 +1,223 @@
+// Package hooks runs a user's command and posts to a webhook when a
+// torrent finishes downloading or fails, so media managers and other
+// automation can pick up the result.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+// DefaultTimeout bounds each command and webhook request
+const DefaultTimeout = time.Minute
+
+// Event types
+const (
+	EventComplete = "complete"
+	EventError    = "error"
+)
+
+// Config says what to run. Empty fields are skipped.
+type Config struct {
+	OnComplete string        // program run when a torrent finishes downloading
+	OnError    string        // program run when a torrent stops or pauses with an error
+	Webhook    string        // URL an Event is POSTed to as JSON for both
+	Timeout    time.Duration // per command or request, 0 for DefaultTimeout
+}
+
+// Event describes the torrent a hook fires for. Commands receive it in
+// BT_* environment variables, webhooks as the JSON body.
+type Event struct {
+	Event      string    `json:"event"`
+	InfoHash   string    `json:"infoHash"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"` // the torrent's file or directory
+	SaveDir    string    `json:"saveDir"`
+	Size       int64     `json:"size"`
+	Downloaded int64     `json:"downloaded"`
+	Uploaded   int64     `json:"uploaded"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// env returns the event as environment variables for a command
+func (e Event) env() []string {
+	return []string{
+		"BT_EVENT=" + e.Event,
+		"BT_INFO_HASH=" + e.InfoHash,
+		"BT_NAME=" + e.Name,
+		"BT_PATH=" + e.Path,
+		"BT_SAVE_DIR=" + e.SaveDir,
+		"BT_SIZE=" + strconv.FormatInt(e.Size, 10),
+		"BT_DOWNLOADED=" + strconv.FormatInt(e.Downloaded, 10),
+		"BT_UPLOADED=" + strconv.FormatInt(e.Uploaded, 10),
+		"BT_ERROR=" + e.Error,
+	}
+}
+
+// Runner fires the configured hooks for a session's torrents
+type Runner struct {
+	config Config
+	client *http.Client
+	logger *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a runner watching the session's torrents. Hooks run in the
+// background; Close waits for those still running.
+func New(s *session.Session, config Config) *Runner {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Runner{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		logger: s.Logger().Component(logging.Hooks),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.Subscribe(r)
+	return r
+}
+
+// Close waits for running hooks to finish, cancelling them if they take
+// longer than the timeout
+func (r *Runner) Close() {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(r.config.Timeout):
+		r.cancel()
+		<-done
+	}
+	r.cancel()
+}
+
+// HandleStateChange fires the hooks for a torrent that finished
+// downloading or stopped with an error. It is called with no locks held
+// and must not block, so the hooks run in the background.
+func (r *Runner) HandleStateChange(h *session.Handle, from, to session.State) {
+	var event Event
+	switch {
+	case from == session.StateDownloading && to == session.StateSeeding:
+		event = newEvent(EventComplete, h)
+	case to == session.StateError && !errors.Is(h.Err(), session.ErrSessionClosed):
+		event = newEvent(EventError, h)
+	case to == session.StatePaused && h.Err() != nil:
+		// Paused by a disk error rather than by hand
+		event = newEvent(EventError, h)
+	default:
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.fire(event)
+	}()
+}
+
+// newEvent describes a torrent for a hook
+func newEvent(kind string, h *session.Handle) Event {
+	counters := h.Counters()
+	event := Event{
+		Event:      kind,
+		InfoHash:   h.Torrent().InfoHashString(),
+		Name:       h.Name(),
+		Path:       filepath.Join(h.SaveDir(), h.Name()),
+		SaveDir:    h.SaveDir(),
+		Size:       counters.Size,
+		Downloaded: counters.Downloaded,
+		Uploaded:   counters.Uploaded,
+		Time:       time.Now(),
+	}
+	if err := h.Err(); err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// fire runs the command for the event and posts it to the webhook
+func (r *Runner) fire(event Event) {
+	command := r.config.OnComplete
+	if event.Event == EventError {
+		command = r.config.OnError
+	}
+
+	logger := r.logger.With("event", event.Event, "torrent", event.Name)
+	if command != "" {
+		if err := r.run(command, event); err != nil {
+			logger.Error("Hook command failed", "command", command, "err", err)
+		}
+	}
+	if r.config.Webhook != "" {
+		if err := r.post(event); err != nil {
+			logger.Error("Webhook failed", "url", r.config.Webhook, "err", err)
+		}
+	}
+}
+
+// run executes a hook command with the event in its environment
+func (r *Runner) run(command string, event Event) error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Env = append(os.Environ(), event.env()...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+		return err
+	}
+	return nil
+}
+
+// post sends the event to the webhook as JSON
+func (r *Runner) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodPost, r.config.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
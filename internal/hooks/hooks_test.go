@@ -0,0 +1,140 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// newTestHandle returns a handle for a one-piece torrent in a new session
+func newTestHandle(t *testing.T) (*session.Session, *session.Handle) {
+	t.Helper()
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "hooked.bin",
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("a", 20),
+			"length":       int64(1000),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	config := session.DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	s, err := session.New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	return s, h
+}
+
+// webhookRecorder collects the events posted to it
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.mu.Lock()
+	w.events = append(w.events, event)
+	w.mu.Unlock()
+}
+
+func TestWebhook(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	s, h := newTestHandle(t)
+	r := New(s, Config{Webhook: server.URL})
+
+	r.HandleStateChange(h, session.StateDownloading, session.StateSeeding)
+	r.HandleStateChange(h, session.StateQueued, session.StateDownloading) // not hooked
+	r.HandleStateChange(h, session.StateDownloading, session.StatePaused) // by hand, not hooked
+	r.HandleStateChange(h, session.StateDownloading, session.StateError)
+	r.Close()
+
+	if len(recorder.events) != 2 {
+		t.Fatalf("webhook received %d events, want 2", len(recorder.events))
+	}
+	kinds := map[string]bool{}
+	for _, event := range recorder.events {
+		kinds[event.Event] = true
+		if event.Name != "hooked.bin" || event.Size != 1000 || event.InfoHash != h.Torrent().InfoHashString() {
+			t.Errorf("event = %+v, want hooked.bin of 1000 bytes", event)
+		}
+		if want := filepath.Join(h.SaveDir(), "hooked.bin"); event.Path != want {
+			t.Errorf("Path = %q, want %q", event.Path, want)
+		}
+	}
+	if !kinds[EventComplete] || !kinds[EventError] {
+		t.Errorf("events = %v, want complete and error", kinds)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "env")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nenv | grep ^BT_ > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s, h := newTestHandle(t)
+	r := New(s, Config{OnComplete: script})
+	r.HandleStateChange(h, session.StateDownloading, session.StateSeeding)
+	r.Close()
+
+	env, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook did not run: %v", err)
+	}
+	for _, want := range []string{"BT_EVENT=complete", "BT_NAME=hooked.bin", "BT_SIZE=1000"} {
+		if !strings.Contains(string(env), want+"\n") {
+			t.Errorf("environment lacks %s:\n%s", want, env)
+		}
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	s, _ := newTestHandle(t)
+	r := New(s, Config{Webhook: server.URL})
+	defer r.Close()
+
+	if err := r.post(Event{Event: EventComplete}); err == nil {
+		t.Error("post succeeded against a failing webhook")
+	}
+}
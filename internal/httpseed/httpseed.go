@@ -0,0 +1,264 @@
+// Package httpseed downloads pieces from BEP 17 HTTP seeds. An HTTP seed
+// is a script that serves a torrent's pieces by info hash and index:
+//
+//	GET <url>?info_hash=<20 bytes, escaped>&piece=<index>
+//
+// A busy seed answers 503 with the number of seconds to wait in the body.
+package httpseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/ratelimit"
+)
+
+const (
+	// RequestTimeout bounds a single piece request
+	RequestTimeout = 60 * time.Second
+
+	// RetryDelay is the wait after a failed request, doubled with each
+	// failure in a row
+	RetryDelay = 30 * time.Second
+
+	// DefaultBusyDelay is the wait after a 503 that does not say how long
+	// to wait
+	DefaultBusyDelay = 60 * time.Second
+
+	// MaxFailures is how many failed requests in a row make us give up on
+	// a seed
+	MaxFailures = 5
+
+	// IdleDelay is how long to wait before asking for another piece when
+	// none is free
+	IdleDelay = 5 * time.Second
+)
+
+// BusyError is returned when a seed is too busy to serve a piece
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("http seed busy, retry after %v", e.RetryAfter)
+}
+
+// PieceURL returns the URL of a piece on the seed at base
+func PieceURL(base string, infoHash [20]byte, index int) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid http seed URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported http seed scheme %q", u.Scheme)
+	}
+
+	// url.Values would sort the keys and re-escape the existing query
+	query := "info_hash=" + url.QueryEscape(string(infoHash[:])) + "&piece=" + strconv.Itoa(index)
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	u.RawQuery = query
+	return u.String(), nil
+}
+
+// Seed downloads pieces of one torrent from one HTTP seed
+type Seed struct {
+	url        string
+	infoHash   [20]byte
+	pieces     *piece.Manager
+	client     *http.Client
+	limiter    *ratelimit.Limiter
+	downloaded atomic.Int64
+	logger     *slog.Logger
+}
+
+// New creates a seed downloading pieces for pieces from the seed at
+// seedURL
+func New(seedURL string, infoHash [20]byte, pieces *piece.Manager) *Seed {
+	return &Seed{
+		url:      seedURL,
+		infoHash: infoHash,
+		pieces:   pieces,
+		client:   &http.Client{Timeout: RequestTimeout},
+		logger:   logging.Discard(),
+	}
+}
+
+// SetClient sets the HTTP client used for requests
+func (s *Seed) SetClient(client *http.Client) {
+	s.client = client
+}
+
+// SetRateLimiter sets the limiter that piece data is read through
+func (s *Seed) SetRateLimiter(limiter *ratelimit.Limiter) {
+	s.limiter = limiter
+}
+
+// SetLogger sets the seed's logger
+func (s *Seed) SetLogger(logger *slog.Logger) {
+	s.logger = logger.With("httpseed", s.url)
+}
+
+// URL returns the seed's URL
+func (s *Seed) URL() string {
+	return s.url
+}
+
+// Downloaded returns the bytes of piece data received from the seed
+func (s *Seed) Downloaded() int64 {
+	return s.downloaded.Load()
+}
+
+// id is the name the seed works on pieces under, and the source its
+// blocks are recorded with
+func (s *Seed) id() string {
+	return "httpseed:" + s.url
+}
+
+// FetchPiece downloads a piece of length bytes. A busy seed returns a
+// *BusyError.
+func (s *Seed) FetchPiece(ctx context.Context, index, length int) ([]byte, error) {
+	pieceURL, err := PieceURL(s.url, s.infoHash, index)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pieceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+		delay := DefaultBusyDelay
+		if seconds, err := strconv.Atoi(strings.TrimSpace(string(body))); err == nil && seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		return nil, &BusyError{RetryAfter: delay}
+	default:
+		return nil, fmt.Errorf("http seed returned %s", resp.Status)
+	}
+
+	var body io.Reader = io.LimitReader(resp.Body, int64(length)+1)
+	if s.limiter != nil {
+		body = limitedReader{body, s.limiter}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read piece %d: %w", index, err)
+	}
+	if len(data) != length {
+		return nil, fmt.Errorf("piece %d: got %d bytes, want %d", index, len(data), length)
+	}
+	return data, nil
+}
+
+// Run downloads pieces nobody else is working on until every wanted piece
+// is verified, ctx is done or the seed has failed MaxFailures times in a row.
+// Each piece is fetched from the seed at most once; a piece that fails its
+// hash check is left to peers.
+func (s *Seed) Run(ctx context.Context) {
+	// The pieces we may still ask the seed for
+	_, total := s.pieces.GetProgressCounts()
+	wanted := make([]byte, (total+7)/8)
+	for i := 0; i < total; i++ {
+		wanted[i/8] |= 0x80 >> (i % 8)
+	}
+
+	failures, remaining := 0, total
+	for remaining > 0 && s.pieces.BytesLeft() > 0 {
+		delay := time.Duration(0)
+		index, err := s.pieces.AssignPiece(s.id(), wanted, false)
+		if err != nil {
+			delay = IdleDelay
+		} else if err := s.download(ctx, index); err != nil {
+			var busy *BusyError
+			switch {
+			case ctx.Err() != nil:
+				return
+			case errors.As(err, &busy):
+				delay = busy.RetryAfter
+			default:
+				failures++
+				if failures >= MaxFailures {
+					s.logger.Warn("Giving up on http seed", "err", err)
+					return
+				}
+				delay = RetryDelay << (failures - 1)
+				s.logger.Debug("HTTP seed request failed", "piece", index, "err", err)
+			}
+		} else {
+			wanted[index/8] &^= 0x80 >> (index % 8)
+			remaining--
+			failures = 0
+		}
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// download fetches an assigned piece and hands its blocks to the piece
+// manager, releasing the piece either way
+func (s *Seed) download(ctx context.Context, index int) error {
+	defer s.pieces.UnassignPeer(s.id())
+
+	p := s.pieces.GetPiece(index)
+	if p == nil {
+		return fmt.Errorf("piece %d not found", index)
+	}
+	data, err := s.FetchPiece(ctx, index, p.Length)
+	if err != nil {
+		return err
+	}
+	s.downloaded.Add(int64(len(data)))
+
+	// Blocks that arrived from peers meanwhile are refused; that is fine
+	for begin := 0; begin < len(data); begin += piece.BlockSize {
+		end := min(begin+piece.BlockSize, len(data))
+		s.pieces.AddBlockDataFrom(index, begin, data[begin:end], s.id())
+	}
+	return nil
+}
+
+// limitedReader reads through a rate limiter
+type limitedReader struct {
+	r       io.Reader
+	limiter *ratelimit.Limiter
+}
+
+func (l limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.limiter.Wait(n)
+	}
+	return n, err
+}
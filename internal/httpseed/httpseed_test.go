@@ -0,0 +1,145 @@
+package httpseed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/swarmtest"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// newSeedServer serves the pieces of content for infoHash as an HTTP seed,
+// answering the first busy requests with 503
+func newSeedServer(t *testing.T, infoHash [20]byte, content []byte, pieceLength, busy int) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != string(infoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		if busy > 0 {
+			busy--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("1"))
+			return
+		}
+		index, err := strconv.Atoi(r.URL.Query().Get("piece"))
+		begin := index * pieceLength
+		if err != nil || index < 0 || begin >= len(content) {
+			http.Error(w, "no such piece", http.StatusBadRequest)
+			return
+		}
+		w.Write(content[begin:min(begin+pieceLength, len(content))])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newPieceManager returns a piece manager storing tor in memory
+func newPieceManager(tor *torrent.Torrent) *piece.Manager {
+	hashes := make([][20]byte, tor.NumPieces())
+	for i := range hashes {
+		hashes[i], _ = tor.PieceHash(i)
+	}
+	m := piece.NewManager(tor.NumPieces(), int(tor.Info.PieceLength), int(tor.PieceSize(tor.NumPieces()-1)), hashes)
+	m.SetDiskManager(swarmtest.NewStorage(tor))
+	m.SetSelectionStrategy(piece.NewSequentialStrategy())
+	return m
+}
+
+func TestPieceURL(t *testing.T) {
+	infoHash := [20]byte{'a', ' ', 0xff}
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"http://seed.example.com/seed.php", "http://seed.example.com/seed.php?info_hash=a+%FF%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&piece=3"},
+		{"https://seed.example.com/s?key=1", "https://seed.example.com/s?key=1&info_hash=a+%FF%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&piece=3"},
+	}
+	for _, tt := range tests {
+		got, err := PieceURL(tt.base, infoHash, 3)
+		if err != nil {
+			t.Fatalf("PieceURL(%q) failed: %v", tt.base, err)
+		}
+		if got != tt.want {
+			t.Errorf("PieceURL(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+
+	if _, err := PieceURL("ftp://seed.example.com/", infoHash, 0); err == nil {
+		t.Error("PieceURL accepted an ftp URL")
+	}
+}
+
+func TestFetchPiece(t *testing.T) {
+	content := bytes.Repeat([]byte("seed"), 5000)
+	infoHash := [20]byte{1}
+	server := newSeedServer(t, infoHash, content, 16384, 1)
+	seed := New(server.URL, infoHash, nil)
+
+	var busy *BusyError
+	if _, err := seed.FetchPiece(context.Background(), 0, 16384); !errors.As(err, &busy) || busy.RetryAfter != time.Second {
+		t.Errorf("FetchPiece of a busy seed = %v, want retry after 1s", err)
+	}
+
+	data, err := seed.FetchPiece(context.Background(), 1, len(content)-16384)
+	if err != nil {
+		t.Fatalf("FetchPiece failed: %v", err)
+	}
+	if !bytes.Equal(data, content[16384:]) {
+		t.Error("FetchPiece returned different data")
+	}
+
+	if _, err := seed.FetchPiece(context.Background(), 0, 1000); err == nil {
+		t.Error("FetchPiece accepted a piece of the wrong length")
+	}
+	if _, err := seed.FetchPiece(context.Background(), 9, 16384); err == nil {
+		t.Error("FetchPiece accepted an error status")
+	}
+}
+
+func TestRun(t *testing.T) {
+	content := make([]byte, 3*16384+100)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	tor, err := swarmtest.NewTorrent("seeded.bin", content, 16384)
+	if err != nil {
+		t.Fatalf("NewTorrent failed: %v", err)
+	}
+	pieces := newPieceManager(tor)
+	server := newSeedServer(t, tor.InfoHash, content, 16384, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	seed := New(server.URL, tor.InfoHash, pieces)
+
+	done := make(chan struct{})
+	go func() {
+		seed.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("Run did not finish the torrent")
+	}
+	pieces.Wait()
+
+	if !pieces.IsComplete() {
+		done, total := pieces.GetProgressCounts()
+		t.Fatalf("%d of %d pieces verified", done, total)
+	}
+	if got := seed.Downloaded(); got != int64(len(content)) {
+		t.Errorf("Downloaded = %d, want %d", got, len(content))
+	}
+}
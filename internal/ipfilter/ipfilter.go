@@ -0,0 +1,372 @@
+// Package ipfilter blocks peers by IP address using PeerGuardian, eMule
+// ipfilter.dat and CIDR block lists.
+package ipfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidRule is returned for rules that cannot be parsed
+var ErrInvalidRule = errors.New("invalid filter rule")
+
+// emuleAllowLevel is the eMule access level at or above which a range is
+// allowed rather than blocked
+const emuleAllowLevel = 128
+
+// Rule blocks every address from Start to End inclusive
+type Rule struct {
+	Start       netip.Addr
+	End         netip.Addr
+	Description string
+}
+
+// Contains returns true if addr is within the rule's range
+func (r Rule) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return r.Start.Compare(addr) <= 0 && addr.Compare(r.End) <= 0
+}
+
+// String returns the rule as start-end
+func (r Rule) String() string {
+	if r.Start == r.End {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// interval is a merged range in the lookup index
+type interval struct {
+	start, end netip.Addr
+}
+
+// Filter is a set of blocked address ranges. It is safe for concurrent use.
+type Filter struct {
+	mu    sync.RWMutex
+	rules []Rule
+	index []interval // sorted, non-overlapping
+}
+
+// New creates an empty filter
+func New() *Filter {
+	return &Filter{}
+}
+
+// Blocked returns true if ip falls in any blocked range
+func (f *Filter) Blocked(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return f.BlockedAddr(addr)
+}
+
+// BlockedAddr returns true if addr falls in any blocked range
+func (f *Filter) BlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Find the last interval starting at or before addr
+	i := sort.Search(len(f.index), func(i int) bool {
+		return f.index[i].start.Compare(addr) > 0
+	}) - 1
+
+	return i >= 0 && addr.Compare(f.index[i].end) <= 0
+}
+
+// Add adds a rule to the filter
+func (f *Filter) Add(rule Rule) error {
+	rule, err := normalize(rule)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rule)
+	f.rebuild()
+	return nil
+}
+
+// AddString parses and adds a single rule in any supported format
+func (f *Filter) AddString(spec string) error {
+	rule, ok, err := ParseRule(spec)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidRule, spec)
+	}
+	return f.Add(rule)
+}
+
+// Remove removes every rule covering exactly the range given by spec and
+// reports whether any was removed
+func (f *Filter) Remove(spec string) bool {
+	target, ok, err := ParseRule(spec)
+	if err != nil || !ok {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kept := f.rules[:0]
+	for _, rule := range f.rules {
+		if rule.Start != target.Start || rule.End != target.End {
+			kept = append(kept, rule)
+		}
+	}
+
+	removed := len(kept) != len(f.rules)
+	clear(f.rules[len(kept):])
+	f.rules = kept
+	if removed {
+		f.rebuild()
+	}
+	return removed
+}
+
+// Clear removes all rules
+func (f *Filter) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+	f.index = nil
+}
+
+// Rules returns a copy of all rules
+func (f *Filter) Rules() []Rule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	rules := make([]Rule, len(f.rules))
+	copy(rules, f.rules)
+	return rules
+}
+
+// Len returns the number of rules
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.rules)
+}
+
+// LoadFile adds the rules from a block list file
+func (f *Filter) LoadFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open block list: %w", err)
+	}
+	defer file.Close()
+
+	return f.Load(file)
+}
+
+// Load adds rules from a block list, one per line, in PeerGuardian, eMule
+// or CIDR format. Comments and lines that cannot be parsed are skipped, as
+// published lists often contain a few. It returns the number of rules added.
+func (f *Filter) Load(r io.Reader) (int, error) {
+	var rules []Rule
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rule, ok, err := ParseRule(scanner.Text())
+		if err != nil || !ok {
+			continue
+		}
+		if rule, err = normalize(rule); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read block list: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rules...)
+	f.rebuild()
+	return len(rules), nil
+}
+
+// rebuild regenerates the lookup index from the rules (must hold lock)
+func (f *Filter) rebuild() {
+	index := make([]interval, 0, len(f.rules))
+	for _, rule := range f.rules {
+		index = append(index, interval{rule.Start, rule.End})
+	}
+
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].start.Compare(index[j].start) < 0
+	})
+
+	// Merge overlapping and adjacent ranges so every lookup is a single
+	// binary search
+	merged := index[:0]
+	for _, iv := range index {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if iv.start.Compare(last.end) <= 0 || last.end.Next() == iv.start {
+				if iv.end.Compare(last.end) > 0 {
+					last.end = iv.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, iv)
+	}
+
+	f.index = merged
+}
+
+// normalize unmaps IPv4-in-IPv6 addresses and checks the range is valid
+func normalize(rule Rule) (Rule, error) {
+	rule.Start = rule.Start.Unmap()
+	rule.End = rule.End.Unmap()
+
+	if !rule.Start.IsValid() || !rule.End.IsValid() {
+		return rule, fmt.Errorf("%w: missing address", ErrInvalidRule)
+	}
+	if rule.Start.Is4() != rule.End.Is4() {
+		return rule, fmt.Errorf("%w: mixed address families in %s", ErrInvalidRule, rule)
+	}
+	if rule.Start.Compare(rule.End) > 0 {
+		return rule, fmt.Errorf("%w: start after end in %s", ErrInvalidRule, rule)
+	}
+	return rule, nil
+}
+
+// ParseRule parses one block list line. It accepts
+//
+//	description:1.2.3.0-1.2.3.255             (PeerGuardian)
+//	001.002.003.000 - 001.002.003.255 , 000 , description  (eMule)
+//	10.0.0.0/8, 2001:db8::/32, 192.0.2.1      (CIDR or single address)
+//
+// ok is false for blank lines, comments and eMule ranges whose access
+// level allows the range.
+func ParseRule(line string) (rule Rule, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+		return Rule{}, false, nil
+	}
+
+	// eMule: range, access level, description
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if rule, err := parseRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return Rule{}, false, fmt.Errorf("%w: bad access level in %q", ErrInvalidRule, line)
+			}
+			if level >= emuleAllowLevel {
+				return Rule{}, false, nil
+			}
+			if len(fields) > 2 {
+				rule.Description = strings.TrimSpace(strings.Join(fields[2:], ","))
+			}
+			return rule, true, nil
+		}
+	}
+
+	// PeerGuardian: the description may itself contain colons, so split
+	// at the last one before the range
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], "-") && strings.Count(line[i+1:], ".") > 0 {
+		rule, err := parseRange(line[i+1:])
+		if err != nil {
+			return Rule{}, false, err
+		}
+		rule.Description = strings.TrimSpace(line[:i])
+		return rule, true, nil
+	}
+
+	rule, err = parseRange(line)
+	if err != nil {
+		return Rule{}, false, err
+	}
+	return rule, true, nil
+}
+
+// parseRange parses start-end, a CIDR prefix or a single address
+func parseRange(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+
+	if start, end, found := strings.Cut(s, "-"); found {
+		startAddr, err := parseAddr(start)
+		if err != nil {
+			return Rule{}, err
+		}
+		endAddr, err := parseAddr(end)
+		if err != nil {
+			return Rule{}, err
+		}
+		return Rule{Start: startAddr, End: endAddr}, nil
+	}
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Rule{}, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		prefix = prefix.Masked()
+		return Rule{Start: prefix.Addr(), End: lastAddr(prefix)}, nil
+	}
+
+	addr, err := parseAddr(s)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Start: addr, End: addr}, nil
+}
+
+// parseAddr parses an address, accepting the zero-padded IPv4 octets
+// used by eMule lists
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Count(s, ".") == 3 && !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		var b [4]byte
+		for i, octet := range octets {
+			n, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("%w: bad address %q", ErrInvalidRule, s)
+			}
+			b[i] = byte(n)
+		}
+		return netip.AddrFrom4(b), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	return addr.Unmap(), nil
+}
+
+// lastAddr returns the highest address in a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range b {
+		for bit := 0; bit < 8; bit++ {
+			if i*8+bit >= bits {
+				b[i] |= 0x80 >> bit
+			}
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,138 @@
+package ipfilter
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line  string
+		start string
+		end   string
+		desc  string
+		ok    bool
+	}{
+		{"Bad Corp:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", "Bad Corp", true},
+		{"Foo, Inc: Bar:10.0.0.1-10.0.0.9", "10.0.0.1", "10.0.0.9", "Foo, Inc: Bar", true},
+		{"001.002.003.000 - 001.002.003.255 , 000 , eMule entry", "1.2.3.0", "1.2.3.255", "eMule entry", true},
+		{"001.002.003.000 - 001.002.003.255 , 200 , allowed", "", "", "", false},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255", "", true},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "", true},
+		{"192.0.2.7", "192.0.2.7", "192.0.2.7", "", true},
+		{"# comment", "", "", "", false},
+		{"   ", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		rule, ok, err := ParseRule(tt.line)
+		if err != nil {
+			t.Errorf("ParseRule(%q) error: %v", tt.line, err)
+			continue
+		}
+		if ok != tt.ok {
+			t.Errorf("ParseRule(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rule.Start.String() != tt.start || rule.End.String() != tt.end || rule.Description != tt.desc {
+			t.Errorf("ParseRule(%q) = %s-%s %q, want %s-%s %q",
+				tt.line, rule.Start, rule.End, rule.Description, tt.start, tt.end, tt.desc)
+		}
+	}
+
+	for _, bad := range []string{"not an address", "1.2.3.256", "10.0.0.0/99"} {
+		if _, _, err := ParseRule(bad); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestFilterLoad(t *testing.T) {
+	list := `# mixed block list
+Range A:1.0.0.0-1.0.0.255
+002.000.000.000 - 002.000.000.255 , 000 , Range B
+003.000.000.000 - 003.000.000.255 , 255 , allowed
+10.0.0.0/8
+garbage line
+2001:db8::/32
+`
+	f := New()
+	n, err := f.Load(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("Load added %d rules, want 4", n)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.0.0.0", true},
+		{"1.0.0.255", true},
+		{"1.0.1.0", false},
+		{"2.0.0.128", true},
+		{"3.0.0.1", false},
+		{"10.200.3.4", true},
+		{"11.0.0.0", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.1.1.1", true},
+	}
+
+	for _, tt := range tests {
+		if got := f.Blocked(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestFilterOverlappingRanges(t *testing.T) {
+	f := New()
+	for _, spec := range []string{"10.0.0.0-10.0.0.50", "10.0.0.20-10.0.0.30", "10.0.0.51-10.0.0.60", "10.0.1.0/24"} {
+		if err := f.AddString(spec); err != nil {
+			t.Fatalf("AddString(%q) failed: %v", spec, err)
+		}
+	}
+
+	for _, ip := range []string{"10.0.0.0", "10.0.0.25", "10.0.0.55", "10.0.1.200"} {
+		if !f.BlockedAddr(netip.MustParseAddr(ip)) {
+			t.Errorf("BlockedAddr(%s) = false, want true", ip)
+		}
+	}
+	if f.BlockedAddr(netip.MustParseAddr("10.0.0.61")) {
+		t.Error("BlockedAddr(10.0.0.61) = true, want false")
+	}
+}
+
+func TestFilterAddRemove(t *testing.T) {
+	f := New()
+	ip := net.ParseIP("192.0.2.10")
+
+	if err := f.AddString("192.0.2.0/24"); err != nil {
+		t.Fatalf("AddString failed: %v", err)
+	}
+	if !f.Blocked(ip) {
+		t.Error("Blocked = false after AddString")
+	}
+
+	if f.Remove("192.0.2.0/25") {
+		t.Error("Remove of a different range reported success")
+	}
+	if !f.Remove("192.0.2.0-192.0.2.255") {
+		t.Error("Remove of the same range as start-end failed")
+	}
+	if f.Blocked(ip) || f.Len() != 0 {
+		t.Errorf("Blocked = %v, Len = %d after Remove, want false, 0", f.Blocked(ip), f.Len())
+	}
+
+	if err := f.AddString("10.0.0.9-10.0.0.1"); err == nil {
+		t.Error("AddString accepted a reversed range")
+	}
+}
@@ -0,0 +1,115 @@
+// Package logging hands out structured loggers for each component of the
+// client. All components share one slog handler, but each has its own
+// minimum level that can be changed at runtime.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Component names
+const (
+	Session  = "session"
+	Peer     = "peer"
+	Download = "download"
+	Piece    = "piece"
+	Hooks    = "hooks"
+)
+
+// ComponentKey is the attribute naming the component that logged a record
+const ComponentKey = "component"
+
+// Logger creates component loggers writing to a shared handler
+type Logger struct {
+	handler slog.Handler
+
+	mu     sync.RWMutex
+	def    slog.Level
+	levels map[string]slog.Level
+}
+
+// New returns a logger writing to handler at slog.LevelInfo. A nil handler
+// writes through slog.Default.
+func New(handler slog.Handler) *Logger {
+	if handler == nil {
+		handler = slog.Default().Handler()
+	}
+	return &Logger{
+		handler: handler,
+		def:     slog.LevelInfo,
+		levels:  make(map[string]slog.Level),
+	}
+}
+
+// SetDefaultLevel sets the level of components without their own
+func (l *Logger) SetDefaultLevel(level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def = level
+}
+
+// SetLevel sets a component's minimum level
+func (l *Logger) SetLevel(component string, level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels[component] = level
+}
+
+// Level returns a component's minimum level
+func (l *Logger) Level(component string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if level, ok := l.levels[component]; ok {
+		return level
+	}
+	return l.def
+}
+
+// Component returns the logger for a component. Its records carry the
+// component attribute and are filtered by the component's level only, so
+// a component set to debug logs at debug whatever the handler's own level.
+func (l *Logger) Component(name string) *slog.Logger {
+	return slog.New(&componentHandler{
+		logger:    l,
+		component: name,
+		handler:   l.handler.WithAttrs([]slog.Attr{slog.String(ComponentKey, name)}),
+	})
+}
+
+// componentHandler filters records by a component's level
+type componentHandler struct {
+	logger    *Logger
+	component string
+	handler   slog.Handler
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.logger.Level(h.component)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &componentHandler{h.logger, h.component, h.handler.WithAttrs(attrs)}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{h.logger, h.component, h.handler.WithGroup(name)}
+}
+
+// Discard returns a logger that drops every record
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
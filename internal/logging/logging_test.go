@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError}))
+	l.SetLevel(Peer, slog.LevelDebug)
+
+	peer := l.Component(Peer)
+	download := l.Component(Download).With("torrent", "a")
+
+	tests := []struct {
+		name   string
+		log    func()
+		logged bool
+	}{
+		// Component levels override the handler's own level
+		{"peer debug", func() { peer.Debug("peer debug") }, true},
+		{"download debug", func() { download.Debug("download debug") }, false},
+		{"download info", func() { download.Info("download info") }, true},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		tt.log()
+		if got := strings.Contains(buf.String(), tt.name); got != tt.logged {
+			t.Errorf("%s: logged = %v, want %v (output %q)", tt.name, got, tt.logged, buf.String())
+		}
+	}
+
+	buf.Reset()
+	download.Info("with attrs")
+	if out := buf.String(); !strings.Contains(out, "component=download") || !strings.Contains(out, "torrent=a") {
+		t.Errorf("output %q lacks the component and torrent attributes", out)
+	}
+
+	// Levels can change while components are in use
+	l.SetDefaultLevel(slog.LevelWarn)
+	buf.Reset()
+	download.Info("download info")
+	if buf.Len() != 0 {
+		t.Errorf("info logged at default level warn: %q", buf.String())
+	}
+	if got := l.Level(Peer); got != slog.LevelDebug {
+		t.Errorf("Level(peer) = %v, want debug", got)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	if Discard().Enabled(context.Background(), slog.LevelError) {
+		t.Error("Discard logger enabled for errors")
+	}
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"net"
+	"sync"
+)
+
+// BanList is a set of banned IP addresses. It is kept apart from the
+// manager so that bans outlive it: a torrent that is paused and resumed
+// hands the same list to its new manager.
+type BanList struct {
+	mu  sync.RWMutex
+	ips map[string]bool
+}
+
+// NewBanList creates an empty ban list
+func NewBanList() *BanList {
+	return &BanList{ips: make(map[string]bool)}
+}
+
+// Add bans ip
+func (b *BanList) Add(ip net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ips[ip.String()] = true
+}
+
+// Contains returns true if ip is banned
+func (b *BanList) Contains(ip net.IP) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.ips[ip.String()]
+}
+
+// IPs returns the banned IP addresses
+func (b *BanList) IPs() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ips := make([]string, 0, len(b.ips))
+	for ip := range b.ips {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// SetBanList sets the list of banned addresses, replacing the manager's
+// own empty one. Peers already connected from a newly banned address are
+// not disconnected.
+func (m *Manager) SetBanList(banned *BanList) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.banned = banned
+}
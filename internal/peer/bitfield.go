@@ -0,0 +1,134 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxBufferedHaves bounds the HAVE messages kept for a peer while the
+// torrent's piece count is not known
+const MaxBufferedHaves = 1 << 16
+
+// ErrInvalidBitfield is returned for a bitfield whose length does not
+// match the torrent's piece count or that has spare bits set
+var ErrInvalidBitfield = errors.New("invalid bitfield")
+
+// ErrInvalidPiece is returned for a HAVE message naming a piece the
+// torrent does not have
+var ErrInvalidPiece = errors.New("invalid piece index")
+
+// ValidateBitfield checks a bitfield against the torrent's piece count: it
+// must have exactly one bit per piece, rounded up to whole bytes, with the
+// spare bits at the end clear
+func ValidateBitfield(bitfield []byte, numPieces int) error {
+	if want := (numPieces + 7) / 8; len(bitfield) != want {
+		return fmt.Errorf("%w: %d bytes for %d pieces, want %d", ErrInvalidBitfield, len(bitfield), numPieces, want)
+	}
+	if spare := numPieces % 8; spare != 0 && bitfield[len(bitfield)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("%w: spare bits set", ErrInvalidBitfield)
+	}
+	return nil
+}
+
+// validPiece returns true if index is a piece of the torrent. Until the
+// piece count is known, any non-negative index is accepted. (must hold
+// p.mu)
+func (p *Peer) validPiece(index int) bool {
+	return index >= 0 && (p.numPieces == 0 || index < p.numPieces)
+}
+
+// pieceCount returns the number of pieces in the torrent, or 0 if it is
+// not known yet
+func (p *Peer) pieceCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.numPieces
+}
+
+// bufferHave keeps a HAVE message received before the piece count was
+// known, for setNumPieces to apply (must hold p.mu)
+func (p *Peer) bufferHave(index int) error {
+	if len(p.haves) >= MaxBufferedHaves {
+		return fmt.Errorf("%w: more than %d HAVE messages before metadata", ErrInvalidPiece, MaxBufferedHaves)
+	}
+	p.haves = append(p.haves, index)
+	return nil
+}
+
+// setNumPieces gives the peer the torrent's piece count once the metadata
+// is known, checking the bitfield it sent and applying its buffered HAVE
+// messages. It returns true if the peer has announced any pieces.
+func (p *Peer) setNumPieces(n int) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.numPieces == n {
+		return false, nil
+	}
+	p.numPieces = n
+	haves := p.haves
+	p.haves = nil
+
+	if p.seed {
+		return true, nil
+	}
+	if p.bitfield != nil {
+		if err := ValidateBitfield(p.bitfield, n); err != nil {
+			p.bitfield = nil
+			return false, err
+		}
+	} else if len(haves) > 0 {
+		p.bitfield = make([]byte, (n+7)/8)
+	}
+	for _, index := range haves {
+		if !p.validPiece(index) {
+			return false, fmt.Errorf("%w: have %d of %d pieces", ErrInvalidPiece, index, n)
+		}
+		p.setPieceUnsafe(index)
+	}
+	return p.bitfield != nil, nil
+}
+
+// SetNumPieces sets the piece count of a torrent whose metadata was not
+// known when the manager was created, as when it was added from a magnet
+// link. The bitfields and HAVE messages peers sent meanwhile are checked
+// against it and reported to the event handler as bitfields; peers whose
+// announcements do not fit the torrent are disconnected; seeds are
+// reported with PeerHaveAll.
+func (m *Manager) SetNumPieces(n int) {
+	m.mu.Lock()
+	m.numPieces = n
+	if size := (n + 7) / 8; len(m.bitfield) != size {
+		m.bitfield = make([]byte, size)
+	}
+	m.mu.Unlock()
+
+	for _, peer := range m.GetPeers() {
+		m.applyNumPieces(peer, n)
+	}
+}
+
+// applyNumPieces gives a peer the piece count, disconnecting it if what
+// it announced does not fit
+func (m *Manager) applyNumPieces(peer *Peer, n int) {
+	announced, err := peer.setNumPieces(n)
+	if err != nil {
+		m.log().Debug("Disconnecting peer", "peer", peer.Address(), "err", err)
+		peer.Stop()
+		return
+	}
+	switch {
+	case announced && peer.IsSeed():
+		m.peerEvent(PeerEvent{Type: PeerHaveAll, Peer: peer})
+	case announced:
+		m.peerEvent(PeerEvent{Type: PeerBitfield, Peer: peer})
+	}
+}
+
+// pieceCount returns the number of pieces in the torrent, or 0 if it is
+// not known yet
+func (m *Manager) pieceCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.numPieces
+}
@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestValidateBitfield(t *testing.T) {
+	tests := []struct {
+		name      string
+		bitfield  []byte
+		numPieces int
+		ok        bool
+	}{
+		{"exact", []byte{0xff, 0xff}, 16, true},
+		{"spare bits clear", []byte{0xff, 0xe0}, 11, true},
+		{"spare bits set", []byte{0xff, 0xf0}, 11, false},
+		{"too short", []byte{0xff}, 11, false},
+		{"too long", []byte{0xff, 0xe0, 0x00}, 11, false},
+		{"empty", nil, 1, false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateBitfield(tt.bitfield, tt.numPieces)
+		if tt.ok && err != nil {
+			t.Errorf("%s: ValidateBitfield = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidBitfield) {
+			t.Errorf("%s: ValidateBitfield = %v, want ErrInvalidBitfield", tt.name, err)
+		}
+	}
+}
+
+func TestInvalidBitfieldRejected(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	peer.numPieces = 11
+
+	if err := peer.handleMessage(NewBitfieldMessage([]byte{0xff, 0xff})); !errors.Is(err, ErrInvalidBitfield) {
+		t.Errorf("bitfield with spare bits = %v, want ErrInvalidBitfield", err)
+	}
+	if peer.GetBitfield() != nil {
+		t.Error("invalid bitfield stored")
+	}
+
+	if err := peer.handleMessage(NewBitfieldMessage([]byte{0x80, 0x20})); err != nil {
+		t.Fatalf("valid bitfield rejected: %v", err)
+	}
+	if err := peer.handleMessage(NewHaveMessage(11)); !errors.Is(err, ErrInvalidPiece) {
+		t.Errorf("have past the last piece = %v, want ErrInvalidPiece", err)
+	}
+
+	// Lookups outside the torrent are false rather than reading spare bits
+	// or panicking
+	for _, index := range []int{-1, 11, 15, 1 << 20} {
+		if peer.HasPiece(index) {
+			t.Errorf("HasPiece(%d) = true", index)
+		}
+	}
+	if !peer.HasPiece(0) || !peer.HasPiece(10) {
+		t.Error("HasPiece is false for announced pieces")
+	}
+}
+
+func TestAnnouncementsBeforeMetadata(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 0)
+	handler := &recordingEvents{}
+	manager.SetPeerEventHandler(handler)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	if !manager.addPeer(peer) {
+		t.Fatal("addPeer failed")
+	}
+
+	// Without the piece count nothing can be checked or announced
+	for _, msg := range []*Message{NewBitfieldMessage([]byte{0x80, 0x00}), NewHaveMessage(9)} {
+		if err := peer.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage(%v) before metadata = %v", msg, err)
+		}
+		if _, ok := peer.eventFor(msg); ok {
+			t.Errorf("eventFor(%v) reported before metadata", msg)
+		}
+	}
+
+	manager.SetNumPieces(10)
+	if !peer.HasPiece(0) || !peer.HasPiece(9) || peer.HasPiece(1) {
+		t.Errorf("bitfield after SetNumPieces = %08b", peer.GetBitfield())
+	}
+	if len(handler.events) != 1 || handler.events[0].Type != PeerBitfield {
+		t.Errorf("events = %v, want one bitfield", handler.events)
+	}
+
+	// HAVE messages that do not fit the torrent disconnect the peer
+	other := NewPeer(client, [20]byte{}, [20]byte{})
+	if err := other.handleMessage(NewHaveMessage(10)); err != nil {
+		t.Fatalf("handleMessage before metadata = %v", err)
+	}
+	if _, err := other.setNumPieces(10); !errors.Is(err, ErrInvalidPiece) {
+		t.Errorf("setNumPieces with a HAVE past the end = %v, want ErrInvalidPiece", err)
+	}
+}
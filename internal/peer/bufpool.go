@@ -0,0 +1,25 @@
+package peer
+
+import "sync"
+
+// pieceBufferSize holds the payload of a piece message carrying one
+// standard block: index, begin and BlockSize bytes of data
+const pieceBufferSize = 8 + BlockSize
+
+// piecePool recycles piece message payloads, which are by far the most
+// frequent large allocation on the download path
+var piecePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, pieceBufferSize)
+		return &buf
+	},
+}
+
+func getPieceBuffer() *[]byte {
+	return piecePool.Get().(*[]byte)
+}
+
+func putPieceBuffer(buf *[]byte) {
+	*buf = (*buf)[:cap(*buf)]
+	piecePool.Put(buf)
+}
@@ -0,0 +1,205 @@
+package peer
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ChokeInterval is how often upload slots are handed out again
+	ChokeInterval = 10 * time.Second
+
+	// OptimisticUnchokeRounds is how many choke rounds an optimistic
+	// unchoke lasts before another peer gets the chance
+	OptimisticUnchokeRounds = 3
+
+	// DefaultUploadSlots is the number of peers unchoked at once, and
+	// where automatic tuning starts
+	DefaultUploadSlots = 4
+
+	// AutoUploadSlots has SetUploadSlots tune the number of slots to the
+	// upload capacity
+	AutoUploadSlots = 0
+
+	// MinUploadSlots and MaxUploadSlots bound automatic tuning
+	MinUploadSlots = 2
+	MaxUploadSlots = 20
+
+	// MinSlotRate is the upload rate in bytes per second below which a
+	// slot is given up once the upload capacity is used
+	MinSlotRate = 4 * 1024
+)
+
+// choker decides which interested peers we upload to: the ones that give
+// us the most, or take the most once we are seeding, plus one picked at
+// random so new peers get a start
+type choker struct {
+	mu         sync.Mutex
+	auto       bool
+	slots      int
+	capacity   func() int64 // upload capacity in bytes per second, 0 if unlimited
+	peak       float64      // highest total upload rate seen
+	round      int
+	optimistic *Peer
+}
+
+func newChoker() *choker {
+	return &choker{auto: true, slots: DefaultUploadSlots}
+}
+
+// tune adjusts the number of slots after a round in which candidates
+// peers wanted them and total bytes per second were uploaded. A slot is
+// added while capacity is left unused and dropped when each slot gets too
+// little of it. Without a configured capacity, the highest rate seen
+// stands in for it.
+func (c *choker) tune(total float64, candidates int) {
+	if !c.auto {
+		return
+	}
+
+	c.peak = max(c.peak, total)
+	capacity := c.peak
+	if c.capacity != nil {
+		if limit := c.capacity(); limit > 0 {
+			capacity = float64(limit)
+		}
+	}
+
+	switch {
+	case candidates < c.slots:
+		// Empty slots say nothing about capacity
+	case total < 0.9*capacity:
+		c.slots = min(c.slots+1, MaxUploadSlots)
+	case total/float64(c.slots) < MinSlotRate && c.slots > MinUploadSlots:
+		c.slots--
+	}
+}
+
+// SetUploadSlots sets how many peers are unchoked at once, or with
+// AutoUploadSlots tunes the number to the upload capacity
+func (m *Manager) SetUploadSlots(slots int) {
+	m.choker.mu.Lock()
+	defer m.choker.mu.Unlock()
+
+	m.choker.auto = slots <= AutoUploadSlots
+	if m.choker.auto {
+		m.choker.slots = DefaultUploadSlots
+	} else {
+		m.choker.slots = slots
+	}
+}
+
+// SetUploadCapacity sets the function reporting the upload capacity in
+// bytes per second, 0 if unlimited, that automatic slot tuning aims to
+// use. It is called every choke round, so it may follow a rate limit.
+func (m *Manager) SetUploadCapacity(capacity func() int64) {
+	m.choker.mu.Lock()
+	defer m.choker.mu.Unlock()
+	m.choker.capacity = capacity
+}
+
+// UploadSlots returns how many peers are unchoked at once
+func (m *Manager) UploadSlots() int {
+	m.choker.mu.Lock()
+	defer m.choker.mu.Unlock()
+	return m.choker.slots
+}
+
+// chokeLoop hands out upload slots every ChokeInterval
+func (m *Manager) chokeLoop() {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.rechoke()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// rechoke unchokes the interested peers that deserve a slot and chokes
+// the rest
+func (m *Manager) rechoke() {
+	peers := m.GetPeers()
+	seeding := m.complete()
+
+	var total float64
+	var candidates []*Peer
+	rates := make(map[*Peer]float64)
+	for _, peer := range peers {
+		stats := peer.Stats()
+		total += stats.UploadRate
+		if !peer.IsConnected() || !peer.GetState().PeerInterested || peer.IsSnubbed() {
+			continue
+		}
+		candidates = append(candidates, peer)
+		rates[peer] = stats.DownloadRate
+		if seeding {
+			rates[peer] = stats.UploadRate
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rates[candidates[i]] > rates[candidates[j]]
+	})
+
+	c := m.choker
+	c.mu.Lock()
+	c.tune(total, len(candidates))
+	unchoke := make(map[*Peer]bool)
+	regular := min(c.slots-1, len(candidates))
+	if c.slots == 1 {
+		regular = min(1, len(candidates))
+	}
+	for _, peer := range candidates[:regular] {
+		unchoke[peer] = true
+	}
+
+	// The optimistic unchoke moves on every few rounds, or once its peer
+	// is no longer waiting for a slot
+	rest := candidates[regular:]
+	c.round++
+	if c.optimistic == nil || c.round%OptimisticUnchokeRounds == 0 || !contains(rest, c.optimistic) {
+		c.optimistic = nil
+		if len(rest) > 0 && c.slots > 1 {
+			c.optimistic = rest[rand.Intn(len(rest))]
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	c.mu.Unlock()
+
+	for _, peer := range peers {
+		choking := peer.GetState().AmChoking
+		switch {
+		case unchoke[peer] && choking:
+			m.Unchoke(peer)
+		case !unchoke[peer] && !choking:
+			m.Choke(peer)
+		}
+	}
+}
+
+// complete returns true if we have every piece
+func (m *Manager) complete() bool {
+	for index := 0; index < m.numPieces; index++ {
+		if !m.hasPieceIndex(index) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(peers []*Peer, peer *Peer) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChokerTune(t *testing.T) {
+	tests := []struct {
+		name       string
+		auto       bool
+		slots      int
+		capacity   int64
+		peak       float64
+		total      float64
+		candidates int
+		want       int
+	}{
+		{"manual", false, 4, 100000, 0, 10000, 10, 4},
+		{"capacity unused", true, 4, 100000, 0, 50000, 10, 5},
+		{"slots left empty", true, 4, 100000, 0, 50000, 3, 4},
+		{"capacity used", true, 4, 100000, 0, 95000, 10, 4},
+		{"slots too slow", true, 4, 10000, 0, 9500, 10, 3},
+		{"at the minimum", true, MinUploadSlots, 5000, 0, 5000, 10, MinUploadSlots},
+		{"at the maximum", true, MaxUploadSlots, 1000000, 0, 10000, 30, MaxUploadSlots},
+		{"below the peak without a limit", true, 4, 0, 100000, 50000, 10, 5},
+		{"at the peak without a limit", true, 4, 0, 100000, 100000, 10, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &choker{auto: tt.auto, slots: tt.slots, peak: tt.peak}
+			c.capacity = func() int64 { return tt.capacity }
+			c.tune(tt.total, tt.candidates)
+			if c.slots != tt.want {
+				t.Errorf("slots = %d, want %d", c.slots, tt.want)
+			}
+		})
+	}
+}
+
+func TestRechoke(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetUploadSlots(3)
+
+	// Peers 0 to 4 are interested and send us more the higher they are;
+	// peer 5 is unchoked but not interested
+	now := time.Now()
+	peers := make([]*Peer, 6)
+	for i := range peers {
+		peers[i] = newUploadTestPeer(t)
+		peers[i].mu.Lock()
+		peers[i].state.AmChoking = i != 5
+		peers[i].state.PeerInterested = i != 5
+		peers[i].mu.Unlock()
+		peers[i].stats.blockReceived(0, 0, (i+1)*BlockSize, now)
+		manager.mu.Lock()
+		manager.peers[fmt.Sprint(i)] = peers[i]
+		manager.mu.Unlock()
+	}
+
+	manager.rechoke()
+
+	unchoked := 0
+	for i, peer := range peers {
+		choking := peer.GetState().AmChoking
+		if !choking {
+			unchoked++
+		}
+		switch {
+		case (i == 3 || i == 4) && choking:
+			t.Errorf("peer %d, among the fastest, is choked", i)
+		case i == 5 && !choking:
+			t.Error("peer 5, not interested, is unchoked")
+		}
+	}
+	if unchoked != 3 {
+		t.Errorf("%d peers unchoked, want 3", unchoked)
+	}
+}
@@ -0,0 +1,145 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// azureusClients names the clients by their Azureus-style peer ID code
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libTorrent",
+	"lt": "libtorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients names the clients by their Shadow-style peer ID letter
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ParseClient returns the client name and version announced by a peer ID
+// in the Azureus style ("-qB4650-...") or the Shadow style
+// ("T03I-----..."), or "" if the peer ID follows neither. Clients with an
+// Azureus-style code we don't know are shown by their code.
+func ParseClient(peerID [20]byte) string {
+	if name, ok := parseAzureus(peerID); ok {
+		return name
+	}
+	if name, ok := parseShadow(peerID); ok {
+		return name
+	}
+	return ""
+}
+
+// parseAzureus decodes a peer ID like "-qB4650-", with a two letter client
+// code and one version digit per byte
+func parseAzureus(id [20]byte) (string, bool) {
+	if id[0] != '-' || id[7] != '-' || !isAlnum(id[1]) || !isAlnum(id[2]) {
+		return "", false
+	}
+	parts := make([]int, 4)
+	for i := range parts {
+		d, ok := versionDigit(id[3+i])
+		if !ok {
+			return "", false
+		}
+		parts[i] = d
+	}
+
+	code := string(id[1:3])
+	name, ok := azureusClients[code]
+	if !ok {
+		name = code
+	}
+	return name + " " + formatVersion(parts), true
+}
+
+// parseShadow decodes a peer ID like "T03I-----", with a client letter,
+// up to five version digits padded with '-' and three more dashes
+func parseShadow(id [20]byte) (string, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok || string(id[6:9]) != "---" {
+		return "", false
+	}
+	var parts []int
+	for _, c := range id[1:6] {
+		if c == '-' {
+			break
+		}
+		d, ok := versionDigit(c)
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, d)
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return name + " " + formatVersion(parts), true
+}
+
+// versionDigit decodes one version byte: 0-9, then A-Z for 10-35 and a-z
+// for 36-61
+func versionDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	default:
+		return 0, false
+	}
+}
+
+// formatVersion joins version parts with dots, dropping trailing zeros
+// past the third
+func formatVersion(parts []int) string {
+	for len(parts) > 3 && parts[len(parts)-1] == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	s := make([]string, len(parts))
+	for i, p := range parts {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ".")
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// Client returns the peer's client software: the name and version from its
+// extended handshake if it sent one, otherwise what its peer ID announces,
+// or "" if unknown
+func (p *Peer) Client() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.extHandshake != nil {
+		if v := strings.TrimSpace(p.extHandshake.V); v != "" {
+			return v
+		}
+	}
+	return ParseClient(p.remotePeerID)
+}
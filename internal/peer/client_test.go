@@ -0,0 +1,43 @@
+package peer
+
+import "testing"
+
+func TestParseClient(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-qB4650-abcdefghijkl", "qBittorrent 4.6.5"},
+		{"-TR3000-abcdefghijkl", "Transmission 3.0.0"},
+		{"-lt0D60-abcdefghijkl", "libtorrent 0.13.6"},
+		{"-SB0100-abcdefghijkl", "SB 0.1.0"},
+		{"-UT3550-abcdefghijkl", "µTorrent 3.5.5"},
+		{"T03I--------abcdefgh", "BitTornado 0.3.18"},
+		{"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		{"-qB46!0-abcdefghijkl", ""},
+		{"M7-10-0--abcdefghijk", ""},
+		{"T03I-abcdefghijklmno", ""},
+		{"abcdefghijklmnopqrst", ""},
+	}
+
+	for _, tt := range tests {
+		var id [20]byte
+		copy(id[:], tt.id)
+		if got := ParseClient(id); got != tt.want {
+			t.Errorf("ParseClient(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestPeerClient(t *testing.T) {
+	p := &Peer{}
+	copy(p.remotePeerID[:], "-TR4050-abcdefghijkl")
+	if got := p.Client(); got != "Transmission 4.0.5" {
+		t.Errorf("Client() from the peer ID = %q, want Transmission 4.0.5", got)
+	}
+
+	p.extHandshake = &ExtendedHandshake{V: "Transmission 4.0.5 (a6fe2a64aa)"}
+	if got := p.Client(); got != "Transmission 4.0.5 (a6fe2a64aa)" {
+		t.Errorf("Client() from the extended handshake = %q", got)
+	}
+}
@@ -0,0 +1,223 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+const (
+	// DefaultMaxHalfOpen is the default cap on concurrent outgoing dials
+	DefaultMaxHalfOpen = 8
+
+	// MaxConnectFailures is how many failed attempts drop a candidate
+	MaxConnectFailures = 5
+
+	// ConnectRetryBase is the wait after the first failed attempt; it
+	// doubles with each further failure
+	ConnectRetryBase = 30 * time.Second
+
+	// ConnectRetryMax caps the wait between attempts
+	ConnectRetryMax = 30 * time.Minute
+
+	// ConnectInterval is how often the queue is checked for candidates
+	// whose backoff has expired
+	ConnectInterval = 1 * time.Second
+)
+
+// candidate is a peer address waiting to be dialed
+type candidate struct {
+	peer        tracker.Peer
+	addr        string
+	source      Source
+	failures    int
+	nextAttempt time.Time
+	seq         uint64 // insertion order
+	dialing     bool
+	local       bool   // on a private or link-local network
+	priority    uint32 // BEP 40 priority with our endpoint
+}
+
+// connectQueue ranks candidate addresses, caps concurrent dials and
+// remembers failures so unreachable peers are retried with backoff
+type connectQueue struct {
+	mu          sync.Mutex
+	candidates  map[string]*candidate
+	halfOpen    int
+	maxHalfOpen int
+	seq         uint64
+	wake        chan struct{}
+	self        netip.AddrPort // our external endpoint, if known
+}
+
+func newConnectQueue(maxHalfOpen int) *connectQueue {
+	return &connectQueue{
+		candidates:  make(map[string]*candidate),
+		maxHalfOpen: maxHalfOpen,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// add queues peers that are not already known. Known addresses keep their
+// failure count, backoff and original source.
+func (q *connectQueue) add(peers []tracker.Peer, source Source) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := false
+	for _, p := range peers {
+		if p.IP == nil || p.Port == 0 {
+			continue
+		}
+		addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+		if _, exists := q.candidates[addr]; exists {
+			continue
+		}
+		q.seq++
+		c := &candidate{
+			peer:   p,
+			addr:   addr,
+			source: source,
+			seq:    q.seq,
+			local:  p.IP.IsPrivate() || p.IP.IsLoopback() || p.IP.IsLinkLocalUnicast(),
+		}
+		c.priority = q.priorityOf(c)
+		q.candidates[addr] = c
+		added = true
+	}
+
+	if added {
+		q.signal()
+	}
+}
+
+// setSelf sets our external endpoint and re-ranks all candidates
+func (q *connectQueue) setSelf(self netip.AddrPort) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.self = self
+	for _, c := range q.candidates {
+		c.priority = q.priorityOf(c)
+	}
+}
+
+// priorityOf returns the BEP 40 priority of a candidate, or 0 while our
+// own endpoint is unknown (must hold lock)
+func (q *connectQueue) priorityOf(c *candidate) uint32 {
+	addr, ok := netip.AddrFromSlice(c.peer.IP)
+	if !q.self.IsValid() || !ok {
+		return 0
+	}
+	return Priority(q.self, netip.AddrPortFrom(addr, c.peer.Port))
+}
+
+// signal wakes the connect loop without blocking
+func (q *connectQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns up to free candidates ready to dial, best first, and
+// counts them as half-open
+func (q *connectQueue) next(now time.Time, free int) []*candidate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.maxHalfOpen - q.halfOpen
+	if free-q.halfOpen < n {
+		n = free - q.halfOpen
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	var ready []*candidate
+	for _, c := range q.candidates {
+		if !c.dialing && !now.Before(c.nextAttempt) {
+			ready = append(ready, c)
+		}
+	}
+
+	// Untried and less troublesome addresses first, then local peers,
+	// then by BEP 40 priority, then oldest
+	sort.Slice(ready, func(i, j int) bool {
+		a, b := ready[i], ready[j]
+		if a.failures != b.failures {
+			return a.failures < b.failures
+		}
+		if a.local != b.local {
+			return a.local
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.seq < b.seq
+	})
+
+	if len(ready) > n {
+		ready = ready[:n]
+	}
+	for _, c := range ready {
+		c.dialing = true
+	}
+	q.halfOpen += len(ready)
+	return ready
+}
+
+// done records the outcome of a dial
+func (q *connectQueue) done(c *candidate, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.halfOpen--
+	c.dialing = false
+
+	switch {
+	case err == nil,
+		errors.Is(err, ErrPeerConnected),
+		errors.Is(err, ErrPeerBlocked),
+		errors.Is(err, ErrPeerBanned),
+		errors.Is(err, ErrPrivateSource):
+		// Connected, or never worth dialing again
+		delete(q.candidates, c.addr)
+	case errors.Is(err, ErrTooManyPeers):
+		// Not the candidate's fault; try again when a slot frees up
+	default:
+		c.failures++
+		if c.failures >= MaxConnectFailures {
+			delete(q.candidates, c.addr)
+			break
+		}
+		c.nextAttempt = now.Add(connectBackoff(c.failures))
+	}
+
+	q.signal()
+}
+
+// len returns the number of queued candidates and dials in progress
+func (q *connectQueue) len() (queued, halfOpen int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.candidates), q.halfOpen
+}
+
+// connectBackoff returns the wait after the given number of failures
+func connectBackoff(failures int) time.Duration {
+	wait := ConnectRetryBase
+	for i := 1; i < failures && wait < ConnectRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > ConnectRetryMax {
+		wait = ConnectRetryMax
+	}
+	return wait
+}
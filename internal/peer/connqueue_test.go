@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+func testPeers(n int) []tracker.Peer {
+	peers := make([]tracker.Peer, n)
+	for i := range peers {
+		peers[i] = tracker.Peer{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881}
+	}
+	return peers
+}
+
+func TestConnectQueueHalfOpenCap(t *testing.T) {
+	q := newConnectQueue(2)
+	q.add(testPeers(5), SourceTracker)
+	now := time.Now()
+
+	first := q.next(now, 50)
+	if len(first) != 2 {
+		t.Fatalf("next returned %d candidates, want 2", len(first))
+	}
+	if more := q.next(now, 50); len(more) != 0 {
+		t.Errorf("next returned %d more candidates while at the cap", len(more))
+	}
+
+	// Free peer slots also limit dials
+	q.done(first[0], nil, now)
+	q.done(first[1], nil, now)
+	if got := q.next(now, 1); len(got) != 1 {
+		t.Errorf("next with 1 free slot returned %d candidates", len(got))
+	}
+
+	if queued, halfOpen := q.len(); queued != 3 || halfOpen != 1 {
+		t.Errorf("len = %d queued, %d half-open, want 3, 1", queued, halfOpen)
+	}
+}
+
+func TestConnectQueueBackoff(t *testing.T) {
+	q := newConnectQueue(8)
+	q.add(testPeers(2), SourceTracker)
+	now := time.Now()
+
+	all := q.next(now, 50)
+	failed, other := all[0], all[1]
+	q.done(failed, errors.New("connection refused"), now)
+	q.done(other, ErrTooManyPeers, now)
+
+	// The failed address waits; the one turned away for capacity does not
+	ready := q.next(now, 50)
+	if len(ready) != 1 || ready[0] != other {
+		t.Fatalf("next = %v, want only the capacity-limited candidate", ready)
+	}
+	q.done(other, nil, now)
+
+	if got := q.next(now.Add(ConnectRetryBase-time.Second), 50); len(got) != 0 {
+		t.Errorf("failed candidate retried before its backoff expired")
+	}
+	if got := q.next(now.Add(ConnectRetryBase), 50); len(got) != 1 {
+		t.Errorf("failed candidate not retried after its backoff")
+	}
+
+	// Re-announcing a failed address keeps its history
+	q.add(testPeers(1), SourceTracker)
+	if c := q.candidates[failed.addr]; c.failures != 1 {
+		t.Errorf("failures = %d after re-add, want 1", c.failures)
+	}
+}
+
+func TestConnectQueueDropsAfterMaxFailures(t *testing.T) {
+	q := newConnectQueue(8)
+	q.add(testPeers(1), SourceTracker)
+	now := time.Now()
+
+	for i := 0; i < MaxConnectFailures; i++ {
+		ready := q.next(now, 50)
+		if len(ready) != 1 {
+			t.Fatalf("attempt %d: next returned %d candidates", i+1, len(ready))
+		}
+		q.done(ready[0], errors.New("timeout"), now)
+		now = now.Add(ConnectRetryMax)
+	}
+
+	if queued, _ := q.len(); queued != 0 {
+		t.Errorf("%d candidates queued after %d failures, want 0", queued, MaxConnectFailures)
+	}
+}
+
+func TestConnectBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, ConnectRetryBase},
+		{2, 2 * ConnectRetryBase},
+		{3, 4 * ConnectRetryBase},
+		{20, ConnectRetryMax},
+	}
+
+	for _, tt := range tests {
+		if got := connectBackoff(tt.failures); got != tt.want {
+			t.Errorf("connectBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestConnectQueueRanking(t *testing.T) {
+	q := newConnectQueue(8)
+	q.setSelf(netip.MustParseAddrPort("123.213.32.10:6881"))
+
+	public := []tracker.Peer{
+		{IP: net.IPv4(98, 76, 54, 32), Port: 6881},
+		{IP: net.IPv4(123, 213, 32, 234), Port: 6881},
+		{IP: net.IPv4(8, 8, 4, 4), Port: 6881},
+	}
+	lan := tracker.Peer{IP: net.IPv4(192, 168, 1, 20), Port: 6881}
+	q.add(append(public, lan), SourceTracker)
+
+	ready := q.next(time.Now(), 50)
+	if len(ready) != 4 {
+		t.Fatalf("next returned %d candidates, want 4", len(ready))
+	}
+	if !ready[0].peer.IP.Equal(lan.IP) {
+		t.Errorf("first candidate = %s, want the LAN peer", ready[0].addr)
+	}
+	for i := 2; i < len(ready); i++ {
+		if ready[i-1].priority < ready[i].priority {
+			t.Errorf("candidate %d has priority %08x above %08x", i, ready[i].priority, ready[i-1].priority)
+		}
+	}
+
+	want := Priority(netip.MustParseAddrPort("123.213.32.10:6881"), netip.MustParseAddrPort("98.76.54.32:6881"))
+	if c := q.candidates["98.76.54.32:6881"]; c.priority != want {
+		t.Errorf("priority = %08x, want %08x", c.priority, want)
+	}
+}
+
+func TestConnectQueueKeepsFirstSource(t *testing.T) {
+	q := newConnectQueue(8)
+	peers := testPeers(1)
+	q.add(peers, SourceTracker)
+	q.add(peers, SourceDHT)
+
+	ready := q.next(time.Now(), 1)
+	if len(ready) != 1 {
+		t.Fatalf("next returned %d candidates, want 1", len(ready))
+	}
+	if ready[0].source != SourceTracker {
+		t.Errorf("source = %v, want %v", ready[0].source, SourceTracker)
+	}
+}
@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// IdleTimeout is how long a connected peer may stay silent before it
+	// is dropped, unless the manager sets another with SetIdleTimeout
+	IdleTimeout = 5 * time.Minute
+
+	// KeepAliveInterval is how often we send a keep-alive. Peers send them
+	// every two minutes too, so an idle timeout shorter than this drops
+	// healthy peers that have nothing to say.
+	KeepAliveInterval = 2 * time.Minute
+)
+
+// SetIdleTimeout sets how long peers connected from now on may send
+// nothing, not even a keep-alive, before they are disconnected. A dead
+// connection would otherwise linger until the OS noticed. Zero restores
+// IdleTimeout.
+func (m *Manager) SetIdleTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = IdleTimeout
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idleTimeout = timeout
+}
+
+// peerIdleTimeout returns the idle timeout for new peers
+func (m *Manager) peerIdleTimeout() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.idleTimeout
+}
+
+// readWithTimeout runs read with the connection's read deadline set to
+// timeout from now, clearing the deadline afterwards
+func readWithTimeout(conn net.Conn, timeout time.Duration, read func() error) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := read()
+	if isTimeout(err) {
+		return fmt.Errorf("read timeout after %v: %w", timeout, err)
+	}
+	return err
+}
+
+// readWithContext runs read, interrupting it if ctx is done first. Any
+// deadline already set on the connection still applies.
+func readWithContext(ctx context.Context, conn net.Conn, read func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Expire the deadline to unblock a pending read
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+
+	err := read()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// withContext runs fn, interrupting its reads and writes on conn if ctx
+// is done first. The connection is no use afterwards if it was.
+func withContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Expire the deadlines to unblock pending reads and writes
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := fn()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// isTimeout reports whether err is a deadline expiry
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return err != nil && errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	peer.idleTimeout = 100 * time.Millisecond
+	peer.run(&Handshake{})
+	defer peer.Stop()
+
+	// Keep-alives keep a quiet peer connected
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if _, err := server.Write(KeepAlive().Serialize()); err != nil {
+			t.Fatalf("keep-alive %d failed: %v", i, err)
+		}
+	}
+	if !peer.IsConnected() {
+		t.Fatal("peer sending keep-alives was disconnected")
+	}
+
+	select {
+	case <-peer.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer was not disconnected")
+	}
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetIdleTimeout(time.Minute)
+	if got := manager.peerIdleTimeout(); got != time.Minute {
+		t.Errorf("idle timeout = %v, want %v", got, time.Minute)
+	}
+	manager.SetIdleTimeout(0)
+	if got := manager.peerIdleTimeout(); got != IdleTimeout {
+		t.Errorf("idle timeout after reset = %v, want %v", got, IdleTimeout)
+	}
+}
@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"net"
+	"net/netip"
+)
+
+// DHT is the DHT node a manager feeds with the nodes its peers advertise
+// in PORT messages (BEP 5)
+type DHT interface {
+	// Port returns the UDP port the node listens on
+	Port() uint16
+
+	// AddNode pings the node at addr and adds it to the routing table if
+	// it answers
+	AddNode(addr netip.AddrPort)
+}
+
+// SetDHT sets the DHT node for peers of this torrent. With one set, we
+// advertise DHT support in our handshake, send our PORT to peers that
+// support it and add the nodes they advertise. It is ignored for private
+// torrents, and takes effect for peers connected from then on.
+func (m *Manager) SetDHT(dht DHT) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dht = dht
+}
+
+// dhtPort returns the port of our DHT node, or 0 if DHT is off or the
+// torrent is private
+func (m *Manager) dhtPort() uint16 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.dht == nil || m.private {
+		return 0
+	}
+	return m.dht.Port()
+}
+
+// handlePort adds the DHT node a peer advertised in a PORT message
+func (m *Manager) handlePort(peer *Peer, port uint16) {
+	m.mu.RLock()
+	dht, private := m.dht, m.private
+	m.mu.RUnlock()
+	if dht == nil || private || port == 0 {
+		return
+	}
+
+	tcpAddr, ok := peer.Address().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return
+	}
+	dht.AddNode(netip.AddrPortFrom(ip.Unmap(), port))
+}
+
+// localExtensions returns the extensions we advertise to the peer
+func (p *Peer) localExtensions() Extensions {
+	ext := SupportedExtensions
+	ext.DHT = p.dhtPort > 0
+	return ext
+}
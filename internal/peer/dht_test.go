@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dhtRecorder records the nodes it is asked to add
+type dhtRecorder struct {
+	mu    sync.Mutex
+	nodes []netip.AddrPort
+}
+
+func (d *dhtRecorder) Port() uint16 { return 6882 }
+
+func (d *dhtRecorder) AddNode(addr netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes = append(d.nodes, addr)
+}
+
+func TestManagerHandlesPort(t *testing.T) {
+	dht := &dhtRecorder{}
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	peer := newHolepunchTestPeer(t, "10.0.0.1:6881", false)
+
+	// Without a DHT the message is ignored
+	manager.handlePeerMessage(PeerMessage{Peer: peer, Message: NewPortMessage(7000)})
+
+	manager.SetDHT(dht)
+	manager.handlePeerMessage(PeerMessage{Peer: peer, Message: NewPortMessage(0)})
+	manager.handlePeerMessage(PeerMessage{Peer: peer, Message: NewPortMessage(7001)})
+
+	want := []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:7001")}
+	if !reflect.DeepEqual(dht.nodes, want) {
+		t.Errorf("added nodes %v, want %v", dht.nodes, want)
+	}
+}
+
+func TestPeerSendsPort(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{1}, [20]byte{2})
+	peer.dhtPort = 6882
+	defer peer.Stop()
+
+	remote := NewHandshake([20]byte{1}, [20]byte{3})
+	remote.SetExtensions(Extensions{DHT: true})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- peer.Accept(remote) }()
+
+	reply, err := Read(server)
+	if err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if !reply.ParseExtensions().DHT {
+		t.Error("handshake does not advertise DHT")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := ReadMessage(server)
+	if err != nil {
+		t.Fatalf("failed to read port message: %v", err)
+	}
+	if port, err := msg.ParsePort(); err != nil || port != 6882 {
+		t.Errorf("first message = %v, want port 6882", msg)
+	}
+}
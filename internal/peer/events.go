@@ -0,0 +1,150 @@
+package peer
+
+// PeerEventType identifies a change in a connected peer's state
+type PeerEventType int
+
+const (
+	// PeerUnchoked means the peer will now serve our requests
+	PeerUnchoked PeerEventType = iota
+
+	// PeerChoked means the peer stopped serving our requests
+	PeerChoked
+
+	// PeerHave means the peer announced one new piece
+	PeerHave
+
+	// PeerBitfield means the peer sent its full bitfield
+	PeerBitfield
+
+	// PeerDisconnected means the peer was removed from the manager
+	PeerDisconnected
+
+	// PeerConnected means the peer completed the handshake and was added
+	// to the manager
+	PeerConnected
+
+	// PeerHaveAll means the peer announced every piece with the Fast
+	// extension's Have All message. It has no bitfield to look at; Have
+	// None is reported as an empty PeerBitfield.
+	PeerHaveAll
+
+	// PeerRejected means the peer will not send a block we requested,
+	// with the Fast extension's Reject Request message
+	PeerRejected
+)
+
+var peerEventNames = map[PeerEventType]string{
+	PeerUnchoked:     "unchoked",
+	PeerChoked:       "choked",
+	PeerHave:         "have",
+	PeerBitfield:     "bitfield",
+	PeerDisconnected: "disconnected",
+	PeerConnected:    "connected",
+	PeerHaveAll:      "have all",
+	PeerRejected:     "rejected",
+}
+
+// String returns the name of the event type
+func (t PeerEventType) String() string {
+	if name, ok := peerEventNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// PeerEvent describes a state change of a connected peer
+type PeerEvent struct {
+	Type  PeerEventType
+	Peer  *Peer
+	Piece int // piece index for PeerHave and PeerRejected
+	Begin int // block offset for PeerRejected
+}
+
+// PeerEventHandler is notified of peer state changes. It is called from
+// the peer's receive loop, so it must not block.
+type PeerEventHandler interface {
+	HandlePeerEvent(event PeerEvent)
+}
+
+// eventFor returns the event caused by a handled message, if any
+func (p *Peer) eventFor(msg *Message) (PeerEvent, bool) {
+	event := PeerEvent{Peer: p}
+	if msg == nil {
+		return event, false
+	}
+
+	switch msg.ID {
+	case MsgUnchoke:
+		event.Type = PeerUnchoked
+	case MsgChoke:
+		event.Type = PeerChoked
+	case MsgHave:
+		index, err := msg.ParseHave()
+		if err != nil || p.pieceCount() == 0 {
+			return event, false
+		}
+		event.Type = PeerHave
+		event.Piece = int(index)
+	case MsgBitfield:
+		// Announced with the piece count by Manager.SetNumPieces
+		if p.pieceCount() == 0 {
+			return event, false
+		}
+		event.Type = PeerBitfield
+	case MsgHaveAll, MsgHaveNone:
+		if p.pieceCount() == 0 {
+			return event, false
+		}
+		event.Type = PeerBitfield
+		if msg.ID == MsgHaveAll {
+			event.Type = PeerHaveAll
+		}
+	case MsgRejectRequest:
+		index, begin, _, err := msg.ParseRejectRequest()
+		if err != nil {
+			return event, false
+		}
+		event.Type = PeerRejected
+		event.Piece = int(index)
+		event.Begin = int(begin)
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// SetPeerEventHandler sets the handler notified of peer state changes
+func (m *Manager) SetPeerEventHandler(handler PeerEventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eventHandler = handler
+}
+
+// peerEvent forwards a peer's state change to the event handler
+func (m *Manager) peerEvent(event PeerEvent) {
+	m.mu.RLock()
+	handler := m.eventHandler
+	m.mu.RUnlock()
+
+	if handler != nil {
+		handler.HandlePeerEvent(event)
+	}
+}
+
+// HandlePieceVerified records a piece we can now serve and announces it
+// to connected peers
+func (m *Manager) HandlePieceVerified(index int) {
+	m.BroadcastHave(index)
+}
+
+// HandlePieceFailed is called when a piece has to be downloaded again
+func (m *Manager) HandlePieceFailed(index int, err error) {}
+
+// HandleTorrentComplete tells every peer we no longer want anything
+func (m *Manager) HandleTorrentComplete() {
+	for _, peer := range m.GetPeers() {
+		if peer.GetState().AmInterested {
+			peer.NotInterested()
+		}
+	}
+}
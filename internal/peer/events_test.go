@@ -0,0 +1,143 @@
+package peer
+
+import "testing"
+
+func TestEventFor(t *testing.T) {
+	p := &Peer{numPieces: 8}
+
+	tests := []struct {
+		msg   *Message
+		want  PeerEventType
+		piece int
+		ok    bool
+	}{
+		{NewUnchokeMessage(), PeerUnchoked, 0, true},
+		{NewChokeMessage(), PeerChoked, 0, true},
+		{NewHaveMessage(7), PeerHave, 7, true},
+		{NewBitfieldMessage([]byte{0xff}), PeerBitfield, 0, true},
+		{NewHaveAllMessage(), PeerHaveAll, 0, true},
+		{NewHaveNoneMessage(), PeerBitfield, 0, true},
+		{NewRejectRequestMessage(5, BlockSize, BlockSize), PeerRejected, 5, true},
+		{NewInterestedMessage(), 0, 0, false},
+		{NewPieceMessage(0, 0, []byte("x")), 0, 0, false},
+		{KeepAlive(), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		event, ok := p.eventFor(tt.msg)
+		if ok != tt.ok {
+			t.Errorf("eventFor(%v) ok = %v, want %v", tt.msg, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if event.Type != tt.want || event.Piece != tt.piece || event.Peer != p {
+			t.Errorf("eventFor(%v) = %v piece %d, want %v piece %d", tt.msg, event.Type, event.Piece, tt.want, tt.piece)
+		}
+	}
+}
+
+// recordingEvents collects the events a manager forwards
+type recordingEvents struct {
+	events []PeerEvent
+}
+
+func (r *recordingEvents) HandlePeerEvent(event PeerEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestManagerForwardsPeerEvents(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+
+	// No handler set yet
+	manager.peerEvent(PeerEvent{Type: PeerUnchoked})
+
+	handler := &recordingEvents{}
+	manager.SetPeerEventHandler(handler)
+	manager.peerEvent(PeerEvent{Type: PeerHave, Piece: 3})
+
+	if len(handler.events) != 1 || handler.events[0].Type != PeerHave || handler.events[0].Piece != 3 {
+		t.Errorf("forwarded events = %v, want one have for piece 3", handler.events)
+	}
+}
+
+func TestRemovePeerReportsDisconnect(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	handler := &recordingEvents{}
+	manager.SetPeerEventHandler(handler)
+
+	peer := newUploadTestPeer(t)
+	if !manager.addPeer(peer) {
+		t.Fatal("addPeer failed")
+	}
+
+	manager.removePeer(peer)
+	manager.removePeer(peer) // already gone, reported once
+
+	if len(handler.events) != 1 || handler.events[0].Type != PeerDisconnected || handler.events[0].Peer != peer {
+		t.Errorf("events = %v, want one disconnect", handler.events)
+	}
+}
+
+func TestManagerPieceEvents(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	peer := newUploadTestPeer(t)
+	peer.mu.Lock()
+	peer.state.AmInterested = true
+	peer.mu.Unlock()
+	manager.addPeer(peer)
+
+	manager.HandlePieceVerified(3)
+	if !manager.hasPieceIndex(3) {
+		t.Error("verified piece missing from our bitfield")
+	}
+	if sent := peer.outbox.take(); len(sent) != 1 || sent[0].ID != MsgHave {
+		t.Errorf("queued messages = %v, want have", sent)
+	}
+
+	manager.HandleTorrentComplete()
+	if peer.GetState().AmInterested {
+		t.Error("still interested after the torrent completed")
+	}
+	if sent := peer.outbox.take(); len(sent) != 1 || sent[0].ID != MsgNotInterested {
+		t.Errorf("queued messages = %v, want not interested", sent)
+	}
+}
+
+func TestBroadcastHaveSuppression(t *testing.T) {
+	tests := []struct {
+		name     string
+		suppress bool
+		peerHas  bool
+		wantHave bool
+	}{
+		{"peer lacks piece", false, false, true},
+		{"peer has piece", false, true, true},
+		{"suppressed, peer lacks piece", true, false, true},
+		{"suppressed, peer has piece", true, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager([20]byte{}, [20]byte{}, 10)
+			manager.SetHaveSuppression(tt.suppress)
+			peer := newUploadTestPeer(t)
+			if tt.peerHas {
+				peer.bitfield = []byte{0x10, 0}
+			}
+			manager.addPeer(peer)
+
+			manager.BroadcastHave(3)
+
+			sent := peer.outbox.take()
+			gotHave := len(sent) == 1 && sent[0].ID == MsgHave
+			if gotHave != tt.wantHave {
+				t.Errorf("sent = %v, want have %v", sent, tt.wantHave)
+			}
+			if !manager.hasPieceIndex(3) {
+				t.Error("piece missing from our bitfield")
+			}
+		})
+	}
+}
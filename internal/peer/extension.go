@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+)
+
+const (
+	// ExtendedHandshakeID is the extended message ID of the BEP 10
+	// handshake
+	ExtendedHandshakeID = 0
+
+	// ClientVersion is the client name sent in the extended handshake
+	ClientVersion = "SB 0.1.0"
+
+	// DefaultRemoteReqq is the request queue depth assumed for peers that
+	// do not advertise one
+	DefaultRemoteReqq = 250
+)
+
+// ExtendedHandshake is the BEP 10 extended handshake
+type ExtendedHandshake struct {
+	M      map[string]int // extension name -> message ID
+	V      string         // client name and version
+	Reqq   int            // outstanding requests the peer will queue
+	Port   int            // listen port
+	YourIP []byte         // our address as seen by the peer
+}
+
+// NewExtendedHandshakeMessage creates an extended handshake message
+func NewExtendedHandshakeMessage(h *ExtendedHandshake) (*Message, error) {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = int64(id)
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = int64(h.Reqq)
+	}
+	if h.Port > 0 {
+		dict["p"] = int64(h.Port)
+	}
+	if len(h.YourIP) > 0 {
+		dict["yourip"] = string(h.YourIP)
+	}
+
+	data, err := bencode.Encode(dict)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode extended handshake: %w", err)
+	}
+
+	payload := make([]byte, 1+len(data))
+	payload[0] = ExtendedHandshakeID
+	copy(payload[1:], data)
+	return NewMessage(MsgExtended, payload), nil
+}
+
+// ParseExtendedHandshake parses the payload of an extended message whose
+// extended ID is ExtendedHandshakeID
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	if len(payload) < 1 || payload[0] != ExtendedHandshakeID {
+		return nil, fmt.Errorf("not an extended handshake")
+	}
+
+	var dict map[string]interface{}
+	if err := bencode.Decode(payload[1:], &dict); err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %w", err)
+	}
+
+	h := &ExtendedHandshake{M: make(map[string]int)}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if n, ok := id.(int64); ok {
+				h.M[name] = int(n)
+			}
+		}
+	}
+	if v, ok := dict["v"].(string); ok {
+		h.V = v
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		h.Reqq = int(reqq)
+	}
+	if port, ok := dict["p"].(int64); ok && port > 0 && port <= 65535 {
+		h.Port = int(port)
+	}
+	if ip, ok := dict["yourip"].(string); ok && (len(ip) == 4 || len(ip) == 16) {
+		h.YourIP = []byte(ip)
+	}
+	return h, nil
+}
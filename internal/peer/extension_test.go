@@ -0,0 +1,61 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	msg, err := NewExtendedHandshakeMessage(&ExtendedHandshake{
+		M:      map[string]int{"ut_pex": 1},
+		V:      ClientVersion,
+		Reqq:   500,
+		Port:   6881,
+		YourIP: []byte{10, 0, 0, 1},
+	})
+	if err != nil {
+		t.Fatalf("NewExtendedHandshakeMessage failed: %v", err)
+	}
+	if msg.ID != MsgExtended {
+		t.Errorf("message ID = %d, want %d", msg.ID, MsgExtended)
+	}
+
+	h, err := ParseExtendedHandshake(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseExtendedHandshake failed: %v", err)
+	}
+	if h.M["ut_pex"] != 1 || h.V != ClientVersion || h.Reqq != 500 || h.Port != 6881 {
+		t.Errorf("parsed handshake = %+v", h)
+	}
+	if !bytes.Equal(h.YourIP, []byte{10, 0, 0, 1}) {
+		t.Errorf("YourIP = %v, want 10.0.0.1", h.YourIP)
+	}
+}
+
+func TestParseExtendedHandshakeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"other extended ID", []byte("\x01d1:v1:xe")},
+		{"not bencode", []byte("\x00not bencode")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseExtendedHandshake(tt.payload); err == nil {
+				t.Error("ParseExtendedHandshake accepted invalid payload")
+			}
+		})
+	}
+
+	// Out of range values are ignored rather than rejected
+	h, err := ParseExtendedHandshake([]byte("\x00d4:reqqi-5e1:pi70000ee"))
+	if err != nil {
+		t.Fatalf("ParseExtendedHandshake failed: %v", err)
+	}
+	if h.Reqq != 0 || h.Port != 0 {
+		t.Errorf("parsed handshake = %+v, want reqq and port ignored", h)
+	}
+}
@@ -0,0 +1,100 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrFastNotNegotiated is returned for a Fast extension message from a
+// peer that did not negotiate the extension, which BEP 6 says must close
+// the connection
+var ErrFastNotNegotiated = errors.New("fast extension not negotiated")
+
+// isFastMessage returns true for the messages the Fast extension adds
+func isFastMessage(id uint8) bool {
+	switch id {
+	case MsgSuggestPiece, MsgHaveAll, MsgHaveNone, MsgRejectRequest, MsgAllowedFast:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewHaveAllMessage creates a Fast extension Have All message, sent in
+// place of a bitfield by a peer with every piece
+func NewHaveAllMessage() *Message {
+	return NewMessage(MsgHaveAll, nil)
+}
+
+// NewHaveNoneMessage creates a Fast extension Have None message, sent in
+// place of a bitfield by a peer with no pieces
+func NewHaveNoneMessage() *Message {
+	return NewMessage(MsgHaveNone, nil)
+}
+
+// IsSeed returns true if the peer announced every piece with Have All
+func (p *Peer) IsSeed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.seed
+}
+
+// haveAll records a Have All or, if all is false, a Have None message. A
+// seed is kept as a flag rather than a bitfield with every bit set, which
+// on a big torrent saves memory on every seed connected. Have None before
+// the piece count is known leaves the peer with no bitfield, as if it had
+// sent nothing. (must hold p.mu)
+func (p *Peer) haveAll(all bool) {
+	p.seed = all
+	p.haves = nil
+	p.bitfield = nil
+	if !all && p.numPieces > 0 {
+		p.bitfield = make([]byte, (p.numPieces+7)/8)
+	}
+}
+
+// fullBitfield returns a bitfield with every one of n pieces set
+func fullBitfield(n int) []byte {
+	bitfield := make([]byte, (n+7)/8)
+	for i := range bitfield {
+		bitfield[i] = 0xff
+	}
+	if spare := n % 8; spare != 0 {
+		bitfield[len(bitfield)-1] = 0xff << (8 - spare)
+	}
+	return bitfield
+}
+
+// NewRejectRequestMessage creates a Fast extension Reject Request message,
+// telling a peer a block it requested will not be sent
+func NewRejectRequestMessage(index, begin, length uint32) *Message {
+	msg := NewRequestMessage(index, begin, length)
+	msg.ID = MsgRejectRequest
+	return msg
+}
+
+// rejectRequest tells a peer with the Fast extension that a block it
+// requested will not be sent. Other peers are told nothing; they drop
+// their requests when choked.
+func (p *Peer) rejectRequest(r uploadRequest) {
+	if p.FastExtension() {
+		p.SendMessage(NewRejectRequestMessage(r.index, r.begin, r.length))
+	}
+}
+
+// ParseRejectRequest parses a Reject Request message and returns the
+// index, begin and length of the block the peer will not send
+func (m *Message) ParseRejectRequest() (index, begin, length uint32, err error) {
+	if m.ID != MsgRejectRequest {
+		return 0, 0, 0, fmt.Errorf("not a reject request message: ID %d", m.ID)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid reject request payload length: %d", len(m.Payload))
+	}
+
+	index = binary.BigEndian.Uint32(m.Payload[0:4])
+	begin = binary.BigEndian.Uint32(m.Payload[4:8])
+	length = binary.BigEndian.Uint32(m.Payload[8:12])
+	return index, begin, length, nil
+}
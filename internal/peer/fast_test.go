@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHaveAll(t *testing.T) {
+	p := &Peer{numPieces: 10, extensions: Extensions{FastPeers: true}}
+
+	if err := p.handleMessage(NewHaveAllMessage()); err != nil {
+		t.Fatalf("handleMessage(HaveAll) = %v", err)
+	}
+	if !p.IsSeed() || p.bitfield != nil {
+		t.Errorf("seed = %v with bitfield %08b, want a seed without one", p.IsSeed(), p.bitfield)
+	}
+	if !p.HasPiece(0) || !p.HasPiece(9) || p.HasPiece(10) {
+		t.Error("HasPiece wrong for a seed")
+	}
+	if got, want := p.GetBitfield(), []byte{0xff, 0xc0}; !bytes.Equal(got, want) {
+		t.Errorf("GetBitfield = %08b, want %08b", got, want)
+	}
+	if !p.NeedsPieces([]int{5}) {
+		t.Error("NeedsPieces = false for a seed")
+	}
+
+	// Have messages from a seed change nothing
+	if err := p.handleMessage(NewHaveMessage(3)); err != nil || p.bitfield != nil {
+		t.Errorf("handleMessage(Have) from a seed = %v with bitfield %08b", err, p.bitfield)
+	}
+
+	// Have None and bitfields replace Have All
+	if err := p.handleMessage(NewHaveNoneMessage()); err != nil {
+		t.Fatalf("handleMessage(HaveNone) = %v", err)
+	}
+	if p.IsSeed() || p.HasPiece(0) || len(p.bitfield) != 2 {
+		t.Errorf("after HaveNone seed = %v with bitfield %08b", p.IsSeed(), p.bitfield)
+	}
+	p.handleMessage(NewHaveAllMessage())
+	p.handleMessage(NewBitfieldMessage([]byte{0x80, 0x00}))
+	if p.IsSeed() || !p.HasPiece(0) || p.HasPiece(1) {
+		t.Errorf("after a bitfield seed = %v with bitfield %08b", p.IsSeed(), p.bitfield)
+	}
+}
+
+func TestHaveAllBeforeMetadata(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 0)
+	handler := &recordingEvents{}
+	manager.SetPeerEventHandler(handler)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	seed, empty := NewPeer(client, [20]byte{}, [20]byte{}), NewPeer(client, [20]byte{}, [20]byte{})
+	seed.extensions.FastPeers = true
+	empty.extensions.FastPeers = true
+	seed.handleMessage(NewHaveAllMessage())
+	empty.handleMessage(NewHaveNoneMessage())
+	manager.mu.Lock()
+	manager.peers["seed"] = seed
+	manager.peers["empty"] = empty
+	manager.mu.Unlock()
+
+	manager.SetNumPieces(10)
+	if !seed.HasPiece(9) || empty.HasPiece(0) {
+		t.Error("announcements lost when the piece count arrived")
+	}
+	if len(handler.events) != 1 || handler.events[0].Type != PeerHaveAll || handler.events[0].Peer != seed {
+		t.Errorf("events = %v, want have all from the seed", handler.events)
+	}
+}
+
+func TestFastMessagesNeedNegotiation(t *testing.T) {
+	messages := []*Message{
+		NewHaveAllMessage(),
+		NewHaveNoneMessage(),
+		NewRejectRequestMessage(0, 0, BlockSize),
+		NewMessage(MsgSuggestPiece, []byte{0, 0, 0, 1}),
+		NewMessage(MsgAllowedFast, []byte{0, 0, 0, 1}),
+	}
+	for _, msg := range messages {
+		p := &Peer{numPieces: 10}
+		if err := p.handleMessage(msg); !errors.Is(err, ErrFastNotNegotiated) {
+			t.Errorf("handleMessage(%v) without Fast = %v, want ErrFastNotNegotiated", msg, err)
+		}
+
+		p.extensions.FastPeers = true
+		if err := p.handleMessage(msg); err != nil {
+			t.Errorf("handleMessage(%v) with Fast = %v", msg, err)
+		}
+	}
+}
+
+func TestHaveNoneSentWithoutPieces(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	fast, plain := newUploadTestPeer(t), newUploadTestPeer(t)
+	fast.extensions.FastPeers = true
+
+	manager.announcePieces(fast)
+	manager.announcePieces(plain)
+
+	if sent := fast.outbox.take(); len(sent) != 1 || sent[0].ID != MsgHaveNone {
+		t.Errorf("sent %v to a Fast peer, want Have None", sent)
+	}
+	if sent := plain.outbox.take(); len(sent) != 0 {
+		t.Errorf("sent %v to a peer without Fast, want nothing", sent)
+	}
+}
+
+func TestChokeRejectsQueuedRequests(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(blockSource{})
+	manager.setPiece(0)
+	peer := newUploadTestPeer(t)
+	peer.extensions.FastPeers = true
+
+	for i := uint32(0); i < 2; i++ {
+		peer.admitRequest()
+		manager.handlePieceRequest(peer, 0, i*BlockSize, BlockSize)
+	}
+	manager.Choke(peer)
+
+	sent := peer.outbox.take()
+	if len(sent) != 3 || sent[0].ID != MsgChoke {
+		t.Fatalf("sent %v, want a choke and two rejects", sent)
+	}
+	for i, msg := range sent[1:] {
+		index, begin, length, err := msg.ParseRejectRequest()
+		if err != nil || index != 0 || begin != uint32(i)*BlockSize || length != BlockSize {
+			t.Errorf("reject %d = %d:%d:%d, %v, want block %d", i, index, begin, length, err, i)
+		}
+	}
+	if manager.uploads.pending(peer) != 0 {
+		t.Error("requests still queued after the choke")
+	}
+}
@@ -2,6 +2,7 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -19,6 +20,9 @@ const (
 	HandshakeTimeout = 30 * time.Second
 )
 
+// SupportedExtensions are the extensions we advertise in our handshake
+var SupportedExtensions = Extensions{FastPeers: true, ExtProtocol: true}
+
 // Handshake represents a BitTorrent handshake message
 type Handshake struct {
 	Pstr     string
@@ -59,14 +63,9 @@ func (h *Handshake) Serialize() []byte {
 	return buf
 }
 
-// Read reads a handshake from an io.Reader
+// Read reads a handshake from an io.Reader. It blocks until the handshake
+// arrives or the reader fails; use ReadHandshakeTimeout to bound the wait.
 func Read(r io.Reader) (*Handshake, error) {
-	// Set read timeout if it's a net.Conn
-	if conn, ok := r.(net.Conn); ok {
-		conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
-		defer conn.SetReadDeadline(time.Time{})
-	}
-	
 	// Read protocol string length
 	lengthBuf := make([]byte, 1)
 	if _, err := io.ReadFull(r, lengthBuf); err != nil {
@@ -127,8 +126,33 @@ func (h *Handshake) Write(w io.Writer) error {
 
 // DoHandshake performs a complete handshake with a peer
 func DoHandshake(conn net.Conn, infoHash, peerID [20]byte) (*Handshake, error) {
+	return DoHandshakeContext(context.Background(), conn, infoHash, peerID)
+}
+
+// DoHandshakeContext performs a complete handshake with a peer, abandoning
+// it if ctx is done first
+func DoHandshakeContext(ctx context.Context, conn net.Conn, infoHash, peerID [20]byte) (*Handshake, error) {
+	return handshakeContext(ctx, conn, infoHash, peerID, SupportedExtensions)
+}
+
+// handshakeContext is DoHandshakeContext advertising ext
+func handshakeContext(ctx context.Context, conn net.Conn, infoHash, peerID [20]byte, ext Extensions) (*Handshake, error) {
+	var peerHandshake *Handshake
+	err := withContext(ctx, conn, func() (err error) {
+		peerHandshake, err = doHandshake(conn, infoHash, peerID, ext)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return peerHandshake, nil
+}
+
+// doHandshake sends our handshake and reads the peer's
+func doHandshake(conn net.Conn, infoHash, peerID [20]byte, ext Extensions) (*Handshake, error) {
 	// Create our handshake
 	ourHandshake := NewHandshake(infoHash, peerID)
+	ourHandshake.SetExtensions(ext)
 	
 	// Send our handshake
 	if err := ourHandshake.Write(conn); err != nil {
@@ -136,7 +160,7 @@ func DoHandshake(conn net.Conn, infoHash, peerID [20]byte) (*Handshake, error) {
 	}
 	
 	// Read peer's handshake
-	peerHandshake, err := Read(conn)
+	peerHandshake, err := ReadHandshakeTimeout(conn, HandshakeTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read peer handshake: %w", err)
 	}
@@ -230,29 +254,15 @@ func ValidatePeerID(peerID [20]byte) bool {
 	return !allZeros
 }
 
-// ReadHandshakeTimeout reads a handshake with a specific timeout
-func ReadHandshakeTimeout(r io.Reader, timeout time.Duration) (*Handshake, error) {
-	// Create a channel for the result
-	type result struct {
-		handshake *Handshake
-		err       error
-	}
-	
-	ch := make(chan result, 1)
-	
-	// Read in a goroutine
-	go func() {
-		h, err := Read(r)
-		ch <- result{h, err}
-	}()
-	
-	// Wait for result or timeout
-	select {
-	case res := <-ch:
-		return res.handshake, res.err
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("handshake timeout after %v", timeout)
-	}
+// ReadHandshakeTimeout reads a handshake, failing if it does not arrive
+// within timeout
+func ReadHandshakeTimeout(conn net.Conn, timeout time.Duration) (*Handshake, error) {
+	var h *Handshake
+	err := readWithTimeout(conn, timeout, func() (err error) {
+		h, err = Read(conn)
+		return err
+	})
+	return h, err
 }
 
 // MarshalBinary implements encoding.BinaryMarshaler
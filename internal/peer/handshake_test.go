@@ -2,6 +2,8 @@ package peer
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -196,11 +198,15 @@ func TestHandshakeBinaryMarshaling(t *testing.T) {
 }
 
 func TestReadHandshakeTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	
 	// Test successful read
 	data := NewHandshake([20]byte{1}, [20]byte{2}).Serialize()
-	buf := bytes.NewBuffer(data)
+	go server.Write(data)
 	
-	h, err := ReadHandshakeTimeout(buf, 1*time.Second)
+	h, err := ReadHandshakeTimeout(client, 1*time.Second)
 	if err != nil {
 		t.Errorf("ReadHandshakeTimeout failed: %v", err)
 	}
@@ -208,18 +214,28 @@ func TestReadHandshakeTimeout(t *testing.T) {
 		t.Error("Expected handshake, got nil")
 	}
 	
-	// Test timeout (with a reader that blocks)
-	blockingReader := &blockingReader{}
-	_, err = ReadHandshakeTimeout(blockingReader, 100*time.Millisecond)
-	if err == nil {
-		t.Error("Expected timeout error")
+	// Test timeout (nothing is written)
+	_, err = ReadHandshakeTimeout(client, 100*time.Millisecond)
+	if !isTimeout(err) {
+		t.Errorf("Expected timeout error, got %v", err)
 	}
 }
 
-// blockingReader is a reader that blocks forever
-type blockingReader struct{}
+func TestDoHandshakeContext(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The remote never reads our handshake
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
 
-func (r *blockingReader) Read(p []byte) (n int, err error) {
-	// Block forever
-	select {}
-}
\ No newline at end of file
+	start := time.Now()
+	_, err := DoHandshakeContext(ctx, client, [20]byte{1}, [20]byte{2})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("DoHandshakeContext error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DoHandshakeContext returned after %v", elapsed)
+	}
+}
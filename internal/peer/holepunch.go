@@ -0,0 +1,242 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+const (
+	// ExtHolepunch is the BEP 10 name of the BEP 55 holepunch extension
+	ExtHolepunch = "ut_holepunch"
+
+	// HolepunchID is the extended message ID we assign to ut_holepunch
+	HolepunchID = 1
+
+	// MaxHolepunchRelays is how many relays a failed dial asks to
+	// introduce us to the peer
+	MaxHolepunchRelays = 3
+)
+
+// Holepunch message types
+const (
+	HolepunchRendezvous = 0 // ask the relay to introduce us to a peer
+	HolepunchConnect    = 1 // connect to the peer at the address
+	HolepunchError      = 2 // the relay could not introduce us
+)
+
+// Holepunch error codes
+const (
+	HolepunchNoSuchPeer   = 1 // the address is not a valid peer
+	HolepunchNotConnected = 2 // the relay is not connected to the peer
+	HolepunchNoSupport    = 3 // the peer does not support holepunch
+	HolepunchNoSelf       = 4 // the address is the sender's own
+)
+
+// ErrNoHolepunch is returned when sending a holepunch message to a peer
+// that does not support the extension
+var ErrNoHolepunch = errors.New("peer does not support ut_holepunch")
+
+// HolepunchMessage is a BEP 55 holepunch message
+type HolepunchMessage struct {
+	Type    byte
+	Addr    netip.AddrPort
+	ErrCode uint32
+}
+
+// NewHolepunchMessage creates a holepunch message for a peer that assigned
+// the extension the ID id
+func NewHolepunchMessage(id int, hm HolepunchMessage) *Message {
+	addr := hm.Addr.Addr().Unmap()
+	addrType, ip := byte(0), addr.AsSlice()
+	if addr.Is6() {
+		addrType = 1
+	}
+
+	payload := make([]byte, 0, 3+len(ip)+6)
+	payload = append(payload, byte(id), hm.Type, addrType)
+	payload = append(payload, ip...)
+	payload = binary.BigEndian.AppendUint16(payload, hm.Addr.Port())
+	payload = binary.BigEndian.AppendUint32(payload, hm.ErrCode)
+	return NewMessage(MsgExtended, payload)
+}
+
+// ParseHolepunch parses the payload of an extended message carrying a
+// holepunch message
+func ParseHolepunch(payload []byte) (HolepunchMessage, error) {
+	if len(payload) < 3 {
+		return HolepunchMessage{}, fmt.Errorf("holepunch message too short")
+	}
+
+	var size int
+	switch payload[2] {
+	case 0:
+		size = 4
+	case 1:
+		size = 16
+	default:
+		return HolepunchMessage{}, fmt.Errorf("unknown holepunch address type %d", payload[2])
+	}
+	if len(payload) != 3+size+6 {
+		return HolepunchMessage{}, fmt.Errorf("holepunch message has %d bytes, want %d", len(payload), 3+size+6)
+	}
+
+	addr, _ := netip.AddrFromSlice(payload[3 : 3+size])
+	rest := payload[3+size:]
+	return HolepunchMessage{
+		Type:    payload[1],
+		Addr:    netip.AddrPortFrom(addr, binary.BigEndian.Uint16(rest)),
+		ErrCode: binary.BigEndian.Uint32(rest[2:]),
+	}, nil
+}
+
+// extensionID returns the ID the peer assigned an extension in its
+// extended handshake, or false if it does not support it
+func (p *Peer) extensionID(name string) (int, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.extHandshake == nil {
+		return 0, false
+	}
+	id, ok := p.extHandshake.M[name]
+	return id, ok && id > 0
+}
+
+// SupportsHolepunch returns true if the peer advertised ut_holepunch
+func (p *Peer) SupportsHolepunch() bool {
+	_, ok := p.extensionID(ExtHolepunch)
+	return ok
+}
+
+// SendHolepunch sends a holepunch message to the peer
+func (p *Peer) SendHolepunch(hm HolepunchMessage) error {
+	id, ok := p.extensionID(ExtHolepunch)
+	if !ok {
+		return ErrNoHolepunch
+	}
+	return p.SendMessage(NewHolepunchMessage(id, hm))
+}
+
+// ListenAddr returns the address other peers can connect to the peer on:
+// its IP with the listen port from its extended handshake, or the port we
+// are connected to if it sent none
+func (p *Peer) ListenAddr() netip.AddrPort {
+	tcpAddr, ok := p.Address().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	addr := tcpAddr.AddrPort()
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.extHandshake != nil && p.extHandshake.Port > 0 {
+		return netip.AddrPortFrom(addr.Addr(), uint16(p.extHandshake.Port))
+	}
+	return addr
+}
+
+// Rendezvous asks the peer, as a relay, to introduce us to the peer at
+// target. If it is connected to target, both of us are sent a connect
+// message and dial each other at once, opening a path through NATs on
+// either side.
+func (p *Peer) Rendezvous(target netip.AddrPort) error {
+	return p.SendHolepunch(HolepunchMessage{Type: HolepunchRendezvous, Addr: target})
+}
+
+// rendezvousRelays asks up to MaxHolepunchRelays connected peers that
+// support holepunch to introduce us to a peer we failed to dial, unless
+// the torrent is private
+func (m *Manager) rendezvousRelays(target tracker.Peer) {
+	if m.isPrivate() {
+		return
+	}
+	ip, ok := netip.AddrFromSlice(target.IP)
+	if !ok {
+		return
+	}
+	addr := netip.AddrPortFrom(ip.Unmap(), target.Port)
+
+	sent := 0
+	for _, relay := range m.GetConnectedPeers() {
+		if sent == MaxHolepunchRelays {
+			return
+		}
+		if relay.ListenAddr() == addr || !relay.SupportsHolepunch() {
+			continue
+		}
+		if relay.Rendezvous(addr) == nil {
+			sent++
+		}
+	}
+}
+
+// handleHolepunch handles a holepunch message from a peer. A private
+// torrent ignores them: it neither relays nor takes peers from relays.
+func (m *Manager) handleHolepunch(peer *Peer, payload []byte) {
+	if m.isPrivate() {
+		return
+	}
+	hm, err := ParseHolepunch(payload)
+	if err != nil {
+		m.log().Debug("Invalid holepunch message", "peer", peer.Address(), "err", err)
+		return
+	}
+
+	switch hm.Type {
+	case HolepunchRendezvous:
+		m.relayHolepunch(peer, hm.Addr)
+
+	case HolepunchConnect:
+		target := tracker.Peer{IP: net.IP(hm.Addr.Addr().AsSlice()), Port: hm.Addr.Port()}
+		m.spawn(func() {
+			if err := m.connectToPeer(target, SourceHolepunch); err != nil {
+				m.log().Debug("Holepunch connect failed", "addr", hm.Addr, "err", err)
+			}
+		})
+
+	case HolepunchError:
+		m.log().Debug("Holepunch rendezvous failed", "relay", peer.Address(), "addr", hm.Addr, "code", hm.ErrCode)
+	}
+}
+
+// relayHolepunch introduces the peer that sent a rendezvous to the target
+// peer, or tells it why we cannot
+func (m *Manager) relayHolepunch(from *Peer, target netip.AddrPort) {
+	reply := func(code uint32) {
+		from.SendHolepunch(HolepunchMessage{Type: HolepunchError, Addr: target, ErrCode: code})
+	}
+
+	if !target.IsValid() || target.Port() == 0 {
+		reply(HolepunchNoSuchPeer)
+		return
+	}
+	if target == from.ListenAddr() {
+		reply(HolepunchNoSelf)
+		return
+	}
+
+	var to *Peer
+	for _, p := range m.GetConnectedPeers() {
+		if p != from && p.ListenAddr() == target {
+			to = p
+			break
+		}
+	}
+	if to == nil {
+		reply(HolepunchNotConnected)
+		return
+	}
+	if !to.SupportsHolepunch() {
+		reply(HolepunchNoSupport)
+		return
+	}
+
+	to.SendHolepunch(HolepunchMessage{Type: HolepunchConnect, Addr: from.ListenAddr()})
+	from.SendHolepunch(HolepunchMessage{Type: HolepunchConnect, Addr: target})
+}
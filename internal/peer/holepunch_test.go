@@ -0,0 +1,147 @@
+package peer
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// tcpConn is a pipe with the remote address of a TCP connection
+type tcpConn struct {
+	net.Conn
+	addr *net.TCPAddr
+}
+
+func (c tcpConn) RemoteAddr() net.Addr { return c.addr }
+
+// newHolepunchTestPeer returns a peer at addr that advertised ut_holepunch
+// under the ID 7 if supported is set
+func newHolepunchTestPeer(t *testing.T, addr string, supported bool) *Peer {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	peer := NewPeer(tcpConn{client, net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))}, [20]byte{}, [20]byte{})
+	h := &ExtendedHandshake{M: map[string]int{}}
+	if supported {
+		h.M[ExtHolepunch] = 7
+	}
+	peer.mu.Lock()
+	peer.extHandshake = h
+	peer.mu.Unlock()
+	return peer
+}
+
+// sentHolepunch returns the holepunch messages queued for a peer
+func sentHolepunch(t *testing.T, peer *Peer) []HolepunchMessage {
+	t.Helper()
+
+	var sent []HolepunchMessage
+	for _, msg := range peer.outbox.take() {
+		if msg == nil || msg.ID != MsgExtended || msg.Payload[0] != 7 {
+			continue
+		}
+		hm, err := ParseHolepunch(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseHolepunch failed: %v", err)
+		}
+		sent = append(sent, hm)
+	}
+	return sent
+}
+
+func TestHolepunchMessage(t *testing.T) {
+	tests := []HolepunchMessage{
+		{Type: HolepunchConnect, Addr: netip.MustParseAddrPort("10.1.2.3:6881")},
+		{Type: HolepunchRendezvous, Addr: netip.MustParseAddrPort("[2001:db8::1]:51413")},
+		{Type: HolepunchError, Addr: netip.MustParseAddrPort("10.1.2.3:6881"), ErrCode: HolepunchNotConnected},
+	}
+	for _, want := range tests {
+		msg := NewHolepunchMessage(7, want)
+		if msg.ID != MsgExtended || msg.Payload[0] != 7 {
+			t.Fatalf("message = %d with extended ID %d, want %d with 7", msg.ID, msg.Payload[0], MsgExtended)
+		}
+		got, err := ParseHolepunch(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseHolepunch failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("ParseHolepunch = %+v, want %+v", got, want)
+		}
+	}
+
+	for _, payload := range [][]byte{
+		{7, 0},
+		{7, 0, 2, 1, 2, 3, 4, 0, 1, 0, 0, 0, 0},
+		{7, 0, 1, 1, 2, 3, 4, 0, 1, 0, 0, 0, 0},
+	} {
+		if _, err := ParseHolepunch(payload); err == nil {
+			t.Errorf("ParseHolepunch(%v) succeeded", payload)
+		}
+	}
+}
+
+func TestRelayHolepunch(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		supported bool
+		errCode   uint32
+	}{
+		{"introduced", "10.0.0.2:6881", true, 0},
+		{"not connected", "10.0.0.9:6881", true, HolepunchNotConnected},
+		{"no support", "10.0.0.2:6881", false, HolepunchNoSupport},
+		{"self", "10.0.0.1:6881", true, HolepunchNoSelf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager([20]byte{}, [20]byte{}, 10)
+			from := newHolepunchTestPeer(t, "10.0.0.1:6881", true)
+			to := newHolepunchTestPeer(t, "10.0.0.2:6881", tt.supported)
+			manager.mu.Lock()
+			manager.peers["from"] = from
+			manager.peers["to"] = to
+			manager.mu.Unlock()
+
+			target := netip.MustParseAddrPort(tt.target)
+			rendezvous := NewHolepunchMessage(HolepunchID, HolepunchMessage{Type: HolepunchRendezvous, Addr: target})
+			manager.handlePeerMessage(PeerMessage{Peer: from, Message: rendezvous})
+
+			sent := sentHolepunch(t, from)
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages to the initiator, want 1", len(sent))
+			}
+			if tt.errCode != 0 {
+				if sent[0].Type != HolepunchError || sent[0].ErrCode != tt.errCode {
+					t.Errorf("reply = %+v, want error %d", sent[0], tt.errCode)
+				}
+				return
+			}
+			if sent[0].Type != HolepunchConnect || sent[0].Addr != target {
+				t.Errorf("reply = %+v, want connect to %s", sent[0], target)
+			}
+			sent = sentHolepunch(t, to)
+			if len(sent) != 1 || sent[0].Type != HolepunchConnect || sent[0].Addr != from.ListenAddr() {
+				t.Errorf("target was sent %+v, want connect to %s", sent, from.ListenAddr())
+			}
+		})
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	peer := newHolepunchTestPeer(t, "10.0.0.1:50000", true)
+	if got, want := peer.ListenAddr(), netip.MustParseAddrPort("10.0.0.1:50000"); got != want {
+		t.Errorf("ListenAddr = %s, want %s", got, want)
+	}
+
+	peer.mu.Lock()
+	peer.extHandshake.Port = 6881
+	peer.mu.Unlock()
+	if got, want := peer.ListenAddr(), netip.MustParseAddrPort("10.0.0.1:6881"); got != want {
+		t.Errorf("ListenAddr with a listen port = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// BitfieldMode says how our pieces are announced to a newly connected
+// peer
+type BitfieldMode int
+
+const (
+	// BitfieldFull sends the whole bitfield at once
+	BitfieldFull BitfieldMode = iota
+	// BitfieldPartial leaves up to LazyWithheldPieces random pieces out
+	// of the bitfield and announces them with HAVE messages soon after,
+	// so a seed cannot be told apart by its bitfield alone
+	BitfieldPartial
+	// BitfieldEmpty sends no bitfield and announces every piece with HAVE
+	// messages over time
+	BitfieldEmpty
+)
+
+const (
+	// LazyWithheldPieces is how many pieces BitfieldPartial leaves out
+	LazyWithheldPieces = 16
+
+	// LazyHaveInterval and LazyHaveBatch pace the HAVE messages for
+	// pieces left out of the bitfield
+	LazyHaveInterval = time.Second
+	LazyHaveBatch    = 32
+)
+
+// ParseBitfieldMode parses "full", "partial" or "empty"; "" is full
+func ParseBitfieldMode(s string) (BitfieldMode, error) {
+	switch s {
+	case "", "full":
+		return BitfieldFull, nil
+	case "partial":
+		return BitfieldPartial, nil
+	case "empty":
+		return BitfieldEmpty, nil
+	default:
+		return BitfieldFull, fmt.Errorf("unknown bitfield mode %q", s)
+	}
+}
+
+// String returns the name of the mode
+func (b BitfieldMode) String() string {
+	switch b {
+	case BitfieldFull:
+		return "full"
+	case BitfieldPartial:
+		return "partial"
+	case BitfieldEmpty:
+		return "empty"
+	default:
+		return "unknown"
+	}
+}
+
+// SetBitfieldMode sets how our pieces are announced to peers that
+// connect from now on
+func (m *Manager) SetBitfieldMode(mode BitfieldMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bitfieldMode = mode
+}
+
+// announcePieces tells a new peer which pieces we have, in the manager's
+// bitfield mode
+func (m *Manager) announcePieces(peer *Peer) {
+	// A Fast peer expects a bitfield, Have All or Have None first
+	if !m.hasPieces() {
+		if peer.FastExtension() {
+			peer.SendMessage(NewHaveNoneMessage())
+		}
+		return
+	}
+	bitfield := m.getBitfield()
+
+	m.mu.RLock()
+	mode := m.bitfieldMode
+	m.mu.RUnlock()
+
+	var withheld []int
+	switch mode {
+	case BitfieldPartial:
+		// Keep one piece, or the bitfield would be as good as empty
+		withheld = withholdPieces(bitfield, LazyWithheldPieces, 1)
+	case BitfieldEmpty:
+		withheld = withholdPieces(bitfield, len(bitfield)*8, 0)
+	}
+
+	switch {
+	case mode != BitfieldEmpty:
+		peer.SendBitfield(bitfield)
+	case peer.FastExtension():
+		peer.SendMessage(NewHaveNoneMessage())
+	}
+	if len(withheld) > 0 {
+		m.spawn(func() { m.sendWithheld(peer, withheld) })
+	}
+}
+
+// withholdPieces clears up to n random pieces from a bitfield, leaving at
+// least keep set, and returns them in random order
+func withholdPieces(bitfield []byte, n, keep int) []int {
+	var have []int
+	for i := 0; i < len(bitfield)*8; i++ {
+		if bitfield[i/8]&(1<<(7-i%8)) != 0 {
+			have = append(have, i)
+		}
+	}
+	n = min(n, len(have)-keep)
+	if n <= 0 {
+		return nil
+	}
+
+	rand.Shuffle(len(have), func(i, j int) { have[i], have[j] = have[j], have[i] })
+	withheld := have[:n]
+	for _, index := range withheld {
+		clearPiece(bitfield, index)
+	}
+	return withheld
+}
+
+// clearPiece clears a piece's bit in a bitfield
+func clearPiece(bitfield []byte, index int) {
+	bitfield[index/8] &^= 1 << (7 - index%8)
+}
+
+// sendWithheld announces pieces left out of a peer's bitfield with HAVE
+// messages, LazyHaveBatch at a time, until they are all sent or the peer
+// disconnects
+func (m *Manager) sendWithheld(peer *Peer, pieces []int) {
+	ticker := time.NewTicker(LazyHaveInterval)
+	defer ticker.Stop()
+
+	for len(pieces) > 0 {
+		select {
+		case <-ticker.C:
+		case <-peer.Done():
+			return
+		case <-m.ctx.Done():
+			return
+		}
+
+		m.mu.RLock()
+		suppress := m.suppressHave
+		m.mu.RUnlock()
+
+		batch := min(LazyHaveBatch, len(pieces))
+		for _, index := range pieces[:batch] {
+			if suppress && peer.HasPiece(index) {
+				continue
+			}
+			peer.SendMessage(NewHaveMessage(uint32(index)))
+		}
+		pieces = pieces[batch:]
+	}
+}
@@ -0,0 +1,60 @@
+package peer
+
+import "testing"
+
+func TestParseBitfieldMode(t *testing.T) {
+	for _, mode := range []BitfieldMode{BitfieldFull, BitfieldPartial, BitfieldEmpty} {
+		got, err := ParseBitfieldMode(mode.String())
+		if err != nil || got != mode {
+			t.Errorf("ParseBitfieldMode(%q) = %v, %v, want %v", mode.String(), got, err, mode)
+		}
+	}
+	if _, err := ParseBitfieldMode("lazy"); err == nil {
+		t.Error("ParseBitfieldMode accepted an unknown mode")
+	}
+}
+
+func TestWithholdPieces(t *testing.T) {
+	tests := []struct {
+		name     string
+		bitfield []byte
+		n, keep  int
+		want     int
+	}{
+		{"partial", []byte{0xff, 0xff, 0xff}, 16, 1, 16},
+		{"partial with few pieces", []byte{0xa0, 0x00, 0x00}, 16, 1, 1},
+		{"partial with one piece", []byte{0x00, 0x01, 0x00}, 16, 1, 0},
+		{"empty", []byte{0xff, 0x0f, 0x00}, 24, 0, 12},
+	}
+
+	for _, tt := range tests {
+		bitfield := append([]byte(nil), tt.bitfield...)
+		withheld := withholdPieces(bitfield, tt.n, tt.keep)
+		if len(withheld) != tt.want {
+			t.Errorf("%s: withheld %d pieces, want %d", tt.name, len(withheld), tt.want)
+		}
+
+		// Every withheld piece was ours and is now missing from the bitfield
+		for _, index := range withheld {
+			if tt.bitfield[index/8]&(1<<(7-index%8)) == 0 {
+				t.Errorf("%s: withheld piece %d we do not have", tt.name, index)
+			}
+			if bitfield[index/8]&(1<<(7-index%8)) != 0 {
+				t.Errorf("%s: withheld piece %d still in the bitfield", tt.name, index)
+			}
+		}
+		if got := countPieces(tt.bitfield) - countPieces(bitfield); got != len(withheld) {
+			t.Errorf("%s: %d pieces cleared, want %d", tt.name, got, len(withheld))
+		}
+	}
+}
+
+func countPieces(bitfield []byte) int {
+	n := 0
+	for i := 0; i < len(bitfield)*8; i++ {
+		if bitfield[i/8]&(1<<(7-i%8)) != 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -2,8 +2,12 @@ package peer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -22,6 +26,14 @@ const (
 	
 	// CleanupInterval is how often we clean up dead connections
 	CleanupInterval = 1 * time.Minute
+	
+	// MessageWorkers is the number of goroutines handling peer messages.
+	// Each peer's messages go to one of them, so they are handled in order.
+	MessageWorkers = 4
+	
+	// UploadWorkers is the number of goroutines serving upload requests, so
+	// a slow disk read holds up only the block being read
+	UploadWorkers = 4
 )
 
 // Manager manages multiple peer connections
@@ -33,12 +45,17 @@ type Manager struct {
 	maxPeers        int
 	maxDownloadPeers int
 	bitfield        []byte
+	numPieces       int
 	ctx             context.Context
 	cancel          context.CancelFunc
+	stopOnce        sync.Once
 	
-	// Channels
-	incomingPeers   chan *Peer
-	incomingMessages chan PeerMessage
+	// Goroutines started by the manager, which Stop waits for
+	wg sync.WaitGroup
+	
+	// Messages from peers for each message worker. They are never closed;
+	// senders give up once the manager's context is done.
+	dispatch []chan PeerMessage
 	
 	// Statistics
 	stats PeerStats
@@ -48,12 +65,79 @@ type Manager struct {
 	
 	// Piece handler for notifying about received pieces
 	pieceHandler PieceHandler
+	
+	// Handler for peer state changes
+	eventHandler PeerEventHandler
+	
+	// Dialer for outgoing connections, e.g. through a proxy
+	dialer Dialer
+	
+	// Filter for blocked peer addresses
+	filter AddrFilter
+	
+	// DHT node fed with the nodes peers advertise, if DHT is enabled
+	dht DHT
+	
+	// Whether the torrent is private, limiting where peers come from
+	private bool
+	
+	// Addresses banned for sending corrupt data
+	banned *BanList
+	
+	// Candidates waiting for an outgoing connection
+	queue *connectQueue
+	
+	// Requests waiting to be served by the upload loop
+	uploads *uploadQueue
+	
+	// Which peers we upload to
+	choker *choker
+	
+	// Skip HAVE messages to peers that already have the piece
+	suppressHave bool
+	
+	// How our pieces are announced to new peers
+	bitfieldMode BitfieldMode
+	
+	// The longest message a new peer may send and the longest block a
+	// peer may request
+	maxMessageLength int
+	maxRequestLength int
+	
+	// How long a new peer may stay silent
+	idleTimeout time.Duration
+	
+	logger *slog.Logger
+}
+
+// AddrFilter decides whether a peer address is blocked
+type AddrFilter interface {
+	Blocked(ip net.IP) bool
+}
+
+var (
+	ErrPeerBlocked    = errors.New("peer address is blocked")
+	ErrPeerBanned     = errors.New("peer is banned")
+	ErrPeerConnected  = errors.New("peer already connected")
+	ErrTooManyPeers   = errors.New("too many peers")
+	ErrManagerStopped = errors.New("peer manager stopped")
+)
+
+// Dialer opens outgoing peer connections
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 // PieceManager interface for piece operations
 type PieceManager interface {
-	ReadBlockFromDisk(pieceIndex, begin, length int) ([]byte, error)
-	AddBlockData(pieceIndex, begin int, data []byte) error
+	// ReadBlockInto reads a block of a piece we have into buf, which is
+	// as long as the block
+	ReadBlockInto(pieceIndex, begin int, buf []byte) error
+	// PieceLength returns the length of a piece, 0 if it is not known
+	PieceLength(index int) int
+	// AddBlockBuffer takes ownership of data, which may belong to a
+	// pooled buffer, and calls release once it no longer needs it
+	AddBlockBuffer(pieceIndex, begin int, data []byte, release func(), source string) error
 }
 
 // PieceHandler interface for handling received pieces
@@ -77,6 +161,9 @@ type PeerStats struct {
 	UploadingPeers   int
 	BytesDownloaded  int64
 	BytesUploaded    int64
+	QueuedPeers      int
+	HalfOpenPeers    int
+	PeersBySource    map[Source]int
 }
 
 // NewManager creates a new peer manager
@@ -87,6 +174,11 @@ func NewManager(infoHash, peerID [20]byte, numPieces int) *Manager {
 	bitfieldSize := (numPieces + 7) / 8
 	bitfield := make([]byte, bitfieldSize)
 	
+	dispatch := make([]chan PeerMessage, MessageWorkers)
+	for i := range dispatch {
+		dispatch[i] = make(chan PeerMessage, 1000/MessageWorkers)
+	}
+	
 	return &Manager{
 		peers:            make(map[string]*Peer),
 		infoHash:         infoHash,
@@ -94,82 +186,362 @@ func NewManager(infoHash, peerID [20]byte, numPieces int) *Manager {
 		maxPeers:         DefaultMaxPeers,
 		maxDownloadPeers: DefaultMaxDownloadPeers,
 		bitfield:         bitfield,
+		numPieces:        numPieces,
 		ctx:              ctx,
 		cancel:           cancel,
-		incomingPeers:    make(chan *Peer, 100),
-		incomingMessages: make(chan PeerMessage, 1000),
+		dispatch:         dispatch,
+		dialer:           &net.Dialer{},
+		banned:           NewBanList(),
+		queue:            newConnectQueue(DefaultMaxHalfOpen),
+		uploads:          newUploadQueue(),
+		choker:           newChoker(),
+		maxMessageLength: MaxMessageLength,
+		maxRequestLength: MaxRequestLength,
+		idleTimeout:      IdleTimeout,
+		logger:           slog.Default(),
 	}
 }
 
 // Start begins the peer manager
 func (m *Manager) Start() {
-	go m.messageLoop()
-	go m.cleanupLoop()
+	m.StartContext(context.Background())
+}
+
+// StartContext begins the peer manager, which is stopped as by Stop once
+// ctx is done
+func (m *Manager) StartContext(ctx context.Context) {
+	for _, messages := range m.dispatch {
+		m.spawn(func() { m.messageLoop(messages) })
+	}
+	for i := 0; i < UploadWorkers; i++ {
+		m.spawn(m.uploadLoop)
+	}
+	m.spawn(m.cleanupLoop)
+	m.spawn(m.connectLoop)
+	m.spawn(m.snubLoop)
+	m.spawn(m.chokeLoop)
+	
+	context.AfterFunc(ctx, m.Stop)
 }
 
-// Stop shuts down the peer manager and all connections
+// Stop shuts down the peer manager and all connections, and waits for
+// the manager's goroutines and the peers' loops to exit. It may be called
+// any number of times, but not from the manager's own handlers, such as
+// a PieceHandler or PeerEventHandler.
 func (m *Manager) Stop() {
+	m.stopOnce.Do(m.stop)
+}
+
+func (m *Manager) stop() {
+	// From here on no peer is added and no goroutine started
 	m.cancel()
 	
 	m.mu.Lock()
+	peers := make([]*Peer, 0, len(m.peers))
 	for _, peer := range m.peers {
 		peer.Stop()
+		peers = append(peers, peer)
 	}
 	m.mu.Unlock()
 	
-	close(m.incomingPeers)
-	close(m.incomingMessages)
+	m.wg.Wait()
+	for _, peer := range peers {
+		peer.wait()
+	}
+	
+	// Release the buffers of messages nobody will handle
+	for _, messages := range m.dispatch {
+		drainMessages(messages)
+	}
 }
 
-// ConnectToPeers connects to a list of peers from tracker
-func (m *Manager) ConnectToPeers(trackerPeers []tracker.Peer) {
-	for _, trackerPeer := range trackerPeers {
-		if m.GetActivePeerCount() >= m.maxPeers {
-			break
+// drainMessages releases the buffers of the messages left in a channel
+func drainMessages(messages chan PeerMessage) {
+	for {
+		select {
+		case peerMsg := <-messages:
+			if peerMsg.Message != nil {
+				peerMsg.Message.Release()
+			}
+		default:
+			return
 		}
+	}
+}
+
+// spawn runs f in a goroutine that Stop waits for, returning false
+// without running it if the manager is stopping
+func (m *Manager) spawn(f func()) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	// Checked under the lock Stop takes after cancelling, so every Add
+	// happens before Stop waits
+	if m.ctx.Err() != nil {
+		return false
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// ConnectToPeers queues peers from a tracker for connection. They are
+// dialed by the connect loop once the manager is started.
+func (m *Manager) ConnectToPeers(trackerPeers []tracker.Peer) {
+	m.AddPeers(trackerPeers, SourceTracker)
+}
+
+// AddPeers queues peers learned from source for connection
+func (m *Manager) AddPeers(peers []tracker.Peer, source Source) {
+	if !m.allowedSource(source) {
+		m.log().Debug("Ignoring peers for private torrent", "source", source, "count", len(peers))
+		return
+	}
+	m.queue.add(peers, source)
+}
+
+// connectLoop dials queued candidates as half-open and peer slots allow
+func (m *Manager) connectLoop() {
+	ticker := time.NewTicker(ConnectInterval)
+	defer ticker.Stop()
+	
+	for {
+		m.dialCandidates()
 		
-		go m.connectToPeer(trackerPeer)
+		select {
+		case <-m.queue.wake:
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
 	}
 }
 
-// connectToPeer connects to a single peer
-func (m *Manager) connectToPeer(trackerPeer tracker.Peer) {
+// dialCandidates starts dials for the best ready candidates
+func (m *Manager) dialCandidates() {
+	free := m.maxPeers - m.GetActivePeerCount()
+	for _, c := range m.queue.next(time.Now(), free) {
+		started := m.spawn(func() {
+			err := m.connectToPeer(c.peer, c.source)
+			if err != nil {
+				m.log().Debug("Failed to connect to peer", "addr", c.addr, "err", err)
+				
+				// A relay may get us through the peer's NAT
+				var opErr *net.OpError
+				if errors.As(err, &opErr) && opErr.Op == "dial" {
+					m.rendezvousRelays(c.peer)
+				}
+			}
+			m.queue.done(c, err, time.Now())
+		})
+		if !started {
+			m.queue.done(c, m.ctx.Err(), time.Now())
+		}
+	}
+}
+
+// connectToPeer connects to a single peer learned from source
+func (m *Manager) connectToPeer(trackerPeer tracker.Peer, source Source) error {
 	addr := net.JoinHostPort(trackerPeer.IP.String(), fmt.Sprintf("%d", trackerPeer.Port))
 	
 	// Check if we're already connected to this peer
 	if m.hasPeer(addr) {
-		return
+		return ErrPeerConnected
 	}
 	
-	conn, err := net.DialTimeout("tcp", addr, ConnectionTimeout)
+	if !m.allowedSource(source) {
+		return ErrPrivateSource
+	}
+	if m.isBlocked(trackerPeer.IP) {
+		return ErrPeerBlocked
+	}
+	if m.IsBanned(trackerPeer.IP) {
+		return ErrPeerBanned
+	}
+	
+	m.mu.RLock()
+	dialer := m.dialer
+	m.mu.RUnlock()
+	
+	ctx, cancel := context.WithTimeout(m.ctx, ConnectionTimeout)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	cancel()
 	if err != nil {
-		return
+		return err
 	}
 	
 	peer := NewPeer(conn, m.infoHash, m.peerID)
+	peer.SetSource(source)
+	peer.numPieces = m.pieceCount()
+	peer.onEvent = m.peerEvent
+	peer.onSent = m.uploads.signal
+	peer.dhtPort = m.dhtPort()
+	peer.private = m.isPrivate()
+	peer.maxMessageLength = m.messageLength()
+	peer.maxRequestLength = m.requestLength()
+	peer.idleTimeout = m.peerIdleTimeout()
+	peer.logger = m.log()
+	
+	// Stopping the manager abandons the handshake
+	if err := peer.StartContext(m.ctx); err != nil {
+		peer.Stop()
+		return err
+	}
+	
+	return m.registerPeer(peer)
+}
+
+// AddIncomingPeer takes over an accepted connection whose handshake has
+// already been read and matched to this torrent
+func (m *Manager) AddIncomingPeer(conn net.Conn, handshake *Handshake) error {
+	if m.ctx.Err() != nil {
+		return ErrManagerStopped
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if m.isBlocked(tcpAddr.IP) {
+			return ErrPeerBlocked
+		}
+		if m.IsBanned(tcpAddr.IP) {
+			return ErrPeerBanned
+		}
+	}
+	if m.hasPeer(conn.RemoteAddr().String()) {
+		return ErrPeerConnected
+	}
+	if m.GetActivePeerCount() >= m.maxPeers {
+		return ErrTooManyPeers
+	}
 	
-	if err := peer.Start(); err != nil {
+	peer := NewPeer(conn, m.infoHash, m.peerID)
+	peer.SetSource(SourceIncoming)
+	peer.numPieces = m.pieceCount()
+	peer.onEvent = m.peerEvent
+	peer.onSent = m.uploads.signal
+	peer.dhtPort = m.dhtPort()
+	peer.private = m.isPrivate()
+	peer.maxMessageLength = m.messageLength()
+	peer.maxRequestLength = m.requestLength()
+	peer.idleTimeout = m.peerIdleTimeout()
+	peer.logger = m.log()
+	if err := peer.AcceptContext(m.ctx, handshake); err != nil {
 		peer.Stop()
+		return err
+	}
+	
+	return m.registerPeer(peer)
+}
+
+// registerPeer adds a connected peer and starts handling its messages,
+// stopping it if it cannot be added
+func (m *Manager) registerPeer(peer *Peer) error {
+	if !m.addPeer(peer) {
+		peer.Stop()
+		if m.ctx.Err() != nil {
+			return ErrManagerStopped
+		}
+		return ErrTooManyPeers
+	}
+	m.peerEvent(PeerEvent{Type: PeerConnected, Peer: peer})
+	
+	// The piece count may have become known while the peer connected
+	if n := m.pieceCount(); n > 0 {
+		m.applyNumPieces(peer, n)
+	}
+	
+	if !m.spawn(func() { m.handlePeer(peer) }) {
+		// The manager stopped while the peer was added
+		peer.Stop()
+		m.removePeer(peer)
+		return ErrManagerStopped
+	}
+	
+	m.announcePieces(peer)
+	return nil
+}
+
+// isBlocked returns true if the filter blocks ip
+func (m *Manager) isBlocked(ip net.IP) bool {
+	m.mu.RLock()
+	filter := m.filter
+	m.mu.RUnlock()
+	
+	return filter != nil && filter.Blocked(ip)
+}
+
+// BanPeer disconnects every peer at the IP of addr and refuses further
+// connections from it
+func (m *Manager) BanPeer(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
 		return
 	}
 	
-	// Add to peer list
-	if m.addPeer(peer) {
-		go m.handlePeer(peer)
-		
-		// Send our bitfield if we have any pieces
-		if m.hasPieces() {
-			peer.SendBitfield(m.getBitfield())
+	m.mu.Lock()
+	m.banned.Add(ip)
+	var toStop []*Peer
+	for _, peer := range m.peers {
+		if tcpAddr, ok := peer.Address().(*net.TCPAddr); ok && tcpAddr.IP.Equal(ip) {
+			toStop = append(toStop, peer)
 		}
-	} else {
+	}
+	m.mu.Unlock()
+	
+	for _, peer := range toStop {
 		peer.Stop()
 	}
 }
 
-// handlePeer handles messages from a specific peer
+// HashFailed records that the peer at addr contributed to a piece that
+// failed verification
+func (m *Manager) HashFailed(addr string) {
+	m.mu.RLock()
+	peer, exists := m.peers[addr]
+	m.mu.RUnlock()
+	
+	if exists {
+		peer.RecordHashFailure()
+	}
+}
+
+// BytesWasted records bytes the peer at addr sent that were thrown away
+func (m *Manager) BytesWasted(addr string, n int64) {
+	m.mu.RLock()
+	peer, exists := m.peers[addr]
+	m.mu.RUnlock()
+	
+	if exists {
+		peer.RecordWaste(n)
+	}
+}
+
+// IsBanned returns true if ip has been banned
+func (m *Manager) IsBanned(ip net.IP) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.banned.Contains(ip)
+}
+
+// BannedPeers returns the banned IP addresses
+func (m *Manager) BannedPeers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.banned.IPs()
+}
+
+// handlePeer handles messages from a specific peer until it disconnects
+// or the manager stops, then stops and removes it
 func (m *Manager) handlePeer(peer *Peer) {
 	defer m.removePeer(peer)
+	defer peer.Stop()
 	
+	messages := m.worker(peer)
 	for {
 		select {
 		case <-peer.Done():
@@ -184,9 +556,9 @@ func (m *Manager) handlePeer(peer *Peer) {
 			return
 		}
 		
-		// Forward message to main message loop
+		// Forward message to the peer's message worker
 		select {
-		case m.incomingMessages <- PeerMessage{Peer: peer, Message: msg}:
+		case messages <- PeerMessage{Peer: peer, Message: msg}:
 		case <-m.ctx.Done():
 			return
 		case <-peer.Done():
@@ -195,11 +567,19 @@ func (m *Manager) handlePeer(peer *Peer) {
 	}
 }
 
-// messageLoop processes incoming messages from all peers
-func (m *Manager) messageLoop() {
+// worker returns the channel of the message worker that handles a peer's
+// messages, chosen by its address
+func (m *Manager) worker(peer *Peer) chan PeerMessage {
+	h := fnv.New32a()
+	h.Write([]byte(peer.Address().String()))
+	return m.dispatch[h.Sum32()%uint32(len(m.dispatch))]
+}
+
+// messageLoop processes the messages of the peers assigned to a worker
+func (m *Manager) messageLoop(messages chan PeerMessage) {
 	for {
 		select {
-		case peerMsg := <-m.incomingMessages:
+		case peerMsg := <-messages:
 			m.handlePeerMessage(peerMsg)
 		case <-m.ctx.Done():
 			return
@@ -226,11 +606,12 @@ func (m *Manager) handlePeerMessage(peerMsg PeerMessage) {
 		m.handlePieceRequest(peer, index, begin, length)
 		
 	case MsgPiece:
-		index, begin, block, err := msg.ParsePiece()
+		index, begin, block, err := msg.PieceBlock()
 		if err != nil {
+			msg.Release()
 			return
 		}
-		m.handlePieceData(peer, index, begin, block)
+		m.handlePieceData(peer, index, begin, block, msg.Release)
 		
 	case MsgCancel:
 		index, begin, length, err := msg.ParseCancel()
@@ -238,43 +619,47 @@ func (m *Manager) handlePeerMessage(peerMsg PeerMessage) {
 			return
 		}
 		m.handleCancelRequest(peer, index, begin, length)
+		
+	case MsgPort:
+		port, err := msg.ParsePort()
+		if err != nil {
+			return
+		}
+		m.handlePort(peer, port)
+		
+	case MsgExtended:
+		if len(msg.Payload) > 0 && msg.Payload[0] == HolepunchID {
+			m.handleHolepunch(peer, msg.Payload)
+		}
 	}
 }
 
-// handlePieceRequest handles a piece request from a peer
+// handlePieceRequest queues a piece request from a peer for the upload
+// loop, discarding requests we cannot serve
 func (m *Manager) handlePieceRequest(peer *Peer, index, begin, length uint32) {
-	// Check if we have this piece
-	if !m.hasPieceIndex(int(index)) {
+	r := uploadRequest{index, begin, length}
+	
+	// Check if we have this piece, the peer may download from us and the
+	// block lies within the piece and is not too long
+	if !m.hasPieceIndex(int(index)) || !peer.CanUpload() || !m.validRequest(peer, r) {
+		m.refuseRequest(peer, r)
 		return
 	}
 	
-	// Check if peer can upload
-	if !peer.CanUpload() {
+	if !m.uploads.push(peer, r) {
+		// Already queued; the duplicate holds no slot
+		peer.RequestDone()
 		return
 	}
 	
-	// Read block data from disk through piece manager
-	m.mu.RLock()
-	pieceManager := m.pieceManager
-	m.mu.RUnlock()
-	
-	if pieceManager != nil {
-		blockData, err := pieceManager.ReadBlockFromDisk(int(index), int(begin), int(length))
-		if err == nil {
-			// Send the block data to the peer
-			msg := NewPieceMessage(index, begin, blockData)
-			peer.SendMessage(msg)
-			
-			// Update upload statistics
-			m.stats.mu.Lock()
-			m.stats.BytesUploaded += int64(len(blockData))
-			m.stats.mu.Unlock()
-		}
+	if peer.sequentialRequest(index, begin, length) {
+		m.readAhead(int(index))
 	}
 }
 
-// handlePieceData handles piece data from a peer
-func (m *Manager) handlePieceData(peer *Peer, index, begin uint32, block []byte) {
+// handlePieceData hands a received block to the piece manager, along
+// with release for the buffer it lives in
+func (m *Manager) handlePieceData(peer *Peer, index, begin uint32, block []byte, release func()) {
 	// Update statistics
 	m.stats.mu.Lock()
 	m.stats.BytesDownloaded += int64(len(block))
@@ -286,26 +671,27 @@ func (m *Manager) handlePieceData(peer *Peer, index, begin uint32, block []byte)
 	pieceHandler := m.pieceHandler
 	m.mu.RUnlock()
 	
-	if pieceManager != nil {
-		// Add the block data to the piece manager
-		// The piece manager will handle verification and disk storage
-		err := pieceManager.AddBlockData(int(index), int(begin), block)
-		if err != nil {
-			// Log error or handle appropriately
-			// For now, we just ignore the error
-			_ = err
-		}
-		
-		// Notify the piece handler about received piece
-		if pieceHandler != nil {
-			pieceHandler.HandlePieceReceived(int(index), int(begin))
-		}
+	if pieceManager == nil {
+		release()
+		return
+	}
+	
+	// The piece manager will handle verification and disk storage, and
+	// releases the buffer even if it rejects the block
+	pieceManager.AddBlockBuffer(int(index), int(begin), block, release, peer.Address().String())
+	
+	// Notify the piece handler about received piece
+	if pieceHandler != nil {
+		pieceHandler.HandlePieceReceived(int(index), int(begin))
 	}
 }
 
-// handleCancelRequest handles a cancel request from a peer
+// handleCancelRequest removes a request the peer no longer wants from the
+// upload queue
 func (m *Manager) handleCancelRequest(peer *Peer, index, begin, length uint32) {
-	// TODO: Cancel any pending piece sending
+	if m.uploads.cancel(peer, uploadRequest{index, begin, length}) {
+		peer.RequestDone()
+	}
 }
 
 // cleanupLoop periodically cleans up dead connections
@@ -346,6 +732,11 @@ func (m *Manager) addPeer(peer *Peer) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	// A stopping manager takes no new peers
+	if m.ctx.Err() != nil {
+		return false
+	}
+	
 	// Check limits
 	if len(m.peers) >= m.maxPeers {
 		return false
@@ -367,14 +758,15 @@ func (m *Manager) addPeer(peer *Peer) bool {
 	return true
 }
 
-// removePeer removes a peer from the manager
+// removePeer removes a peer from the manager and reports the disconnect
+// so its outstanding requests can go to other peers
 func (m *Manager) removePeer(peer *Peer) {
 	addr := peer.Address().String()
+	m.dropUploads(peer)
 	
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	
-	if _, exists := m.peers[addr]; exists {
+	current, exists := m.peers[addr]
+	if exists && current == peer {
 		delete(m.peers, addr)
 		
 		m.stats.mu.Lock()
@@ -382,6 +774,11 @@ func (m *Manager) removePeer(peer *Peer) {
 		m.stats.TotalDisconnected++
 		m.stats.mu.Unlock()
 	}
+	m.mu.Unlock()
+	
+	if exists && current == peer {
+		m.peerEvent(PeerEvent{Type: PeerDisconnected, Peer: peer})
+	}
 }
 
 // hasPeer checks if we're connected to a peer at the given address
@@ -454,12 +851,20 @@ func (m *Manager) RequestPieceFromPeers(index int, begin, length uint32) error {
 	return fmt.Errorf("no peers have piece %d", index)
 }
 
-// BroadcastHave broadcasts that we have a piece to all peers
+// BroadcastHave broadcasts that we have a piece to all peers. With have
+// suppression enabled, peers that already have the piece are skipped.
 func (m *Manager) BroadcastHave(index int) {
 	peers := m.GetPeers()
 	msg := NewHaveMessage(uint32(index))
 	
+	m.mu.RLock()
+	suppress := m.suppressHave
+	m.mu.RUnlock()
+	
 	for _, peer := range peers {
+		if suppress && peer.HasPiece(index) {
+			continue
+		}
 		peer.SendMessage(msg)
 	}
 	
@@ -472,6 +877,10 @@ func (m *Manager) setPiece(index int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	if index < 0 || index >= m.numPieces {
+		return
+	}
+	
 	byteIndex := index / 8
 	bitIndex := index % 8
 	
@@ -485,6 +894,10 @@ func (m *Manager) hasPieceIndex(index int) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
+	if index < 0 || index >= m.numPieces {
+		return false
+	}
+	
 	byteIndex := index / 8
 	bitIndex := index % 8
 	
@@ -528,6 +941,13 @@ func (m *Manager) GetStats() PeerStats {
 	downloadingPeers := len(m.GetDownloadingPeers())
 	uploadingPeers := len(m.GetUploadingPeers())
 	
+	queued, halfOpen := m.queue.len()
+	
+	bySource := make(map[Source]int)
+	for _, peer := range m.GetPeers() {
+		bySource[peer.Source()]++
+	}
+	
 	// Create a copy without the mutex
 	return PeerStats{
 		TotalConnected:   m.stats.TotalConnected,
@@ -537,6 +957,9 @@ func (m *Manager) GetStats() PeerStats {
 		UploadingPeers:   uploadingPeers,
 		BytesDownloaded:  m.stats.BytesDownloaded,
 		BytesUploaded:    m.stats.BytesUploaded,
+		QueuedPeers:      queued,
+		HalfOpenPeers:    halfOpen,
+		PeersBySource:    bySource,
 	}
 }
 
@@ -547,6 +970,32 @@ func (m *Manager) SetMaxPeers(max int) {
 	m.maxPeers = max
 }
 
+// SetExternalAddr sets our address as seen by other peers, which ranks
+// connection candidates by BEP 40 priority
+func (m *Manager) SetExternalAddr(ip net.IP, port uint16) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return
+	}
+	m.queue.setSelf(netip.AddrPortFrom(addr.Unmap(), port))
+}
+
+// SetMaxHalfOpen sets the maximum number of concurrent outgoing dials
+func (m *Manager) SetMaxHalfOpen(max int) {
+	m.queue.mu.Lock()
+	defer m.queue.mu.Unlock()
+	m.queue.maxHalfOpen = max
+}
+
+// SetHaveSuppression sets whether HAVE messages are withheld from peers
+// that already have the piece. This saves bandwidth, but such peers can no
+// longer tell how far along we are.
+func (m *Manager) SetHaveSuppression(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.suppressHave = enabled
+}
+
 // SetMaxDownloadPeers sets the maximum number of download connections
 func (m *Manager) SetMaxDownloadPeers(max int) {
 	m.mu.Lock()
@@ -554,6 +1003,21 @@ func (m *Manager) SetMaxDownloadPeers(max int) {
 	m.maxDownloadPeers = max
 }
 
+// SetLogger sets the logger for the manager and the peers it connects
+// from now on
+func (m *Manager) SetLogger(logger *slog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = logger
+}
+
+// log returns the manager's logger
+func (m *Manager) log() *slog.Logger {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.logger
+}
+
 // SetPieceManager sets the piece manager for piece operations
 func (m *Manager) SetPieceManager(pieceManager PieceManager) {
 	m.mu.Lock()
@@ -561,6 +1025,20 @@ func (m *Manager) SetPieceManager(pieceManager PieceManager) {
 	m.pieceManager = pieceManager
 }
 
+// SetDialer sets the dialer used for outgoing peer connections
+func (m *Manager) SetDialer(dialer Dialer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialer = dialer
+}
+
+// SetFilter sets the filter applied to outgoing and incoming peers
+func (m *Manager) SetFilter(filter AddrFilter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filter = filter
+}
+
 // SetPieceHandler sets the piece handler for piece notifications
 func (m *Manager) SetPieceHandler(pieceHandler PieceHandler) {
 	m.mu.Lock()
@@ -598,6 +1076,10 @@ func (m *Manager) GetPeerInfo() []PeerInfo {
 			IsConnected:    peer.IsConnected(),
 			CanDownload:    peer.CanDownload(),
 			CanUpload:      peer.CanUpload(),
+			Stats:          peer.Stats(),
+			Source:         peer.Source(),
+			IsSnubbed:      peer.IsSnubbed(),
+			Client:         peer.Client(),
 		}
 	}
 	
@@ -614,6 +1096,10 @@ type PeerInfo struct {
 	IsConnected bool
 	CanDownload bool
 	CanUpload   bool
+	Stats       TransferStats
+	Source      Source
+	IsSnubbed   bool
+	Client      string // client name and version, or "" if unknown
 }
 
 // GetConnectedPeers returns a list of all connected peers (alias for GetPeers)
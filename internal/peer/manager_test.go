@@ -1,7 +1,11 @@
 package peer
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -407,6 +411,79 @@ func TestManagerConnectToPeers(t *testing.T) {
 	}
 }
 
+// recordingDialer records dialed addresses and always fails
+type recordingDialer struct {
+	dialed chan string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed <- address
+	return nil, errors.New("dial refused")
+}
+
+func TestManagerSetDialer(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	dialer := &recordingDialer{dialed: make(chan string, 1)}
+	manager.SetDialer(dialer)
+	manager.Start()
+	defer manager.Stop()
+
+	manager.ConnectToPeers([]tracker.Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+
+	select {
+	case addr := <-dialer.dialed:
+		if addr != "10.0.0.1:6881" {
+			t.Errorf("dialed %q, want %q", addr, "10.0.0.1:6881")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("custom dialer was not used")
+	}
+}
+
+// blockAll is a filter that blocks every address
+type blockAll struct{}
+
+func (blockAll) Blocked(ip net.IP) bool { return true }
+
+func TestManagerFilterBlocksDials(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	dialer := &recordingDialer{dialed: make(chan string, 1)}
+	manager.SetDialer(dialer)
+	manager.SetFilter(blockAll{})
+
+	manager.connectToPeer(tracker.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, SourceTracker)
+
+	select {
+	case addr := <-dialer.dialed:
+		t.Errorf("dialed blocked address %q", addr)
+	default:
+	}
+}
+
+func TestManagerBanPeer(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	dialer := &recordingDialer{dialed: make(chan string, 1)}
+	manager.SetDialer(dialer)
+
+	manager.BanPeer("10.0.0.1:6881")
+
+	if !manager.IsBanned(net.IPv4(10, 0, 0, 1)) {
+		t.Error("IsBanned = false after BanPeer")
+	}
+
+	// Bans apply to the IP, whatever the port
+	manager.connectToPeer(tracker.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 7000}, SourceTracker)
+	select {
+	case addr := <-dialer.dialed:
+		t.Errorf("dialed banned address %q", addr)
+	default:
+	}
+
+	if banned := manager.BannedPeers(); len(banned) != 1 || banned[0] != "10.0.0.1" {
+		t.Errorf("BannedPeers = %v, want [10.0.0.1]", banned)
+	}
+}
+
 func TestManagerGetPeerInfo(t *testing.T) {
 	manager := NewManager([20]byte{}, [20]byte{}, 10)
 	
@@ -469,4 +546,116 @@ func TestManagerStartStop(t *testing.T) {
 	default:
 		t.Error("Manager context should be cancelled after stop")
 	}
-}
\ No newline at end of file
+}
+
+func TestManagerStartContext(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.StartContext(ctx)
+
+	cancel()
+	select {
+	case <-manager.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("manager still running after its context was cancelled")
+	}
+
+	// Stopping again is harmless
+	manager.Stop()
+}
+
+// addrConn is a connection with a remote address of its own, so pipes can
+// be told apart
+type addrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return &mockAddr{c.addr} }
+
+// floodingPeer connects a remote peer to the manager that, once the
+// handshake is done, sends HAVE messages until its connection closes
+func floodingPeer(t *testing.T, m *Manager, i int) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	go func() {
+		if _, err := Read(remote); err != nil {
+			return
+		}
+		for {
+			if _, err := remote.Write(NewHaveMessage(uint32(i % 10)).Serialize()); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		conn := addrConn{local, fmt.Sprintf("10.0.0.%d:6881", i)}
+		m.AddIncomingPeer(conn, NewHandshake(m.infoHash, [20]byte{byte(i)}))
+	}()
+}
+
+func TestManagerStopStress(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		m := NewManager([20]byte{1}, [20]byte{2}, 10)
+		m.Start()
+		for i := 0; i < 20; i++ {
+			floodingPeer(t, m, i)
+		}
+
+		// Stop concurrently, from several goroutines and the context
+		ctx, cancel := context.WithCancel(context.Background())
+		m.StartContext(ctx)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.Stop()
+			}()
+		}
+		cancel()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop did not return")
+		}
+
+		for _, peer := range m.GetPeers() {
+			if peer.IsConnected() {
+				t.Errorf("peer %s still connected after Stop", peer.Address())
+			}
+		}
+		if err := m.AddIncomingPeer(addrConn{&mockConn{}, "10.0.1.1:6881"}, NewHandshake(m.infoHash, [20]byte{})); !errors.Is(err, ErrManagerStopped) {
+			t.Errorf("AddIncomingPeer after Stop error = %v, want %v", err, ErrManagerStopped)
+		}
+	}
+}
+
+func TestPeerStopConcurrent(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.Stop()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-peer.Done():
+	default:
+		t.Error("Done not closed after Stop")
+	}
+}
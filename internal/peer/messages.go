@@ -1,7 +1,9 @@
 package peer
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -20,14 +22,23 @@ const (
 	MsgPiece         = 7
 	MsgCancel        = 8
 	MsgPort          = 9 // DHT extension
+	MsgSuggestPiece  = 13 // BEP 6 fast extension
+	MsgHaveAll       = 14 // BEP 6 fast extension
+	MsgHaveNone      = 15 // BEP 6 fast extension
+	MsgRejectRequest = 16 // BEP 6 fast extension
+	MsgAllowedFast   = 17 // BEP 6 fast extension
+	MsgExtended      = 20 // BEP 10 extension protocol
 )
 
 const (
 	// MessageTimeout is the timeout for message operations
 	MessageTimeout = 30 * time.Second
 	
-	// MaxMessageLength is the maximum allowed message length
-	MaxMessageLength = 131072 // 128KB
+	// MaxMessageLength is the default limit on the length of a message
+	// from a peer: a piece message carrying a MaxRequestLength block. A
+	// peer may send a longer bitfield if the torrent needs one, or a
+	// longer piece if it may request longer blocks.
+	MaxMessageLength = MaxRequestLength + 9
 	
 	// BlockSize is the standard block size for piece requests
 	BlockSize = 16384 // 16KB
@@ -37,6 +48,8 @@ const (
 type Message struct {
 	ID      uint8
 	Payload []byte
+	
+	pooled *[]byte // buffer backing Payload, returned by Release
 }
 
 // NewMessage creates a new message with the given ID and payload
@@ -69,21 +82,26 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
-// ReadMessage reads a message from a connection
+// ErrMessageTooLarge is returned for a message longer than the reader's
+// limit
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ReadMessage reads a message from a connection. It blocks until a whole
+// message arrives or the reader fails; use ReadMessageTimeout or
+// ReadMessageContext to bound the wait.
 func ReadMessage(r io.Reader) (*Message, error) {
-	// Set read timeout if it's a net.Conn
-	if conn, ok := r.(net.Conn); ok {
-		conn.SetReadDeadline(time.Now().Add(MessageTimeout))
-		defer conn.SetReadDeadline(time.Time{})
-	}
-	
+	return readMessage(r, MaxMessageLength)
+}
+
+// readMessage is ReadMessage with messages longer than limit refused
+func readMessage(r io.Reader, limit int) (*Message, error) {
 	// Read length prefix (4 bytes)
-	lengthBuf := make([]byte, 4)
-	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
 		return nil, fmt.Errorf("failed to read message length: %w", err)
 	}
 	
-	length := binary.BigEndian.Uint32(lengthBuf)
+	length := binary.BigEndian.Uint32(header[:])
 	
 	// Keep-alive message
 	if length == 0 {
@@ -91,20 +109,42 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	}
 	
 	// Validate message length
-	if length > MaxMessageLength {
-		return nil, fmt.Errorf("message too large: %d bytes", length)
+	if int64(length) > int64(limit) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, length)
 	}
 	
-	// Read message ID and payload
-	messageBuf := make([]byte, length)
-	if _, err := io.ReadFull(r, messageBuf); err != nil {
+	// Read message ID
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
 		return nil, fmt.Errorf("failed to read message: %w", err)
 	}
+	msg := &Message{ID: header[0]}
+	
+	// Piece payloads come from a pool; everything else is small or rare
+	size := int(length) - 1
+	if msg.ID == MsgPiece && size <= pieceBufferSize {
+		msg.pooled = getPieceBuffer()
+		msg.Payload = (*msg.pooled)[:size]
+	} else {
+		msg.Payload = make([]byte, size)
+	}
 	
-	return &Message{
-		ID:      messageBuf[0],
-		Payload: messageBuf[1:],
-	}, nil
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		msg.Release()
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	
+	return msg, nil
+}
+
+// Release returns a pooled payload buffer for reuse. Neither the message
+// nor any slice of its payload may be used afterwards.
+func (m *Message) Release() {
+	if m == nil || m.pooled == nil {
+		return
+	}
+	putPieceBuffer(m.pooled)
+	m.pooled = nil
+	m.Payload = nil
 }
 
 // WriteMessage writes a message to a connection
@@ -173,11 +213,18 @@ func NewRequestMessage(index, begin, length uint32) *Message {
 
 // NewPieceMessage creates a piece message with block data
 func NewPieceMessage(index, begin uint32, block []byte) *Message {
-	payload := make([]byte, 8+len(block))
+	msg, data := newPieceMessage(index, begin, len(block))
+	copy(data, block)
+	return msg
+}
+
+// newPieceMessage creates a piece message for a block of length bytes and
+// returns the part of its payload the block goes in
+func newPieceMessage(index, begin uint32, length int) (*Message, []byte) {
+	payload := make([]byte, 8+length)
 	binary.BigEndian.PutUint32(payload[0:4], index)
 	binary.BigEndian.PutUint32(payload[4:8], begin)
-	copy(payload[8:], block)
-	return NewMessage(MsgPiece, payload)
+	return NewMessage(MsgPiece, payload), payload[8:]
 }
 
 // NewCancelMessage creates a cancel message for a piece block
@@ -260,6 +307,23 @@ func (m *Message) ParsePiece() (index, begin uint32, block []byte, err error) {
 	return index, begin, block, nil
 }
 
+// PieceBlock parses a piece message like ParsePiece, but returns the block
+// as a slice of the payload instead of a copy. It is only valid until the
+// message is released.
+func (m *Message) PieceBlock() (index, begin uint32, block []byte, err error) {
+	if m.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("not a piece message: ID %d", m.ID)
+	}
+	
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("invalid piece payload length: %d", len(m.Payload))
+	}
+	
+	index = binary.BigEndian.Uint32(m.Payload[0:4])
+	begin = binary.BigEndian.Uint32(m.Payload[4:8])
+	return index, begin, m.Payload[8:], nil
+}
+
 // ParseCancel parses a cancel message and returns index, begin, length
 func (m *Message) ParseCancel() (index, begin, length uint32, err error) {
 	if m.ID != MsgCancel {
@@ -307,6 +371,11 @@ func (m *Message) String() string {
 		MsgPiece:         "Piece",
 		MsgCancel:        "Cancel",
 		MsgPort:          "Port",
+		MsgHaveAll:       "HaveAll",
+		MsgHaveNone:      "HaveNone",
+		MsgRejectRequest: "RejectRequest",
+		MsgSuggestPiece:  "SuggestPiece",
+		MsgAllowedFast:   "AllowedFast",
 	}
 	
 	name, ok := names[m.ID]
@@ -324,13 +393,13 @@ func (m *Message) IsValid() bool {
 	}
 	
 	switch m.ID {
-	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested:
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
 		return len(m.Payload) == 0
-	case MsgHave:
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
 		return len(m.Payload) == 4
 	case MsgBitfield:
 		return len(m.Payload) > 0
-	case MsgRequest, MsgCancel:
+	case MsgRequest, MsgCancel, MsgRejectRequest:
 		return len(m.Payload) == 12
 	case MsgPiece:
 		return len(m.Payload) >= 8
@@ -374,24 +443,35 @@ func CopyMessage(msg *Message) *Message {
 	}
 }
 
-// ReadMessageTimeout reads a message with a specific timeout
-func ReadMessageTimeout(r io.Reader, timeout time.Duration) (*Message, error) {
-	type result struct {
-		msg *Message
-		err error
-	}
-	
-	ch := make(chan result, 1)
-	
-	go func() {
-		msg, err := ReadMessage(r)
-		ch <- result{msg, err}
-	}()
-	
-	select {
-	case res := <-ch:
-		return res.msg, res.err
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("message read timeout after %v", timeout)
+// ReadMessageTimeout reads a message, failing if it does not arrive within
+// timeout
+func ReadMessageTimeout(conn net.Conn, timeout time.Duration) (*Message, error) {
+	var msg *Message
+	err := readWithTimeout(conn, timeout, func() (err error) {
+		msg, err = ReadMessage(conn)
+		return err
+	})
+	return msg, err
+}
+
+// ReadMessageContext reads a message, giving up when ctx is done. The
+// connection's read deadline is reset when ctx ends, so the caller must
+// set a new one before reading again.
+func ReadMessageContext(ctx context.Context, conn net.Conn) (*Message, error) {
+	return readMessageContext(ctx, conn, MaxMessageLength)
+}
+
+// readMessageContext is ReadMessageContext with messages longer than limit
+// refused
+func readMessageContext(ctx context.Context, conn net.Conn, limit int) (*Message, error) {
+	var msg *Message
+	err := readWithContext(ctx, conn, func() (err error) {
+		msg, err = readMessage(conn, limit)
+		return err
+	})
+	if err != nil {
+		msg.Release()
+		return nil, err
 	}
+	return msg, nil
 }
\ No newline at end of file
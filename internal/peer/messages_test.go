@@ -2,6 +2,9 @@ package peer
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"testing"
 	"time"
 )
@@ -319,12 +322,15 @@ func TestCopyMessage(t *testing.T) {
 }
 
 func TestReadMessageTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
 	// Test successful read
 	msg := NewHaveMessage(42)
-	data := msg.Serialize()
-	buf := bytes.NewBuffer(data)
+	go server.Write(msg.Serialize())
 
-	result, err := ReadMessageTimeout(buf, 1*time.Second)
+	result, err := ReadMessageTimeout(client, 1*time.Second)
 	if err != nil {
 		t.Errorf("ReadMessageTimeout failed: %v", err)
 	}
@@ -333,10 +339,39 @@ func TestReadMessageTimeout(t *testing.T) {
 	}
 
 	// Test timeout
-	slowReader := &slowReader{}
-	_, err = ReadMessageTimeout(slowReader, 100*time.Millisecond)
-	if err == nil {
-		t.Error("Expected timeout error")
+	_, err = ReadMessageTimeout(client, 100*time.Millisecond)
+	if !isTimeout(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write(NewHaveMessage(42).Serialize())
+	msg, err := ReadMessageContext(context.Background(), client)
+	if err != nil || msg == nil || msg.ID != MsgHave {
+		t.Fatalf("ReadMessageContext = %v, %v, want have", msg, err)
+	}
+
+	// Cancelling the context unblocks a pending read
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = ReadMessageContext(ctx, client)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadMessageContext error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadMessageContext returned after %v", elapsed)
+	}
+
+	// A done context fails without reading
+	if _, err := ReadMessageContext(ctx, client); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadMessageContext with done context = %v, want %v", err, context.Canceled)
 	}
 }
 
@@ -357,11 +392,53 @@ func TestLargeMessage(t *testing.T) {
 		t.Error("Expected error for oversized message")
 	}
 }
+func TestReadMessagePooledPiece(t *testing.T) {
+	block := bytes.Repeat([]byte{0xab}, BlockSize)
+	data := NewPieceMessage(4, BlockSize, block).Serialize()
+
+	msg, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if msg.pooled == nil {
+		t.Fatal("piece payload was not read into a pooled buffer")
+	}
+
+	index, begin, got, err := msg.PieceBlock()
+	if err != nil {
+		t.Fatalf("PieceBlock failed: %v", err)
+	}
+	if index != 4 || begin != BlockSize || !bytes.Equal(got, block) {
+		t.Errorf("PieceBlock = %d, %d, %d bytes, want 4, %d, %d bytes", index, begin, len(got), BlockSize, BlockSize)
+	}
+
+	// The block aliases the payload rather than copying it
+	got[0] = 0
+	if msg.Payload[8] != 0 {
+		t.Error("PieceBlock returned a copy")
+	}
+
+	msg.Release()
+	if msg.pooled != nil || msg.Payload != nil {
+		t.Error("Release did not drop the buffer")
+	}
+	msg.Release() // a second release is harmless
+}
+
+func TestReadMessageUnpooled(t *testing.T) {
+	data := NewHaveMessage(7).Serialize()
 
-// slowReader blocks for a while before returning data
-type slowReader struct{}
+	msg, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if msg.pooled != nil {
+		t.Error("have message used a pooled buffer")
+	}
 
-func (r *slowReader) Read(p []byte) (n int, err error) {
-	time.Sleep(200 * time.Millisecond)
-	return 0, nil
-}
\ No newline at end of file
+	// Releasing an unpooled message leaves it intact
+	msg.Release()
+	if index, err := msg.ParseHave(); err != nil || index != 7 {
+		t.Errorf("ParseHave after Release = %d, %v, want 7", index, err)
+	}
+}
@@ -0,0 +1,105 @@
+package peer
+
+const (
+	// MaxRequestLength is the default limit on the blocks a peer may
+	// request from us. We ask for BlockSize blocks, but some clients ask
+	// for up to 256KB.
+	MaxRequestLength = 256 * 1024
+
+	// RequestQueueBytes bounds the bytes a peer's full request queue may
+	// ask for: MaxRequestLength blocks 64 deep. A peer that negotiates a
+	// deeper queue in its extended handshake is held to shorter blocks,
+	// down to BlockSize.
+	RequestQueueBytes = 64 * MaxRequestLength
+)
+
+// messageLimit returns the longest message the peer may send: the
+// configured limit, raised to fit a bitfield for the torrent and a piece
+// message carrying the longest block the peer may request
+func (p *Peer) messageLimit() int {
+	limit := p.requestLimit() + 9
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return max(p.maxMessageLength, 1+(p.numPieces+7)/8, limit)
+}
+
+// requestLimit returns the longest block the peer may request: the
+// configured limit, lowered to a whole number of blocks so that a queue as
+// deep as the lower of the peer's reqq and ours stays within
+// RequestQueueBytes. A peer that sent no reqq gets the configured limit.
+func (p *Peer) requestLimit() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.extHandshake == nil || p.extHandshake.Reqq <= 0 {
+		return p.maxRequestLength
+	}
+	depth := min(MaxIncomingRequests, p.extHandshake.Reqq)
+	perRequest := RequestQueueBytes / depth / BlockSize * BlockSize
+	return min(p.maxRequestLength, max(BlockSize, perRequest))
+}
+
+// SetMaxMessageLength sets the longest message peers connected from now on
+// may send. A longer message drops the connection, except a bitfield the
+// torrent needs, which is always let through. Zero restores
+// MaxMessageLength.
+func (m *Manager) SetMaxMessageLength(n int) {
+	if n <= 0 {
+		n = MaxMessageLength
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxMessageLength = n
+}
+
+// SetMaxRequestLength sets the longest block peers connected from now on
+// may request. Longer requests are refused without dropping the
+// connection, with a Reject Request if the peer has the Fast extension. A
+// peer whose queue of such blocks would exceed RequestQueueBytes is held
+// to less. Zero restores MaxRequestLength.
+func (m *Manager) SetMaxRequestLength(n int) {
+	if n <= 0 {
+		n = MaxRequestLength
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxRequestLength = n
+}
+
+// validRequest returns true if a request is for a block within its piece
+// no longer than the peer's request length limit. Blocks need not be
+// BlockSize long or aligned to it.
+func (m *Manager) validRequest(peer *Peer, r uploadRequest) bool {
+	if r.length == 0 || int64(r.length) > int64(peer.requestLimit()) {
+		return false
+	}
+
+	m.mu.RLock()
+	pieceManager := m.pieceManager
+	m.mu.RUnlock()
+	if pieceManager == nil {
+		return false
+	}
+	return int64(r.begin)+int64(r.length) <= int64(pieceManager.PieceLength(int(r.index)))
+}
+
+// messageLength returns the message limit for new peers
+func (m *Manager) messageLength() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxMessageLength
+}
+
+// requestLength returns the request length limit for new peers
+func (m *Manager) requestLength() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxRequestLength
+}
+
+// refuseRequest releases an incoming request we will not serve, telling a
+// peer with the Fast extension so that it need not wait for the block
+func (m *Manager) refuseRequest(peer *Peer, r uploadRequest) {
+	peer.RequestDone()
+	peer.rejectRequest(r)
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMessageLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+
+	// A piece message with a block of the longest length we serve fits
+	block := NewPieceMessage(0, 0, make([]byte, MaxRequestLength)).Serialize()
+	if _, err := readMessage(bytes.NewReader(block), peer.messageLimit()); err != nil {
+		t.Errorf("reading a %d byte block failed: %v", MaxRequestLength, err)
+	}
+
+	// A torrent with more pieces than the limit has bits needs a longer
+	// bitfield, which is let through
+	bitfield := NewBitfieldMessage(make([]byte, MaxMessageLength)).Serialize()
+	if _, err := readMessage(bytes.NewReader(bitfield), peer.messageLimit()); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("long bitfield for an unknown torrent = %v, want %v", err, ErrMessageTooLarge)
+	}
+	peer.setNumPieces(MaxMessageLength * 8)
+	if _, err := readMessage(bytes.NewReader(bitfield), peer.messageLimit()); err != nil {
+		t.Errorf("reading the torrent's bitfield failed: %v", err)
+	}
+}
+
+func TestNegotiatedRequestLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+
+	// By default a peer may ask for the 256KB blocks some clients use
+	if got := peer.requestLimit(); got != 256*1024 {
+		t.Errorf("default request limit = %d, want %d", got, 256*1024)
+	}
+
+	tests := []struct {
+		reqq, configured, want int
+	}{
+		{reqq: 0, configured: MaxRequestLength, want: MaxRequestLength},
+		{reqq: 0, configured: 1 << 20, want: 1 << 20},
+		{reqq: 16, configured: MaxRequestLength, want: MaxRequestLength},
+		{reqq: 64, configured: MaxRequestLength, want: MaxRequestLength},
+		{reqq: 128, configured: MaxRequestLength, want: 128 * 1024},
+		{reqq: 500, configured: MaxRequestLength, want: 64 * 1024},
+		{reqq: 16, configured: 1 << 20, want: 1 << 20},
+		{reqq: 16, configured: BlockSize, want: BlockSize},
+	}
+	for _, tt := range tests {
+		peer.mu.Lock()
+		peer.maxRequestLength = tt.configured
+		peer.extHandshake = &ExtendedHandshake{Reqq: tt.reqq}
+		peer.mu.Unlock()
+
+		if got := peer.requestLimit(); got != tt.want {
+			t.Errorf("reqq %d, configured %d: request limit = %d, want %d", tt.reqq, tt.configured, got, tt.want)
+		}
+		if got := peer.messageLimit(); got < tt.want+9 {
+			t.Errorf("reqq %d, configured %d: message limit %d does not fit a %d byte block", tt.reqq, tt.configured, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(blockSource{})
+	manager.setPiece(0)
+	peer := newUploadTestPeer(t)
+	peer.maxRequestLength = 2 * BlockSize
+
+	tests := []struct {
+		name          string
+		begin, length uint32
+		queued        bool
+	}{
+		{"empty", 0, 0, false},
+		{"too long", 0, 3 * BlockSize, false},
+		{"past the piece", 3 * BlockSize, 2 * BlockSize, false},
+		{"unaligned", 1000, 2*BlockSize - 1000, true},
+		{"last bytes", 4*BlockSize - 10, 10, true},
+	}
+	for _, tt := range tests {
+		peer.admitRequest()
+		before := manager.uploads.pending(peer)
+		manager.handlePieceRequest(peer, 0, tt.begin, tt.length)
+		if queued := manager.uploads.pending(peer) > before; queued != tt.queued {
+			t.Errorf("%s: queued = %v, want %v", tt.name, queued, tt.queued)
+		}
+	}
+	if got := peer.PendingRequests(); got != 2 {
+		t.Errorf("PendingRequests = %d, want 2", got)
+	}
+	if !peer.IsConnected() {
+		t.Error("peer disconnected for a bad request")
+	}
+
+	// Blocks are served at the length asked for
+	for i := 0; i < 2; i++ {
+		p, r, _ := manager.uploads.pop()
+		manager.serveRequest(p, r)
+	}
+	sent := peer.outbox.take()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d messages, want 2 blocks", len(sent))
+	}
+	for i, msg := range sent {
+		if index, begin, block, err := msg.ParsePiece(); err != nil || index != 0 || begin != tests[3+i].begin || len(block) != int(tests[3+i].length) {
+			t.Errorf("sent block %d:%d+%d, %v, want the %s block", index, begin, len(block), err, tests[3+i].name)
+		}
+	}
+}
+
+func TestRefusedRequestRejected(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(blockSource{})
+	peer := newUploadTestPeer(t)
+	peer.mu.Lock()
+	peer.extensions.FastPeers = true
+	peer.mu.Unlock()
+
+	peer.admitRequest()
+	manager.handlePieceRequest(peer, 0, 0, BlockSize)
+
+	sent := peer.outbox.take()
+	if len(sent) != 1 || sent[0].ID != MsgRejectRequest {
+		t.Fatalf("sent %v, want a reject", sent)
+	}
+	index, begin, length, err := sent[0].ParseRejectRequest()
+	if err != nil || index != 0 || begin != 0 || length != BlockSize {
+		t.Errorf("rejected %d:%d:%d, %v, want the request", index, begin, length, err)
+	}
+}
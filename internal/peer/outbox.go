@@ -0,0 +1,164 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxQueuedData bounds the piece messages waiting to be written
+	MaxQueuedData = 100
+
+	// WriteBufferSize is the size of the buffered connection writer.
+	// Queued messages are coalesced into writes of up to this size.
+	WriteBufferSize = 64 * 1024
+
+	// SendTimeout is how long SendMessage waits for room in the queue
+	SendTimeout = 5 * time.Second
+)
+
+// outbox queues messages for the send loop. Control messages go out ahead
+// of queued piece data, so chokes, haves and keep-alives are not stuck
+// behind a burst of blocks.
+type outbox struct {
+	mu      sync.Mutex
+	control []*Message
+	data    []*Message
+	bytes   int           // payload bytes of the queued data
+	ready   chan struct{} // signalled when messages are queued
+	space   chan struct{} // signalled when data leaves the queue
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+// isDataMessage returns true for messages that carry piece data
+func isDataMessage(msg *Message) bool {
+	return msg != nil && msg.ID == MsgPiece
+}
+
+// hasData returns true if a batch holds piece data
+func hasData(batch []*Message) bool {
+	for _, msg := range batch {
+		if isDataMessage(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// push queues a message, returning false if the data queue is full.
+// Control messages are always accepted.
+func (o *outbox) push(msg *Message) bool {
+	o.mu.Lock()
+	if isDataMessage(msg) {
+		if len(o.data) >= MaxQueuedData {
+			o.mu.Unlock()
+			return false
+		}
+		o.data = append(o.data, msg)
+		o.bytes += len(msg.Payload)
+	} else {
+		o.control = append(o.control, msg)
+	}
+	o.mu.Unlock()
+
+	notify(o.ready)
+	return true
+}
+
+// take removes the next batch to write: every control message, then piece
+// data up to about WriteBufferSize bytes. If messages remain, ready is
+// signalled again so the send loop comes back for them.
+func (o *outbox) take() []*Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	batch := o.control
+	o.control = nil
+
+	size, n := 0, 0
+	for n < len(o.data) && (n == 0 || size+len(o.data[n].Payload) <= WriteBufferSize) {
+		size += len(o.data[n].Payload)
+		n++
+	}
+	o.bytes -= size
+	if n > 0 {
+		batch = append(batch, o.data[:n]...)
+		o.data = append([]*Message(nil), o.data[n:]...)
+		notify(o.space)
+	}
+
+	if len(o.data) > 0 {
+		notify(o.ready)
+	}
+	return batch
+}
+
+// len returns the number of queued messages
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.control) + len(o.data)
+}
+
+// dataBytes returns the payload bytes of the piece data waiting to be
+// written
+func (o *outbox) dataBytes() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.bytes
+}
+
+// notify wakes a waiter on ch without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// writeBatch writes a batch of messages through w with a single flush
+func (p *Peer) writeBatch(w *bufio.Writer, batch []*Message) error {
+	p.conn.SetWriteDeadline(time.Now().Add(MessageTimeout))
+	defer p.conn.SetWriteDeadline(time.Time{})
+
+	var header [5]byte
+	for _, msg := range batch {
+		if msg == nil {
+			// Keep-alive
+			if _, err := w.Write(header[:4]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		binary.BigEndian.PutUint32(header[:4], uint32(1+len(msg.Payload)))
+		header[4] = msg.ID
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg.Payload); err != nil {
+			return err
+		}
+		header = [5]byte{}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, msg := range batch {
+		if isDataMessage(msg) && len(msg.Payload) >= 8 {
+			p.stats.blockSent(len(msg.Payload)-8, now)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutboxControlFirst(t *testing.T) {
+	o := newOutbox()
+
+	o.push(NewPieceMessage(0, 0, make([]byte, BlockSize)))
+	o.push(NewHaveMessage(3))
+	o.push(KeepAlive())
+
+	batch := o.take()
+	if len(batch) != 3 {
+		t.Fatalf("batch has %d messages, want 3", len(batch))
+	}
+	if batch[0] == nil || batch[0].ID != MsgHave {
+		t.Errorf("first message = %v, want have", batch[0])
+	}
+	if batch[1] != nil {
+		t.Errorf("second message = %v, want keep-alive", batch[1])
+	}
+	if batch[2] == nil || batch[2].ID != MsgPiece {
+		t.Errorf("last message = %v, want piece", batch[2])
+	}
+}
+
+func TestOutboxBatchesData(t *testing.T) {
+	o := newOutbox()
+
+	for i := 0; i < MaxQueuedData; i++ {
+		if !o.push(NewPieceMessage(0, uint32(i*BlockSize), make([]byte, BlockSize))) {
+			t.Fatalf("push %d refused below MaxQueuedData", i)
+		}
+	}
+	if o.push(NewPieceMessage(1, 0, make([]byte, BlockSize))) {
+		t.Error("push accepted data past MaxQueuedData")
+	}
+	// Control messages are never refused
+	if !o.push(NewChokeMessage()) {
+		t.Error("push refused a control message")
+	}
+
+	batch := o.take()
+	perBatch := WriteBufferSize / (BlockSize + 8)
+	if len(batch) != 1+perBatch {
+		t.Errorf("batch has %d messages, want choke plus %d blocks", len(batch), perBatch)
+	}
+
+	// More data is waiting, so the send loop is woken again
+	select {
+	case <-o.ready:
+	default:
+		t.Error("ready not signalled while data remains")
+	}
+	select {
+	case <-o.space:
+	default:
+		t.Error("space not signalled after data was taken")
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	batch := []*Message{NewUnchokeMessage(), KeepAlive(), NewPieceMessage(2, 0, []byte("data"))}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- peer.writeBatch(bufio.NewWriterSize(client, WriteBufferSize), batch)
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, want := range batch {
+		got, err := ReadMessage(server)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want == nil {
+			if got != nil {
+				t.Errorf("message %d = %v, want keep-alive", i, got)
+			}
+			continue
+		}
+		if got == nil || got.ID != want.ID || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("message %d = %v, want %v", i, got, want)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("writeBatch failed: %v", err)
+	}
+
+	if stats := peer.Stats(); stats.BytesUploaded != 4 {
+		t.Errorf("BytesUploaded = %d, want 4", stats.BytesUploaded)
+	}
+}
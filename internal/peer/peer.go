@@ -1,8 +1,10 @@
 package peer
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -35,13 +37,57 @@ type Peer struct {
 	remotePeerID [20]byte
 	state        *PeerState
 	bitfield     []byte
-	sendCh       chan *Message
+	seed         bool // sent Have All; bitfield stays nil
+	numPieces    int // pieces in the torrent; 0 if not known
+	haves        []int // HAVE messages received before numPieces was known
+	outbox       *outbox
 	receiveCh    chan *Message
 	doneCh       chan struct{}
 	ctx          context.Context
 	cancel       context.CancelFunc
 	extensions   Extensions
 	lastSeen     time.Time
+	stopOnce     sync.Once
+	loops        sync.WaitGroup // the send and receive loops
+	stats        *peerStats
+	source       Source
+	snubbed      bool
+	extHandshake *ExtendedHandshake
+	
+	// Incoming requests queued for the upload path, and requests dropped
+	// for exceeding MaxIncomingRequests
+	incomingRequests int
+	excessRequests   int
+	
+	// The block a peer reading in order would request next, and how many
+	// blocks in a row it has requested in order
+	readNext uploadRequest
+	readRun  int
+	
+	// Called with state changes from the receive loop; set before the
+	// loops start
+	onEvent func(PeerEvent)
+	
+	// Called from the send loop once piece data has been written; set
+	// before the loops start
+	onSent func()
+	
+	// The UDP port of our DHT node, or 0 if DHT is off; set before the
+	// handshake
+	dhtPort uint16
+	
+	// Whether the torrent is private, so ut_holepunch is not advertised;
+	// set before the handshake
+	private bool
+	
+	// The longest message the peer may send, raised to fit its bitfield,
+	// the longest block it may request, lowered for a deep request queue,
+	// and how long it may stay silent; set before the loops start
+	maxMessageLength int
+	maxRequestLength int
+	idleTimeout      time.Duration
+	
+	logger *slog.Logger
 }
 
 // NewPeer creates a new peer connection
@@ -53,52 +99,124 @@ func NewPeer(conn net.Conn, infoHash, peerID [20]byte) *Peer {
 		infoHash:  infoHash,
 		peerID:    peerID,
 		state:     NewPeerState(),
-		sendCh:    make(chan *Message, 100),
+		outbox:    newOutbox(),
 		receiveCh: make(chan *Message, 100),
 		doneCh:    make(chan struct{}),
 		ctx:       ctx,
 		cancel:    cancel,
 		lastSeen:  time.Now(),
+		stats:     newPeerStats(),
+		logger:    slog.Default(),
+		
+		maxMessageLength: MaxMessageLength,
+		maxRequestLength: MaxRequestLength,
+		idleTimeout:      IdleTimeout,
 	}
 }
 
 // Start begins the peer communication loops
 func (p *Peer) Start() error {
+	return p.StartContext(context.Background())
+}
+
+// StartContext is Start with a handshake abandoned once ctx is done
+func (p *Peer) StartContext(ctx context.Context) error {
 	// Perform handshake
-	handshake, err := DoHandshake(p.conn, p.infoHash, p.peerID)
+	handshake, err := handshakeContext(ctx, p.conn, p.infoHash, p.peerID, p.localExtensions())
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	
+	p.run(handshake)
+	return nil
+}
+
+// Accept completes the handshake for an incoming connection whose
+// handshake has already been read, and starts the communication loops
+func (p *Peer) Accept(remote *Handshake) error {
+	return p.AcceptContext(context.Background(), remote)
+}
+
+// AcceptContext is Accept with a handshake abandoned once ctx is done
+func (p *Peer) AcceptContext(ctx context.Context, remote *Handshake) error {
+	if remote.InfoHash != p.infoHash {
+		return fmt.Errorf("info hash mismatch: expected %x, got %x", p.infoHash, remote.InfoHash)
+	}
+	
+	handshake := NewHandshake(p.infoHash, p.peerID)
+	handshake.SetExtensions(p.localExtensions())
+	err := withContext(ctx, p.conn, func() error {
+		return handshake.Write(p.conn)
+	})
 	if err != nil {
 		return fmt.Errorf("handshake failed: %w", err)
 	}
 	
+	p.run(remote)
+	return nil
+}
+
+// run records the remote handshake and starts the send and receive loops
+func (p *Peer) run(handshake *Handshake) {
 	p.mu.Lock()
 	p.remotePeerID = handshake.PeerID
 	p.extensions = handshake.ParseExtensions()
 	p.mu.Unlock()
 	
+	if p.extensions.ExtProtocol {
+		p.sendExtendedHandshake()
+	}
+	if p.extensions.DHT && p.dhtPort > 0 {
+		p.SendMessage(NewPortMessage(p.dhtPort))
+	}
+	
 	// Start send and receive loops
+	p.loops.Add(2)
 	go p.sendLoop()
 	go p.receiveLoop()
-	
-	return nil
 }
 
-// Stop closes the peer connection and stops all loops
+// Stop closes the peer connection and stops all loops. It may be called
+// any number of times, from any goroutine, and does not wait for the loops
+// to exit.
 func (p *Peer) Stop() {
-	p.cancel()
-	p.conn.Close()
-	close(p.doneCh)
+	p.stopOnce.Do(func() {
+		p.cancel()
+		p.conn.Close()
+		close(p.doneCh)
+	})
+}
+
+// wait waits for the send and receive loops of a stopped peer to exit. It
+// must not be called from the peer's own event handler.
+func (p *Peer) wait() {
+	p.loops.Wait()
 }
 
-// SendMessage sends a message to the peer
+// SendMessage queues a message for the peer. Piece messages wait up to
+// SendTimeout for room in the queue; other messages are never refused.
 func (p *Peer) SendMessage(msg *Message) error {
-	select {
-	case p.sendCh <- msg:
-		return nil
-	case <-p.ctx.Done():
+	if !p.IsConnected() {
 		return fmt.Errorf("peer connection closed")
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("send channel full")
 	}
+	
+	var timeout <-chan time.Time
+	for !p.outbox.push(msg) {
+		if timeout == nil {
+			timer := time.NewTimer(SendTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		
+		select {
+		case <-p.outbox.space:
+		case <-p.ctx.Done():
+			return fmt.Errorf("peer connection closed")
+		case <-timeout:
+			return fmt.Errorf("send queue full")
+		}
+	}
+	return nil
 }
 
 // ReceiveMessage receives a message from the peer
@@ -123,6 +241,9 @@ func (p *Peer) GetBitfield() []byte {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
+	if p.seed {
+		return fullBitfield(p.numPieces)
+	}
 	if p.bitfield == nil {
 		return nil
 	}
@@ -137,7 +258,10 @@ func (p *Peer) HasPiece(index int) bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if p.bitfield == nil {
+	if p.seed {
+		return p.validPiece(index)
+	}
+	if p.bitfield == nil || !p.validPiece(index) {
 		return false
 	}
 	
@@ -156,7 +280,7 @@ func (p *Peer) SetPiece(index int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	
-	if p.bitfield == nil {
+	if p.bitfield == nil || !p.validPiece(index) {
 		return
 	}
 	
@@ -202,23 +326,28 @@ func (p *Peer) LastSeen() time.Time {
 
 // sendLoop handles sending messages to the peer
 func (p *Peer) sendLoop() {
+	defer p.loops.Done()
 	defer p.cancel()
 	
-	keepAliveTicker := time.NewTicker(2 * time.Minute)
+	keepAliveTicker := time.NewTicker(KeepAliveInterval)
 	defer keepAliveTicker.Stop()
 	
+	w := bufio.NewWriterSize(p.conn, WriteBufferSize)
+	
 	for {
 		select {
-		case msg := <-p.sendCh:
-			if err := WriteMessage(p.conn, msg); err != nil {
+		case <-p.outbox.ready:
+			batch := p.outbox.take()
+			if err := p.writeBatch(w, batch); err != nil {
 				return
 			}
+			if p.onSent != nil && hasData(batch) {
+				p.onSent()
+			}
 			
 		case <-keepAliveTicker.C:
 			// Send keep-alive message
-			if err := WriteMessage(p.conn, KeepAlive()); err != nil {
-				return
-			}
+			p.outbox.push(KeepAlive())
 			
 		case <-p.ctx.Done():
 			return
@@ -228,6 +357,7 @@ func (p *Peer) sendLoop() {
 
 // receiveLoop handles receiving messages from the peer
 func (p *Peer) receiveLoop() {
+	defer p.loops.Done()
 	defer p.cancel()
 	
 	for {
@@ -237,11 +367,18 @@ func (p *Peer) receiveLoop() {
 		default:
 		}
 		
-		// Set read timeout
-		p.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		// Silent peers are dropped; stopping the peer interrupts the read
+		p.conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
 		
-		msg, err := ReadMessage(p.conn)
+		msg, err := readMessageContext(p.ctx, p.conn, p.messageLimit())
 		if err != nil {
+			switch {
+			case p.ctx.Err() != nil:
+			case isTimeout(err):
+				p.logger.Debug("Disconnecting silent peer", "peer", p.Address(), "idle", p.idleTimeout)
+			default:
+				p.logger.Debug("Peer connection lost", "peer", p.Address(), "err", err)
+			}
 			return
 		}
 		
@@ -251,8 +388,24 @@ func (p *Peer) receiveLoop() {
 		
 		// Handle the message
 		if err := p.handleMessage(msg); err != nil {
+			p.logger.Debug("Disconnecting peer", "peer", p.Address(), "err", err)
 			return
 		}
+		if event, ok := p.eventFor(msg); ok && p.onEvent != nil {
+			p.onEvent(event)
+		}
+		
+		// Requests beyond the queue depth we advertised are dropped
+		if msg != nil && msg.ID == MsgRequest {
+			admitted, err := p.admitRequest()
+			if err != nil {
+				p.logger.Debug("Disconnecting peer", "peer", p.Address(), "err", err)
+				return
+			}
+			if !admitted {
+				continue
+			}
+		}
 		
 		// Forward to receive channel if not a control message
 		if msg != nil && !p.isControlMessage(msg) {
@@ -262,6 +415,10 @@ func (p *Peer) receiveLoop() {
 				return
 			default:
 				// Channel full, drop message
+				if msg.ID == MsgRequest {
+					p.RequestDone()
+				}
+				msg.Release()
 			}
 		}
 	}
@@ -273,6 +430,9 @@ func (p *Peer) handleMessage(msg *Message) error {
 		// Keep-alive message, nothing to do
 		return nil
 	}
+	if isFastMessage(msg.ID) && !p.FastExtension() {
+		return fmt.Errorf("%w: %s", ErrFastNotNegotiated, msg)
+	}
 	
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -283,6 +443,7 @@ func (p *Peer) handleMessage(msg *Message) error {
 		
 	case MsgUnchoke:
 		p.state.PeerChoking = false
+		p.stats.restartWait(time.Now())
 		
 	case MsgInterested:
 		p.state.PeerInterested = true
@@ -295,6 +456,19 @@ func (p *Peer) handleMessage(msg *Message) error {
 		if err != nil {
 			return err
 		}
+		if p.numPieces == 0 {
+			return p.bufferHave(int(index))
+		}
+		if !p.validPiece(int(index)) {
+			return fmt.Errorf("%w: have %d of %d pieces", ErrInvalidPiece, index, p.numPieces)
+		}
+		if p.seed {
+			break
+		}
+		// A peer with few pieces may skip the bitfield
+		if p.bitfield == nil {
+			p.bitfield = make([]byte, (p.numPieces+7)/8)
+		}
 		p.setPieceUnsafe(int(index))
 		
 	case MsgBitfield:
@@ -302,7 +476,34 @@ func (p *Peer) handleMessage(msg *Message) error {
 		if err != nil {
 			return err
 		}
+		// Without the piece count the bitfield is kept as sent, and
+		// checked by setNumPieces once the metadata arrives
+		if p.numPieces > 0 {
+			if err := ValidateBitfield(bitfield, p.numPieces); err != nil {
+				return err
+			}
+		}
 		p.bitfield = bitfield
+		p.seed = false
+		
+	case MsgHaveAll, MsgHaveNone:
+		p.haveAll(msg.ID == MsgHaveAll)
+		
+	case MsgPiece:
+		index, begin, block, err := msg.PieceBlock()
+		if err != nil {
+			return err
+		}
+		p.stats.blockReceived(index, begin, len(block), time.Now())
+		p.snubbed = false
+		
+	case MsgExtended:
+		if len(msg.Payload) > 0 && msg.Payload[0] == ExtendedHandshakeID {
+			// A malformed handshake only costs us the extensions
+			if h, err := ParseExtendedHandshake(msg.Payload); err == nil {
+				p.extHandshake = h
+			}
+		}
 	}
 	
 	return nil
@@ -310,7 +511,7 @@ func (p *Peer) handleMessage(msg *Message) error {
 
 // setPieceUnsafe marks a piece as available (must hold lock)
 func (p *Peer) setPieceUnsafe(index int) {
-	if p.bitfield == nil {
+	if p.bitfield == nil || !p.validPiece(index) {
 		return
 	}
 	
@@ -327,8 +528,11 @@ func (p *Peer) setPieceUnsafe(index int) {
 // isControlMessage returns true for messages that update peer state
 func (p *Peer) isControlMessage(msg *Message) bool {
 	switch msg.ID {
-	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHave, MsgBitfield:
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHave, MsgBitfield, MsgHaveAll, MsgHaveNone, MsgRejectRequest:
 		return true
+	case MsgExtended:
+		// Extension messages other than the handshake go to the manager
+		return len(msg.Payload) == 0 || msg.Payload[0] == ExtendedHandshakeID
 	default:
 		return false
 	}
@@ -377,21 +581,32 @@ func (p *Peer) RequestPiece(index, begin, length uint32) error {
 		return fmt.Errorf("peer is choking us")
 	}
 	
-	return p.SendMessage(NewRequestMessage(index, begin, length))
+	if err := p.SendMessage(NewRequestMessage(index, begin, length)); err != nil {
+		return err
+	}
+	
+	p.stats.requestSent(index, begin, time.Now())
+	return nil
 }
 
 // SendPiece sends a piece block to the peer
 func (p *Peer) SendPiece(index, begin uint32, data []byte) error {
+	return p.sendPiece(NewPieceMessage(index, begin, data))
+}
+
+// sendPiece sends a piece message unless we are choking the peer
+func (p *Peer) sendPiece(msg *Message) error {
 	state := p.GetState()
 	if state.AmChoking {
 		return fmt.Errorf("we are choking peer")
 	}
 	
-	return p.SendMessage(NewPieceMessage(index, begin, data))
+	return p.SendMessage(msg)
 }
 
 // Cancel sends a cancel message for a piece block
 func (p *Peer) Cancel(index, begin, length uint32) error {
+	p.stats.requestCancelled(index, begin)
 	return p.SendMessage(NewCancelMessage(index, begin, length))
 }
 
@@ -419,6 +634,43 @@ func (p *Peer) GetExtensions() Extensions {
 	return p.extensions
 }
 
+// FastExtension returns true if both sides support the Fast extension
+// (BEP 6). Without it, a choke silently discards our pending requests;
+// with it, each is answered with a block or a Reject Request.
+func (p *Peer) FastExtension() bool {
+	return SupportedExtensions.FastPeers && p.GetExtensions().FastPeers
+}
+
+// Stats returns the transfer statistics for this peer
+func (p *Peer) Stats() TransferStats {
+	return p.stats.snapshot(time.Now())
+}
+
+// Source returns how we learned about this peer
+func (p *Peer) Source() Source {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.source
+}
+
+// SetSource records how we learned about this peer
+func (p *Peer) SetSource(source Source) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.source = source
+}
+
+// RecordHashFailure counts a failed piece this peer contributed to
+func (p *Peer) RecordHashFailure() {
+	p.stats.hashFailed()
+}
+
+// RecordWaste counts bytes the peer sent that were thrown away, as
+// duplicates or as part of a piece that failed verification
+func (p *Peer) RecordWaste(n int64) {
+	p.stats.wasted(n)
+}
+
 // RemotePeerID returns the remote peer's ID
 func (p *Peer) RemotePeerID() [20]byte {
 	p.mu.RLock()
@@ -433,7 +685,10 @@ func (p *Peer) Done() <-chan struct{} {
 
 // NeedsPieces checks if we should be interested in this peer based on available pieces
 func (p *Peer) NeedsPieces(neededPieces []int) bool {
-	if p.bitfield == nil {
+	p.mu.RLock()
+	known := p.bitfield != nil || p.seed
+	p.mu.RUnlock()
+	if !known {
 		return false
 	}
 	
@@ -447,14 +702,32 @@ func (p *Peer) NeedsPieces(neededPieces []int) bool {
 
 // EnsureInterested ensures we express interest if peer has pieces we need
 func (p *Peer) EnsureInterested(neededPieces []int) error {
-	shouldBeInterested := p.NeedsPieces(neededPieces)
-	state := p.GetState()
-	
-	if shouldBeInterested && !state.AmInterested {
-		return p.Interested()
-	} else if !shouldBeInterested && state.AmInterested {
-		return p.NotInterested()
+	return p.SetInterested(p.NeedsPieces(neededPieces))
+}
+
+// SetInterested sends Interested or Not Interested if our interest in the
+// peer changed, and nothing otherwise. If the send fails the state is
+// restored so that the next call tries again.
+func (p *Peer) SetInterested(interested bool) error {
+	p.mu.Lock()
+	if p.state.AmInterested == interested {
+		p.mu.Unlock()
+		return nil
 	}
+	p.state.AmInterested = interested
+	p.mu.Unlock()
 	
+	msg := NewNotInterestedMessage()
+	if interested {
+		msg = NewInterestedMessage()
+	}
+	if err := p.SendMessage(msg); err != nil {
+		p.mu.Lock()
+		if p.state.AmInterested == interested {
+			p.state.AmInterested = !interested
+		}
+		p.mu.Unlock()
+		return err
+	}
 	return nil
 }
\ No newline at end of file
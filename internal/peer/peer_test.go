@@ -47,8 +47,8 @@ func TestNewPeer(t *testing.T) {
 	if peer.state == nil {
 		t.Error("State not initialized")
 	}
-	if peer.sendCh == nil {
-		t.Error("Send channel not initialized")
+	if peer.outbox == nil {
+		t.Error("Send queue not initialized")
 	}
 	if peer.receiveCh == nil {
 		t.Error("Receive channel not initialized")
@@ -168,6 +168,38 @@ func TestPeerStateTransitions(t *testing.T) {
 	}
 }
 
+func TestSetInterested(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	for _, interested := range []bool{true, true, false, false} {
+		if err := peer.SetInterested(interested); err != nil {
+			t.Fatalf("SetInterested(%v) failed: %v", interested, err)
+		}
+	}
+	
+	var sent []uint8
+	for _, msg := range peer.outbox.take() {
+		if msg != nil {
+			sent = append(sent, msg.ID)
+		}
+	}
+	if len(sent) != 2 || sent[0] != MsgInterested || sent[1] != MsgNotInterested {
+		t.Errorf("sent %v, want Interested then Not Interested once each", sent)
+	}
+	
+	// A failed send leaves us not interested, so the next call tries again
+	peer.Stop()
+	if err := peer.SetInterested(true); err == nil {
+		t.Error("SetInterested on a stopped peer succeeded")
+	}
+	if peer.GetState().AmInterested {
+		t.Error("interested after the message failed to send")
+	}
+}
+
 func TestPeerCanUploadDownload(t *testing.T) {
 	server, client := net.Pipe()
 	defer server.Close()
@@ -216,6 +248,7 @@ func TestPeerMessageHandling(t *testing.T) {
 	// Initialize bitfield for testing
 	peer.mu.Lock()
 	peer.bitfield = make([]byte, 2)
+	peer.numPieces = 16
 	peer.mu.Unlock()
 	
 	// Test handling choke message
@@ -406,6 +439,8 @@ func TestPeerControlMessages(t *testing.T) {
 		{NewRequestMessage(0, 0, 16384), false},
 		{NewPieceMessage(0, 0, []byte("data")), false},
 		{NewCancelMessage(0, 0, 16384), false},
+		{NewMessage(MsgExtended, []byte{ExtendedHandshakeID}), true},
+		{NewHolepunchMessage(HolepunchID, HolepunchMessage{}), false},
 	}
 	
 	for _, tt := range tests {
@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BEP 40 masks, chosen by how many leading bytes the two addresses share
+var (
+	v4Masks = [3][4]byte{
+		{0xff, 0xff, 0x55, 0x55}, // different /16
+		{0xff, 0xff, 0xff, 0x55}, // same /16
+		{0xff, 0xff, 0xff, 0xff}, // same /24
+	}
+	v6Masks = [3][8]byte{
+		{0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55}, // different /32
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55}, // same /32
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // same /48
+	}
+)
+
+// Priority returns the canonical peer priority of a connection between
+// two endpoints (BEP 40). Both sides compute the same value, so preferring
+// high-priority connections makes the swarm converge on the same graph.
+func Priority(a, b netip.AddrPort) uint32 {
+	a = netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+	b = netip.AddrPortFrom(b.Addr().Unmap(), b.Port())
+
+	if a.Compare(b) > 0 {
+		a, b = b, a
+	}
+
+	if a.Addr() == b.Addr() {
+		var buf [4]byte
+		binary.BigEndian.PutUint16(buf[0:2], a.Port())
+		binary.BigEndian.PutUint16(buf[2:4], b.Port())
+		return crc32.Checksum(buf[:], castagnoli)
+	}
+
+	if a.Addr().Is4() && b.Addr().Is4() {
+		b1, b2 := a.Addr().As4(), b.Addr().As4()
+		mask := v4Masks[sharedPrefix(b1[:], b2[:], 2, 3)]
+		for i := range mask {
+			b1[i] &= mask[i]
+			b2[i] &= mask[i]
+		}
+		return crc32.Checksum(append(b1[:], b2[:]...), castagnoli)
+	}
+
+	b1, b2 := a.Addr().As16(), b.Addr().As16()
+	mask := v6Masks[sharedPrefix(b1[:], b2[:], 4, 6)]
+	for i := range mask {
+		b1[i] &= mask[i]
+		b2[i] &= mask[i]
+	}
+	return crc32.Checksum(append(b1[:], b2[:]...), castagnoli)
+}
+
+// sharedPrefix returns 0 if a and b differ in their first short bytes, 1
+// if they differ within their first long bytes, and 2 otherwise
+func sharedPrefix(a, b []byte, short, long int) int {
+	switch {
+	case !bytes.Equal(a[:short], b[:short]):
+		return 0
+	case !bytes.Equal(a[:long], b[:long]):
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"hash/crc32"
+	"net/netip"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	ep := netip.MustParseAddrPort
+
+	tests := []struct {
+		a, b string
+		want uint32
+	}{
+		// Test vectors from BEP 40
+		{"123.213.32.10:0", "98.76.54.32:0", 0xec2d7224},
+		{"123.213.32.10:0", "123.213.32.234:0", 0x99568189},
+		{"230.12.123.3:0", "230.12.123.1:0",
+			crc32.Checksum([]byte{230, 12, 123, 1, 230, 12, 123, 3}, castagnoli)},
+		{"10.0.0.1:6881", "10.0.0.1:51413",
+			crc32.Checksum([]byte{0x1a, 0xe1, 0xc8, 0xd5}, castagnoli)},
+	}
+
+	for _, tt := range tests {
+		a, b := ep(tt.a), ep(tt.b)
+		if got := Priority(a, b); got != tt.want {
+			t.Errorf("Priority(%s, %s) = %08x, want %08x", a, b, got, tt.want)
+		}
+		if got := Priority(b, a); got != tt.want {
+			t.Errorf("Priority(%s, %s) = %08x, want %08x", b, a, got, tt.want)
+		}
+	}
+}
+
+func TestPriorityIPv6Symmetric(t *testing.T) {
+	a := netip.MustParseAddrPort("[2001:db8::1]:6881")
+	b := netip.MustParseAddrPort("[2001:db8:1::2]:6881")
+
+	if Priority(a, b) != Priority(b, a) {
+		t.Error("IPv6 priority is not symmetric")
+	}
+
+	// Bytes beyond the masked prefix differ, so the priority does too
+	c := netip.MustParseAddrPort("[2001:db8:1::3]:6881")
+	if Priority(a, b) == Priority(a, c) {
+		t.Error("IPv6 priority ignores the interface identifier")
+	}
+}
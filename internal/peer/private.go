@@ -0,0 +1,35 @@
+package peer
+
+import "errors"
+
+// ErrPrivateSource is returned when a private torrent is offered a peer
+// from a source it may not use
+var ErrPrivateSource = errors.New("peer source not allowed for a private torrent")
+
+// SetPrivate marks the torrent private (BEP 27). A private torrent takes
+// peers only from its trackers, the user and incoming connections: peers
+// from DHT, PEX, LSD and holepunch relays are refused, the DHT node is
+// ignored and ut_holepunch is neither advertised nor answered. It must be
+// set before Start.
+func (m *Manager) SetPrivate(private bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.private = private
+}
+
+// isPrivate returns true if the torrent is private
+func (m *Manager) isPrivate() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.private
+}
+
+// allowedSource returns true if the torrent may use peers from source
+func (m *Manager) allowedSource(source Source) bool {
+	switch source {
+	case SourceTracker, SourceManual, SourceIncoming:
+		return true
+	default:
+		return !m.isPrivate()
+	}
+}
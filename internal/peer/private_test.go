@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+func TestPrivateRefusesUntrackedPeers(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	dialer := &recordingDialer{dialed: make(chan string, 1)}
+	manager.SetDialer(dialer)
+	manager.SetPrivate(true)
+
+	target := tracker.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	for _, source := range []Source{SourceDHT, SourcePEX, SourceLSD, SourceHolepunch} {
+		if err := manager.connectToPeer(target, source); !errors.Is(err, ErrPrivateSource) {
+			t.Errorf("connecting to a %s peer = %v, want %v", source, err, ErrPrivateSource)
+		}
+		manager.AddPeers([]tracker.Peer{target}, source)
+	}
+	select {
+	case addr := <-dialer.dialed:
+		t.Errorf("dialed %q from a refused source", addr)
+	default:
+	}
+	if queued, _ := manager.queue.len(); queued != 0 {
+		t.Errorf("queued %d peers from refused sources", queued)
+	}
+
+	// Tracker peers are still dialed
+	manager.connectToPeer(target, SourceTracker)
+	select {
+	case <-dialer.dialed:
+	default:
+		t.Error("tracker peer not dialed")
+	}
+}
+
+func TestPrivateDisablesDHTAndHolepunch(t *testing.T) {
+	dht := &dhtRecorder{}
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetDHT(dht)
+	manager.SetPrivate(true)
+
+	if port := manager.dhtPort(); port != 0 {
+		t.Errorf("dhtPort = %d for a private torrent, want 0", port)
+	}
+	peer := newHolepunchTestPeer(t, "10.0.0.1:6881", true)
+	manager.handlePeerMessage(PeerMessage{Peer: peer, Message: NewPortMessage(7001)})
+	if len(dht.nodes) != 0 {
+		t.Errorf("added DHT nodes %v for a private torrent", dht.nodes)
+	}
+
+	peer.private = true
+	if err := peer.sendExtendedHandshake(); err != nil {
+		t.Fatalf("sendExtendedHandshake failed: %v", err)
+	}
+	sent := peer.outbox.take()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want the extended handshake", len(sent))
+	}
+	h, err := ParseExtendedHandshake(sent[0].Payload)
+	if err != nil {
+		t.Fatalf("ParseExtendedHandshake failed: %v", err)
+	}
+	if _, ok := h.M[ExtHolepunch]; ok {
+		t.Error("private torrent advertised ut_holepunch")
+	}
+}
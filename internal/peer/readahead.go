@@ -0,0 +1,36 @@
+package peer
+
+// SequentialThreshold is how many blocks in a row a peer must request in
+// order before the piece after the one it is reading is prefetched
+const SequentialThreshold = 4
+
+// sequentialRequest records a request from the peer and returns true once
+// it has asked for SequentialThreshold blocks in a row in order. The first
+// block of the next piece follows any block of the one before, since the
+// length of a piece is not known here.
+func (p *Peer) sequentialRequest(index, begin, length uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case index == p.readNext.index && begin == p.readNext.begin,
+		index == p.readNext.index+1 && begin == 0 && p.readRun > 0:
+		p.readRun++
+	default:
+		p.readRun = 1
+	}
+	p.readNext = uploadRequest{index: index, begin: begin + length}
+	return p.readRun >= SequentialThreshold
+}
+
+// readAhead prefetches the piece after index for a peer reading in order,
+// if we have it and the piece manager is a Prefetcher
+func (m *Manager) readAhead(index int) {
+	m.mu.RLock()
+	prefetcher, ok := m.pieceManager.(Prefetcher)
+	m.mu.RUnlock()
+
+	if ok && m.hasPieceIndex(index+1) {
+		prefetcher.Prefetch(index + 1)
+	}
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSequentialRequest(t *testing.T) {
+	p := &Peer{}
+	steps := []struct {
+		index, begin uint32
+		want         bool
+	}{
+		{0, 0, false},
+		{0, BlockSize, false},
+		{0, 2 * BlockSize, false},
+		{1, 0, true}, // the next piece follows any block
+		{1, BlockSize, true},
+		{5, 0, false}, // a jump starts over
+		{5, BlockSize, false},
+		{5, 3 * BlockSize, false},
+	}
+	for i, step := range steps {
+		if got := p.sequentialRequest(step.index, step.begin, BlockSize); got != step.want {
+			t.Errorf("step %d: sequentialRequest(%d, %d) = %v, want %v", i, step.index, step.begin, got, step.want)
+		}
+	}
+}
+
+func TestManagerReadsAhead(t *testing.T) {
+	recorder := &prefetchRecorder{}
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(recorder)
+	manager.setPiece(0)
+	manager.setPiece(1)
+
+	peer := newUploadTestPeer(t)
+	for i := uint32(0); i < SequentialThreshold; i++ {
+		peer.admitRequest()
+		manager.handlePieceRequest(peer, 0, i*BlockSize, BlockSize)
+	}
+	if want := []int{1}; !reflect.DeepEqual(recorder.indices, want) {
+		t.Errorf("prefetched %v, want %v", recorder.indices, want)
+	}
+
+	// Piece 2 is not ours to read ahead
+	for i := uint32(0); i < SequentialThreshold; i++ {
+		peer.admitRequest()
+		manager.handlePieceRequest(peer, 1, i*BlockSize, BlockSize)
+	}
+	if want := []int{1}; !reflect.DeepEqual(recorder.indices, want) {
+		t.Errorf("prefetched %v, want %v", recorder.indices, want)
+	}
+}
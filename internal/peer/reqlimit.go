@@ -0,0 +1,105 @@
+package peer
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	// MaxIncomingRequests is the request queue depth we advertise as reqq
+	// and enforce on each peer
+	MaxIncomingRequests = 250
+
+	// MaxExcessRequests is how many requests beyond MaxIncomingRequests a
+	// peer may send before it is disconnected
+	MaxExcessRequests = 100
+)
+
+// ErrRequestFlood is returned when a peer keeps sending requests past the
+// queue depth we advertised
+var ErrRequestFlood = errors.New("peer exceeded request queue limit")
+
+// admitRequest counts an incoming request against the peer's queue. It
+// returns false if the request must be dropped, and ErrRequestFlood once
+// the peer has overrun the queue too often.
+func (p *Peer) admitRequest() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.incomingRequests < MaxIncomingRequests {
+		p.incomingRequests++
+		return true, nil
+	}
+
+	p.excessRequests++
+	if p.excessRequests > MaxExcessRequests {
+		return false, ErrRequestFlood
+	}
+	return false, nil
+}
+
+// RequestDone releases a queued incoming request once it has been served
+// or discarded
+func (p *Peer) RequestDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.incomingRequests > 0 {
+		p.incomingRequests--
+	}
+}
+
+// PendingRequests returns the number of incoming requests waiting to be
+// served
+func (p *Peer) PendingRequests() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.incomingRequests
+}
+
+// MaxOutstandingRequests returns how many requests the peer will queue for
+// us, from the reqq of its extended handshake
+func (p *Peer) MaxOutstandingRequests() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.extHandshake != nil && p.extHandshake.Reqq > 0 {
+		return p.extHandshake.Reqq
+	}
+	return DefaultRemoteReqq
+}
+
+// ExtendedHandshake returns the peer's BEP 10 handshake, or nil if it has
+// not sent one
+func (p *Peer) ExtendedHandshake() *ExtendedHandshake {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.extHandshake
+}
+
+// sendExtendedHandshake queues our BEP 10 handshake advertising the
+// request queue depth we enforce, and holepunch unless the torrent is
+// private
+func (p *Peer) sendExtendedHandshake() error {
+	h := &ExtendedHandshake{
+		M:    map[string]int{},
+		V:    ClientVersion,
+		Reqq: MaxIncomingRequests,
+	}
+	if !p.private {
+		h.M[ExtHolepunch] = HolepunchID
+	}
+	if tcpAddr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			h.YourIP = ip4
+		} else {
+			h.YourIP = tcpAddr.IP.To16()
+		}
+	}
+
+	msg, err := NewExtendedHandshakeMessage(h)
+	if err != nil {
+		return err
+	}
+	return p.SendMessage(msg)
+}
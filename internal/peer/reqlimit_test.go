@@ -0,0 +1,96 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerAdmitRequest(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+
+	for i := 0; i < MaxIncomingRequests; i++ {
+		if admitted, err := peer.admitRequest(); !admitted || err != nil {
+			t.Fatalf("request %d: admitRequest = %v, %v, want admitted", i, admitted, err)
+		}
+	}
+	if got := peer.PendingRequests(); got != MaxIncomingRequests {
+		t.Errorf("PendingRequests = %d, want %d", got, MaxIncomingRequests)
+	}
+
+	// Serving a request frees a slot
+	peer.RequestDone()
+	if admitted, _ := peer.admitRequest(); !admitted {
+		t.Error("request refused after a slot was freed")
+	}
+
+	// Excess requests are dropped, then the peer is cut off
+	for i := 0; i < MaxExcessRequests; i++ {
+		if admitted, err := peer.admitRequest(); admitted || err != nil {
+			t.Fatalf("excess request %d: admitRequest = %v, %v, want dropped", i, admitted, err)
+		}
+	}
+	if _, err := peer.admitRequest(); !errors.Is(err, ErrRequestFlood) {
+		t.Errorf("admitRequest error = %v, want ErrRequestFlood", err)
+	}
+}
+
+func TestPeerSendsExtendedHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{1}, [20]byte{2})
+	defer peer.Stop()
+
+	remote := NewHandshake([20]byte{1}, [20]byte{3})
+	remote.SetExtensions(Extensions{ExtProtocol: true})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- peer.Accept(remote) }()
+
+	reply, err := Read(server)
+	if err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if !reply.ParseExtensions().ExtProtocol {
+		t.Error("handshake does not advertise the extension protocol")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := ReadMessage(server)
+	if err != nil {
+		t.Fatalf("failed to read extended handshake: %v", err)
+	}
+	if msg == nil || msg.ID != MsgExtended {
+		t.Fatalf("first message = %v, want extended handshake", msg)
+	}
+	h, err := ParseExtendedHandshake(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseExtendedHandshake failed: %v", err)
+	}
+	if h.Reqq != MaxIncomingRequests {
+		t.Errorf("advertised reqq = %d, want %d", h.Reqq, MaxIncomingRequests)
+	}
+
+	// The peer's own reqq is honoured once received
+	ours, _ := NewExtendedHandshakeMessage(&ExtendedHandshake{Reqq: 8})
+	if err := WriteMessage(server, ours); err != nil {
+		t.Fatalf("failed to send extended handshake: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for peer.MaxOutstandingRequests() != 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := peer.MaxOutstandingRequests(); got != 8 {
+		t.Errorf("MaxOutstandingRequests = %d, want 8", got)
+	}
+}
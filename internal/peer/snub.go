@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"time"
+)
+
+const (
+	// SnubTimeout is how long a peer that has unchoked us may leave our
+	// requests unanswered before it is considered snubbing us
+	SnubTimeout = 60 * time.Second
+
+	// SnubCheckInterval is how often peers are checked for snubbing
+	SnubCheckInterval = 10 * time.Second
+)
+
+// IsSnubbed returns true if the peer has unchoked us but stopped sending
+// the blocks we request. The flag clears when a block arrives.
+func (p *Peer) IsSnubbed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.snubbed
+}
+
+// checkSnubbed marks the peer snubbed if it is unchoking us and no block
+// has arrived for SnubTimeout while requests are pending. It returns true
+// only when the peer becomes snubbed.
+func (p *Peer) checkSnubbed(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.snubbed || p.state.PeerChoking {
+		return false
+	}
+	if p.stats.waiting(now) < SnubTimeout {
+		return false
+	}
+	p.snubbed = true
+	return true
+}
+
+// snubLoop periodically looks for peers that are snubbing us
+func (m *Manager) snubLoop() {
+	ticker := time.NewTicker(SnubCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkSnubbed(time.Now())
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkSnubbed marks peers that stopped sending us data as snubbed and,
+// as in the reference client, stops uploading to them in return
+func (m *Manager) checkSnubbed(now time.Time) {
+	for _, peer := range m.GetPeers() {
+		if !peer.checkSnubbed(now) {
+			continue
+		}
+		m.log().Info("Peer is snubbing us", "peer", peer.Address())
+		if !peer.GetState().AmChoking {
+			m.Choke(peer)
+		}
+	}
+}
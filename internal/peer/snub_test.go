@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerSnubbing(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	now := time.Unix(1000, 0)
+
+	// Requests sent while choked do not count against the peer
+	peer.stats.requestSent(0, 0, now)
+	if peer.checkSnubbed(now.Add(2 * SnubTimeout)) {
+		t.Error("choking peer marked snubbed")
+	}
+
+	peer.mu.Lock()
+	peer.state.PeerChoking = false
+	peer.mu.Unlock()
+	peer.stats.restartWait(now)
+
+	if peer.checkSnubbed(now.Add(SnubTimeout / 2)) {
+		t.Error("peer snubbed before SnubTimeout")
+	}
+	if !peer.checkSnubbed(now.Add(SnubTimeout)) {
+		t.Error("peer not snubbed after SnubTimeout")
+	}
+	if !peer.IsSnubbed() {
+		t.Error("IsSnubbed = false after snubbing")
+	}
+	// Becoming snubbed is reported once
+	if peer.checkSnubbed(now.Add(2 * SnubTimeout)) {
+		t.Error("checkSnubbed reported an already snubbed peer")
+	}
+
+	// Any block clears the flag
+	if err := peer.handleMessage(NewPieceMessage(0, 0, make([]byte, 16))); err != nil {
+		t.Fatalf("handleMessage failed: %v", err)
+	}
+	if peer.IsSnubbed() {
+		t.Error("IsSnubbed = true after a block arrived")
+	}
+}
+
+func TestManagerChokesSnubbingPeer(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	peer.mu.Lock()
+	peer.state.PeerChoking = false
+	peer.state.AmChoking = false
+	peer.mu.Unlock()
+	manager.addPeer(peer)
+
+	now := time.Now()
+	peer.stats.requestSent(0, 0, now)
+	manager.checkSnubbed(now.Add(SnubTimeout))
+
+	if !peer.IsSnubbed() {
+		t.Fatal("peer not snubbed")
+	}
+	if !peer.GetState().AmChoking {
+		t.Error("snubbing peer was not choked")
+	}
+	if info := manager.GetPeerInfo(); len(info) != 1 || !info[0].IsSnubbed {
+		t.Errorf("GetPeerInfo = %+v, want one snubbed peer", info)
+	}
+}
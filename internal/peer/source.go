@@ -0,0 +1,46 @@
+package peer
+
+// Source records how we learned about a peer
+type Source int
+
+const (
+	// SourceTracker peers came from a tracker announce
+	SourceTracker Source = iota
+	// SourceDHT peers came from a DHT lookup
+	SourceDHT
+	// SourcePEX peers came from peer exchange
+	SourcePEX
+	// SourceLSD peers came from local service discovery
+	SourceLSD
+	// SourceManual peers were added by the user
+	SourceManual
+	// SourceIncoming peers connected to us
+	SourceIncoming
+	// SourceHolepunch peers were introduced by a relay with ut_holepunch
+	SourceHolepunch
+)
+
+// Sources lists every peer source in display order
+var Sources = []Source{SourceTracker, SourceDHT, SourcePEX, SourceLSD, SourceManual, SourceIncoming, SourceHolepunch}
+
+// String returns the name of the source
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	case SourceManual:
+		return "manual"
+	case SourceIncoming:
+		return "incoming"
+	case SourceHolepunch:
+		return "holepunch"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,190 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// RateTimeConstant is the time constant of the transfer rate averages
+	RateTimeConstant = 5 * time.Second
+
+	// latencyWeight is the weight of a new sample in the latency average
+	latencyWeight = 0.2
+)
+
+// rateEstimator is an exponentially weighted transfer rate in bytes per
+// second. It decays continuously, so it needs no ticker.
+type rateEstimator struct {
+	rate float64
+	last time.Time
+}
+
+// add records n bytes transferred at now
+func (r *rateEstimator) add(n int, now time.Time) {
+	r.rate = r.value(now) + float64(n)/RateTimeConstant.Seconds()
+	r.last = now
+}
+
+// value returns the rate as of now
+func (r *rateEstimator) value(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(r.last).Seconds()
+	if elapsed <= 0 {
+		return r.rate
+	}
+	return r.rate * math.Exp(-elapsed/RateTimeConstant.Seconds())
+}
+
+// TransferStats is a snapshot of the traffic exchanged with one peer
+type TransferStats struct {
+	BytesDownloaded int64
+	BytesUploaded   int64
+	DownloadRate    float64       // bytes per second
+	UploadRate      float64       // bytes per second
+	RequestLatency  time.Duration // average time from request to block
+	HashFailures    int           // failed pieces this peer contributed to
+	BytesWasted     int64         // bytes received and thrown away
+}
+
+// blockKey identifies a requested block
+type blockKey struct {
+	index, begin uint32
+}
+
+// peerStats accumulates per-peer transfer statistics
+type peerStats struct {
+	mu              sync.Mutex
+	bytesDownloaded int64
+	bytesUploaded   int64
+	downRate        rateEstimator
+	upRate          rateEstimator
+	latency         time.Duration
+	latencyDev      time.Duration // mean deviation of the latency samples
+	hashFailures    int
+	bytesWasted     int64
+	requested       map[blockKey]time.Time
+	waitingSince    time.Time // last progress while requests are pending
+}
+
+func newPeerStats() *peerStats {
+	return &peerStats{
+		requested: make(map[blockKey]time.Time),
+	}
+}
+
+// requestSent records when a block was requested
+func (s *peerStats) requestSent(index, begin uint32, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requested) == 0 {
+		s.waitingSince = now
+	}
+	s.requested[blockKey{index, begin}] = now
+}
+
+// requestCancelled forgets a request that will not be answered
+func (s *peerStats) requestCancelled(index, begin uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.requested, blockKey{index, begin})
+	if len(s.requested) == 0 {
+		s.waitingSince = time.Time{}
+	}
+}
+
+// blockReceived records a downloaded block and, if we asked for it, the
+// time it took to arrive
+func (s *peerStats) blockReceived(index, begin uint32, n int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytesDownloaded += int64(n)
+	s.downRate.add(n, now)
+
+	key := blockKey{index, begin}
+	if sent, ok := s.requested[key]; ok {
+		delete(s.requested, key)
+		sample := now.Sub(sent)
+		if s.latency == 0 {
+			s.latency = sample
+			s.latencyDev = sample / 2
+		} else {
+			diff := sample - s.latency
+			if diff < 0 {
+				diff = -diff
+			}
+			s.latencyDev += time.Duration(latencyWeight * float64(diff-s.latencyDev))
+			s.latency += time.Duration(latencyWeight * float64(sample-s.latency))
+		}
+	}
+
+	if len(s.requested) == 0 {
+		s.waitingSince = time.Time{}
+	} else {
+		s.waitingSince = now
+	}
+}
+
+// restartWait restarts the wait for pending requests, for when the peer
+// unchokes us and time spent choked should not count against it
+func (s *peerStats) restartWait(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requested) > 0 {
+		s.waitingSince = now
+	}
+}
+
+// waiting returns how long pending requests have gone without any block
+// arriving, or 0 if nothing is pending
+func (s *peerStats) waiting(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requested) == 0 || s.waitingSince.IsZero() {
+		return 0
+	}
+	return now.Sub(s.waitingSince)
+}
+
+// blockSent records an uploaded block
+func (s *peerStats) blockSent(n int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bytesUploaded += int64(n)
+	s.upRate.add(n, now)
+}
+
+// hashFailed counts a failed piece the peer contributed to
+func (s *peerStats) hashFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashFailures++
+}
+
+// wasted counts bytes the peer sent that were thrown away
+func (s *peerStats) wasted(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytesWasted += n
+}
+
+// snapshot returns the statistics as of now
+func (s *peerStats) snapshot(now time.Time) TransferStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return TransferStats{
+		BytesDownloaded: s.bytesDownloaded,
+		BytesUploaded:   s.bytesUploaded,
+		DownloadRate:    s.downRate.value(now),
+		UploadRate:      s.upRate.value(now),
+		RequestLatency:  s.latency,
+		HashFailures:    s.hashFailures,
+		BytesWasted:     s.bytesWasted,
+	}
+}
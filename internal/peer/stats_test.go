@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateEstimator(t *testing.T) {
+	var r rateEstimator
+	start := time.Unix(1000, 0)
+
+	// A steady 10 KB/s converges on 10 KB/s
+	for i := 0; i < 300; i++ {
+		r.add(1024, start.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	now := start.Add(299 * 100 * time.Millisecond)
+	if got := r.value(now); math.Abs(got-10240) > 1024 {
+		t.Errorf("steady rate = %.0f, want about 10240", got)
+	}
+
+	// With no traffic the rate decays by e over one time constant
+	later := now.Add(RateTimeConstant)
+	if got, want := r.value(later), r.value(now)/math.E; math.Abs(got-want) > 1 {
+		t.Errorf("decayed rate = %.0f, want %.0f", got, want)
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	s := newPeerStats()
+	now := time.Unix(1000, 0)
+
+	s.requestSent(1, 0, now)
+	s.requestSent(1, 16384, now)
+	s.blockReceived(1, 0, 16384, now.Add(100*time.Millisecond))
+	s.blockReceived(1, 16384, 16384, now.Add(200*time.Millisecond))
+
+	// Unrequested blocks count as traffic but not latency
+	s.blockReceived(2, 0, 100, now.Add(time.Second))
+
+	s.blockSent(500, now)
+	s.hashFailed()
+	s.wasted(100)
+
+	stats := s.snapshot(now.Add(time.Second))
+	if stats.BytesDownloaded != 32868 {
+		t.Errorf("BytesDownloaded = %d, want 32868", stats.BytesDownloaded)
+	}
+	if stats.BytesUploaded != 500 {
+		t.Errorf("BytesUploaded = %d, want 500", stats.BytesUploaded)
+	}
+	if stats.DownloadRate <= 0 || stats.UploadRate <= 0 {
+		t.Errorf("rates = %.0f/%.0f, want positive", stats.DownloadRate, stats.UploadRate)
+	}
+	// 100ms then 200ms with weight 0.2
+	if stats.RequestLatency != 120*time.Millisecond {
+		t.Errorf("RequestLatency = %v, want 120ms", stats.RequestLatency)
+	}
+	if stats.HashFailures != 1 {
+		t.Errorf("HashFailures = %d, want 1", stats.HashFailures)
+	}
+	if stats.BytesWasted != 100 {
+		t.Errorf("BytesWasted = %d, want 100", stats.BytesWasted)
+	}
+	if len(s.requested) != 0 {
+		t.Errorf("%d requests still tracked, want 0", len(s.requested))
+	}
+}
+
+func TestPeerStatsWaiting(t *testing.T) {
+	s := newPeerStats()
+	now := time.Unix(1000, 0)
+
+	if got := s.waiting(now); got != 0 {
+		t.Errorf("waiting with nothing pending = %v, want 0", got)
+	}
+
+	s.requestSent(1, 0, now)
+	s.requestSent(1, 16384, now.Add(time.Second))
+	if got := s.waiting(now.Add(10 * time.Second)); got != 10*time.Second {
+		t.Errorf("waiting = %v, want 10s from the first request", got)
+	}
+
+	// A block restarts the clock while requests remain
+	s.blockReceived(1, 0, 16384, now.Add(10*time.Second))
+	if got := s.waiting(now.Add(15 * time.Second)); got != 5*time.Second {
+		t.Errorf("waiting after block = %v, want 5s", got)
+	}
+
+	s.requestCancelled(1, 16384)
+	if got := s.waiting(now.Add(time.Minute)); got != 0 {
+		t.Errorf("waiting after cancel = %v, want 0", got)
+	}
+}
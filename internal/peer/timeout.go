@@ -0,0 +1,40 @@
+package peer
+
+import "time"
+
+const (
+	// DefaultRequestTimeout is how long a block may take to arrive from a
+	// peer that has not sent one yet
+	DefaultRequestTimeout = 15 * time.Second
+
+	// MinRequestTimeout and MaxRequestTimeout bound the request timeout
+	// derived from a peer's latency
+	MinRequestTimeout = 4 * time.Second
+	MaxRequestTimeout = 60 * time.Second
+)
+
+// RequestTimeout returns how long to wait for a block requested from the
+// peer before asking another peer for it. As with TCP retransmission, it
+// is the average request latency plus four times its deviation, so a peer
+// with steady latency is given up on sooner than an erratic one.
+func (p *Peer) RequestTimeout() time.Duration {
+	return p.stats.requestTimeout()
+}
+
+// requestTimeout derives the request timeout from the latency samples
+func (s *peerStats) requestTimeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.latency == 0 {
+		return DefaultRequestTimeout
+	}
+	timeout := s.latency + 4*s.latencyDev
+	if timeout < MinRequestTimeout {
+		return MinRequestTimeout
+	}
+	if timeout > MaxRequestTimeout {
+		return MaxRequestTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,32 @@
+package peer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"no samples", nil, DefaultRequestTimeout},
+		{"fast peer", []time.Duration{100 * time.Millisecond, 120 * time.Millisecond}, MinRequestTimeout},
+		{"steady peer", []time.Duration{2 * time.Second, 2 * time.Second}, 5200 * time.Millisecond},
+		{"slow peer", []time.Duration{30 * time.Second}, MaxRequestTimeout},
+	}
+
+	for _, tt := range tests {
+		s := newPeerStats()
+		now := time.Unix(1000, 0)
+		for i, sample := range tt.samples {
+			s.requestSent(0, uint32(i), now)
+			now = now.Add(sample)
+			s.blockReceived(0, uint32(i), 16384, now)
+		}
+		if got := s.requestTimeout(); got != tt.want {
+			t.Errorf("%s: requestTimeout() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package peer
+
+import (
+	"sync"
+)
+
+// MaxQueuedUploadBytes bounds the block data we hold for one peer: blocks
+// waiting in its send queue plus blocks being read for it. A peer at the
+// bound is passed over until its connection drains, so a fast-requesting
+// peer cannot fill the send path while others wait.
+const MaxQueuedUploadBytes = 4 * BlockSize
+
+// uploadRequest is a block a peer has asked us for
+type uploadRequest struct {
+	index, begin, length uint32
+}
+
+// uploadQueue holds the pending requests of every peer we upload to. It
+// serves one block per peer in turn so a peer with a deep queue cannot
+// starve the others, and skips peers holding MaxQueuedUploadBytes so a
+// peer that requests faster than it reads cannot either.
+type uploadQueue struct {
+	mu       sync.Mutex
+	queues   map[*Peer][]uploadRequest
+	order    []*Peer       // peers with pending requests, next to be served first
+	inFlight map[*Peer]int // bytes popped and not yet queued to the peer
+	wake     chan struct{}
+}
+
+func newUploadQueue() *uploadQueue {
+	return &uploadQueue{
+		queues:   make(map[*Peer][]uploadRequest),
+		inFlight: make(map[*Peer]int),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// signal wakes an upload loop without blocking
+func (q *uploadQueue) signal() {
+	notify(q.wake)
+}
+
+// push queues a request, returning false if the peer already asked for
+// the same block
+func (q *uploadQueue) push(p *Peer, r uploadRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending, exists := q.queues[p]
+	for _, queued := range pending {
+		if queued == r {
+			return false
+		}
+	}
+	if !exists {
+		q.order = append(q.order, p)
+	}
+	q.queues[p] = append(pending, r)
+
+	q.signal()
+	return true
+}
+
+// cancel removes a queued request, returning false if it was not queued
+func (q *uploadQueue) cancel(p *Peer, r uploadRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.queues[p]
+	for i, queued := range pending {
+		if queued == r {
+			pending = append(pending[:i], pending[i+1:]...)
+			q.setPending(p, pending)
+			return true
+		}
+	}
+	return false
+}
+
+// drop removes and returns every request queued by a peer
+func (q *uploadQueue) drop(p *Peer) []uploadRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.queues[p]
+	q.setPending(p, nil)
+	return pending
+}
+
+// pop returns the next request to serve, rotating through peers. Peers
+// holding MaxQueuedUploadBytes are passed over and keep their place, so
+// they are served first once their data has been sent. The caller must
+// call done with the request once it has been served.
+func (q *uploadQueue) pop() (*Peer, uploadRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	next := -1
+	for i, p := range q.order {
+		if q.inFlight[p]+p.outbox.dataBytes() < MaxQueuedUploadBytes {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return nil, uploadRequest{}, false
+	}
+
+	p := q.order[next]
+	pending := q.queues[p]
+	r := pending[0]
+	q.order = append(q.order[:next], q.order[next+1:]...)
+	q.inFlight[p] += int(r.length)
+
+	if len(pending) > 1 {
+		q.queues[p] = pending[1:]
+		q.order = append(q.order, p)
+	} else {
+		delete(q.queues, p)
+	}
+
+	// Pass the wake-up on so another worker takes the next request
+	if len(q.order) > 0 {
+		q.signal()
+	}
+	return p, r, true
+}
+
+// done releases a popped request once its block has been queued to the
+// peer or discarded
+func (q *uploadQueue) done(p *Peer, r uploadRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.inFlight[p] -= int(r.length); q.inFlight[p] <= 0 {
+		delete(q.inFlight, p)
+	}
+	if len(q.order) > 0 {
+		q.signal()
+	}
+}
+
+// pending returns the number of requests queued by a peer
+func (q *uploadQueue) pending(p *Peer) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queues[p])
+}
+
+// setPending replaces a peer's queue, removing the peer from the rotation
+// when it is empty (must hold lock)
+func (q *uploadQueue) setPending(p *Peer, pending []uploadRequest) {
+	if len(pending) > 0 {
+		q.queues[p] = pending
+		return
+	}
+
+	if _, exists := q.queues[p]; !exists {
+		return
+	}
+	delete(q.queues, p)
+	for i, queued := range q.order {
+		if queued == p {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// uploadLoop serves queued requests until the manager stops. The manager
+// runs several, so a slow read for one request does not hold up the rest.
+func (m *Manager) uploadLoop() {
+	for {
+		peer, r, ok := m.uploads.pop()
+		if !ok {
+			select {
+			case <-m.uploads.wake:
+				continue
+			case <-m.ctx.Done():
+				return
+			}
+		}
+		m.serveRequest(peer, r)
+		m.uploads.done(peer, r)
+	}
+}
+
+// serveRequest reads a requested block from disk and sends it. Requests
+// from a peer we have since choked are refused along with the rest of its
+// queue.
+func (m *Manager) serveRequest(peer *Peer, r uploadRequest) {
+	defer peer.RequestDone()
+
+	if !peer.IsConnected() {
+		return
+	}
+	if !peer.CanUpload() {
+		peer.rejectRequest(r)
+		m.dropUploads(peer)
+		return
+	}
+
+	m.mu.RLock()
+	pieceManager := m.pieceManager
+	m.mu.RUnlock()
+	if pieceManager == nil {
+		return
+	}
+
+	// The block is read straight into the message that carries it
+	msg, block := newPieceMessage(r.index, r.begin, int(r.length))
+	if err := pieceManager.ReadBlockInto(int(r.index), int(r.begin), block); err != nil {
+		m.log().Warn("Failed to read block for upload", "piece", r.index, "begin", r.begin, "peer", peer.Address(), "err", err)
+		return
+	}
+
+	if err := peer.sendPiece(msg); err != nil {
+		return
+	}
+
+	m.stats.mu.Lock()
+	m.stats.BytesUploaded += int64(len(block))
+	m.stats.mu.Unlock()
+}
+
+// dropUploads refuses all requests queued by a peer
+func (m *Manager) dropUploads(peer *Peer) {
+	for _, r := range m.uploads.drop(peer) {
+		m.refuseRequest(peer, r)
+	}
+}
+
+// Choke chokes a peer and refuses the requests it has queued. A peer with
+// the Fast extension keeps its requests through a choke until each is
+// rejected.
+func (m *Manager) Choke(peer *Peer) error {
+	err := peer.Choke()
+	m.dropUploads(peer)
+	return err
+}
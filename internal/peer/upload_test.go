@@ -0,0 +1,258 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// blockSource serves every block as zeros, of pieces 4 blocks long
+type blockSource struct{}
+
+func (blockSource) ReadBlockInto(pieceIndex, begin int, buf []byte) error {
+	clear(buf)
+	return nil
+}
+
+func (blockSource) PieceLength(index int) int {
+	return 4 * BlockSize
+}
+
+func (blockSource) AddBlockBuffer(pieceIndex, begin int, data []byte, release func(), source string) error {
+	release()
+	return nil
+}
+
+// slowSource serves blocks of piece 0 only once release is closed
+type slowSource struct {
+	blockSource
+	release chan struct{}
+}
+
+func (s slowSource) ReadBlockInto(pieceIndex, begin int, buf []byte) error {
+	if pieceIndex == 0 {
+		<-s.release
+	}
+	return s.blockSource.ReadBlockInto(pieceIndex, begin, buf)
+}
+
+// newUploadTestPeer returns a peer over a pipe that we are unchoking
+func newUploadTestPeer(t *testing.T) *Peer {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	peer := NewPeer(client, [20]byte{}, [20]byte{})
+	peer.mu.Lock()
+	peer.state.AmChoking = false
+	peer.state.PeerInterested = true
+	peer.mu.Unlock()
+	return peer
+}
+
+func TestUploadQueueRoundRobin(t *testing.T) {
+	q := newUploadQueue()
+	a, b := &Peer{outbox: newOutbox()}, &Peer{outbox: newOutbox()}
+
+	for i := uint32(0); i < 3; i++ {
+		q.push(a, uploadRequest{0, i * BlockSize, BlockSize})
+	}
+	q.push(b, uploadRequest{1, 0, BlockSize})
+
+	if q.push(a, uploadRequest{0, 0, BlockSize}) {
+		t.Error("duplicate request was queued")
+	}
+
+	var served []*Peer
+	for {
+		p, _, ok := q.pop()
+		if !ok {
+			break
+		}
+		served = append(served, p)
+	}
+
+	want := []*Peer{a, b, a, a}
+	if len(served) != len(want) {
+		t.Fatalf("served %d requests, want %d", len(served), len(want))
+	}
+	for i := range want {
+		if served[i] != want[i] {
+			t.Errorf("request %d served to the wrong peer", i)
+		}
+	}
+}
+
+func TestUploadQueueBoundsQueuedBytes(t *testing.T) {
+	q := newUploadQueue()
+	a, b := &Peer{outbox: newOutbox()}, &Peer{outbox: newOutbox()}
+
+	for i := uint32(0); i < 6; i++ {
+		q.push(a, uploadRequest{0, i * BlockSize, BlockSize})
+	}
+	q.push(b, uploadRequest{1, 0, BlockSize})
+
+	// Blocks being read for a count against its bound
+	var popped []uploadRequest
+	for i := 0; i < 4; i++ {
+		p, r, ok := q.pop()
+		if !ok {
+			t.Fatalf("pop %d found nothing", i)
+		}
+		if p == a {
+			popped = append(popped, r)
+		}
+	}
+	if p, _, ok := q.pop(); !ok || p != a {
+		t.Fatalf("pop did not serve a's fourth block")
+	}
+	if _, _, ok := q.pop(); ok {
+		t.Fatal("pop served a peer holding MaxQueuedUploadBytes")
+	}
+
+	// So do blocks waiting to be sent
+	for _, r := range popped {
+		q.done(a, r)
+		a.outbox.push(NewPieceMessage(r.index, r.begin, make([]byte, r.length)))
+	}
+	if _, _, ok := q.pop(); ok {
+		t.Fatal("pop served a peer with a full send queue")
+	}
+
+	a.outbox.take()
+	if p, _, ok := q.pop(); !ok || p != a {
+		t.Error("pop did not serve a once its send queue drained")
+	}
+}
+
+func TestUploadQueueCancelAndDrop(t *testing.T) {
+	q := newUploadQueue()
+	a, b := &Peer{outbox: newOutbox()}, &Peer{outbox: newOutbox()}
+
+	q.push(a, uploadRequest{0, 0, BlockSize})
+	q.push(a, uploadRequest{0, BlockSize, BlockSize})
+	q.push(b, uploadRequest{1, 0, BlockSize})
+
+	if !q.cancel(a, uploadRequest{0, 0, BlockSize}) {
+		t.Error("cancel of a queued request failed")
+	}
+	if q.cancel(a, uploadRequest{5, 0, BlockSize}) {
+		t.Error("cancel of an unknown request succeeded")
+	}
+	if n := len(q.drop(b)); n != 1 {
+		t.Errorf("drop = %d, want 1", n)
+	}
+
+	p, r, ok := q.pop()
+	if !ok || p != a || r.begin != BlockSize {
+		t.Errorf("pop = %v, %+v, %v, want peer a's second block", p == a, r, ok)
+	}
+	if _, _, ok := q.pop(); ok {
+		t.Error("queue not empty after cancel and drop")
+	}
+}
+
+func TestManagerQueuesAndCancelsRequests(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(blockSource{})
+	manager.setPiece(0)
+
+	peer := newUploadTestPeer(t)
+	peer.admitRequest()
+	peer.admitRequest()
+
+	manager.handlePieceRequest(peer, 0, 0, BlockSize)
+	manager.handlePieceRequest(peer, 0, BlockSize, BlockSize)
+	if got := manager.uploads.pending(peer); got != 2 {
+		t.Fatalf("queued requests = %d, want 2", got)
+	}
+
+	manager.handleCancelRequest(peer, 0, 0, BlockSize)
+	if got := manager.uploads.pending(peer); got != 1 {
+		t.Errorf("queued requests after cancel = %d, want 1", got)
+	}
+	if got := peer.PendingRequests(); got != 1 {
+		t.Errorf("PendingRequests after cancel = %d, want 1", got)
+	}
+
+	// A piece we do not have is refused outright
+	peer.admitRequest()
+	manager.handlePieceRequest(peer, 3, 0, BlockSize)
+	if got := manager.uploads.pending(peer); got != 1 {
+		t.Errorf("queued requests = %d, want 1", got)
+	}
+
+	p, r, _ := manager.uploads.pop()
+	manager.serveRequest(p, r)
+
+	if sent := peer.outbox.take(); len(sent) != 1 || sent[0].ID != MsgPiece {
+		t.Fatalf("queued messages = %v, want one piece", sent)
+	}
+	if got := peer.PendingRequests(); got != 0 {
+		t.Errorf("PendingRequests after serving = %d, want 0", got)
+	}
+	if got := manager.GetStats().BytesUploaded; got != BlockSize {
+		t.Errorf("BytesUploaded = %d, want %d", got, BlockSize)
+	}
+}
+
+func TestManagerDropsRequestsAfterChoke(t *testing.T) {
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(blockSource{})
+	manager.setPiece(0)
+
+	peer := newUploadTestPeer(t)
+	for i := uint32(0); i < 3; i++ {
+		peer.admitRequest()
+		manager.handlePieceRequest(peer, 0, i*BlockSize, BlockSize)
+	}
+
+	peer.mu.Lock()
+	peer.state.AmChoking = true
+	peer.mu.Unlock()
+
+	p, r, _ := manager.uploads.pop()
+	manager.serveRequest(p, r)
+
+	if got := manager.uploads.pending(peer); got != 0 {
+		t.Errorf("queued requests after choke = %d, want 0", got)
+	}
+	if got := peer.PendingRequests(); got != 0 {
+		t.Errorf("PendingRequests after choke = %d, want 0", got)
+	}
+	if peer.outbox.len() != 0 {
+		t.Error("a block was sent to a choked peer")
+	}
+}
+
+func TestManagerServesPastSlowRead(t *testing.T) {
+	source := slowSource{release: make(chan struct{})}
+	manager := NewManager([20]byte{}, [20]byte{}, 10)
+	manager.SetPieceManager(source)
+	manager.setPiece(0)
+	manager.setPiece(1)
+	manager.Start()
+	defer manager.Stop()
+	defer close(source.release)
+
+	slow, fast := newUploadTestPeer(t), newUploadTestPeer(t)
+	slow.admitRequest()
+	manager.handlePieceRequest(slow, 0, 0, BlockSize)
+	fast.admitRequest()
+	manager.handlePieceRequest(fast, 1, 0, BlockSize)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fast.outbox.len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request was not served while another read was blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slow.outbox.len() != 0 {
+		t.Error("blocked read was served")
+	}
+}
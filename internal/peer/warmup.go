@@ -0,0 +1,65 @@
+package peer
+
+import "sort"
+
+// WarmupPieces is how many pieces are prefetched for a peer when it is
+// unchoked
+const WarmupPieces = 2
+
+// Prefetcher is implemented by piece managers that can read pieces into
+// memory ahead of requests for them
+type Prefetcher interface {
+	Prefetch(index int)
+}
+
+// Unchoke unchokes a peer. If the piece manager is a Prefetcher, the
+// pieces the peer is likely to request first are read in the background,
+// so its first requests do not wait for the disk.
+func (m *Manager) Unchoke(peer *Peer) error {
+	if err := peer.Unchoke(); err != nil {
+		return err
+	}
+	m.warmUp(peer)
+	return nil
+}
+
+// warmUp prefetches the pieces we have and peer lacks that are rarest
+// among our other peers, which a peer picking rarest first asks for
+func (m *Manager) warmUp(peer *Peer) {
+	m.mu.RLock()
+	prefetcher, ok := m.pieceManager.(Prefetcher)
+	ours := append([]byte(nil), m.bitfield...)
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	var candidates []int
+	for index := 0; index < m.numPieces; index++ {
+		if ours[index/8]&(1<<(7-index%8)) != 0 && !peer.HasPiece(index) {
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	availability := make(map[int]int, len(candidates))
+	for _, other := range m.GetPeers() {
+		if other == peer {
+			continue
+		}
+		for _, index := range candidates {
+			if other.HasPiece(index) {
+				availability[index]++
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return availability[candidates[i]] < availability[candidates[j]]
+	})
+
+	for _, index := range candidates[:min(WarmupPieces, len(candidates))] {
+		prefetcher.Prefetch(index)
+	}
+}
@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// prefetchRecorder records the pieces it is asked to prefetch
+type prefetchRecorder struct {
+	blockSource
+	mu      sync.Mutex
+	indices []int
+}
+
+func (r *prefetchRecorder) Prefetch(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.indices = append(r.indices, index)
+}
+
+func TestUnchokeWarmsUp(t *testing.T) {
+	recorder := &prefetchRecorder{}
+	manager := NewManager([20]byte{}, [20]byte{}, 8)
+	manager.SetPieceManager(recorder)
+	for index := 0; index < 5; index++ {
+		manager.setPiece(index)
+	}
+
+	// The peer has piece 0, and another peer pieces 1 and 2, so pieces 3
+	// and 4 are the rarest the peer lacks
+	peer, other := newUploadTestPeer(t), newUploadTestPeer(t)
+	peer.mu.Lock()
+	peer.bitfield = []byte{0x80}
+	peer.mu.Unlock()
+	other.mu.Lock()
+	other.bitfield = []byte{0x60}
+	other.mu.Unlock()
+	manager.mu.Lock()
+	manager.peers["other"] = other
+	manager.mu.Unlock()
+
+	if err := manager.Unchoke(peer); err != nil {
+		t.Fatalf("Unchoke failed: %v", err)
+	}
+	if peer.GetState().AmChoking {
+		t.Error("peer still choked")
+	}
+	if want := []int{3, 4}; !reflect.DeepEqual(recorder.indices, want) {
+		t.Errorf("prefetched %v, want %v", recorder.indices, want)
+	}
+}
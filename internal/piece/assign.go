@@ -0,0 +1,189 @@
+package piece
+
+import (
+	"fmt"
+	"time"
+)
+
+// AssignPiece picks a piece for a peer to work on and records the peer as
+// its owner. A piece the peer already owns is returned while it still has
+// blocks nobody has requested. Otherwise pieces with deadlines come first;
+// then the strategy picks among pieces the peer has that no other peer
+// owns, high priority pieces first. In the endgame, pieces owned by others
+// may be shared. Skipped pieces are never assigned.
+func (m *Manager) AssignPiece(peerID string, peerBitfield []byte, endgame bool) (int, error) {
+	m.expireDeadlines(time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Keep working on our own pieces first
+	for index, owners := range m.assignments {
+		if owners[peerID] && m.pieces[index].hasUnrequestedBlocks(m.requests) {
+			return index, nil
+		}
+	}
+
+	if m.strategy == nil {
+		return -1, fmt.Errorf("no selection strategy set")
+	}
+
+	// Hide skipped pieces and pieces owned by other peers from the strategy,
+	// and pieces not yet started once no more may be
+	candidates := m.maskSkipped(peerBitfield)
+	limited := m.partialLimited()
+	if limited {
+		candidates = m.maskStarted(candidates)
+	}
+	if piece := m.urgentPiece(candidates, endgame, time.Now()); piece != nil {
+		m.assign(piece.Index, peerID)
+		return piece.Index, nil
+	}
+	if !endgame && len(m.assignments) > 0 {
+		if m.priorities == nil && !limited {
+			candidates = make([]byte, len(peerBitfield))
+			copy(candidates, peerBitfield)
+		}
+		for index := range m.assignments {
+			clearPiece(candidates, index)
+		}
+	}
+
+	piece := m.selectPiece(candidates)
+	if piece == nil && limited {
+		return -1, ErrPartialLimit
+	}
+	if piece == nil {
+		return -1, fmt.Errorf("no piece selected")
+	}
+	m.assign(piece.Index, peerID)
+	return piece.Index, nil
+}
+
+// assign records a peer as an owner of a piece (must hold m.mu)
+func (m *Manager) assign(index int, peerID string) {
+	owners := m.assignments[index]
+	if owners == nil {
+		owners = make(map[string]bool)
+		m.assignments[index] = owners
+	}
+	owners[peerID] = true
+}
+
+// UnassignPeer releases every piece owned by a peer, e.g. when it
+// disconnects or chokes us
+func (m *Manager) UnassignPeer(peerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for index, owners := range m.assignments {
+		delete(owners, peerID)
+		if len(owners) == 0 {
+			delete(m.assignments, index)
+		}
+	}
+}
+
+// PieceOwners returns the peers working on a piece
+func (m *Manager) PieceOwners(index int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owners := make([]string, 0, len(m.assignments[index]))
+	for peerID := range m.assignments[index] {
+		owners = append(owners, peerID)
+	}
+	return owners
+}
+
+// unassignPiece releases a piece from all its owners once it is finished
+// or has to start over
+func (m *Manager) unassignPiece(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.assignments, index)
+}
+
+// HasUnrequestedBlocks returns true while some missing block of a wanted
+// piece has not been requested from anyone. Once it returns false every
+// remaining block is in flight and the download is in its endgame. The
+// count is kept by the request tracker, and only the pieces changed since
+// the last call are counted again.
+func (m *Manager) HasUnrequestedBlocks() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stale, all := m.requests.takeStale()
+	if all {
+		stale = make([]int, len(m.pieces))
+		for i := range stale {
+			stale[i] = i
+		}
+	}
+	for _, i := range stale {
+		if i < 0 || i >= len(m.pieces) {
+			continue
+		}
+		n := 0
+		if m.priority(i) != PrioritySkip {
+			n = m.pieces[i].unrequestedBlocks(m.requests)
+		}
+		m.requests.setUnrequested(i, n)
+	}
+	return m.requests.unrequestedBlocks() > 0
+}
+
+// hasUnrequestedBlocks returns true if some missing block of the piece has
+// not been requested
+func (p *Piece) hasUnrequestedBlocks(requests *Requests) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.State == PieceStateVerified {
+		return false
+	}
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) && !requests.Requested(p.Index, block.Begin) {
+			return true
+		}
+	}
+	return false
+}
+
+// unrequestedBlocks counts the missing blocks of the piece that have not
+// been requested
+func (p *Piece) unrequestedBlocks(requests *Requests) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.State == PieceStateVerified {
+		return 0
+	}
+	n := 0
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) && !requests.Requested(p.Index, block.Begin) {
+			n++
+		}
+	}
+	return n
+}
+
+// pendingRequests counts the missing blocks of the piece that are
+// requested (must hold p.mu)
+func (p *Piece) pendingRequests(requests *Requests) int {
+	n := 0
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) && requests.Requested(p.Index, block.Begin) {
+			n++
+		}
+	}
+	return n
+}
+
+// clearPiece clears a piece's bit in a bitfield
+func clearPiece(bitfield []byte, index int) {
+	byteIndex := index / 8
+	if byteIndex < len(bitfield) {
+		bitfield[byteIndex] &^= 1 << (7 - index%8)
+	}
+}
@@ -0,0 +1,124 @@
+package piece
+
+import "testing"
+
+// newAssignTestManager returns a manager for four two-block pieces
+func newAssignTestManager() *Manager {
+	return NewManager(4, 2*BlockSize, 2*BlockSize, make([][20]byte, 4))
+}
+
+// requestAll marks every block of a piece as requested
+func requestAll(m *Manager, index int) {
+	m.RequestBlock("a", index, 0, BlockSize)
+	m.RequestBlock("a", index, BlockSize, BlockSize)
+}
+
+func TestAssignPieceExclusive(t *testing.T) {
+	m := newAssignTestManager()
+	all := []byte{0xf0}
+
+	a, err := m.AssignPiece("a", all, false)
+	if err != nil || a != 0 {
+		t.Fatalf("AssignPiece(a) = %d, %v, want 0", a, err)
+	}
+
+	// Another peer is given a different piece
+	b, err := m.AssignPiece("b", all, false)
+	if err != nil || b != 1 {
+		t.Fatalf("AssignPiece(b) = %d, %v, want 1", b, err)
+	}
+
+	// A peer keeps its piece while it has unrequested blocks
+	if got, _ := m.AssignPiece("a", all, false); got != 0 {
+		t.Errorf("AssignPiece(a) again = %d, want 0", got)
+	}
+
+	// and moves on once they are all requested
+	requestAll(m, 0)
+	if got, _ := m.AssignPiece("a", all, false); got != 2 {
+		t.Errorf("AssignPiece(a) after requesting piece 0 = %d, want 2", got)
+	}
+
+	// A peer with only owned pieces gets nothing outside the endgame
+	if got, err := m.AssignPiece("c", []byte{0x40}, false); err == nil {
+		t.Errorf("AssignPiece(c) = %d, want error", got)
+	}
+	if got, err := m.AssignPiece("c", []byte{0x40}, true); err != nil || got != 1 {
+		t.Errorf("AssignPiece(c) in endgame = %d, %v, want 1", got, err)
+	}
+	if owners := m.PieceOwners(1); len(owners) != 2 {
+		t.Errorf("PieceOwners(1) = %v, want b and c", owners)
+	}
+}
+
+func TestUnassignPeer(t *testing.T) {
+	m := newAssignTestManager()
+
+	m.AssignPiece("a", []byte{0x80}, false)
+	if _, err := m.AssignPiece("b", []byte{0x80}, false); err == nil {
+		t.Fatal("piece 0 assigned twice")
+	}
+
+	m.UnassignPeer("a")
+	if owners := m.PieceOwners(0); len(owners) != 0 {
+		t.Errorf("PieceOwners(0) = %v after unassign, want none", owners)
+	}
+	if got, err := m.AssignPiece("b", []byte{0x80}, false); err != nil || got != 0 {
+		t.Errorf("AssignPiece(b) = %d, %v, want 0", got, err)
+	}
+}
+
+func TestVerifiedPieceUnassigned(t *testing.T) {
+	good := make([]byte, 2*BlockSize)
+	m, _ := newBanTestManager(good)
+
+	if _, err := m.AssignPiece("a", []byte{0x80}, false); err != nil {
+		t.Fatalf("AssignPiece failed: %v", err)
+	}
+	attempt(m, good, [2]string{"a", "a"})
+
+	if owners := m.PieceOwners(0); len(owners) != 0 {
+		t.Errorf("PieceOwners(0) = %v after verification, want none", owners)
+	}
+}
+
+func TestHasUnrequestedBlocks(t *testing.T) {
+	m := newAssignTestManager()
+	if err := m.SetPriorities([]Priority{PriorityNormal, PriorityNormal, PrioritySkip, PriorityNormal}); err != nil {
+		t.Fatalf("SetPriorities failed: %v", err)
+	}
+	m.MarkPieceVerified(3)
+
+	requestAll(m, 0)
+	m.RequestBlock("a", 1, 0, BlockSize)
+	if !m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = false with a block of piece 1 left")
+	}
+
+	// Skipped and verified pieces are not waited on
+	m.RequestBlock("a", 1, BlockSize, BlockSize)
+	if m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = true with every wanted block requested")
+	}
+
+	m.ReleaseBlock(0, 0, BlockSize)
+	if !m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = false after a block was released")
+	}
+
+	// The running count follows priorities and arriving blocks
+	m.SetPriorities([]Priority{PrioritySkip, PriorityNormal, PrioritySkip, PriorityNormal})
+	if m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = true with the released block's piece skipped")
+	}
+	m.SetPriorities(nil)
+	if !m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = false with the released block's piece wanted again")
+	}
+	m.RequestBlock("a", 2, 0, BlockSize)
+	m.RequestBlock("a", 2, BlockSize, BlockSize)
+	m.AddBlockDataFrom(0, 0, make([]byte, BlockSize), "httpseed:x")
+	if m.HasUnrequestedBlocks() {
+		t.Error("HasUnrequestedBlocks = true after the released block arrived")
+	}
+}
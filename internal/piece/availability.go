@@ -0,0 +1,133 @@
+package piece
+
+// Availability returns how many connected peers have each piece, by
+// index. The counts are kept up to date as peers send bitfields and have
+// messages and disconnect.
+func (m *Manager) Availability() []int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	availability := make([]int, len(m.availability))
+	for i, count := range m.availability {
+		availability[i] = count + len(m.seeds)
+	}
+	return availability
+}
+
+// PeerHaveAll records a peer that announced every piece with the Fast
+// extension's Have All message. Seeds are counted without a bitfield and
+// are left out of the strategy's rarest-first counts, which they would
+// raise evenly without changing their order.
+func (m *Manager) PeerHaveAll(peerID string) {
+	m.mu.Lock()
+	m.forgetPeer(peerID)
+	m.seeds[peerID] = true
+	m.mu.Unlock()
+
+	if tracker := m.peerTracker(); tracker != nil {
+		tracker.RemovePeer(peerID)
+	}
+}
+
+// setPeerPieces replaces the pieces a peer has, nil once it is gone. Until
+// the metadata is known the bitfield is kept whole, for SetMetadata.
+func (m *Manager) setPeerPieces(peerID string, bitfield []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forgetPeer(peerID)
+	if bitfield == nil {
+		return
+	}
+	size := (len(m.pieces) + 7) / 8
+	if len(m.pieces) == 0 {
+		size = len(bitfield)
+	}
+	pieces := make([]byte, size)
+	copy(pieces, bitfield)
+	for i := range m.availability {
+		if peerHasPiece(pieces, i) {
+			m.availability[i]++
+		}
+	}
+	m.peerPieces[peerID] = pieces
+}
+
+// addPeerPiece records a piece a peer announced. It returns false for a
+// seed, whose have messages tell us nothing.
+func (m *Manager) addPeerPiece(peerID string, index int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.seeds[peerID] {
+		return false
+	}
+	if len(m.pieces) == 0 {
+		m.bufferPeerPiece(peerID, index)
+		return true
+	}
+	if index < 0 || index >= len(m.availability) {
+		return true
+	}
+	pieces, ok := m.peerPieces[peerID]
+	if !ok {
+		pieces = make([]byte, (len(m.pieces)+7)/8)
+		m.peerPieces[peerID] = pieces
+	}
+	if !peerHasPiece(pieces, index) {
+		pieces[index/8] |= 1 << (7 - index%8)
+		m.availability[index]++
+	}
+	return true
+}
+
+// bufferPeerPiece records a piece a peer announced before the metadata is
+// known, growing its bitfield to fit (must hold m.mu)
+func (m *Manager) bufferPeerPiece(peerID string, index int) {
+	if index < 0 || index >= maxBufferedPieces {
+		return
+	}
+	pieces := m.peerPieces[peerID]
+	if size := index/8 + 1; len(pieces) < size {
+		pieces = append(pieces, make([]byte, size-len(pieces))...)
+	}
+	pieces[index/8] |= 1 << (7 - index%8)
+	m.peerPieces[peerID] = pieces
+}
+
+// forgetPeer drops the pieces recorded for a peer (must hold m.mu)
+func (m *Manager) forgetPeer(peerID string) {
+	delete(m.seeds, peerID)
+	pieces, ok := m.peerPieces[peerID]
+	if !ok {
+		return
+	}
+	for i := range m.availability {
+		if peerHasPiece(pieces, i) {
+			m.availability[i]--
+		}
+	}
+	delete(m.peerPieces, peerID)
+}
+
+// PeerInteresting returns true if a peer has a piece we still want, one
+// that is neither verified nor skipped
+func (m *Manager) PeerInteresting(peerID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seed := m.seeds[peerID]
+	pieces, ok := m.peerPieces[peerID]
+	if !seed && !ok {
+		return false
+	}
+	for i, piece := range m.pieces {
+		if piece.State == PieceStateVerified || m.priority(i) == PrioritySkip {
+			continue
+		}
+		if seed || peerHasPiece(pieces, i) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package piece
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAvailability(t *testing.T) {
+	m := newAssignTestManager()
+
+	m.UpdatePeerBitfield("a", []byte{0xc0})
+	m.UpdatePeerBitfield("b", []byte{0x60})
+	m.PeerHave("c", 3)
+	m.PeerHave("c", 3)
+	if got, want := m.Availability(), []int{1, 2, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability = %v, want %v", got, want)
+	}
+
+	// A new bitfield replaces the old one
+	m.UpdatePeerBitfield("a", []byte{0x10})
+	m.PeerHave("b", 0)
+	if got, want := m.Availability(), []int{1, 1, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability after updates = %v, want %v", got, want)
+	}
+
+	m.RemovePeer("b")
+	m.RemovePeer("unknown")
+	if got, want := m.Availability(), []int{0, 0, 0, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability after RemovePeer = %v, want %v", got, want)
+	}
+}
+
+func TestPeerHaveAll(t *testing.T) {
+	m := newAssignTestManager()
+	strategy := NewRarestFirstStrategy()
+	m.SetSelectionStrategy(strategy)
+
+	m.UpdatePeerBitfield("a", []byte{0x80})
+	m.UpdatePeerBitfield("seed", []byte{0x40})
+	m.PeerHaveAll("seed")
+	m.PeerHave("seed", 2)
+	if got, want := m.Availability(), []int{2, 1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability = %v, want %v", got, want)
+	}
+	if _, ok := strategy.peerBitfields["seed"]; ok {
+		t.Error("seed still tracked by the strategy")
+	}
+
+	// A bitfield sent later replaces Have All
+	m.UpdatePeerBitfield("seed", []byte{0x10})
+	if got, want := m.Availability(), []int{1, 0, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability after a bitfield = %v, want %v", got, want)
+	}
+
+	m.PeerHaveAll("seed")
+	m.RemovePeer("seed")
+	if got, want := m.Availability(), []int{1, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability after RemovePeer = %v, want %v", got, want)
+	}
+}
+
+func TestPeerInteresting(t *testing.T) {
+	m := newAssignTestManager()
+	m.UpdatePeerBitfield("a", []byte{0xc0})
+	m.PeerHaveAll("seed")
+
+	if !m.PeerInteresting("a") || !m.PeerInteresting("seed") {
+		t.Error("PeerInteresting = false for peers with pieces we need")
+	}
+	if m.PeerInteresting("unknown") {
+		t.Error("PeerInteresting = true for a peer that announced nothing")
+	}
+
+	m.MarkPieceVerified(0)
+	m.SetPriorities([]Priority{PriorityNormal, PrioritySkip, PriorityNormal, PriorityNormal})
+	if m.PeerInteresting("a") {
+		t.Error("PeerInteresting = true for a peer with only verified and skipped pieces")
+	}
+	m.PeerHave("a", 3)
+	if !m.PeerInteresting("a") {
+		t.Error("PeerInteresting = false after the peer announced a needed piece")
+	}
+}
@@ -0,0 +1,44 @@
+package piece
+
+import "fmt"
+
+// BootstrapMode is how SmartStrategy picks a torrent's first pieces,
+// before it has enough to trade and switches to rarest-first
+type BootstrapMode int
+
+const (
+	// BootstrapSequential picks the first pieces in order, so the start
+	// of the content is there early
+	BootstrapSequential BootstrapMode = iota
+	// BootstrapRandom picks them at random, as the reference client does,
+	// so the peers of a young swarm do not all start on the same pieces
+	BootstrapRandom
+)
+
+// DefaultBootstrapPieces is how many pieces SmartStrategy picks with its
+// bootstrap mode before switching to rarest-first
+const DefaultBootstrapPieces = 4
+
+// ParseBootstrapMode parses "sequential" or "random"; "" is sequential
+func ParseBootstrapMode(s string) (BootstrapMode, error) {
+	switch s {
+	case "", "sequential":
+		return BootstrapSequential, nil
+	case "random":
+		return BootstrapRandom, nil
+	default:
+		return BootstrapSequential, fmt.Errorf("unknown bootstrap mode %q", s)
+	}
+}
+
+// String returns the name of the mode
+func (b BootstrapMode) String() string {
+	switch b {
+	case BootstrapSequential:
+		return "sequential"
+	case BootstrapRandom:
+		return "random"
+	default:
+		return fmt.Sprintf("BootstrapMode(%d)", int(b))
+	}
+}
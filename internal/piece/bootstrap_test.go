@@ -0,0 +1,58 @@
+package piece
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseBootstrapMode(t *testing.T) {
+	for _, mode := range []BootstrapMode{BootstrapSequential, BootstrapRandom} {
+		got, err := ParseBootstrapMode(mode.String())
+		if err != nil || got != mode {
+			t.Errorf("ParseBootstrapMode(%q) = %v, %v, want %v", mode.String(), got, err, mode)
+		}
+	}
+	if _, err := ParseBootstrapMode("backwards"); err == nil {
+		t.Error("ParseBootstrapMode accepted an unknown mode")
+	}
+}
+
+func TestSmartStrategyRandomBootstrap(t *testing.T) {
+	strategy := NewSmartStrategy(WithBootstrap(BootstrapRandom, 3), WithRandomSeed(1))
+	pieces := createTestPieces(40)
+	all := make([]int, 40)
+	for i := range all {
+		all[i] = i
+	}
+	peerBitfield := createBitfield(40, all)
+
+	// Seeded, so the picks are the same every run
+	inOrder := true
+	for i := 0; i < 3; i++ {
+		selected := strategy.SelectPiece(pieces, peerBitfield)
+		if selected == nil {
+			t.Fatal("Expected a piece to be selected")
+		}
+		if selected.State == PieceStateVerified {
+			t.Fatalf("selected verified piece %d", selected.Index)
+		}
+		if selected.Index != i {
+			inOrder = false
+		}
+		selected.State = PieceStateVerified
+	}
+	if inOrder {
+		t.Error("random bootstrap picked the first pieces in order")
+	}
+
+	// Once bootstrapped, rarest-first takes over: a missing piece another
+	// peer lacks is the rarest
+	rare := 39
+	for pieces[rare].State == PieceStateVerified {
+		rare--
+	}
+	strategy.UpdatePeerBitfield("peer1", createBitfield(40, slices.Delete(slices.Clone(all), rare, rare+1)))
+	if selected := strategy.SelectPiece(pieces, peerBitfield); selected == nil || selected.Index != rare {
+		t.Errorf("after bootstrap selected %v, want the rarest piece %d", selected, rare)
+	}
+}
@@ -0,0 +1,170 @@
+package piece
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultReadCacheSize is how many bytes of prefetched pieces are kept in
+// memory for uploads
+const DefaultReadCacheSize = 16 << 20
+
+// readCache keeps whole verified pieces in memory so their blocks can be
+// uploaded without waiting for the disk. The least recently used pieces
+// are evicted once it is full.
+type readCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[int]*list.Element
+	lru      *list.List // of *cacheEntry, most recently used first
+	loading  map[int]bool
+
+	// Bumped by clear, so reads started before it are not cached
+	generation int
+}
+
+type cacheEntry struct {
+	index int
+	data  []byte
+}
+
+func newReadCache(capacity int64) *readCache {
+	return &readCache{
+		capacity: capacity,
+		entries:  make(map[int]*list.Element),
+		lru:      list.New(),
+		loading:  make(map[int]bool),
+	}
+}
+
+// readInto copies the part of a cached piece at begin into buf, returning
+// false if the piece is not cached
+func (c *readCache) readInto(index, begin int, buf []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[index]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(e)
+	data := e.Value.(*cacheEntry).data
+	if begin < 0 || begin+len(buf) > len(data) {
+		return false
+	}
+	copy(buf, data[begin:])
+	return true
+}
+
+// startLoad claims a piece for reading into the cache, returning false
+// if it is cached, already being read or the cache is disabled
+func (c *readCache) startLoad(index int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, cached := c.entries[index]; cached || c.loading[index] || c.capacity <= 0 {
+		return 0, false
+	}
+	c.loading[index] = true
+	return c.generation, true
+}
+
+// finishLoad caches a piece read since startLoad, unless the read failed
+// (data is nil) or the cache was cleared in the meantime
+func (c *readCache) finishLoad(index, generation int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	delete(c.loading, index)
+	if data == nil || int64(len(data)) > c.capacity {
+		return
+	}
+
+	c.entries[index] = c.lru.PushFront(&cacheEntry{index, data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// remove drops a piece from the cache
+func (c *readCache) remove(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[index]; ok {
+		c.drop(e)
+	}
+}
+
+// clear drops every piece and abandons reads in progress
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]*list.Element)
+	c.lru.Init()
+	c.loading = make(map[int]bool)
+	c.size = 0
+	c.generation++
+}
+
+// setCapacity changes the size of the cache, evicting pieces that no
+// longer fit
+func (c *readCache) setCapacity(capacity int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+// evict drops the least recently used pieces until the cache fits (must
+// hold c.mu)
+func (c *readCache) evict() {
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		c.drop(c.lru.Back())
+	}
+}
+
+// drop removes an entry (must hold c.mu)
+func (c *readCache) drop(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.index)
+	c.size -= int64(len(entry.data))
+}
+
+// SetReadCacheSize sets how many bytes of prefetched pieces are kept in
+// memory. Zero turns prefetching off.
+func (m *Manager) SetReadCacheSize(size int64) {
+	m.cache.setCapacity(size)
+}
+
+// Prefetch reads a verified piece into the read cache in the background,
+// so uploads of its blocks do not wait for the disk. It does nothing if
+// the piece is missing, cached or already being read.
+func (m *Manager) Prefetch(index int) {
+	m.mu.RLock()
+	verified := index >= 0 && index < len(m.pieces) && m.pieces[index].State == PieceStateVerified
+	diskManager := m.diskManager
+	m.mu.RUnlock()
+
+	if !verified || diskManager == nil {
+		return
+	}
+	generation, ok := m.cache.startLoad(index)
+	if !ok {
+		return
+	}
+
+	go func() {
+		// A failed read is reported when an upload reads the block itself
+		data, err := diskManager.ReadPiece(index)
+		if err != nil {
+			m.log().Debug("Prefetch failed", "piece", index, "err", err)
+			data = nil
+		}
+		m.cache.finishLoad(index, generation, data)
+	}()
+}
@@ -0,0 +1,105 @@
+package piece
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pieceDisk serves every byte of piece i as i and counts block reads
+type pieceDisk struct {
+	hashDisk
+	mu     sync.Mutex
+	blocks int
+}
+
+func (d *pieceDisk) ReadPiece(pieceIndex int) ([]byte, error) {
+	return bytes.Repeat([]byte{byte(pieceIndex)}, 2*BlockSize), nil
+}
+
+func (d *pieceDisk) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
+	d.mu.Lock()
+	d.blocks++
+	d.mu.Unlock()
+	return bytes.Repeat([]byte{byte(pieceIndex)}, length), nil
+}
+
+func (d *pieceDisk) blockReads() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.blocks
+}
+
+func TestReadCache(t *testing.T) {
+	c := newReadCache(3 * BlockSize)
+	load := func(index int) {
+		generation, ok := c.startLoad(index)
+		if !ok {
+			t.Fatalf("startLoad(%d) refused", index)
+		}
+		c.finishLoad(index, generation, make([]byte, BlockSize))
+	}
+
+	load(0)
+	load(1)
+	if _, ok := c.startLoad(1); ok {
+		t.Error("startLoad of a cached piece succeeded")
+	}
+
+	// Using piece 0 leaves piece 1 the least recently used
+	c.readInto(0, 0, make([]byte, 1))
+	load(2)
+	load(3)
+	for index, want := range []bool{true, false, true, true} {
+		if ok := c.readInto(index, 0, make([]byte, 1)); ok != want {
+			t.Errorf("piece %d cached = %v, want %v", index, ok, want)
+		}
+	}
+
+	// A read started before a clear is not cached
+	generation, _ := c.startLoad(4)
+	c.clear()
+	c.finishLoad(4, generation, make([]byte, BlockSize))
+	if ok := c.readInto(4, 0, make([]byte, 1)); ok {
+		t.Error("piece read before clear was cached")
+	}
+
+	c.setCapacity(0)
+	if _, ok := c.startLoad(5); ok {
+		t.Error("startLoad succeeded with the cache off")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	m := newAssignTestManager()
+	disk := &pieceDisk{}
+	m.SetDiskManager(disk)
+	m.MarkPieceVerified(2)
+
+	// Missing pieces are not read
+	m.Prefetch(1)
+	m.Prefetch(2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok := m.cache.readInto(2, 0, make([]byte, 1)); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("piece 2 was not prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	data, err := m.ReadBlockFromDisk(2, BlockSize, BlockSize)
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{2}, BlockSize)) {
+		t.Errorf("ReadBlockFromDisk = %d bytes, %v, want piece 2's block", len(data), err)
+	}
+	if got := disk.blockReads(); got != 0 {
+		t.Errorf("disk block reads = %d, want 0", got)
+	}
+	if ok := m.cache.readInto(1, 0, make([]byte, 1)); ok {
+		t.Error("missing piece 1 was prefetched")
+	}
+}
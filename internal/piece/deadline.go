@@ -0,0 +1,92 @@
+package piece
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeadlineGrace is how long past its deadline a piece nobody is
+// downloading keeps it. No peer we could ask has the piece by then, so the
+// deadline is dropped rather than letting the piece hold up the rest of
+// the download.
+const DeadlineGrace = 10 * time.Second
+
+// SetDeadline asks for a missing piece by a time, e.g. because a stream is
+// about to play it. Pieces with deadlines are picked before any other, the
+// earliest first, whatever the strategy and priorities say; once its
+// deadline has passed a piece may be downloaded from several peers at
+// once. The deadline is dropped when the piece is verified.
+func (m *Manager) SetDeadline(index int, deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if index < 0 || index >= len(m.pieces) {
+		return fmt.Errorf("piece index %d out of range", index)
+	}
+	if peerHasPiece(m.bitfield, index) {
+		return nil
+	}
+	if m.deadlines == nil {
+		m.deadlines = make(map[int]time.Time)
+	}
+	m.deadlines[index] = deadline
+	return nil
+}
+
+// ClearDeadline drops a piece's deadline
+func (m *Manager) ClearDeadline(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deadlines, index)
+}
+
+// Deadline returns a piece's deadline, if it has one
+func (m *Manager) Deadline(index int) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deadline, ok := m.deadlines[index]
+	return deadline, ok
+}
+
+// expireDeadlines drops the deadlines of pieces more than DeadlineGrace
+// past them that no peer is working on, and reports them to subscribers
+// implementing DeadlineHandler. The pieces fall back to their priority.
+func (m *Manager) expireDeadlines(now time.Time) {
+	m.mu.Lock()
+	var missed []int
+	for index, deadline := range m.deadlines {
+		if now.Sub(deadline) > DeadlineGrace && len(m.assignments[index]) == 0 {
+			delete(m.deadlines, index)
+			missed = append(missed, index)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, index := range missed {
+		m.deadlineMissed(index)
+	}
+}
+
+// urgentPiece returns the piece among candidates with the earliest
+// deadline that still has blocks to request, or nil. Pieces other peers
+// own are passed over until their deadline is past, unless shared is set
+// (must hold m.mu).
+func (m *Manager) urgentPiece(candidates []byte, shared bool, now time.Time) *Piece {
+	best := -1
+	var bestDeadline time.Time
+	for index, deadline := range m.deadlines {
+		if !peerHasPiece(candidates, index) || !m.pieces[index].hasUnrequestedBlocks(m.requests) {
+			continue
+		}
+		if len(m.assignments[index]) > 0 && !shared && deadline.After(now) {
+			continue
+		}
+		if best < 0 || deadline.Before(bestDeadline) || deadline.Equal(bestDeadline) && index < best {
+			best, bestDeadline = index, deadline
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return m.pieces[best]
+}
@@ -0,0 +1,81 @@
+package piece
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+	m := newAssignTestManager()
+	all := []byte{0xf0}
+	now := time.Now()
+
+	m.SetDeadline(3, now.Add(time.Minute))
+	m.SetDeadline(2, now.Add(time.Second))
+
+	// Pieces with deadlines come first, the earliest first
+	if got, _ := m.AssignPiece("a", all, false); got != 2 {
+		t.Errorf("AssignPiece(a) = %d, want 2", got)
+	}
+	if got, _ := m.AssignPiece("b", all, false); got != 3 {
+		t.Errorf("AssignPiece(b) = %d, want 3", got)
+	}
+	if got, _ := m.AssignPiece("c", all, false); got != 0 {
+		t.Errorf("AssignPiece(c) = %d, want 0 once urgent pieces are owned", got)
+	}
+
+	// A piece past its deadline is shared while it has blocks to request
+	m.SetDeadline(3, now.Add(-time.Second))
+	if got, _ := m.AssignPiece("d", all, false); got != 3 {
+		t.Errorf("AssignPiece(d) = %d, want 3 past its deadline", got)
+	}
+	requestAll(m, 3)
+	if got, _ := m.AssignPiece("e", all, false); got == 3 {
+		t.Error("AssignPiece(e) = 3 with every block requested")
+	}
+
+	// Deadlines go once pieces are verified
+	m.MarkPieceVerified(2)
+	if _, ok := m.Deadline(2); ok {
+		t.Error("piece 2 kept its deadline once verified")
+	}
+	m.SetDeadline(2, now)
+	if _, ok := m.Deadline(2); ok {
+		t.Error("SetDeadline set a deadline for a verified piece")
+	}
+	m.ClearDeadline(3)
+	if _, ok := m.Deadline(3); ok {
+		t.Error("ClearDeadline kept the deadline")
+	}
+	if err := m.SetDeadline(4, now); err == nil {
+		t.Error("SetDeadline accepted a piece out of range")
+	}
+}
+
+func TestDeadlineMissed(t *testing.T) {
+	m := newAssignTestManager()
+	events := &recordingEvents{}
+	m.Subscribe(events)
+	now := time.Now()
+
+	// Nobody has piece 3, and piece 1 is being downloaded
+	m.SetDeadline(3, now.Add(-2*DeadlineGrace))
+	m.SetDeadline(1, now.Add(-2*DeadlineGrace))
+	m.SetDeadline(2, now)
+	m.assign(1, "a")
+
+	if got, _ := m.AssignPiece("b", []byte{0x60}, false); got != 1 {
+		t.Errorf("AssignPiece(b) = %d, want the overdue piece 1", got)
+	}
+	if len(events.missed) != 1 || events.missed[0] != 3 {
+		t.Errorf("missed = %v, want [3]", events.missed)
+	}
+	if _, ok := m.Deadline(3); ok {
+		t.Error("missed piece kept its deadline")
+	}
+	for _, index := range []int{1, 2} {
+		if _, ok := m.Deadline(index); !ok {
+			t.Errorf("piece %d lost its deadline", index)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package piece
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrHashMismatch is reported for a piece whose data failed verification
+var ErrHashMismatch = errors.New("piece hash mismatch")
+
+// DiskError is a failure to write a verified piece to storage or read a
+// block back from it, such as when the drive has gone away
+type DiskError struct {
+	Op    string // "write" or "read"
+	Piece int
+	Err   error
+}
+
+func (e *DiskError) Error() string {
+	return fmt.Sprintf("failed to %s piece %d: %v", e.Op, e.Piece, e.Err)
+}
+
+func (e *DiskError) Unwrap() error {
+	return e.Err
+}
+
+// DiskErrorHandler is implemented by event handlers that also want to
+// know about disk errors. A failed write is reported to HandlePieceFailed
+// as well, as the piece has to be downloaded again. It is called from the
+// goroutine that hit the error, so it must not block.
+type DiskErrorHandler interface {
+	HandleDiskError(err *DiskError)
+}
+
+// DeadlineHandler is implemented by event handlers that also want to know
+// when a piece's deadline is dropped because no peer could provide it in
+// time. It is called from the goroutine assigning pieces, so it must not
+// block.
+type DeadlineHandler interface {
+	HandleDeadlineMissed(index int)
+}
+
+// EventHandler is told about the outcome of each completed piece. It is
+// called from the verifying goroutine, so it must not block.
+type EventHandler interface {
+	// HandlePieceVerified is called once a piece is verified and stored
+	HandlePieceVerified(index int)
+
+	// HandlePieceFailed is called when a piece has to be downloaded
+	// again, with ErrHashMismatch or the error that stopped it being
+	// stored
+	HandlePieceFailed(index int, err error)
+
+	// HandleTorrentComplete is called once every piece is verified
+	HandleTorrentComplete()
+}
+
+// SetLogger sets the manager's logger
+func (m *Manager) SetLogger(logger *slog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = logger
+}
+
+// log returns the manager's logger
+func (m *Manager) log() *slog.Logger {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.logger
+}
+
+// Subscribe adds a handler for piece events
+func (m *Manager) Subscribe(handler EventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Unsubscribe removes a handler added with Subscribe
+func (m *Manager) Unsubscribe(handler EventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	handlers := make([]EventHandler, 0, len(m.handlers))
+	for _, h := range m.handlers {
+		if h != handler {
+			handlers = append(handlers, h)
+		}
+	}
+	m.handlers = handlers
+}
+
+// subscribers returns the current event handlers
+func (m *Manager) subscribers() []EventHandler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.handlers
+}
+
+// pieceVerified notifies subscribers that a piece is verified and stored,
+// and that the torrent is complete if it was the last one
+func (m *Manager) pieceVerified(index int) {
+	for _, handler := range m.subscribers() {
+		handler.HandlePieceVerified(index)
+	}
+
+	m.mu.Lock()
+	done := !m.completed && m.allVerified()
+	if done {
+		m.completed = true
+	}
+	m.mu.Unlock()
+
+	if done {
+		for _, handler := range m.subscribers() {
+			handler.HandleTorrentComplete()
+		}
+	}
+}
+
+// pieceFailed notifies subscribers that a piece has to start over
+func (m *Manager) pieceFailed(index int, err error) {
+	m.log().Warn("Piece failed", "piece", index, "err", err)
+	for _, handler := range m.subscribers() {
+		handler.HandlePieceFailed(index, err)
+	}
+}
+
+// diskFailed notifies subscribers that implement DiskErrorHandler of a
+// disk error
+func (m *Manager) diskFailed(err *DiskError) {
+	m.log().Error("Disk error", "piece", err.Piece, "op", err.Op, "err", err.Err)
+	for _, handler := range m.subscribers() {
+		if h, ok := handler.(DiskErrorHandler); ok {
+			h.HandleDiskError(err)
+		}
+	}
+}
+
+// deadlineMissed notifies subscribers that implement DeadlineHandler that
+// a piece's deadline was dropped
+func (m *Manager) deadlineMissed(index int) {
+	m.log().Info("Piece deadline missed, no peer has it", "piece", index)
+	for _, handler := range m.subscribers() {
+		if h, ok := handler.(DeadlineHandler); ok {
+			h.HandleDeadlineMissed(index)
+		}
+	}
+}
+
+// allVerified returns true if every piece is verified (must hold m.mu)
+func (m *Manager) allVerified() bool {
+	for _, piece := range m.pieces {
+		if !piece.isVerified() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package piece
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// recordingEvents records the piece events a manager reports
+type recordingEvents struct {
+	verified   []int
+	failed     []error
+	complete   int
+	diskErrors []*DiskError
+	missed     []int
+}
+
+func (r *recordingEvents) HandlePieceVerified(index int) {
+	r.verified = append(r.verified, index)
+}
+
+func (r *recordingEvents) HandlePieceFailed(index int, err error) {
+	r.failed = append(r.failed, err)
+}
+
+func (r *recordingEvents) HandleTorrentComplete() {
+	r.complete++
+}
+
+func (r *recordingEvents) HandleDiskError(err *DiskError) {
+	r.diskErrors = append(r.diskErrors, err)
+}
+
+func (r *recordingEvents) HandleDeadlineMissed(index int) {
+	r.missed = append(r.missed, index)
+}
+
+// failingDisk verifies like hashDisk but cannot write or read
+type failingDisk struct {
+	hashDisk
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (d *failingDisk) WritePiece(pieceIndex int, data []byte) error { return errDiskFull }
+
+func (d *failingDisk) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
+	return nil, errDiskFull
+}
+
+func TestPieceEvents(t *testing.T) {
+	good := make([]byte, 2*BlockSize)
+	m, _ := newBanTestManager(good)
+
+	events := &recordingEvents{}
+	m.Subscribe(events)
+
+	// A corrupt attempt is reported as a failure
+	attempt(m, bytes.Repeat([]byte{1}, 2*BlockSize), [2]string{"a", "b"})
+	if len(events.verified) != 0 {
+		t.Errorf("verified = %v after a hash failure, want none", events.verified)
+	}
+	if len(events.failed) != 1 || !errors.Is(events.failed[0], ErrHashMismatch) {
+		t.Errorf("failed = %v, want one hash mismatch", events.failed)
+	}
+
+	attempt(m, good, [2]string{"a", "b"})
+	if len(events.verified) != 1 || events.verified[0] != 0 {
+		t.Errorf("verified = %v, want [0]", events.verified)
+	}
+	if events.complete != 1 {
+		t.Errorf("complete reported %d times, want 1", events.complete)
+	}
+
+	// Marking it again changes nothing
+	m.MarkPieceVerified(0)
+	if stats := m.GetStatistics(); stats.VerifiedPieces != 1 {
+		t.Errorf("VerifiedPieces = %d, want 1", stats.VerifiedPieces)
+	}
+	if len(events.verified) != 1 || events.complete != 1 {
+		t.Errorf("re-marking reported verified = %v, complete = %d", events.verified, events.complete)
+	}
+}
+
+func TestPieceWriteFailure(t *testing.T) {
+	good := make([]byte, 2*BlockSize)
+	m, _ := newBanTestManager(good)
+	m.SetDiskManager(&failingDisk{*m.diskManager.(*hashDisk)})
+
+	events := &recordingEvents{}
+	m.Subscribe(events)
+	attempt(m, good, [2]string{"a", "b"})
+
+	if len(events.failed) != 1 || !errors.Is(events.failed[0], errDiskFull) {
+		t.Errorf("failed = %v, want the write error", events.failed)
+	}
+	var diskErr *DiskError
+	if len(events.failed) == 1 && (!errors.As(events.failed[0], &diskErr) || diskErr.Op != "write") {
+		t.Errorf("failed = %v, want a *DiskError writing", events.failed[0])
+	}
+	if len(events.diskErrors) != 1 || events.diskErrors[0].Piece != 0 {
+		t.Errorf("disk errors = %v, want one for piece 0", events.diskErrors)
+	}
+	if len(events.verified) != 0 || events.complete != 0 {
+		t.Errorf("verified = %v, complete = %d, want neither", events.verified, events.complete)
+	}
+
+	// The piece is downloaded again
+	piece := m.GetPiece(0)
+	if piece.State != PieceStateMissing || len(piece.GetMissingBlocks()) != 2 {
+		t.Errorf("piece state = %v with %d missing blocks, want missing with 2", piece.State, len(piece.GetMissingBlocks()))
+	}
+}
+
+func TestPieceReadFailure(t *testing.T) {
+	m := NewManager(2, BlockSize, BlockSize, make([][20]byte, 2))
+	m.SetDiskManager(&failingDisk{})
+	events := &recordingEvents{}
+	m.Subscribe(events)
+	m.MarkPieceVerified(0)
+
+	_, err := m.ReadBlockFromDisk(0, 0, BlockSize)
+	var diskErr *DiskError
+	if !errors.As(err, &diskErr) || diskErr.Op != "read" || !errors.Is(err, errDiskFull) {
+		t.Errorf("ReadBlockFromDisk error = %v, want a *DiskError reading", err)
+	}
+	if len(events.diskErrors) != 1 {
+		t.Errorf("disk errors = %v, want one", events.diskErrors)
+	}
+
+	// Bad requests are not disk errors
+	for _, r := range [][3]int{{1, 0, BlockSize}, {0, BlockSize, 1}, {0, -1, 2}, {2, 0, 1}} {
+		if _, err := m.ReadBlockFromDisk(r[0], r[1], r[2]); err == nil || errors.As(err, &diskErr) {
+			t.Errorf("ReadBlockFromDisk%v error = %v, want a request error", r, err)
+		}
+	}
+	if len(events.diskErrors) != 1 {
+		t.Errorf("bad requests reported as disk errors: %v", events.diskErrors)
+	}
+}
+
+func TestMarkPieceVerifiedNotifies(t *testing.T) {
+	m := NewManager(2, BlockSize, BlockSize, make([][20]byte, 2))
+	events := &recordingEvents{}
+	m.Subscribe(events)
+
+	// Pieces found on disk are announced like downloaded ones
+	m.MarkPieceVerified(1)
+	if len(events.verified) != 1 || events.verified[0] != 1 {
+		t.Errorf("verified = %v, want [1]", events.verified)
+	}
+	if events.complete != 0 {
+		t.Errorf("complete reported with a piece missing")
+	}
+
+	m.MarkPieceVerified(0)
+	if events.complete != 1 {
+		t.Errorf("complete reported %d times, want 1", events.complete)
+	}
+}
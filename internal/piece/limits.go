@@ -0,0 +1,84 @@
+package piece
+
+import "errors"
+
+// ErrPartialLimit is returned by AssignPiece when starting a piece would go
+// over the limits set with SetPartialLimits. The peer is to finish the
+// pieces already started first.
+var ErrPartialLimit = errors.New("partial piece limit reached")
+
+// SetPartialLimits bounds the pieces downloaded at once, those assigned to
+// peers or with blocks held in memory, and the bytes of block data held
+// for them; 0 is no limit. Once either limit is reached AssignPiece only
+// hands out pieces already started, so that a flaky swarm cannot leave
+// half-downloaded pieces piling up.
+func (m *Manager) SetPartialLimits(pieces int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxPartialPieces = pieces
+	m.maxPartialBytes = bytes
+}
+
+// PartialPieces returns the number of pieces being downloaded and the
+// bytes of block data held for them
+func (m *Manager) PartialPieces() (pieces int, bytes int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.startedPieces()), m.partialBytes()
+}
+
+// partialLimited returns true if no piece may be started now (must hold
+// m.mu)
+func (m *Manager) partialLimited() bool {
+	if m.maxPartialPieces > 0 && len(m.startedPieces()) >= m.maxPartialPieces {
+		return true
+	}
+	return m.maxPartialBytes > 0 && m.partialBytes() >= m.maxPartialBytes
+}
+
+// startedPieces returns the pieces assigned to a peer or with blocks held
+// (must hold m.mu)
+func (m *Manager) startedPieces() map[int]bool {
+	started := make(map[int]bool, len(m.assignments)+len(m.partial))
+	for index := range m.assignments {
+		started[index] = true
+	}
+	for index := range m.partial {
+		started[index] = true
+	}
+	return started
+}
+
+// partialBytes returns the bytes of block data held for pieces not yet
+// verified (must hold m.mu)
+func (m *Manager) partialBytes() int64 {
+	var n int64
+	for index := range m.partial {
+		n += m.pieces[index].heldBytes()
+	}
+	return n
+}
+
+// maskStarted returns the pieces of candidates that are already started
+// (must hold m.mu)
+func (m *Manager) maskStarted(candidates []byte) []byte {
+	masked := make([]byte, len(candidates))
+	for index := range m.startedPieces() {
+		if peerHasPiece(candidates, index) {
+			masked[index/8] |= 1 << (7 - index%8)
+		}
+	}
+	return masked
+}
+
+// heldBytes returns the bytes of block data the piece holds
+func (p *Piece) heldBytes() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var n int64
+	for _, block := range p.Blocks {
+		n += int64(len(block.Data))
+	}
+	return n
+}
@@ -0,0 +1,38 @@
+package piece
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPartialLimits(t *testing.T) {
+	m := newAssignTestManager()
+	all := []byte{0xf0}
+	m.SetPartialLimits(1, 0)
+
+	if index, err := m.AssignPiece("a", all, false); err != nil || index != 0 {
+		t.Fatalf("AssignPiece(a) = %d, %v, want 0", index, err)
+	}
+	if _, err := m.AssignPiece("b", all, false); !errors.Is(err, ErrPartialLimit) {
+		t.Errorf("AssignPiece(b) = %v, want ErrPartialLimit", err)
+	}
+
+	// A started piece its peer left is handed to the next one
+	m.AddBlockData(0, 0, make([]byte, BlockSize))
+	m.UnassignPeer("a")
+	if index, err := m.AssignPiece("b", all, false); err != nil || index != 0 {
+		t.Errorf("AssignPiece(b) = %d, %v, want the started piece 0", index, err)
+	}
+	if pieces, bytes := m.PartialPieces(); pieces != 1 || bytes != BlockSize {
+		t.Errorf("PartialPieces = %d, %d, want 1, %d", pieces, bytes, BlockSize)
+	}
+
+	m.SetPartialLimits(0, BlockSize)
+	if _, err := m.AssignPiece("c", all, false); !errors.Is(err, ErrPartialLimit) {
+		t.Errorf("AssignPiece(c) at the byte limit = %v, want ErrPartialLimit", err)
+	}
+	m.SetPartialLimits(0, 0)
+	if index, err := m.AssignPiece("c", all, false); err != nil || index == 0 {
+		t.Errorf("AssignPiece(c) without limits = %d, %v, want a new piece", index, err)
+	}
+}
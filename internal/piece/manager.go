@@ -1,7 +1,10 @@
 package piece
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"sync"
 	"time"
 )
@@ -12,9 +15,6 @@ const (
 
 	// MaxRequestsPerPeer is the maximum number of outstanding requests per peer
 	MaxRequestsPerPeer = 5
-
-	// RequestTimeout is how long to wait for a block before re-requesting
-	RequestTimeout = 30 * time.Second
 )
 
 // PieceState represents the state of a piece
@@ -45,29 +45,44 @@ func (ps PieceState) String() string {
 
 // Block represents a block within a piece
 type Block struct {
-	Index       int       // Piece index
-	Begin       int       // Offset within piece
-	Length      int       // Block length
-	Data        []byte    // Block data (nil if not downloaded)
-	RequestedAt time.Time // When this block was requested
+	Index  int    // Piece index
+	Begin  int    // Offset within piece
+	Length int    // Block length
+	Data   []byte // Block data (nil if not downloaded)
+	Source string // Peer that supplied the data
+	
+	release func() // returns Data's buffer to its owner
 }
 
-// Request represents a pending block request
-type Request struct {
-	Block     Block
-	PeerID    string
-	Timestamp time.Time
+// releaseData drops the block's data, returning a borrowed buffer
+func (b *Block) releaseData() {
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+	b.Data = nil
 }
 
-// Piece represents a piece and its blocks
+// Piece represents a piece and its blocks. Whether a block has arrived is
+// kept apart from its data, which may be dropped once written out. Its
+// lock guards State, Blocks and that record and is only ever taken by
+// Piece's own methods. A caller holding the manager's lock as well takes
+// it first. States change with both locks held, so code holding either
+// may read State.
 type Piece struct {
 	Index    int
 	Length   int
 	Hash     [20]byte
 	State    PieceState
 	Blocks   []Block
-	Requests map[string]Request // PeerID -> Request
 	mu       sync.RWMutex
+	
+	// Blocks that have arrived, one bit each as in a bitfield, and how many
+	done       []byte
+	doneBlocks int
+	
+	// Arrived blocks Snapshot has written to disk, one bit each
+	stored []byte
 }
 
 // NewPiece creates a new piece
@@ -99,21 +114,17 @@ func NewPiece(index, length int, hash [20]byte) *Piece {
 		Hash:     hash,
 		State:    PieceStateMissing,
 		Blocks:   blocks,
-		Requests: make(map[string]Request),
+		done:     make([]byte, (numBlocks+7)/8),
 	}
 }
 
-// IsComplete returns true if all blocks have been downloaded
+// IsComplete returns true if all blocks have been downloaded, whether or
+// not their data is still held
 func (p *Piece) IsComplete() bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	for _, block := range p.Blocks {
-		if block.Data == nil {
-			return false
-		}
-	}
-	return true
+	return p.allBlocksDone()
 }
 
 // GetMissingBlocks returns blocks that haven't been downloaded
@@ -122,50 +133,35 @@ func (p *Piece) GetMissingBlocks() []Block {
 	defer p.mu.RUnlock()
 	
 	var missing []Block
-	for _, block := range p.Blocks {
-		if block.Data == nil {
+	if p.State == PieceStateVerified {
+		return missing
+	}
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) {
 			missing = append(missing, block)
 		}
 	}
 	return missing
 }
 
-// GetPendingBlocks returns blocks that are currently being requested
-func (p *Piece) GetPendingBlocks() []Request {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	
-	var pending []Request
-	for _, req := range p.Requests {
-		pending = append(pending, req)
-	}
-	return pending
-}
-
-// AddRequest adds a pending request for a block
-func (p *Piece) AddRequest(peerID string, block Block) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	
-	key := fmt.Sprintf("%s-%d-%d", peerID, block.Begin, block.Length)
-	p.Requests[key] = Request{
-		Block:     block,
-		PeerID:    peerID,
-		Timestamp: time.Now(),
-	}
+// SetBlockData sets the data for a specific block
+func (p *Piece) SetBlockData(begin int, data []byte) error {
+	return p.SetBlockDataFrom(begin, data, "")
 }
 
-// RemoveRequest removes a pending request
-func (p *Piece) RemoveRequest(peerID string, begin, length int) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	
-	key := fmt.Sprintf("%s-%d-%d", peerID, begin, length)
-	delete(p.Requests, key)
+// SetBlockDataFrom sets the data for a block and records the peer that
+// supplied it
+func (p *Piece) SetBlockDataFrom(begin int, data []byte, source string) error {
+	// Create a copy of the data
+	blockData := make([]byte, len(data))
+	copy(blockData, data)
+	return p.SetBlockBufferFrom(begin, blockData, nil, source)
 }
 
-// SetBlockData sets the data for a specific block
-func (p *Piece) SetBlockData(begin int, data []byte) error {
+// SetBlockBufferFrom sets the data for a block without copying it. The
+// piece owns data from then on and calls release, if not nil, once it no
+// longer needs it, including when the block is rejected.
+func (p *Piece) SetBlockBufferFrom(begin int, data []byte, release func(), source string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	
@@ -173,49 +169,84 @@ func (p *Piece) SetBlockData(begin int, data []byte) error {
 	for i, block := range p.Blocks {
 		if block.Begin == begin {
 			if len(data) != block.Length {
+				if release != nil {
+					release()
+				}
 				return fmt.Errorf("block data length mismatch: got %d, expected %d", len(data), block.Length)
 			}
 			
-			// Create a copy of the data
-			blockData := make([]byte, len(data))
-			copy(blockData, data)
-			p.Blocks[i].Data = blockData
-			
-			// Remove any pending requests for this block
-			var toDelete []string
-			for key, req := range p.Requests {
-				if req.Block.Begin == begin {
-					toDelete = append(toDelete, key)
+			// Keep the first copy of a block; the piece may already be
+			// hashing it
+			if p.blockDone(i) || p.State == PieceStateVerified {
+				if release != nil {
+					release()
 				}
+				return fmt.Errorf("%w: %d:%d", ErrDuplicateBlock, p.Index, begin)
 			}
-			for _, key := range toDelete {
-				delete(p.Requests, key)
-			}
+			
+			p.Blocks[i].Data = data
+			p.Blocks[i].release = release
+			p.Blocks[i].Source = source
+			p.setBlockDone(i)
 			
 			return nil
 		}
 	}
 	
+	if release != nil {
+		release()
+	}
 	return fmt.Errorf("block with begin offset %d not found", begin)
 }
 
+// releaseBlocks drops the data of every block (must hold lock)
+func (p *Piece) releaseBlocks() {
+	for i := range p.Blocks {
+		p.Blocks[i].releaseData()
+		p.Blocks[i].Source = ""
+	}
+}
+
 // GetData returns the complete piece data if all blocks are available
 func (p *Piece) GetData() ([]byte, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if !p.IsComplete() {
-		return nil, fmt.Errorf("piece %d is not complete", p.Index)
-	}
-	
 	data := make([]byte, 0, p.Length)
 	for _, block := range p.Blocks {
+		if block.Data == nil {
+			return nil, fmt.Errorf("piece %d is not complete", p.Index)
+		}
 		data = append(data, block.Data...)
 	}
 	
 	return data, nil
 }
 
+// WriteTo writes the complete piece to w block by block, straight from the
+// block buffers, so it can be hashed or stored without joining the blocks
+// into one buffer first. It implements io.WriterTo.
+func (p *Piece) WriteTo(w io.Writer) (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	for _, block := range p.Blocks {
+		if block.Data == nil {
+			return 0, fmt.Errorf("piece %d is not complete", p.Index)
+		}
+	}
+	
+	var written int64
+	for _, block := range p.Blocks {
+		n, err := w.Write(block.Data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 // Manager manages all pieces for a torrent
 type Manager struct {
 	mu       sync.RWMutex
@@ -228,6 +259,47 @@ type Manager struct {
 	
 	// Disk manager for I/O operations
 	diskManager DiskManager
+	
+	// Smart ban state
+	banHandler BanHandler
+	banMu      sync.Mutex
+	failures   map[int]*failureHistory
+	
+	// Subscribers to piece events, and whether completion was reported
+	handlers  []EventHandler
+	completed bool
+	
+	logger *slog.Logger
+	
+	// Peers working on each piece, by piece index
+	assignments map[int]map[string]bool
+	
+	// Piece priorities by index, nil if every piece is normal
+	priorities []Priority
+
+	// Deadlines of missing pieces set with SetDeadline
+	deadlines map[int]time.Time
+
+	// Blocks requested from peers
+	requests *Requests
+
+	// Pieces with blocks held in memory until they are verified or reset,
+	// and the limits set with SetPartialLimits
+	partial          map[int]bool
+	maxPartialPieces int
+	maxPartialBytes  int64
+
+	// Pieces each connected peer has, and how many peers have each piece
+	// besides the seeds, which are counted apart
+	peerPieces   map[string][]byte
+	availability []int
+	seeds        map[string]bool
+	
+	// Completed pieces being verified and written
+	pending sync.WaitGroup
+
+	// Pieces read ahead for uploads
+	cache *readCache
 }
 
 // DiskManager interface for disk I/O operations
@@ -238,37 +310,48 @@ type DiskManager interface {
 	VerifyPiece(pieceIndex int, data []byte) bool
 }
 
+// StreamingDiskManager is implemented by disk managers that can hash and
+// store a piece as it is written to them by src, a *Piece. Completed
+// pieces are then verified and stored from their block buffers rather
+// than from a copy of the whole piece.
+type StreamingDiskManager interface {
+	VerifyPieceFrom(pieceIndex int, src io.WriterTo) bool
+	WritePieceFrom(pieceIndex int, src io.WriterTo) error
+}
+
+// DirectReadDiskManager is implemented by disk managers that can read a
+// block into the caller's buffer, which saves uploads a copy of each block
+type DirectReadDiskManager interface {
+	ReadBlockInto(pieceIndex, begin int, buf []byte) error
+}
+
+// BlockDiskManager is implemented by disk managers that can store a block
+// before its piece is complete. Snapshots then keep the blocks of partial
+// pieces on disk rather than in the snapshot.
+type BlockDiskManager interface {
+	WriteBlock(pieceIndex, begin int, data []byte) error
+}
+
 // Statistics contains download statistics
 type Statistics struct {
 	mu                 sync.RWMutex
 	TotalPieces        int
 	CompletedPieces    int
 	VerifiedPieces     int
-	ActiveRequests     int
 	BytesDownloaded    int64
 	BytesVerified      int64
-	DownloadSpeed      float64 // bytes per second
-	lastUpdate         time.Time
-	lastBytesDownloaded int64
+	HashFailures       int
+	
+	// Bytes received and thrown away: duplicate blocks and the pieces that
+	// failed verification
+	BytesWasted int64
 }
 
-// NewManager creates a new piece manager
+// NewManager creates a new piece manager. A manager for a torrent whose
+// metadata is not known yet is created with no pieces and given them
+// later with SetMetadata.
 func NewManager(numPieces int, pieceLength int, lastPieceLength int, pieceHashes [][20]byte) *Manager {
-	pieces := make([]*Piece, numPieces)
-	
-	for i := 0; i < numPieces; i++ {
-		length := pieceLength
-		if i == numPieces-1 && lastPieceLength > 0 {
-			length = lastPieceLength
-		}
-		
-		var hash [20]byte
-		if i < len(pieceHashes) {
-			hash = pieceHashes[i]
-		}
-		
-		pieces[i] = NewPiece(i, length, hash)
-	}
+	pieces := newPieces(numPieces, pieceLength, lastPieceLength, pieceHashes)
 	
 	// Initialize bitfield (all pieces missing)
 	bitfieldSize := (numPieces + 7) / 8
@@ -278,9 +361,17 @@ func NewManager(numPieces int, pieceLength int, lastPieceLength int, pieceHashes
 		pieces:   pieces,
 		bitfield: bitfield,
 		strategy: NewSequentialStrategy(), // Default strategy
+		failures: make(map[int]*failureHistory),
+		assignments: make(map[int]map[string]bool),
+		peerPieces: make(map[string][]byte),
+		availability: make([]int, numPieces),
+		seeds: make(map[string]bool),
+		requests: NewRequests(),
+		partial: make(map[int]bool),
+		cache:    newReadCache(DefaultReadCacheSize),
+		logger:   slog.Default(),
 		stats: Statistics{
 			TotalPieces: numPieces,
-			lastUpdate:  time.Now(),
 		},
 	}
 }
@@ -292,11 +383,53 @@ func (m *Manager) SetSelectionStrategy(strategy SelectionStrategy) {
 	m.strategy = strategy
 }
 
+// peerTracker returns the strategy if it tracks peer pieces
+func (m *Manager) peerTracker() PeerTracker {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tracker, _ := m.strategy.(PeerTracker)
+	return tracker
+}
+
+// UpdatePeerBitfield tells the strategy which pieces a peer has
+func (m *Manager) UpdatePeerBitfield(peerID string, bitfield []byte) {
+	m.setPeerPieces(peerID, bitfield)
+	if tracker := m.peerTracker(); tracker != nil {
+		tracker.UpdatePeerBitfield(peerID, bitfield)
+	}
+}
+
+// PeerHave tells the strategy that a peer announced a piece
+func (m *Manager) PeerHave(peerID string, index int) {
+	if !m.addPeerPiece(peerID, index) {
+		return
+	}
+	if tracker := m.peerTracker(); tracker != nil {
+		tracker.PeerHave(peerID, index)
+	}
+}
+
+// RemovePeer tells the strategy that a peer is gone
+func (m *Manager) RemovePeer(peerID string) {
+	m.setPeerPieces(peerID, nil)
+	if tracker := m.peerTracker(); tracker != nil {
+		tracker.RemovePeer(peerID)
+	}
+}
+
+// SetBanHandler sets the handler told about peers that sent corrupt data
+func (m *Manager) SetBanHandler(banHandler BanHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.banHandler = banHandler
+}
+
 // SetDiskManager sets the disk manager for I/O operations
 func (m *Manager) SetDiskManager(diskManager DiskManager) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.diskManager = diskManager
+	m.cache.clear()
 }
 
 // GetBitfield returns a copy of the current bitfield
@@ -363,50 +496,109 @@ func (m *Manager) GetNextBlocks(pieceIndex int, maxBlocks int) []Block {
 
 // AddBlockData adds block data for a piece
 func (m *Manager) AddBlockData(pieceIndex, begin int, data []byte) error {
+	return m.AddBlockDataFrom(pieceIndex, begin, data, "")
+}
+
+// AddBlockDataFrom adds block data for a piece, remembering which peer
+// sent it so the peer can be banned if the piece turns out corrupt
+func (m *Manager) AddBlockDataFrom(pieceIndex, begin int, data []byte, source string) error {
+	blockData := make([]byte, len(data))
+	copy(blockData, data)
+	return m.AddBlockBuffer(pieceIndex, begin, blockData, nil, source)
+}
+
+// AddBlockBuffer adds block data like AddBlockDataFrom, but takes ownership
+// of data instead of copying it. release, if not nil, is called once the
+// piece has been written to disk or the data is discarded, whether or not
+// an error is returned.
+func (m *Manager) AddBlockBuffer(pieceIndex, begin int, data []byte, release func(), source string) error {
 	m.mu.RLock()
-	piece := m.pieces[pieceIndex]
+	var piece *Piece
+	if pieceIndex >= 0 && pieceIndex < len(m.pieces) {
+		piece = m.pieces[pieceIndex]
+	}
 	m.mu.RUnlock()
 	
 	if piece == nil {
+		if release != nil {
+			release()
+		}
 		return fmt.Errorf("piece %d not found", pieceIndex)
 	}
 	
-	err := piece.SetBlockData(begin, data)
+	err := piece.SetBlockBufferFrom(begin, data, release, source)
+	if errors.Is(err, ErrDuplicateBlock) {
+		m.wasted(map[string]int64{source: int64(len(data))})
+	}
 	if err != nil {
 		return err
 	}
+	m.requests.touchPiece(pieceIndex)
+	m.cancelOthers(pieceIndex, begin, source)
 	
 	// Update statistics
 	m.stats.mu.Lock()
 	m.stats.BytesDownloaded += int64(len(data))
 	m.stats.mu.Unlock()
 	
-	// Check if piece is complete
-	if piece.IsComplete() {
-		piece.mu.Lock()
-		piece.State = PieceStateDownloaded
-		piece.mu.Unlock()
-		
+	m.checkDownloaded(pieceIndex, piece)
+	return nil
+}
+
+// checkDownloaded records a piece a block has arrived for as partial, and
+// starts verifying and storing it once its last block has arrived
+func (m *Manager) checkDownloaded(pieceIndex int, piece *Piece) {
+	m.mu.Lock()
+	m.partial[pieceIndex] = true
+	downloaded := piece.markDownloaded()
+	m.mu.Unlock()
+	if downloaded {
 		// Try to verify and store the piece
-		go m.verifyAndStorePiece(pieceIndex)
+		m.pending.Add(1)
+		go func() {
+			defer m.pending.Done()
+			m.verifyAndStorePiece(pieceIndex)
+		}()
+	}
+}
+
+// Wait blocks until every completed piece has been verified and, if good,
+// written to disk. Call it once no more blocks can arrive.
+func (m *Manager) Wait() {
+	m.pending.Wait()
+}
+
+// MarkPieceVerified marks a piece as verified and updates the bitfield.
+// Subscribers are notified the first time a piece is marked, so peers
+// learn about it whether it was downloaded or found on disk.
+func (m *Manager) MarkPieceVerified(index int) error {
+	marked, err := m.markVerified(index)
+	if err != nil || !marked {
+		return err
 	}
 	
+	m.unassignPiece(index)
+	m.pieceVerified(index)
 	return nil
 }
 
-// MarkPieceVerified marks a piece as verified and updates the bitfield
-func (m *Manager) MarkPieceVerified(index int) error {
+// markVerified records a piece as verified, returning false if it already
+// was. The piece is served from disk from now on, so its blocks are dropped.
+func (m *Manager) markVerified(index int) (bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
 	if index < 0 || index >= len(m.pieces) {
-		return fmt.Errorf("piece index %d out of range", index)
+		return false, fmt.Errorf("piece index %d out of range", index)
 	}
 	
 	piece := m.pieces[index]
-	piece.mu.Lock()
-	piece.State = PieceStateVerified
-	piece.mu.Unlock()
+	if !piece.markVerified() {
+		return false, nil
+	}
+	delete(m.deadlines, index)
+	delete(m.partial, index)
+	m.requests.touchPiece(index)
 	
 	// Update bitfield
 	byteIndex := index / 8
@@ -422,34 +614,24 @@ func (m *Manager) MarkPieceVerified(index int) error {
 	m.stats.BytesVerified += int64(piece.Length)
 	m.stats.mu.Unlock()
 	
-	return nil
+	return true, nil
 }
 
-// GetStatistics returns current download statistics
+// GetStatistics returns the piece counters. Transfer rates are computed
+// by the stats package from periodic samples of these counters.
 func (m *Manager) GetStatistics() Statistics {
-	m.stats.mu.Lock()
-	defer m.stats.mu.Unlock()
-	
-	// Update download speed
-	now := time.Now()
-	if now.Sub(m.stats.lastUpdate) >= time.Second {
-		duration := now.Sub(m.stats.lastUpdate).Seconds()
-		bytesDiff := m.stats.BytesDownloaded - m.stats.lastBytesDownloaded
-		m.stats.DownloadSpeed = float64(bytesDiff) / duration
-		
-		m.stats.lastUpdate = now
-		m.stats.lastBytesDownloaded = m.stats.BytesDownloaded
-	}
+	m.stats.mu.RLock()
+	defer m.stats.mu.RUnlock()
 	
 	// Return a copy
 	return Statistics{
 		TotalPieces:        m.stats.TotalPieces,
 		CompletedPieces:    m.stats.CompletedPieces,
 		VerifiedPieces:     m.stats.VerifiedPieces,
-		ActiveRequests:     m.stats.ActiveRequests,
 		BytesDownloaded:    m.stats.BytesDownloaded,
 		BytesVerified:      m.stats.BytesVerified,
-		DownloadSpeed:      m.stats.DownloadSpeed,
+		HashFailures:       m.stats.HashFailures,
+		BytesWasted:        m.stats.BytesWasted,
 	}
 }
 
@@ -462,10 +644,11 @@ func (m *Manager) GetProgress() float64 {
 	return float64(stats.VerifiedPieces) / float64(stats.TotalPieces) * 100.0
 }
 
-// IsComplete returns true if all pieces have been verified
+// IsComplete returns true if all pieces have been verified. A manager
+// without metadata is not complete.
 func (m *Manager) IsComplete() bool {
 	stats := m.GetStatistics()
-	return stats.VerifiedPieces == stats.TotalPieces
+	return stats.TotalPieces > 0 && stats.VerifiedPieces == stats.TotalPieces
 }
 
 // GetMissingPieces returns indices of pieces we don't have
@@ -483,76 +666,6 @@ func (m *Manager) GetMissingPieces() []int {
 	return missing
 }
 
-// GetTimeoutRequests returns requests that have timed out
-func (m *Manager) GetTimeoutRequests() []Request {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	now := time.Now()
-	var timeouts []Request
-	
-	for _, piece := range m.pieces {
-		piece.mu.RLock()
-		for _, req := range piece.Requests {
-			if now.Sub(req.Timestamp) > RequestTimeout {
-				timeouts = append(timeouts, req)
-			}
-		}
-		piece.mu.RUnlock()
-	}
-	
-	return timeouts
-}
-
-// CancelRequest cancels a pending request
-func (m *Manager) CancelRequest(pieceIndex int, peerID string, begin, length int) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
-		return
-	}
-	
-	piece := m.pieces[pieceIndex]
-	piece.RemoveRequest(peerID, begin, length)
-}
-
-// AddRequest adds a pending request
-func (m *Manager) AddRequest(pieceIndex int, peerID string, block Block) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
-		return
-	}
-	
-	piece := m.pieces[pieceIndex]
-	piece.AddRequest(peerID, block)
-	
-	m.stats.mu.Lock()
-	m.stats.ActiveRequests++
-	m.stats.mu.Unlock()
-}
-
-// RemoveRequest removes a pending request
-func (m *Manager) RemoveRequest(pieceIndex int, peerID string, begin, length int) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
-		return
-	}
-	
-	piece := m.pieces[pieceIndex]
-	piece.RemoveRequest(peerID, begin, length)
-	
-	m.stats.mu.Lock()
-	if m.stats.ActiveRequests > 0 {
-		m.stats.ActiveRequests--
-	}
-	m.stats.mu.Unlock()
-}
-
 // GetPieceInfo returns information about all pieces
 func (m *Manager) GetPieceInfo() []PieceInfo {
 	m.mu.RLock()
@@ -560,16 +673,7 @@ func (m *Manager) GetPieceInfo() []PieceInfo {
 	
 	info := make([]PieceInfo, len(m.pieces))
 	for i, piece := range m.pieces {
-		piece.mu.RLock()
-		info[i] = PieceInfo{
-			Index:         piece.Index,
-			Length:        piece.Length,
-			State:         piece.State,
-			BlocksTotal:   len(piece.Blocks),
-			BlocksMissing: len(piece.GetMissingBlocks()),
-			PendingRequests: len(piece.Requests),
-		}
-		piece.mu.RUnlock()
+		info[i] = piece.info(m.requests)
 	}
 	
 	return info
@@ -586,28 +690,63 @@ func (m *Manager) verifyAndStorePiece(pieceIndex int) {
 		return
 	}
 	
-	// Get the complete piece data
-	data, err := piece.GetData()
+	// Get the complete piece data, unless the disk manager can take it
+	// straight from the blocks
+	streaming, _ := diskManager.(StreamingDiskManager)
+	var data []byte
+	var err error
+	if streaming == nil {
+		data, err = piece.GetData()
+	} else if !piece.IsComplete() {
+		err = fmt.Errorf("piece %d is not complete", pieceIndex)
+	}
 	if err != nil {
+		m.resetPiece(piece)
+		m.pieceFailed(pieceIndex, err)
 		return
 	}
 	
+	// Snapshot the blocks so their senders can be judged
+	blocks := piece.snapshotBlocks()
+	
 	// Verify the piece hash
-	if !diskManager.VerifyPiece(pieceIndex, data) {
+	var valid bool
+	if streaming != nil {
+		valid = streaming.VerifyPieceFrom(pieceIndex, piece)
+	} else {
+		valid = diskManager.VerifyPiece(pieceIndex, data)
+	}
+	if !valid {
+		// Judge the blocks before their buffers are released
+		banned := m.recordFailure(pieceIndex, blocks)
+		
 		// Hash verification failed, reset piece to missing
-		piece.mu.Lock()
-		piece.State = PieceStateMissing
-		// Clear all block data
-		for i := range piece.Blocks {
-			piece.Blocks[i].Data = nil
-		}
-		piece.mu.Unlock()
+		m.resetPiece(piece)
+		
+		m.stats.mu.Lock()
+		m.stats.HashFailures++
+		m.stats.mu.Unlock()
+		m.wasted(blockSources(blocks))
+		
+		m.banPeers(banned)
+		m.pieceFailed(pieceIndex, ErrHashMismatch)
 		return
 	}
 	
+	// Peers whose blocks differ from the good copy sent corrupt data
+	m.banPeers(m.resolveFailures(pieceIndex, blocks))
+	
 	// Write piece to disk
-	err = diskManager.WritePiece(pieceIndex, data)
+	if streaming != nil {
+		err = streaming.WritePieceFrom(pieceIndex, piece)
+	} else {
+		err = diskManager.WritePiece(pieceIndex, data)
+	}
 	if err != nil {
+		diskErr := &DiskError{Op: "write", Piece: pieceIndex, Err: err}
+		m.resetPiece(piece)
+		m.diskFailed(diskErr)
+		m.pieceFailed(pieceIndex, diskErr)
 		return
 	}
 	
@@ -615,10 +754,76 @@ func (m *Manager) verifyAndStorePiece(pieceIndex int) {
 	m.MarkPieceVerified(pieceIndex)
 }
 
-// ReadBlockFromDisk reads a block from disk if the piece is verified
+// resetPiece discards a piece's blocks so it is downloaded again, possibly
+// from other peers
+func (m *Manager) resetPiece(piece *Piece) {
+	m.mu.Lock()
+	piece.reset()
+	delete(m.partial, piece.Index)
+	m.requests.touchPiece(piece.Index)
+	m.mu.Unlock()
+	
+	m.cache.remove(piece.Index)
+	m.unassignPiece(piece.Index)
+}
+
+// ReadBlockFromDisk reads a block from disk if the piece is verified, or
+// from the read cache if the piece was prefetched. A read that fails once
+// the block is known to be valid returns a *DiskError, which subscribers
+// are told about.
 func (m *Manager) ReadBlockFromDisk(pieceIndex, begin, length int) ([]byte, error) {
+	if _, err := m.readableBlock(pieceIndex, begin, length); err != nil {
+		return nil, err
+	}
+	
+	data := make([]byte, length)
+	if err := m.ReadBlockInto(pieceIndex, begin, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadBlockInto reads a block of a verified piece into buf, which is as
+// long as the block, from the read cache or the disk
+func (m *Manager) ReadBlockInto(pieceIndex, begin int, buf []byte) error {
+	diskManager, err := m.readableBlock(pieceIndex, begin, len(buf))
+	if err != nil {
+		return err
+	}
+	
+	if m.cache.readInto(pieceIndex, begin, buf) {
+		return nil
+	}
+	
+	if diskManager == nil {
+		return fmt.Errorf("disk manager not set")
+	}
+	
+	if reader, ok := diskManager.(DirectReadDiskManager); ok {
+		err = reader.ReadBlockInto(pieceIndex, begin, buf)
+	} else {
+		var data []byte
+		data, err = diskManager.ReadBlock(pieceIndex, begin, len(buf))
+		if err == nil && copy(buf, data) != len(buf) {
+			err = fmt.Errorf("short read: %d of %d bytes", len(data), len(buf))
+		}
+	}
+	if err != nil {
+		diskErr := &DiskError{Op: "read", Piece: pieceIndex, Err: err}
+		m.diskFailed(diskErr)
+		return diskErr
+	}
+	return nil
+}
+
+// readableBlock checks that a block lies within a verified piece and
+// returns the disk manager to read it from
+func (m *Manager) readableBlock(pieceIndex, begin, length int) (DiskManager, error) {
 	m.mu.RLock()
-	piece := m.pieces[pieceIndex]
+	var piece *Piece
+	if pieceIndex >= 0 && pieceIndex < len(m.pieces) {
+		piece = m.pieces[pieceIndex]
+	}
 	diskManager := m.diskManager
 	m.mu.RUnlock()
 	
@@ -626,15 +831,26 @@ func (m *Manager) ReadBlockFromDisk(pieceIndex, begin, length int) ([]byte, erro
 		return nil, fmt.Errorf("piece %d not found", pieceIndex)
 	}
 	
-	if piece.State != PieceStateVerified {
+	if !piece.isVerified() {
 		return nil, fmt.Errorf("piece %d not verified", pieceIndex)
 	}
 	
-	if diskManager == nil {
-		return nil, fmt.Errorf("disk manager not set")
+	if begin < 0 || length <= 0 || begin+length > piece.Length {
+		return nil, fmt.Errorf("block %d:%d+%d out of range", pieceIndex, begin, length)
 	}
+	return diskManager, nil
+}
+
+// PieceLength returns the length of a piece, or 0 if there is no such
+// piece
+func (m *Manager) PieceLength(index int) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	
-	return diskManager.ReadBlock(pieceIndex, begin, length)
+	if index < 0 || index >= len(m.pieces) {
+		return 0
+	}
+	return m.pieces[index].Length
 }
 
 // PieceInfo contains information about a piece
@@ -654,13 +870,14 @@ type BlockRequest struct {
 }
 
 // GetNeededPieces returns a list of piece indices that are not yet verified
+// and not skipped
 func (m *Manager) GetNeededPieces() []int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
 	needed := make([]int, 0)
 	for i, piece := range m.pieces {
-		if piece.State != PieceStateVerified {
+		if piece.State != PieceStateVerified && m.priority(i) != PrioritySkip {
 			needed = append(needed, i)
 		}
 	}
@@ -693,45 +910,7 @@ func (m *Manager) GetBlockRequests(pieceIndex int) []BlockRequest {
 		return nil
 	}
 	
-	piece := m.pieces[pieceIndex]
-	piece.mu.RLock()
-	defer piece.mu.RUnlock()
-	
-	requests := make([]BlockRequest, 0)
-	for _, block := range piece.Blocks {
-		if block.Data == nil {
-			requests = append(requests, BlockRequest{
-				Begin:  block.Begin,
-				Length: block.Length,
-			})
-		}
-	}
-	
-	return requests
-}
-
-// RequestBlock marks a block as requested
-func (m *Manager) RequestBlock(pieceIndex, begin, length int) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	
-	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
-		return fmt.Errorf("invalid piece index: %d", pieceIndex)
-	}
-	
-	piece := m.pieces[pieceIndex]
-	piece.mu.Lock()
-	defer piece.mu.Unlock()
-	
-	// Find the block and mark it as requested
-	for i, block := range piece.Blocks {
-		if block.Begin == begin && block.Length == length {
-			piece.Blocks[i].RequestedAt = time.Now()
-			break
-		}
-	}
-	
-	return nil
+	return m.pieces[pieceIndex].blockRequests()
 }
 
 // GetActiveRequests returns a map of active requests with their timestamps
@@ -742,14 +921,7 @@ func (m *Manager) GetActiveRequests() map[string]time.Time {
 	requests := make(map[string]time.Time)
 	
 	for _, piece := range m.pieces {
-		piece.mu.RLock()
-		for _, block := range piece.Blocks {
-			if !block.RequestedAt.IsZero() && block.Data == nil {
-				key := fmt.Sprintf("%d:%d", piece.Index, block.Begin)
-				requests[key] = block.RequestedAt
-			}
-		}
-		piece.mu.RUnlock()
+		piece.addActiveRequests(requests, m.requests)
 	}
 	
 	return requests
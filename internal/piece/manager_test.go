@@ -1,8 +1,10 @@
 package piece
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"io"
 	"testing"
-	"time"
 )
 
 func TestNewPiece(t *testing.T) {
@@ -116,30 +118,6 @@ func TestPieceBlockOperations(t *testing.T) {
 	}
 }
 
-func TestPieceRequests(t *testing.T) {
-	piece := NewPiece(0, 16384, [20]byte{})
-	block := piece.Blocks[0]
-
-	// Add a request
-	piece.AddRequest("peer1", block)
-
-	pending := piece.GetPendingBlocks()
-	if len(pending) != 1 {
-		t.Errorf("Expected 1 pending request, got %d", len(pending))
-	}
-	if pending[0].PeerID != "peer1" {
-		t.Errorf("Expected peer1, got %s", pending[0].PeerID)
-	}
-
-	// Remove the request
-	piece.RemoveRequest("peer1", block.Begin, block.Length)
-
-	pending = piece.GetPendingBlocks()
-	if len(pending) != 0 {
-		t.Errorf("Expected 0 pending requests, got %d", len(pending))
-	}
-}
-
 func TestNewManager(t *testing.T) {
 	hashes := make([][20]byte, 10)
 	for i := range hashes {
@@ -244,27 +222,6 @@ func TestManagerBlockOperations(t *testing.T) {
 	}
 }
 
-func TestManagerRequests(t *testing.T) {
-	manager := NewManager(1, 16384, 0, nil)
-	block := Block{Index: 0, Begin: 0, Length: 16384}
-
-	// Add request
-	manager.AddRequest(0, "peer1", block)
-
-	stats := manager.GetStatistics()
-	if stats.ActiveRequests != 1 {
-		t.Errorf("Expected 1 active request, got %d", stats.ActiveRequests)
-	}
-
-	// Remove request
-	manager.RemoveRequest(0, "peer1", 0, 16384)
-
-	stats = manager.GetStatistics()
-	if stats.ActiveRequests != 0 {
-		t.Errorf("Expected 0 active requests, got %d", stats.ActiveRequests)
-	}
-}
-
 func TestManagerProgress(t *testing.T) {
 	manager := NewManager(4, 16384, 0, nil)
 
@@ -327,30 +284,6 @@ func TestManagerMissingPieces(t *testing.T) {
 	}
 }
 
-func TestManagerTimeoutRequests(t *testing.T) {
-	manager := NewManager(1, 16384, 0, nil)
-	piece := manager.GetPiece(0)
-	block := piece.Blocks[0]
-
-	// Add a request with old timestamp
-	piece.mu.Lock()
-	piece.Requests["peer1-0-16384"] = Request{
-		Block:     block,
-		PeerID:    "peer1",
-		Timestamp: time.Now().Add(-RequestTimeout - time.Second),
-	}
-	piece.mu.Unlock()
-
-	// Should find timeout request
-	timeouts := manager.GetTimeoutRequests()
-	if len(timeouts) != 1 {
-		t.Errorf("Expected 1 timeout request, got %d", len(timeouts))
-	}
-	if timeouts[0].PeerID != "peer1" {
-		t.Errorf("Expected peer1, got %s", timeouts[0].PeerID)
-	}
-}
-
 func TestManagerStatistics(t *testing.T) {
 	manager := NewManager(2, 16384, 0, nil)
 
@@ -419,4 +352,179 @@ func TestPieceStateString(t *testing.T) {
 			t.Errorf("State %d: expected %s, got %s", int(tt.state), tt.expected, result)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestAddBlockBufferOwnership(t *testing.T) {
+	good := make([]byte, 2*BlockSize)
+	for i := range good {
+		good[i] = byte(i)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		verified bool
+	}{
+		{"verified", good, true},
+		{"hash failure", make([]byte, 2*BlockSize), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newBanTestManager(good)
+			released := 0
+			release := func() { released++ }
+
+			// Feed the blocks in directly so verification runs synchronously
+			piece := m.GetPiece(0)
+			piece.SetBlockBufferFrom(0, tt.data[:BlockSize], release, "a")
+			piece.SetBlockBufferFrom(BlockSize, tt.data[BlockSize:], release, "b")
+			if released != 0 {
+				t.Fatalf("released %d buffers before verification", released)
+			}
+
+			m.verifyAndStorePiece(0)
+			if released != 2 {
+				t.Errorf("released %d buffers, want 2", released)
+			}
+			if got := piece.IsComplete(); got != tt.verified {
+				t.Errorf("IsComplete() = %v, want %v", got, tt.verified)
+			}
+			if got := len(m.GetBlockRequests(0)); tt.verified && got != 0 {
+				t.Errorf("GetBlockRequests returned %d blocks for a verified piece", got)
+			}
+		})
+	}
+}
+
+func TestAddBlockBufferRejected(t *testing.T) {
+	good := make([]byte, 2*BlockSize)
+	m, _ := newBanTestManager(good)
+	m.verifyAndStorePiece(0) // incomplete, nothing happens
+
+	tests := []struct {
+		name  string
+		index int
+		begin int
+		data  []byte
+	}{
+		{"bad index", 5, 0, good[:BlockSize]},
+		{"bad offset", 0, 1, good[:BlockSize]},
+		{"bad length", 0, 0, good[:10]},
+	}
+
+	for _, tt := range tests {
+		released := false
+		err := m.AddBlockBuffer(tt.index, tt.begin, tt.data, func() { released = true }, "a")
+		if err == nil {
+			t.Errorf("%s: AddBlockBuffer succeeded", tt.name)
+		}
+		if !released {
+			t.Errorf("%s: buffer not released", tt.name)
+		}
+	}
+
+	// A second copy of a block is refused and released
+	piece := m.GetPiece(0)
+	piece.SetBlockDataFrom(0, good[:BlockSize], "a")
+	released := false
+	if err := piece.SetBlockBufferFrom(0, make([]byte, BlockSize), func() { released = true }, "b"); err == nil {
+		t.Error("duplicate block accepted")
+	}
+	if !released {
+		t.Error("duplicate block not released")
+	}
+	if !bytes.Equal(piece.Blocks[0].Data, good[:BlockSize]) {
+		t.Error("duplicate block replaced the first copy")
+	}
+}
+
+
+func TestReleaseBlock(t *testing.T) {
+	m := NewManager(2, 2*BlockSize, 2*BlockSize, make([][20]byte, 2))
+
+	m.RequestBlock("a", 1, BlockSize, BlockSize)
+	if got := len(m.GetActiveRequests()); got != 1 {
+		t.Fatalf("active requests = %d, want 1", got)
+	}
+	if got := m.GetPieceInfo()[1].PendingRequests; got != 1 {
+		t.Errorf("PendingRequests = %d, want 1", got)
+	}
+
+	if err := m.ReleaseBlock(1, BlockSize, BlockSize); err != nil {
+		t.Fatalf("ReleaseBlock failed: %v", err)
+	}
+	if got := len(m.GetActiveRequests()); got != 0 {
+		t.Errorf("active requests after release = %d, want 0", got)
+	}
+
+	if err := m.ReleaseBlock(5, 0, BlockSize); err == nil {
+		t.Error("ReleaseBlock accepted an invalid piece index")
+	}
+}
+
+// streamingDisk is a hashDisk that also takes pieces from their blocks
+type streamingDisk struct {
+	hashDisk
+	written []byte
+	joined  int // pieces handed over as one buffer
+}
+
+func (d *streamingDisk) WritePiece(pieceIndex int, data []byte) error {
+	d.joined++
+	return nil
+}
+
+func (d *streamingDisk) VerifyPieceFrom(pieceIndex int, src io.WriterTo) bool {
+	var buf bytes.Buffer
+	src.WriteTo(&buf)
+	return d.VerifyPiece(pieceIndex, buf.Bytes())
+}
+
+func (d *streamingDisk) WritePieceFrom(pieceIndex int, src io.WriterTo) error {
+	var buf bytes.Buffer
+	_, err := src.WriteTo(&buf)
+	d.written = buf.Bytes()
+	return err
+}
+
+func TestPieceWriteTo(t *testing.T) {
+	piece := NewPiece(0, 2*BlockSize+10, [20]byte{})
+	data := make([]byte, piece.Length)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var buf bytes.Buffer
+	if _, err := piece.WriteTo(&buf); err == nil {
+		t.Error("WriteTo succeeded for an incomplete piece")
+	}
+
+	for _, block := range piece.Blocks {
+		piece.SetBlockData(block.Begin, data[block.Begin:block.Begin+block.Length])
+	}
+	n, err := piece.WriteTo(&buf)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("WriteTo = %d, %v, want the piece's %d bytes", n, err, len(data))
+	}
+}
+
+func TestStreamingDiskManager(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, 2*BlockSize)
+	m, _ := newBanTestManager(good)
+	disk := &streamingDisk{hashDisk: hashDisk{hashes: [][20]byte{sha1.Sum(good)}}}
+	m.SetDiskManager(disk)
+
+	attempt(m, bytes.Repeat([]byte{2}, 2*BlockSize), [2]string{"a", "a"})
+	if disk.written != nil || m.HasPiece(0) {
+		t.Error("bad piece written")
+	}
+
+	attempt(m, good, [2]string{"b", "b"})
+	if !m.HasPiece(0) || !bytes.Equal(disk.written, good) {
+		t.Error("good piece not written from its blocks")
+	}
+	if disk.joined != 0 {
+		t.Errorf("%d pieces joined into one buffer, want 0", disk.joined)
+	}
+}
@@ -0,0 +1,92 @@
+package piece
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxBufferedPieces bounds the piece index of a have message kept while
+// the piece count is not known
+const maxBufferedPieces = 1 << 20
+
+// ErrMetadataKnown is returned by SetMetadata for a manager that already
+// has its pieces
+var ErrMetadataKnown = errors.New("piece metadata already known")
+
+// newPieces creates the pieces of a torrent. Every piece but the last is
+// pieceLength long; the last is lastPieceLength long if that is set.
+func newPieces(numPieces, pieceLength, lastPieceLength int, pieceHashes [][20]byte) []*Piece {
+	pieces := make([]*Piece, numPieces)
+	for i := range pieces {
+		length := pieceLength
+		if i == numPieces-1 && lastPieceLength > 0 {
+			length = lastPieceLength
+		}
+
+		var hash [20]byte
+		if i < len(pieceHashes) {
+			hash = pieceHashes[i]
+		}
+		pieces[i] = NewPiece(i, length, hash)
+	}
+	return pieces
+}
+
+// HasMetadata returns true once the manager knows the torrent's pieces
+func (m *Manager) HasMetadata() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.pieces) > 0
+}
+
+// SetMetadata gives a manager created without pieces, as with
+// NewManager(0, 0, 0, nil) for a torrent added from a magnet link, its
+// pieces once the metadata has arrived: one per hash, the last one
+// lastPieceLength long. The bitfields and have messages peers sent
+// meanwhile are counted towards availability from then on, less any bits
+// past the last piece, and handed to the selection strategy so that it
+// starts from the swarm's rarest pieces.
+func (m *Manager) SetMetadata(pieceLength int, hashes [][20]byte, lastPieceLength int) error {
+	if len(hashes) == 0 || pieceLength <= 0 {
+		return fmt.Errorf("invalid metadata: %d pieces of %d bytes", len(hashes), pieceLength)
+	}
+
+	m.mu.Lock()
+	if len(m.pieces) > 0 {
+		m.mu.Unlock()
+		return ErrMetadataKnown
+	}
+	n := len(hashes)
+	m.pieces = newPieces(n, pieceLength, lastPieceLength, hashes)
+	m.bitfield = make([]byte, (n+7)/8)
+	m.availability = make([]int, n)
+	m.requests.touchAll()
+	tracker, _ := m.strategy.(PeerTracker)
+	buffered := make(map[string][]byte, len(m.peerPieces))
+	for peerID, bitfield := range m.peerPieces {
+		pieces := make([]byte, len(m.bitfield))
+		copy(pieces, bitfield)
+		if spare := n % 8; spare != 0 {
+			pieces[len(pieces)-1] &^= 0xff >> spare
+		}
+		for i := range m.availability {
+			if peerHasPiece(pieces, i) {
+				m.availability[i]++
+			}
+		}
+		m.peerPieces[peerID] = pieces
+		buffered[peerID] = pieces
+	}
+	m.mu.Unlock()
+
+	if tracker != nil {
+		for peerID, pieces := range buffered {
+			tracker.UpdatePeerBitfield(peerID, pieces)
+		}
+	}
+
+	m.stats.mu.Lock()
+	m.stats.TotalPieces = n
+	m.stats.mu.Unlock()
+	return nil
+}
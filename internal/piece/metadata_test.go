@@ -0,0 +1,61 @@
+package piece
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetMetadata(t *testing.T) {
+	m := NewManager(0, 0, 0, nil)
+	if m.HasMetadata() || m.IsComplete() {
+		t.Fatal("manager without metadata has pieces or is complete")
+	}
+
+	// Announcements made meanwhile are kept, bits past the end dropped
+	m.UpdatePeerBitfield("a", []byte{0xff})
+	m.PeerHave("b", 1)
+	m.PeerHave("b", 9)
+
+	if err := m.SetMetadata(2*BlockSize, make([][20]byte, 3), BlockSize); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+	if !m.HasMetadata() {
+		t.Error("HasMetadata = false after SetMetadata")
+	}
+	if got := m.GetPiece(2).Length; got != BlockSize {
+		t.Errorf("last piece length = %d, want %d", got, BlockSize)
+	}
+	if got := m.GetStatistics().TotalPieces; got != 3 {
+		t.Errorf("TotalPieces = %d, want 3", got)
+	}
+	if got, want := m.Availability(), []int{1, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability = %v, want %v", got, want)
+	}
+	m.RemovePeer("a")
+	if got, want := m.Availability(), []int{0, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Availability after a left = %v, want %v", got, want)
+	}
+
+	if err := m.SetMetadata(BlockSize, make([][20]byte, 1), 0); !errors.Is(err, ErrMetadataKnown) {
+		t.Errorf("second SetMetadata = %v, want ErrMetadataKnown", err)
+	}
+}
+
+func TestSetMetadataFeedsStrategy(t *testing.T) {
+	m := NewManager(0, 0, 0, nil)
+	m.UpdatePeerBitfield("a", []byte{0xff})
+	m.PeerHave("b", 1)
+
+	// A strategy set before the metadata arrives learns of them then
+	strategy := NewRarestFirstStrategy()
+	m.SetSelectionStrategy(strategy)
+	if err := m.SetMetadata(BlockSize, make([][20]byte, 3), 0); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+
+	want := map[string][]byte{"a": {0xe0}, "b": {0x40}}
+	if !reflect.DeepEqual(strategy.peerBitfields, want) {
+		t.Errorf("strategy bitfields = %v, want %v", strategy.peerBitfields, want)
+	}
+}
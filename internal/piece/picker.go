@@ -0,0 +1,93 @@
+package piece
+
+// availability counts how many peers have each piece and keeps the pieces
+// bucketed by that count, so the rarest pieces are found without scanning
+// every piece and every peer. Updates for a have message are O(1).
+type availability struct {
+	counts  []int   // peers having each piece
+	buckets [][]int // piece indices by count
+	slot    []int   // position of each piece in its bucket, -1 once removed
+}
+
+// newAvailability returns availability for pieces nobody has yet
+func newAvailability(numPieces int) *availability {
+	a := &availability{
+		counts:  make([]int, numPieces),
+		buckets: [][]int{make([]int, numPieces)},
+		slot:    make([]int, numPieces),
+	}
+	for i := 0; i < numPieces; i++ {
+		a.buckets[0][i] = i
+		a.slot[i] = i
+	}
+	return a
+}
+
+// add changes the count of a piece by delta and moves it to its new bucket
+func (a *availability) add(index, delta int) {
+	if index < 0 || index >= len(a.counts) {
+		return
+	}
+
+	count := a.counts[index] + delta
+	if count < 0 {
+		count = 0
+	}
+	if a.slot[index] >= 0 {
+		a.unlink(index)
+		a.link(index, count)
+	}
+	a.counts[index] = count
+}
+
+// addBitfield changes the count of every piece set in bitfield by delta
+func (a *availability) addBitfield(bitfield []byte, delta int) {
+	for i := range a.counts {
+		if peerHasPiece(bitfield, i) {
+			a.add(i, delta)
+		}
+	}
+}
+
+// remove drops a piece from selection, e.g. once it is verified
+func (a *availability) remove(index int) {
+	if index < 0 || index >= len(a.slot) || a.slot[index] < 0 {
+		return
+	}
+	a.unlink(index)
+	a.slot[index] = -1
+}
+
+// rarest returns the piece with the lowest count for which match returns
+// true, or -1. Buckets are walked from the rarest up, so the cost depends
+// on how many rarer pieces the peer lacks rather than on the torrent size.
+func (a *availability) rarest(match func(index int) bool) int {
+	for _, bucket := range a.buckets {
+		for _, index := range bucket {
+			if match(index) {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+// link appends a piece to the bucket for count
+func (a *availability) link(index, count int) {
+	for len(a.buckets) <= count {
+		a.buckets = append(a.buckets, nil)
+	}
+	a.slot[index] = len(a.buckets[count])
+	a.buckets[count] = append(a.buckets[count], index)
+}
+
+// unlink removes a piece from its bucket by swapping in the last entry
+func (a *availability) unlink(index int) {
+	bucket := a.buckets[a.counts[index]]
+	pos := a.slot[index]
+	last := bucket[len(bucket)-1]
+
+	bucket[pos] = last
+	a.slot[last] = pos
+	a.buckets[a.counts[index]] = bucket[:len(bucket)-1]
+}
@@ -0,0 +1,118 @@
+package piece
+
+import "testing"
+
+// checkBuckets verifies that every tracked piece sits in the bucket for
+// its count at the recorded slot
+func checkBuckets(t *testing.T, a *availability) {
+	t.Helper()
+
+	seen := 0
+	for count, bucket := range a.buckets {
+		for pos, index := range bucket {
+			if a.counts[index] != count || a.slot[index] != pos {
+				t.Errorf("piece %d in bucket %d slot %d, has count %d slot %d",
+					index, count, pos, a.counts[index], a.slot[index])
+			}
+			seen++
+		}
+	}
+	for _, slot := range a.slot {
+		if slot >= 0 {
+			seen--
+		}
+	}
+	if seen != 0 {
+		t.Errorf("buckets and slots disagree on the number of pieces by %d", seen)
+	}
+}
+
+func TestAvailabilityBuckets(t *testing.T) {
+	a := newAvailability(6)
+	checkBuckets(t, a)
+
+	a.addBitfield(createBitfield(6, []int{0, 1, 2}), 1)
+	a.addBitfield(createBitfield(6, []int{1, 2}), 1)
+	a.add(2, 1)
+	checkBuckets(t, a)
+
+	want := []int{1, 2, 3, 0, 0, 0}
+	for i, count := range want {
+		if a.counts[i] != count {
+			t.Errorf("count of piece %d = %d, want %d", i, a.counts[i], count)
+		}
+	}
+
+	// Rarest piece among those matching
+	has := func(indices ...int) func(int) bool {
+		return func(i int) bool {
+			for _, index := range indices {
+				if i == index {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	tests := []struct {
+		match []int
+		want  int
+	}{
+		{[]int{0, 1, 2}, 0},
+		{[]int{1, 2}, 1},
+		{[]int{2, 5}, 5},
+		{nil, -1},
+	}
+	for _, tt := range tests {
+		if got := a.rarest(has(tt.match...)); got != tt.want {
+			t.Errorf("rarest(%v) = %d, want %d", tt.match, got, tt.want)
+		}
+	}
+
+	// Removed pieces are never selected, but counts keep working
+	a.remove(5)
+	a.remove(5)
+	a.add(5, 1)
+	if got := a.rarest(has(2, 5)); got != 2 {
+		t.Errorf("rarest after remove = %d, want 2", got)
+	}
+
+	a.addBitfield(createBitfield(6, []int{0, 1, 2}), -1)
+	a.add(0, -1) // never below zero
+	checkBuckets(t, a)
+	if a.counts[0] != 0 || a.counts[2] != 2 {
+		t.Errorf("counts after removal = %v", a.counts)
+	}
+}
+
+func TestRarestFirstPeerHave(t *testing.T) {
+	strategy := NewRarestFirstStrategy()
+	pieces := createTestPieces(4)
+	all := createBitfield(4, []int{0, 1, 2, 3})
+
+	strategy.UpdatePeerBitfield("peer1", createBitfield(4, []int{0, 1, 2}))
+	strategy.UpdatePeerBitfield("peer2", createBitfield(4, []int{1, 2}))
+	strategy.PeerHave("peer2", 3)
+	strategy.PeerHave("peer3", 2)
+
+	// Counts are 1, 2, 3, 1
+	if got := strategy.SelectPiece(pieces, all); got.Index != 0 && got.Index != 3 {
+		t.Errorf("selected piece %d, want 0 or 3", got.Index)
+	}
+
+	// Haves after the first selection update the counts too; a repeated
+	// have is not counted twice
+	strategy.PeerHave("peer3", 0)
+	strategy.PeerHave("peer3", 0)
+	strategy.PeerHave("peer3", 1)
+	if got := strategy.SelectPiece(pieces, all); got.Index != 3 {
+		t.Errorf("selected piece %d, want 3", got.Index)
+	}
+
+	// Counts are 1, 2, 2, 1 without peer1; 3 is verified
+	strategy.RemovePeer("peer1")
+	pieces[3].State = PieceStateVerified
+	if got := strategy.SelectPiece(pieces, all); got.Index != 0 {
+		t.Errorf("selected piece %d, want 0", got.Index)
+	}
+}
@@ -0,0 +1,159 @@
+package piece
+
+import (
+	"fmt"
+	"time"
+)
+
+// The methods below take a piece's lock on behalf of the manager, which
+// never takes it itself. Like Piece's exported methods, each takes it once
+// and calls nothing that locks again, so none can deadlock against a
+// writer waiting on the lock. Where the manager's lock is needed as well
+// it is taken first, by the caller.
+
+// markDownloaded moves a missing piece whose blocks have all arrived to
+// PieceStateDownloaded. It returns true for the one call that makes the
+// change, so a piece is verified once however its last blocks race (must
+// hold m.mu for writing).
+func (p *Piece) markDownloaded() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.State != PieceStateMissing || !p.allBlocksDone() {
+		return false
+	}
+	p.State = PieceStateDownloaded
+	return true
+}
+
+// markVerified moves the piece to PieceStateVerified and drops its
+// blocks, which are served from disk from now on. It returns false if the
+// piece already was verified (must hold m.mu for writing).
+func (p *Piece) markVerified() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.State == PieceStateVerified {
+		return false
+	}
+	p.State = PieceStateVerified
+	p.releaseBlocks()
+	for i := range p.Blocks {
+		p.setBlockDone(i)
+	}
+	return true
+}
+
+// reset drops the piece's blocks and makes it missing again (must hold
+// m.mu for writing)
+func (p *Piece) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.State = PieceStateMissing
+	p.releaseBlocks()
+	clear(p.done)
+	clear(p.stored)
+	p.doneBlocks = 0
+}
+
+// isVerified returns true once the piece is verified
+func (p *Piece) isVerified() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.State == PieceStateVerified
+}
+
+// snapshotBlocks returns a copy of the piece's blocks. Their data is
+// shared, so it is only valid until the piece is reset or verified.
+func (p *Piece) snapshotBlocks() []Block {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]Block(nil), p.Blocks...)
+}
+
+// info describes the piece, whose requests are tracked by requests
+func (p *Piece) info(requests *Requests) PieceInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	info := PieceInfo{
+		Index:       p.Index,
+		Length:      p.Length,
+		State:       p.State,
+		BlocksTotal: len(p.Blocks),
+	}
+	if p.State == PieceStateVerified {
+		return info
+	}
+	info.BlocksMissing = len(p.Blocks) - p.doneBlocks
+	info.PendingRequests = p.pendingRequests(requests)
+	return info
+}
+
+// blockRequests returns a request for every missing block
+func (p *Piece) blockRequests() []BlockRequest {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	requests := make([]BlockRequest, 0)
+	if p.State == PieceStateVerified {
+		return requests
+	}
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) {
+			requests = append(requests, BlockRequest{
+				Begin:  block.Begin,
+				Length: block.Length,
+			})
+		}
+	}
+	return requests
+}
+
+// addActiveRequests adds the time each requested missing block was
+// requested, as tracked by tracker, to requests, keyed by "index:begin"
+func (p *Piece) addActiveRequests(requests map[string]time.Time, tracker *Requests) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.State == PieceStateVerified {
+		return
+	}
+	for i, block := range p.Blocks {
+		if p.blockDone(i) {
+			continue
+		}
+		if req, ok := tracker.Get(p.Index, block.Begin); ok {
+			requests[fmt.Sprintf("%d:%d", p.Index, block.Begin)] = req.At
+		}
+	}
+}
+
+// blockDone returns true once block i has arrived, whether or not its data
+// is still held (must hold p.mu)
+func (p *Piece) blockDone(i int) bool {
+	return p.done[i/8]&(0x80>>(i%8)) != 0
+}
+
+// setBlockDone records that block i has arrived (must hold p.mu for
+// writing)
+func (p *Piece) setBlockDone(i int) {
+	if !p.blockDone(i) {
+		p.done[i/8] |= 0x80 >> (i % 8)
+		p.doneBlocks++
+	}
+}
+
+// allBlocksDone returns true once every block has arrived (must hold p.mu)
+func (p *Piece) allBlocksDone() bool {
+	return p.doneBlocks == len(p.Blocks)
+}
+
+// DownloadedBlocks returns a bitmap of the blocks that have arrived, the
+// first block in the high bit of the first byte as in a bitfield. Every
+// block of a verified piece has arrived.
+func (p *Piece) DownloadedBlocks() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]byte(nil), p.done...)
+}
@@ -0,0 +1,94 @@
+package piece
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMarkDownloadedOnce(t *testing.T) {
+	p := NewPiece(0, 2*BlockSize, [20]byte{})
+	p.SetBlockData(0, make([]byte, BlockSize))
+	if p.markDownloaded() {
+		t.Fatal("incomplete piece marked downloaded")
+	}
+	p.SetBlockData(BlockSize, make([]byte, BlockSize))
+
+	// However many callers race, one moves the piece on
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	marked := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p.markDownloaded() {
+				mu.Lock()
+				marked++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if marked != 1 || p.State != PieceStateDownloaded {
+		t.Errorf("marked %d times to state %v, want once", marked, p.State)
+	}
+
+	if !p.markVerified() || p.markVerified() {
+		t.Error("markVerified did not report the first change only")
+	}
+	if p.Blocks[0].Data != nil {
+		t.Error("verified piece kept its blocks")
+	}
+	p.reset()
+	if p.State != PieceStateMissing || p.isVerified() {
+		t.Errorf("state after reset = %v, want missing", p.State)
+	}
+}
+
+func TestPieceInfo(t *testing.T) {
+	m := NewManager(1, 3*BlockSize, 0, make([][20]byte, 1))
+	m.RequestBlock("a", 0, 0, BlockSize)
+	m.RequestBlock("a", 0, BlockSize, BlockSize)
+	m.AddBlockData(0, 0, make([]byte, BlockSize))
+
+	info := m.GetPieceInfo()[0]
+	if info.BlocksTotal != 3 || info.BlocksMissing != 2 || info.PendingRequests != 1 {
+		t.Errorf("info = %+v, want 3 blocks, 2 missing, 1 requested", info)
+	}
+	if got := m.GetActiveRequests(); len(got) != 1 {
+		t.Errorf("active requests = %v, want block 0:%d", got, BlockSize)
+	}
+	if got := m.GetBlockRequests(0); len(got) != 2 || got[0].Begin != BlockSize {
+		t.Errorf("block requests = %v, want the two missing blocks", got)
+	}
+}
+
+func TestBlocksDoneWithoutData(t *testing.T) {
+	p := NewPiece(0, 3*BlockSize, [20]byte{})
+	p.SetBlockData(0, make([]byte, BlockSize))
+	p.SetBlockData(2*BlockSize, make([]byte, BlockSize))
+
+	// Dropping the data, as once it is written out, leaves the blocks done
+	p.mu.Lock()
+	p.releaseBlocks()
+	p.mu.Unlock()
+
+	if got := p.DownloadedBlocks(); len(got) != 1 || got[0] != 0xa0 {
+		t.Errorf("DownloadedBlocks = %08b, want 10100000", got)
+	}
+	if missing := p.GetMissingBlocks(); len(missing) != 1 || missing[0].Begin != BlockSize {
+		t.Errorf("missing blocks = %v, want block %d", missing, BlockSize)
+	}
+	if err := p.SetBlockData(0, make([]byte, BlockSize)); err == nil {
+		t.Error("block accepted twice after its data was dropped")
+	}
+
+	p.SetBlockData(BlockSize, make([]byte, BlockSize))
+	if !p.IsComplete() {
+		t.Error("piece not complete with every block done")
+	}
+	p.reset()
+	if p.IsComplete() || len(p.GetMissingBlocks()) != 3 {
+		t.Error("reset piece still has blocks done")
+	}
+}
@@ -0,0 +1,145 @@
+package piece
+
+import "fmt"
+
+// Priority is how much a piece is wanted
+type Priority int
+
+const (
+	// PrioritySkip pieces are not downloaded
+	PrioritySkip Priority = iota - 1
+
+	// PriorityNormal is the default priority
+	PriorityNormal
+
+	// PriorityHigh pieces are picked before normal ones
+	PriorityHigh
+)
+
+var priorityNames = map[Priority]string{
+	PrioritySkip:   "skip",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+// String returns the name of the priority
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParsePriority returns the priority with the given name
+func ParsePriority(name string) (Priority, error) {
+	for p, n := range priorityNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", name)
+}
+
+// MarshalText encodes the priority as its name
+func (p Priority) MarshalText() ([]byte, error) {
+	if _, ok := priorityNames[p]; !ok {
+		return nil, fmt.Errorf("unknown priority %d", int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes a priority name
+func (p *Priority) UnmarshalText(text []byte) error {
+	parsed, err := ParsePriority(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// SetPriorities sets the priority of every piece; nil makes every piece
+// normal. Skipped pieces are no longer assigned to peers, but pieces
+// already being downloaded are finished.
+func (m *Manager) SetPriorities(priorities []Priority) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if priorities != nil && len(priorities) != len(m.pieces) {
+		return fmt.Errorf("got %d priorities for %d pieces", len(priorities), len(m.pieces))
+	}
+	m.priorities = nil
+	if priorities != nil {
+		m.priorities = append([]Priority(nil), priorities...)
+	}
+	m.requests.touchAll()
+	return nil
+}
+
+// PiecePriority returns the priority of a piece
+func (m *Manager) PiecePriority(index int) Priority {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.priority(index)
+}
+
+// BytesLeft returns the bytes of the pieces that are neither verified nor
+// skipped, which is what is left to download
+func (m *Manager) BytesLeft() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var left int64
+	for i, piece := range m.pieces {
+		if piece.State != PieceStateVerified && m.priority(i) != PrioritySkip {
+			left += int64(piece.Length)
+		}
+	}
+	return left
+}
+
+// priority returns the priority of a piece (must hold m.mu)
+func (m *Manager) priority(index int) Priority {
+	if index < 0 || index >= len(m.priorities) {
+		return PriorityNormal
+	}
+	return m.priorities[index]
+}
+
+// maskSkipped clears skipped pieces from a copy of bitfield (must hold
+// m.mu)
+func (m *Manager) maskSkipped(bitfield []byte) []byte {
+	if m.priorities == nil {
+		return bitfield
+	}
+
+	masked := make([]byte, len(bitfield))
+	copy(masked, bitfield)
+	for index, p := range m.priorities {
+		if p == PrioritySkip {
+			clearPiece(masked, index)
+		}
+	}
+	return masked
+}
+
+// selectPiece runs the strategy on the high priority pieces among
+// candidates first, then on all of them (must hold m.mu)
+func (m *Manager) selectPiece(candidates []byte) *Piece {
+	if m.priorities != nil {
+		high := make([]byte, len(candidates))
+		found := false
+		for index, p := range m.priorities {
+			if p == PriorityHigh && peerHasPiece(candidates, index) {
+				high[index/8] |= 1 << (7 - index%8)
+				found = true
+			}
+		}
+		if found {
+			if piece := m.strategy.SelectPiece(m.pieces, high); piece != nil {
+				return piece
+			}
+		}
+	}
+	return m.strategy.SelectPiece(m.pieces, candidates)
+}
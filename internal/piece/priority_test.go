@@ -0,0 +1,86 @@
+package piece
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAssignPieceByPriority(t *testing.T) {
+	m := newAssignTestManager()
+	all := []byte{0xf0}
+
+	err := m.SetPriorities([]Priority{PrioritySkip, PriorityNormal, PriorityHigh, PrioritySkip})
+	if err != nil {
+		t.Fatalf("SetPriorities failed: %v", err)
+	}
+
+	tests := []struct {
+		peer string
+		want int
+	}{
+		{"a", 2},  // high first
+		{"b", 1},  // then normal
+		{"c", -1}, // skipped pieces are never assigned
+	}
+	for _, tt := range tests {
+		got, _ := m.AssignPiece(tt.peer, all, false)
+		if got != tt.want {
+			t.Errorf("AssignPiece(%s) = %d, want %d", tt.peer, got, tt.want)
+		}
+	}
+
+	if got, want := m.GetNeededPieces(), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetNeededPieces() = %v, want %v", got, want)
+	}
+
+	if err := m.SetPriorities(nil); err != nil {
+		t.Fatalf("SetPriorities(nil) failed: %v", err)
+	}
+	if got, _ := m.AssignPiece("c", all, false); got != 0 {
+		t.Errorf("AssignPiece(c) after reset = %d, want 0", got)
+	}
+}
+
+func TestSetPrioritiesLength(t *testing.T) {
+	m := newAssignTestManager()
+	if err := m.SetPriorities([]Priority{PriorityHigh}); err == nil {
+		t.Error("SetPriorities accepted one priority for four pieces")
+	}
+}
+
+func TestBytesLeft(t *testing.T) {
+	m := newAssignTestManager()
+	if got, want := m.BytesLeft(), int64(8*BlockSize); got != want {
+		t.Errorf("BytesLeft() = %d, want %d", got, want)
+	}
+
+	m.MarkPieceVerified(1)
+	if err := m.SetPriorities([]Priority{PrioritySkip, PriorityNormal, PriorityHigh, PriorityNormal}); err != nil {
+		t.Fatalf("SetPriorities failed: %v", err)
+	}
+	if got, want := m.BytesLeft(), int64(4*BlockSize); got != want {
+		t.Errorf("BytesLeft() = %d, want %d", got, want)
+	}
+}
+
+func TestPriorityJSON(t *testing.T) {
+	for _, p := range []Priority{PrioritySkip, PriorityNormal, PriorityHigh} {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Marshal(%v) failed: %v", p, err)
+		}
+		var got Priority
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s) failed: %v", data, err)
+		}
+		if got != p {
+			t.Errorf("round trip of %v = %v", p, got)
+		}
+	}
+
+	var p Priority
+	if err := json.Unmarshal([]byte(`"urgent"`), &p); err == nil {
+		t.Error("Unmarshal accepted an unknown priority")
+	}
+}
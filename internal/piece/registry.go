@@ -0,0 +1,62 @@
+package piece
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// StrategyFactory creates a selection strategy. It is called once per
+// torrent, so strategies may keep per-torrent state.
+type StrategyFactory func() SelectionStrategy
+
+// ErrUnknownStrategy is returned for a strategy name nothing is registered
+// under
+var ErrUnknownStrategy = errors.New("unknown selection strategy")
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[string]StrategyFactory{
+		"sequential":   func() SelectionStrategy { return NewSequentialStrategy() },
+		"random":       func() SelectionStrategy { return NewRandomStrategy() },
+		"rarest-first": func() SelectionStrategy { return NewRarestFirstStrategy() },
+		"smart":        func() SelectionStrategy { return NewSmartStrategy() },
+	}
+)
+
+// RegisterStrategy makes a strategy selectable by name, as with the
+// session's Strategy setting, replacing any registered under that name. It
+// panics if name is empty or factory is nil.
+func RegisterStrategy(name string, factory StrategyFactory) {
+	if name == "" || factory == nil {
+		panic("piece: RegisterStrategy needs a name and a factory")
+	}
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[name] = factory
+}
+
+// NewStrategy creates the strategy registered under name
+func NewStrategy(name string) (SelectionStrategy, error) {
+	strategiesMu.RLock()
+	factory, ok := strategies[name]
+	strategiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownStrategy, name)
+	}
+	return factory(), nil
+}
+
+// StrategyNames returns the names of the registered strategies, sorted
+func StrategyNames() []string {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+package piece
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// firstStrategy picks the first piece, whatever the peer has
+type firstStrategy struct{}
+
+func (firstStrategy) SelectPiece(pieces []*Piece, peerBitfield []byte) *Piece {
+	if len(pieces) == 0 {
+		return nil
+	}
+	return pieces[0]
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	if _, err := NewStrategy("first"); !errors.Is(err, ErrUnknownStrategy) {
+		t.Fatalf("NewStrategy before registering error = %v, want %v", err, ErrUnknownStrategy)
+	}
+
+	RegisterStrategy("first", func() SelectionStrategy { return firstStrategy{} })
+	defer func() {
+		strategiesMu.Lock()
+		delete(strategies, "first")
+		strategiesMu.Unlock()
+	}()
+
+	strategy, err := NewStrategy("first")
+	if err != nil {
+		t.Fatalf("NewStrategy failed: %v", err)
+	}
+	if _, ok := strategy.(firstStrategy); !ok {
+		t.Errorf("NewStrategy = %T, want firstStrategy", strategy)
+	}
+	if _, ok := GetStrategyByName("first").(firstStrategy); !ok {
+		t.Errorf("GetStrategyByName = %T, want firstStrategy", GetStrategyByName("first"))
+	}
+	if names := StrategyNames(); !slices.Contains(names, "first") || !slices.IsSorted(names) {
+		t.Errorf("StrategyNames = %v, want sorted names including first", names)
+	}
+}
+
+func TestNewStrategyCreatesEach(t *testing.T) {
+	a, _ := NewStrategy("sequential")
+	b, _ := NewStrategy("sequential")
+	if a == b {
+		t.Error("NewStrategy returned the same strategy twice")
+	}
+}
@@ -0,0 +1,404 @@
+package piece
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Request is a block requested from a peer
+type Request struct {
+	Piece    int
+	Begin    int
+	Length   int
+	Peer     string    // ID of the peer asked for the block
+	At       time.Time // when the request was sent
+	Deadline time.Time // when the request times out, zero for never
+
+	cancel func()
+}
+
+// Cancel withdraws the request at the peer, if it was added with a way to
+func (r Request) Cancel() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// blockKey identifies a block by piece index and offset
+type blockKey struct {
+	index, begin int
+}
+
+// MaxBlockOwners is how many peers a block may be requested from at once.
+// Outside the endgame a block is requested from one peer at a time.
+const MaxBlockOwners = 2
+
+// Requests tracks the blocks requested from peers: which peers were asked
+// for each, when the requests time out, and the peer each block last timed
+// out at, so it is asked of someone else. A block is requested from one
+// peer at a time, or from up to MaxBlockOwners in the endgame. The tracker
+// is shared by the manager, which counts the requests of each piece, and
+// the download coordinator, which makes them. Its lock is taken after the
+// manager's and the pieces' and nothing is called while it is held.
+//
+// It also keeps the manager's count of the missing blocks of each wanted
+// piece that nobody has been asked for. A piece whose requests or blocks
+// change is marked stale and counted again when the count is next read.
+type Requests struct {
+	mu       sync.Mutex
+	active   map[blockKey][]Request // in the order the peers were asked
+	timedOut map[blockKey]string
+
+	unrequested      map[int]int // by piece, zero counts left out
+	unrequestedTotal int
+	stale            map[int]bool
+	allStale         bool
+}
+
+// NewRequests creates an empty request tracker
+func NewRequests() *Requests {
+	return &Requests{
+		active:      make(map[blockKey][]Request),
+		timedOut:    make(map[blockKey]string),
+		unrequested: make(map[int]int),
+		stale:       make(map[int]bool),
+		allStale:    true,
+	}
+}
+
+// Add records a request, which cancel withdraws at the peer. It returns
+// false, recording nothing, if the block last timed out at the same peer
+// or is already requested. In the endgame a block requested from another
+// peer may be requested again, up to MaxBlockOwners.
+func (r *Requests) Add(req Request, cancel func(), endgame bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := blockKey{req.Piece, req.Begin}
+	owners := r.active[key]
+	if len(owners) > 0 && (!endgame || len(owners) >= MaxBlockOwners) {
+		return false
+	}
+	for _, owner := range owners {
+		if owner.Peer == req.Peer {
+			return false
+		}
+	}
+	if peerID, ok := r.timedOut[key]; ok && peerID == req.Peer {
+		return false
+	}
+	req.cancel = cancel
+	r.active[key] = append(owners, req)
+	r.touch(key.index)
+	return true
+}
+
+// Get returns the first outstanding request for a block
+func (r *Requests) Get(index, begin int) (Request, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	owners := r.active[blockKey{index, begin}]
+	if len(owners) == 0 {
+		return Request{}, false
+	}
+	return owners[0], true
+}
+
+// Requested returns true if a block is requested
+func (r *Requests) Requested(index, begin int) bool {
+	_, ok := r.Get(index, begin)
+	return ok
+}
+
+// Complete removes the requests for a block that has arrived and forgets
+// that it timed out anywhere. It returns the first request, if there was
+// one.
+func (r *Requests) Complete(index, begin int) (Request, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := blockKey{index, begin}
+	owners := r.active[key]
+	r.remove(key)
+	delete(r.timedOut, key)
+	if len(owners) == 0 {
+		return Request{}, false
+	}
+	return owners[0], true
+}
+
+// Arrived takes the requests for a block that has arrived from source that
+// are outstanding at other peers, which are then to be told to cancel
+// them. A request at source itself is left for Complete.
+func (r *Requests) Arrived(index, begin int, source string) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := blockKey{index, begin}
+	var others, kept []Request
+	for _, req := range r.active[key] {
+		if req.Peer == source {
+			kept = append(kept, req)
+		} else {
+			others = append(others, req)
+		}
+	}
+	if len(others) > 0 {
+		r.set(key, kept)
+	}
+	return others
+}
+
+// Release removes the requests for a block so it may be asked of another
+// peer, and returns the first
+func (r *Requests) Release(index, begin int) (Request, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := blockKey{index, begin}
+	owners := r.active[key]
+	r.remove(key)
+	if len(owners) == 0 {
+		return Request{}, false
+	}
+	return owners[0], true
+}
+
+// ReleaseAt removes the request for a block at one peer, leaving any other
+// peer asked for it in the endgame, and returns it
+func (r *Requests) ReleaseAt(index, begin int, peerID string) (Request, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := blockKey{index, begin}
+	owners := r.active[key]
+	for i, req := range owners {
+		if req.Peer == peerID {
+			r.set(key, append(owners[:i:i], owners[i+1:]...))
+			return req, true
+		}
+	}
+	return Request{}, false
+}
+
+// ReleasePeer removes and returns every request outstanding at a peer,
+// which will not serve them, and forgets the blocks that timed out there
+func (r *Requests) ReleasePeer(peerID string) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var released []Request
+	for key, owners := range r.active {
+		var kept []Request
+		for _, req := range owners {
+			if req.Peer == peerID {
+				released = append(released, req)
+			} else {
+				kept = append(kept, req)
+			}
+		}
+		if len(kept) != len(owners) {
+			r.set(key, kept)
+		}
+	}
+	for key, timedOut := range r.timedOut {
+		if timedOut == peerID {
+			delete(r.timedOut, key)
+		}
+	}
+	return released
+}
+
+// Expire removes and returns the requests whose deadline is past at now.
+// Each block is remembered as timed out at its peer until it arrives or
+// the peer is released.
+func (r *Requests) Expire(now time.Time) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired []Request
+	for key, owners := range r.active {
+		var kept []Request
+		for _, req := range owners {
+			if !req.Deadline.IsZero() && now.After(req.Deadline) {
+				expired = append(expired, req)
+				r.timedOut[key] = req.Peer
+			} else {
+				kept = append(kept, req)
+			}
+		}
+		if len(kept) != len(owners) {
+			r.set(key, kept)
+		}
+	}
+	return expired
+}
+
+// TimedOutAt returns the peer a block last timed out at, if any
+func (r *Requests) TimedOutAt(index, begin int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peerID, ok := r.timedOut[blockKey{index, begin}]
+	return peerID, ok
+}
+
+// Count returns the number of outstanding requests
+func (r *Requests) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, owners := range r.active {
+		n += len(owners)
+	}
+	return n
+}
+
+// PeerCount returns the number of requests outstanding at a peer
+func (r *Requests) PeerCount(peerID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, owners := range r.active {
+		for _, req := range owners {
+			if req.Peer == peerID {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Peers returns the peers with requests outstanding
+func (r *Requests) Peers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var peers []string
+	for _, owners := range r.active {
+		for _, req := range owners {
+			if !seen[req.Peer] {
+				seen[req.Peer] = true
+				peers = append(peers, req.Peer)
+			}
+		}
+	}
+	return peers
+}
+
+// set replaces the requests for a block (must hold r.mu)
+func (r *Requests) set(key blockKey, owners []Request) {
+	if len(owners) == 0 {
+		r.remove(key)
+		return
+	}
+	r.active[key] = owners
+}
+
+// remove drops every request for a block (must hold r.mu)
+func (r *Requests) remove(key blockKey) {
+	if _, ok := r.active[key]; ok {
+		delete(r.active, key)
+		r.touch(key.index)
+	}
+}
+
+// touch marks a piece's unrequested count stale (must hold r.mu)
+func (r *Requests) touch(index int) {
+	r.stale[index] = true
+}
+
+// touchPiece marks a piece's unrequested count stale once its blocks or
+// state have changed
+func (r *Requests) touchPiece(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.touch(index)
+}
+
+// touchAll marks every piece's unrequested count stale, as when the
+// pieces or their priorities change
+func (r *Requests) touchAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.allStale = true
+}
+
+// takeStale returns the pieces whose unrequested count is stale, or all
+// if every piece is, and marks them current
+func (r *Requests) takeStale() ([]int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.allStale {
+		r.allStale = false
+		clear(r.stale)
+		clear(r.unrequested)
+		r.unrequestedTotal = 0
+		return nil, true
+	}
+	stale := make([]int, 0, len(r.stale))
+	for index := range r.stale {
+		stale = append(stale, index)
+	}
+	clear(r.stale)
+	return stale, false
+}
+
+// setUnrequested records how many missing blocks of a wanted piece nobody
+// has been asked for, and returns the total over every piece
+func (r *Requests) setUnrequested(index, n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unrequestedTotal += n - r.unrequested[index]
+	if n == 0 {
+		delete(r.unrequested, index)
+	} else {
+		r.unrequested[index] = n
+	}
+	return r.unrequestedTotal
+}
+
+// unrequestedBlocks returns the total unrequested count
+func (r *Requests) unrequestedBlocks() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unrequestedTotal
+}
+
+// Requests returns the tracker of the blocks requested from peers
+func (m *Manager) Requests() *Requests {
+	return m.requests
+}
+
+// RequestBlock records a block as requested from a peer, with no timeout
+func (m *Manager) RequestBlock(peerID string, pieceIndex, begin, length int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
+		return fmt.Errorf("invalid piece index: %d", pieceIndex)
+	}
+	req := Request{Piece: pieceIndex, Begin: begin, Length: length, Peer: peerID, At: time.Now()}
+	if !m.requests.Add(req, nil, false) {
+		return fmt.Errorf("block %d:%d already requested", pieceIndex, begin)
+	}
+	return nil
+}
+
+// ReleaseBlock marks a requested block as no longer requested, so it can
+// be asked of another peer
+func (m *Manager) ReleaseBlock(pieceIndex, begin, length int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if pieceIndex < 0 || pieceIndex >= len(m.pieces) {
+		return fmt.Errorf("invalid piece index: %d", pieceIndex)
+	}
+	m.requests.Release(pieceIndex, begin)
+	return nil
+}
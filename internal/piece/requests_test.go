@@ -0,0 +1,106 @@
+package piece
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequests(t *testing.T) {
+	r := NewRequests()
+	now := time.Now()
+	cancelled := 0
+	add := func(index, begin int, peerID string, deadline time.Time) bool {
+		req := Request{Piece: index, Begin: begin, Length: BlockSize, Peer: peerID, At: now, Deadline: deadline}
+		return r.Add(req, func() { cancelled++ }, false)
+	}
+
+	if !add(0, 0, "a", now.Add(-time.Second)) || !add(0, BlockSize, "a", now.Add(time.Minute)) || !add(1, 0, "b", time.Time{}) {
+		t.Fatal("Add refused a free block")
+	}
+	if add(0, 0, "b", time.Time{}) {
+		t.Error("Add accepted a block already requested")
+	}
+	if got := r.PeerCount("a"); got != 2 {
+		t.Errorf("PeerCount(a) = %d, want 2", got)
+	}
+
+	expired := r.Expire(now)
+	if len(expired) != 1 || expired[0].Begin != 0 || expired[0].Peer != "a" {
+		t.Fatalf("Expire = %+v, want block 0:0 at a", expired)
+	}
+	expired[0].Cancel()
+	if cancelled != 1 {
+		t.Errorf("cancelled %d requests, want 1", cancelled)
+	}
+
+	// The block is asked of another peer, not the one it timed out at
+	if add(0, 0, "a", time.Time{}) {
+		t.Error("Add accepted a block at the peer it timed out at")
+	}
+	if !add(0, 0, "b", time.Time{}) {
+		t.Error("Add refused a timed out block at another peer")
+	}
+	if req, ok := r.Complete(0, 0); !ok || req.Peer != "b" {
+		t.Errorf("Complete = %+v, %v, want the request at b", req, ok)
+	}
+	if _, ok := r.TimedOutAt(0, 0); ok {
+		t.Error("completed block still remembered as timed out")
+	}
+
+	if released := r.ReleasePeer("a"); len(released) != 1 || released[0].Begin != BlockSize {
+		t.Errorf("ReleasePeer(a) = %+v, want block 0:%d", released, BlockSize)
+	}
+	if got := r.Count(); got != 1 {
+		t.Errorf("Count = %d, want 1", got)
+	}
+	if peers := r.Peers(); len(peers) != 1 || peers[0] != "b" {
+		t.Errorf("Peers = %v, want [b]", peers)
+	}
+}
+
+func TestEndgameRequests(t *testing.T) {
+	r := NewRequests()
+	cancelled := make(map[string]int)
+	add := func(peerID string, endgame bool) bool {
+		req := Request{Piece: 0, Begin: 0, Length: BlockSize, Peer: peerID}
+		return r.Add(req, func() { cancelled[peerID]++ }, endgame)
+	}
+
+	if !add("a", false) {
+		t.Fatal("Add refused a free block")
+	}
+	if add("b", false) {
+		t.Error("Add accepted a second peer outside the endgame")
+	}
+	if add("a", true) {
+		t.Error("Add accepted the same peer twice")
+	}
+	if !add("b", true) {
+		t.Fatal("Add refused a second peer in the endgame")
+	}
+	if add("c", true) {
+		t.Errorf("Add accepted more than %d peers", MaxBlockOwners)
+	}
+	if got := r.Count(); got != 2 {
+		t.Errorf("Count = %d, want 2", got)
+	}
+
+	// Either peer may give up the block without releasing the other
+	if _, ok := r.ReleaseAt(0, 0, "b"); !ok || r.PeerCount("a") != 1 {
+		t.Error("ReleaseAt(b) did not leave the request at a")
+	}
+	add("b", true)
+	add("c", true)
+
+	// The block arriving from one peer cancels it at the other
+	others := r.Arrived(0, 0, "b")
+	for _, req := range others {
+		req.Cancel()
+	}
+	if len(others) != 1 || cancelled["a"] != 1 || cancelled["b"] != 0 {
+		t.Errorf("Arrived = %+v, cancelled %v, want the request at a", others, cancelled)
+	}
+	if req, ok := r.Complete(0, 0); !ok || req.Peer != "b" {
+		t.Errorf("Complete = %+v, %v, want the request at b", req, ok)
+	}
+}
@@ -0,0 +1,142 @@
+package piece
+
+import "crypto/sha1"
+
+// MaxHashFailures is how many failed attempts a piece may have before the
+// peers that contributed to every attempt are banned
+const MaxHashFailures = 3
+
+// BanHandler is told about peers that sent corrupt data
+type BanHandler interface {
+	// HashFailed is called for every peer that contributed to a piece
+	// that failed verification
+	HashFailed(source string)
+
+	// BanPeer is called for peers identified as sending corrupt data
+	BanPeer(source string)
+}
+
+// blockRecord remembers who sent a block of a failed piece and what it was
+type blockRecord struct {
+	source string
+	hash   [20]byte
+}
+
+// failureHistory holds the blocks of every failed attempt at one piece
+type failureHistory struct {
+	attempts [][]blockRecord // indexed by attempt, then block
+}
+
+// recordFailure stores the blocks of a piece that failed verification and
+// returns the sources that can already be blamed (must not hold piece.mu)
+func (m *Manager) recordFailure(pieceIndex int, blocks []Block) []string {
+	records := make([]blockRecord, len(blocks))
+	sources := make(map[string]bool)
+	for i, block := range blocks {
+		records[i] = blockRecord{source: block.Source, hash: sha1.Sum(block.Data)}
+		if block.Source != "" {
+			sources[block.Source] = true
+		}
+	}
+
+	m.mu.RLock()
+	banHandler := m.banHandler
+	m.mu.RUnlock()
+
+	if banHandler != nil {
+		for source := range sources {
+			banHandler.HashFailed(source)
+		}
+	}
+
+	m.banMu.Lock()
+	defer m.banMu.Unlock()
+
+	history := m.failures[pieceIndex]
+	if history == nil {
+		history = &failureHistory{}
+		m.failures[pieceIndex] = history
+	}
+	history.attempts = append(history.attempts, records)
+
+	// A single contributor is certainly the culprit
+	if len(sources) == 1 {
+		for source := range sources {
+			return []string{source}
+		}
+	}
+
+	if len(history.attempts) < MaxHashFailures {
+		return nil
+	}
+
+	// Blame the peers that took part in every failed attempt
+	var culprits []string
+	for source := range sources {
+		inAll := true
+		for _, attempt := range history.attempts {
+			if !attemptHasSource(attempt, source) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			culprits = append(culprits, source)
+		}
+	}
+	return culprits
+}
+
+// resolveFailures compares earlier failed attempts with the verified piece
+// and returns the sources of blocks that differed
+func (m *Manager) resolveFailures(pieceIndex int, blocks []Block) []string {
+	m.banMu.Lock()
+	history := m.failures[pieceIndex]
+	delete(m.failures, pieceIndex)
+	m.banMu.Unlock()
+
+	if history == nil {
+		return nil
+	}
+
+	good := make([][20]byte, len(blocks))
+	for i, block := range blocks {
+		good[i] = sha1.Sum(block.Data)
+	}
+
+	seen := make(map[string]bool)
+	var culprits []string
+	for _, attempt := range history.attempts {
+		for i, record := range attempt {
+			if i >= len(good) || record.source == "" || record.hash == good[i] || seen[record.source] {
+				continue
+			}
+			seen[record.source] = true
+			culprits = append(culprits, record.source)
+		}
+	}
+	return culprits
+}
+
+// banPeers reports culprits to the ban handler
+func (m *Manager) banPeers(sources []string) {
+	m.mu.RLock()
+	banHandler := m.banHandler
+	m.mu.RUnlock()
+
+	if banHandler == nil {
+		return
+	}
+	for _, source := range sources {
+		banHandler.BanPeer(source)
+	}
+}
+
+func attemptHasSource(attempt []blockRecord, source string) bool {
+	for _, record := range attempt {
+		if record.source == source {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package piece
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"sort"
+	"testing"
+)
+
+// hashDisk verifies pieces against fixed hashes and discards writes
+type hashDisk struct {
+	hashes [][20]byte
+}
+
+func (d *hashDisk) WritePiece(pieceIndex int, data []byte) error { return nil }
+func (d *hashDisk) ReadPiece(pieceIndex int) ([]byte, error)     { return nil, nil }
+func (d *hashDisk) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
+	return nil, nil
+}
+func (d *hashDisk) VerifyPiece(pieceIndex int, data []byte) bool {
+	return sha1.Sum(data) == d.hashes[pieceIndex]
+}
+
+// recordingBans collects banned sources
+type recordingBans struct {
+	banned []string
+	failed map[string]int
+	wasted map[string]int64
+}
+
+func (b *recordingBans) BytesWasted(source string, n int64) {
+	if b.wasted == nil {
+		b.wasted = make(map[string]int64)
+	}
+	b.wasted[source] += n
+}
+
+func (b *recordingBans) HashFailed(source string) {
+	if b.failed == nil {
+		b.failed = make(map[string]int)
+	}
+	b.failed[source]++
+}
+
+func (b *recordingBans) BanPeer(source string) {
+	b.banned = append(b.banned, source)
+}
+
+// newBanTestManager returns a manager for one two-block piece whose
+// correct content is good
+func newBanTestManager(good []byte) (*Manager, *recordingBans) {
+	hashes := [][20]byte{sha1.Sum(good)}
+	m := NewManager(1, len(good), 0, hashes)
+	m.SetDiskManager(&hashDisk{hashes: hashes})
+
+	bans := &recordingBans{}
+	m.SetBanHandler(bans)
+	return m, bans
+}
+
+// attempt fills the piece with one block from each source and verifies it
+func attempt(m *Manager, data []byte, sources [2]string) {
+	piece := m.GetPiece(0)
+	piece.SetBlockDataFrom(0, data[:BlockSize], sources[0])
+	piece.SetBlockDataFrom(BlockSize, data[BlockSize:], sources[1])
+	m.verifyAndStorePiece(0)
+}
+
+func TestSmartBanSingleSource(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, 2*BlockSize)
+	bad := bytes.Repeat([]byte{2}, 2*BlockSize)
+	m, bans := newBanTestManager(good)
+
+	attempt(m, bad, [2]string{"10.0.0.1:6881", "10.0.0.1:6881"})
+
+	if len(bans.banned) != 1 || bans.banned[0] != "10.0.0.1:6881" {
+		t.Errorf("banned = %v, want [10.0.0.1:6881]", bans.banned)
+	}
+	if stats := m.GetStatistics(); stats.HashFailures != 1 {
+		t.Errorf("HashFailures = %d, want 1", stats.HashFailures)
+	}
+	if m.GetPiece(0).IsComplete() {
+		t.Error("failed piece still has block data")
+	}
+}
+
+func TestSmartBanResolvedByGoodCopy(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, 2*BlockSize)
+
+	// Only the second block is corrupt
+	bad := append([]byte(nil), good...)
+	bad[BlockSize+10] ^= 0xff
+
+	m, bans := newBanTestManager(good)
+
+	attempt(m, bad, [2]string{"honest:1", "liar:1"})
+	if len(bans.banned) != 0 {
+		t.Fatalf("banned %v before the culprit could be identified", bans.banned)
+	}
+
+	attempt(m, good, [2]string{"honest:1", "other:1"})
+
+	if len(bans.banned) != 1 || bans.banned[0] != "liar:1" {
+		t.Errorf("banned = %v, want [liar:1]", bans.banned)
+	}
+	if m.GetPiece(0).State != PieceStateVerified {
+		t.Errorf("State = %v, want verified", m.GetPiece(0).State)
+	}
+}
+
+func TestSmartBanRepeatedFailures(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, 2*BlockSize)
+	bad := bytes.Repeat([]byte{2}, 2*BlockSize)
+	m, bans := newBanTestManager(good)
+
+	// "common" took part in every failure; the others rotate
+	others := []string{"a:1", "b:1", "c:1"}
+	for i := 0; i < MaxHashFailures; i++ {
+		attempt(m, bad, [2]string{"common:1", others[i]})
+	}
+
+	sort.Strings(bans.banned)
+	if len(bans.banned) != 1 || bans.banned[0] != "common:1" {
+		t.Errorf("banned = %v, want [common:1]", bans.banned)
+	}
+	if got := bans.failed["common:1"]; got != MaxHashFailures {
+		t.Errorf("HashFailed(common:1) called %d times, want %d", got, MaxHashFailures)
+	}
+}
@@ -0,0 +1,179 @@
+package piece
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSnapshotMismatch is returned by Restore for a snapshot of a torrent
+// with a different number of pieces
+var ErrSnapshotMismatch = errors.New("snapshot does not match the torrent")
+
+// Snapshot is the state of a manager's pieces, from which a manager for
+// the same torrent, in this process or another, carries on: which pieces
+// are verified and which blocks of the others have arrived. The blocks
+// themselves are kept in the torrent's files, so a snapshot stays small.
+// It is made to be encoded as JSON, as resume data is.
+type Snapshot struct {
+	NumPieces int            `json:"numPieces"`
+	Verified  []byte         `json:"verified"` // bitfield of verified pieces
+	Partial   []PartialPiece `json:"partial,omitempty"`
+}
+
+// PartialPiece is a piece of which some blocks have arrived
+type PartialPiece struct {
+	Index  int    `json:"index"`
+	Blocks []byte `json:"blocks"` // bitmap of arrived blocks, as DownloadedBlocks
+}
+
+// Snapshot returns the state of the manager's pieces. The arrived blocks
+// of partial pieces are first written to disk, each once, which needs a
+// BlockDiskManager; without one no partial pieces are recorded.
+func (m *Manager) Snapshot() Snapshot {
+	m.mu.RLock()
+	pieces := m.pieces
+	writer, canStore := m.diskManager.(BlockDiskManager)
+	m.mu.RUnlock()
+	if !canStore {
+		pieces = nil
+	}
+
+	var partials []PartialPiece
+	for _, piece := range pieces {
+		partial, ok, err := piece.store(writer)
+		switch {
+		case err != nil:
+			m.log().Warn("Failed to store partial piece", "piece", piece.Index, "err", err)
+		case ok:
+			partials = append(partials, partial)
+		}
+	}
+
+	// Taken last, so a piece verified meanwhile is not left out of both
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Snapshot{
+		NumPieces: len(m.pieces),
+		Verified:  append([]byte(nil), m.bitfield...),
+		Partial:   partials,
+	}
+}
+
+// Restore brings a manager with the torrent's metadata to the state of a
+// snapshot: its verified pieces, which must be on disk already, are marked
+// verified, notifying subscribers, and the blocks of its partial pieces
+// are read back from disk and added as if they had just arrived. A piece
+// that is complete is verified and stored. The snapshot is checked whole
+// before anything is changed.
+func (m *Manager) Restore(s Snapshot) error {
+	m.mu.RLock()
+	numPieces := len(m.pieces)
+	diskManager := m.diskManager
+	m.mu.RUnlock()
+
+	if s.NumPieces != numPieces || len(s.Verified) != (numPieces+7)/8 {
+		return fmt.Errorf("%w: %d pieces, want %d", ErrSnapshotMismatch, s.NumPieces, numPieces)
+	}
+	for _, partial := range s.Partial {
+		if err := m.checkPartial(partial); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < numPieces; i++ {
+		if peerHasPiece(s.Verified, i) {
+			m.MarkPieceVerified(i)
+		}
+	}
+	if diskManager == nil {
+		return nil
+	}
+	for _, partial := range s.Partial {
+		if !peerHasPiece(s.Verified, partial.Index) {
+			m.restorePartial(diskManager, partial)
+		}
+	}
+	return nil
+}
+
+// restorePartial reads the arrived blocks of a partial piece back from
+// disk and adds them. A block that cannot be read is downloaded again.
+func (m *Manager) restorePartial(diskManager DiskManager, partial PartialPiece) {
+	piece := m.GetPiece(partial.Index)
+	for i := range piece.Blocks {
+		if !peerHasPiece(partial.Blocks, i) {
+			continue
+		}
+		block := &piece.Blocks[i]
+		data, err := diskManager.ReadBlock(partial.Index, block.Begin, block.Length)
+		if err != nil || len(data) != block.Length {
+			m.log().Warn("Failed to read partial block", "piece", partial.Index, "begin", block.Begin, "err", err)
+			continue
+		}
+		// Blocks that arrived since the snapshot are kept
+		if piece.SetBlockData(block.Begin, data) == nil {
+			piece.markStored(i)
+			m.requests.touchPiece(partial.Index)
+			m.checkDownloaded(partial.Index, piece)
+		}
+	}
+}
+
+// checkPartial checks a partial piece of a snapshot against the torrent
+func (m *Manager) checkPartial(partial PartialPiece) error {
+	piece := m.GetPiece(partial.Index)
+	if piece == nil {
+		return fmt.Errorf("%w: partial piece %d out of range", ErrSnapshotMismatch, partial.Index)
+	}
+	if len(partial.Blocks) != (len(piece.Blocks)+7)/8 {
+		return fmt.Errorf("%w: piece %d has a %d byte block bitmap", ErrSnapshotMismatch, partial.Index, len(partial.Blocks))
+	}
+	if spare := len(piece.Blocks) % 8; spare != 0 && partial.Blocks[len(partial.Blocks)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("%w: piece %d has blocks past its end", ErrSnapshotMismatch, partial.Index)
+	}
+	return nil
+}
+
+// store writes the arrived blocks of the piece that are not on disk yet
+// and returns the bitmap of its arrived blocks, unless none have arrived
+// or the piece is verified
+func (p *Piece) store(writer BlockDiskManager) (PartialPiece, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.State == PieceStateVerified || p.doneBlocks == 0 {
+		return PartialPiece{}, false, nil
+	}
+	for i, block := range p.Blocks {
+		if !p.blockDone(i) || p.blockStored(i) {
+			continue
+		}
+		if err := writer.WriteBlock(p.Index, block.Begin, block.Data); err != nil {
+			return PartialPiece{}, false, err
+		}
+		p.setBlockStored(i)
+	}
+	return PartialPiece{Index: p.Index, Blocks: append([]byte(nil), p.done...)}, true, nil
+}
+
+// markStored records that block i is on disk already
+func (p *Piece) markStored(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setBlockStored(i)
+}
+
+// blockStored returns true if block i has been written to disk (must hold
+// p.mu)
+func (p *Piece) blockStored(i int) bool {
+	return p.stored != nil && p.stored[i/8]&(0x80>>(i%8)) != 0
+}
+
+// setBlockStored records that block i has been written to disk (must hold
+// p.mu for writing)
+func (p *Piece) setBlockStored(i int) {
+	if p.stored == nil {
+		p.stored = make([]byte, len(p.done))
+	}
+	p.stored[i/8] |= 0x80 >> (i % 8)
+}
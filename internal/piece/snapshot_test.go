@@ -0,0 +1,116 @@
+package piece
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// blockDisk is a hashDisk that keeps the blocks written to it
+type blockDisk struct {
+	hashDisk
+	blocks map[[2]int][]byte
+	writes int
+}
+
+func newBlockDisk(hashes [][20]byte) *blockDisk {
+	return &blockDisk{hashDisk: hashDisk{hashes: hashes}, blocks: make(map[[2]int][]byte)}
+}
+
+func (d *blockDisk) WriteBlock(pieceIndex, begin int, data []byte) error {
+	d.blocks[[2]int{pieceIndex, begin}] = append([]byte(nil), data...)
+	d.writes++
+	return nil
+}
+
+func (d *blockDisk) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
+	data, ok := d.blocks[[2]int{pieceIndex, begin}]
+	if !ok {
+		return nil, errors.New("block not written")
+	}
+	return data, nil
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	good := bytes.Repeat([]byte{7}, 2*BlockSize)
+	hashes := make([][20]byte, 4)
+	for i := range hashes {
+		hashes[i] = sha1.Sum(good)
+	}
+	// Both managers share the disk, as they would the torrent's files
+	disk := newBlockDisk(hashes)
+	newManager := func() *Manager {
+		m := NewManager(4, 2*BlockSize, 0, hashes)
+		m.SetDiskManager(disk)
+		return m
+	}
+
+	m := newManager()
+	m.MarkPieceVerified(0)
+	m.AddBlockData(1, BlockSize, good[BlockSize:])
+	m.AddBlockData(2, 0, good[:BlockSize])
+	m.AddBlockData(3, 0, good[:BlockSize])
+
+	// Blocks are written to disk once, however many snapshots are taken
+	m.Snapshot()
+	snapshot := m.Snapshot()
+	if disk.writes != 3 {
+		t.Errorf("%d blocks written, want 3", disk.writes)
+	}
+
+	// The snapshot survives encoding, as it would between processes
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var s Snapshot
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(s.Partial) != 3 || s.Partial[0].Index != 1 || s.Partial[0].Blocks[0] != 0x40 {
+		t.Fatalf("partial pieces = %+v, want block 1 of piece 1 and block 0 of pieces 2 and 3", s.Partial)
+	}
+
+	// A block lost from disk is downloaded again
+	delete(disk.blocks, [2]int{3, 0})
+
+	restored := newManager()
+	restored.AddBlockData(2, BlockSize, good[BlockSize:])
+	if err := restored.Restore(s); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored.Wait()
+
+	if !restored.HasPiece(0) {
+		t.Error("verified piece not restored")
+	}
+	if got := restored.GetPiece(1).DownloadedBlocks(); got[0] != 0x40 {
+		t.Errorf("piece 1 blocks = %08b, want 01000000", got)
+	}
+	if got := restored.GetPiece(1).Blocks[1].Data; !bytes.Equal(got, good[BlockSize:]) {
+		t.Error("piece 1 block data not read back from disk")
+	}
+	if got := restored.GetPiece(3).DownloadedBlocks(); got[0] != 0 {
+		t.Errorf("piece 3 blocks = %08b, want none", got)
+	}
+	if !restored.HasPiece(2) {
+		t.Error("piece completed by the snapshot not verified")
+	}
+}
+
+func TestRestoreMismatch(t *testing.T) {
+	m := NewManager(2, 2*BlockSize, 0, make([][20]byte, 2))
+	tests := []Snapshot{
+		{NumPieces: 3, Verified: []byte{0}},
+		{NumPieces: 2, Verified: []byte{0}, Partial: []PartialPiece{{Index: 5, Blocks: []byte{0x80}}}},
+		{NumPieces: 2, Verified: []byte{0}, Partial: []PartialPiece{{Index: 0, Blocks: []byte{0xe0}}}},
+		{NumPieces: 2, Verified: []byte{0}, Partial: []PartialPiece{{Index: 0, Blocks: []byte{0x80, 0}}}},
+	}
+	for i, s := range tests {
+		if err := m.Restore(s); !errors.Is(err, ErrSnapshotMismatch) {
+			t.Errorf("Restore(%d) = %v, want ErrSnapshotMismatch", i, err)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package piece
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"math/rand"
 	"sort"
+	"sync"
 )
 
 // SelectionStrategy defines how pieces are selected for download
@@ -11,7 +14,10 @@ type SelectionStrategy interface {
 }
 
 // SequentialStrategy downloads pieces in order
-type SequentialStrategy struct{}
+type SequentialStrategy struct {
+	mu   sync.Mutex
+	next int // pieces before this one are all verified
+}
 
 // NewSequentialStrategy creates a new sequential strategy
 func NewSequentialStrategy() *SequentialStrategy {
@@ -20,7 +26,17 @@ func NewSequentialStrategy() *SequentialStrategy {
 
 // SelectPiece selects the first missing piece
 func (s *SequentialStrategy) SelectPiece(pieces []*Piece, peerBitfield []byte) *Piece {
-	for i, piece := range pieces {
+	// Skip the verified prefix once rather than on every call
+	s.mu.Lock()
+	for s.next < len(pieces) && pieces[s.next].State == PieceStateVerified {
+		s.next++
+	}
+	start := s.next
+	s.mu.Unlock()
+	
+	for i := start; i < len(pieces); i++ {
+		piece := pieces[i]
+		
 		// Check if we already have this piece
 		if piece.State == PieceStateVerified {
 			continue
@@ -42,10 +58,19 @@ type RandomStrategy struct {
 	rand *rand.Rand
 }
 
-// NewRandomStrategy creates a new random strategy
+// NewRandomStrategy creates a random strategy seeded from crypto/rand, so
+// no two peers or runs pick pieces in the same order
 func NewRandomStrategy() *RandomStrategy {
+	var seed [8]byte
+	crand.Read(seed[:])
+	return NewSeededRandomStrategy(int64(binary.LittleEndian.Uint64(seed[:])))
+}
+
+// NewSeededRandomStrategy creates a random strategy that picks pieces in
+// the same order for the same seed, for tests
+func NewSeededRandomStrategy(seed int64) *RandomStrategy {
 	return &RandomStrategy{
-		rand: rand.New(rand.NewSource(42)), // Fixed seed for reproducibility
+		rand: rand.New(rand.NewSource(seed)),
 	}
 }
 
@@ -74,9 +99,13 @@ func (s *RandomStrategy) SelectPiece(pieces []*Piece, peerBitfield []byte) *Piec
 	return available[s.rand.Intn(len(available))]
 }
 
-// RarestFirstStrategy implements the rarest-first algorithm
+// RarestFirstStrategy implements the rarest-first algorithm. Piece
+// availability is kept up to date as bitfields and haves arrive, so
+// selection does not have to count every peer's pieces.
 type RarestFirstStrategy struct {
+	mu            sync.Mutex
 	peerBitfields map[string][]byte // peerID -> bitfield
+	avail         *availability     // nil until the piece count is known
 }
 
 // NewRarestFirstStrategy creates a new rarest-first strategy
@@ -88,61 +117,86 @@ func NewRarestFirstStrategy() *RarestFirstStrategy {
 
 // UpdatePeerBitfield updates a peer's bitfield
 func (s *RarestFirstStrategy) UpdatePeerBitfield(peerID string, bitfield []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if old, exists := s.peerBitfields[peerID]; exists && s.avail != nil {
+		s.avail.addBitfield(old, -1)
+	}
+	
+	stored := make([]byte, len(bitfield))
+	copy(stored, bitfield)
+	s.peerBitfields[peerID] = stored
+	
+	if s.avail != nil {
+		s.avail.addBitfield(stored, 1)
+	}
+}
+
+// PeerHave records that a peer announced a piece
+func (s *RarestFirstStrategy) PeerHave(peerID string, index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	bitfield, exists := s.peerBitfields[peerID]
+	if !exists {
+		bitfield = make([]byte, index/8+1)
+	} else if index/8 >= len(bitfield) {
+		grown := make([]byte, index/8+1)
+		copy(grown, bitfield)
+		bitfield = grown
+	}
 	s.peerBitfields[peerID] = bitfield
+	
+	if peerHasPiece(bitfield, index) {
+		return
+	}
+	bitfield[index/8] |= 1 << (7 - index%8)
+	
+	if s.avail != nil {
+		s.avail.add(index, 1)
+	}
 }
 
 // RemovePeer removes a peer's bitfield
 func (s *RarestFirstStrategy) RemovePeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if old, exists := s.peerBitfields[peerID]; exists && s.avail != nil {
+		s.avail.addBitfield(old, -1)
+	}
 	delete(s.peerBitfields, peerID)
 }
 
-// pieceRarity represents how rare a piece is
-type pieceRarity struct {
-	index  int
-	rarity int // number of peers who have this piece
-}
-
 // SelectPiece selects the rarest piece that the peer has
 func (s *RarestFirstStrategy) SelectPiece(pieces []*Piece, peerBitfield []byte) *Piece {
-	// Calculate rarity for each piece
-	var candidates []pieceRarity
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	
-	for i, piece := range pieces {
-		// Check if we already have this piece
-		if piece.State == PieceStateVerified {
-			continue
+	if s.avail == nil || len(s.avail.counts) != len(pieces) {
+		// First selection: count the bitfields gathered so far
+		s.avail = newAvailability(len(pieces))
+		for _, bitfield := range s.peerBitfields {
+			s.avail.addBitfield(bitfield, 1)
 		}
-		
-		// Check if this peer has the piece
-		if !peerHasPiece(peerBitfield, i) {
-			continue
+	}
+	
+	for {
+		index := s.avail.rarest(func(i int) bool {
+			return pieces[i].State == PieceStateVerified || peerHasPiece(peerBitfield, i)
+		})
+		if index < 0 {
+			return nil
 		}
 		
-		// Count how many peers have this piece
-		rarity := 0
-		for _, otherBitfield := range s.peerBitfields {
-			if peerHasPiece(otherBitfield, i) {
-				rarity++
-			}
+		// Verified pieces leave the buckets for good
+		if pieces[index].State == PieceStateVerified {
+			s.avail.remove(index)
+			continue
 		}
-		
-		candidates = append(candidates, pieceRarity{
-			index:  i,
-			rarity: rarity,
-		})
+		return pieces[index]
 	}
-	
-	if len(candidates) == 0 {
-		return nil
-	}
-	
-	// Sort by rarity (ascending - rarest first)
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].rarity < candidates[j].rarity
-	})
-	
-	// Return the rarest piece
-	return pieces[candidates[0].index]
 }
 
 // EndGameStrategy is used when only a few pieces remain
@@ -191,22 +245,70 @@ type SmartStrategy struct {
 	random       *RandomStrategy
 	
 	// Configuration
-	sequentialThreshold int // use sequential for first N pieces
-	endGameThreshold    int // switch to end game when N pieces remain
+	bootstrap          BootstrapMode // how the first pieces are picked
+	bootstrapThreshold int           // use the bootstrap mode for the first N pieces
+	endGameThreshold   int           // switch to end game when N pieces remain
+}
+
+// Default SmartStrategy thresholds
+const (
+	DefaultEndGamePieces    = 10 // pieces left when end game starts
+	DefaultEndGameAnyPieces = 5  // pieces left when end game takes any piece
+)
+
+// SmartOption configures a SmartStrategy
+type SmartOption func(*SmartStrategy)
+
+// WithBootstrap sets how the first pieces are picked and how many
+func WithBootstrap(mode BootstrapMode, pieces int) SmartOption {
+	return func(s *SmartStrategy) {
+		s.bootstrap = mode
+		s.bootstrapThreshold = pieces
+	}
 }
 
-// NewSmartStrategy creates a new smart strategy
-func NewSmartStrategy() *SmartStrategy {
+// WithEndGamePieces sets how many pieces are left when selection passes
+// to the end game strategy
+func WithEndGamePieces(pieces int) SmartOption {
+	return func(s *SmartStrategy) {
+		s.endGameThreshold = pieces
+	}
+}
+
+// WithEndGameAnyPieces sets how many pieces are left when the end game
+// strategy takes any piece a peer has rather than the rarest
+func WithEndGameAnyPieces(pieces int) SmartOption {
+	return func(s *SmartStrategy) {
+		s.endGame.threshold = pieces
+	}
+}
+
+// WithRandomSeed seeds the random picks of the bootstrap, so they are the
+// same in every run, for tests
+func WithRandomSeed(seed int64) SmartOption {
+	return func(s *SmartStrategy) {
+		s.random = NewSeededRandomStrategy(seed)
+	}
+}
+
+// NewSmartStrategy creates a new smart strategy. By default it picks the
+// first DefaultBootstrapPieces pieces in order and enters end game with
+// DefaultEndGamePieces left.
+func NewSmartStrategy(opts ...SmartOption) *SmartStrategy {
 	rarestFirst := NewRarestFirstStrategy()
 	
-	return &SmartStrategy{
+	s := &SmartStrategy{
 		sequential:          &SequentialStrategy{},
 		rarestFirst:         rarestFirst,
-		endGame:            NewEndGameStrategy(5, rarestFirst),
+		endGame:            NewEndGameStrategy(DefaultEndGameAnyPieces, rarestFirst),
 		random:             NewRandomStrategy(),
-		sequentialThreshold: 4,  // Download first 4 pieces sequentially
-		endGameThreshold:    10, // Switch to end game at 10 pieces
+		bootstrapThreshold:  DefaultBootstrapPieces,
+		endGameThreshold:    DefaultEndGamePieces,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // UpdatePeerBitfield updates peer information for rarest-first
@@ -214,6 +316,11 @@ func (s *SmartStrategy) UpdatePeerBitfield(peerID string, bitfield []byte) {
 	s.rarestFirst.UpdatePeerBitfield(peerID, bitfield)
 }
 
+// PeerHave records that a peer announced a piece
+func (s *SmartStrategy) PeerHave(peerID string, index int) {
+	s.rarestFirst.PeerHave(peerID, index)
+}
+
 // RemovePeer removes peer information
 func (s *SmartStrategy) RemovePeer(peerID string) {
 	s.rarestFirst.RemovePeer(peerID)
@@ -233,9 +340,13 @@ func (s *SmartStrategy) SelectPiece(pieces []*Piece, peerBitfield []byte) *Piece
 	
 	remaining := total - completed
 	
-	// Use sequential for the first few pieces
-	if completed < s.sequentialThreshold {
-		if piece := s.sequential.SelectPiece(pieces, peerBitfield); piece != nil {
+	// Use the bootstrap mode for the first few pieces
+	if completed < s.bootstrapThreshold {
+		bootstrap := SelectionStrategy(s.sequential)
+		if s.bootstrap == BootstrapRandom {
+			bootstrap = s.random
+		}
+		if piece := bootstrap.SelectPiece(pieces, peerBitfield); piece != nil {
 			return piece
 		}
 	}
@@ -328,18 +439,19 @@ func peerHasPiece(bitfield []byte, pieceIndex int) bool {
 	return (bitfield[byteIndex] & (1 << (7 - bitIndex))) != 0
 }
 
-// GetStrategyByName returns a strategy by name
+// GetStrategyByName returns the strategy registered under name, or a
+// sequential one if there is none
 func GetStrategyByName(name string) SelectionStrategy {
-	switch name {
-	case "sequential":
-		return &SequentialStrategy{}
-	case "random":
-		return NewRandomStrategy()
-	case "rarest-first":
-		return NewRarestFirstStrategy()
-	case "smart":
-		return NewSmartStrategy()
-	default:
-		return &SequentialStrategy{} // default
-	}
-}
\ No newline at end of file
+	strategy, err := NewStrategy(name)
+	if err != nil {
+		return NewSequentialStrategy()
+	}
+	return strategy
+}
+// PeerTracker is implemented by strategies that need to know which pieces
+// each peer has
+type PeerTracker interface {
+	UpdatePeerBitfield(peerID string, bitfield []byte)
+	PeerHave(peerID string, index int)
+	RemovePeer(peerID string)
+}
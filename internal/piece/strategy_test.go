@@ -2,6 +2,7 @@ package piece
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -114,6 +115,31 @@ func TestRandomStrategy(t *testing.T) {
 	}
 }
 
+func TestRandomStrategySeed(t *testing.T) {
+	pieces := createTestPieces(100)
+	all := make([]int, 100)
+	for i := range all {
+		all[i] = i
+	}
+	peerBitfield := createBitfield(100, all)
+	
+	picks := func(strategy *RandomStrategy) []int {
+		var indexes []int
+		for i := 0; i < 20; i++ {
+			indexes = append(indexes, strategy.SelectPiece(pieces, peerBitfield).Index)
+		}
+		return indexes
+	}
+	
+	if a, b := picks(NewSeededRandomStrategy(7)), picks(NewSeededRandomStrategy(7)); !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed picked %v and %v", a, b)
+	}
+	// 20 picks out of 100 pieces matching by chance is vanishingly unlikely
+	if a, b := picks(NewRandomStrategy()), picks(NewRandomStrategy()); reflect.DeepEqual(a, b) {
+		t.Errorf("two random strategies both picked %v", a)
+	}
+}
+
 func TestRarestFirstStrategy(t *testing.T) {
 	strategy := NewRarestFirstStrategy()
 	pieces := createTestPieces(5)
@@ -261,6 +287,40 @@ func TestSmartStrategy(t *testing.T) {
 	// Should prefer pieces that are rarer
 }
 
+func TestSmartStrategyOptions(t *testing.T) {
+	all := make([]int, 20)
+	for i := range all {
+		all[i] = i
+	}
+	
+	tests := []struct {
+		name string
+		opts []SmartOption
+		want int
+	}{
+		// 5 pieces left: end game takes the first piece the peer has
+		{"defaults", nil, 15},
+		// Not yet in end game: the piece the other peer lacks is rarest
+		{"late end game", []SmartOption{WithEndGamePieces(3), WithEndGameAnyPieces(3)}, 19},
+		// In end game, but still picking the rarest
+		{"late any piece", []SmartOption{WithEndGameAnyPieces(2)}, 19},
+	}
+	
+	for _, tt := range tests {
+		strategy := NewSmartStrategy(tt.opts...)
+		pieces := createTestPieces(20)
+		for i := 0; i < 15; i++ {
+			pieces[i].State = PieceStateVerified
+		}
+		strategy.UpdatePeerBitfield("peer1", createBitfield(20, all[:19]))
+		
+		selected := strategy.SelectPiece(pieces, createBitfield(20, all))
+		if selected == nil || selected.Index != tt.want {
+			t.Errorf("%s: selected %v, want piece %d", tt.name, selected, tt.want)
+		}
+	}
+}
+
 func TestPriorityStrategy(t *testing.T) {
 	baseStrategy := NewSequentialStrategy()
 	strategy := NewPriorityStrategy(baseStrategy)
@@ -373,4 +433,33 @@ func TestGetStrategyByName(t *testing.T) {
 			t.Errorf("GetStrategyByName(%s) = %s, want %s", tt.name, strategyType, tt.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestManagerFeedsPeerTracker(t *testing.T) {
+	m := NewManager(3, BlockSize, BlockSize, make([][20]byte, 3))
+	m.SetSelectionStrategy(NewRarestFirstStrategy())
+	all := createBitfield(3, []int{0, 1, 2})
+
+	m.UpdatePeerBitfield("peer1", createBitfield(3, []int{0, 1}))
+	m.UpdatePeerBitfield("peer2", createBitfield(3, []int{0}))
+	m.PeerHave("peer2", 2)
+	m.PeerHave("peer3", 2)
+
+	// Counts are 2, 1, 2
+	if got, err := m.SelectPieceForPeer(all); err != nil || got != 1 {
+		t.Errorf("SelectPieceForPeer = %d, %v, want 1", got, err)
+	}
+
+	// Counts are 1, 0, 2 without peer1, then 1, 2, 2
+	m.RemovePeer("peer1")
+	m.PeerHave("peer3", 1)
+	m.PeerHave("peer2", 1)
+	if got, err := m.SelectPieceForPeer(all); err != nil || got != 0 {
+		t.Errorf("SelectPieceForPeer = %d, %v, want 0", got, err)
+	}
+
+	// Strategies that do not track peers are left alone
+	m.SetSelectionStrategy(NewSequentialStrategy())
+	m.UpdatePeerBitfield("peer1", all)
+	m.RemovePeer("peer1")
+}
@@ -0,0 +1,60 @@
+package piece
+
+import "errors"
+
+// ErrDuplicateBlock is returned for a block that has already arrived, or
+// whose piece is verified. Its bytes are counted as wasted.
+var ErrDuplicateBlock = errors.New("block already downloaded")
+
+// WasteHandler is implemented by ban handlers that also account for the
+// data each peer sent that was thrown away
+type WasteHandler interface {
+	// BytesWasted is called with the bytes of a source's blocks that were
+	// discarded, as duplicates or as part of a piece that failed
+	// verification
+	BytesWasted(source string, n int64)
+}
+
+// wasted counts bytes thrown away, by source, towards the statistics and
+// tells the ban handler, if it accounts for them
+func (m *Manager) wasted(bySource map[string]int64) {
+	var total int64
+	for _, n := range bySource {
+		total += n
+	}
+	m.stats.mu.Lock()
+	m.stats.BytesWasted += total
+	m.stats.mu.Unlock()
+
+	m.mu.RLock()
+	handler, _ := m.banHandler.(WasteHandler)
+	m.mu.RUnlock()
+	if handler == nil {
+		return
+	}
+	for source, n := range bySource {
+		if source != "" {
+			handler.BytesWasted(source, n)
+		}
+	}
+}
+
+// cancelOthers cancels the requests for a block that has arrived from
+// source at every other peer they are outstanding at, as when the block
+// was requested twice in the endgame or an HTTP seed supplied it, so the
+// peers do not send it only for it to be thrown away as a duplicate
+func (m *Manager) cancelOthers(index, begin int, source string) {
+	for _, req := range m.requests.Arrived(index, begin, source) {
+		m.log().Debug("Cancelling request for a block that arrived from another peer", "piece", index, "begin", begin, "peer", req.Peer, "from", source)
+		req.Cancel()
+	}
+}
+
+// blockSources returns the bytes of blocks each source supplied
+func blockSources(blocks []Block) map[string]int64 {
+	bySource := make(map[string]int64)
+	for _, block := range blocks {
+		bySource[block.Source] += int64(block.Length)
+	}
+	return bySource
+}
@@ -0,0 +1,55 @@
+package piece
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBytesWasted(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, 2*BlockSize)
+	bad := bytes.Repeat([]byte{2}, 2*BlockSize)
+	m, bans := newBanTestManager(good)
+
+	// A failed piece wastes the blocks of each peer that sent them
+	attempt(m, bad, [2]string{"a", "b"})
+	if got := m.GetStatistics().BytesWasted; got != 2*BlockSize {
+		t.Errorf("BytesWasted after a hash failure = %d, want %d", got, 2*BlockSize)
+	}
+	if bans.wasted["a"] != BlockSize || bans.wasted["b"] != BlockSize {
+		t.Errorf("wasted by source = %v, want a block each from a and b", bans.wasted)
+	}
+
+	// So does a block that arrives twice
+	m.AddBlockDataFrom(0, 0, good[:BlockSize], "a")
+	err := m.AddBlockDataFrom(0, 0, good[:BlockSize], "c")
+	if !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("duplicate block = %v, want ErrDuplicateBlock", err)
+	}
+	if got := m.GetStatistics().BytesWasted; got != 3*BlockSize {
+		t.Errorf("BytesWasted after a duplicate = %d, want %d", got, 3*BlockSize)
+	}
+	if bans.wasted["c"] != BlockSize {
+		t.Errorf("wasted by c = %d, want %d", bans.wasted["c"], BlockSize)
+	}
+}
+
+func TestBlockFromElsewhereCancelsRequest(t *testing.T) {
+	m := NewManager(1, 2*BlockSize, 0, make([][20]byte, 1))
+	cancelled := 0
+	for _, begin := range []int{0, BlockSize} {
+		m.Requests().Add(Request{Piece: 0, Begin: begin, Length: BlockSize, Peer: "a"}, func() { cancelled++ }, false)
+	}
+
+	// The peer asked for the block delivers it; its request is completed
+	// by the coordinator, not cancelled
+	m.AddBlockDataFrom(0, 0, make([]byte, BlockSize), "a")
+	if cancelled != 0 || !m.Requests().Requested(0, 0) {
+		t.Error("request at the sender cancelled")
+	}
+
+	m.AddBlockDataFrom(0, BlockSize, make([]byte, BlockSize), "httpseed:x")
+	if cancelled != 1 || m.Requests().Requested(0, BlockSize) {
+		t.Errorf("cancelled %d requests, want the one at a", cancelled)
+	}
+}
@@ -0,0 +1,134 @@
+// Package ratelimit throttles byte streams to a configured rate. Limiters
+// are shared by many connections, so a session-wide limit applies to the
+// total transfer of every peer.
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxChunk is the largest read or write passed to the connection at once,
+// so a single large write cannot run far ahead of the limit
+const MaxChunk = 32 * 1024
+
+// Limiter is a token bucket allowing a number of bytes per second. Bytes
+// may be taken before they are available; the caller then waits for the
+// debt to be paid off.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing rate bytes per second; 0 means no
+// limit
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Rate returns the limit in bytes per second, 0 if there is none
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the limit; 0 removes it
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// Wait blocks until n bytes may be transferred
+func (l *Limiter) Wait(n int) {
+	if d := l.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait for
+// them to be available
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call, keeping at most one
+// second's worth (must hold l.mu)
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if elapsed <= 0 || l.rate <= 0 {
+		return
+	}
+	l.tokens += elapsed * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// Conn is a connection whose reads and writes are throttled
+type Conn struct {
+	net.Conn
+	read, write *Limiter
+}
+
+// NewConn wraps conn so reads wait on read and writes on write. Either
+// limiter may be nil.
+func NewConn(conn net.Conn, read, write *Limiter) *Conn {
+	return &Conn{Conn: conn, read: read, write: write}
+}
+
+// Read reads at most MaxChunk bytes and then waits for them to be allowed
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(p)
+	}
+	if len(p) > MaxChunk {
+		p = p[:MaxChunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.read.Wait(n)
+	return n, err
+}
+
+// Write writes p in chunks of at most MaxChunk bytes, waiting before each
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > MaxChunk {
+			chunk = chunk[:MaxChunk]
+		}
+		c.write.Wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
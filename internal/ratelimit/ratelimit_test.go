@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	start := time.Now()
+	l := NewLimiter(1000)
+	l.last = start
+
+	tests := []struct {
+		name  string
+		n     int
+		after time.Duration
+		want  time.Duration
+	}{
+		{"burst", 1000, 0, 0},
+		{"empty bucket", 500, 0, 500 * time.Millisecond},
+		{"debt paid", 100, 600 * time.Millisecond, 0},
+		{"refill capped", 1500, 10 * time.Second, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := l.reserve(tt.n, start.Add(tt.after))
+		if got != tt.want {
+			t.Errorf("%s: reserve(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l := NewLimiter(0)
+	if d := l.reserve(1<<30, time.Now()); d != 0 {
+		t.Errorf("reserve without limit = %v, want 0", d)
+	}
+
+	l.SetRate(100)
+	if d := l.reserve(200, time.Now()); d <= 0 {
+		t.Errorf("reserve after SetRate = %v, want a wait", d)
+	}
+	l.SetRate(0)
+	if d := l.reserve(200, time.Now()); d != 0 {
+		t.Errorf("reserve after removing limit = %v, want 0", d)
+	}
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	const rate = 64 * 1024
+	limited := NewConn(client, nil, NewLimiter(rate))
+	data := bytes.Repeat([]byte("x"), 2*rate)
+
+	go func() {
+		limited.Write(data)
+	}()
+
+	start := time.Now()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	// The first second's worth is the burst, the second must wait
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("wrote %d bytes at %d B/s in %v, want about 1s", len(data), rate, elapsed)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data changed in transit")
+	}
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAddr is where the daemon serves the API unless told otherwise
+const DefaultAddr = "127.0.0.1:9080"
+
+// ClientTimeout bounds a single call
+const ClientTimeout = 30 * time.Second
+
+// Client calls a Server over HTTP
+type Client struct {
+	url    string
+	token  string
+	http   *http.Client
+	nextID atomic.Int64
+}
+
+// NewClient returns a client for the server at url, e.g.
+// "http://127.0.0.1:9080/". token may be empty.
+func NewClient(url, token string) *Client {
+	return &Client{url: url, token: token, http: &http.Client{Timeout: ClientTimeout}}
+}
+
+// NewUnixClient returns a client for a server listening on a unix socket
+func NewUnixClient(socket, token string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{
+		url:   "http://unix/",
+		token: token,
+		http:  &http.Client{Timeout: ClientTimeout, Transport: transport},
+	}
+}
+
+// Call invokes method with params and decodes its result into result,
+// which may be nil. Errors returned by the server are *Error.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      c.nextID.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+func TestClient(t *testing.T) {
+	server := newTestServer(t, "secret")
+	ctx := context.Background()
+
+	client := NewClient(server.URL, "secret")
+	var status session.Status
+	err := client.Call(ctx, "torrent.add", map[string]interface{}{
+		"metainfo": testTorrentData(t, "client.bin"),
+	}, &status)
+	if err != nil {
+		t.Fatalf("torrent.add failed: %v", err)
+	}
+	if status.Name != "client.bin" {
+		t.Errorf("Name = %q, want client.bin", status.Name)
+	}
+
+	var rpcErr *Error
+	err = client.Call(ctx, "torrent.get", map[string]string{"infoHash": "00"}, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams {
+		t.Errorf("torrent.get error = %v, want code %d", err, CodeInvalidParams)
+	}
+
+	if err := NewClient(server.URL, "wrong").Call(ctx, "torrent.list", nil, nil); err == nil {
+		t.Error("call with the wrong token succeeded")
+	}
+}
+
+func TestUnixClient(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "rpc.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	go http.Serve(listener, NewServer(newTestSession(t), ""))
+	t.Cleanup(func() { listener.Close() })
+
+	var list []session.Status
+	if err := NewUnixClient(socket, "").Call(context.Background(), "torrent.list", nil, &list); err != nil {
+		t.Fatalf("torrent.list failed: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("torrent.list returned %d torrents, want 0", len(list))
+	}
+}
@@ -0,0 +1,473 @@
+// Package rpc exposes session operations as JSON-RPC 2.0 over HTTP, so
+// the client can run headless and be driven by other programs.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// MaxRequestSize limits the body of a request, which may carry a
+// .torrent file
+const MaxRequestSize = 16 * 1024 * 1024
+
+// JSON-RPC error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	// Application errors
+	CodeTorrentNotFound  = -32001
+	CodeDuplicateTorrent = -32002
+	CodeNotRunning       = -32003
+	CodeLabelNotFound    = -32004
+)
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// request is a JSON-RPC request; a missing id makes it a notification
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// response is a JSON-RPC response
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// method handles the params of one call
+type method func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// Server answers JSON-RPC calls for a session
+type Server struct {
+	session *session.Session
+	token   string
+	methods map[string]method
+}
+
+// NewServer creates a server controlling s. Calls must carry token as a
+// bearer token unless it is empty.
+func NewServer(s *session.Session, token string) *Server {
+	srv := &Server{session: s, token: token}
+	srv.methods = map[string]method{
+		"session.stats":            srv.sessionStats,
+		"session.history":          srv.sessionHistory,
+		"session.setLimits":        srv.setLimits,
+		"session.setAltSpeed":      srv.setAltSpeed,
+		"torrent.list":             srv.list,
+		"torrent.get":              srv.get,
+		"torrent.history":          srv.torrentHistory,
+		"torrent.add":              srv.add,
+		"torrent.start":            srv.action((*session.Handle).Start),
+		"torrent.pause":            srv.action((*session.Handle).Pause),
+		"torrent.resume":           srv.action((*session.Handle).Resume),
+		"torrent.stop":             srv.action(stop),
+		"torrent.remove":           srv.remove,
+		"torrent.setQueuePosition": srv.setQueuePosition,
+		"torrent.setLabel":         srv.setLabel,
+		"label.list":               srv.labels,
+		"label.set":                srv.putLabel,
+		"label.remove":             srv.removeLabel,
+	}
+	return srv
+}
+
+// ServeHTTP answers a single JSON-RPC call sent as a POST body
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !srv.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxRequestSize+1))
+	if err != nil || len(body) > MaxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp, ok := srv.call(r.Context(), body)
+	if !ok {
+		// A notification gets no response
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authorized checks the bearer token
+func (srv *Server) authorized(r *http.Request) bool {
+	if srv.token == "" {
+		return true
+	}
+	want := "Bearer " + srv.token
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// call decodes and runs one request, returning false for notifications
+func (srv *Server) call(ctx context.Context, body []byte) (*response, bool) {
+	resp := &response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		resp.Error = &Error{CodeParseError, "parse error"}
+		return resp, true
+	}
+	if req.ID != nil {
+		resp.ID = req.ID
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &Error{CodeInvalidRequest, "invalid request"}
+		return resp, true
+	}
+
+	m, ok := srv.methods[req.Method]
+	if !ok {
+		resp.Error = &Error{CodeMethodNotFound, fmt.Sprintf("method not found: %s", req.Method)}
+		return resp, req.ID != nil
+	}
+
+	result, err := m(ctx, req.Params)
+	if err != nil {
+		resp.Error = toError(err)
+	} else {
+		resp.Result = result
+	}
+	return resp, req.ID != nil
+}
+
+// toError maps session errors to JSON-RPC error codes
+func toError(err error) *Error {
+	var rpcErr *Error
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, session.ErrTorrentNotFound):
+		return &Error{CodeTorrentNotFound, err.Error()}
+	case errors.Is(err, session.ErrDuplicateTorrent):
+		return &Error{CodeDuplicateTorrent, err.Error()}
+	case errors.Is(err, session.ErrTorrentNotRunning):
+		return &Error{CodeNotRunning, err.Error()}
+	case errors.Is(err, session.ErrLabelNotFound):
+		return &Error{CodeLabelNotFound, err.Error()}
+	case errors.Is(err, session.ErrInvalidLabel):
+		return &Error{CodeInvalidParams, err.Error()}
+	default:
+		return &Error{CodeInternalError, err.Error()}
+	}
+}
+
+// decode unmarshals params into v, rejecting unknown fields
+func decode(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &Error{CodeInvalidParams, fmt.Sprintf("invalid params: %v", err)}
+	}
+	return nil
+}
+
+// torrentParams names a torrent by its hex info hash
+type torrentParams struct {
+	InfoHash string `json:"infoHash"`
+}
+
+// handle finds the torrent named by params
+func (srv *Server) handle(params json.RawMessage) (*session.Handle, error) {
+	var p torrentParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	return srv.lookup(p.InfoHash)
+}
+
+// lookup finds a torrent by its hex info hash
+func (srv *Server) lookup(infoHash string) (*session.Handle, error) {
+	var hash [20]byte
+	if b, err := hex.DecodeString(infoHash); err != nil || len(b) != len(hash) {
+		return nil, &Error{CodeInvalidParams, fmt.Sprintf("invalid info hash %q", infoHash)}
+	} else {
+		copy(hash[:], b)
+	}
+	return srv.session.Get(hash)
+}
+
+// action wraps a handle operation as a method returning the new status
+func (srv *Server) action(op func(*session.Handle) error) method {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		h, err := srv.handle(params)
+		if err != nil {
+			return nil, err
+		}
+		if err := op(h); err != nil {
+			return nil, err
+		}
+		return h.Status(), nil
+	}
+}
+
+// stop adapts Handle.Stop to an action
+func stop(h *session.Handle) error {
+	h.Stop()
+	return nil
+}
+
+// SessionStats is the result of session.stats
+type SessionStats struct {
+	Torrents        int     `json:"torrents"`
+	RunningTorrents int     `json:"runningTorrents"`
+	ActivePeers     int     `json:"activePeers"`
+	Downloaded      int64   `json:"downloaded"`
+	Uploaded        int64   `json:"uploaded"`
+	DownloadRate    float64 `json:"downloadRate"`
+	UploadRate      float64 `json:"uploadRate"`
+	AltSpeed        bool    `json:"altSpeed"`   // alternate rate limits in force
+	ListenPort      uint16  `json:"listenPort"` // 0 if not listening
+}
+
+func (srv *Server) sessionStats(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	stats := srv.session.Stats()
+	return SessionStats{
+		Torrents:        stats.Torrents,
+		RunningTorrents: stats.RunningTorrents,
+		ActivePeers:     stats.ActivePeers,
+		Downloaded:      stats.Transfer.Downloaded,
+		Uploaded:        stats.Transfer.Uploaded,
+		DownloadRate:    stats.Transfer.DownloadRate,
+		UploadRate:      stats.Transfer.UploadRate,
+		AltSpeed:        srv.session.AltSpeed(),
+		ListenPort:      srv.session.ListenPort(),
+	}, nil
+}
+
+func (srv *Server) sessionHistory(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return srv.session.SpeedHistory(), nil
+}
+
+func (srv *Server) torrentHistory(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.handle(params)
+	if err != nil {
+		return nil, err
+	}
+	return h.SpeedHistory(), nil
+}
+
+// limitsParams are the params of session.setLimits
+type limitsParams struct {
+	MaxActiveDownloads int `json:"maxActiveDownloads"`
+	MaxActiveSeeds     int `json:"maxActiveSeeds"`
+}
+
+func (srv *Server) setLimits(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	config := srv.session.Config()
+	p := limitsParams{config.MaxActiveDownloads, config.MaxActiveSeeds}
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	srv.session.SetQueueLimits(p.MaxActiveDownloads, p.MaxActiveSeeds)
+	return p, nil
+}
+
+// altSpeedParams are the params of session.setAltSpeed
+type altSpeedParams struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (srv *Server) setAltSpeed(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p altSpeedParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	srv.session.SetAltSpeed(p.Enabled)
+	return p, nil
+}
+
+func (srv *Server) list(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	handles := srv.session.Torrents()
+	statuses := make([]session.Status, 0, len(handles))
+	for _, h := range handles {
+		statuses = append(statuses, h.Status())
+	}
+	return statuses, nil
+}
+
+func (srv *Server) get(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.handle(params)
+	if err != nil {
+		return nil, err
+	}
+	return h.Status(), nil
+}
+
+// addParams are the params of torrent.add; exactly one source is given
+type addParams struct {
+	Path     string `json:"path"`     // .torrent file on the server
+	URL      string `json:"url"`      // .torrent file over HTTP(S)
+	Metainfo []byte `json:"metainfo"` // .torrent file contents, base64
+	Label    string `json:"label"`
+	SaveDir  string `json:"saveDir"`  // overrides the label's and the session's
+	SeedOnly bool   `json:"seedOnly"` // seed the data already in the save directory
+	Start    bool   `json:"start"`
+}
+
+func (srv *Server) add(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p addParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+
+	opts := session.AddOptions{Label: p.Label, SaveDir: p.SaveDir, SeedOnly: p.SeedOnly}
+	var h *session.Handle
+	var err error
+	switch {
+	case p.Path != "" && p.URL == "" && p.Metainfo == nil:
+		var t *torrent.Torrent
+		t, err = torrent.ParseFile(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		h, err = srv.session.AddWithOptions(t, opts)
+	case p.URL != "" && p.Path == "" && p.Metainfo == nil:
+		h, err = srv.session.AddTorrentURLWithOptions(ctx, p.URL, opts)
+	case p.Metainfo != nil && p.Path == "" && p.URL == "":
+		var t *torrent.Torrent
+		t, err = torrent.Parse(bytes.NewReader(p.Metainfo))
+		if err != nil {
+			return nil, &Error{CodeInvalidParams, fmt.Sprintf("invalid metainfo: %v", err)}
+		}
+		h, err = srv.session.AddWithOptions(t, opts)
+	default:
+		return nil, &Error{CodeInvalidParams, "exactly one of path, url and metainfo is required"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Start {
+		if err := h.Start(); err != nil {
+			return nil, err
+		}
+	}
+	return h.Status(), nil
+}
+
+func (srv *Server) remove(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.handle(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.session.Remove(h.InfoHash()); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// positionParams are the params of torrent.setQueuePosition
+type positionParams struct {
+	InfoHash string `json:"infoHash"`
+	Position int    `json:"position"`
+}
+
+func (srv *Server) setQueuePosition(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p positionParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	h, err := srv.lookup(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	h.SetQueuePosition(p.Position)
+	return h.Status(), nil
+}
+
+// setLabelParams are the params of torrent.setLabel; an empty label takes
+// the torrent's label away
+type setLabelParams struct {
+	InfoHash string `json:"infoHash"`
+	Label    string `json:"label"`
+}
+
+func (srv *Server) setLabel(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p setLabelParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	h, err := srv.lookup(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.SetLabel(p.Label); err != nil {
+		return nil, err
+	}
+	return h.Status(), nil
+}
+
+func (srv *Server) labels(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	return srv.session.Labels(), nil
+}
+
+// putLabel creates or replaces a label; its params are a session.Label
+func (srv *Server) putLabel(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var l session.Label
+	if err := decode(params, &l); err != nil {
+		return nil, err
+	}
+	if err := srv.session.SetLabel(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// labelParams names a label
+type labelParams struct {
+	Name string `json:"name"`
+}
+
+func (srv *Server) removeLabel(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p labelParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	if err := srv.session.RemoveLabel(p.Name); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
@@ -0,0 +1,330 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+func testTorrentData(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("a", 20),
+			"length":       int64(1000),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	return data
+}
+
+func newTestSession(t *testing.T) *session.Session {
+	t.Helper()
+
+	config := session.DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	s, err := session.New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(NewServer(newTestSession(t), token))
+	t.Cleanup(server.Close)
+	return server
+}
+
+type testResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// call sends a request body and decodes the response
+func call(t *testing.T, server *httptest.Server, body string) testResponse {
+	t.Helper()
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var r testResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return r
+}
+
+// newRequest builds a request body for method with params
+func newRequest(t *testing.T, method string, params interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	return string(data)
+}
+
+func TestErrors(t *testing.T) {
+	server := newTestServer(t, "")
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"parse error", `{"jsonrpc":`, CodeParseError},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"torrent.list"}`, CodeInvalidRequest},
+		{"unknown method", `{"jsonrpc":"2.0","id":1,"method":"torrent.explode"}`, CodeMethodNotFound},
+		{"bad info hash", newRequest(t, "torrent.get", map[string]string{"infoHash": "xyz"}), CodeInvalidParams},
+		{"unknown field", newRequest(t, "torrent.get", map[string]string{"hash": "00"}), CodeInvalidParams},
+		{"no source", newRequest(t, "torrent.add", map[string]string{}), CodeInvalidParams},
+		{"not found", newRequest(t, "torrent.get", map[string]string{"infoHash": strings.Repeat("00", 20)}), CodeTorrentNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := call(t, server, tt.body)
+			if r.Error == nil {
+				t.Fatalf("got result %s, want error %d", r.Result, tt.code)
+			}
+			if r.Error.Code != tt.code {
+				t.Errorf("Code = %d, want %d", r.Error.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestTorrentMethods(t *testing.T) {
+	server := newTestServer(t, "")
+
+	var status session.Status
+	r := call(t, server, newRequest(t, "torrent.add", map[string]interface{}{
+		"metainfo": testTorrentData(t, "rpc.bin"),
+	}))
+	if r.Error != nil {
+		t.Fatalf("torrent.add error: %v", r.Error)
+	}
+	if err := json.Unmarshal(r.Result, &status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if status.Name != "rpc.bin" || status.State != "queued" {
+		t.Errorf("added status = %+v, want rpc.bin queued", status)
+	}
+	if _, err := hex.DecodeString(status.InfoHash); err != nil {
+		t.Errorf("InfoHash = %q, want hex", status.InfoHash)
+	}
+
+	r = call(t, server, newRequest(t, "torrent.add", map[string]interface{}{
+		"metainfo": testTorrentData(t, "rpc.bin"),
+	}))
+	if r.Error == nil || r.Error.Code != CodeDuplicateTorrent {
+		t.Errorf("second torrent.add error = %v, want code %d", r.Error, CodeDuplicateTorrent)
+	}
+
+	hash := map[string]string{"infoHash": status.InfoHash}
+	steps := []struct {
+		method string
+		state  string
+	}{
+		{"torrent.start", "downloading"},
+		{"torrent.pause", "paused"},
+		{"torrent.resume", "downloading"},
+		{"torrent.stop", "stopped"},
+	}
+	for _, step := range steps {
+		r := call(t, server, newRequest(t, step.method, hash))
+		if r.Error != nil {
+			t.Fatalf("%s error: %v", step.method, r.Error)
+		}
+		if err := json.Unmarshal(r.Result, &status); err != nil {
+			t.Fatalf("failed to decode status: %v", err)
+		}
+		if status.State != step.state {
+			t.Errorf("%s state = %s, want %s", step.method, status.State, step.state)
+		}
+	}
+
+	var list []session.Status
+	r = call(t, server, newRequest(t, "torrent.list", nil))
+	if err := json.Unmarshal(r.Result, &list); err != nil {
+		t.Fatalf("failed to decode list: %v", err)
+	}
+	if len(list) != 1 {
+		t.Errorf("torrent.list returned %d torrents, want 1", len(list))
+	}
+
+	r = call(t, server, newRequest(t, "torrent.remove", hash))
+	if r.Error != nil {
+		t.Fatalf("torrent.remove error: %v", r.Error)
+	}
+	r = call(t, server, newRequest(t, "torrent.get", hash))
+	if r.Error == nil || r.Error.Code != CodeTorrentNotFound {
+		t.Errorf("torrent.get after remove error = %v, want code %d", r.Error, CodeTorrentNotFound)
+	}
+}
+
+func TestLabelMethods(t *testing.T) {
+	server := newTestServer(t, "")
+	saveDir := t.TempDir()
+
+	r := call(t, server, newRequest(t, "label.set", map[string]interface{}{
+		"name": "movies", "saveDir": saveDir, "seedTime": 3600,
+	}))
+	if r.Error != nil {
+		t.Fatalf("label.set error: %v", r.Error)
+	}
+	r = call(t, server, newRequest(t, "label.set", map[string]interface{}{"name": ""}))
+	if r.Error == nil || r.Error.Code != CodeInvalidParams {
+		t.Errorf("label.set without a name error = %v, want code %d", r.Error, CodeInvalidParams)
+	}
+
+	var labels []session.Label
+	r = call(t, server, newRequest(t, "label.list", nil))
+	if err := json.Unmarshal(r.Result, &labels); err != nil {
+		t.Fatalf("failed to decode labels: %v", err)
+	}
+	if len(labels) != 1 || labels[0].Name != "movies" || labels[0].SeedTime != time.Hour {
+		t.Errorf("label.list = %+v, want movies with an hour's seed time", labels)
+	}
+
+	var status session.Status
+	r = call(t, server, newRequest(t, "torrent.add", map[string]interface{}{
+		"metainfo": testTorrentData(t, "label.bin"),
+		"label":    "movies",
+	}))
+	if r.Error != nil {
+		t.Fatalf("torrent.add error: %v", r.Error)
+	}
+	if err := json.Unmarshal(r.Result, &status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if status.Label != "movies" || status.SaveDir != saveDir {
+		t.Errorf("added label %q in %s, want movies in %s", status.Label, status.SaveDir, saveDir)
+	}
+
+	r = call(t, server, newRequest(t, "torrent.setLabel", map[string]string{
+		"infoHash": status.InfoHash, "label": "music",
+	}))
+	if r.Error == nil || r.Error.Code != CodeLabelNotFound {
+		t.Errorf("torrent.setLabel to a missing label error = %v, want code %d", r.Error, CodeLabelNotFound)
+	}
+
+	r = call(t, server, newRequest(t, "label.remove", map[string]string{"name": "movies"}))
+	if r.Error != nil {
+		t.Fatalf("label.remove error: %v", r.Error)
+	}
+	var removed session.Status
+	r = call(t, server, newRequest(t, "torrent.get", map[string]string{"infoHash": status.InfoHash}))
+	if err := json.Unmarshal(r.Result, &removed); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if removed.Label != "" {
+		t.Errorf("label after label.remove = %q, want none", removed.Label)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	server := newTestServer(t, "")
+
+	r := call(t, server, newRequest(t, "session.setLimits", map[string]int{"maxActiveSeeds": 2}))
+	if r.Error != nil {
+		t.Fatalf("session.setLimits error: %v", r.Error)
+	}
+
+	var limits limitsParams
+	if err := json.Unmarshal(r.Result, &limits); err != nil {
+		t.Fatalf("failed to decode limits: %v", err)
+	}
+	want := limitsParams{MaxActiveDownloads: session.DefaultMaxActiveDownloads, MaxActiveSeeds: 2}
+	if limits != want {
+		t.Errorf("limits = %+v, want %+v", limits, want)
+	}
+}
+
+func TestSetAltSpeed(t *testing.T) {
+	server := newTestServer(t, "")
+
+	r := call(t, server, newRequest(t, "session.setAltSpeed", map[string]bool{"enabled": true}))
+	if r.Error != nil {
+		t.Fatalf("session.setAltSpeed error: %v", r.Error)
+	}
+
+	var stats SessionStats
+	r = call(t, server, newRequest(t, "session.stats", nil))
+	if err := json.Unmarshal(r.Result, &stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if !stats.AltSpeed {
+		t.Error("session.stats altSpeed = false after turning it on")
+	}
+}
+
+func TestNotification(t *testing.T) {
+	server := newTestServer(t, "")
+
+	resp, err := http.Post(server.URL, "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"torrent.list"}`))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("StatusCode = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestToken(t *testing.T) {
+	server := newTestServer(t, "secret")
+	body := newRequest(t, "session.stats", nil)
+
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte(body)))
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("Authorization %q: StatusCode = %d, want %d", tt.auth, resp.StatusCode, tt.status)
+		}
+	}
+}
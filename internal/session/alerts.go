@@ -0,0 +1,209 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// DefaultAlertBuffer is the channel capacity of an alert subscription
+const DefaultAlertBuffer = 1024
+
+// AlertType identifies something that happened to a torrent
+type AlertType int
+
+const (
+	// AlertPeerConnected means a peer completed the handshake
+	AlertPeerConnected AlertType = iota
+
+	// AlertPeerDisconnected means a peer connection was closed
+	AlertPeerDisconnected
+
+	// AlertPieceVerified means a piece passed the hash check and was stored
+	AlertPieceVerified
+
+	// AlertPieceFailed means a piece failed the hash check
+	AlertPieceFailed
+
+	// AlertTrackerError means an announce to a tracker failed
+	AlertTrackerError
+
+	// AlertMetadataReceived means a torrent's metadata was fetched
+	AlertMetadataReceived
+
+	// AlertTorrentFinished means every piece of a torrent is verified
+	AlertTorrentFinished
+
+	// AlertDiskError means the torrent's files could not be opened,
+	// written or closed
+	AlertDiskError
+
+	// AlertDeadlineMissed means a piece a stream was waiting for could not
+	// be fetched in time and was given back its normal priority
+	AlertDeadlineMissed
+)
+
+var alertNames = map[AlertType]string{
+	AlertPeerConnected:    "peer connected",
+	AlertPeerDisconnected: "peer disconnected",
+	AlertPieceVerified:    "piece verified",
+	AlertPieceFailed:      "piece failed",
+	AlertTrackerError:     "tracker error",
+	AlertMetadataReceived: "metadata received",
+	AlertTorrentFinished:  "torrent finished",
+	AlertDiskError:        "disk error",
+	AlertDeadlineMissed:   "deadline missed",
+}
+
+// String returns the name of the alert type
+func (t AlertType) String() string {
+	if name, ok := alertNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Alert describes one event. Fields that do not apply to the type are
+// left zero.
+type Alert struct {
+	Type     AlertType
+	Time     time.Time
+	InfoHash [20]byte
+	Name     string // torrent name
+	Peer     string // peer address
+	Piece    int    // piece index
+	Tracker  string // announce URL
+	Err      error
+}
+
+// AlertSubscription delivers alerts on C until it is closed. Alerts are
+// dropped rather than delaying the client when C is full.
+type AlertSubscription struct {
+	C <-chan Alert
+
+	c       chan Alert
+	types   map[AlertType]bool // nil for every type
+	dropped atomic.Int64
+	session *Session
+}
+
+// Dropped returns how many alerts did not fit in the channel
+func (a *AlertSubscription) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close stops delivery and closes C
+func (a *AlertSubscription) Close() {
+	a.session.alerts.remove(a)
+}
+
+// alertHub fans alerts out to subscriptions
+type alertHub struct {
+	mu   sync.RWMutex
+	subs []*AlertSubscription
+}
+
+// SubscribeAlerts returns a subscription to the given alert types, or to
+// every type if none are given. buffer is the channel capacity; 0 uses
+// DefaultAlertBuffer.
+func (s *Session) SubscribeAlerts(buffer int, types ...AlertType) *AlertSubscription {
+	if buffer <= 0 {
+		buffer = DefaultAlertBuffer
+	}
+
+	c := make(chan Alert, buffer)
+	sub := &AlertSubscription{C: c, c: c, session: s}
+	if len(types) > 0 {
+		sub.types = make(map[AlertType]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	s.alerts.mu.Lock()
+	defer s.alerts.mu.Unlock()
+	s.alerts.subs = append(s.alerts.subs, sub)
+	return sub
+}
+
+// post delivers an alert to every interested subscription without
+// blocking
+func (hub *alertHub) post(alert Alert) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	for _, sub := range hub.subs {
+		if sub.types != nil && !sub.types[alert.Type] {
+			continue
+		}
+		select {
+		case sub.c <- alert:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// remove closes a subscription
+func (hub *alertHub) remove(sub *AlertSubscription) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for i, s := range hub.subs {
+		if s == sub {
+			hub.subs = append(hub.subs[:i], hub.subs[i+1:]...)
+			close(sub.c)
+			return
+		}
+	}
+}
+
+// closeAll closes every subscription
+func (hub *alertHub) closeAll() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, sub := range hub.subs {
+		close(sub.c)
+	}
+	hub.subs = nil
+}
+
+// alert posts an alert about this torrent
+func (h *Handle) alert(alert Alert) {
+	alert.Time = time.Now()
+	alert.InfoHash = h.torrent.InfoHash
+	alert.Name = h.torrent.Info.Name
+	h.session.alerts.post(alert)
+}
+
+// peerAlerts passes peer events on to the coordinator and reports
+// connections and disconnections as alerts
+type peerAlerts struct {
+	next peer.PeerEventHandler
+	h    *Handle
+}
+
+func (a peerAlerts) HandlePeerEvent(event peer.PeerEvent) {
+	a.next.HandlePeerEvent(event)
+
+	switch event.Type {
+	case peer.PeerConnected:
+		a.h.alert(Alert{Type: AlertPeerConnected, Peer: event.Peer.Address().String()})
+	case peer.PeerDisconnected:
+		a.h.alert(Alert{Type: AlertPeerDisconnected, Peer: event.Peer.Address().String()})
+	}
+}
+
+// pieceAlertType returns the alert for a failed piece: a hash mismatch,
+// or an error storing it
+func pieceAlertType(err error) AlertType {
+	if errors.Is(err, piece.ErrHashMismatch) {
+		return AlertPieceFailed
+	}
+	return AlertDiskError
+}
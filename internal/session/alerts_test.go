@@ -0,0 +1,121 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// receive returns the next queued alert, failing if there is none
+func receive(t *testing.T, sub *AlertSubscription) Alert {
+	t.Helper()
+
+	select {
+	case alert := <-sub.C:
+		return alert
+	default:
+		t.Fatal("no alert queued")
+		return Alert{}
+	}
+}
+
+func TestAlertSubscription(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "alerts.bin")
+
+	all := s.SubscribeAlerts(2)
+	failures := s.SubscribeAlerts(0, AlertPieceFailed, AlertDiskError)
+
+	events := pieceEvents{h}
+	events.HandlePieceVerified(1)
+	events.HandlePieceFailed(2, piece.ErrHashMismatch)
+	events.HandlePieceFailed(3, errors.New("disk full"))
+
+	// The third alert did not fit
+	if got := receive(t, all); got.Type != AlertPieceVerified || got.Piece != 1 || got.InfoHash != h.InfoHash() {
+		t.Errorf("first alert = %+v, want piece 1 verified", got)
+	}
+	if got := receive(t, all); got.Type != AlertPieceFailed || got.Piece != 2 {
+		t.Errorf("second alert = %+v, want piece 2 failed", got)
+	}
+	if all.Dropped() != 1 {
+		t.Errorf("Dropped = %d, want 1", all.Dropped())
+	}
+
+	// Filtered by type
+	if got := receive(t, failures); got.Type != AlertPieceFailed {
+		t.Errorf("first failure = %v, want piece failed", got.Type)
+	}
+	if got := receive(t, failures); got.Type != AlertDiskError || got.Piece != 3 || got.Err == nil {
+		t.Errorf("second failure = %+v, want disk error for piece 3", got)
+	}
+
+	failures.Close()
+	if _, ok := <-failures.C; ok {
+		t.Error("channel still open after Close")
+	}
+	events.HandlePieceFailed(4, piece.ErrHashMismatch)
+	if failures.Dropped() != 0 {
+		t.Error("closed subscription still receiving")
+	}
+}
+
+// nopPeerEvents ignores peer events
+type nopPeerEvents struct{}
+
+func (nopPeerEvents) HandlePeerEvent(peer.PeerEvent) {}
+
+func TestPeerAlerts(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "peers.bin")
+	sub := s.SubscribeAlerts(0)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	p := peer.NewPeer(client, [20]byte{}, [20]byte{})
+
+	handler := peerAlerts{nopPeerEvents{}, h}
+	handler.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerConnected, Peer: p})
+	handler.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerUnchoked, Peer: p})
+	handler.HandlePeerEvent(peer.PeerEvent{Type: peer.PeerDisconnected, Peer: p})
+
+	if got := receive(t, sub); got.Type != AlertPeerConnected || got.Peer != p.Address().String() {
+		t.Errorf("first alert = %+v, want peer connected", got)
+	}
+	if got := receive(t, sub); got.Type != AlertPeerDisconnected {
+		t.Errorf("second alert = %v, want peer disconnected", got.Type)
+	}
+}
+
+func TestMetadataAlert(t *testing.T) {
+	data := testTorrentData(t, "fetched.bin")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	s := newTestSession(t, testConfig(t))
+	sub := s.SubscribeAlerts(0, AlertMetadataReceived)
+
+	h, err := s.AddTorrentURL(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("AddTorrentURL failed: %v", err)
+	}
+	if got := receive(t, sub); got.Name != h.Name() {
+		t.Errorf("alert name = %q, want %q", got.Name, h.Name())
+	}
+
+	// Closing the session ends every subscription
+	s.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("channel still open after the session closed")
+	}
+}
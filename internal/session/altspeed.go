@@ -0,0 +1,217 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AltSpeedCheckInterval is how often the alternate speed schedule is
+// checked
+const AltSpeedCheckInterval = 30 * time.Second
+
+// Schedule is a daily window of time, such as working hours, on some days
+// of the week
+type Schedule struct {
+	Days  []time.Weekday // days the window starts on; empty for every day
+	Start time.Duration  // since midnight
+	End   time.Duration  // since midnight; before Start for a window past midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseSchedule parses a schedule such as "mon-fri 09:00-17:00",
+// "sat,sun 22:00-06:00" or "01:00-07:00". A window ending before it starts
+// runs past midnight into the next day; one ending when it starts lasts all
+// day.
+func ParseSchedule(s string) (*Schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid schedule %q: want [days] HH:MM-HH:MM", s)
+	}
+
+	var sch Schedule
+	if len(fields) == 2 {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", s, err)
+		}
+		sch.Days = days
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid schedule %q: want HH:MM-HH:MM", s)
+	}
+	var err error
+	if sch.Start, err = parseClock(start); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", s, err)
+	}
+	if sch.End, err = parseClock(end); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", s, err)
+	}
+	return &sch, nil
+}
+
+// parseDays parses a comma-separated list of days and ranges of days
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return nil, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		// Ranges wrap around the week, so fri-mon is four days
+		for d := from; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of day as HH:MM
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active returns true if t falls inside the schedule's window. The part of
+// a window past midnight belongs to the day it started on.
+func (sch *Schedule) Active(t time.Time) bool {
+	hour, min, sec := t.Clock()
+	now := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+
+	switch {
+	case sch.Start == sch.End:
+		return sch.onDay(t.Weekday())
+	case sch.Start < sch.End:
+		return now >= sch.Start && now < sch.End && sch.onDay(t.Weekday())
+	case now >= sch.Start:
+		return sch.onDay(t.Weekday())
+	case now < sch.End:
+		return sch.onDay((t.Weekday() + 6) % 7)
+	default:
+		return false
+	}
+}
+
+// onDay returns true if the window starts on day
+func (sch *Schedule) onDay(day time.Weekday) bool {
+	if len(sch.Days) == 0 {
+		return true
+	}
+	for _, d := range sch.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the schedule as ParseSchedule accepts it
+func (sch *Schedule) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	window := clock(sch.Start) + "-" + clock(sch.End)
+	if len(sch.Days) == 0 {
+		return window
+	}
+	names := make([]string, len(sch.Days))
+	for i, d := range sch.Days {
+		names[i] = strings.ToLower(d.String()[:3])
+	}
+	return strings.Join(names, ",") + " " + window
+}
+
+// SetAltSpeed turns the alternate rate limits on or off. Connected peers
+// are throttled right away. With a schedule, the setting lasts until the
+// schedule next starts or ends.
+func (s *Session) SetAltSpeed(enabled bool) {
+	s.mu.Lock()
+	changed := s.altSpeed != enabled
+	s.altSpeed = enabled
+	s.applyRateLimits()
+	s.mu.Unlock()
+
+	if changed {
+		s.logger.Info("Alternate speed limits changed", "enabled", enabled)
+	}
+}
+
+// AltSpeed returns true if the alternate rate limits are in force
+func (s *Session) AltSpeed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.altSpeed
+}
+
+// SetAltRateLimits changes the alternate transfer limits in bytes per
+// second; 0 means no limit
+func (s *Session) SetAltRateLimits(download, upload int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.AltDownloadRateLimit = download
+	s.config.AltUploadRateLimit = upload
+	s.applyRateLimits()
+}
+
+// applyRateLimits sets the limiters to the normal or alternate limits
+// (must hold s.mu)
+func (s *Session) applyRateLimits() {
+	download, upload := s.config.DownloadRateLimit, s.config.UploadRateLimit
+	if s.altSpeed {
+		download, upload = s.config.AltDownloadRateLimit, s.config.AltUploadRateLimit
+	}
+	s.downloadLimit.SetRate(download)
+	s.uploadLimit.SetRate(upload)
+}
+
+// altSpeedLoop switches the alternate rate limits on and off as the
+// schedule starts and ends
+func (s *Session) altSpeedLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(AltSpeedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.checkAltSchedule(now)
+		}
+	}
+}
+
+// checkAltSchedule applies the schedule if it started or ended since the
+// last check, overriding any manual setting
+func (s *Session) checkAltSchedule(now time.Time) {
+	s.mu.Lock()
+	scheduled := s.config.AltSchedule.Active(now)
+	if scheduled == s.altScheduled {
+		s.mu.Unlock()
+		return
+	}
+	s.altScheduled = scheduled
+	s.mu.Unlock()
+
+	s.SetAltSpeed(scheduled)
+}
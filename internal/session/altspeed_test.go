@@ -0,0 +1,134 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"mon-fri 09:00-17:00", "mon,tue,wed,thu,fri 09:00-17:00", true},
+		{"Sat,sun 22:00-06:30", "sat,sun 22:00-06:30", true},
+		{"fri-mon 00:00-00:00", "fri,sat,sun,mon 00:00-00:00", true},
+		{"01:00-07:00", "01:00-07:00", true},
+		{"", "", false},
+		{"mon-fri", "", false},
+		{"someday 09:00-17:00", "", false},
+		{"mon 9-17", "", false},
+		{"mon 09:00-25:00", "", false},
+		{"mon 09:00-17:00 extra", "", false},
+	}
+
+	for _, tt := range tests {
+		sch, err := ParseSchedule(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseSchedule(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if err == nil && sch.String() != tt.want {
+			t.Errorf("ParseSchedule(%q) = %s, want %s", tt.in, sch, tt.want)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	workHours, err := ParseSchedule("mon-fri 09:00-17:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overnight, err := ParseSchedule("fri 22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-01 was a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		time     time.Time
+		want     bool
+	}{
+		{"monday morning", workHours, at(1, 9, 0), true},
+		{"monday before work", workHours, at(1, 8, 59), false},
+		{"monday at the end", workHours, at(1, 17, 0), false},
+		{"saturday", workHours, at(6, 12, 0), false},
+		{"friday night", overnight, at(5, 23, 0), true},
+		{"saturday early", overnight, at(6, 5, 59), true},
+		{"saturday morning", overnight, at(6, 6, 0), false},
+		{"friday early", overnight, at(5, 1, 0), false},
+		{"saturday night", overnight, at(6, 23, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.schedule.Active(tt.time); got != tt.want {
+			t.Errorf("%s: Active = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAltSpeed(t *testing.T) {
+	config := testConfig(t)
+	config.DownloadRateLimit = 1000
+	config.AltDownloadRateLimit = 100
+	config.AltUploadRateLimit = 50
+	s := newTestSession(t, config)
+
+	if s.AltSpeed() {
+		t.Error("AltSpeed is on without a schedule")
+	}
+	s.SetAltSpeed(true)
+	if down, up := s.RateLimits(); down != 100 || up != 50 {
+		t.Errorf("RateLimits() with alternate speed = %d, %d, want 100, 50", down, up)
+	}
+
+	// Normal limits changed meanwhile apply when alternate speed goes off
+	s.SetRateLimits(2000, 0)
+	if down, _ := s.RateLimits(); down != 100 {
+		t.Errorf("download limit after SetRateLimits = %d, want 100 until alternate speed is off", down)
+	}
+	s.SetAltSpeed(false)
+	if down, up := s.RateLimits(); down != 2000 || up != 0 {
+		t.Errorf("RateLimits() after alternate speed = %d, %d, want 2000, 0", down, up)
+	}
+}
+
+func TestAltSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("09:00-17:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	config.AltDownloadRateLimit = 100
+	config.AltSchedule = schedule
+	s := newTestSession(t, config)
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	morning, noon, evening := day.Add(9*time.Hour), day.Add(12*time.Hour), day.Add(17*time.Hour)
+
+	s.checkAltSchedule(morning)
+	if !s.AltSpeed() {
+		t.Fatal("AltSpeed is off once the schedule starts")
+	}
+	if down, _ := s.RateLimits(); down != 100 {
+		t.Errorf("download limit = %d, want 100", down)
+	}
+
+	// Turning it off by hand lasts until the schedule next changes
+	s.SetAltSpeed(false)
+	s.checkAltSchedule(noon)
+	if s.AltSpeed() {
+		t.Error("schedule overrode a manual change before it ended")
+	}
+	s.SetAltSpeed(true)
+	s.checkAltSchedule(evening)
+	if s.AltSpeed() {
+		t.Error("AltSpeed is on after the schedule ended")
+	}
+}
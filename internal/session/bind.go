@@ -0,0 +1,162 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// BindCheckInterval is how often the bind address is checked when
+// BindKillSwitch is set
+const BindCheckInterval = 5 * time.Second
+
+// ErrBindUnavailable is returned, and recorded on torrents paused by the
+// kill switch, when the bind address is not assigned to an interface that
+// is up
+var ErrBindUnavailable = errors.New("bind address unavailable")
+
+// resolveBindAddress returns the local IP for a bind address: an IP
+// assigned to an interface that is up, or the name of such an interface,
+// whose first IPv4 address is preferred
+func resolveBindAddress(bind string) (net.IP, error) {
+	if ip := net.ParseIP(bind); ip != nil {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 {
+				continue
+			}
+			for _, addr := range interfaceIPs(iface) {
+				if addr.Equal(ip) {
+					return ip, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%w: %s is not assigned to an interface that is up", ErrBindUnavailable, bind)
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBindUnavailable, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("%w: interface %s is down", ErrBindUnavailable, bind)
+	}
+	var found net.IP
+	for _, ip := range interfaceIPs(*iface) {
+		if ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip, nil
+		}
+		if found == nil {
+			found = ip
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: interface %s has no address", ErrBindUnavailable, bind)
+	}
+	return found, nil
+}
+
+// interfaceIPs returns the IPs assigned to an interface
+func interfaceIPs(iface net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// boundTransport returns an HTTP transport whose connections are made
+// from ip
+func boundTransport(ip net.IP) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// BindAvailable returns false while the kill switch has found the bind
+// address gone
+func (s *Session) BindAvailable() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.bindDown
+}
+
+// bindLoop checks the bind address until the session closes
+func (s *Session) bindLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(BindCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		ip, err := resolveBindAddress(s.config.BindAddress)
+		if err == nil && !ip.Equal(s.bindIP) {
+			// Connections made from the old address are gone either way
+			err = fmt.Errorf("%w: %s now has %s", ErrBindUnavailable, s.config.BindAddress, ip)
+		}
+		s.setBindAvailable(err)
+	}
+}
+
+// setBindAvailable pauses every running torrent when the bind address is
+// lost, err saying why, and resumes them once it is back (err is nil)
+func (s *Session) setBindAvailable(err error) {
+	s.mu.Lock()
+	if s.bindDown == (err != nil) {
+		s.mu.Unlock()
+		return
+	}
+	s.bindDown = err != nil
+	paused := s.bindPaused
+	s.bindPaused = nil
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("Bind address lost, pausing all torrents", "err", err)
+		for _, h := range s.Torrents() {
+			h.lifecycle.Lock()
+			if h.State().Active() {
+				h.pause(err)
+				paused = append(paused, h)
+			}
+			h.lifecycle.Unlock()
+		}
+		s.mu.Lock()
+		s.bindPaused = paused
+		s.mu.Unlock()
+		s.persist()
+		return
+	}
+
+	s.logger.Info("Bind address is back, resuming torrents")
+	for _, h := range paused {
+		if h.State() == StatePaused {
+			h.Resume()
+		}
+	}
+}
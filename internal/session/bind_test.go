@@ -0,0 +1,96 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces failed: %v", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestResolveBindAddress(t *testing.T) {
+	tests := []struct {
+		bind string
+		want net.IP
+	}{
+		{"127.0.0.1", net.IPv4(127, 0, 0, 1)},
+		{loopbackInterface(t), net.IPv4(127, 0, 0, 1)},
+		{"192.0.2.1", nil},
+		{"no-such-if0", nil},
+	}
+	for _, tt := range tests {
+		ip, err := resolveBindAddress(tt.bind)
+		if tt.want == nil {
+			if !errors.Is(err, ErrBindUnavailable) {
+				t.Errorf("resolveBindAddress(%q) error = %v, want %v", tt.bind, err, ErrBindUnavailable)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveBindAddress(%q) failed: %v", tt.bind, err)
+		} else if !ip.Equal(tt.want) {
+			t.Errorf("resolveBindAddress(%q) = %v, want %v", tt.bind, ip, tt.want)
+		}
+	}
+}
+
+func TestNewRejectsMissingBindAddress(t *testing.T) {
+	config := testConfig(t)
+	config.BindAddress = "192.0.2.1"
+
+	if _, err := New(config); !errors.Is(err, ErrBindUnavailable) {
+		t.Errorf("New error = %v, want %v", err, ErrBindUnavailable)
+	}
+}
+
+func TestListenBindAddress(t *testing.T) {
+	config := testConfig(t)
+	config.ListenPort = 0
+	config.BindAddress = "127.0.0.1"
+	s := newTestSession(t, config)
+
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if ip := s.Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("listener IP = %v, want 127.0.0.1", ip)
+	}
+}
+
+func TestBindKillSwitch(t *testing.T) {
+	s, h := startListeningTorrent(t)
+	if !h.State().Active() {
+		t.Fatalf("State = %v, want an active state", h.State())
+	}
+
+	s.setBindAvailable(ErrBindUnavailable)
+	if h.State() != StatePaused {
+		t.Errorf("State after losing the bind address = %v, want %v", h.State(), StatePaused)
+	}
+	if !errors.Is(h.Err(), ErrBindUnavailable) {
+		t.Errorf("Err = %v, want %v", h.Err(), ErrBindUnavailable)
+	}
+	if err := h.Resume(); !errors.Is(err, ErrBindUnavailable) {
+		t.Errorf("Resume error = %v, want %v", err, ErrBindUnavailable)
+	}
+
+	s.setBindAvailable(nil)
+	if !h.State().Active() {
+		t.Errorf("State after the bind address came back = %v, want an active state", h.State())
+	}
+}
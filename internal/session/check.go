@@ -0,0 +1,50 @@
+package session
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mt/bittorrent-impl/internal/disk"
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// hasData returns true if any of the torrent's files already exists and
+// is not empty
+func (h *Handle) hasData() bool {
+	for _, file := range h.torrent.GetFiles() {
+		if fi, err := os.Stat(filepath.Join(h.saveDir, file.Path)); err == nil && fi.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPieces hashes the data on disk and marks the pieces that match as
+// verified. It gives up if the session closes.
+func (h *Handle) checkPieces(diskManager *disk.Manager, pieceManager *piece.Manager) error {
+	h.logger.Info("Checking existing data")
+
+	for index := 0; index < h.torrent.NumPieces(); index++ {
+		select {
+		case <-h.session.done:
+			return ErrSessionClosed
+		default:
+		}
+
+		data, err := diskManager.ReadPiece(index)
+		if err != nil {
+			err = fmt.Errorf("failed to check piece %d: %w", index, err)
+			h.alert(Alert{Type: AlertDiskError, Err: err})
+			return err
+		}
+		if diskManager.VerifyPiece(index, data) {
+			if err := pieceManager.MarkPieceVerified(index); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.logger.Info("Checked existing data", "progress", pieceManager.GetProgress())
+	return nil
+}
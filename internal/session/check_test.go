@@ -0,0 +1,179 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// addHashedTorrent adds a single-file torrent of content in 16 KiB pieces
+// with real piece hashes
+func addHashedTorrent(t *testing.T, s *Session, name string, content []byte) *Handle {
+	t.Helper()
+
+	h, err := s.Add(hashedTorrent(t, name, content))
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	return h
+}
+
+// hashedTorrent returns a single-file torrent of content in 16 KiB pieces
+func hashedTorrent(t *testing.T, name string, content []byte) *torrent.Torrent {
+	t.Helper()
+
+	const pieceLength = 16384
+	var hashes []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		end := min(begin+pieceLength, len(content))
+		sum := sha1.Sum(content[begin:end])
+		hashes = append(hashes, sum[:]...)
+	}
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(pieceLength),
+			"pieces":       string(hashes),
+			"length":       int64(len(content)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return tor
+}
+
+func TestCheckExistingData(t *testing.T) {
+	content := make([]byte, 40000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name     string
+		corrupt  int // byte to flip, or -1
+		progress float64
+		state    State
+	}{
+		{"complete", -1, 100, StateSeeding},
+		{"corrupt middle piece", 20000, float64(2) / 3 * 100, StateDownloading},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			data := append([]byte(nil), content...)
+			if tt.corrupt >= 0 {
+				data[tt.corrupt] ^= 0xff
+			}
+			if err := os.WriteFile(filepath.Join(config.DownloadDir, "data.bin"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s := newTestSession(t, config)
+			h := addHashedTorrent(t, s, "data.bin", content)
+			if err := h.Start(); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			if got := h.Progress(); got != tt.progress {
+				t.Errorf("Progress = %v, want %v", got, tt.progress)
+			}
+			if got := h.State(); got != tt.state {
+				t.Errorf("State = %v, want %v", got, tt.state)
+			}
+			h.mu.RLock()
+			readOnly := h.disk.ReadOnly()
+			h.mu.RUnlock()
+			if want := tt.state == StateSeeding; readOnly != want {
+				t.Errorf("ReadOnly() = %v, want %v once complete", readOnly, want)
+			}
+		})
+	}
+}
+
+func TestCheckSkippedWithResumeData(t *testing.T) {
+	content := bytes.Repeat([]byte{1}, 40000)
+
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+
+	s := newTestSession(t, config)
+	h := addHashedTorrent(t, s, "data.bin", content)
+	stopWithPieces(t, h, 0)
+	s.Close()
+
+	// Resume data is trusted over the files while they are unchanged, so
+	// the zeroed file is not hashed
+	s = newTestSession(t, config)
+	h = addHashedTorrent(t, s, "data.bin", content)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if got, want := h.Progress(), float64(1)/3*100; got != want {
+		t.Errorf("Progress = %v, want %v", got, want)
+	}
+}
+
+func TestSeedOnly(t *testing.T) {
+	content := make([]byte, 40000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte // nil for no file
+		state State
+		err   error
+	}{
+		{"complete", content, StateSeeding, nil},
+		{"corrupt", append(append([]byte(nil), content[:20000]...), make([]byte, 20000)...), StateError, ErrIncompleteData},
+		{"wrong size", content[:30000], StateError, nil},
+		{"missing", nil, StateError, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			path := filepath.Join(config.DownloadDir, "data.bin")
+			if tt.data != nil {
+				if err := os.WriteFile(path, tt.data, 0444); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := newTestSession(t, config)
+			h, err := s.AddWithOptions(hashedTorrent(t, "data.bin", content), AddOptions{SeedOnly: true})
+			if err != nil {
+				t.Fatalf("AddWithOptions failed: %v", err)
+			}
+			err = h.Start()
+			if got := h.State(); got != tt.state {
+				t.Errorf("State = %v, want %v (err %v)", got, tt.state, err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Start error = %v, want %v", err, tt.err)
+			}
+
+			// Nothing is created, resized or written
+			got, err := os.ReadFile(path)
+			switch {
+			case tt.data == nil && !errors.Is(err, os.ErrNotExist):
+				t.Errorf("file was created: %v", err)
+			case tt.data != nil && !bytes.Equal(got, tt.data):
+				t.Error("file was changed")
+			}
+		})
+	}
+}
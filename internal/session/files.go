@@ -0,0 +1,126 @@
+package session
+
+import (
+	"fmt"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// File describes one file of a torrent
+type File struct {
+	Path     string         `json:"path"`
+	Length   int64          `json:"length"`
+	Priority piece.Priority `json:"priority"`
+	Progress float64        `json:"progress"` // percent of the file's pieces verified
+}
+
+// Files returns the torrent's files with their priorities and progress
+func (h *Handle) Files() []File {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	infos := h.torrent.GetFiles()
+	files := make([]File, len(infos))
+	for i, info := range infos {
+		files[i] = File{
+			Path:     info.Path,
+			Length:   info.Length,
+			Priority: h.filePriority(i),
+			Progress: 100,
+		}
+
+		first, last := h.layout.FilePieces(i)
+		if first > last {
+			continue
+		}
+		verified := 0
+		if h.pieces != nil {
+			for index := first; index <= last; index++ {
+				if h.pieces.HasPiece(index) {
+					verified++
+				}
+			}
+		}
+		files[i].Progress = float64(verified) / float64(last-first+1) * 100
+	}
+	return files
+}
+
+// SetFilePriority sets the priority of the file at index. A piece shared
+// by several files takes the highest priority among them, so it is only
+// skipped if every file in it is.
+func (h *Handle) SetFilePriority(index int, priority piece.Priority) error {
+	if _, ok := validPriorities[priority]; !ok {
+		return fmt.Errorf("invalid priority %d", int(priority))
+	}
+
+	h.mu.Lock()
+	files := h.torrent.GetFiles()
+	if index < 0 || index >= len(files) {
+		h.mu.Unlock()
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	if h.filePriorities == nil {
+		h.filePriorities = make([]piece.Priority, len(files))
+	}
+	h.filePriorities[index] = priority
+
+	var err error
+	if h.pieces != nil {
+		err = h.pieces.SetPriorities(h.piecePriorities())
+	}
+	h.mu.Unlock()
+
+	h.session.persist()
+	return err
+}
+
+// validPriorities are the priorities a file may have
+var validPriorities = map[piece.Priority]bool{
+	piece.PrioritySkip:   true,
+	piece.PriorityNormal: true,
+	piece.PriorityHigh:   true,
+}
+
+// filePriority returns the priority of a file (must hold h.mu)
+func (h *Handle) filePriority(index int) piece.Priority {
+	if index >= len(h.filePriorities) {
+		return piece.PriorityNormal
+	}
+	return h.filePriorities[index]
+}
+
+// piecePriorities maps file priorities onto pieces, or returns nil if every
+// file is normal (must hold h.mu)
+func (h *Handle) piecePriorities() []piece.Priority {
+	custom := false
+	for _, p := range h.filePriorities {
+		if p != piece.PriorityNormal {
+			custom = true
+		}
+	}
+	if !custom {
+		return nil
+	}
+
+	priorities := make([]piece.Priority, h.torrent.NumPieces())
+	wanted := make([]bool, len(priorities))
+	for i := range h.torrent.GetFiles() {
+		p := h.filePriority(i)
+		first, last := h.layout.FilePieces(i)
+		for index := first; index <= last; index++ {
+			if p != piece.PrioritySkip {
+				wanted[index] = true
+			}
+			if p > priorities[index] {
+				priorities[index] = p
+			}
+		}
+	}
+	for index := range priorities {
+		if !wanted[index] {
+			priorities[index] = piece.PrioritySkip
+		}
+	}
+	return priorities
+}
@@ -0,0 +1,105 @@
+package session
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// addMultiFileTorrent adds a torrent of three 16 KiB pieces holding files
+// of 10000, 20000 and 5000 bytes
+func addMultiFileTorrent(t *testing.T, s *Session) *Handle {
+	t.Helper()
+
+	var files []interface{}
+	for i, length := range []int64{10000, 20000, 5000} {
+		files = append(files, map[string]interface{}{
+			"length": length,
+			"path":   []interface{}{string(rune('a' + i))},
+		})
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "multi",
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("a", 3*20),
+			"files":        files,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	return h
+}
+
+func TestFilePriorities(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addMultiFileTorrent(t, s)
+
+	const (
+		skip   = piece.PrioritySkip
+		normal = piece.PriorityNormal
+		high   = piece.PriorityHigh
+	)
+
+	steps := []struct {
+		file     int
+		priority piece.Priority
+		want     []piece.Priority
+	}{
+		{0, normal, nil},
+		{1, skip, []piece.Priority{normal, normal, normal}},
+		{0, skip, []piece.Priority{skip, normal, normal}},
+		{2, high, []piece.Priority{skip, high, high}},
+		{1, high, []piece.Priority{high, high, high}},
+	}
+	for _, step := range steps {
+		if err := h.SetFilePriority(step.file, step.priority); err != nil {
+			t.Fatalf("SetFilePriority(%d, %v) failed: %v", step.file, step.priority, err)
+		}
+		h.mu.RLock()
+		got := h.piecePriorities()
+		h.mu.RUnlock()
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("after file %d -> %v: piece priorities = %v, want %v", step.file, step.priority, got, step.want)
+		}
+	}
+
+	if err := h.SetFilePriority(3, normal); err == nil {
+		t.Error("SetFilePriority accepted an index past the last file")
+	}
+	if err := h.SetFilePriority(0, piece.Priority(7)); err == nil {
+		t.Error("SetFilePriority accepted an unknown priority")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addMultiFileTorrent(t, s)
+	h.SetFilePriority(1, piece.PriorityHigh)
+
+	files := h.Files()
+	if len(files) != 3 {
+		t.Fatalf("Files() returned %d files, want 3", len(files))
+	}
+	if files[1].Priority != piece.PriorityHigh || files[0].Priority != piece.PriorityNormal {
+		t.Errorf("priorities = %v, %v, want high, normal", files[1].Priority, files[0].Priority)
+	}
+	if files[0].Progress != 0 {
+		t.Errorf("Progress of unstarted file = %v, want 0", files[0].Progress)
+	}
+}
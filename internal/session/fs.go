@@ -0,0 +1,360 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// ErrPieceSkipped is returned when reading data whose piece is missing and
+// will not be downloaded because every file in it is skipped
+var ErrPieceSkipped = errors.New("piece is skipped")
+
+// ReadaheadInterval spaces the deadlines of the pieces a FileReader reads
+// ahead: the nth piece past a read is wanted n intervals from now
+const ReadaheadInterval = 500 * time.Millisecond
+
+// FileReader reads one of a torrent's files. Reads of data that is not
+// verified yet wait for its pieces to arrive, so a file can be read while
+// it downloads; the missing pieces are given deadlines so they are
+// downloaded before any other. Reads fail with ErrTorrentNotRunning once
+// the torrent stops. ReadAt may be called concurrently; Read and Seek may
+// not.
+type FileReader struct {
+	h      *Handle
+	info   torrent.FileInfo
+	offset int64 // of the next Read
+
+	mu        sync.Mutex
+	readahead int64
+	deadlines map[int]bool // pieces given deadlines by the reader
+}
+
+// OpenFile returns a reader for the file at index in the torrent's file
+// list
+func (h *Handle) OpenFile(index int) (*FileReader, error) {
+	files := h.torrent.GetFiles()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range", index)
+	}
+	return &FileReader{h: h, info: files[index]}, nil
+}
+
+// Size returns the length of the file
+func (r *FileReader) Size() int64 {
+	return r.info.Length
+}
+
+// SetReadahead makes each read also ask for the missing pieces holding
+// the next n bytes of the file, with deadlines further out the further
+// ahead they are, so sequential reads such as a media stream rarely wait
+func (r *FileReader) SetReadahead(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readahead = n
+}
+
+// ReadAt reads len(p) bytes from off in the file, waiting for the pieces
+// holding them. Like any io.ReaderAt it returns io.EOF if the file ends
+// first.
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.info.Length {
+		return 0, io.EOF
+	}
+
+	want := p
+	if remaining := r.info.Length - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+
+	r.request(off, int64(len(want)))
+
+	pieceLength := r.h.torrent.Info.PieceLength
+	n := 0
+	for n < len(want) {
+		pos := r.info.Offset + off + int64(n)
+		index, begin := int(pos/pieceLength), int(pos%pieceLength)
+		length := min(len(want)-n, int(r.h.torrent.PieceSize(index))-begin)
+
+		data, err := r.h.readVerified(index, begin, length)
+		if err != nil {
+			return n, err
+		}
+		n += copy(want[n:], data)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the file's current offset
+func (r *FileReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.Length
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Stat describes the file
+func (r *FileReader) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: filepath.Base(r.info.Path), size: r.info.Length}, nil
+}
+
+// Close drops the deadlines the reader gave pieces that are still
+// missing. The torrent's files stay open.
+func (r *FileReader) Close() error {
+	r.mu.Lock()
+	deadlines := r.deadlines
+	r.deadlines = nil
+	r.mu.Unlock()
+
+	r.h.mu.RLock()
+	pieces := r.h.pieces
+	r.h.mu.RUnlock()
+	if pieces != nil {
+		for index := range deadlines {
+			pieces.ClearDeadline(index)
+		}
+	}
+	return nil
+}
+
+// request gives deadlines to the missing pieces holding length bytes from
+// off in the file, which are wanted now, and to those in the readahead
+// after them
+func (r *FileReader) request(off, length int64) {
+	r.h.mu.RLock()
+	pieces := r.h.pieces
+	r.h.mu.RUnlock()
+	if pieces == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pieceLength := r.h.torrent.Info.PieceLength
+	start := r.info.Offset + off
+	wanted := (start + length - 1) / pieceLength
+	end := r.info.Offset + min(off+length+r.readahead, r.info.Length)
+
+	now := time.Now()
+	for index := start / pieceLength; index <= (end-1)/pieceLength; index++ {
+		if pieces.HasPiece(int(index)) {
+			continue
+		}
+		deadline := now
+		if index > wanted {
+			deadline = now.Add(time.Duration(index-wanted) * ReadaheadInterval)
+		}
+		// A piece keeps the earliest deadline it was given
+		if current, ok := pieces.Deadline(int(index)); ok && current.Before(deadline) {
+			continue
+		}
+		if pieces.SetDeadline(int(index), deadline) == nil {
+			if r.deadlines == nil {
+				r.deadlines = make(map[int]bool)
+			}
+			r.deadlines[int(index)] = true
+		}
+	}
+}
+
+// readVerified reads part of a piece once it is verified (must not hold
+// h.mu)
+func (h *Handle) readVerified(index, begin, length int) ([]byte, error) {
+	for {
+		wake := h.waitChange()
+
+		h.mu.RLock()
+		pieces, open := h.pieces, h.disk != nil
+		h.mu.RUnlock()
+
+		switch {
+		case pieces == nil || !open:
+			return nil, ErrTorrentNotRunning
+		case pieces.HasPiece(index):
+			return pieces.ReadBlockFromDisk(index, begin, length)
+		case pieces.PiecePriority(index) == piece.PrioritySkip:
+			return nil, fmt.Errorf("%w: %d", ErrPieceSkipped, index)
+		}
+
+		select {
+		case <-wake:
+		case <-h.session.done:
+			return nil, ErrSessionClosed
+		}
+	}
+}
+
+// waitChange returns a channel closed once a piece is verified or the
+// torrent changes state
+func (h *Handle) waitChange() <-chan struct{} {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	if h.changed == nil {
+		h.changed = make(chan struct{})
+	}
+	return h.changed
+}
+
+// wake wakes the readers waiting for a change
+func (h *Handle) wake() {
+	h.waitMu.Lock()
+	defer h.waitMu.Unlock()
+	if h.changed != nil {
+		close(h.changed)
+		h.changed = nil
+	}
+}
+
+// FS returns the torrent's contents as a read-only file system laid out as
+// on disk: a single-file torrent holds one file, a multi-file torrent one
+// directory named after the torrent. Files are FileReaders.
+func (h *Handle) FS() fs.FS {
+	return torrentFS{h}
+}
+
+// torrentFS is the fs.FS returned by Handle.FS
+type torrentFS struct {
+	h *Handle
+}
+
+// Open opens a file or directory of the torrent
+func (t torrentFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	for i, file := range t.h.torrent.GetFiles() {
+		p := filepath.ToSlash(file.Path)
+		if p == name {
+			return t.h.OpenFile(i)
+		}
+
+		// Collect the directory's entries in case name is one
+		rest, ok := strings.CutPrefix(p, name+"/")
+		if name == "." {
+			rest, ok = p, true
+		}
+		if !ok {
+			continue
+		}
+		child, _, isDir := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		if isDir {
+			entries = append(entries, fileInfo{name: child, dir: true})
+		} else {
+			entries = append(entries, fileInfo{name: child, size: file.Length})
+		}
+	}
+
+	if entries == nil && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &dirFile{name: path.Base(name), entries: entries}, nil
+}
+
+// dirFile is an open directory of a torrentFS
+type dirFile struct {
+	name    string
+	entries []fs.DirEntry
+	mu      sync.Mutex
+	read    int // entries returned by ReadDir
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: d.name, dir: true}, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir returns the directory's next n entries, or all remaining ones
+// if n <= 0
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	remaining := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.read += n
+	return remaining[:n], nil
+}
+
+// fileInfo describes a file or directory of a torrentFS; it is also its
+// directory entry
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() any           { return nil }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// testFile is a file of a torrent made by addHashedFiles
+type testFile struct {
+	path []string
+	data []byte
+}
+
+// addHashedFiles adds a multi-file torrent named name in 16 KiB pieces
+// with real piece hashes, and writes the files to the download directory
+func addHashedFiles(t *testing.T, s *Session, name string, files []testFile) *Handle {
+	t.Helper()
+
+	var content []byte
+	var list []interface{}
+	for _, file := range files {
+		content = append(content, file.data...)
+		path := make([]interface{}, len(file.path))
+		for i, p := range file.path {
+			path[i] = p
+		}
+		list = append(list, map[string]interface{}{"length": int64(len(file.data)), "path": path})
+
+		full := filepath.Join(append([]string{s.Config().DownloadDir, name}, file.path...)...)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, file.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const pieceLength = 16384
+	var hashes []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+		hashes = append(hashes, sum[:]...)
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(pieceLength),
+			"pieces":       string(hashes),
+			"files":        list,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	return h
+}
+
+func TestFS(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	files := []testFile{
+		{[]string{"a.txt"}, bytes.Repeat([]byte("a"), 20000)},
+		{[]string{"sub", "b.txt"}, bytes.Repeat([]byte("bc"), 9000)},
+	}
+	h := addHashedFiles(t, s, "pack", files)
+
+	if _, err := h.FS().Open("pack/a.txt"); err != nil {
+		t.Fatalf("Open before Start failed: %v", err)
+	}
+	f, _ := h.OpenFile(0)
+	if _, err := f.ReadAt(make([]byte, 10), 0); !errors.Is(err, ErrTorrentNotRunning) {
+		t.Errorf("ReadAt before Start error = %v, want %v", err, ErrTorrentNotRunning)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := fstest.TestFS(h.FS(), "pack/a.txt", "pack/sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read spanning pieces, cut short at the end of the file
+	buf := make([]byte, 2000)
+	f, _ = h.OpenFile(1)
+	n, err := f.ReadAt(buf, 17000)
+	if n != 1000 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v, want 1000, EOF", n, err)
+	}
+	if !bytes.Equal(buf[:n], files[1].data[17000:]) {
+		t.Error("ReadAt returned different data")
+	}
+}
+
+func TestFileReaderWaitsForPieces(t *testing.T) {
+	content := make([]byte, 40000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	config := testConfig(t)
+	path := filepath.Join(config.DownloadDir, "data.bin")
+	corrupt := append([]byte(nil), content...)
+	corrupt[20000] ^= 0xff
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestSession(t, config)
+	h := addHashedTorrent(t, s, "data.bin", content)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	f, err := h.FS().Open("data.bin")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	done := make(chan error, 1)
+	got := make([]byte, 1000)
+	go func() {
+		_, err := f.(io.ReaderAt).ReadAt(got, 19500)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("ReadAt returned before the piece was verified: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := h.pieces.Deadline(1); !ok {
+		t.Error("the piece being read has no deadline")
+	}
+
+	// The piece arrives
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.pieces.MarkPieceVerified(1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadAt still waiting after the piece was verified")
+	}
+	if !bytes.Equal(got, content[19500:20500]) {
+		t.Error("ReadAt returned different data")
+	}
+
+	// Stopping wakes readers waiting for data
+	if _, err := fs.Stat(h.FS(), "data.bin"); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+	h.Stop()
+	if _, err := f.(io.ReaderAt).ReadAt(got, 0); !errors.Is(err, ErrTorrentNotRunning) {
+		t.Errorf("ReadAt after Stop error = %v, want %v", err, ErrTorrentNotRunning)
+	}
+}
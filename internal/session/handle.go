@@ -0,0 +1,816 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/disk"
+	"github.com/mt/bittorrent-impl/internal/download"
+	"github.com/mt/bittorrent-impl/internal/httpseed"
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/stats"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+const (
+	// DefaultAnnounceInterval is used when a tracker does not specify one
+	DefaultAnnounceInterval = 30 * time.Minute
+
+	// AnnounceRetryInterval is the wait after every tracker failed
+	AnnounceRetryInterval = 1 * time.Minute
+
+	// StoppedAnnounceTimeout bounds the final announce sent on Stop
+	StoppedAnnounceTimeout = 5 * time.Second
+)
+
+// Handle is a torrent that belongs to a session. It owns the disk, piece,
+// peer and download managers for that torrent.
+type Handle struct {
+	mu      sync.RWMutex
+	session *Session
+	torrent *torrent.Torrent
+	saveDir string
+	label   string
+
+	// Seeding data that was already there, with the files read-only
+	seedOnly bool
+
+	// Where each piece is stored, shared with the disk manager
+	layout *disk.Layout
+
+	disk        *disk.Manager
+	pieces      *piece.Manager
+	peers       *peer.Manager
+	coordinator *download.Coordinator
+	seeds       []*httpseed.Seed // the torrent's BEP 17 HTTP seeds
+
+	manualPeers []tracker.Peer
+
+	// Addresses banned for sending corrupt data, handed to each peer
+	// manager so that bans survive pause and resume
+	banned *peer.BanList
+
+	// File priorities by index, nil if every file is normal
+	filePriorities []piece.Priority
+
+	// Transfer totals of peer managers and HTTP seeds replaced by pause
+	// and resume
+	downloaded int64
+	uploaded   int64
+
+	// Transfer totals at the last "started" announce and the figures last
+	// announced since, touched only by announce
+	announceBase stats.Counters
+	announced    stats.Counters
+
+	// The tracker tiers, each with the tracker that last answered first,
+	// touched only by announce
+	tiers [][]string
+
+	// Seeders and leechers reported by trackers at the last announce
+	seeders  int
+	leechers int
+
+	state   State
+	err     error
+	changes []stateChange
+
+	// Closed when a piece is verified or the state changes, to wake
+	// FileReaders waiting for data
+	waitMu  sync.Mutex
+	changed chan struct{}
+
+	// When the torrent last started seeding
+	seedingSince time.Time
+
+	// Pieces verified since resume data was last saved, and saves running
+	// in the background
+	unsaved atomic.Int64
+	saving  atomic.Bool
+	saves   sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// lifecycle serializes Start, Stop, Pause and Resume
+	lifecycle sync.Mutex
+
+	logger *slog.Logger
+}
+
+func newHandle(s *Session, t *torrent.Torrent, saveDir string) *Handle {
+	return &Handle{
+		session: s,
+		torrent: t,
+		saveDir: saveDir,
+		layout:  disk.NewLayout(t),
+		tiers:   t.AnnounceTiers(),
+		banned:  peer.NewBanList(),
+		state:   StateQueued,
+		logger:  s.logger.With("torrent", t.Info.Name),
+	}
+}
+
+// Torrent returns the torrent metadata
+func (h *Handle) Torrent() *torrent.Torrent {
+	return h.torrent
+}
+
+// InfoHash returns the torrent's info hash
+func (h *Handle) InfoHash() [20]byte {
+	return h.torrent.InfoHash
+}
+
+// Name returns the torrent name
+func (h *Handle) Name() string {
+	return h.torrent.Info.Name
+}
+
+// SaveDir returns the directory the torrent is saved in
+func (h *Handle) SaveDir() string {
+	return h.saveDir
+}
+
+// IsRunning returns true if the torrent is downloading or seeding
+func (h *Handle) IsRunning() bool {
+	return h.State().Active()
+}
+
+// Start queues the torrent to run. It starts right away if a download or
+// seed slot is free, and otherwise waits in StateQueued until the session
+// queue promotes it. A paused torrent is resumed the same way.
+func (h *Handle) Start() error {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	defer h.session.persist()
+	return h.start()
+}
+
+// start admits the torrent to the queue (must hold h.lifecycle)
+func (h *Handle) start() error {
+	if h.State().Active() {
+		return nil
+	}
+	if !h.session.BindAvailable() {
+		return ErrBindUnavailable
+	}
+
+	if !h.session.queue.admit(h) {
+		h.mu.Lock()
+		h.setState(StateQueued, nil)
+		h.unlock()
+		return nil
+	}
+
+	if err := h.activate(); err != nil {
+		h.session.queue.release(h)
+		return err
+	}
+	return nil
+}
+
+// activate opens the torrent's storage if needed and connects to peers
+// once it holds a queue slot (must hold h.lifecycle)
+func (h *Handle) activate() error {
+	h.mu.Lock()
+	defer h.unlock()
+
+	if h.state.Active() {
+		return nil
+	}
+	if h.disk == nil {
+		if err := h.open(); err != nil {
+			h.setState(StateError, err)
+			return err
+		}
+	}
+	h.startPeers()
+	return nil
+}
+
+// open allocates files and creates the piece manager (must hold h.mu)
+func (h *Handle) open() error {
+	h.setState(StateChecking, nil)
+
+	t := h.torrent
+
+	// Check the resume data before the files are opened, which touches them
+	resume, err := h.loadResumeData()
+	if err == nil && resume != nil {
+		err = h.checkResumeFiles(resume)
+	}
+	if err != nil {
+		h.logger.Warn("Ignoring resume data", "err", err)
+		resume = nil
+	}
+	// Without it, any data left by an earlier run is hashed
+	check := resume == nil && (h.seedOnly || h.hasData())
+
+	diskManager := disk.NewManager(t, h.saveDir)
+	diskManager.SetLayout(h.layout)
+	openFiles := diskManager.Initialize
+	if h.seedOnly {
+		openFiles = diskManager.OpenReadOnly
+	}
+	if err := openFiles(); err != nil {
+		err = fmt.Errorf("failed to initialize storage: %w", err)
+		h.alert(Alert{Type: AlertDiskError, Err: err})
+		return err
+	}
+
+	pieceHashes := make([][20]byte, t.NumPieces())
+	for i := range pieceHashes {
+		pieceHashes[i], _ = t.PieceHash(i)
+	}
+	lastPieceSize := int(t.PieceSize(t.NumPieces() - 1))
+
+	// The manager is given its pieces as one for a torrent added from a
+	// magnet link is once the metadata arrives
+	pieceManager := piece.NewManager(0, 0, 0, nil)
+	pieceManager.SetDiskManager(diskManager)
+	pieceManager.SetSelectionStrategy(h.selectionStrategy())
+	if err := pieceManager.SetMetadata(int(t.Info.PieceLength), pieceHashes, lastPieceSize); err != nil {
+		diskManager.Close()
+		return err
+	}
+	pieceManager.SetLogger(h.componentLogger(logging.Piece))
+	pieceManager.SetPartialLimits(h.session.Config().MaxPartialPieces, h.session.Config().MaxPartialBytes)
+	if err := pieceManager.SetPriorities(h.piecePriorities()); err != nil {
+		diskManager.Close()
+		return err
+	}
+	if resume != nil {
+		h.restorePieces(pieceManager, resume)
+	}
+
+	h.disk = diskManager
+	h.pieces = pieceManager
+
+	if check {
+		// Hash without holding the lock, so the torrent's progress can be
+		// followed while it is checked
+		h.unlock()
+		err := h.checkPieces(diskManager, pieceManager)
+		h.mu.Lock()
+		if err != nil {
+			h.disk, h.pieces = nil, nil
+			diskManager.Close()
+			return err
+		}
+	}
+	if h.seedOnly {
+		if done, total := pieceManager.GetProgressCounts(); done < total {
+			h.disk, h.pieces = nil, nil
+			diskManager.Close()
+			return fmt.Errorf("%w: %d of %d pieces match the torrent", ErrIncompleteData, done, total)
+		}
+	}
+	if pieceManager.IsComplete() {
+		h.sealFiles(diskManager)
+	}
+	pieceManager.Subscribe(pieceEvents{h})
+	return nil
+}
+
+// selectionStrategy creates the piece selection strategy the session is
+// configured with
+func (h *Handle) selectionStrategy() piece.SelectionStrategy {
+	config := h.session.Config()
+	if config.Strategy == "smart" {
+		return piece.NewSmartStrategy(smartOptions(config)...)
+	}
+	return piece.GetStrategyByName(config.Strategy)
+}
+
+// smartOptions returns the smart strategy options of a configuration
+func smartOptions(config Config) []piece.SmartOption {
+	bootstrapPieces := config.BootstrapPieces
+	if bootstrapPieces == 0 {
+		bootstrapPieces = piece.DefaultBootstrapPieces
+	}
+	opts := []piece.SmartOption{piece.WithBootstrap(config.Bootstrap, bootstrapPieces)}
+	if config.EndGamePieces != 0 {
+		opts = append(opts, piece.WithEndGamePieces(config.EndGamePieces))
+	}
+	if config.EndGameAnyPieces != 0 {
+		opts = append(opts, piece.WithEndGameAnyPieces(config.EndGameAnyPieces))
+	}
+	return opts
+}
+
+// sealFiles reopens a complete torrent's files read-only, so nothing
+// written while seeding can corrupt them. On failure it seeds from the
+// writable files.
+func (h *Handle) sealFiles(diskManager *disk.Manager) {
+	if err := diskManager.ReopenReadOnly(); err != nil {
+		h.logger.Warn("Failed to reopen files read-only", "err", err)
+	}
+}
+
+// startPeers creates the peer manager and coordinator for the torrent's
+// pieces, starts them and begins announcing (must hold h.mu)
+func (h *Handle) startPeers() {
+	t := h.torrent
+
+	if h.peers != nil {
+		old := h.peers.GetStats()
+		h.downloaded += old.BytesDownloaded
+		h.uploaded += old.BytesUploaded
+	}
+	for _, seed := range h.seeds {
+		h.downloaded += seed.Downloaded()
+	}
+	h.seeds = nil
+
+	peerManager := peer.NewManager(t.InfoHash, h.session.PeerID(), t.NumPieces())
+	peerManager.SetPieceManager(h.pieces)
+	peerManager.SetLogger(h.componentLogger(logging.Peer))
+	peerManager.SetFilter(h.session.filter)
+	peerManager.SetBanList(h.banned)
+	// A private torrent takes peers only from its trackers, so its DHT
+	// nodes are never used and no DHT node is set
+	peerManager.SetPrivate(t.IsPrivate())
+	peerManager.SetHaveSuppression(h.session.Config().SuppressHave)
+	peerManager.SetBitfieldMode(h.session.Config().BitfieldMode)
+	peerManager.SetUploadSlots(h.session.Config().UploadSlots)
+	peerManager.SetMaxMessageLength(h.session.Config().MaxMessageLength)
+	peerManager.SetMaxRequestLength(h.session.Config().MaxRequestLength)
+	peerManager.SetIdleTimeout(h.session.Config().PeerIdleTimeout)
+	peerManager.SetUploadCapacity(h.session.uploadLimit.Rate)
+	peerManager.SetDialer(labelDialer{h})
+
+	h.pieces.SetBanHandler(peerManager)
+
+	coordinator := download.NewCoordinator(peerManager, h.pieces)
+	coordinator.SetLogger(h.componentLogger(logging.Download))
+	peerManager.SetPieceHandler(coordinator)
+	peerManager.SetPeerEventHandler(peerAlerts{coordinator, h})
+	h.pieces.Subscribe(peerManager)
+	h.pieces.Subscribe(coordinator)
+
+	h.peers = peerManager
+	h.coordinator = coordinator
+
+	peerManager.Start()
+	coordinator.Start()
+
+	if len(h.manualPeers) > 0 {
+		peerManager.AddPeers(h.manualPeers, peer.SourceManual)
+	}
+
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+
+	h.wg.Add(1)
+	go h.announceLoop(h.ctx)
+
+	if !h.pieces.IsComplete() {
+		ctx := h.ctx
+		for _, seedURL := range t.HTTPSeeds {
+			seed := httpseed.New(seedURL, t.InfoHash, h.pieces)
+			seed.SetRateLimiter(h.session.downloadLimit)
+			if h.session.bindIP != nil {
+				seed.SetClient(&http.Client{Timeout: httpseed.RequestTimeout, Transport: h.session.httpClient.Transport})
+			}
+			seed.SetLogger(h.componentLogger(logging.Download))
+			h.seeds = append(h.seeds, seed)
+
+			h.wg.Add(1)
+			go func() {
+				defer h.wg.Done()
+				seed.Run(ctx)
+			}()
+		}
+	}
+
+	if h.pieces.IsComplete() {
+		h.setState(StateSeeding, nil)
+	} else {
+		h.setState(StateDownloading, nil)
+	}
+}
+
+// stopPeers winds the torrent down: it sends the final announce, stops
+// requesting blocks, closes every peer connection, waits for completed
+// pieces to be written and for background saves, and saves resume data.
+// Connections are closed before the writes drain so no piece completes
+// after the resume data is saved. The announce loop must already be
+// cancelled.
+func (h *Handle) stopPeers() {
+	h.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedAnnounceTimeout)
+	h.announce(ctx, "stopped")
+	cancel()
+
+	h.coordinator.Stop()
+	h.peers.Stop()
+	h.pieces.Unsubscribe(h.coordinator)
+	h.pieces.Unsubscribe(h.peers)
+
+	h.pieces.Wait()
+	h.saves.Wait()
+	if err := h.SaveResumeData(); err != nil {
+		h.logger.Error("Failed to save resume data", "err", err)
+	}
+}
+
+// Pause disconnects from all peers and stops announcing, giving up the
+// torrent's queue slot. Progress and open files are kept, so Resume picks
+// up where the torrent left off.
+func (h *Handle) Pause() error {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	defer h.session.persist()
+	return h.pause(nil)
+}
+
+// pause moves the torrent to StatePaused, recording err as the reason if
+// it is not nil (must hold h.lifecycle)
+func (h *Handle) pause(err error) error {
+	wanted := h.session.queue.isWanted(h)
+
+	h.mu.Lock()
+	state := h.state
+	switch {
+	case state == StatePaused:
+		h.unlock()
+		return nil
+	case state.Active():
+		h.cancel()
+	case !wanted:
+		h.unlock()
+		return ErrTorrentNotRunning
+	}
+	h.setState(StatePaused, err)
+	h.unlock()
+
+	h.session.queue.release(h)
+	if state.Active() {
+		h.stopPeers()
+	}
+	return nil
+}
+
+// diskFailed pauses a running torrent after a disk error, so it stops
+// downloading pieces it cannot store or promising blocks it cannot read.
+// Resume tries again. The error is reported from piece manager and peer
+// goroutines that pausing waits for, so the torrent is paused from a new
+// one.
+func (h *Handle) diskFailed(err error) {
+	go func() {
+		h.lifecycle.Lock()
+		defer h.lifecycle.Unlock()
+
+		if !h.State().Active() {
+			return
+		}
+		h.logger.Error("Pausing after disk error", "err", err)
+		h.pause(err)
+		h.session.persist()
+	}()
+}
+
+// Resume queues a paused torrent to run again. It does nothing unless the
+// torrent is paused.
+func (h *Handle) Resume() error {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	defer h.session.persist()
+
+	if h.State() != StatePaused {
+		return nil
+	}
+	return h.start()
+}
+
+// Stop stops the torrent, sends a final announce and closes its files
+func (h *Handle) Stop() {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+	defer h.session.persist()
+
+	wanted := h.session.queue.release(h)
+
+	h.mu.Lock()
+	state := h.state
+	if state.Active() {
+		h.cancel()
+	}
+	diskManager := h.disk
+	h.disk = nil
+	if diskManager != nil || wanted || state == StatePaused {
+		h.setState(StateStopped, nil)
+	}
+	h.unlock()
+
+	if state.Active() {
+		h.stopPeers()
+	}
+
+	if diskManager != nil {
+		if err := diskManager.Close(); err != nil {
+			h.logger.Error("Failed to close files", "err", err)
+			h.alert(Alert{Type: AlertDiskError, Err: err})
+		}
+	}
+}
+
+// AddPeer connects to a peer at "host:port" without waiting for a tracker.
+// The peer is remembered and dialled again each time the torrent starts.
+func (h *Handle) AddPeer(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidPeerAddr, addr, err)
+	}
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() || tcpAddr.Port == 0 {
+		return fmt.Errorf("%w %q", ErrInvalidPeerAddr, addr)
+	}
+	p := tracker.Peer{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)}
+
+	h.mu.Lock()
+	h.manualPeers = append(h.manualPeers, p)
+	running, peers := h.state.Active(), h.peers
+	h.mu.Unlock()
+
+	if running {
+		peers.AddPeers([]tracker.Peer{p}, peer.SourceManual)
+	}
+	return nil
+}
+
+// acceptPeer hands an incoming connection to the peer manager
+func (h *Handle) acceptPeer(conn net.Conn, handshake *peer.Handshake) error {
+	h.mu.RLock()
+	running, peers := h.state.Active(), h.peers
+	h.mu.RUnlock()
+
+	if !running {
+		return ErrTorrentNotRunning
+	}
+	return peers.AddIncomingPeer(h.limit(conn), handshake)
+}
+
+// Progress returns the download progress as a percentage
+func (h *Handle) Progress() float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.pieces == nil {
+		return 0
+	}
+	return h.pieces.GetProgress()
+}
+
+// Availability returns how many connected peers have each piece, or nil
+// before the torrent is opened
+func (h *Handle) Availability() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.pieces == nil {
+		return nil
+	}
+	return h.pieces.Availability()
+}
+
+// Peers returns information about the connected peers
+func (h *Handle) Peers() []peer.PeerInfo {
+	h.mu.RLock()
+	running, peers := h.state.Active(), h.peers
+	h.mu.RUnlock()
+
+	if !running {
+		return nil
+	}
+	return peers.GetPeerInfo()
+}
+
+// componentLogger returns a component's logger for this torrent
+func (h *Handle) componentLogger(component string) *slog.Logger {
+	return h.session.Logger().Component(component).With("torrent", h.Name())
+}
+
+// Counters returns the torrent's cumulative totals, which the session
+// samples for its statistics
+func (h *Handle) Counters() stats.Counters {
+	h.mu.RLock()
+	active := h.state.Active()
+	pieces, peers, coordinator := h.pieces, h.peers, h.coordinator
+	seeds := h.seeds
+	counters := stats.Counters{
+		Downloaded: h.downloaded,
+		Uploaded:   h.uploaded,
+		Size:       h.torrent.TotalLength(),
+		Left:       h.torrent.TotalLength(),
+	}
+	h.mu.RUnlock()
+
+	if pieces != nil {
+		pieceStats := pieces.GetStatistics()
+		counters.Verified = pieceStats.BytesVerified
+		counters.HashFailures = pieceStats.HashFailures
+		counters.Wasted = pieceStats.BytesWasted
+		counters.Left = pieces.BytesLeft()
+	}
+	if peers != nil {
+		peerStats := peers.GetStats()
+		counters.Downloaded += peerStats.BytesDownloaded
+		counters.Uploaded += peerStats.BytesUploaded
+		if active {
+			counters.Peers = peerStats.ActivePeers
+			counters.ActiveRequests = coordinator.GetActiveRequestCount()
+		}
+	}
+	for _, seed := range seeds {
+		counters.Downloaded += seed.Downloaded()
+	}
+	return counters
+}
+
+// Stats returns the torrent's counters, rates and ETA as of the session's
+// last sample
+func (h *Handle) Stats() stats.Snapshot {
+	snapshot, _ := h.session.stats.Get(h.torrent.InfoHashString())
+	return snapshot
+}
+
+// SpeedHistory returns the torrent's rates at each of the session's
+// recent statistics samples, oldest first
+func (h *Handle) SpeedHistory() []stats.Point {
+	points, _ := h.session.stats.History(h.torrent.InfoHashString())
+	return points
+}
+
+// announceLoop announces to the trackers until the handle is stopped
+func (h *Handle) announceLoop(ctx context.Context) {
+	defer h.wg.Done()
+
+	event := "started"
+	for {
+		interval := h.announce(ctx, event)
+		event = ""
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// announce announces to the torrent's trackers, hands the peers they
+// return to the peer manager and returns how long to wait before the next
+// announce. With an announce concurrency above 1 every tier is announced
+// to, that many at once; otherwise the trackers are tried in turn until
+// one answers.
+func (h *Handle) announce(ctx context.Context, event string) time.Duration {
+	if len(h.tiers) == 0 {
+		return DefaultAnnounceInterval
+	}
+
+	counters := h.announceCounters(h.Counters(), event)
+
+	params := tracker.AnnounceParams{
+		InfoHash:   h.torrent.InfoHash,
+		PeerID:     h.session.PeerID(),
+		Port:       h.session.Config().ListenPort,
+		Uploaded:   counters.Uploaded,
+		Downloaded: counters.Downloaded,
+		Left:       counters.Left,
+		Event:      event,
+		Compact:    true,
+	}
+
+	// A stopping client has no use for more peers
+	if event != "stopped" {
+		params.NumWant = h.session.Config().NumWant
+	}
+
+	var responses []*tracker.TrackerResponse
+	if concurrency := h.session.Config().AnnounceConcurrency; concurrency > 1 {
+		responses = h.announceTiers(ctx, params, concurrency)
+	} else if resp := h.announceTier(ctx, h.torrent.GetAnnounceURLs(), params); resp != nil {
+		responses = append(responses, resp)
+	}
+	if ctx.Err() != nil {
+		return 0
+	}
+	if len(responses) == 0 {
+		return AnnounceRetryInterval
+	}
+
+	// Trackers of one swarm mostly count the same peers, so the largest
+	// counts are the best guess, and the longest interval keeps every
+	// tracker's
+	var peers []tracker.Peer
+	seen := make(map[string]bool)
+	seeders, leechers, interval := 0, 0, 0
+	for _, resp := range responses {
+		for _, p := range resp.Peers {
+			key := p.String()
+			if !seen[key] {
+				seen[key] = true
+				peers = append(peers, p)
+			}
+		}
+		seeders = max(seeders, resp.Complete)
+		leechers = max(leechers, resp.Incomplete)
+		interval = max(interval, resp.Interval)
+		if resp.ExternalIP != nil && event != "stopped" {
+			h.peers.SetExternalAddr(resp.ExternalIP, params.Port)
+		}
+	}
+
+	h.mu.Lock()
+	h.seeders, h.leechers = seeders, leechers
+	h.mu.Unlock()
+
+	if event != "stopped" {
+		h.peers.ConnectToPeers(peers)
+	}
+	if interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return DefaultAnnounceInterval
+}
+
+// announceTiers announces to every tier, up to concurrency at once, and
+// returns the responses of those that answered. The tracker that answers
+// moves to the front of its tier, as BEP 12 asks.
+func (h *Handle) announceTiers(ctx context.Context, params tracker.AnnounceParams, concurrency int) []*tracker.TrackerResponse {
+	responses := make([]*tracker.TrackerResponse, len(h.tiers))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range h.tiers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			responses[i] = h.announceTier(ctx, h.tiers[i], params)
+		}()
+	}
+	wg.Wait()
+
+	var answered []*tracker.TrackerResponse
+	for _, resp := range responses {
+		if resp != nil {
+			answered = append(answered, resp)
+		}
+	}
+	return answered
+}
+
+// announceTier tries the trackers of a tier in turn and returns the
+// response of the first that answers, moved to the front of tier, or nil
+// if none does
+func (h *Handle) announceTier(ctx context.Context, tier []string, params tracker.AnnounceParams) *tracker.TrackerResponse {
+	for i, url := range tier {
+		resp, err := h.session.tracker.AnnounceContext(ctx, url, params)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			h.logger.Warn("Announce failed", "tracker", url, "err", err)
+			h.alert(Alert{Type: AlertTrackerError, Tracker: url, Err: err})
+			continue
+		}
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = url
+		return resp
+	}
+	return nil
+}
+
+// TrackerCounts returns the seeders and leechers reported by trackers at
+// the last announce
+func (h *Handle) TrackerCounts() (seeders, leechers int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.seeders, h.leechers
+}
+
+// announceCounters returns the figures to announce given the torrent's
+// counters. Uploaded and downloaded count from the "started" announce, as
+// trackers expect, and never go back below what was last announced.
+func (h *Handle) announceCounters(counters stats.Counters, event string) stats.Counters {
+	if event == "started" {
+		h.announceBase = counters
+		h.announced = stats.Counters{}
+	}
+
+	h.announced.Uploaded = max(h.announced.Uploaded, counters.Uploaded-h.announceBase.Uploaded)
+	h.announced.Downloaded = max(h.announced.Downloaded, counters.Downloaded-h.announceBase.Downloaded)
+	h.announced.Left = max(counters.Left, 0)
+	return h.announced
+}
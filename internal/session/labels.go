@@ -0,0 +1,215 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/ratelimit"
+)
+
+// Label groups torrents that share a save directory, rate limits and
+// seeding policy. Zero fields fall back to the session's settings.
+type Label struct {
+	Name              string        `json:"name"`
+	SaveDir           string        `json:"saveDir,omitempty"`           // for torrents added with the label
+	DownloadRateLimit int64         `json:"downloadRateLimit,omitempty"` // bytes per second across the label's torrents
+	UploadRateLimit   int64         `json:"uploadRateLimit,omitempty"`   // bytes per second across the label's torrents
+	SeedRatio         float64       `json:"seedRatio,omitempty"`
+	SeedTime          time.Duration `json:"-"`
+}
+
+// labelJSON is a Label with the seed time in seconds
+type labelJSON struct {
+	labelFields
+	SeedTime int64 `json:"seedTime,omitempty"`
+}
+
+// labelFields has Label's fields without its JSON methods
+type labelFields Label
+
+// MarshalJSON encodes the label with its seed time in seconds
+func (l Label) MarshalJSON() ([]byte, error) {
+	return json.Marshal(labelJSON{labelFields(l), int64(l.SeedTime / time.Second)})
+}
+
+// UnmarshalJSON decodes a label with its seed time in seconds
+func (l *Label) UnmarshalJSON(data []byte) error {
+	var v labelJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*l = Label(v.labelFields)
+	l.SeedTime = time.Duration(v.SeedTime) * time.Second
+	return nil
+}
+
+// label is a label with the limiters its torrents share
+type label struct {
+	Label
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+}
+
+// SetLabel creates a label or changes an existing one. New limits apply
+// to the label's connected peers right away; a new save directory only
+// to torrents added later.
+func (s *Session) SetLabel(l Label) error {
+	if l.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidLabel)
+	}
+	if l.DownloadRateLimit < 0 || l.UploadRateLimit < 0 || l.SeedRatio < 0 || l.SeedTime < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidLabel)
+	}
+
+	s.mu.Lock()
+	if existing, ok := s.labels[l.Name]; ok {
+		// Labels are replaced rather than changed, as callers of findLabel
+		// read them without the lock
+		existing.download.SetRate(l.DownloadRateLimit)
+		existing.upload.SetRate(l.UploadRateLimit)
+		s.labels[l.Name] = &label{Label: l, download: existing.download, upload: existing.upload}
+	} else {
+		s.labels[l.Name] = &label{
+			Label:    l,
+			download: ratelimit.NewLimiter(l.DownloadRateLimit),
+			upload:   ratelimit.NewLimiter(l.UploadRateLimit),
+		}
+	}
+	s.mu.Unlock()
+
+	s.persist()
+	return nil
+}
+
+// RemoveLabel deletes a label, taking it off every torrent that had it
+func (s *Session) RemoveLabel(name string) error {
+	s.mu.Lock()
+	if _, ok := s.labels[name]; !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %q", ErrLabelNotFound, name)
+	}
+	delete(s.labels, name)
+	handles := make([]*Handle, 0, len(s.torrents))
+	for _, h := range s.torrents {
+		handles = append(handles, h)
+	}
+	s.mu.Unlock()
+
+	for _, h := range handles {
+		h.mu.Lock()
+		if h.label == name {
+			h.label = ""
+		}
+		h.mu.Unlock()
+	}
+
+	s.persist()
+	return nil
+}
+
+// Labels returns every label, sorted by name
+func (s *Session) Labels() []Label {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	labels := make([]Label, 0, len(s.labels))
+	for _, l := range s.labels {
+		labels = append(labels, l.Label)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// Label returns the label with the given name
+func (s *Session) Label(name string) (Label, error) {
+	l, ok := s.findLabel(name)
+	if !ok {
+		return Label{}, fmt.Errorf("%w: %q", ErrLabelNotFound, name)
+	}
+	return l.Label, nil
+}
+
+// findLabel looks up a label; "" is never found
+func (s *Session) findLabel(name string) (*label, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.labels[name]
+	return l, ok
+}
+
+// Label returns the torrent's label, or "" if it has none
+func (h *Handle) Label() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.label
+}
+
+// SetLabel gives the torrent a label, or takes its label away if name is
+// "". Peers connected from now on share the label's rate limits; the
+// torrent stays in its save directory.
+func (h *Handle) SetLabel(name string) error {
+	if name != "" {
+		if _, ok := h.session.findLabel(name); !ok {
+			return fmt.Errorf("%w: %q", ErrLabelNotFound, name)
+		}
+	}
+
+	h.mu.Lock()
+	h.label = name
+	h.mu.Unlock()
+
+	h.session.persist()
+	return nil
+}
+
+// labelLimiters returns the limiters of the torrent's label, or nil if it
+// has none
+func (h *Handle) labelLimiters() (download, upload *ratelimit.Limiter) {
+	l, ok := h.session.findLabel(h.Label())
+	if !ok {
+		return nil, nil
+	}
+	return l.download, l.upload
+}
+
+// labelDialer adds the rate limits of the torrent's label at the time of
+// dialling to the session's
+type labelDialer struct {
+	h *Handle
+}
+
+func (d labelDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.h.session.peerDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.h.limit(conn), nil
+}
+
+// limit throttles an incoming peer connection with the label's rate limits
+func (h *Handle) limit(conn net.Conn) net.Conn {
+	download, upload := h.labelLimiters()
+	if download == nil {
+		return conn
+	}
+	return ratelimit.NewConn(conn, download, upload)
+}
+
+// seedPolicy returns the seed ratio and time the torrent stops seeding
+// at: its label's where set, otherwise the session's
+func (h *Handle) seedPolicy(config Config) (ratio float64, seedTime time.Duration) {
+	ratio, seedTime = config.SeedRatio, config.SeedTime
+	if l, ok := h.session.findLabel(h.Label()); ok {
+		if l.SeedRatio > 0 {
+			ratio = l.SeedRatio
+		}
+		if l.SeedTime > 0 {
+			seedTime = l.SeedTime
+		}
+	}
+	return ratio, seedTime
+}
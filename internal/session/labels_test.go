@@ -0,0 +1,224 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/ratelimit"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+func TestSetLabel(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+
+	invalid := []Label{
+		{},
+		{Name: "a", DownloadRateLimit: -1},
+		{Name: "a", SeedRatio: -1},
+		{Name: "a", SeedTime: -time.Second},
+	}
+	for _, l := range invalid {
+		if err := s.SetLabel(l); !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("SetLabel(%+v) = %v, want ErrInvalidLabel", l, err)
+		}
+	}
+
+	for _, name := range []string{"tv", "movies"} {
+		if err := s.SetLabel(Label{Name: name}); err != nil {
+			t.Fatalf("SetLabel(%s) failed: %v", name, err)
+		}
+	}
+	if err := s.SetLabel(Label{Name: "tv", SeedRatio: 2}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+
+	labels := s.Labels()
+	if len(labels) != 2 || labels[0].Name != "movies" || labels[1].Name != "tv" {
+		t.Errorf("Labels() = %+v, want movies and tv", labels)
+	}
+	if l, err := s.Label("tv"); err != nil || l.SeedRatio != 2 {
+		t.Errorf("Label(tv) = %+v, %v, want seed ratio 2", l, err)
+	}
+	if _, err := s.Label("news"); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("Label(news) error = %v, want ErrLabelNotFound", err)
+	}
+}
+
+func TestRemoveLabel(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "label.bin")
+
+	if err := h.SetLabel("tv"); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("SetLabel before the label exists = %v, want ErrLabelNotFound", err)
+	}
+	if err := s.SetLabel(Label{Name: "tv"}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := h.SetLabel("tv"); err != nil {
+		t.Fatalf("Handle.SetLabel failed: %v", err)
+	}
+	if got := h.Status().Label; got != "tv" {
+		t.Errorf("Status().Label = %q, want tv", got)
+	}
+
+	if err := s.RemoveLabel("tv"); err != nil {
+		t.Fatalf("RemoveLabel failed: %v", err)
+	}
+	if got := h.Label(); got != "" {
+		t.Errorf("Label() after RemoveLabel = %q, want none", got)
+	}
+	if err := s.RemoveLabel("tv"); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("RemoveLabel again = %v, want ErrLabelNotFound", err)
+	}
+}
+
+func TestAddWithOptions(t *testing.T) {
+	config := testConfig(t)
+	s := newTestSession(t, config)
+	labelDir, optsDir := t.TempDir(), t.TempDir()
+	if err := s.SetLabel(Label{Name: "tv", SaveDir: labelDir}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := s.SetLabel(Label{Name: "movies"}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    AddOptions
+		saveDir string
+	}{
+		{"no options", AddOptions{}, config.DownloadDir},
+		{"label", AddOptions{Label: "tv"}, labelDir},
+		{"label without directory", AddOptions{Label: "movies"}, config.DownloadDir},
+		{"directory", AddOptions{Label: "tv", SaveDir: optsDir}, optsDir},
+	}
+	for _, tt := range tests {
+		tor, err := torrent.Parse(bytes.NewReader(testTorrentData(t, tt.name)))
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		h, err := s.AddWithOptions(tor, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: AddWithOptions failed: %v", tt.name, err)
+		}
+		if h.SaveDir() != tt.saveDir || h.Label() != tt.opts.Label {
+			t.Errorf("%s: added %q in %s, want %q in %s", tt.name, h.Label(), h.SaveDir(), tt.opts.Label, tt.saveDir)
+		}
+	}
+
+	tor, err := torrent.Parse(bytes.NewReader(testTorrentData(t, "unknown")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err := s.AddWithOptions(tor, AddOptions{Label: "news"}); !errors.Is(err, ErrLabelNotFound) {
+		t.Errorf("AddWithOptions with an unknown label = %v, want ErrLabelNotFound", err)
+	}
+}
+
+func TestLabelSeedPolicy(t *testing.T) {
+	config := testConfig(t)
+	config.SeedRatio = 1
+	config.SeedTime = time.Hour
+	s := newTestSession(t, config)
+	h := addTestTorrent(t, s, "seed.bin")
+
+	if ratio, seedTime := h.seedPolicy(config); ratio != 1 || seedTime != time.Hour {
+		t.Errorf("seedPolicy without a label = %v, %v, want 1, 1h", ratio, seedTime)
+	}
+
+	if err := s.SetLabel(Label{Name: "keep", SeedRatio: 3}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := h.SetLabel("keep"); err != nil {
+		t.Fatalf("Handle.SetLabel failed: %v", err)
+	}
+	if ratio, seedTime := h.seedPolicy(config); ratio != 3 || seedTime != time.Hour {
+		t.Errorf("seedPolicy with a label = %v, %v, want 3, 1h", ratio, seedTime)
+	}
+}
+
+func TestLabelLimits(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "limits.bin")
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	if got := h.limit(conn); got != conn {
+		t.Errorf("limit without a label = %T, want the connection unchanged", got)
+	}
+
+	if err := s.SetLabel(Label{Name: "slow", UploadRateLimit: 1024}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := h.SetLabel("slow"); err != nil {
+		t.Fatalf("Handle.SetLabel failed: %v", err)
+	}
+	if _, ok := h.limit(conn).(*ratelimit.Conn); !ok {
+		t.Errorf("limit with a label = %T, want *ratelimit.Conn", h.limit(conn))
+	}
+
+	// Changing the label keeps the limiters its connections share
+	_, before := h.labelLimiters()
+	if err := s.SetLabel(Label{Name: "slow", UploadRateLimit: 2048}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if _, after := h.labelLimiters(); after != before || after.Rate() != 2048 {
+		t.Errorf("upload limiter after SetLabel = %p at %d, want %p at 2048", after, after.Rate(), before)
+	}
+}
+
+func TestLabelJSON(t *testing.T) {
+	l := Label{Name: "tv", SaveDir: "/data/tv", UploadRateLimit: 1024, SeedRatio: 1.5, SeedTime: 2 * time.Hour}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if fields["seedTime"] != float64(7200) {
+		t.Errorf("seedTime = %v, want 7200 seconds", fields["seedTime"])
+	}
+
+	var got Label
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got != l {
+		t.Errorf("round trip = %+v, want %+v", got, l)
+	}
+}
+
+func TestRestoreLabels(t *testing.T) {
+	config := persistConfig(t)
+
+	s := newTestSession(t, config)
+	if err := s.SetLabel(Label{Name: "tv", SeedTime: time.Hour}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := addTestTorrent(t, s, "labelled.bin").SetLabel("tv"); err != nil {
+		t.Fatalf("Handle.SetLabel failed: %v", err)
+	}
+	s.Close()
+
+	s = newTestSession(t, config)
+	handles, err := s.Restore()
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if l, err := s.Label("tv"); err != nil || l.SeedTime != time.Hour {
+		t.Errorf("restored label = %+v, %v, want tv with an hour's seed time", l, err)
+	}
+	if len(handles) != 1 || handles[0].Label() != "tv" {
+		t.Errorf("restored torrents = %d, want one labelled tv", len(handles))
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/ratelimit"
+)
+
+// SeedCheckInterval is how often seeding torrents are checked against the
+// seed ratio and time limits
+const SeedCheckInterval = 5 * time.Second
+
+// limitedDialer throttles outgoing peer connections with the session's
+// rate limits
+type limitedDialer struct {
+	next             peer.Dialer
+	download, upload *ratelimit.Limiter
+}
+
+func (d limitedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.next.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewConn(conn, d.download, d.upload), nil
+}
+
+// limit throttles an incoming peer connection with the session's rate
+// limits
+func (s *Session) limit(conn net.Conn) net.Conn {
+	return ratelimit.NewConn(conn, s.downloadLimit, s.uploadLimit)
+}
+
+// SetRateLimits changes the session-wide transfer limits in bytes per
+// second; 0 means no limit. Connected peers are throttled right away, or
+// once alternate speed is turned off if it is on.
+func (s *Session) SetRateLimits(download, upload int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.DownloadRateLimit = download
+	s.config.UploadRateLimit = upload
+	s.applyRateLimits()
+}
+
+// RateLimits returns the session-wide transfer limits in force, in bytes
+// per second
+func (s *Session) RateLimits() (download, upload int64) {
+	return s.downloadLimit.Rate(), s.uploadLimit.Rate()
+}
+
+// seedLoop stops seeding torrents that reached the seed ratio or time
+// limit
+func (s *Session) seedLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(SeedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		config := s.Config()
+		for _, h := range s.Torrents() {
+			ratio, seedTime := h.seedPolicy(config)
+			if h.seedGoalReached(ratio, seedTime, time.Now()) {
+				h.logger.Info("Seeding goal reached, stopping")
+				h.Stop()
+			}
+		}
+	}
+}
+
+// seedGoalReached returns true if the torrent is seeding and has uploaded
+// ratio times its size or seeded for seedTime; zero limits are ignored
+func (h *Handle) seedGoalReached(ratio float64, seedTime time.Duration, now time.Time) bool {
+	h.mu.RLock()
+	seeding, since := h.state == StateSeeding, h.seedingSince
+	h.mu.RUnlock()
+
+	if !seeding {
+		return false
+	}
+	if seedTime > 0 && now.Sub(since) >= seedTime {
+		return true
+	}
+	if ratio > 0 {
+		counters := h.Counters()
+		return counters.Size > 0 && float64(counters.Uploaded) >= ratio*float64(counters.Size)
+	}
+	return false
+}
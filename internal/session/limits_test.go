@@ -0,0 +1,62 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetRateLimits(t *testing.T) {
+	config := testConfig(t)
+	config.DownloadRateLimit = 1000
+	s := newTestSession(t, config)
+
+	if down, up := s.RateLimits(); down != 1000 || up != 0 {
+		t.Errorf("RateLimits() = %d, %d, want 1000, 0", down, up)
+	}
+
+	s.SetRateLimits(0, 2000)
+	if down, up := s.RateLimits(); down != 0 || up != 2000 {
+		t.Errorf("RateLimits() after SetRateLimits = %d, %d, want 0, 2000", down, up)
+	}
+	if got := s.Config().UploadRateLimit; got != 2000 {
+		t.Errorf("Config().UploadRateLimit = %d, want 2000", got)
+	}
+}
+
+func TestSeedGoalReached(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "seed.bin") // 1000 bytes
+
+	now := time.Now()
+	h.mu.Lock()
+	h.setState(StateSeeding, nil)
+	h.seedingSince = now.Add(-time.Hour)
+	h.uploaded = 1500
+	h.unlock()
+
+	tests := []struct {
+		name  string
+		ratio float64
+		time  time.Duration
+		want  bool
+	}{
+		{"no limits", 0, 0, false},
+		{"ratio reached", 1.5, 0, true},
+		{"ratio not reached", 2, 0, false},
+		{"time reached", 0, time.Hour, true},
+		{"time not reached", 0, 2 * time.Hour, false},
+		{"either reached", 2, time.Hour, true},
+	}
+	for _, tt := range tests {
+		if got := h.seedGoalReached(tt.ratio, tt.time, now); got != tt.want {
+			t.Errorf("%s: seedGoalReached = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	h.mu.Lock()
+	h.setState(StateQueued, nil)
+	h.unlock()
+	if h.seedGoalReached(1, 0, now) {
+		t.Error("seedGoalReached is true for a queued torrent")
+	}
+}
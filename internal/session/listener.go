@@ -0,0 +1,146 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+)
+
+// ListenAttempts is how many random ports of the listen port range are
+// tried before giving up
+const ListenAttempts = 10
+
+// Listen starts accepting incoming peer connections on the listen port, or
+// a random free port of the listen port range, on the bind address if one
+// is set
+func (s *Session) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if s.listener != nil {
+		return errors.New("session is already listening")
+	}
+
+	host := ""
+	if s.bindIP != nil {
+		host = s.bindIP.String()
+	}
+	listener, err := s.listen(host)
+	if err != nil {
+		return err
+	}
+
+	// Report the real port to trackers when it was picked for us or at
+	// random
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		s.config.ListenPort = uint16(tcpAddr.Port)
+	}
+
+	s.listener = listener
+	s.wg.Add(1)
+	go s.acceptLoop(listener)
+
+	return nil
+}
+
+// listen opens a TCP listener on host, trying random ports of the listen
+// port range until one is free (must hold s.mu)
+func (s *Session) listen(host string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.config.ReusePort {
+		lc.Control = reusePort
+	}
+
+	first, last := int(s.config.ListenPort), int(s.config.ListenPortMax)
+	if last <= first {
+		addr := net.JoinHostPort(host, strconv.Itoa(first))
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		return listener, nil
+	}
+
+	var err error
+	for i := 0; i < ListenAttempts; i++ {
+		port := first + rand.IntN(last-first+1)
+		var listener net.Listener
+		listener, err = lc.Listen(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to listen on a port from %d to %d: %w", first, last, err)
+}
+
+// Addr returns the listener address, or nil if the session is not listening
+func (s *Session) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// ListenPort returns the port the session listens on, or 0 if it is not
+// listening
+func (s *Session) ListenPort() uint16 {
+	if tcpAddr, ok := s.Addr().(*net.TCPAddr); ok {
+		return uint16(tcpAddr.Port)
+	}
+	return 0
+}
+
+// acceptLoop accepts connections until the listener is closed
+func (s *Session) acceptLoop(listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Warn("Accept failed", "err", err)
+			continue
+		}
+
+		go s.handleIncoming(conn)
+	}
+}
+
+// handleIncoming reads the handshake of an accepted connection and hands
+// the connection to the torrent it names
+func (s *Session) handleIncoming(conn net.Conn) {
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.filter.Blocked(tcpAddr.IP) {
+		conn.Close()
+		return
+	}
+	conn = s.limit(conn)
+
+	handshake, err := peer.ReadHandshakeTimeout(conn, peer.HandshakeTimeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	h, err := s.Get(handshake.InfoHash)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if err := h.acceptPeer(conn, handshake); err != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// startListeningTorrent returns a listening session running one torrent
+func startListeningTorrent(t *testing.T) (*Session, *Handle) {
+	t.Helper()
+
+	config := testConfig(t)
+	config.ListenPort = 0
+	s := newTestSession(t, config)
+
+	data := testTorrentData(t, "incoming.bin")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	h, err := s.AddTorrentURL(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("AddTorrentURL failed: %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	return s, h
+}
+
+// loopbackAddr returns the IPv4 loopback address of the listener
+func loopbackAddr(s *Session) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Addr().(*net.TCPAddr).Port))
+}
+
+func TestListenAcceptsHandshake(t *testing.T) {
+	s, h := startListeningTorrent(t)
+
+	conn, err := net.Dial("tcp", loopbackAddr(s))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	remoteID := [20]byte{'-', 'T', 'T', '0', '0', '0', '1', '-'}
+	if err := peer.NewHandshake(h.InfoHash(), remoteID).Write(conn); err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
+
+	reply, err := peer.Read(conn)
+	if err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if reply.InfoHash != h.InfoHash() {
+		t.Errorf("reply info hash = %x, want %x", reply.InfoHash, h.InfoHash())
+	}
+	if reply.PeerID != s.PeerID() {
+		t.Errorf("reply peer ID = %x, want %x", reply.PeerID, s.PeerID())
+	}
+
+	// The peer is registered just after the reply is written
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().ActivePeers == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := s.Stats()
+	if stats.PeersBySource[peer.SourceIncoming] != 1 {
+		t.Errorf("incoming peers = %d, want 1 (stats %+v)", stats.PeersBySource[peer.SourceIncoming], stats)
+	}
+	if infos := h.Peers(); len(infos) != 1 || infos[0].Source != peer.SourceIncoming {
+		t.Errorf("Peers() = %+v, want one incoming peer", infos)
+	}
+}
+
+func TestListenRejectsUnknownAndBlocked(t *testing.T) {
+	s, h := startListeningTorrent(t)
+
+	expectClosed := func(name string, infoHash [20]byte) {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", loopbackAddr(s))
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		peer.NewHandshake(infoHash, [20]byte{1}).Write(conn)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		var buf bytes.Buffer
+		if n, _ := buf.ReadFrom(conn); n != 0 {
+			t.Errorf("%s: received %d bytes, want connection closed", name, n)
+		}
+	}
+
+	expectClosed("unknown torrent", [20]byte{0xff})
+
+	if err := s.IPFilter().AddString("127.0.0.0/8"); err != nil {
+		t.Fatalf("AddString failed: %v", err)
+	}
+	expectClosed("blocked address", h.InfoHash())
+}
+
+func TestHandleAddPeer(t *testing.T) {
+	seed, seedHandle := startListeningTorrent(t)
+
+	tor, err := torrent.Parse(bytes.NewReader(testTorrentData(t, "incoming.bin")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	s := newTestSession(t, testConfig(t))
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if h.InfoHash() != seedHandle.InfoHash() {
+		t.Fatalf("info hash mismatch between sessions")
+	}
+
+	for _, bad := range []string{"", "127.0.0.1", "127.0.0.1:0", "0.0.0.0:6881", "127.0.0.1:70000"} {
+		if err := h.AddPeer(bad); !errors.Is(err, ErrInvalidPeerAddr) {
+			t.Errorf("AddPeer(%q) error = %v, want ErrInvalidPeerAddr", bad, err)
+		}
+	}
+
+	// Added before Start; the peer is dialled once the torrent runs
+	if err := h.AddPeer(loopbackAddr(seed)); err != nil {
+		t.Fatalf("AddPeer failed: %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().PeersBySource[peer.SourceManual] == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := s.Stats().PeersBySource[peer.SourceManual]; got != 1 {
+		t.Errorf("manual peers = %d, want 1", got)
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	// Find a free port and listen from a range starting there
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	first := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	if first > 65535-8 {
+		t.Skip("no room for a port range")
+	}
+
+	config := testConfig(t)
+	config.BindAddress = "127.0.0.1"
+	config.ListenPort = uint16(first)
+	config.ListenPortMax = uint16(first + 8)
+	s := newTestSession(t, config)
+
+	if err := s.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := s.ListenPort()
+	if int(port) < first || int(port) > first+8 {
+		t.Errorf("ListenPort = %d, want one from %d to %d", port, first, first+8)
+	}
+	if got := s.Config().ListenPort; got != port {
+		t.Errorf("Config().ListenPort = %d, want %d", got, port)
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	config := testConfig(t)
+	config.BindAddress = "127.0.0.1"
+	config.ListenPort = 0
+	config.ReusePort = true
+	s := newTestSession(t, config)
+
+	if err := s.Listen(); err != nil {
+		t.Skipf("Listen failed: %v", err)
+	}
+
+	// A second socket may bind the port only if it was shared
+	lc := net.ListenConfig{Control: reusePort}
+	other, err := lc.Listen(context.Background(), "tcp", loopbackAddr(s))
+	if err != nil {
+		t.Fatalf("second Listen on the port failed: %v", err)
+	}
+	other.Close()
+}
+
+func TestNewRejectsBadPortRange(t *testing.T) {
+	config := testConfig(t)
+	config.ListenPort = 7000
+	config.ListenPortMax = 6000
+
+	if _, err := New(config); err == nil {
+		t.Error("New accepted a listen port range that ends before it starts")
+	}
+}
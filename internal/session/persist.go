@@ -0,0 +1,293 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+const (
+	// SessionFile is the torrent list kept in Config.StateDir
+	SessionFile = "session.json"
+
+	// MetainfoFileExt is the extension of the .torrent files cached in
+	// Config.StateDir
+	MetainfoFileExt = ".torrent"
+)
+
+// Saved run states of a torrent; a torrent that was added but never
+// started has none
+const (
+	savedStarted = "started"
+	savedPaused  = "paused"
+	savedStopped = "stopped"
+)
+
+// savedSession is the content of SessionFile
+type savedSession struct {
+	Labels   []Label        `json:"labels,omitempty"`
+	Torrents []savedTorrent `json:"torrents"` // in queue order
+}
+
+// savedTorrent is a torrent as it was when the session state was saved
+type savedTorrent struct {
+	InfoHash       string           `json:"infoHash"`
+	SaveDir        string           `json:"saveDir"`
+	Label          string           `json:"label,omitempty"`
+	State          string           `json:"state,omitempty"`
+	FilePriorities []piece.Priority `json:"filePriorities,omitempty"`
+	SeedOnly       bool             `json:"seedOnly,omitempty"`
+}
+
+// SaveState writes the labels and the list of torrents, with their save
+// directories, labels, file priorities and whether they are started,
+// paused or stopped, to the state directory. It does nothing unless
+// Config.PersistTorrents is set. The session saves its state whenever it
+// changes, so callers rarely need to.
+func (s *Session) SaveState() error {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	return s.saveState()
+}
+
+// persist saves the session state, logging any failure. Once the session
+// is closing it does nothing, so that torrents stopped by Close are
+// restored as they were before it.
+func (s *Session) persist() {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed || s.restoring {
+		return
+	}
+
+	if err := s.saveState(); err != nil {
+		s.logger.Error("Failed to save session state", "err", err)
+	}
+}
+
+// saveState writes SessionFile (must hold s.persistMu)
+func (s *Session) saveState() error {
+	config := s.Config()
+	if !config.PersistTorrents || config.StateDir == "" {
+		return nil
+	}
+
+	// The queue holds every torrent in order
+	q := s.queue
+	q.mu.Lock()
+	handles := append([]*Handle(nil), q.order...)
+	wanted := make([]bool, len(handles))
+	for i, h := range handles {
+		wanted[i] = q.wanted[h]
+	}
+	q.mu.Unlock()
+
+	saved := savedSession{
+		Labels:   s.Labels(),
+		Torrents: make([]savedTorrent, 0, len(handles)),
+	}
+	for i, h := range handles {
+		h.mu.RLock()
+		t := savedTorrent{
+			InfoHash:       h.torrent.InfoHashString(),
+			SaveDir:        h.saveDir,
+			Label:          h.label,
+			FilePriorities: append([]piece.Priority(nil), h.filePriorities...),
+			SeedOnly:       h.seedOnly,
+		}
+		switch {
+		case wanted[i]:
+			t.State = savedStarted
+		case h.state == StatePaused:
+			t.State = savedPaused
+		case h.state == StateStopped || h.state == StateError:
+			t.State = savedStopped
+		}
+		h.mu.RUnlock()
+		saved.Torrents = append(saved.Torrents, t)
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(config.StateDir, SessionFile), data); err != nil {
+		return fmt.Errorf("failed to save session state: %w", err)
+	}
+	return nil
+}
+
+// saveMetainfo caches a torrent's .torrent file in the state directory so
+// Restore can add it again
+func (s *Session) saveMetainfo(t *torrent.Torrent) error {
+	config := s.Config()
+	if !config.PersistTorrents || config.StateDir == "" {
+		return nil
+	}
+	if len(t.Metainfo) == 0 {
+		return errors.New("torrent has no metainfo to save")
+	}
+
+	path := filepath.Join(config.StateDir, t.InfoHashString()+MetainfoFileExt)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := writeFileAtomic(path, t.Metainfo); err != nil {
+		return fmt.Errorf("failed to save metainfo: %w", err)
+	}
+	return nil
+}
+
+// forget deletes the files kept in the state directory for a removed
+// torrent
+func (s *Session) forget(t *torrent.Torrent) {
+	dir := s.Config().StateDir
+	if dir == "" {
+		return
+	}
+	for _, ext := range []string{MetainfoFileExt, ResumeFileExt} {
+		path := filepath.Join(dir, t.InfoHashString()+ext)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("Failed to delete state file", "path", path, "err", err)
+		}
+	}
+}
+
+// Restore adds the torrents listed in the state directory by an earlier
+// session, in their old queue order, and starts or pauses them as they
+// were. A torrent whose resume data is still valid carries on without
+// checking its files; otherwise the data already on disk is hashed when it
+// starts. Torrents that cannot be restored are logged and skipped.
+func (s *Session) Restore() ([]*Handle, error) {
+	dir := s.Config().StateDir
+	if dir == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, SessionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session state: %w", err)
+	}
+
+	var saved savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid session state: %w", err)
+	}
+
+	// Saving part of the list would lose the rest if the process died now
+	s.persistMu.Lock()
+	s.restoring = true
+	s.persistMu.Unlock()
+	defer func() {
+		s.persistMu.Lock()
+		s.restoring = false
+		s.persistMu.Unlock()
+		s.persist()
+	}()
+
+	for _, l := range saved.Labels {
+		if err := s.SetLabel(l); err != nil {
+			s.logger.Error("Failed to restore label", "label", l.Name, "err", err)
+		}
+	}
+
+	var handles []*Handle
+	for _, st := range saved.Torrents {
+		h, err := s.restoreTorrent(dir, st)
+		if err != nil {
+			s.logger.Error("Failed to restore torrent", "infoHash", st.InfoHash, "err", err)
+			continue
+		}
+		handles = append(handles, h)
+	}
+	return handles, nil
+}
+
+// restoreTorrent adds one saved torrent and puts it back in its state
+func (s *Session) restoreTorrent(dir string, st savedTorrent) (*Handle, error) {
+	t, err := torrent.ParseFile(filepath.Join(dir, st.InfoHash+MetainfoFileExt))
+	if err != nil {
+		return nil, err
+	}
+	if t.InfoHashString() != st.InfoHash {
+		return nil, fmt.Errorf("metainfo has info hash %s", t.InfoHashString())
+	}
+	if st.FilePriorities != nil && len(st.FilePriorities) != len(t.GetFiles()) {
+		return nil, fmt.Errorf("%d file priorities for %d files", len(st.FilePriorities), len(t.GetFiles()))
+	}
+
+	if _, ok := s.findLabel(st.Label); st.Label != "" && !ok {
+		s.logger.Warn("Torrent's label no longer exists", "infoHash", st.InfoHash, "label", st.Label)
+		st.Label = ""
+	}
+
+	opts := AddOptions{SaveDir: st.SaveDir, Label: st.Label, SeedOnly: st.SeedOnly}
+	h, err := s.add(t, opts, st.FilePriorities)
+	if err != nil {
+		return nil, err
+	}
+
+	switch st.State {
+	case savedStarted:
+		if err := h.Start(); err != nil {
+			h.logger.Error("Failed to start restored torrent", "err", err)
+		}
+	case savedPaused:
+		h.mu.Lock()
+		h.setState(StatePaused, nil)
+		h.unlock()
+	case savedStopped:
+		h.mu.Lock()
+		h.setState(StateStopped, nil)
+		h.unlock()
+	}
+	return h, nil
+}
+
+// writeFileAtomic replaces the file at path. The data is written to a
+// temporary file and synced before the rename, so a crash leaves either
+// the old content or the new.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory too, so the rename itself survives a crash
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+func persistConfig(t *testing.T) Config {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+	config.PersistTorrents = true
+	return config
+}
+
+func TestRestore(t *testing.T) {
+	config := persistConfig(t)
+
+	s := newTestSession(t, config)
+	started := addTestTorrent(t, s, "started.bin")
+	paused := addTestTorrent(t, s, "paused.bin")
+	stopped := addTestTorrent(t, s, "stopped.bin")
+	added := addMultiFileTorrent(t, s)
+
+	if err := started.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := paused.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := paused.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if err := stopped.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	stopped.Stop()
+	if err := added.SetFilePriority(1, piece.PrioritySkip); err != nil {
+		t.Fatalf("SetFilePriority failed: %v", err)
+	}
+	added.SetQueuePosition(0)
+	s.Close()
+
+	s = newTestSession(t, config)
+	handles, err := s.Restore()
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	want := []struct {
+		name  string
+		state State
+	}{
+		{"multi", StateQueued},
+		{"started.bin", StateDownloading},
+		{"paused.bin", StatePaused},
+		{"stopped.bin", StateStopped},
+	}
+	if len(handles) != len(want) {
+		t.Fatalf("Restore returned %d torrents, want %d", len(handles), len(want))
+	}
+	for i, w := range want {
+		h := handles[i]
+		if h.Name() != w.name || h.State() != w.state || h.QueuePosition() != i {
+			t.Errorf("torrent %d = %s %v at %d, want %s %v", i, h.Name(), h.State(), h.QueuePosition(), w.name, w.state)
+		}
+	}
+	if got := handles[0].Files()[1].Priority; got != piece.PrioritySkip {
+		t.Errorf("restored file priority = %v, want skip", got)
+	}
+
+	// Restored torrents are saved again as they are
+	if err := handles[2].Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	s.Close()
+
+	s = newTestSession(t, config)
+	handles, err = s.Restore()
+	if err != nil {
+		t.Fatalf("second Restore failed: %v", err)
+	}
+	if len(handles) != 4 || handles[2].State() != StateDownloading {
+		t.Errorf("resumed torrent restored as %v, want downloading", handles[2].State())
+	}
+}
+
+func TestRestoreWithoutState(t *testing.T) {
+	s := newTestSession(t, persistConfig(t))
+
+	handles, err := s.Restore()
+	if err != nil || handles != nil {
+		t.Errorf("Restore = %v, %v, want nothing", handles, err)
+	}
+}
+
+func TestRestoreSkipsMissingMetainfo(t *testing.T) {
+	config := persistConfig(t)
+
+	s := newTestSession(t, config)
+	h := addTestTorrent(t, s, "gone.bin")
+	addTestTorrent(t, s, "kept.bin")
+	s.Close()
+
+	if err := os.Remove(filepath.Join(config.StateDir, h.torrent.InfoHashString()+MetainfoFileExt)); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSession(t, config)
+	handles, err := s.Restore()
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(handles) != 1 || handles[0].Name() != "kept.bin" {
+		t.Errorf("Restore returned %d torrents, want only kept.bin", len(handles))
+	}
+}
+
+func TestRemoveForgetsTorrent(t *testing.T) {
+	config := persistConfig(t)
+
+	s := newTestSession(t, config)
+	h := addMultiFileTorrent(t, s)
+	stopWithPieces(t, h, 0)
+
+	if err := s.Remove(h.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	for _, ext := range []string{MetainfoFileExt, ResumeFileExt} {
+		path := filepath.Join(config.StateDir, h.torrent.InfoHashString()+ext)
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists after Remove: %v", ext, err)
+		}
+	}
+	s.Close()
+
+	s = newTestSession(t, config)
+	if handles, err := s.Restore(); err != nil || len(handles) != 0 {
+		t.Errorf("Restore = %d torrents, %v, want none", len(handles), err)
+	}
+}
+
+func TestNoPersistTorrents(t *testing.T) {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+
+	s := newTestSession(t, config)
+	addTestTorrent(t, s, "local.bin")
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(config.StateDir, SessionFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("session state saved without PersistTorrents: %v", err)
+	}
+}
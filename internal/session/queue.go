@@ -0,0 +1,300 @@
+package session
+
+import "sync"
+
+const (
+	// DefaultMaxActiveDownloads is the number of torrents downloading at once
+	DefaultMaxActiveDownloads = 5
+
+	// DefaultMaxActiveSeeds is the number of torrents seeding at once
+	DefaultMaxActiveSeeds = 5
+)
+
+// queue decides which started torrents may run. Torrents hold a download
+// or seed slot depending on whether they are complete; the rest wait in
+// StateQueued, ordered by position, and are promoted as slots free up. A
+// torrent further up the queue takes the slot of one further down.
+//
+// The queue's lock may be held while taking a handle's mu, never the
+// other way round.
+type queue struct {
+	mu           sync.Mutex
+	order        []*Handle        // by position, first is highest priority
+	wanted       map[*Handle]bool // started and not paused or stopped
+	active       map[*Handle]bool // holding a slot
+	maxDownloads int
+	maxSeeds     int
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newQueue returns a queue with the given slot limits; 0 means no limit
+func newQueue(maxDownloads, maxSeeds int) *queue {
+	q := &queue{
+		wanted:       make(map[*Handle]bool),
+		active:       make(map[*Handle]bool),
+		maxDownloads: maxDownloads,
+		maxSeeds:     maxSeeds,
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+// close stops promoting and demoting torrents
+func (q *queue) close() {
+	close(q.done)
+	q.wg.Wait()
+}
+
+// run rebalances the queue each time it is woken
+func (q *queue) run() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		}
+
+		start, stop := q.rebalance()
+		for _, h := range stop {
+			h.demote()
+		}
+		for _, h := range start {
+			h.promote()
+		}
+	}
+}
+
+// notify wakes the queue loop without blocking
+func (q *queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// HandleStateChange rebalances after any transition, e.g. a finished
+// download moving from a download slot to a seed slot
+func (q *queue) HandleStateChange(h *Handle, from, to State) {
+	q.notify()
+}
+
+// setLimits changes the slot limits and hands the slots out again
+func (q *queue) setLimits(maxDownloads, maxSeeds int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxDownloads = maxDownloads
+	q.maxSeeds = maxSeeds
+	q.notify()
+}
+
+// add appends a torrent to the end of the queue
+func (q *queue) add(h *Handle) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.order = append(q.order, h)
+}
+
+// remove drops a torrent from the queue, freeing its slot
+func (q *queue) remove(h *Handle) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i := q.position(h); i >= 0 {
+		q.order = append(q.order[:i], q.order[i+1:]...)
+	}
+	delete(q.wanted, h)
+	delete(q.active, h)
+	q.notify()
+}
+
+// admit marks a torrent as started and returns true if it may run now
+func (q *queue) admit(h *Handle) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.wanted[h] = true
+	if q.active[h] {
+		return true
+	}
+
+	downloads, seeds := 0, 0
+	for active := range q.active {
+		if active.complete() {
+			seeds++
+		} else {
+			downloads++
+		}
+	}
+	if !q.fits(h.complete(), downloads, seeds) {
+		return false
+	}
+	q.active[h] = true
+	return true
+}
+
+// release marks a torrent as paused or stopped, freeing its slot, and
+// returns whether it had been started
+func (q *queue) release(h *Handle) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wanted := q.wanted[h]
+	delete(q.wanted, h)
+	delete(q.active, h)
+	q.notify()
+	return wanted
+}
+
+// isWanted returns true if the torrent was started and not since paused
+// or stopped
+func (q *queue) isWanted(h *Handle) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.wanted[h]
+}
+
+// isActive returns true if the torrent holds a slot
+func (q *queue) isActive(h *Handle) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active[h]
+}
+
+// fits returns true if another download or seed fits next to the counts
+// given (must hold q.mu)
+func (q *queue) fits(complete bool, downloads, seeds int) bool {
+	if complete {
+		return q.maxSeeds <= 0 || seeds < q.maxSeeds
+	}
+	return q.maxDownloads <= 0 || downloads < q.maxDownloads
+}
+
+// rebalance hands out slots in queue order and returns the torrents that
+// gained and lost one
+func (q *queue) rebalance() (start, stop []*Handle) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	downloads, seeds := 0, 0
+	for _, h := range q.order {
+		if !q.wanted[h] {
+			continue
+		}
+
+		complete := h.complete()
+		fits := q.fits(complete, downloads, seeds)
+		if fits && complete {
+			seeds++
+		} else if fits {
+			downloads++
+		}
+
+		switch {
+		case fits && !q.active[h]:
+			q.active[h] = true
+			start = append(start, h)
+		case !fits && q.active[h]:
+			delete(q.active, h)
+			stop = append(stop, h)
+		}
+	}
+	return start, stop
+}
+
+// position returns a torrent's index in the queue or -1 (must hold q.mu)
+func (q *queue) position(h *Handle) int {
+	for i, queued := range q.order {
+		if queued == h {
+			return i
+		}
+	}
+	return -1
+}
+
+// QueuePosition returns the torrent's place in the session queue, 0 being
+// the highest priority, or -1 once it is removed
+func (h *Handle) QueuePosition() int {
+	q := h.session.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.position(h)
+}
+
+// SetQueuePosition moves the torrent to pos in the session queue. Positions
+// past the end move it to the back. Slots are handed out again in the new
+// order.
+func (h *Handle) SetQueuePosition(pos int) {
+	q := h.session.queue
+	q.mu.Lock()
+	i := q.position(h)
+	if i < 0 {
+		q.mu.Unlock()
+		return
+	}
+	q.order = append(q.order[:i], q.order[i+1:]...)
+
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(q.order) {
+		pos = len(q.order)
+	}
+	q.order = append(q.order[:pos], append([]*Handle{h}, q.order[pos:]...)...)
+	q.notify()
+	q.mu.Unlock()
+
+	h.session.persist()
+}
+
+// promote starts a torrent the queue gave a slot to
+func (h *Handle) promote() {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+
+	// Paused or stopped since the queue decided
+	if !h.session.queue.isActive(h) {
+		return
+	}
+	if err := h.activate(); err != nil {
+		h.logger.Error("Failed to start torrent", "err", err)
+		h.session.queue.release(h)
+	}
+}
+
+// demote stops a torrent that lost its slot, keeping its progress
+func (h *Handle) demote() {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+
+	if h.session.queue.isActive(h) {
+		return
+	}
+
+	h.mu.Lock()
+	if !h.state.Active() {
+		h.unlock()
+		return
+	}
+	h.cancel()
+	h.setState(StateQueued, nil)
+	h.unlock()
+
+	h.stopPeers()
+}
+
+// complete returns true if every piece of the torrent is verified
+func (h *Handle) complete() bool {
+	h.mu.RLock()
+	pieces := h.pieces
+	h.mu.RUnlock()
+
+	return pieces != nil && pieces.IsComplete()
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// queuedHandle returns a handle with its completeness set, for queue tests
+func queuedHandle(complete bool) *Handle {
+	pieces := piece.NewManager(1, piece.BlockSize, piece.BlockSize, make([][20]byte, 1))
+	if complete {
+		pieces.MarkPieceVerified(0)
+	}
+	return &Handle{pieces: pieces}
+}
+
+func TestQueueRebalance(t *testing.T) {
+	download1, download2, download3 := queuedHandle(false), queuedHandle(false), queuedHandle(false)
+	seed1, seed2 := queuedHandle(true), queuedHandle(true)
+	names := map[*Handle]string{
+		download1: "download1", download2: "download2", download3: "download3",
+		seed1: "seed1", seed2: "seed2",
+	}
+
+	q := &queue{
+		order:        []*Handle{download1, seed1, download2, seed2, download3},
+		wanted:       map[*Handle]bool{download1: true, seed1: true, download2: true, seed2: true},
+		active:       map[*Handle]bool{download2: true, seed2: true},
+		maxDownloads: 1,
+		maxSeeds:     1,
+		wake:         make(chan struct{}, 1),
+	}
+
+	start, stop := q.rebalance()
+
+	// Higher positions take the slots of lower ones; download3 was never
+	// started
+	var started, stopped []string
+	for _, h := range start {
+		started = append(started, names[h])
+	}
+	for _, h := range stop {
+		stopped = append(stopped, names[h])
+	}
+	if len(started) != 2 || started[0] != "download1" || started[1] != "seed1" {
+		t.Errorf("started = %v, want [download1 seed1]", started)
+	}
+	if len(stopped) != 2 || stopped[0] != "download2" || stopped[1] != "seed2" {
+		t.Errorf("stopped = %v, want [download2 seed2]", stopped)
+	}
+
+	// Balanced now
+	if start, stop := q.rebalance(); len(start) != 0 || len(stop) != 0 {
+		t.Errorf("second rebalance started %d and stopped %d, want none", len(start), len(stop))
+	}
+}
+
+// waitForState waits for the queue loop to move a handle to state
+func waitForState(t *testing.T, h *Handle, state State) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: State = %v, want %v", h.Name(), h.State(), state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueuePromotion(t *testing.T) {
+	config := testConfig(t)
+	config.MaxActiveDownloads = 1
+	s := newTestSession(t, config)
+	first := addTestTorrent(t, s, "first.bin")
+	second := addTestTorrent(t, s, "second.bin")
+
+	for _, h := range []*Handle{first, second} {
+		if err := h.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	}
+	if first.State() != StateDownloading || second.State() != StateQueued {
+		t.Fatalf("states = %v, %v, want downloading, queued", first.State(), second.State())
+	}
+
+	// Moving the second torrent up swaps the slot
+	second.SetQueuePosition(0)
+	if second.QueuePosition() != 0 || first.QueuePosition() != 1 {
+		t.Errorf("positions = %d, %d, want 1, 0", first.QueuePosition(), second.QueuePosition())
+	}
+	waitForState(t, second, StateDownloading)
+	waitForState(t, first, StateQueued)
+
+	// Pausing frees the slot for the next in line
+	if err := second.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	waitForState(t, first, StateDownloading)
+
+	// Removing a torrent drops it from the queue
+	if err := s.Remove(first.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if first.QueuePosition() != -1 || second.QueuePosition() != 0 {
+		t.Errorf("positions after Remove = %d, %d, want -1, 0", first.QueuePosition(), second.QueuePosition())
+	}
+}
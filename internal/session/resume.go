@@ -0,0 +1,268 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+const (
+	// ResumeFileExt is the extension of resume data files in Config.StateDir
+	ResumeFileExt = ".resume"
+
+	// DefaultResumeSavePieces is how many pieces are verified between
+	// saves of a running torrent's resume data
+	DefaultResumeSavePieces = 32
+)
+
+// errStaleResumeData means resume data no longer matches the files on disk
+var errStaleResumeData = errors.New("resume data is stale")
+
+// ResumeData is what a torrent needs to carry on where it left off after
+// a restart without hashing its files again
+type ResumeData struct {
+	InfoHash       string               `json:"infoHash"`
+	SaveDir        string               `json:"saveDir"`
+	Pieces         []byte               `json:"pieces"`            // bitfield of verified pieces
+	Partial        []piece.PartialPiece `json:"partial,omitempty"` // arrived blocks of other pieces, kept in the files
+	Downloaded     int64                `json:"downloaded"`
+	Uploaded       int64                `json:"uploaded"`
+	FilePriorities []piece.Priority     `json:"filePriorities,omitempty"`
+	Files          []ResumeFile         `json:"files"`
+	SavedAt        time.Time            `json:"savedAt"`
+
+	// Running is set for resume data saved while the torrent was running,
+	// whose files may since have been written by a session that crashed
+	Running bool `json:"running,omitempty"`
+}
+
+// ResumeFile records a file as it was when resume data was saved, so a
+// file changed since then is noticed
+type ResumeFile struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"modTime"` // nanoseconds since the epoch
+}
+
+// resumePath returns where a torrent's resume data is kept, or "" if the
+// session does not keep any
+func (h *Handle) resumePath() string {
+	dir := h.session.Config().StateDir
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, h.torrent.InfoHashString()+ResumeFileExt)
+}
+
+// SaveResumeData writes the torrent's verified pieces, which blocks of the
+// others have arrived, its transfer totals and file priorities to the
+// session's state directory. The arrived blocks are written to the
+// torrent's files first, so only a bitmap of them is saved. It does
+// nothing if the session has no state directory or the torrent has not
+// been started.
+func (h *Handle) SaveResumeData() error {
+	path := h.resumePath()
+	if path == "" {
+		return nil
+	}
+
+	h.mu.RLock()
+	pieces := h.pieces
+	priorities := append([]piece.Priority(nil), h.filePriorities...)
+	running := h.state.Active()
+	h.mu.RUnlock()
+
+	if pieces == nil {
+		return nil
+	}
+
+	counters := h.Counters()
+	snapshot := pieces.Snapshot()
+	data := ResumeData{
+		InfoHash:       h.torrent.InfoHashString(),
+		SaveDir:        h.saveDir,
+		Pieces:         snapshot.Verified,
+		Partial:        snapshot.Partial,
+		Downloaded:     counters.Downloaded,
+		Uploaded:       counters.Uploaded,
+		FilePriorities: priorities,
+		SavedAt:        time.Now(),
+		Running:        running,
+	}
+	files, err := h.statFiles()
+	if err != nil {
+		return fmt.Errorf("failed to save resume data: %w", err)
+	}
+	data.Files = files
+
+	if err := writeResumeData(path, &data); err != nil {
+		return fmt.Errorf("failed to save resume data: %w", err)
+	}
+	return nil
+}
+
+// checkpoint counts a newly verified piece and saves resume data in the
+// background once Config.ResumeSavePieces have been verified since the
+// last save, so a crash loses at most that many pieces. Pieces are synced
+// to disk before they are verified, so the saved bitfield never claims
+// data that a crash could lose.
+func (h *Handle) checkpoint() {
+	every := h.session.Config().ResumeSavePieces
+	if every <= 0 || h.resumePath() == "" {
+		return
+	}
+	if h.unsaved.Add(1) >= int64(every) {
+		h.saveInBackground()
+	}
+}
+
+// saveInBackground saves resume data from a new goroutine unless a save is
+// already running. stopPeers waits for it before the final save.
+func (h *Handle) saveInBackground() {
+	if !h.saving.CompareAndSwap(false, true) {
+		return
+	}
+	h.unsaved.Store(0)
+
+	h.saves.Add(1)
+	go func() {
+		defer h.saves.Done()
+		defer h.saving.Store(false)
+		if err := h.SaveResumeData(); err != nil {
+			h.logger.Warn("Failed to save resume data", "err", err)
+		}
+	}()
+}
+
+// restore carries the transfer totals and file priorities over from resume
+// data saved by an earlier session. The pieces are restored when the
+// torrent opens, if its files are unchanged. It is called before the
+// handle is added to the session.
+func (h *Handle) restore() {
+	data, err := h.loadResumeData()
+	if err != nil {
+		h.logger.Warn("Ignoring resume data", "err", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	h.downloaded = data.Downloaded
+	h.uploaded = data.Uploaded
+	h.filePriorities = data.FilePriorities
+}
+
+// loadResumeData reads the torrent's resume data, returning nil if there
+// is none
+func (h *Handle) loadResumeData() (*ResumeData, error) {
+	path := h.resumePath()
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data ResumeData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("invalid resume data: %w", err)
+	}
+	if err := h.validateResumeData(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// validateResumeData checks resume data belongs to this torrent
+func (h *Handle) validateResumeData(data *ResumeData) error {
+	if data.InfoHash != h.torrent.InfoHashString() {
+		return fmt.Errorf("invalid resume data: info hash %s", data.InfoHash)
+	}
+	if len(data.Pieces) != (h.torrent.NumPieces()+7)/8 {
+		return fmt.Errorf("invalid resume data: bitfield of %d bytes", len(data.Pieces))
+	}
+	if spare := h.torrent.NumPieces() % 8; spare != 0 && data.Pieces[len(data.Pieces)-1]&(0xff>>spare) != 0 {
+		return errors.New("invalid resume data: spare bits set")
+	}
+	if data.FilePriorities != nil && len(data.FilePriorities) != len(h.torrent.GetFiles()) {
+		return fmt.Errorf("invalid resume data: %d file priorities", len(data.FilePriorities))
+	}
+	return nil
+}
+
+// restorePieces brings a new piece manager to the state resume data
+// recorded. Partial pieces that do not fit the torrent are dropped, and
+// only the verified pieces are restored.
+func (h *Handle) restorePieces(pieces *piece.Manager, data *ResumeData) {
+	snapshot := piece.Snapshot{
+		NumPieces: h.torrent.NumPieces(),
+		Verified:  data.Pieces,
+		Partial:   data.Partial,
+	}
+	if err := pieces.Restore(snapshot); err != nil {
+		h.logger.Warn("Ignoring partial pieces in resume data", "err", err)
+		snapshot.Partial = nil
+		pieces.Restore(snapshot)
+	}
+}
+
+// checkResumeFiles checks the torrent's files are where they were and
+// unchanged since the resume data was saved, so its pieces can be trusted
+func (h *Handle) checkResumeFiles(data *ResumeData) error {
+	if data.SaveDir != h.saveDir {
+		return fmt.Errorf("%w: saved for %s", errStaleResumeData, data.SaveDir)
+	}
+	files, err := h.statFiles()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errStaleResumeData, err)
+	}
+	if len(files) != len(data.Files) {
+		return errStaleResumeData
+	}
+	for i := range files {
+		if files[i] == data.Files[i] {
+			continue
+		}
+		// A session that crashed after saving went on writing pieces the
+		// resume data does not claim
+		if data.Running && files[i].Size == data.Files[i].Size && files[i].ModTime >= data.Files[i].ModTime {
+			continue
+		}
+		return fmt.Errorf("%w: %s changed", errStaleResumeData, h.torrent.GetFiles()[i].Path)
+	}
+	return nil
+}
+
+// statFiles returns the size and modification time of each of the
+// torrent's files
+func (h *Handle) statFiles() ([]ResumeFile, error) {
+	infos := h.torrent.GetFiles()
+	files := make([]ResumeFile, len(infos))
+	for i, info := range infos {
+		fi, err := os.Stat(filepath.Join(h.saveDir, info.Path))
+		if err != nil {
+			return nil, err
+		}
+		files[i] = ResumeFile{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	}
+	return files, nil
+}
+
+// writeResumeData encodes resume data and writes it to path
+func writeResumeData(path string, data *ResumeData) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, raw)
+}
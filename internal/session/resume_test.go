@@ -0,0 +1,278 @@
+package session
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// stopWithPieces starts the handle, marks pieces verified and stops it,
+// which saves its resume data
+func stopWithPieces(t *testing.T, h *Handle, pieces ...int) {
+	t.Helper()
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for _, index := range pieces {
+		if err := h.pieces.MarkPieceVerified(index); err != nil {
+			t.Fatalf("MarkPieceVerified(%d) failed: %v", index, err)
+		}
+	}
+	h.Stop()
+}
+
+func TestResumeData(t *testing.T) {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+
+	s := newTestSession(t, config)
+	h := addMultiFileTorrent(t, s)
+	if err := h.SetFilePriority(2, piece.PriorityHigh); err != nil {
+		t.Fatalf("SetFilePriority failed: %v", err)
+	}
+	h.uploaded = 12345
+	stopWithPieces(t, h, 0, 2)
+	s.Close()
+
+	path := filepath.Join(config.StateDir, h.torrent.InfoHashString()+ResumeFileExt)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("resume data not saved: %v", err)
+	}
+
+	// A new session picks up where the last one stopped
+	s = newTestSession(t, config)
+	h = addMultiFileTorrent(t, s)
+	if got := h.Counters().Uploaded; got != 12345 {
+		t.Errorf("Uploaded = %d, want 12345", got)
+	}
+	if got := h.Files()[2].Priority; got != piece.PriorityHigh {
+		t.Errorf("file 2 priority = %v, want high", got)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for index, want := range []bool{true, false, true} {
+		if got := h.pieces.HasPiece(index); got != want {
+			t.Errorf("HasPiece(%d) = %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestResumeDataAcrossRestart(t *testing.T) {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+
+	s := newTestSession(t, config)
+	h := addMultiFileTorrent(t, s)
+	stopWithPieces(t, h, 1)
+
+	// Stopping closes the files, so starting again relies on resume data
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if !h.pieces.HasPiece(1) {
+		t.Error("piece 1 lost across Stop and Start")
+	}
+}
+
+func TestResumePartialPieces(t *testing.T) {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "partial.bin",
+			"piece length": int64(2 * piece.BlockSize),
+			"pieces":       strings.Repeat("a", 2*20),
+			"length":       int64(4 * piece.BlockSize),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	add := func(s *Session) *Handle {
+		tor, err := torrent.Parse(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		h, err := s.Add(tor)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		return h
+	}
+
+	s := newTestSession(t, config)
+	h := add(s)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	block := bytes.Repeat([]byte{7}, piece.BlockSize)
+	if err := h.pieces.AddBlockData(1, piece.BlockSize, block); err != nil {
+		t.Fatalf("AddBlockData failed: %v", err)
+	}
+	h.Stop()
+	s.Close()
+
+	// The block that arrived is not downloaded again after a restart
+	s = newTestSession(t, config)
+	h = add(s)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	p := h.pieces.GetPiece(1)
+	if got := p.DownloadedBlocks(); got[0] != 0x40 {
+		t.Fatalf("piece 1 blocks = %08b, want 01000000", got)
+	}
+	if got := p.Blocks[1].Data; !bytes.Equal(got, block) {
+		t.Error("restored block data differs")
+	}
+}
+
+func TestResumeDataStale(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, config *Config)
+	}{
+		{"file modified", func(t *testing.T, config *Config) {
+			path := filepath.Join(config.DownloadDir, "multi", "b")
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"file removed", func(t *testing.T, config *Config) {
+			if err := os.Remove(filepath.Join(config.DownloadDir, "multi", "c")); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"save directory moved", func(t *testing.T, config *Config) {
+			dir := t.TempDir()
+			if err := os.Rename(filepath.Join(config.DownloadDir, "multi"), filepath.Join(dir, "multi")); err != nil {
+				t.Fatal(err)
+			}
+			config.DownloadDir = dir
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.StateDir = t.TempDir()
+
+			s := newTestSession(t, config)
+			stopWithPieces(t, addMultiFileTorrent(t, s), 0, 1, 2)
+			s.Close()
+
+			tt.change(t, &config)
+
+			s = newTestSession(t, config)
+			h := addMultiFileTorrent(t, s)
+			if err := h.Start(); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			if got := h.Progress(); got != 0 {
+				t.Errorf("Progress = %v, want 0 with stale resume data", got)
+			}
+		})
+	}
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	config := testConfig(t)
+	config.StateDir = t.TempDir()
+	config.ResumeSavePieces = 2
+
+	s := newTestSession(t, config)
+	h := addMultiFileTorrent(t, s)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	path := h.resumePath()
+	h.pieces.MarkPieceVerified(0)
+	h.saves.Wait()
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("resume data saved after one piece, want two")
+	}
+	h.pieces.MarkPieceVerified(2)
+	h.saves.Wait()
+
+	data, err := h.loadResumeData()
+	if err != nil || data == nil {
+		t.Fatalf("loadResumeData = %v, %v, want a checkpoint", data, err)
+	}
+	if !data.Running || data.Pieces[0] != 0xa0 {
+		t.Errorf("checkpoint running %v with pieces %08b, want running with 0 and 2", data.Running, data.Pieces[0])
+	}
+
+	// The session dies without stopping the torrent, after writing more
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(config.DownloadDir, "multi", "b"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSession(t, config)
+	h = addMultiFileTorrent(t, s)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for index, want := range []bool{true, false, true} {
+		if got := h.pieces.HasPiece(index); got != want {
+			t.Errorf("HasPiece(%d) = %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestValidateResumeData(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addMultiFileTorrent(t, s)
+
+	valid := func() *ResumeData {
+		return &ResumeData{InfoHash: h.torrent.InfoHashString(), Pieces: []byte{0xa0}}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(d *ResumeData)
+		valid  bool
+	}{
+		{"valid", func(d *ResumeData) {}, true},
+		{"other torrent", func(d *ResumeData) { d.InfoHash = "00" }, false},
+		{"short bitfield", func(d *ResumeData) { d.Pieces = nil }, false},
+		{"spare bits", func(d *ResumeData) { d.Pieces = []byte{0xf0} }, false},
+		{"priorities", func(d *ResumeData) { d.FilePriorities = []piece.Priority{piece.PriorityHigh} }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := valid()
+			tt.modify(data)
+			if err := h.validateResumeData(data); (err == nil) != tt.valid {
+				t.Errorf("validateResumeData = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestNoStateDir(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addMultiFileTorrent(t, s)
+	stopWithPieces(t, h, 0)
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if h.pieces.HasPiece(0) {
+		t.Error("piece 0 kept across restart without a state directory")
+	}
+}
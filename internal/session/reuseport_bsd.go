@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package session
+
+import "syscall"
+
+// soReusePort is the SO_REUSEPORT socket option
+const soReusePort = syscall.SO_REUSEPORT
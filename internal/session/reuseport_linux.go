@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package session
+
+// soReusePort is SO_REUSEPORT, which syscall lacks on 386, amd64 and arm
+const soReusePort = 0xf
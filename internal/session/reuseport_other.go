@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(mips || mipsle || mips64 || mips64le)))
+
+package session
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails where SO_REUSEPORT is not supported
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("port reuse is not supported on this platform")
+}
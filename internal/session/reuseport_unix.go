@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(mips || mipsle || mips64 || mips64le))
+
+package session
+
+import "syscall"
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound, so other
+// sockets may bind the same port
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
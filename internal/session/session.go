@@ -0,0 +1,613 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/ipfilter"
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/ratelimit"
+	"github.com/mt/bittorrent-impl/internal/socks5"
+	"github.com/mt/bittorrent-impl/internal/stats"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+const (
+	// DefaultListenPort is the port reported to trackers
+	DefaultListenPort = 6881
+
+	// DefaultNumWant is the number of peers requested per announce
+	DefaultNumWant = 50
+
+	// DefaultAnnounceConcurrency is how many tracker tiers are announced
+	// to at once
+	DefaultAnnounceConcurrency = 4
+
+	// DefaultMaxTorrentFileSize bounds .torrent files fetched over HTTP
+	DefaultMaxTorrentFileSize = 10 * 1024 * 1024 // 10MB
+
+	// FetchTimeout is the timeout for downloading a .torrent file
+	FetchTimeout = 30 * time.Second
+)
+
+var (
+	ErrDuplicateTorrent  = errors.New("torrent already added")
+	ErrTorrentNotFound   = errors.New("torrent not found")
+	ErrSessionClosed     = errors.New("session closed")
+	ErrInvalidPeerAddr   = errors.New("invalid peer address")
+	ErrTorrentNotRunning = errors.New("torrent is not running")
+	ErrLabelNotFound     = errors.New("label not found")
+	ErrInvalidLabel      = errors.New("invalid label")
+	ErrIncompleteData    = errors.New("existing data is incomplete")
+)
+
+// Config contains session-wide settings
+type Config struct {
+	DownloadDir        string // directory torrents are saved to
+	ListenPort         uint16 // port to listen on, 0 for any; once listening, the port in use, which is reported to trackers
+	ListenPortMax      uint16 // if above ListenPort, listen on a random free port from ListenPort to ListenPortMax
+	ReusePort          bool   // set SO_REUSEPORT on the listener, so other sockets such as a uTP one may share its port
+	Strategy           string // piece selection strategy name, as registered with piece.RegisterStrategy
+	NumWant            int    // peers requested per announce
+	MaxTorrentFileSize int64  // size limit for AddTorrentURL
+
+	// Smart strategy settings, 0 for the piece package defaults
+	Bootstrap        piece.BootstrapMode // how a torrent's first pieces are picked
+	BootstrapPieces  int                 // pieces picked that way before rarest-first
+	EndGamePieces    int                 // pieces left when end game starts
+	EndGameAnyPieces int                 // pieces left when end game takes any piece a peer has
+
+	// Tracker tiers announced to at once. Above 1, every tier is announced
+	// to and the peers returned are merged; 0 or 1 announces to the first
+	// tracker that answers.
+	AnnounceConcurrency int
+
+	TrackerProxy     string            // proxy URL for tracker requests
+	TrackerTLSConfig *tls.Config       // TLS settings for HTTPS trackers
+	PeerProxy        string            // socks5://[user:pass@]host:port for peer connections
+	Blocklist        string            // path to a PeerGuardian, eMule or CIDR block list
+	SuppressHave     bool              // skip HAVE messages to peers that already have the piece
+	BitfieldMode     peer.BitfieldMode // how our pieces are announced to new peers
+	UploadSlots      int               // peers each torrent uploads to at once, peer.AutoUploadSlots to tune it to the upload limit
+
+	MaxMessageLength int // longest message a peer may send, 0 for peer.MaxMessageLength; a bitfield the torrent needs always fits
+	MaxRequestLength int // longest block a peer may request, 0 for peer.MaxRequestLength; longer requests are refused
+
+	PeerIdleTimeout time.Duration // disconnect peers that send nothing, not even a keep-alive, for this long; 0 for peer.IdleTimeout
+
+	BindAddress    string // local IP or interface name for the listener and all outgoing connections, empty for any
+	BindKillSwitch bool   // pause every torrent while the bind address is gone, e.g. when a VPN drops
+
+	MaxActiveDownloads int // torrents downloading at once, 0 for no limit
+	MaxActiveSeeds     int // torrents seeding at once, 0 for no limit
+
+	MaxPartialPieces int   // pieces each torrent downloads at once, 0 for no limit
+	MaxPartialBytes  int64 // bytes of unverified blocks each torrent holds in memory, 0 for no limit
+
+	DownloadRateLimit int64         // bytes per second across all peers, 0 for no limit
+	UploadRateLimit   int64         // bytes per second across all peers, 0 for no limit
+	SeedRatio         float64       // stop seeding after uploading this many times the size, 0 to seed on
+	SeedTime          time.Duration // stop seeding after this long, 0 to seed on
+
+	AltDownloadRateLimit int64     // download limit while alternate speed is on, 0 for no limit
+	AltUploadRateLimit   int64     // upload limit while alternate speed is on, 0 for no limit
+	AltSchedule          *Schedule // when to turn alternate speed on, nil to only do it by hand
+
+	StateDir         string // directory resume data is saved in, empty to save none
+	PersistTorrents  bool   // also keep the torrent list in StateDir for Restore
+	ResumeSavePieces int    // save a running torrent's resume data after this many pieces, 0 only when it stops
+
+	Logger *logging.Logger // component loggers; nil logs through slog.Default
+}
+
+// DefaultConfig returns the default session configuration
+func DefaultConfig() Config {
+	return Config{
+		DownloadDir:         ".",
+		ListenPort:          DefaultListenPort,
+		Strategy:            "smart",
+		NumWant:             DefaultNumWant,
+		AnnounceConcurrency: DefaultAnnounceConcurrency,
+		MaxTorrentFileSize:  DefaultMaxTorrentFileSize,
+		MaxActiveDownloads:  DefaultMaxActiveDownloads,
+		MaxActiveSeeds:      DefaultMaxActiveSeeds,
+		ResumeSavePieces:    DefaultResumeSavePieces,
+	}
+}
+
+// Session owns all torrents and the resources they share
+type Session struct {
+	mu         sync.RWMutex
+	config     Config
+	peerID     [20]byte
+	tracker    *tracker.Client
+	peerDialer peer.Dialer
+	filter     *ipfilter.Filter
+	httpClient *http.Client
+	torrents   map[[20]byte]*Handle
+	labels     map[string]*label
+	queue      *queue
+	logger     *slog.Logger
+
+	downloadLimit *ratelimit.Limiter
+	uploadLimit   *ratelimit.Limiter
+	altSpeed      bool // alternate rate limits in force
+	altScheduled  bool // AltSchedule active at its last check
+
+	stats    *stats.Collector
+	handlers []StateHandler
+	alerts   alertHub
+	listener net.Listener
+	done     chan struct{}
+
+	// The local IP connections are bound to, nil for any; whether the kill
+	// switch found it gone, and the torrents it paused
+	bindIP     net.IP
+	bindDown   bool
+	bindPaused []*Handle
+
+	wg     sync.WaitGroup
+	closed bool
+
+	// persistMu serializes writes of the session state, which are held
+	// back while restoring
+	persistMu sync.Mutex
+	restoring bool
+}
+
+// New creates a new session
+func New(config Config) (*Session, error) {
+	if config.MaxTorrentFileSize <= 0 {
+		config.MaxTorrentFileSize = DefaultMaxTorrentFileSize
+	}
+
+	if config.Strategy != "" {
+		if _, err := piece.NewStrategy(config.Strategy); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ListenPortMax != 0 && config.ListenPortMax < config.ListenPort {
+		return nil, fmt.Errorf("invalid listen port range %d-%d", config.ListenPort, config.ListenPortMax)
+	}
+
+	var bindIP net.IP
+	if config.BindAddress != "" {
+		ip, err := resolveBindAddress(config.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind address: %w", err)
+		}
+		bindIP = ip
+	}
+
+	trackerConfig := tracker.DefaultClientConfig()
+	trackerConfig.ProxyURL = config.TrackerProxy
+	trackerConfig.TLSConfig = config.TrackerTLSConfig
+	trackerConfig.LocalAddr = bindIP
+
+	trackerClient, err := tracker.NewClientWithConfig(trackerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracker client: %w", err)
+	}
+
+	var localAddr net.Addr
+	if bindIP != nil {
+		localAddr = &net.TCPAddr{IP: bindIP}
+	}
+	var peerDialer peer.Dialer = &net.Dialer{LocalAddr: localAddr}
+	if config.PeerProxy != "" {
+		proxyDialer, err := socks5.ParseURL(config.PeerProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer proxy: %w", err)
+		}
+		proxyDialer.LocalAddr = localAddr
+		peerDialer = proxyDialer
+	}
+
+	filter := ipfilter.New()
+	if config.Blocklist != "" {
+		if _, err := filter.LoadFile(config.Blocklist); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Logger == nil {
+		config.Logger = logging.New(nil)
+	}
+
+	q := newQueue(config.MaxActiveDownloads, config.MaxActiveSeeds)
+	collector := stats.NewCollector(stats.DefaultInterval)
+	collector.Start()
+
+	downloadLimit := ratelimit.NewLimiter(config.DownloadRateLimit)
+	uploadLimit := ratelimit.NewLimiter(config.UploadRateLimit)
+
+	s := &Session{
+		config:     config,
+		logger:     config.Logger.Component(logging.Session),
+		peerID:     tracker.GeneratePeerID(),
+		tracker:    trackerClient,
+		peerDialer: limitedDialer{peerDialer, downloadLimit, uploadLimit},
+		filter:     filter,
+		httpClient: &http.Client{
+			Timeout: FetchTimeout,
+		},
+		torrents:      make(map[[20]byte]*Handle),
+		labels:        make(map[string]*label),
+		queue:         q,
+		stats:         collector,
+		handlers:      []StateHandler{q},
+		downloadLimit: downloadLimit,
+		uploadLimit:   uploadLimit,
+		done:          make(chan struct{}),
+		bindIP:        bindIP,
+	}
+	if bindIP != nil {
+		s.httpClient.Transport = boundTransport(bindIP)
+	}
+
+	if config.AltSchedule != nil {
+		s.altScheduled = config.AltSchedule.Active(time.Now())
+		s.altSpeed = s.altScheduled
+		s.applyRateLimits()
+
+		s.wg.Add(1)
+		go s.altSpeedLoop()
+	}
+
+	s.wg.Add(1)
+	go s.seedLoop()
+
+	if bindIP != nil && config.BindKillSwitch {
+		s.wg.Add(1)
+		go s.bindLoop()
+	}
+	return s, nil
+}
+
+// Logger returns the session's component loggers, whose levels can be
+// changed while the session runs
+func (s *Session) Logger() *logging.Logger {
+	return s.config.Logger
+}
+
+// SetQueueLimits changes how many torrents may download and seed at once;
+// 0 means no limit. Torrents are promoted or demoted to fit.
+func (s *Session) SetQueueLimits(maxDownloads, maxSeeds int) {
+	s.mu.Lock()
+	s.config.MaxActiveDownloads = maxDownloads
+	s.config.MaxActiveSeeds = maxSeeds
+	s.mu.Unlock()
+
+	s.queue.setLimits(maxDownloads, maxSeeds)
+}
+
+// PeerID returns the peer ID used for all torrents in the session
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// IPFilter returns the session's IP filter. Rules added or removed at
+// runtime apply to all later connections.
+func (s *Session) IPFilter() *ipfilter.Filter {
+	return s.filter
+}
+
+// Config returns the session configuration
+func (s *Session) Config() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Add adds a parsed torrent to the back of the session queue and returns
+// its handle. The torrent is not started until Handle.Start is called.
+func (s *Session) Add(t *torrent.Torrent) (*Handle, error) {
+	return s.AddWithOptions(t, AddOptions{})
+}
+
+// AddOptions are the settings of a torrent being added
+type AddOptions struct {
+	Label   string // label to give the torrent, "" for none
+	SaveDir string // overrides the label's and the session's directory
+
+	// SeedOnly seeds data already in the save directory without writing
+	// to it. The files are opened read-only and hashed, and the torrent
+	// fails with ErrIncompleteData unless every piece matches.
+	SeedOnly bool
+}
+
+// AddWithOptions adds a parsed torrent like Add, with a label or save
+// directory. A labelled torrent is saved in the label's directory unless
+// opts names one.
+func (s *Session) AddWithOptions(t *torrent.Torrent, opts AddOptions) (*Handle, error) {
+	saveDir := s.Config().DownloadDir
+	if opts.Label != "" {
+		l, ok := s.findLabel(opts.Label)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrLabelNotFound, opts.Label)
+		}
+		if l.SaveDir != "" {
+			saveDir = l.SaveDir
+		}
+	}
+	if opts.SaveDir != "" {
+		saveDir = opts.SaveDir
+	}
+	opts.SaveDir = saveDir
+	return s.add(t, opts, nil)
+}
+
+// add adds a torrent saved to opts.SaveDir. File priorities override those
+// in the torrent's resume data unless nil.
+func (s *Session) add(t *torrent.Torrent, opts AddOptions, priorities []piece.Priority) (*Handle, error) {
+	h := newHandle(s, t, opts.SaveDir)
+	h.label = opts.Label
+	h.seedOnly = opts.SeedOnly
+	h.restore()
+	if priorities != nil {
+		h.filePriorities = priorities
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if _, exists := s.torrents[t.InfoHash]; exists {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateTorrent, t.InfoHashString())
+	}
+	s.torrents[t.InfoHash] = h
+	s.queue.add(h)
+	s.stats.Add(t.InfoHashString(), h)
+	s.mu.Unlock()
+
+	if err := s.saveMetainfo(t); err != nil {
+		h.logger.Error("Torrent will not be restored", "err", err)
+	}
+	s.persist()
+	return h, nil
+}
+
+// AddTorrentFile parses a .torrent file from disk and adds it
+func (s *Session) AddTorrentFile(path string) (*Handle, error) {
+	t, err := torrent.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(t)
+}
+
+// AddTorrentURL downloads a .torrent file over HTTP(S) and adds it
+func (s *Session) AddTorrentURL(ctx context.Context, torrentURL string) (*Handle, error) {
+	return s.AddTorrentURLWithOptions(ctx, torrentURL, AddOptions{})
+}
+
+// AddTorrentURLWithOptions downloads a .torrent file over HTTP(S) and adds
+// it like AddWithOptions
+func (s *Session) AddTorrentURLWithOptions(ctx context.Context, torrentURL string, opts AddOptions) (*Handle, error) {
+	t, err := s.fetchTorrent(ctx, torrentURL)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := s.AddWithOptions(t, opts)
+	if err != nil {
+		return nil, err
+	}
+	h.alert(Alert{Type: AlertMetadataReceived})
+	return h, nil
+}
+
+// fetchTorrent downloads and parses a .torrent file, enforcing the size
+// limit and rejecting responses that are clearly not torrent files
+func (s *Session) fetchTorrent(ctx context.Context, torrentURL string) (*torrent.Torrent, error) {
+	u, err := url.Parse(torrentURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported torrent URL scheme: %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/x-bittorrent")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("torrent URL returned status %d", resp.StatusCode)
+	}
+
+	if err := checkTorrentContentType(resp.Header.Get("Content-Type")); err != nil {
+		return nil, err
+	}
+
+	limit := s.Config().MaxTorrentFileSize
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("torrent file too large: %d bytes (limit %d)", resp.ContentLength, limit)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("torrent file too large: exceeds %d bytes", limit)
+	}
+
+	t, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkTorrentContentType accepts the types servers commonly use for
+// .torrent files and rejects text responses such as HTML error pages
+func checkTorrentContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+
+	switch mediaType {
+	case "application/x-bittorrent", "application/octet-stream", "binary/octet-stream":
+		return nil
+	default:
+		return fmt.Errorf("unexpected content type %q for torrent file", mediaType)
+	}
+}
+
+// Get returns the handle for an info hash
+func (s *Session) Get(infoHash [20]byte) (*Handle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, exists := s.torrents[infoHash]
+	if !exists {
+		return nil, ErrTorrentNotFound
+	}
+	return h, nil
+}
+
+// Torrents returns handles for all torrents in the session
+func (s *Session) Torrents() []*Handle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	handles := make([]*Handle, 0, len(s.torrents))
+	for _, h := range s.torrents {
+		handles = append(handles, h)
+	}
+	return handles
+}
+
+// Stats summarises the session's torrents and peers
+type Stats struct {
+	Torrents        int
+	RunningTorrents int
+	ActivePeers     int
+	PeersBySource   map[peer.Source]int
+	Transfer        stats.Snapshot // summed over all torrents at the last sample
+}
+
+// Stats returns counts across all torrents, including connected peers by
+// the mechanism that found them, and the session's transfer totals and
+// rates
+func (s *Session) Stats() Stats {
+	stats := Stats{
+		PeersBySource: make(map[peer.Source]int),
+		Transfer:      s.stats.Total(),
+	}
+	for _, h := range s.Torrents() {
+		stats.Torrents++
+		if h.IsRunning() {
+			stats.RunningTorrents++
+		}
+		for _, info := range h.Peers() {
+			stats.ActivePeers++
+			stats.PeersBySource[info.Source]++
+		}
+	}
+	return stats
+}
+
+// SpeedHistory returns the session's total rates at each recent
+// statistics sample, oldest first
+func (s *Session) SpeedHistory() []stats.Point {
+	return s.stats.TotalHistory()
+}
+
+// Remove stops a torrent and removes it from the session. Downloaded data
+// is left on disk.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	h, exists := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+
+	if !exists {
+		return ErrTorrentNotFound
+	}
+
+	h.Stop()
+	s.queue.remove(h)
+	s.stats.Remove(h.torrent.InfoHashString())
+	s.forget(h.torrent)
+	s.persist()
+	return nil
+}
+
+// Close stops all torrents and closes the session. The session state is
+// saved first, so Restore brings torrents back as they were rather than
+// stopped. Torrents are stopped in parallel so their final announces
+// overlap; each sends its stopped announce, disconnects, finishes writing
+// completed pieces and saves its resume data before its files are closed.
+func (s *Session) Close() {
+	s.persistMu.Lock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.persistMu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	if err := s.saveState(); err != nil {
+		s.logger.Error("Failed to save session state", "err", err)
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	s.persistMu.Unlock()
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	handles := make([]*Handle, 0, len(s.torrents))
+	for _, h := range s.torrents {
+		handles = append(handles, h)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	s.queue.close()
+	s.stats.Stop()
+
+	var wg sync.WaitGroup
+	for _, h := range handles {
+		wg.Add(1)
+		go func(h *Handle) {
+			defer wg.Done()
+			h.Stop()
+		}(h)
+	}
+	wg.Wait()
+	s.alerts.closeAll()
+}
@@ -0,0 +1,339 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/stats"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+// testTorrentData returns an encoded single-file torrent without trackers
+func testTorrentData(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("a", 20),
+			"length":       int64(1000),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	return data
+}
+
+func testConfig(t *testing.T) Config {
+	config := DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	return config
+}
+
+func newTestSession(t *testing.T, config Config) *Session {
+	t.Helper()
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNewRejectsBadProxy(t *testing.T) {
+	config := testConfig(t)
+	config.TrackerProxy = "ftp://proxy.example:21"
+
+	if _, err := New(config); err == nil {
+		t.Error("New accepted an ftp proxy")
+	}
+}
+
+func TestAddTorrentURL(t *testing.T) {
+	data := testTorrentData(t, "remote.bin")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	s := newTestSession(t, testConfig(t))
+
+	h, err := s.AddTorrentURL(context.Background(), server.URL+"/remote.torrent")
+	if err != nil {
+		t.Fatalf("AddTorrentURL failed: %v", err)
+	}
+
+	if h.Name() != "remote.bin" {
+		t.Errorf("Name = %q, want %q", h.Name(), "remote.bin")
+	}
+
+	got, err := s.Get(h.InfoHash())
+	if err != nil || got != h {
+		t.Errorf("Get(%x) = %v, %v, want added handle", h.InfoHash(), got, err)
+	}
+
+	if _, err := s.AddTorrentURL(context.Background(), server.URL); !errors.Is(err, ErrDuplicateTorrent) {
+		t.Errorf("second AddTorrentURL error = %v, want %v", err, ErrDuplicateTorrent)
+	}
+}
+
+func TestAddTorrentURLRejects(t *testing.T) {
+	data := testTorrentData(t, "remote.bin")
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        []byte
+		limit       int64
+	}{
+		{"html page", http.StatusOK, "text/html; charset=utf-8", data, 0},
+		{"not found", http.StatusNotFound, "application/x-bittorrent", data, 0},
+		{"too large", http.StatusOK, "application/x-bittorrent", data, int64(len(data) - 1)},
+		{"not bencode", http.StatusOK, "application/octet-stream", []byte("<html>"), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			config := testConfig(t)
+			config.MaxTorrentFileSize = tt.limit
+			s := newTestSession(t, config)
+
+			if _, err := s.AddTorrentURL(context.Background(), server.URL); err == nil {
+				t.Error("AddTorrentURL succeeded, want error")
+			}
+			if n := len(s.Torrents()); n != 0 {
+				t.Errorf("Torrents() has %d entries, want 0", n)
+			}
+		})
+	}
+}
+
+func TestAddTorrentURLScheme(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+
+	if _, err := s.AddTorrentURL(context.Background(), "file:///etc/passwd"); err == nil {
+		t.Error("AddTorrentURL accepted a file URL")
+	}
+}
+
+func TestStartStopRemove(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+
+	data := testTorrentData(t, "local.bin")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	h, err := s.AddTorrentURL(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("AddTorrentURL failed: %v", err)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if !h.IsRunning() {
+		t.Error("IsRunning = false after Start")
+	}
+
+	if err := s.Remove(h.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if h.IsRunning() {
+		t.Error("IsRunning = true after Remove")
+	}
+	if _, err := s.Get(h.InfoHash()); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("Get after Remove error = %v, want %v", err, ErrTorrentNotFound)
+	}
+}
+
+func TestBanSurvivesPause(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+
+	tor, err := torrent.Parse(bytes.NewReader(testTorrentData(t, "banned.bin")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	h.mu.RLock()
+	h.peers.BanPeer("10.0.0.1:6881")
+	h.mu.RUnlock()
+
+	if err := h.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if err := h.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.peers.IsBanned(net.ParseIP("10.0.0.1")) {
+		t.Error("ban forgotten after pause and resume")
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "stats.bin")
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	s.stats.Sample(time.Now())
+
+	if got := h.Stats().Size; got != 1000 {
+		t.Errorf("handle Size = %d, want 1000", got)
+	}
+	if got := s.Stats().Transfer; got.Size != 1000 || got.ETA != stats.UnknownETA {
+		t.Errorf("session transfer = %+v, want size 1000 with unknown ETA", got)
+	}
+	if got := len(h.SpeedHistory()); got != 1 {
+		t.Errorf("handle history has %d points, want 1", got)
+	}
+	if got := len(s.SpeedHistory()); got != 1 {
+		t.Errorf("session history has %d points, want 1", got)
+	}
+
+	if err := s.Remove(h.InfoHash()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if got := h.Stats(); got.Size != 0 {
+		t.Errorf("Stats after Remove = %+v, want zero", got)
+	}
+}
+
+func TestAnnounceCounters(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "announce.bin")
+
+	steps := []struct {
+		event    string
+		counters stats.Counters
+		want     stats.Counters
+	}{
+		// Totals carried over from earlier runs are not reported again
+		{"started", stats.Counters{Uploaded: 500, Downloaded: 800, Left: 200}, stats.Counters{Left: 200}},
+		{"", stats.Counters{Uploaded: 700, Downloaded: 1000, Left: 0}, stats.Counters{Uploaded: 200, Downloaded: 200}},
+		// A smaller total, such as after a peer manager was replaced, is
+		// never reported
+		{"", stats.Counters{Uploaded: 600, Downloaded: 1100}, stats.Counters{Uploaded: 200, Downloaded: 300}},
+		{"started", stats.Counters{Uploaded: 600, Downloaded: 1100, Left: 1000}, stats.Counters{Left: 1000}},
+	}
+	for i, step := range steps {
+		if got := h.announceCounters(step.counters, step.event); got != step.want {
+			t.Errorf("step %d: announceCounters = %+v, want %+v", i, got, step.want)
+		}
+	}
+}
+
+// newTestTracker serves an announce response with peers at the given
+// ports of 10.0.0.1
+func newTestTracker(t *testing.T, interval, complete, incomplete int, ports ...uint16) string {
+	t.Helper()
+
+	var peers []tracker.Peer
+	for _, port := range ports {
+		peers = append(peers, tracker.Peer{IP: net.IPv4(10, 0, 0, 1), Port: port})
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"interval":   int64(interval),
+		"complete":   int64(complete),
+		"incomplete": int64(incomplete),
+		"peers":      string(tracker.CompactPeersToBytes(peers)),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode response: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	first := newTestTracker(t, 1800, 5, 3, 1001, 1002)
+	second := newTestTracker(t, 900, 7, 1, 1002, 1003)
+
+	tests := []struct {
+		concurrency int
+		interval    time.Duration
+		seeders     int
+		leechers    int
+		queued      int
+	}{
+		{1, 1800 * time.Second, 5, 3, 2},
+		{DefaultAnnounceConcurrency, 1800 * time.Second, 7, 3, 3},
+	}
+	for _, tt := range tests {
+		config := testConfig(t)
+		config.AnnounceConcurrency = tt.concurrency
+		s := newTestSession(t, config)
+		h := addTestTorrent(t, s, "tiers.bin")
+		h.torrent.AnnounceList = [][]string{{first}, {failing.URL + "/announce", second}}
+		h.tiers = h.torrent.AnnounceTiers()
+		h.peers = peer.NewManager(h.torrent.InfoHash, s.PeerID(), 1)
+
+		if got := h.announce(context.Background(), ""); got != tt.interval {
+			t.Errorf("concurrency %d: announce = %v, want %v", tt.concurrency, got, tt.interval)
+		}
+		if seeders, leechers := h.TrackerCounts(); seeders != tt.seeders || leechers != tt.leechers {
+			t.Errorf("concurrency %d: TrackerCounts = %d, %d, want %d, %d", tt.concurrency, seeders, leechers, tt.seeders, tt.leechers)
+		}
+		if got := h.peers.GetStats().QueuedPeers; got != tt.queued {
+			t.Errorf("concurrency %d: queued %d peers, want %d", tt.concurrency, got, tt.queued)
+		}
+		if tt.concurrency > 1 && h.tiers[1][0] != second {
+			t.Errorf("tier = %v, want %s moved to the front", h.tiers[1], second)
+		}
+	}
+}
+
+func TestNewRejectsUnknownStrategy(t *testing.T) {
+	config := testConfig(t)
+	config.Strategy = "no-such-strategy"
+
+	if _, err := New(config); !errors.Is(err, piece.ErrUnknownStrategy) {
+		t.Errorf("New error = %v, want %v", err, piece.ErrUnknownStrategy)
+	}
+}
@@ -0,0 +1,185 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// State is the lifecycle state of a torrent handle
+type State int
+
+const (
+	// StateQueued means the torrent was added but has not been started
+	StateQueued State = iota
+
+	// StateChecking means storage is being prepared and existing data
+	// checked before peers are contacted
+	StateChecking
+
+	// StateDownloading means the torrent is running with pieces missing
+	StateDownloading
+
+	// StateSeeding means the torrent is running with every piece verified
+	StateSeeding
+
+	// StatePaused means peers and announces are suspended but the
+	// torrent keeps its progress and open files. A torrent paused by a
+	// disk error reports it through Handle.Err.
+	StatePaused
+
+	// StateStopped means the torrent was stopped and its files closed
+	StateStopped
+
+	// StateError means the torrent could not be started; see Handle.Err
+	StateError
+)
+
+var stateNames = map[State]string{
+	StateQueued:      "queued",
+	StateChecking:    "checking",
+	StateDownloading: "downloading",
+	StateSeeding:     "seeding",
+	StatePaused:      "paused",
+	StateStopped:     "stopped",
+	StateError:       "error",
+}
+
+// String returns the name of the state
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Active returns true for states in which the torrent talks to peers
+func (s State) Active() bool {
+	return s == StateDownloading || s == StateSeeding
+}
+
+// StateHandler is notified when a torrent changes state. It is called
+// after the handle's lock is released, but from the goroutine making the
+// change, so it must not block.
+type StateHandler interface {
+	HandleStateChange(h *Handle, from, to State)
+}
+
+// stateChange is a transition waiting to be reported
+type stateChange struct {
+	from, to State
+}
+
+// Subscribe adds a handler for torrent state changes
+func (s *Session) Subscribe(handler StateHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// stateChanged tells every subscriber about a handle's transition
+func (s *Session) stateChanged(h *Handle, change stateChange) {
+	s.mu.RLock()
+	handlers := s.handlers
+	s.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler.HandleStateChange(h, change.from, change.to)
+	}
+}
+
+// setState moves the handle to a new state (must hold h.mu). Subscribers
+// are told once the lock is released with unlock.
+func (h *Handle) setState(state State, err error) {
+	h.err = err
+	if state == h.state {
+		return
+	}
+	h.changes = append(h.changes, stateChange{from: h.state, to: state})
+	h.state = state
+	if state == StateSeeding {
+		h.seedingSince = time.Now()
+	}
+}
+
+// unlock releases h.mu and reports the state changes made while it was
+// held
+func (h *Handle) unlock() {
+	changes := h.changes
+	h.changes = nil
+	h.mu.Unlock()
+
+	if len(changes) > 0 {
+		h.wake()
+	}
+	for _, change := range changes {
+		h.session.stateChanged(h, change)
+	}
+}
+
+// State returns the torrent's current state
+func (h *Handle) State() State {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.state
+}
+
+// Err returns the error that put the torrent in StateError, or paused it,
+// if any
+func (h *Handle) Err() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.err
+}
+
+// pieceEvents reports piece outcomes and missed deadlines as alerts, moves a downloading handle
+// to seeding once every piece is verified and pauses it on disk errors
+type pieceEvents struct {
+	h *Handle
+}
+
+func (e pieceEvents) HandlePieceVerified(index int) {
+	e.h.alert(Alert{Type: AlertPieceVerified, Piece: index})
+	e.h.wake()
+	e.h.checkpoint()
+}
+
+func (e pieceEvents) HandlePieceFailed(index int, err error) {
+	var diskErr *piece.DiskError
+	if errors.As(err, &diskErr) {
+		// Reported by HandleDiskError
+		return
+	}
+	e.h.alert(Alert{Type: pieceAlertType(err), Piece: index, Err: err})
+}
+
+func (e pieceEvents) HandleDiskError(err *piece.DiskError) {
+	e.h.alert(Alert{Type: AlertDiskError, Piece: err.Piece, Err: err})
+	e.h.diskFailed(err)
+}
+
+func (e pieceEvents) HandleDeadlineMissed(index int) {
+	e.h.alert(Alert{Type: AlertDeadlineMissed, Piece: index})
+}
+
+func (e pieceEvents) HandleTorrentComplete() {
+	e.h.alert(Alert{Type: AlertTorrentFinished})
+
+	e.h.mu.RLock()
+	diskManager := e.h.disk
+	e.h.mu.RUnlock()
+	if diskManager != nil {
+		e.h.sealFiles(diskManager)
+	}
+
+	if e.h.resumePath() != "" {
+		e.h.saveInBackground()
+	}
+
+	e.h.mu.Lock()
+	if e.h.state == StateDownloading {
+		e.h.setState(StateSeeding, nil)
+	}
+	e.h.unlock()
+}
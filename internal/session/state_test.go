@@ -0,0 +1,180 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// recordingStates records the state changes reported by a session
+type recordingStates struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (r *recordingStates) HandleStateChange(h *Handle, from, to State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes = append(r.changes, from.String()+"->"+to.String())
+}
+
+func (r *recordingStates) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := r.changes
+	r.changes = nil
+	return changes
+}
+
+func addTestTorrent(t *testing.T, s *Session, name string) *Handle {
+	t.Helper()
+
+	tor, err := torrent.Parse(bytes.NewReader(testTorrentData(t, name)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	return h
+}
+
+func TestPauseResume(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	states := &recordingStates{}
+	s.Subscribe(states)
+	h := addTestTorrent(t, s, "state.bin")
+
+	if h.State() != StateQueued {
+		t.Errorf("State = %v before Start, want queued", h.State())
+	}
+	if err := h.Pause(); !errors.Is(err, ErrTorrentNotRunning) {
+		t.Errorf("Pause before Start error = %v, want %v", err, ErrTorrentNotRunning)
+	}
+
+	steps := []struct {
+		name  string
+		do    func() error
+		state State
+		want  []string
+	}{
+		{"start", h.Start, StateDownloading, []string{"queued->checking", "checking->downloading"}},
+		{"pause", h.Pause, StatePaused, []string{"downloading->paused"}},
+		{"pause again", h.Pause, StatePaused, nil},
+		{"resume", h.Resume, StateDownloading, []string{"paused->downloading"}},
+		{"resume again", h.Resume, StateDownloading, nil},
+		{"pause before stop", h.Pause, StatePaused, []string{"downloading->paused"}},
+		{"start while paused", h.Start, StateDownloading, []string{"paused->downloading"}},
+		{"stop", func() error { h.Stop(); return nil }, StateStopped, []string{"downloading->stopped"}},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s failed: %v", step.name, err)
+		}
+		if got := h.State(); got != step.state {
+			t.Errorf("%s: State = %v, want %v", step.name, got, step.state)
+		}
+		if got := states.take(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: changes = %v, want %v", step.name, got, step.want)
+		}
+		if h.IsRunning() != step.state.Active() {
+			t.Errorf("%s: IsRunning = %v", step.name, h.IsRunning())
+		}
+	}
+}
+
+func TestPausedTorrentHasNoPeers(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "state.bin")
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer h.Stop()
+
+	if err := h.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if peers := h.Peers(); peers != nil {
+		t.Errorf("Peers = %v while paused, want none", peers)
+	}
+	if err := h.acceptPeer(nil, nil); !errors.Is(err, ErrTorrentNotRunning) {
+		t.Errorf("acceptPeer error = %v, want %v", err, ErrTorrentNotRunning)
+	}
+}
+
+// unpluggedDisk accepts every piece but cannot store or read any
+type unpluggedDisk struct{}
+
+var errUnplugged = errors.New("input/output error")
+
+func (unpluggedDisk) WritePiece(int, []byte) error              { return errUnplugged }
+func (unpluggedDisk) ReadPiece(int) ([]byte, error)             { return nil, errUnplugged }
+func (unpluggedDisk) ReadBlock(int, int, int) ([]byte, error)   { return nil, errUnplugged }
+func (unpluggedDisk) VerifyPiece(pieceIndex int, b []byte) bool { return true }
+
+func TestDiskErrorPauses(t *testing.T) {
+	s := newTestSession(t, testConfig(t))
+	h := addTestTorrent(t, s, "state.bin")
+	alerts := s.SubscribeAlerts(0, AlertDiskError)
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	h.pieces.SetDiskManager(unpluggedDisk{})
+	if err := h.pieces.AddBlockData(0, 0, make([]byte, 1000)); err != nil {
+		t.Fatalf("AddBlockData failed: %v", err)
+	}
+
+	waitForState(t, h, StatePaused)
+	var diskErr *piece.DiskError
+	if !errors.As(h.Err(), &diskErr) || !errors.Is(h.Err(), errUnplugged) {
+		t.Errorf("Err = %v, want the disk error", h.Err())
+	}
+	if got := h.Status().Error; got == "" {
+		t.Error("Status has no error while paused by a disk error")
+	}
+	select {
+	case alert := <-alerts.C:
+		if alert.Piece != 0 || !errors.Is(alert.Err, errUnplugged) {
+			t.Errorf("alert = %+v, want a disk error for piece 0", alert)
+		}
+	case <-time.After(time.Second):
+		t.Error("no disk error alert")
+	}
+
+	// Resuming tries again
+	if err := h.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if h.State() != StateDownloading || h.Err() != nil {
+		t.Errorf("after Resume: State = %v, Err = %v, want downloading without error", h.State(), h.Err())
+	}
+}
+
+func TestStartError(t *testing.T) {
+	config := testConfig(t)
+	config.DownloadDir = filepath.Join(config.DownloadDir, "file")
+	if err := os.WriteFile(config.DownloadDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(t, config)
+	h := addTestTorrent(t, s, "state.bin")
+
+	if err := h.Start(); err == nil {
+		t.Fatal("Start succeeded with a file as the download directory")
+	}
+	if h.State() != StateError || h.Err() == nil {
+		t.Errorf("State = %v, Err = %v, want error state", h.State(), h.Err())
+	}
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/stats"
+)
+
+// Status summarises a torrent for display and remote control
+type Status struct {
+	InfoHash      string  `json:"infoHash"`
+	Name          string  `json:"name"`
+	Label         string  `json:"label,omitempty"`
+	SaveDir       string  `json:"saveDir"`
+	SeedOnly      bool    `json:"seedOnly,omitempty"`
+	State         string  `json:"state"`
+	Error         string  `json:"error,omitempty"`
+	Progress      float64 `json:"progress"` // percent of pieces verified
+	Size          int64   `json:"size"`
+	Verified      int64   `json:"verified"`
+	Downloaded    int64   `json:"downloaded"`
+	Uploaded      int64   `json:"uploaded"`
+	DownloadRate  float64 `json:"downloadRate"` // bytes per second
+	UploadRate    float64 `json:"uploadRate"`   // bytes per second
+	ETA           int64   `json:"eta"`          // seconds, 0 once done, -1 if stalled or not running
+	Peers         int     `json:"peers"`
+	Seeders       int     `json:"seeders"`  // as trackers last reported
+	Leechers      int     `json:"leechers"` // as trackers last reported
+	QueuePosition int     `json:"queuePosition"`
+}
+
+// Status returns the torrent's state, progress and transfer figures as of
+// the session's last statistics sample
+func (h *Handle) Status() Status {
+	snapshot := h.Stats()
+
+	status := Status{
+		InfoHash:      hex.EncodeToString(h.torrent.InfoHash[:]),
+		Name:          h.Name(),
+		Label:         h.Label(),
+		SaveDir:       h.SaveDir(),
+		SeedOnly:      h.seedOnly,
+		State:         h.State().String(),
+		Progress:      h.Progress(),
+		Size:          h.torrent.TotalLength(),
+		Verified:      snapshot.Verified,
+		Downloaded:    snapshot.Downloaded,
+		Uploaded:      snapshot.Uploaded,
+		DownloadRate:  snapshot.DownloadRate,
+		UploadRate:    snapshot.UploadRate,
+		ETA:           -1,
+		Peers:         snapshot.Peers,
+		QueuePosition: h.QueuePosition(),
+	}
+	status.Seeders, status.Leechers = h.TrackerCounts()
+	if err := h.Err(); err != nil {
+		status.Error = err.Error()
+	}
+	switch {
+	case snapshot.ETA == 0:
+		status.ETA = 0
+	case snapshot.ETA == stats.UnknownETA || !h.State().Active():
+		// A torrent that is not running downloads nothing, whatever its
+		// rate was
+	default:
+		// Rounded up, so 0 only ever means done
+		status.ETA = int64((snapshot.ETA + time.Second - 1) / time.Second)
+	}
+	return status
+}
@@ -0,0 +1,291 @@
+// Package socks5 implements the client side of the SOCKS5 CONNECT command
+// (RFC 1928) with optional username/password authentication (RFC 1929).
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	version5 = 0x05
+
+	authNone         = 0x00
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+
+	passwordVersion = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// DefaultTimeout bounds connecting to the proxy and the SOCKS negotiation
+const DefaultTimeout = 30 * time.Second
+
+var (
+	ErrAuthRejected     = errors.New("socks5: authentication rejected")
+	ErrNoAcceptableAuth = errors.New("socks5: no acceptable authentication method")
+)
+
+// replyMessages describes the reply codes from RFC 1928 section 6
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Dialer opens TCP connections through a SOCKS5 proxy
+type Dialer struct {
+	ProxyAddr string // host:port of the proxy
+	Username  string // empty disables authentication
+	Password  string
+	Timeout   time.Duration
+	LocalAddr net.Addr // local address the proxy is dialed from, nil for any
+}
+
+// NewDialer creates a dialer for the proxy at proxyAddr
+func NewDialer(proxyAddr, username, password string) *Dialer {
+	return &Dialer{
+		ProxyAddr: proxyAddr,
+		Username:  username,
+		Password:  password,
+		Timeout:   DefaultTimeout,
+	}
+}
+
+// ParseURL creates a dialer from a socks5://[user:pass@]host:port URL
+func ParseURL(rawURL string) (*Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no port", rawURL)
+	}
+
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	return NewDialer(u.Host, username, password), nil
+}
+
+// Dial connects to addr through the proxy
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy. Only TCP is supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	nd := net.Dialer{LocalAddr: d.LocalAddr}
+	conn, err := nd.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: failed to connect to proxy: %w", err)
+	}
+
+	// Abort the negotiation when the context ends
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err = d.connect(conn, addr)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect performs the method negotiation and the CONNECT request
+func (d *Dialer) connect(conn net.Conn, addr string) error {
+	if err := d.authenticate(conn); err != nil {
+		return err
+	}
+
+	req, err := connectRequest(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5: failed to send request: %w", err)
+	}
+
+	return readReply(conn)
+}
+
+// authenticate negotiates an authentication method with the proxy
+func (d *Dialer) authenticate(conn net.Conn) error {
+	methods := []byte{authNone}
+	if d.Username != "" {
+		methods = []byte{authPassword}
+	}
+
+	greeting := append([]byte{version5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("socks5: failed to send greeting: %w", err)
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("socks5: failed to read method: %w", err)
+	}
+	if resp[0] != version5 {
+		return fmt.Errorf("socks5: unexpected version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case authNone:
+		if d.Username != "" {
+			return ErrNoAcceptableAuth
+		}
+		return nil
+	case authPassword:
+		if d.Username == "" {
+			return ErrNoAcceptableAuth
+		}
+		return d.sendPassword(conn)
+	case authNoAcceptable:
+		return ErrNoAcceptableAuth
+	default:
+		return fmt.Errorf("socks5: unexpected method %d", resp[1])
+	}
+}
+
+// sendPassword performs username/password authentication (RFC 1929)
+func (d *Dialer) sendPassword(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+
+	req := []byte{passwordVersion, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5: failed to send credentials: %w", err)
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("socks5: failed to read authentication status: %w", err)
+	}
+	if resp[1] != 0x00 {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+// connectRequest builds a CONNECT request for host:port
+func connectRequest(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid address %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	req := []byte{version5, cmdConnect, 0x00}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, atypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, atypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		// Let the proxy resolve names so lookups do not leak
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name too long: %q", host)
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(req, uint16(port)), nil
+}
+
+// readReply reads the proxy's reply to a request, including the bound
+// address that follows it
+func readReply(conn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("socks5: failed to read reply: %w", err)
+	}
+	if header[0] != version5 {
+		return fmt.Errorf("socks5: unexpected version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		if msg, ok := replyMessages[header[1]]; ok {
+			return fmt.Errorf("socks5: %s", msg)
+		}
+		return fmt.Errorf("socks5: request failed with code %d", header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case atypIPv4:
+		addrLen = net.IPv4len
+	case atypIPv6:
+		addrLen = net.IPv6len
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return fmt.Errorf("socks5: failed to read reply: %w", err)
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("socks5: unexpected address type %d", header[3])
+	}
+
+	// Bound address and port are not needed for CONNECT
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return fmt.Errorf("socks5: failed to read reply: %w", err)
+	}
+	return nil
+}
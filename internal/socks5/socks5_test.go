@@ -0,0 +1,192 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// testProxy is a minimal SOCKS5 server that supports CONNECT
+type testProxy struct {
+	listener net.Listener
+	username string
+	password string
+	reply    byte
+	targets  chan string
+}
+
+func newTestProxy(t *testing.T, username, password string) *testProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	p := &testProxy{
+		listener: l,
+		username: username,
+		password: password,
+		targets:  make(chan string, 1),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if p.username == "" {
+		conn.Write([]byte{version5, authNone})
+	} else {
+		conn.Write([]byte{version5, authPassword})
+
+		var header [2]byte
+		io.ReadFull(conn, header[:])
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		pass := make([]byte, n[0])
+		io.ReadFull(conn, pass)
+
+		if string(user) != p.username || string(pass) != p.password {
+			conn.Write([]byte{passwordVersion, 0x01})
+			return
+		}
+		conn.Write([]byte{passwordVersion, 0x00})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case atypIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case atypIPv6:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case atypDomain:
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	p.targets <- net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	conn.Write([]byte{version5, p.reply, 0x00, atypIPv4, 127, 0, 0, 1, 0, 0})
+	if p.reply != 0x00 {
+		return
+	}
+
+	// Echo in place of a real upstream connection
+	io.Copy(conn, conn)
+}
+
+func TestDialConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		addr     string
+		want     string
+	}{
+		{"ipv4 no auth", "", "", "10.1.2.3:6881", "10.1.2.3:6881"},
+		{"ipv6 no auth", "", "", "[2001:db8::1]:51413", "[2001:db8::1]:51413"},
+		{"domain with auth", "user", "secret", "peer.example:6881", "peer.example:6881"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newTestProxy(t, tt.username, tt.password)
+
+			d := NewDialer(proxy.listener.Addr().String(), tt.username, tt.password)
+			conn, err := d.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+
+			if got := <-proxy.targets; got != tt.want {
+				t.Errorf("proxy target = %q, want %q", got, tt.want)
+			}
+
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("echo = %q, %v, want %q", buf, err, "ping")
+			}
+		})
+	}
+}
+
+func TestDialAuthRejected(t *testing.T) {
+	proxy := newTestProxy(t, "user", "secret")
+
+	d := NewDialer(proxy.listener.Addr().String(), "user", "wrong")
+	if _, err := d.Dial("tcp", "10.1.2.3:6881"); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("Dial error = %v, want %v", err, ErrAuthRejected)
+	}
+
+	// The proxy requires credentials the dialer does not have
+	d = NewDialer(proxy.listener.Addr().String(), "", "")
+	if _, err := d.Dial("tcp", "10.1.2.3:6881"); err == nil {
+		t.Error("Dial without credentials succeeded")
+	}
+}
+
+func TestDialReplyError(t *testing.T) {
+	proxy := newTestProxy(t, "", "")
+	proxy.reply = 0x05
+
+	d := NewDialer(proxy.listener.Addr().String(), "", "")
+	_, err := d.Dial("tcp", "10.1.2.3:6881")
+	if err == nil || err.Error() != "socks5: connection refused" {
+		t.Errorf("Dial error = %v, want connection refused", err)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	d, err := ParseURL("socks5://alice:pw@127.0.0.1:1080")
+	if err != nil {
+		t.Fatalf("ParseURL failed: %v", err)
+	}
+	if d.ProxyAddr != "127.0.0.1:1080" || d.Username != "alice" || d.Password != "pw" {
+		t.Errorf("ParseURL = %+v, want alice:pw@127.0.0.1:1080", d)
+	}
+
+	for _, bad := range []string{"http://127.0.0.1:8080", "socks5://127.0.0.1"} {
+		if _, err := ParseURL(bad); err == nil {
+			t.Errorf("ParseURL(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package stats
+
+import "time"
+
+// HistoryLength is the number of samples kept in a history, ten minutes
+// at the default interval
+const HistoryLength = 600
+
+// Point is the rates at one sample
+type Point struct {
+	Time         time.Time `json:"time"`
+	DownloadRate float64   `json:"downloadRate"` // smoothed bytes per second
+	UploadRate   float64   `json:"uploadRate"`   // smoothed bytes per second
+}
+
+// History is a ring buffer of the most recent points
+type History struct {
+	points []Point
+	next   int // where the next point goes
+	full   bool
+}
+
+// NewHistory creates a history holding up to length points
+func NewHistory(length int) *History {
+	if length <= 0 {
+		length = HistoryLength
+	}
+	return &History{points: make([]Point, length)}
+}
+
+// Add records a point, replacing the oldest once the history is full
+func (h *History) Add(p Point) {
+	h.points[h.next] = p
+	h.next++
+	if h.next == len(h.points) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Points returns a copy of the points, oldest first
+func (h *History) Points() []Point {
+	if !h.full {
+		return append(make([]Point, 0, h.next), h.points[:h.next]...)
+	}
+	points := make([]Point, 0, len(h.points))
+	points = append(points, h.points[h.next:]...)
+	return append(points, h.points[:h.next]...)
+}
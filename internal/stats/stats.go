@@ -0,0 +1,300 @@
+// Package stats samples transfer counters at a fixed interval and derives
+// smoothed rates and ETAs for each torrent and for the session as a whole.
+package stats
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultInterval is how often sources are sampled
+	DefaultInterval = time.Second
+
+	// RateTimeConstant is the time constant of the smoothed rates
+	RateTimeConstant = 5 * time.Second
+
+	// ETATimeConstant is the time constant of the download rate ETAs are
+	// estimated from. It is longer than RateTimeConstant so ETAs do not
+	// jump with every burst.
+	ETATimeConstant = 30 * time.Second
+
+	// UnknownETA is reported while a download is stalled
+	UnknownETA time.Duration = -1
+)
+
+// Counters are the cumulative totals of one torrent
+type Counters struct {
+	Downloaded     int64 // payload bytes received
+	Uploaded       int64 // payload bytes sent
+	Verified       int64 // bytes of pieces that passed the hash check
+	Size           int64 // bytes in the torrent
+	Left           int64 // bytes of wanted pieces not yet verified
+	Wasted         int64 // bytes received and thrown away
+	HashFailures   int
+	Peers          int // connected peers
+	ActiveRequests int // blocks requested and not yet received
+}
+
+// add sums two sets of counters
+func (c Counters) add(o Counters) Counters {
+	return Counters{
+		Downloaded:     c.Downloaded + o.Downloaded,
+		Uploaded:       c.Uploaded + o.Uploaded,
+		Verified:       c.Verified + o.Verified,
+		Size:           c.Size + o.Size,
+		Left:           c.Left + o.Left,
+		Wasted:         c.Wasted + o.Wasted,
+		HashFailures:   c.HashFailures + o.HashFailures,
+		Peers:          c.Peers + o.Peers,
+		ActiveRequests: c.ActiveRequests + o.ActiveRequests,
+	}
+}
+
+// Source provides the counters of one torrent. It is called from the
+// collector's goroutine, so it must not block.
+type Source interface {
+	Counters() Counters
+}
+
+// Snapshot is the state of a torrent, or of the whole session, at the
+// last sample
+type Snapshot struct {
+	Counters
+	DownloadRate float64       // smoothed bytes per second
+	UploadRate   float64       // smoothed bytes per second
+	ETA          time.Duration // until every wanted byte is verified, 0 once they are, or UnknownETA
+	Time         time.Time     // when the sample was taken
+}
+
+// Rate is the smoothed rate of change of a cumulative counter, updated
+// from periodic samples. The zero Rate is smoothed with RateTimeConstant.
+type Rate struct {
+	value        float64
+	last         int64
+	at           time.Time
+	timeConstant time.Duration
+}
+
+// NewRate creates a rate smoothed with timeConstant
+func NewRate(timeConstant time.Duration) Rate {
+	return Rate{timeConstant: timeConstant}
+}
+
+// Sample records the counter's total at now
+func (r *Rate) Sample(total int64, now time.Time) {
+	if r.at.IsZero() {
+		r.last, r.at = total, now
+		return
+	}
+
+	elapsed := now.Sub(r.at).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	// Counters only go backwards when reset, which is no transfer
+	delta := total - r.last
+	if delta < 0 {
+		delta = 0
+	}
+
+	timeConstant := r.timeConstant
+	if timeConstant <= 0 {
+		timeConstant = RateTimeConstant
+	}
+	alpha := 1 - math.Exp(-elapsed/timeConstant.Seconds())
+	r.value += alpha * (float64(delta)/elapsed - r.value)
+	r.last, r.at = total, now
+}
+
+// Value returns the smoothed rate in units per second
+func (r *Rate) Value() float64 {
+	return r.value
+}
+
+// ETA returns how long remaining bytes take at rate bytes per second
+func ETA(remaining int64, rate float64) time.Duration {
+	if remaining <= 0 {
+		return 0
+	}
+	if rate < 1 {
+		return UnknownETA
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// tracked is a source and the rates derived from it
+type tracked struct {
+	source   Source
+	download Rate
+	upload   Rate
+	eta      Rate // download rate for the ETA
+	snapshot Snapshot
+	history  *History
+}
+
+// Collector samples its sources at a fixed interval
+type Collector struct {
+	mu       sync.RWMutex
+	interval time.Duration
+	sources  map[string]*tracked
+	total    Snapshot
+	history  *History // of the totals
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewCollector creates a collector sampling every interval
+func NewCollector(interval time.Duration) *Collector {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Collector{
+		interval: interval,
+		sources:  make(map[string]*tracked),
+		history:  NewHistory(HistoryLength),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins sampling
+func (c *Collector) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Stop stops sampling
+func (c *Collector) Stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// run samples every interval until stopped
+func (c *Collector) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.Sample(now)
+		}
+	}
+}
+
+// Add starts sampling a source under key
+func (c *Collector) Add(key string, source Source) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Not sampled yet, so nothing is known about the ETA
+	c.sources[key] = &tracked{
+		source:   source,
+		eta:      NewRate(ETATimeConstant),
+		snapshot: Snapshot{ETA: UnknownETA},
+		history:  NewHistory(HistoryLength),
+	}
+}
+
+// Remove stops sampling the source under key
+func (c *Collector) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sources, key)
+}
+
+// Get returns the last snapshot of the source under key
+func (c *Collector) Get(key string) (Snapshot, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	t, ok := c.sources[key]
+	if !ok {
+		return Snapshot{ETA: UnknownETA}, false
+	}
+	return t.snapshot, true
+}
+
+// History returns the rates of the source under key at each recent
+// sample, oldest first
+func (c *Collector) History(key string) ([]Point, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	t, ok := c.sources[key]
+	if !ok {
+		return nil, false
+	}
+	return t.history.Points(), true
+}
+
+// Total returns the sum over every source at the last sample
+func (c *Collector) Total() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.total
+}
+
+// TotalHistory returns the total rates at each recent sample, oldest
+// first
+func (c *Collector) TotalHistory() []Point {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.history.Points()
+}
+
+// Sample reads every source and updates the rates and snapshots. The
+// collector calls it every interval once started.
+func (c *Collector) Sample(now time.Time) {
+	c.mu.RLock()
+	sources := make([]*tracked, 0, len(c.sources))
+	for _, t := range c.sources {
+		sources = append(sources, t)
+	}
+	c.mu.RUnlock()
+
+	// Read the sources without holding the lock
+	counters := make([]Counters, len(sources))
+	for i, t := range sources {
+		counters[i] = t.source.Counters()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := Snapshot{Time: now}
+	var etaRate float64
+	for i, t := range sources {
+		t.download.Sample(counters[i].Downloaded, now)
+		t.upload.Sample(counters[i].Uploaded, now)
+		t.eta.Sample(counters[i].Downloaded, now)
+		t.snapshot = Snapshot{
+			Counters:     counters[i],
+			DownloadRate: t.download.Value(),
+			UploadRate:   t.upload.Value(),
+			ETA:          ETA(counters[i].Left, t.eta.Value()),
+			Time:         now,
+		}
+		t.history.Add(t.snapshot.point())
+
+		total.Counters = total.Counters.add(counters[i])
+		total.DownloadRate += t.snapshot.DownloadRate
+		total.UploadRate += t.snapshot.UploadRate
+		etaRate += t.eta.Value()
+	}
+	total.ETA = ETA(total.Left, etaRate)
+	c.total = total
+	c.history.Add(total.point())
+}
+
+// point returns the snapshot's rates
+func (s Snapshot) point() Point {
+	return Point{Time: s.Time, DownloadRate: s.DownloadRate, UploadRate: s.UploadRate}
+}
@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	var r Rate
+	start := time.Unix(1000, 0)
+
+	// A steady 1000 B/s converges on 1000
+	for i := 0; i <= 60; i++ {
+		r.Sample(int64(i*1000), start.Add(time.Duration(i)*time.Second))
+	}
+	if got := r.Value(); math.Abs(got-1000) > 1 {
+		t.Errorf("Value = %v, want 1000", got)
+	}
+
+	// A counter reset counts as no transfer, so the rate decays
+	r.Sample(0, start.Add(61*time.Second))
+	if got := r.Value(); got >= 1000 || got < 0 {
+		t.Errorf("Value after reset = %v, want between 0 and 1000", got)
+	}
+
+	// A longer time constant follows a change more slowly
+	fast, slow := Rate{}, NewRate(ETATimeConstant)
+	for i := 0; i <= 10; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		fast.Sample(int64(i*1000), now)
+		slow.Sample(int64(i*1000), now)
+	}
+	if slow.Value() >= fast.Value() {
+		t.Errorf("rate with %v = %v, want below %v", ETATimeConstant, slow.Value(), fast.Value())
+	}
+
+	// The first sample only sets the baseline
+	var fresh Rate
+	fresh.Sample(5000, start)
+	if got := fresh.Value(); got != 0 {
+		t.Errorf("Value after one sample = %v, want 0", got)
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		remaining int64
+		rate      float64
+		want      time.Duration
+	}{
+		{0, 0, 0},
+		{-5, 100, 0},
+		{1000, 0, UnknownETA},
+		{1000, 0.5, UnknownETA},
+		{1000, 100, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := ETA(tt.remaining, tt.rate); got != tt.want {
+			t.Errorf("ETA(%d, %v) = %v, want %v", tt.remaining, tt.rate, got, tt.want)
+		}
+	}
+}
+
+// fakeSource returns whatever counters it holds
+type fakeSource struct {
+	counters Counters
+}
+
+func (f *fakeSource) Counters() Counters { return f.counters }
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(time.Second)
+	a := &fakeSource{Counters{Size: 20000, Left: 10000, Peers: 2}}
+	b := &fakeSource{Counters{Size: 5000, Verified: 5000, Peers: 1}}
+	c.Add("a", a)
+	c.Add("b", b)
+
+	start := time.Unix(1000, 0)
+	// Long enough for the ETA's rate to settle
+	for i := 0; i <= 300; i++ {
+		a.counters.Downloaded = int64(i * 100)
+		b.counters.Uploaded = int64(i * 50)
+		c.Sample(start.Add(time.Duration(i) * time.Second))
+	}
+
+	snapshot, ok := c.Get("a")
+	if !ok {
+		t.Fatal("Get(a) found nothing")
+	}
+	if math.Abs(snapshot.DownloadRate-100) > 1 {
+		t.Errorf("a: DownloadRate = %v, want 100", snapshot.DownloadRate)
+	}
+	if snapshot.ETA < 99*time.Second || snapshot.ETA > 101*time.Second {
+		t.Errorf("a: ETA = %v, want about 100s", snapshot.ETA)
+	}
+	if snapshot, _ := c.Get("b"); snapshot.ETA != 0 {
+		t.Errorf("b: ETA = %v, want 0 with nothing left", snapshot.ETA)
+	}
+
+	total := c.Total()
+	if total.Size != 25000 || total.Peers != 3 || total.Downloaded != 30000 {
+		t.Errorf("total counters = %+v", total.Counters)
+	}
+	if math.Abs(total.UploadRate-50) > 1 {
+		t.Errorf("total UploadRate = %v, want 50", total.UploadRate)
+	}
+
+	history, _ := c.History("b")
+	if len(history) != 301 || !history[300].Time.Equal(start.Add(300*time.Second)) {
+		t.Fatalf("b: history has %d points, want 301 ending at the last sample", len(history))
+	}
+	if last, _ := c.Get("b"); history[300].UploadRate != last.UploadRate {
+		t.Errorf("b: last point = %+v, want the last snapshot's rates", history[300])
+	}
+	if got := len(c.TotalHistory()); got != 301 {
+		t.Errorf("total history has %d points, want 301", got)
+	}
+
+	c.Remove("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get(a) found a removed source")
+	}
+	if _, ok := c.History("a"); ok {
+		t.Error("History(a) found a removed source")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	if got := h.Points(); len(got) != 0 {
+		t.Errorf("Points() of an empty history = %v", got)
+	}
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		h.Add(Point{Time: start.Add(time.Duration(i) * time.Second), DownloadRate: float64(i)})
+	}
+
+	// The oldest two were replaced
+	got := h.Points()
+	if len(got) != 3 {
+		t.Fatalf("Points() has %d points, want 3", len(got))
+	}
+	for i, p := range got {
+		if want := float64(i + 2); p.DownloadRate != want {
+			t.Errorf("point %d has rate %v, want %v", i, p.DownloadRate, want)
+		}
+	}
+}
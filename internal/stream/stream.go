@@ -0,0 +1,132 @@
+// Package stream serves the files of running torrents over HTTP with range
+// requests, so a media player can play a file while it downloads. The
+// pieces a player asks for are fetched before any other.
+package stream
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+// Readahead is how much of a file past each read is fetched ahead of the
+// player
+const Readahead = 8 << 20
+
+// mediaTypes are the content types of media files that the system's MIME
+// table may not know
+var mediaTypes = map[string]string{
+	".aac":  "audio/aac",
+	".avi":  "video/x-msvideo",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".mpg":  "video/mpeg",
+	".ogg":  "audio/ogg",
+	".ogv":  "video/ogg",
+	".opus": "audio/opus",
+	".srt":  "application/x-subrip",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+}
+
+// ContentType returns the content type of a file by its extension, or
+// application/octet-stream if it is unknown
+func ContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Server serves a file of a torrent at /<info hash>/<path>, where path is
+// the file's path in the torrent's file system (see session.Handle.FS)
+type Server struct {
+	session *session.Session
+	mux     *http.ServeMux
+}
+
+// NewServer creates a server for s
+func NewServer(s *session.Session) *Server {
+	srv := &Server{session: s, mux: http.NewServeMux()}
+	srv.mux.HandleFunc("GET /{infoHash}/{path...}", srv.serveFile)
+	return srv
+}
+
+// ServeHTTP serves a file
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+func (srv *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	var infoHash [20]byte
+	b, err := hex.DecodeString(r.PathValue("infoHash"))
+	if err != nil || len(b) != len(infoHash) {
+		http.Error(w, "invalid info hash", http.StatusBadRequest)
+		return
+	}
+	copy(infoHash[:], b)
+
+	h, err := srv.session.Get(infoHash)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Reads would wait for pieces that never come
+	if !h.State().Active() {
+		writeError(w, session.ErrTorrentNotRunning)
+		return
+	}
+
+	name := r.PathValue("path")
+	f, err := h.FS().Open(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	file, ok := f.(*session.FileReader)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	file.SetReadahead(Readahead)
+
+	// Setting the type up front keeps ServeContent from sniffing it, which
+	// would wait for the start of the file
+	w.Header().Set("Content-Type", ContentType(name))
+	http.ServeContent(w, r, path.Base(name), time.Time{}, file)
+}
+
+// writeError responds with the status matching a session or file system
+// error
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, session.ErrTorrentNotFound), errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, fs.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, session.ErrTorrentNotRunning):
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,157 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// newTestServer returns a server for a session seeding a complete
+// single-file torrent named name
+func newTestServer(t *testing.T, name string, content []byte) (*httptest.Server, *session.Handle) {
+	t.Helper()
+
+	config := session.DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(config.DownloadDir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := session.New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	const pieceLength = 16384
+	var hashes []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+		hashes = append(hashes, sum[:]...)
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(pieceLength),
+			"pieces":       string(hashes),
+			"length":       int64(len(content)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	server := httptest.NewServer(NewServer(s))
+	t.Cleanup(server.Close)
+	return server, h
+}
+
+func TestServeFile(t *testing.T) {
+	content := make([]byte, 40000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	server, h := newTestServer(t, "movie.mp4", content)
+	url := server.URL + "/" + h.Torrent().InfoHashString() + "/movie.mp4"
+
+	// A stopped torrent cannot be streamed
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("GET before Start = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		rangeHeader  string
+		status       int
+		contentRange string
+		want         []byte
+	}{
+		{"whole file", "", http.StatusOK, "", content},
+		{"range across pieces", "bytes=16000-17999", http.StatusPartialContent, "bytes 16000-17999/40000", content[16000:18000]},
+		{"suffix range", "bytes=-100", http.StatusPartialContent, "bytes 39900-39999/40000", content[39900:]},
+		{"unsatisfiable", "bytes=50000-", http.StatusRequestedRangeNotSatisfiable, "bytes */40000", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.want != nil {
+				if got := resp.Header.Get("Content-Type"); got != "video/mp4" {
+					t.Errorf("Content-Type = %q, want video/mp4", got)
+				}
+				if !bytes.Equal(body, tt.want) {
+					t.Errorf("body has %d bytes, want %d matching", len(body), len(tt.want))
+				}
+			}
+		})
+	}
+
+	for _, path := range []string{"/" + h.Torrent().InfoHashString() + "/other.mp4", "/" + strings.Repeat("ab", 20) + "/movie.mp4"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a/movie.MKV", "video/x-matroska"},
+		{"song.flac", "audio/flac"},
+		{"subs.srt", "application/x-subrip"},
+		{"data.unknownext", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := ContentType(tt.name); got != tt.want {
+			t.Errorf("ContentType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package swarmtest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// Storage keeps a torrent's data in memory. It implements the disk
+// manager interfaces of the piece manager, streaming included, as
+// disk.Manager does.
+type Storage struct {
+	mu      sync.RWMutex
+	torrent *torrent.Torrent
+	data    []byte
+}
+
+// NewStorage creates empty storage for t
+func NewStorage(t *torrent.Torrent) *Storage {
+	return &Storage{torrent: t, data: make([]byte, t.TotalLength())}
+}
+
+// WritePiece stores a piece
+func (s *Storage) WritePiece(pieceIndex int, data []byte) error {
+	offset, length, err := s.piece(pieceIndex)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != length {
+		return fmt.Errorf("piece %d is %d bytes, got %d", pieceIndex, length, len(data))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.data[offset:], data)
+	return nil
+}
+
+// ReadPiece returns a copy of a piece
+func (s *Storage) ReadPiece(pieceIndex int) ([]byte, error) {
+	_, length, err := s.piece(pieceIndex)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadBlock(pieceIndex, 0, int(length))
+}
+
+// ReadBlock returns a copy of part of a piece
+func (s *Storage) ReadBlock(pieceIndex, begin, length int) ([]byte, error) {
+	offset, pieceLength, err := s.piece(pieceIndex)
+	if err != nil {
+		return nil, err
+	}
+	if begin < 0 || length < 0 || int64(begin+length) > pieceLength {
+		return nil, fmt.Errorf("block %d:%d+%d out of range", pieceIndex, begin, length)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := offset + int64(begin)
+	return append([]byte(nil), s.data[start:start+int64(length)]...), nil
+}
+
+// VerifyPiece checks data against the piece's hash
+func (s *Storage) VerifyPiece(pieceIndex int, data []byte) bool {
+	hash, err := s.torrent.PieceHash(pieceIndex)
+	return err == nil && sha1.Sum(data) == hash
+}
+
+// VerifyPieceFrom checks the data src writes against the piece's hash
+func (s *Storage) VerifyPieceFrom(pieceIndex int, src io.WriterTo) bool {
+	hash, err := s.torrent.PieceHash(pieceIndex)
+	if err != nil {
+		return false
+	}
+	h := sha1.New()
+	if _, err := src.WriteTo(h); err != nil {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), hash[:])
+}
+
+// WritePieceFrom stores the piece src writes
+func (s *Storage) WritePieceFrom(pieceIndex int, src io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := src.WriteTo(&buf); err != nil {
+		return err
+	}
+	return s.WritePiece(pieceIndex, buf.Bytes())
+}
+
+// Bytes returns a copy of the stored data
+func (s *Storage) Bytes() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]byte(nil), s.data...)
+}
+
+// piece returns the offset and length of a piece in the data
+func (s *Storage) piece(index int) (offset, length int64, err error) {
+	if index < 0 || index >= s.torrent.NumPieces() {
+		return 0, 0, fmt.Errorf("piece index %d out of range", index)
+	}
+	return int64(index) * s.torrent.Info.PieceLength, s.torrent.PieceSize(index), nil
+}
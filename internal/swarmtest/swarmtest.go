@@ -0,0 +1,309 @@
+// Package swarmtest runs a swarm of in-process peers for end-to-end
+// tests. Each node has its own piece manager, peer manager and download
+// coordinator, wired as a session wires them, with its data kept in
+// memory. Nodes talk over net.Pipe with the real handshake and messages,
+// so whole downloads run without sockets or temporary files.
+package swarmtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/download"
+	"github.com/mt/bittorrent-impl/internal/logging"
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+	"github.com/mt/bittorrent-impl/internal/tracker"
+)
+
+// ListenPort is the port every node appears to listen on
+const ListenPort = 6881
+
+// NewTorrent creates a single-file torrent holding content
+func NewTorrent(name string, content []byte, pieceLength int) (*torrent.Torrent, error) {
+	var hashes []byte
+	for begin := 0; begin < len(content); begin += pieceLength {
+		sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+		hashes = append(hashes, sum[:]...)
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         name,
+			"piece length": int64(pieceLength),
+			"pieces":       string(hashes),
+			"length":       int64(len(content)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return torrent.Parse(bytes.NewReader(data))
+}
+
+// Swarm is a set of nodes sharing one torrent
+type Swarm struct {
+	mu      sync.Mutex
+	torrent *torrent.Torrent
+	content []byte
+	nodes   map[string]*Node // by address
+	list    []*Node
+	ports   int // last local port handed to a dial
+	logger  *slog.Logger
+}
+
+// New creates an empty swarm for t, whose seeds hold content
+func New(t *torrent.Torrent, content []byte) *Swarm {
+	return &Swarm{
+		torrent: t,
+		content: content,
+		nodes:   make(map[string]*Node),
+		ports:   40000,
+		logger:  logging.Discard(),
+	}
+}
+
+// SetLogger sets the logger given to nodes added from now on
+func (s *Swarm) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+// AddSeed adds and starts a node holding the whole torrent
+func (s *Swarm) AddSeed() *Node {
+	return s.addNode(true)
+}
+
+// AddLeecher adds and starts a node holding none of the torrent
+func (s *Swarm) AddLeecher() *Node {
+	return s.addNode(false)
+}
+
+// Connect makes from connect to to, as if it had learned to's address
+// from a tracker
+func (s *Swarm) Connect(from, to *Node) {
+	from.Peers.AddPeers([]tracker.Peer{{IP: to.Addr.IP, Port: uint16(to.Addr.Port)}}, peer.SourceManual)
+}
+
+// ConnectAll connects every pair of nodes once
+func (s *Swarm) ConnectAll() {
+	nodes := s.Nodes()
+	for i, from := range nodes {
+		for _, to := range nodes[i+1:] {
+			s.Connect(from, to)
+		}
+	}
+}
+
+// Nodes returns the nodes in the order they were added
+func (s *Swarm) Nodes() []*Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Node(nil), s.list...)
+}
+
+// Wait waits until every node has the whole torrent
+func (s *Swarm) Wait(ctx context.Context) error {
+	for _, n := range s.Nodes() {
+		if err := n.Wait(ctx); err != nil {
+			return fmt.Errorf("node %s: %w", n.Addr, err)
+		}
+	}
+	return nil
+}
+
+// Close stops every node
+func (s *Swarm) Close() {
+	for _, n := range s.Nodes() {
+		n.Close()
+	}
+}
+
+func (s *Swarm) addNode(seed bool) *Node {
+	s.mu.Lock()
+	index := len(s.list)
+	n := &Node{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, byte(index>>8), byte(index+1)), Port: ListenPort},
+		Storage:  NewStorage(s.torrent),
+		swarm:    s,
+		complete: make(chan struct{}),
+	}
+	copy(n.peerID[:], fmt.Sprintf("-SW0001-%012d", index))
+	s.nodes[n.Addr.String()] = n
+	s.list = append(s.list, n)
+	logger := s.logger.With("node", n.Addr.String())
+	s.mu.Unlock()
+
+	n.start(seed, logger)
+	return n
+}
+
+// localAddr returns the address a node dials from
+func (s *Swarm) localAddr(n *Node) *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ports++
+	return &net.TCPAddr{IP: n.Addr.IP, Port: s.ports}
+}
+
+// node returns the node at address
+func (s *Swarm) node(address string) (*Node, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[address]
+	return n, ok
+}
+
+// Node is one peer of a swarm. Its managers may be inspected and
+// configured, as with SetSelectionStrategy, while it runs.
+type Node struct {
+	Addr        *net.TCPAddr
+	Storage     *Storage
+	Pieces      *piece.Manager
+	Peers       *peer.Manager
+	Coordinator *download.Coordinator
+
+	swarm    *Swarm
+	peerID   [20]byte
+	complete chan struct{}
+	once     sync.Once
+}
+
+// start creates the node's managers and starts them
+func (n *Node) start(seed bool, logger *slog.Logger) {
+	t := n.swarm.torrent
+
+	hashes := make([][20]byte, t.NumPieces())
+	for i := range hashes {
+		hashes[i], _ = t.PieceHash(i)
+	}
+	n.Pieces = piece.NewManager(t.NumPieces(), int(t.Info.PieceLength), int(t.PieceSize(t.NumPieces()-1)), hashes)
+	n.Pieces.SetDiskManager(n.Storage)
+	n.Pieces.SetLogger(logger)
+
+	n.Peers = peer.NewManager(t.InfoHash, n.peerID, t.NumPieces())
+	n.Peers.SetPieceManager(n.Pieces)
+	n.Peers.SetLogger(logger)
+	n.Peers.SetDialer(nodeDialer{n})
+	n.Pieces.SetBanHandler(n.Peers)
+
+	if seed {
+		for i := 0; i < t.NumPieces(); i++ {
+			offset := int64(i) * t.Info.PieceLength
+			n.Storage.WritePiece(i, n.swarm.content[offset:offset+t.PieceSize(i)])
+			n.Pieces.MarkPieceVerified(i)
+			n.Peers.HandlePieceVerified(i)
+		}
+		n.setComplete()
+	}
+
+	n.Coordinator = download.NewCoordinator(n.Peers, n.Pieces)
+	n.Coordinator.SetLogger(logger)
+	n.Peers.SetPieceHandler(n.Coordinator)
+	n.Peers.SetPeerEventHandler(unchoker{n.Peers, n.Coordinator})
+	n.Pieces.Subscribe(n.Peers)
+	n.Pieces.Subscribe(n.Coordinator)
+	n.Pieces.Subscribe(completion{n})
+
+	n.Peers.Start()
+	n.Coordinator.Start()
+}
+
+// Done returns a channel closed once the node has the whole torrent
+func (n *Node) Done() <-chan struct{} {
+	return n.complete
+}
+
+// Wait waits until the node has the whole torrent
+func (n *Node) Wait(ctx context.Context) error {
+	select {
+	case <-n.complete:
+		return nil
+	case <-ctx.Done():
+		done, total := n.Pieces.GetProgressCounts()
+		return fmt.Errorf("%w with %d of %d pieces", ctx.Err(), done, total)
+	}
+}
+
+// Close stops the node, closing its connections
+func (n *Node) Close() {
+	n.Coordinator.Stop()
+	n.Peers.Stop()
+	n.Pieces.Unsubscribe(n.Coordinator)
+	n.Pieces.Unsubscribe(n.Peers)
+	n.Pieces.Wait()
+}
+
+func (n *Node) setComplete() {
+	n.once.Do(func() { close(n.complete) })
+}
+
+// accept hands an incoming connection to the node, as a session's
+// listener does
+func (n *Node) accept(conn net.Conn) {
+	handshake, err := peer.ReadHandshakeTimeout(conn, peer.HandshakeTimeout)
+	if err != nil || handshake.InfoHash != n.swarm.torrent.InfoHash {
+		conn.Close()
+		return
+	}
+	if err := n.Peers.AddIncomingPeer(conn, handshake); err != nil {
+		conn.Close()
+	}
+}
+
+// nodeDialer connects a node to others in its swarm over pipes
+type nodeDialer struct {
+	n *Node
+}
+
+func (d nodeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target, ok := d.n.swarm.node(address)
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("no node at %s", address)}
+	}
+
+	local := d.n.swarm.localAddr(d.n)
+	client, server := net.Pipe()
+	go target.accept(pipeConn{server, target.Addr, local})
+	return pipeConn{client, local, target.Addr}, nil
+}
+
+// pipeConn is one end of a pipe with the addresses of a TCP connection,
+// so peers can be told apart
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// unchoker unchokes every peer as it connects, standing in for a choking
+// algorithm, and passes events on to the coordinator
+type unchoker struct {
+	peers *peer.Manager
+	next  peer.PeerEventHandler
+}
+
+func (u unchoker) HandlePeerEvent(event peer.PeerEvent) {
+	if event.Type == peer.PeerConnected {
+		u.peers.Unchoke(event.Peer)
+	}
+	u.next.HandlePeerEvent(event)
+}
+
+// completion closes a node's Done channel when its download completes
+type completion struct {
+	n *Node
+}
+
+func (c completion) HandlePieceVerified(index int)          {}
+func (c completion) HandlePieceFailed(index int, err error) {}
+func (c completion) HandleTorrentComplete()                 { c.n.setComplete() }
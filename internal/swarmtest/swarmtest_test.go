@@ -0,0 +1,79 @@
+package swarmtest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mt/bittorrent-impl/internal/piece"
+)
+
+// newSwarm returns a swarm for a torrent of size bytes in 16 KiB pieces
+func newSwarm(t *testing.T, size int) (*Swarm, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 31 / 7)
+	}
+	tor, err := NewTorrent("swarm.bin", content, 16384)
+	if err != nil {
+		t.Fatalf("NewTorrent failed: %v", err)
+	}
+	s := New(tor, content)
+	t.Cleanup(s.Close)
+	return s, content
+}
+
+func waitSwarm(t *testing.T, s *Swarm) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy func() piece.SelectionStrategy
+	}{
+		{"sequential", func() piece.SelectionStrategy { return piece.NewSequentialStrategy() }},
+		{"rarest first", func() piece.SelectionStrategy { return piece.NewRarestFirstStrategy() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, content := newSwarm(t, 10*16384+1000)
+			s.AddSeed()
+			for i := 0; i < 3; i++ {
+				s.AddLeecher().Pieces.SetSelectionStrategy(tt.strategy())
+			}
+			s.ConnectAll()
+			waitSwarm(t, s)
+
+			for _, n := range s.Nodes() {
+				if !bytes.Equal(n.Storage.Bytes(), content) {
+					t.Errorf("node %s has different data", n.Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestSwarmRelay(t *testing.T) {
+	// Pieces reach the last leecher only through the first
+	s, content := newSwarm(t, 6*16384)
+	seed, first, last := s.AddSeed(), s.AddLeecher(), s.AddLeecher()
+	s.Connect(first, seed)
+	s.Connect(last, first)
+	waitSwarm(t, s)
+
+	if !bytes.Equal(last.Storage.Bytes(), content) {
+		t.Error("last leecher has different data")
+	}
+	if got := len(seed.Peers.GetPeers()); got != 1 {
+		t.Errorf("seed has %d peers, want 1", got)
+	}
+}
@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnsafePath is returned for file names that could escape the download
+// directory or that the platform cannot create
+var ErrUnsafePath = errors.New("unsafe path")
+
+// ReplacementChar is substituted for characters that cannot appear in a
+// file name on the target filesystem
+const ReplacementChar = '_'
+
+// windowsReserved are characters Windows does not allow in file names
+const windowsReserved = `<>:"/\|?*`
+
+// SanitizeFileName makes a single path component from a torrent safe to
+// use as a file name on the current platform
+func SanitizeFileName(name string) string {
+	return sanitizeFileName(name, runtime.GOOS)
+}
+
+// sanitizeFileName replaces invalid UTF-8, control characters and path
+// separators, plus the characters goos reserves
+func sanitizeFileName(name, goos string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		i += size
+
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			// Invalid encoding; the torrent had no usable utf-8 key
+			b.WriteRune(ReplacementChar)
+		case r < 0x20 || r == 0x7f || r == '/':
+			b.WriteRune(ReplacementChar)
+		case goos == "windows" && strings.ContainsRune(windowsReserved, r):
+			b.WriteRune(ReplacementChar)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	sanitized := b.String()
+
+	// Windows silently strips trailing dots and spaces, which would make
+	// distinct torrent files collide
+	if goos == "windows" {
+		trimmed := strings.TrimRight(sanitized, ". ")
+		if trimmed != sanitized && trimmed != "" {
+			sanitized = trimmed + strings.Repeat(string(ReplacementChar), len(sanitized)-len(trimmed))
+		}
+	}
+
+	return sanitized
+}
+
+// windowsDeviceNames are reserved on Windows regardless of extension
+var windowsDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidatePathComponent checks that a single name from a torrent can be
+// joined below the download directory without escaping it
+func ValidatePathComponent(name string) error {
+	return validatePathComponent(name, runtime.GOOS)
+}
+
+func validatePathComponent(name, goos string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty path component", ErrUnsafePath)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: relative path component %q", ErrUnsafePath, name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("%w: separator in path component %q", ErrUnsafePath, name)
+	case filepath.IsAbs(name) || filepath.VolumeName(name) != "":
+		return fmt.Errorf("%w: absolute path component %q", ErrUnsafePath, name)
+	}
+
+	if goos == "windows" {
+		if strings.ContainsAny(name, `\:`) {
+			return fmt.Errorf("%w: separator in path component %q", ErrUnsafePath, name)
+		}
+		base := strings.ToUpper(strings.TrimRight(name, ". "))
+		if i := strings.IndexByte(base, '.'); i >= 0 {
+			base = base[:i]
+		}
+		if windowsDeviceNames[strings.TrimRight(base, " ")] {
+			return fmt.Errorf("%w: reserved device name %q", ErrUnsafePath, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		goos     string
+		expected string
+	}{
+		{"plain", "movie.mkv", "linux", "movie.mkv"},
+		{"unicode kept", "café 日本.txt", "linux", "café 日本.txt"},
+		{"slash", "a/b", "linux", "a_b"},
+		{"control chars", "a\x00b\x1fc", "linux", "a_b_c"},
+		{"invalid utf-8", "caf\xe9.txt", "linux", "caf_.txt"},
+		{"colon allowed on linux", "a:b", "linux", "a:b"},
+		{"windows reserved", `a<b>c:d"e\f|g?h*i`, "windows", "a_b_c_d_e_f_g_h_i"},
+		{"windows trailing dot", "name.", "windows", "name_"},
+		{"windows trailing spaces", "name  ", "windows", "name__"},
+		{"trailing dot allowed on linux", "name.", "linux", "name."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sanitizeFileName(tt.input, tt.goos)
+			if result != tt.expected {
+				t.Errorf("sanitizeFileName(%q, %s) = %q, want %q", tt.input, tt.goos, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidatePathComponent(t *testing.T) {
+	tests := []struct {
+		input   string
+		goos    string
+		wantErr bool
+	}{
+		{"file.txt", "linux", false},
+		{"..hidden", "linux", false},
+		{"", "linux", true},
+		{".", "linux", true},
+		{"..", "linux", true},
+		{"a/b", "linux", true},
+		{"/etc", "linux", true},
+		{"nul\x00", "linux", true},
+		{"CON", "linux", false},
+		{"CON", "windows", true},
+		{"con.txt", "windows", true},
+		{"Lpt1 .log", "windows", true},
+		{"console.txt", "windows", false},
+		{`a\b`, "windows", true},
+		{"C:", "windows", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.goos+"/"+tt.input, func(t *testing.T) {
+			err := validatePathComponent(tt.input, tt.goos)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePathComponent(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("validatePathComponent(%q) error = %v, want ErrUnsafePath", tt.input, err)
+			}
+		})
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/mt/bittorrent-impl/internal/bencode"
 )
@@ -19,8 +21,11 @@ type Torrent struct {
 	CreatedBy    string
 	CreationDate int64
 	Comment      string
+	Nodes        []string // DHT bootstrap nodes (BEP 5) as host:port, unused if private
+	HTTPSeeds    []string // BEP 17 HTTP seed URLs
 	InfoHash     [20]byte
 	Info         Info
+	Metainfo     []byte // the .torrent file as parsed
 }
 
 type Info struct {
@@ -29,6 +34,7 @@ type Info struct {
 	Name        string `bencode:"name"`
 	Length      int64  `bencode:"length"`
 	Files       []File `bencode:"files"`
+	Private     bool   `bencode:"private"` // BEP 27
 }
 
 type File struct {
@@ -71,22 +77,28 @@ func Parse(r io.Reader) (*Torrent, error) {
 		return nil, fmt.Errorf("failed to decode torrent: %w", err)
 	}
 
-	// Get the info dictionary to calculate hash
+	// Capture the info dictionary exactly as encoded; re-encoding the
+	// decoded map would change the hash of non-canonical torrents
+	var envelope struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	if err := bencode.Decode(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode torrent: %w", err)
+	}
+
+	// Get the info dictionary
 	infoDict, ok := raw["info"].(map[string]interface{})
-	if !ok {
+	if !ok || len(envelope.Info) == 0 {
 		return nil, errors.New("missing info dictionary")
 	}
 
 	// Calculate info hash
-	infoBencoded, err := bencode.Encode(infoDict)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode info dictionary: %w", err)
-	}
-	infoHash := sha1.Sum(infoBencoded)
+	infoHash := sha1.Sum(envelope.Info)
 
 	// Create the torrent struct
 	t := &Torrent{
 		InfoHash: infoHash,
+		Metainfo: data,
 	}
 
 	// Extract fields from raw map
@@ -122,6 +134,30 @@ func Parse(r io.Reader) (*Torrent, error) {
 		t.Comment = comment
 	}
 
+	if seeds, ok := raw["httpseeds"].([]interface{}); ok {
+		for _, seed := range seeds {
+			if seedURL, ok := seed.(string); ok && seedURL != "" {
+				t.HTTPSeeds = append(t.HTTPSeeds, seedURL)
+			}
+		}
+	}
+
+	// DHT-only torrents list nodes to bootstrap from as [host, port] pairs
+	if nodes, ok := raw["nodes"].([]interface{}); ok {
+		for _, node := range nodes {
+			pair, ok := node.([]interface{})
+			if !ok || len(pair) != 2 {
+				continue
+			}
+			host, ok := pair[0].(string)
+			port, ok2 := pair[1].(int64)
+			if !ok || !ok2 || host == "" || port <= 0 || port > 65535 {
+				continue
+			}
+			t.Nodes = append(t.Nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+		}
+	}
+
 	// Parse info dictionary
 	if pieceLength, ok := infoDict["piece length"].(int64); ok {
 		t.Info.PieceLength = pieceLength
@@ -131,8 +167,16 @@ func Parse(r io.Reader) (*Torrent, error) {
 		t.Info.Pieces = []byte(pieces)
 	}
 
-	if name, ok := infoDict["name"].(string); ok {
-		t.Info.Name = name
+	// Prefer the explicit UTF-8 name when a torrent carries both
+	if name, ok := infoDict["name.utf-8"].(string); ok && name != "" {
+		t.Info.Name = SanitizeFileName(name)
+	} else if name, ok := infoDict["name"].(string); ok {
+		t.Info.Name = SanitizeFileName(name)
+	}
+
+	// Private torrents (BEP 27) must only get peers from their trackers
+	if private, ok := infoDict["private"].(int64); ok {
+		t.Info.Private = private == 1
 	}
 
 	// Check for single file vs multi-file mode
@@ -149,10 +193,14 @@ func Parse(r io.Reader) (*Torrent, error) {
 					f.Length = length
 				}
 				
-				if pathList, ok := fileDict["path"].([]interface{}); ok {
+				pathList, ok := fileDict["path.utf-8"].([]interface{})
+				if !ok || len(pathList) == 0 {
+					pathList, ok = fileDict["path"].([]interface{})
+				}
+				if ok {
 					for _, pathPart := range pathList {
 						if pathStr, ok := pathPart.(string); ok {
-							f.Path = append(f.Path, pathStr)
+							f.Path = append(f.Path, SanitizeFileName(pathStr))
 						}
 					}
 				}
@@ -191,6 +239,10 @@ func (t *Torrent) Validate() error {
 		return errors.New("torrent name is empty")
 	}
 
+	if err := ValidatePathComponent(t.Info.Name); err != nil {
+		return fmt.Errorf("invalid torrent name: %w", err)
+	}
+
 	// Single file mode
 	if len(t.Info.Files) == 0 && t.Info.Length <= 0 {
 		return errors.New("invalid file length")
@@ -205,6 +257,11 @@ func (t *Torrent) Validate() error {
 			if len(file.Path) == 0 {
 				return fmt.Errorf("file %d has empty path", i)
 			}
+			for _, component := range file.Path {
+				if err := ValidatePathComponent(component); err != nil {
+					return fmt.Errorf("file %d has invalid path: %w", i, err)
+				}
+			}
 		}
 	}
 
@@ -216,6 +273,13 @@ func (t *Torrent) IsSingleFile() bool {
 	return len(t.Info.Files) == 0
 }
 
+// IsPrivate returns true if the torrent is marked private (BEP 27). Peers
+// for a private torrent may only come from its trackers, so DHT, PEX and
+// local peer discovery must stay disabled for it.
+func (t *Torrent) IsPrivate() bool {
+	return t.Info.Private
+}
+
 // TotalLength returns the total length of all files in the torrent
 func (t *Torrent) TotalLength() int64 {
 	if t.IsSingleFile() {
@@ -336,6 +400,30 @@ func (t *Torrent) GetAnnounceURLs() []string {
 	return urls
 }
 
+// AnnounceTiers returns the BEP 12 tiers of announce URLs, without
+// duplicates. The announce URL is a tier of its own ahead of the others
+// unless announce-list already has it.
+func (t *Torrent) AnnounceTiers() [][]string {
+	seen := make(map[string]bool)
+	var tiers [][]string
+	for _, tier := range t.AnnounceList {
+		var urls []string
+		for _, url := range tier {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	if t.Announce != "" && !seen[t.Announce] {
+		tiers = append([][]string{{t.Announce}}, tiers...)
+	}
+	return tiers
+}
+
 // String returns a human-readable representation of the torrent
 func (t *Torrent) String() string {
 	var buf bytes.Buffer
@@ -352,6 +440,9 @@ func (t *Torrent) String() string {
 	if t.CreatedBy != "" {
 		fmt.Fprintf(&buf, "Created By: %s\n", t.CreatedBy)
 	}
+	if t.IsPrivate() {
+		fmt.Fprintf(&buf, "Private: yes\n")
+	}
 
 	fmt.Fprintf(&buf, "Files:\n")
 	for _, file := range t.GetFiles() {
@@ -363,5 +454,19 @@ func (t *Torrent) String() string {
 		fmt.Fprintf(&buf, "  %s\n", url)
 	}
 
+	if len(t.HTTPSeeds) > 0 {
+		fmt.Fprintf(&buf, "HTTP Seeds:\n")
+		for _, seed := range t.HTTPSeeds {
+			fmt.Fprintf(&buf, "  %s\n", seed)
+		}
+	}
+
+	if len(t.Nodes) > 0 {
+		fmt.Fprintf(&buf, "DHT Nodes:\n")
+		for _, node := range t.Nodes {
+			fmt.Fprintf(&buf, "  %s\n", node)
+		}
+	}
+
 	return buf.String()
 }
\ No newline at end of file
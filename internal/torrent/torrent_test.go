@@ -2,6 +2,9 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/mt/bittorrent-impl/internal/bencode"
@@ -247,6 +250,53 @@ func TestValidation(t *testing.T) {
 	}
 }
 
+func TestAnnounceTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		torrent *Torrent
+		want    [][]string
+	}{
+		{
+			name:    "announce only",
+			torrent: &Torrent{Announce: "http://tracker1.com"},
+			want:    [][]string{{"http://tracker1.com"}},
+		},
+		{
+			name: "announce in announce-list",
+			torrent: &Torrent{
+				Announce: "http://tracker1.com",
+				AnnounceList: [][]string{
+					{"http://tracker2.com", "http://tracker3.com"},
+					{"http://tracker4.com", "http://tracker1.com", "http://tracker2.com"},
+				},
+			},
+			want: [][]string{
+				{"http://tracker2.com", "http://tracker3.com"},
+				{"http://tracker4.com", "http://tracker1.com"},
+			},
+		},
+		{
+			name: "announce not in announce-list",
+			torrent: &Torrent{
+				Announce:     "http://tracker1.com",
+				AnnounceList: [][]string{{"http://tracker2.com"}},
+			},
+			want: [][]string{{"http://tracker1.com"}, {"http://tracker2.com"}},
+		},
+		{
+			name:    "none",
+			torrent: &Torrent{},
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.torrent.AnnounceTiers(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: AnnounceTiers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestGetAnnounceURLs(t *testing.T) {
 	torrent := &Torrent{
 		Announce: "http://tracker1.com",
@@ -280,4 +330,230 @@ func TestGetAnnounceURLs(t *testing.T) {
 			t.Errorf("URL %s not found in result", expected[i])
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestInfoHashUsesOriginalBytes(t *testing.T) {
+	// Keys are deliberately out of canonical order and include an unknown
+	// key; re-encoding the decoded dictionary would produce different bytes
+	info := "d4:name8:test.txt12:piece lengthi16384e6:pieces20:12345678901234567890" +
+		"6:lengthi1024e5:x-fooli1ei2eee"
+	data := []byte("d8:announce23:http://tracker.test/ann4:info" + info + "e")
+
+	torrent, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	expected := sha1.Sum([]byte(info))
+	if torrent.InfoHash != expected {
+		t.Errorf("InfoHash = %x, want %x", torrent.InfoHash, expected)
+	}
+	if !bytes.Equal(torrent.Metainfo, data) {
+		t.Error("Metainfo differs from the parsed data")
+	}
+
+	reencoded, err := bencode.Encode(map[string]interface{}{
+		"name":         "test.txt",
+		"piece length": int64(16384),
+		"pieces":       "12345678901234567890",
+		"length":       int64(1024),
+		"x-foo":        []interface{}{int64(1), int64(2)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode info: %v", err)
+	}
+	if torrent.InfoHash == sha1.Sum(reencoded) {
+		t.Error("InfoHash should not match the re-encoded info dictionary")
+	}
+}
+
+func TestParseMissingInfo(t *testing.T) {
+	data := []byte("d8:announce23:http://tracker.test/anne")
+	if _, err := Parse(bytes.NewReader(data)); err == nil {
+		t.Error("Parse should fail without an info dictionary")
+	}
+}
+
+func TestParsePrivateFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		private interface{}
+		want    bool
+	}{
+		{"absent", nil, false},
+		{"zero", int64(0), false},
+		{"one", int64(1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := map[string]interface{}{
+				"piece length": int64(16384),
+				"pieces":       "12345678901234567890",
+				"name":         "test.txt",
+				"length":       int64(1024),
+			}
+			if tt.private != nil {
+				info["private"] = tt.private
+			}
+
+			encoded, err := bencode.Encode(map[string]interface{}{"info": info})
+			if err != nil {
+				t.Fatalf("Failed to encode test torrent: %v", err)
+			}
+
+			torrent, err := Parse(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("Failed to parse torrent: %v", err)
+			}
+
+			if torrent.IsPrivate() != tt.want {
+				t.Errorf("IsPrivate() = %v, want %v", torrent.IsPrivate(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	encoded, err := bencode.Encode(map[string]interface{}{
+		"nodes": []interface{}{
+			[]interface{}{"router.example.com", int64(6881)},
+			[]interface{}{"2001:db8::1", int64(51413)},
+			[]interface{}{"10.0.0.1", int64(0)},
+			[]interface{}{"10.0.0.2"},
+			"10.0.0.3:6881",
+		},
+		"info": map[string]interface{}{
+			"piece length": int64(16384),
+			"pieces":       "12345678901234567890",
+			"name":         "test.txt",
+			"length":       int64(1024),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+
+	torrent, err := Parse(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	want := []string{"router.example.com:6881", "[2001:db8::1]:51413"}
+	if !reflect.DeepEqual(torrent.Nodes, want) {
+		t.Errorf("Nodes = %v, want %v", torrent.Nodes, want)
+	}
+}
+
+func TestParseHTTPSeeds(t *testing.T) {
+	encoded, err := bencode.Encode(map[string]interface{}{
+		"httpseeds": []interface{}{"http://seed.example.com/seed.php", int64(1), ""},
+		"info": map[string]interface{}{
+			"piece length": int64(16384),
+			"pieces":       "12345678901234567890",
+			"name":         "test.txt",
+			"length":       int64(1024),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+
+	torrent, err := Parse(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	want := []string{"http://seed.example.com/seed.php"}
+	if !reflect.DeepEqual(torrent.HTTPSeeds, want) {
+		t.Errorf("HTTPSeeds = %v, want %v", torrent.HTTPSeeds, want)
+	}
+}
+
+func TestParseUTF8Keys(t *testing.T) {
+	torrentData := map[string]interface{}{
+		"info": map[string]interface{}{
+			"piece length": int64(16384),
+			"pieces":       "12345678901234567890",
+			"name":         "caf\xe9",
+			"name.utf-8":   "café",
+			"files": []interface{}{
+				map[string]interface{}{
+					"length":     int64(1024),
+					"path":       []interface{}{"r\xe9sum\xe9.txt"},
+					"path.utf-8": []interface{}{"résumé.txt"},
+				},
+				map[string]interface{}{
+					"length": int64(2048),
+					"path":   []interface{}{"sub", "bad\xffname.txt"},
+				},
+			},
+		},
+	}
+
+	encoded, err := bencode.Encode(torrentData)
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+
+	torrent, err := Parse(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+
+	if torrent.Info.Name != "café" {
+		t.Errorf("Name = %q, want %q", torrent.Info.Name, "café")
+	}
+	if got := torrent.Info.Files[0].Path[0]; got != "résumé.txt" {
+		t.Errorf("Files[0] path = %q, want %q", got, "résumé.txt")
+	}
+	if got := torrent.Info.Files[1].Path[1]; got != "bad_name.txt" {
+		t.Errorf("Files[1] path = %q, want %q", got, "bad_name.txt")
+	}
+}
+
+func TestParseRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name string
+		info map[string]interface{}
+	}{
+		{"dot-dot name", map[string]interface{}{
+			"name":   "..",
+			"length": int64(1024),
+		}},
+		{"dot-dot path", map[string]interface{}{
+			"name": "dir",
+			"files": []interface{}{
+				map[string]interface{}{
+					"length": int64(1024),
+					"path":   []interface{}{"..", "..", "etc", "passwd"},
+				},
+			},
+		}},
+		{"empty component", map[string]interface{}{
+			"name": "dir",
+			"files": []interface{}{
+				map[string]interface{}{
+					"length": int64(1024),
+					"path":   []interface{}{"", "file"},
+				},
+			},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.info["piece length"] = int64(16384)
+			tt.info["pieces"] = "12345678901234567890"
+
+			encoded, err := bencode.Encode(map[string]interface{}{"info": tt.info})
+			if err != nil {
+				t.Fatalf("Failed to encode test torrent: %v", err)
+			}
+
+			if _, err := Parse(bytes.NewReader(encoded)); !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("Parse() error = %v, want ErrUnsafePath", err)
+			}
+		})
+	}
+}
@@ -2,7 +2,11 @@ package tracker
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +14,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mt/bittorrent-impl/internal/bencode"
@@ -28,6 +34,8 @@ type TrackerResponse struct {
 	Peers    []Peer
 	Complete int
 	Incomplete int
+	TrackerID string // echoed back on later announces
+	ExternalIP net.IP // our address as seen by the tracker (BEP 24)
 }
 
 // AnnounceParams contains parameters for tracker announce
@@ -40,26 +48,131 @@ type AnnounceParams struct {
 	Left       int64
 	Event      string // "started", "stopped", "completed", or ""
 	Compact    bool
+	NumWant    int    // number of peers wanted, 0 for the tracker default
+	Key        string // overrides the client key when set
+	TrackerID  string // overrides the remembered tracker id when set
 }
 
 // Client handles communication with trackers
 type Client struct {
 	httpClient *http.Client
 	userAgent  string
+	timeout    time.Duration
+	key        string
+
+	mu         sync.Mutex
+	trackerIDs map[string]string // announce URL -> tracker id
+}
+
+// DefaultTimeout is the default per-announce timeout
+const DefaultTimeout = 30 * time.Second
+
+// ClientConfig configures how a Client reaches trackers
+type ClientConfig struct {
+	ProxyURL  string        // http, https or socks5 proxy; empty uses the environment
+	TLSConfig *tls.Config   // e.g. client certificates for private trackers
+	Timeout   time.Duration // per-announce timeout, 0 for none
+	UserAgent string
+	LocalAddr net.IP // local address to connect from, nil for any
+}
+
+// DefaultClientConfig returns the default tracker client configuration
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Timeout:   DefaultTimeout,
+		UserAgent: "SimpleBittorrent/1.0",
+	}
 }
 
 // NewClient creates a new tracker client
 func NewClient() *Client {
+	client, _ := NewClientWithConfig(DefaultClientConfig())
+	return client
+}
+
+// NewClientWithConfig creates a tracker client using a proxy and TLS
+// settings. It fails if the proxy URL is invalid.
+func NewClientWithConfig(config ClientConfig) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig.Clone()
+	}
+
+	if config.LocalAddr != nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: &net.TCPAddr{IP: config.LocalAddr},
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultClientConfig().UserAgent
+	}
+
 	return &Client{
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Transport: transport,
 		},
-		userAgent: "SimpleBittorrent/1.0",
+		userAgent:  userAgent,
+		timeout:    config.Timeout,
+		key:        generateKey(),
+		trackerIDs: make(map[string]string),
+	}, nil
+}
+
+// generateKey returns a random key that identifies this client to trackers
+// across IP address changes
+func generateKey() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint32(b[:], uint32(time.Now().UnixNano()))
 	}
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
+
+// Key returns the key sent with every announce
+func (c *Client) Key() string {
+	return c.key
+}
+
+// TrackerID returns the tracker id last received from announceURL
+func (c *Client) TrackerID(announceURL string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trackerIDs[announceURL]
 }
 
 // Announce sends an announce request to the tracker
 func (c *Client) Announce(announceURL string, params AnnounceParams) (*TrackerResponse, error) {
+	return c.AnnounceContext(context.Background(), announceURL, params)
+}
+
+// AnnounceContext sends an announce request that is abandoned when ctx is
+// cancelled or the client timeout expires
+func (c *Client) AnnounceContext(ctx context.Context, announceURL string, params AnnounceParams) (*TrackerResponse, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
 	// Build the request URL
 	u, err := url.Parse(announceURL)
 	if err != nil {
@@ -81,12 +194,31 @@ func (c *Client) Announce(announceURL string, params AnnounceParams) (*TrackerRe
 	// Request compact format
 	if params.Compact {
 		q.Set("compact", "1")
+		q.Set("no_peer_id", "1")
+	}
+
+	if params.NumWant > 0 {
+		q.Set("numwant", strconv.Itoa(params.NumWant))
+	}
+
+	key := params.Key
+	if key == "" {
+		key = c.key
+	}
+	q.Set("key", key)
+
+	trackerID := params.TrackerID
+	if trackerID == "" {
+		trackerID = c.TrackerID(announceURL)
+	}
+	if trackerID != "" {
+		q.Set("trackerid", trackerID)
 	}
 	
 	u.RawQuery = q.Encode()
 
 	// Create the request
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -112,7 +244,19 @@ func (c *Client) Announce(announceURL string, params AnnounceParams) (*TrackerRe
 	}
 
 	// Parse the response
-	return c.parseResponse(body)
+	response, err := c.parseResponse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember the tracker id so later announces can echo it
+	if response.TrackerID != "" {
+		c.mu.Lock()
+		c.trackerIDs[announceURL] = response.TrackerID
+		c.mu.Unlock()
+	}
+
+	return response, nil
 }
 
 // parseResponse parses the bencode response from the tracker
@@ -144,12 +288,24 @@ func (c *Client) parseResponse(data []byte) (*TrackerResponse, error) {
 		response.Incomplete = int(incomplete)
 	}
 
+	// Extract our external address (BEP 24)
+	if externalIP, ok := resp["external ip"].(string); ok {
+		if len(externalIP) == net.IPv4len || len(externalIP) == net.IPv6len {
+			response.ExternalIP = net.IP(externalIP)
+		}
+	}
+
+	// Extract tracker id
+	if trackerID, ok := resp["tracker id"].(string); ok {
+		response.TrackerID = trackerID
+	}
+
 	// Extract peers
 	if peersData, ok := resp["peers"]; ok {
 		switch v := peersData.(type) {
 		case string:
 			// Compact format
-			response.Peers = parseCompactPeers([]byte(v))
+			response.Peers = ParseCompactPeers([]byte(v))
 		case []interface{}:
 			// Dictionary format
 			response.Peers = parseDictPeers(v)
@@ -158,22 +314,43 @@ func (c *Client) parseResponse(data []byte) (*TrackerResponse, error) {
 		}
 	}
 
+	// Extract IPv6 peers (BEP 7)
+	if peers6, ok := resp["peers6"].(string); ok {
+		response.Peers = append(response.Peers, ParseCompactPeers6([]byte(peers6))...)
+	}
+
 	return response, nil
 }
 
-// parseCompactPeers parses peers in compact format (6 bytes per peer)
-func parseCompactPeers(data []byte) []Peer {
-	if len(data)%6 != 0 {
+// ParseCompactPeers parses IPv4 peers in compact format (6 bytes per peer),
+// as in a tracker's peers string. It returns nil if data is not a whole
+// number of peers.
+func ParseCompactPeers(data []byte) []Peer {
+	return parseCompact(data, net.IPv4len)
+}
+
+// ParseCompactPeers6 parses IPv6 peers in compact format (18 bytes per
+// peer), as in a tracker's peers6 string (BEP 7). It returns nil if data is
+// not a whole number of peers.
+func ParseCompactPeers6(data []byte) []Peer {
+	return parseCompact(data, net.IPv6len)
+}
+
+// parseCompact parses compact peers whose addresses are ipLen bytes
+func parseCompact(data []byte, ipLen int) []Peer {
+	size := ipLen + 2
+	if len(data)%size != 0 {
 		return nil
 	}
 
-	numPeers := len(data) / 6
+	numPeers := len(data) / size
 	peers := make([]Peer, 0, numPeers)
 
 	for i := 0; i < numPeers; i++ {
-		offset := i * 6
-		ip := net.IP(data[offset : offset+4])
-		port := binary.BigEndian.Uint16(data[offset+4 : offset+6])
+		offset := i * size
+		ip := make(net.IP, ipLen)
+		copy(ip, data[offset:offset+ipLen])
+		port := binary.BigEndian.Uint16(data[offset+ipLen : offset+size])
 		
 		peers = append(peers, Peer{
 			IP:   ip,
@@ -224,9 +401,10 @@ func parseDictPeers(peersData []interface{}) []Peer {
 	return peers
 }
 
-// String returns a string representation of a peer
+// String returns the peer's host:port address, with IPv6 addresses in
+// brackets
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 // GeneratePeerID generates a peer ID for our client
@@ -245,7 +423,8 @@ func GeneratePeerID() [20]byte {
 	return peerID
 }
 
-// CompactPeersToBytes converts a slice of peers to compact format
+// CompactPeersToBytes converts the IPv4 peers of a slice to compact
+// format; CompactPeers6ToBytes converts the IPv6 ones
 func CompactPeersToBytes(peers []Peer) []byte {
 	buf := bytes.NewBuffer(nil)
 	
@@ -253,7 +432,7 @@ func CompactPeersToBytes(peers []Peer) []byte {
 		// Write IP (4 bytes)
 		ip := peer.IP.To4()
 		if ip == nil {
-			continue // Skip IPv6 for now
+			continue // IPv6 peers go in peers6
 		}
 		buf.Write(ip)
 		
@@ -262,4 +441,18 @@ func CompactPeersToBytes(peers []Peer) []byte {
 	}
 	
 	return buf.Bytes()
-}
\ No newline at end of file
+}
+
+// CompactPeers6ToBytes converts the IPv6 peers of a slice to the compact
+// format of peers6 (BEP 7), 18 bytes per peer
+func CompactPeers6ToBytes(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*(net.IPv6len+2))
+	for _, peer := range peers {
+		if peer.IP.To4() != nil || len(peer.IP) != net.IPv6len {
+			continue // IPv4 peers go in peers
+		}
+		buf = append(buf, peer.IP...)
+		buf = binary.BigEndian.AppendUint16(buf, peer.Port)
+	}
+	return buf
+}
@@ -2,9 +2,17 @@ package tracker
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/mt/bittorrent-impl/internal/bencode"
 )
@@ -21,7 +29,7 @@ func TestParseCompactPeers(t *testing.T) {
 	copy(data[6:10], net.IPv4(10, 0, 0, 2).To4())
 	binary.BigEndian.PutUint16(data[10:12], 6882)
 	
-	peers := parseCompactPeers(data)
+	peers := ParseCompactPeers(data)
 	
 	if len(peers) != 2 {
 		t.Fatalf("Expected 2 peers, got %d", len(peers))
@@ -125,6 +133,26 @@ func TestParseResponse(t *testing.T) {
 	}
 }
 
+func TestParseResponseExternalIP(t *testing.T) {
+	client := NewClient()
+
+	encoded, err := bencode.Encode(map[string]interface{}{
+		"interval":    int64(1800),
+		"external ip": string([]byte{203, 0, 113, 5}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test response: %v", err)
+	}
+
+	resp, err := client.parseResponse(encoded)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if !resp.ExternalIP.Equal(net.IPv4(203, 0, 113, 5)) {
+		t.Errorf("ExternalIP = %v, want 203.0.113.5", resp.ExternalIP)
+	}
+}
+
 func TestParseResponseWithError(t *testing.T) {
 	client := NewClient()
 	
@@ -197,4 +225,192 @@ func TestCompactPeersToBytes(t *testing.T) {
 	if port2 != 6882 {
 		t.Errorf("Second peer port = %d, want 6882", port2)
 	}
-}
\ No newline at end of file
+}
+
+func TestCompactPeersRoundTrip(t *testing.T) {
+	peers := []Peer{
+		{IP: net.IPv4(192, 168, 1, 1), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51413},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 6882},
+		{IP: net.ParseIP("fe80::2"), Port: 6883},
+	}
+
+	v4 := ParseCompactPeers(CompactPeersToBytes(peers))
+	v6 := ParseCompactPeers6(CompactPeers6ToBytes(peers))
+	got := append(v4, v6...)
+	want := []Peer{peers[0], peers[2], peers[1], peers[3]}
+	if len(got) != len(want) {
+		t.Fatalf("round trip gave %d peers, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].IP.Equal(want[i].IP) || got[i].Port != want[i].Port {
+			t.Errorf("peer %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if peers := ParseCompactPeers6(make([]byte, 17)); peers != nil {
+		t.Errorf("ParseCompactPeers6 of 17 bytes = %v, want nil", peers)
+	}
+}
+
+func TestParseResponsePeers6(t *testing.T) {
+	client := NewClient()
+
+	encoded, err := bencode.Encode(map[string]interface{}{
+		"interval": int64(1800),
+		"peers":    string(CompactPeersToBytes([]Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})),
+		"peers6":   string(CompactPeers6ToBytes([]Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6882}})),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test response: %v", err)
+	}
+
+	resp, err := client.parseResponse(encoded)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(resp.Peers) != 2 {
+		t.Fatalf("got %d peers, want 2", len(resp.Peers))
+	}
+	if !resp.Peers[1].IP.Equal(net.ParseIP("2001:db8::1")) || resp.Peers[1].Port != 6882 {
+		t.Errorf("IPv6 peer = %v, want [2001:db8::1]:6882", resp.Peers[1])
+	}
+}
+
+func TestAnnounceParameters(t *testing.T) {
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		resp, _ := bencode.Encode(map[string]interface{}{
+			"interval":   int64(1800),
+			"tracker id": "abc123",
+			"peers":      "",
+		})
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	client := NewClient()
+	params := AnnounceParams{
+		Port:    6881,
+		Left:    100,
+		Compact: true,
+		NumWant: 30,
+	}
+
+	resp, err := client.Announce(server.URL, params)
+	if err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if resp.TrackerID != "abc123" {
+		t.Errorf("TrackerID = %q, want %q", resp.TrackerID, "abc123")
+	}
+
+	if _, err := client.Announce(server.URL, params); err != nil {
+		t.Fatalf("second Announce failed: %v", err)
+	}
+
+	first, second := queries[0], queries[1]
+	if got := first.Get("numwant"); got != "30" {
+		t.Errorf("numwant = %q, want %q", got, "30")
+	}
+	if got := first.Get("no_peer_id"); got != "1" {
+		t.Errorf("no_peer_id = %q, want %q", got, "1")
+	}
+	if first.Get("key") == "" || first.Get("key") != second.Get("key") {
+		t.Errorf("key = %q then %q, want a stable non-empty key", first.Get("key"), second.Get("key"))
+	}
+	if first.Has("trackerid") {
+		t.Errorf("first announce sent trackerid %q", first.Get("trackerid"))
+	}
+	if got := second.Get("trackerid"); got != "abc123" {
+		t.Errorf("trackerid = %q, want %q", got, "abc123")
+	}
+}
+
+// trackerHandler answers every announce with an empty peer list
+func trackerHandler(w http.ResponseWriter, r *http.Request) {
+	resp, _ := bencode.Encode(map[string]interface{}{
+		"interval": int64(1800),
+		"peers":    "",
+	})
+	w.Write(resp)
+}
+
+func TestAnnounceThroughProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute tracker URL
+		proxiedHost = r.URL.Host
+		trackerHandler(w, r)
+	}))
+	defer proxy.Close()
+
+	config := DefaultClientConfig()
+	config.ProxyURL = proxy.URL
+	client, err := NewClientWithConfig(config)
+	if err != nil {
+		t.Fatalf("NewClientWithConfig failed: %v", err)
+	}
+
+	if _, err := client.Announce("http://tracker.invalid/announce", AnnounceParams{Port: 6881}); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if proxiedHost != "tracker.invalid" {
+		t.Errorf("proxied host = %q, want %q", proxiedHost, "tracker.invalid")
+	}
+}
+
+func TestNewClientWithConfigRejectsProxy(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy:21", "://bad"} {
+		config := DefaultClientConfig()
+		config.ProxyURL = proxyURL
+		if _, err := NewClientWithConfig(config); err == nil {
+			t.Errorf("NewClientWithConfig accepted proxy %q", proxyURL)
+		}
+	}
+}
+
+func TestAnnounceTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(trackerHandler))
+	defer server.Close()
+
+	// The default client does not trust the test certificate
+	if _, err := NewClient().Announce(server.URL, AnnounceParams{}); err == nil {
+		t.Error("Announce succeeded without trusting the server certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	config := DefaultClientConfig()
+	config.TLSConfig = &tls.Config{RootCAs: roots}
+	client, err := NewClientWithConfig(config)
+	if err != nil {
+		t.Fatalf("NewClientWithConfig failed: %v", err)
+	}
+
+	if _, err := client.Announce(server.URL, AnnounceParams{}); err != nil {
+		t.Errorf("Announce failed: %v", err)
+	}
+}
+
+func TestAnnounceContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewClient().AnnounceContext(ctx, server.URL, AnnounceParams{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AnnounceContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
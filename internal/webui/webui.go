@@ -0,0 +1,312 @@
+// Package webui serves a REST API over a session and a single-page UI that
+// uses it to show and control torrents from a browser.
+package webui
+
+import (
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"github.com/mt/bittorrent-impl/internal/peer"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/session"
+)
+
+//go:embed static
+var static embed.FS
+
+// Torrent is a torrent with its peers and files, as returned for a single
+// torrent
+type Torrent struct {
+	session.Status
+	Peers []Peer         `json:"peers"`
+	Files []session.File `json:"files"`
+}
+
+// Peer describes a connected peer
+type Peer struct {
+	Address        string  `json:"address"`
+	Source         string  `json:"source"`
+	Client         string  `json:"client,omitempty"`
+	Downloaded     int64   `json:"downloaded"`
+	Uploaded       int64   `json:"uploaded"`
+	DownloadRate   float64 `json:"downloadRate"`
+	UploadRate     float64 `json:"uploadRate"`
+	AmChoking      bool    `json:"amChoking"`
+	AmInterested   bool    `json:"amInterested"`
+	PeerChoking    bool    `json:"peerChoking"`
+	PeerInterested bool    `json:"peerInterested"`
+	Snubbed        bool    `json:"snubbed"`
+}
+
+// newPeer converts peer manager information for the API
+func newPeer(info peer.PeerInfo) Peer {
+	return Peer{
+		Address:        info.Address,
+		Source:         info.Source.String(),
+		Client:         info.Client,
+		Downloaded:     info.Stats.BytesDownloaded,
+		Uploaded:       info.Stats.BytesUploaded,
+		DownloadRate:   info.Stats.DownloadRate,
+		UploadRate:     info.Stats.UploadRate,
+		AmChoking:      info.State.AmChoking,
+		AmInterested:   info.State.AmInterested,
+		PeerChoking:    info.State.PeerChoking,
+		PeerInterested: info.State.PeerInterested,
+		Snubbed:        info.IsSnubbed,
+	}
+}
+
+// Server serves the API under /api/ and the UI at /
+type Server struct {
+	session *session.Session
+	mux     *http.ServeMux
+}
+
+// NewServer creates a server for s
+func NewServer(s *session.Session) *Server {
+	srv := &Server{session: s, mux: http.NewServeMux()}
+
+	ui, _ := fs.Sub(static, "static")
+	srv.mux.Handle("GET /", http.FileServer(http.FS(ui)))
+
+	srv.mux.HandleFunc("GET /api/torrents", srv.list)
+	srv.mux.HandleFunc("GET /api/torrents/{infoHash}", srv.get)
+	srv.mux.HandleFunc("GET /api/torrents/{infoHash}/history", srv.torrentHistory)
+	srv.mux.HandleFunc("DELETE /api/torrents/{infoHash}", srv.remove)
+	srv.mux.HandleFunc("POST /api/torrents/{infoHash}/{action}", srv.action)
+	srv.mux.HandleFunc("PUT /api/torrents/{infoHash}/files/{index}", srv.setFilePriority)
+	srv.mux.HandleFunc("PUT /api/torrents/{infoHash}/label", srv.setLabel)
+	srv.mux.HandleFunc("GET /api/history", srv.history)
+	srv.mux.HandleFunc("GET /api/altspeed", srv.altSpeed)
+	srv.mux.HandleFunc("PUT /api/altspeed", srv.setAltSpeed)
+	srv.mux.HandleFunc("GET /api/labels", srv.labels)
+	srv.mux.HandleFunc("PUT /api/labels/{name}", srv.putLabel)
+	srv.mux.HandleFunc("DELETE /api/labels/{name}", srv.removeLabel)
+	return srv
+}
+
+// ServeHTTP dispatches a request to the API or the UI
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+func (srv *Server) list(w http.ResponseWriter, r *http.Request) {
+	handles := srv.session.Torrents()
+	statuses := make([]session.Status, 0, len(handles))
+	for _, h := range handles {
+		statuses = append(statuses, h.Status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (srv *Server) get(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+
+	infos := h.Peers()
+	peers := make([]Peer, 0, len(infos))
+	for _, info := range infos {
+		peers = append(peers, newPeer(info))
+	}
+	writeJSON(w, http.StatusOK, Torrent{Status: h.Status(), Peers: peers, Files: h.Files()})
+}
+
+// history returns the session's recent rates for graphs
+func (srv *Server) history(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, srv.session.SpeedHistory())
+}
+
+// torrentHistory returns a torrent's recent rates for graphs
+func (srv *Server) torrentHistory(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.SpeedHistory())
+}
+
+func (srv *Server) remove(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+	if err := srv.session.Remove(h.InfoHash()); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// action runs start, stop, pause or resume on a torrent
+func (srv *Server) action(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	switch r.PathValue("action") {
+	case "start":
+		err = h.Start()
+	case "stop":
+		h.Stop()
+	case "pause":
+		err = h.Pause()
+	case "resume":
+		err = h.Resume()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Status())
+}
+
+// priorityRequest is the body of a file priority change
+type priorityRequest struct {
+	Priority piece.Priority `json:"priority"`
+}
+
+func (srv *Server) setFilePriority(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		http.Error(w, "invalid file index", http.StatusBadRequest)
+		return
+	}
+	var req priorityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.SetFilePriority(index, req.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Files())
+}
+
+// labelRequest is the body of a torrent's label change; an empty label
+// takes the torrent's label away
+type labelRequest struct {
+	Label string `json:"label"`
+}
+
+func (srv *Server) setLabel(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.handle(w, r)
+	if !ok {
+		return
+	}
+
+	var req labelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.SetLabel(req.Label); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Status())
+}
+
+// AltSpeed is whether the session's alternate rate limits are in force
+type AltSpeed struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (srv *Server) altSpeed(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, AltSpeed{srv.session.AltSpeed()})
+}
+
+func (srv *Server) setAltSpeed(w http.ResponseWriter, r *http.Request) {
+	var req AltSpeed
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	srv.session.SetAltSpeed(req.Enabled)
+	writeJSON(w, http.StatusOK, AltSpeed{srv.session.AltSpeed()})
+}
+
+func (srv *Server) labels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, srv.session.Labels())
+}
+
+// putLabel creates or replaces the label named in the path
+func (srv *Server) putLabel(w http.ResponseWriter, r *http.Request) {
+	var l session.Label
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	l.Name = r.PathValue("name")
+	if err := srv.session.SetLabel(l); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+func (srv *Server) removeLabel(w http.ResponseWriter, r *http.Request) {
+	if err := srv.session.RemoveLabel(r.PathValue("name")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handle finds the torrent named in the path, writing an error response
+// if there is none
+func (srv *Server) handle(w http.ResponseWriter, r *http.Request) (*session.Handle, bool) {
+	var infoHash [20]byte
+	b, err := hex.DecodeString(r.PathValue("infoHash"))
+	if err != nil || len(b) != len(infoHash) {
+		http.Error(w, "invalid info hash", http.StatusBadRequest)
+		return nil, false
+	}
+	copy(infoHash[:], b)
+
+	h, err := srv.session.Get(infoHash)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return h, true
+}
+
+// writeError responds with the status matching a session error
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, session.ErrTorrentNotFound), errors.Is(err, session.ErrLabelNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, session.ErrInvalidLabel):
+		status = http.StatusBadRequest
+	case errors.Is(err, session.ErrTorrentNotRunning):
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// writeJSON responds with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
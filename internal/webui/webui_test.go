@@ -0,0 +1,248 @@
+package webui
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mt/bittorrent-impl/internal/bencode"
+	"github.com/mt/bittorrent-impl/internal/piece"
+	"github.com/mt/bittorrent-impl/internal/session"
+	"github.com/mt/bittorrent-impl/internal/stats"
+	"github.com/mt/bittorrent-impl/internal/torrent"
+)
+
+// newTestServer returns a server for a session holding one torrent
+func newTestServer(t *testing.T) (*httptest.Server, *session.Handle) {
+	t.Helper()
+
+	config := session.DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	s, err := session.New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "webui.bin",
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("a", 20),
+			"length":       int64(1000),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode torrent: %v", err)
+	}
+	tor, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := s.Add(tor)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	server := httptest.NewServer(NewServer(s))
+	t.Cleanup(server.Close)
+	return server, h
+}
+
+// do sends a request and decodes a JSON response into v if it is not nil
+func do(t *testing.T, method, url, body string, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	server, h := newTestServer(t)
+	api := server.URL + "/api/torrents/"
+	hash := h.Torrent().InfoHashString()
+
+	var list []session.Status
+	if status := do(t, "GET", server.URL+"/api/torrents", "", &list); status != http.StatusOK {
+		t.Fatalf("GET /api/torrents = %d, want 200", status)
+	}
+	if len(list) != 1 || list[0].InfoHash != hash {
+		t.Errorf("torrent list = %+v, want %s", list, hash)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		state  string
+	}{
+		{"start", "POST", hash + "/start", "", http.StatusOK, "downloading"},
+		{"pause", "POST", hash + "/pause", "", http.StatusOK, "paused"},
+		{"resume", "POST", hash + "/resume", "", http.StatusOK, "downloading"},
+		{"stop", "POST", hash + "/stop", "", http.StatusOK, "stopped"},
+		{"pause stopped", "POST", hash + "/pause", "", http.StatusConflict, ""},
+		{"unknown action", "POST", hash + "/explode", "", http.StatusNotFound, ""},
+		{"bad hash", "GET", "xyz", "", http.StatusBadRequest, ""},
+		{"unknown torrent", "GET", strings.Repeat("00", 20), "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		var status session.Status
+		got := do(t, tt.method, api+tt.path, tt.body, &status)
+		if got != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.status)
+		}
+		if tt.state != "" && status.State != tt.state {
+			t.Errorf("%s: state = %s, want %s", tt.name, status.State, tt.state)
+		}
+	}
+
+	if status := do(t, "DELETE", api+hash, "", nil); status != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want %d", status, http.StatusNoContent)
+	}
+	if status := do(t, "GET", api+hash, "", nil); status != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestTorrentDetails(t *testing.T) {
+	server, h := newTestServer(t)
+	url := server.URL + "/api/torrents/" + h.Torrent().InfoHashString()
+
+	var files []session.File
+	if status := do(t, "PUT", url+"/files/0", `{"priority":"high"}`, &files); status != http.StatusOK {
+		t.Fatalf("PUT priority = %d, want 200", status)
+	}
+	if len(files) != 1 || files[0].Priority != piece.PriorityHigh {
+		t.Errorf("files = %+v, want one high priority file", files)
+	}
+
+	for _, body := range []string{`{"priority":"urgent"}`, `not json`} {
+		if status := do(t, "PUT", url+"/files/0", body, nil); status != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want %d", body, status, http.StatusBadRequest)
+		}
+	}
+	if status := do(t, "PUT", url+"/files/1", `{"priority":"skip"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("PUT missing file = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var details Torrent
+	if status := do(t, "GET", url, "", &details); status != http.StatusOK {
+		t.Fatalf("GET = %d, want 200", status)
+	}
+	if details.Name != "webui.bin" || len(details.Files) != 1 || details.Peers == nil {
+		t.Errorf("details = %+v, want webui.bin with one file and no peers", details)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	server, h := newTestServer(t)
+	labels := server.URL + "/api/labels/"
+	url := server.URL + "/api/torrents/" + h.Torrent().InfoHashString() + "/label"
+
+	var label session.Label
+	if status := do(t, "PUT", labels+"tv", `{"uploadRateLimit":1024,"seedRatio":2}`, &label); status != http.StatusOK {
+		t.Fatalf("PUT label = %d, want 200", status)
+	}
+	if label.Name != "tv" || label.UploadRateLimit != 1024 || label.SeedRatio != 2 {
+		t.Errorf("label = %+v, want tv with its limits", label)
+	}
+	if status := do(t, "PUT", labels+"tv", `{"seedRatio":-1}`, nil); status != http.StatusBadRequest {
+		t.Errorf("PUT negative ratio = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var list []session.Label
+	if status := do(t, "GET", server.URL+"/api/labels", "", &list); status != http.StatusOK {
+		t.Fatalf("GET labels = %d, want 200", status)
+	}
+	if len(list) != 1 || list[0].Name != "tv" {
+		t.Errorf("labels = %+v, want tv", list)
+	}
+
+	var status session.Status
+	if got := do(t, "PUT", url, `{"label":"tv"}`, &status); got != http.StatusOK {
+		t.Fatalf("PUT torrent label = %d, want 200", got)
+	}
+	if status.Label != "tv" {
+		t.Errorf("torrent label = %q, want tv", status.Label)
+	}
+	if got := do(t, "PUT", url, `{"label":"news"}`, nil); got != http.StatusNotFound {
+		t.Errorf("PUT missing label = %d, want %d", got, http.StatusNotFound)
+	}
+
+	if got := do(t, "DELETE", labels+"tv", "", nil); got != http.StatusNoContent {
+		t.Errorf("DELETE label = %d, want %d", got, http.StatusNoContent)
+	}
+	if got := do(t, "DELETE", labels+"tv", "", nil); got != http.StatusNotFound {
+		t.Errorf("DELETE label again = %d, want %d", got, http.StatusNotFound)
+	}
+	if h.Label() != "" {
+		t.Errorf("torrent label after DELETE = %q, want none", h.Label())
+	}
+}
+
+func TestAltSpeed(t *testing.T) {
+	server, _ := newTestServer(t)
+	url := server.URL + "/api/altspeed"
+
+	var got AltSpeed
+	if status := do(t, "PUT", url, `{"enabled":true}`, &got); status != http.StatusOK {
+		t.Fatalf("PUT = %d, want 200", status)
+	}
+	if !got.Enabled {
+		t.Error("PUT enabled = false, want true")
+	}
+	got = AltSpeed{}
+	if status := do(t, "GET", url, "", &got); status != http.StatusOK || !got.Enabled {
+		t.Errorf("GET = %d %+v, want 200 enabled", status, got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	server, h := newTestServer(t)
+
+	for _, path := range []string{"/api/history", "/api/torrents/" + h.Torrent().InfoHashString() + "/history"} {
+		var got []stats.Point
+		if status := do(t, "GET", server.URL+path, "", &got); status != http.StatusOK || got == nil {
+			t.Errorf("GET %s = %d %v, want 200 with an array", path, status, got)
+		}
+	}
+	if status := do(t, "GET", server.URL+"/api/torrents/"+strings.Repeat("ab", 20)+"/history", "", nil); status != http.StatusNotFound {
+		t.Errorf("GET history of unknown torrent = %d, want 404", status)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET / failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET / = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+}